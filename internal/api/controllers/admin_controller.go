@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDisconnectReason is sent when the admin gives no reason
+const defaultDisconnectReason = "disconnected by an administrator"
+
+type AdminController struct{}
+
+// DisconnectUser forcibly closes all of a user's WebSocket connections
+// @Summary Disconnect a user
+// @Description Closes every WebSocket connection of the user, on all instances,
+// @Description with a close frame carrying the reason. The user may reconnect.
+// @Tags Admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param request body services.DisconnectUserRequest false "Reason"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/admin/users/:id/disconnect [post]
+func (ctrl *AdminController) DisconnectUser(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req services.DisconnectUserRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.Error(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = defaultDisconnectReason
+	}
+
+	if _, err := services.User.GetUserByID(c.Request.Context(), uint(userID)); err != nil {
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodeUserNotFound, "User not found")
+		return
+	}
+
+	adminID, _ := middlewares.GetUserID(c)
+	logrus.Infof("Admin %d disconnects user %d: %s", adminID, userID, req.Reason)
+
+	Hub.DisconnectUser(uint(userID), req.Reason)
+	response.OkWithMessage(c, "User disconnected")
+}
+
+// Broadcast sends a system message to the connected users
+// @Summary Broadcast a system message
+// @Description Sends a system_message event to every connected user, or only to
+// @Description the members of group_id. It is not stored and offline users miss it.
+// @Tags Admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.SystemMessageRequest true "Message"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/admin/broadcast [post]
+func (ctrl *AdminController) Broadcast(c *gin.Context) {
+	var req services.SystemMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminID, _ := middlewares.GetUserID(c)
+
+	message, err := services.Admin.BroadcastSystemMessage(c.Request.Context(), adminID, req)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, message)
+}
+
+// GetReports lists message reports for triage
+// @Summary List message reports
+// @Description Newest first, each with the reported message as stored.
+// @Tags Admin
+// @Security BearerAuth
+// @Produce json
+// @Param status query string false "open, resolved or dismissed"
+// @Param limit query int false "Limit (max 100)" default(50)
+// @Param offset query int false "Offset" default(0)
+// @Success 200 {object} map[string]interface{}
+// @Router /api/admin/reports [get]
+func (ctrl *AdminController) GetReports(c *gin.Context) {
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	status := models.ReportStatus(c.Query("status"))
+	switch status {
+	case "", models.ReportStatusOpen, models.ReportStatusResolved, models.ReportStatusDismissed:
+	default:
+		response.Error(c, http.StatusBadRequest, "Invalid report status")
+		return
+	}
+
+	reports, total, err := services.Admin.ListReports(c.Request.Context(), status, limit, offset)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"reports": reports,
+		"count":   len(reports),
+		"total":   total,
+	})
+}
+
+// ReviewReport sets the triage status of a message report
+// @Summary Review a message report
+// @Tags Admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Report ID"
+// @Param request body services.ReviewReportRequest true "Status"
+// @Success 200 {object} models.MessageReport
+// @Router /api/admin/reports/:id [put]
+func (ctrl *AdminController) ReviewReport(c *gin.Context) {
+	reportID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid report ID")
+		return
+	}
+
+	var req services.ReviewReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminID, _ := middlewares.GetUserID(c)
+
+	report, err := services.Admin.ReviewReport(c.Request.Context(), adminID, uint(reportID), req)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, report)
+}
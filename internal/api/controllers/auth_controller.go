@@ -1,11 +1,16 @@
 package controllers
 
 import (
+	"fmt"
+	"mime"
 	"net/http"
 
+	"web-api/internal/api/middlewares"
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 type AuthController struct{}
@@ -21,17 +26,17 @@ type AuthController struct{}
 func (ctrl *AuthController) Register(c *gin.Context) {
 	var req services.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	response, err := services.User.Register(req)
+	auth, err := services.User.Register(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, response)
+	response.Created(c, auth)
 }
 
 // Login handles user login
@@ -45,17 +50,151 @@ func (ctrl *AuthController) Register(c *gin.Context) {
 func (ctrl *AuthController) Login(c *gin.Context) {
 	var req services.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	response, err := services.User.Login(req)
+	auth, err := services.User.Login(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		respondError(c, http.StatusUnauthorized, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	response.OkWithData(c, auth)
+}
+
+// DeleteAccount deletes the current user's account
+// @Summary Delete account
+// @Description Requires the password. Deletes the user's messages, uploads and memberships, hands owned groups over to another member and signs out every session.
+// @Tags Auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.DeleteAccountRequest true "Password confirmation"
+// @Success 200
+// @Router /api/profile [delete]
+func (ctrl *AuthController) DeleteAccount(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.User.DeleteAccount(c.Request.Context(), userID, req.Password); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	Hub.DisconnectUser(userID, "account deleted")
+
+	response.OkWithMessage(c, "Account deleted")
+}
+
+// Refresh issues a new token pair from a refresh token
+// @Summary Refresh access token
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body services.RefreshRequest true "Refresh request"
+// @Success 200 {object} services.AuthResponse
+// @Router /api/refresh [post]
+func (ctrl *AuthController) Refresh(c *gin.Context) {
+	var req services.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	auth, err := services.User.Refresh(c.Request.Context(), req.RefreshToken)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, err)
+		return
+	}
+
+	response.OkWithData(c, auth)
+}
+
+// ForgotPassword emails a password reset link
+// @Summary Request password reset
+// @Description Always answers with the same message, whether or not an
+// @Description account uses the email
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body services.ForgotPasswordRequest true "Email"
+// @Success 200 {object} map[string]string
+// @Router /api/forgot-password [post]
+func (ctrl *AuthController) ForgotPassword(c *gin.Context) {
+	var req services.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.User.ForgotPassword(c.Request.Context(), req.Email); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithMessage(c, "If an account uses this email, a reset link has been sent to it")
+}
+
+// ResetPassword sets a new password with a reset token
+// @Summary Reset password
+// @Description Signs out every session of the user
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body services.ResetPasswordRequest true "Reset request"
+// @Success 200 {object} map[string]string
+// @Router /api/reset-password [post]
+func (ctrl *AuthController) ResetPassword(c *gin.Context) {
+	var req services.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.User.ResetPassword(c.Request.Context(), req.Token, req.NewPassword); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Password has been reset")
+}
+
+// Logout revokes the current access token and the given refresh token
+// @Summary Logout user
+// @Tags Auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.LogoutRequest false "Logout request"
+// @Success 200 {object} map[string]string
+// @Router /api/logout [post]
+func (ctrl *AuthController) Logout(c *gin.Context) {
+	claims, ok := middlewares.GetClaims(c)
+	if !ok {
+		response.Error(c, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req services.LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.Error(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if err := services.User.Logout(c.Request.Context(), claims, req.RefreshToken); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Logged out successfully")
 }
 
 // GetProfile returns current user's profile
@@ -68,15 +207,154 @@ func (ctrl *AuthController) Login(c *gin.Context) {
 func (ctrl *AuthController) GetProfile(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		response.Error(c, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := services.User.GetUserByID(c.Request.Context(), userID.(uint))
+	if err != nil {
+		response.Error(c, http.StatusNotFound, "User not found")
+		return
+	}
+
+	response.OkWithData(c, user.ToResponse())
+}
+
+// ExportPersonalData downloads everything stored about the current user
+// @Summary Export personal data
+// @Description Streams one JSON document with the profile, groups, uploaded files, calls and sent messages of the user.
+// @Tags Auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} services.PersonalDataExport
+// @Router /api/profile/export [get]
+func (ctrl *AuthController) ExportPersonalData(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	export, err := services.Export.ExportPersonalData(c.Request.Context(), userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	filename := fmt.Sprintf("personal-data-%d.json", userID)
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	// The status is already sent, so a failure can only cut the body short
+	if err := export.Write(c.Writer); err != nil {
+		logrus.Errorf("Failed to export personal data of user %d: %v", userID, err)
+	}
+}
+
+// UpdateProfile updates current user's profile
+// @Summary Update current user profile
+// @Tags Auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.UpdateProfileRequest true "Profile update"
+// @Success 200 {object} models.UserResponse
+// @Router /api/profile [put]
+func (ctrl *AuthController) UpdateProfile(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := services.User.UpdateProfile(c.Request.Context(), userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, user.ToResponse())
+}
+
+// UploadAvatar sets the current user's avatar from an uploaded image
+// @Summary Upload profile avatar
+// @Description The image must be a JPEG, PNG or GIF; it is scaled down and
+// @Description stored as PNG. A previously uploaded avatar is deleted.
+// @Tags Auth
+// @Security BearerAuth
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "Image"
+// @Success 200 {object} models.UserResponse
+// @Router /api/profile/avatar [post]
+func (ctrl *AuthController) UploadAvatar(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "No file uploaded")
+		return
+	}
+
+	user, err := services.User.SetAvatar(c.Request.Context(), userID, file)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, user.ToResponse())
+}
+
+// UpdateStatus sets current user's presence status
+// @Summary Update presence status
+// @Description Invisible users appear offline to others
+// @Tags Auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.UpdateStatusRequest true "Presence status"
+// @Success 200
+// @Router /api/profile/status [put]
+func (ctrl *AuthController) UpdateStatus(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.UpdateStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.User.SetPresenceStatus(c.Request.Context(), userID, req.Status); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{"status": req.Status})
+}
+
+// ChangePassword changes current user's password
+// @Summary Change password
+// @Description Revokes all existing tokens and returns a new token pair
+// @Tags Auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.ChangePasswordRequest true "Password change"
+// @Success 200 {object} services.AuthResponse
+// @Router /api/profile/password [post]
+func (ctrl *AuthController) ChangePassword(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	user, err := services.User.GetUserByID(userID.(uint))
+	auth, err := services.User.ChangePassword(c.Request.Context(), userID, req.OldPassword, req.NewPassword)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, user.ToResponse())
+	response.OkWithData(c, auth)
 }
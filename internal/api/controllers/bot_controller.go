@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BotController struct{}
+
+// CreateBotToken mints a bot token for the current user. The response is
+// the only time the token is shown.
+// @Summary Create bot token
+// @Tags Bots
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.CreateBotTokenRequest true "Bot token"
+// @Success 201 {object} map[string]interface{}
+// @Router /api/bot-tokens [post]
+func (ctrl *BotController) CreateBotToken(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.CreateBotTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	botToken, token, err := services.Bot.CreateBotToken(userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, gin.H{
+		"bot_token": botToken,
+		"token":     token,
+	})
+}
+
+// GetBotTokens lists the current user's bot tokens
+// @Summary List bot tokens
+// @Tags Bots
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} models.BotToken
+// @Router /api/bot-tokens [get]
+func (ctrl *BotController) GetBotTokens(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	tokens, err := services.Bot.GetBotTokens(userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"bot_tokens": tokens,
+		"count":      len(tokens),
+	})
+}
+
+// RevokeBotToken revokes one of the current user's bot tokens
+// @Summary Revoke bot token
+// @Tags Bots
+// @Security BearerAuth
+// @Param id path int true "Bot token ID"
+// @Success 200
+// @Router /api/bot-tokens/:id [delete]
+func (ctrl *BotController) RevokeBotToken(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	tokenID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid bot token ID")
+		return
+	}
+
+	if err := services.Bot.RevokeBotToken(userID, uint(tokenID)); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Bot token revoked")
+}
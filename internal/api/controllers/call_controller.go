@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CallController struct{}
+
+// InitiateCall starts a new call
+// @Summary Initiate a call
+// @Tags Calls
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.InitiateCallRequest true "Call request"
+// @Success 201 {object} models.VideoCall
+// @Router /api/calls [post]
+func (ctrl *CallController) InitiateCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.InitiateCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	call, err := services.Call.InitiateCall(userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, call)
+}
+
+// GetCallHistory retrieves the current user's calls
+// @Summary Get call history
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Limit" default(50)
+// @Param offset query int false "Offset" default(0)
+// @Success 200 {array} models.VideoCall
+// @Router /api/calls/history [get]
+func (ctrl *CallController) GetCallHistory(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	calls, err := services.Call.GetCallHistory(userID, limit, offset)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"calls": calls,
+		"count": len(calls),
+	})
+}
+
+// GetCall retrieves a call by ID
+// @Summary Get call by ID
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {object} models.VideoCall
+// @Router /api/calls/:id [get]
+func (ctrl *CallController) GetCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	call, err := services.Call.GetCall(uint(callID), userID)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithData(c, call)
+}
+
+// AcceptCall answers a ringing call
+// @Summary Accept a call
+// @Tags Calls
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Call ID"
+// @Param request body services.AnswerCallRequest true "Answer request"
+// @Success 200 {object} models.VideoCall
+// @Router /api/calls/:id/accept [post]
+func (ctrl *CallController) AcceptCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	var req services.AnswerCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	call, err := services.Call.AcceptCall(uint(callID), userID, req.AnswerSDP)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, call)
+}
+
+// RejectCall declines a ringing call
+// @Summary Reject a call
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {object} models.VideoCall
+// @Router /api/calls/:id/reject [post]
+func (ctrl *CallController) RejectCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	call, err := services.Call.RejectCall(uint(callID), userID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, call)
+}
+
+// EndCall hangs up a call
+// @Summary End a call
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {object} models.VideoCall
+// @Router /api/calls/:id/end [post]
+func (ctrl *CallController) EndCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	call, err := services.Call.EndCall(uint(callID), userID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, call)
+}
+
+// JoinCall joins an ongoing group call
+// @Summary Join a group call
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {object} models.CallParticipant
+// @Router /api/calls/:id/join [post]
+func (ctrl *CallController) JoinCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	participant, err := services.Call.JoinCall(uint(callID), userID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, participant)
+}
+
+// LeaveCall leaves a group call
+// @Summary Leave a group call
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {object} map[string]string
+// @Router /api/calls/:id/leave [post]
+func (ctrl *CallController) LeaveCall(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	if err := services.Call.LeaveCall(uint(callID), userID); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Left call")
+}
+
+// GetCallParticipants lists the participants of a call
+// @Summary Get call participants
+// @Tags Calls
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Call ID"
+// @Success 200 {array} models.CallParticipant
+// @Router /api/calls/:id/participants [get]
+func (ctrl *CallController) GetCallParticipants(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid call ID")
+		return
+	}
+
+	participants, err := services.Call.GetParticipants(uint(callID), userID)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithData(c, participants)
+}
@@ -1,13 +1,22 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"web-api/internal/api/middlewares"
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/models/response"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 type ChatController struct{}
@@ -26,17 +35,22 @@ func (ctrl *ChatController) SendPrivateMessage(c *gin.Context) {
 
 	var req services.SendPrivateMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	message, err := services.Chat.SendPrivateMessage(userID, req)
+	if !middlewares.BotScopeAllows(c, 0) {
+		response.Error(c, http.StatusForbidden, "This token is limited to groups")
+		return
+	}
+
+	message, err := services.Chat.SendPrivateMessage(c.Request.Context(), userID, req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, message)
+	response.Created(c, message)
 }
 
 // GetPrivateMessages retrieves private messages with a user
@@ -54,7 +68,7 @@ func (ctrl *ChatController) GetPrivateMessages(c *gin.Context) {
 
 	otherUserID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
 
@@ -72,13 +86,13 @@ func (ctrl *ChatController) GetPrivateMessages(c *gin.Context) {
 		}
 	}
 
-	messages, err := services.Chat.GetPrivateMessages(userID, uint(otherUserID), limit, offset)
+	messages, err := services.Chat.GetPrivateMessages(c.Request.Context(), userID, uint(otherUserID), limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response.OkWithData(c, gin.H{
 		"messages": messages,
 		"count":    len(messages),
 	})
@@ -98,17 +112,67 @@ func (ctrl *ChatController) SendGroupMessage(c *gin.Context) {
 
 	var req services.SendGroupMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !middlewares.BotScopeAllows(c, req.GroupID) {
+		response.Error(c, http.StatusForbidden, "This token cannot access this group")
+		return
+	}
+
+	message, err := services.Chat.SendGroupMessage(c.Request.Context(), userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, message)
+}
+
+// SendBatch sends several private and group messages in one request
+// @Summary Send messages in a batch
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.BatchSendRequest true "Messages, at most 20 or the flood limit if lower"
+// @Success 200 {array} models.BatchSendResult
+// @Router /api/messages/batch [post]
+func (ctrl *ChatController) SendBatch(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.BatchSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	message, err := services.Chat.SendGroupMessage(userID, req)
+	outcomes, err := services.Chat.SendBatch(c.Request.Context(), userID, req.Messages, func(groupID uint) bool {
+		return middlewares.BotScopeAllows(c, groupID)
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, message)
+	results := make([]models.BatchSendResult, len(outcomes))
+	sent := 0
+	for i, outcome := range outcomes {
+		if outcome.Err != nil {
+			status, code, message := describeError(c, http.StatusBadRequest, outcome.Err)
+			results[i] = models.BatchSendResult{Status: status, Error: code, Detail: message}
+			continue
+		}
+		results[i] = models.BatchSendResult{Status: http.StatusCreated, Message: outcome.Message}
+		sent++
+	}
+
+	response.OkWithData(c, gin.H{
+		"results": results,
+		"sent":    sent,
+		"failed":  len(results) - sent,
+	})
 }
 
 // GetGroupMessages retrieves messages from a group
@@ -126,7 +190,12 @@ func (ctrl *ChatController) GetGroupMessages(c *gin.Context) {
 
 	groupID, err := strconv.ParseUint(c.Param("groupID"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	if !middlewares.BotScopeAllows(c, uint(groupID)) {
+		response.Error(c, http.StatusForbidden, "This token cannot access this group")
 		return
 	}
 
@@ -144,35 +213,256 @@ func (ctrl *ChatController) GetGroupMessages(c *gin.Context) {
 		}
 	}
 
-	messages, err := services.Chat.GetGroupMessages(userID, uint(groupID), limit, offset)
+	messages, err := services.Chat.GetGroupMessages(c.Request.Context(), userID, uint(groupID), limit, offset)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response.OkWithData(c, gin.H{
 		"messages": messages,
 		"count":    len(messages),
 	})
 }
 
+// GetMessageSeenBy lists who read a group message
+// @Summary Get group message readers
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Success 200 {array} services.MessageReader
+// @Router /api/messages/group/:messageID/seen-by [get]
+func (ctrl *ChatController) GetMessageSeenBy(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	// gin makes the route share its wildcard name with GET
+	// /messages/group/:groupID; here it holds the message ID
+	messageID, err := strconv.ParseUint(c.Param("groupID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	readers, err := services.Chat.GetMessageSeenBy(c.Request.Context(), userID, uint(messageID))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"seen_by": readers,
+		"count":   len(readers),
+	})
+}
+
+// EditPrivateMessage edits a private message
+// @Summary Edit private message
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param request body services.EditMessageRequest true "Edit request"
+// @Success 200 {object} models.PrivateMessage
+// @Router /api/messages/private/:messageID [put]
+func (ctrl *ChatController) EditPrivateMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req services.EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message, err := services.Chat.EditPrivateMessage(c.Request.Context(), userID, uint(messageID), req.Content)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, message)
+}
+
+// EditGroupMessage edits a group message
+// @Summary Edit group message
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param request body services.EditMessageRequest true "Edit request"
+// @Success 200 {object} models.GroupMessage
+// @Router /api/messages/group/:messageID [put]
+func (ctrl *ChatController) EditGroupMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req services.EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message, err := services.Chat.EditGroupMessage(c.Request.Context(), userID, uint(messageID), req.Content)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, message)
+}
+
+// DeletePrivateMessage deletes a private message
+// @Summary Delete private message
+// @Tags Chat
+// @Security BearerAuth
+// @Param messageID path int true "Message ID"
+// @Param forEveryone query bool false "Delete for both participants"
+// @Success 200
+// @Router /api/messages/private/:messageID [delete]
+func (ctrl *ChatController) DeletePrivateMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	forEveryone := c.Query("forEveryone") == "true"
+
+	if err := services.Chat.DeletePrivateMessage(c.Request.Context(), userID, uint(messageID), forEveryone); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Message deleted successfully")
+}
+
+// DeleteGroupMessage deletes a group message
+// @Summary Delete group message
+// @Tags Chat
+// @Security BearerAuth
+// @Param messageID path int true "Message ID"
+// @Param forEveryone query bool false "Delete for all members"
+// @Success 200
+// @Router /api/messages/group/:messageID [delete]
+func (ctrl *ChatController) DeleteGroupMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	forEveryone := c.Query("forEveryone") == "true"
+
+	if err := services.Chat.DeleteGroupMessage(c.Request.Context(), userID, uint(messageID), forEveryone); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Message deleted successfully")
+}
+
+// AddReaction adds an emoji reaction to a message
+// @Summary Add reaction
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param request body services.ReactionRequest true "Reaction request"
+// @Success 201 {object} models.MessageReaction
+// @Router /api/messages/:messageID/reactions [post]
+func (ctrl *ChatController) AddReaction(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req services.ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chatType := req.MessageType
+	if chatType == "" {
+		chatType = models.ChatTypePrivate
+	}
+
+	reaction, err := services.Chat.AddReaction(c.Request.Context(), userID, uint(messageID), chatType, req.Emoji)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, reaction)
+}
+
+// RemoveReaction removes an emoji reaction from a message
+// @Summary Remove reaction
+// @Tags Chat
+// @Security BearerAuth
+// @Param messageID path int true "Message ID"
+// @Param emoji path string true "Emoji"
+// @Param message_type query string false "private or group" default(private)
+// @Success 200
+// @Router /api/messages/:messageID/reactions/:emoji [delete]
+func (ctrl *ChatController) RemoveReaction(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	chatType := models.ChatType(c.DefaultQuery("message_type", string(models.ChatTypePrivate)))
+
+	if err := services.Chat.RemoveReaction(c.Request.Context(), userID, uint(messageID), chatType, c.Param("emoji")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Reaction removed successfully")
+}
+
 // GetConversations returns user's conversations
 // @Summary Get conversations
 // @Tags Chat
 // @Security BearerAuth
 // @Produce json
+// @Param include_archived query bool false "Also list archived conversations"
 // @Success 200 {array} map[string]interface{}
 // @Router /api/conversations [get]
 func (ctrl *ChatController) GetConversations(c *gin.Context) {
 	userID, _ := middlewares.GetUserID(c)
 
-	conversations, err := services.Chat.GetConversations(userID)
+	conversations, err := services.Chat.GetConversations(c.Request.Context(), userID, c.Query("include_archived") == "true")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
+	response.OkWithData(c, gin.H{"conversations": conversations})
 }
 
 // MarkMessageAsRead marks a message as read
@@ -187,16 +477,46 @@ func (ctrl *ChatController) MarkMessageAsRead(c *gin.Context) {
 
 	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	if err := services.Chat.MarkMessageAsRead(c.Request.Context(), uint(messageID), userID); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Message marked as read")
+}
+
+// MarkMessagesAsRead marks several private messages as read at once
+// @Summary Mark messages as read
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.MarkMessagesReadRequest true "Message IDs"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/messages/read [post]
+func (ctrl *ChatController) MarkMessagesAsRead(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.MarkMessagesReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if err := services.Chat.MarkMessageAsRead(uint(messageID), userID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	marked, err := services.Chat.MarkMessagesAsRead(c.Request.Context(), userID, req.MessageIDs)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message marked as read"})
+	response.OkWithData(c, gin.H{
+		"message_ids": marked,
+		"count":       len(marked),
+	})
 }
 
 // GetUnreadCount returns unread message count
@@ -209,11 +529,634 @@ func (ctrl *ChatController) MarkMessageAsRead(c *gin.Context) {
 func (ctrl *ChatController) GetUnreadCount(c *gin.Context) {
 	userID, _ := middlewares.GetUserID(c)
 
-	count, err := services.Chat.GetUnreadMessageCount(userID)
+	count, err := services.Chat.GetUnreadMessageCount(c.Request.Context(), userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{"count": count})
+}
+
+// GetUnreadCountsByConversation returns unread message counts per conversation
+// @Summary Get unread counts by conversation
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/messages/unread/by-conversation [get]
+func (ctrl *ChatController) GetUnreadCountsByConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	counts, err := services.Chat.GetUnreadCounts(c.Request.Context(), userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+
+	response.OkWithData(c, gin.H{
+		"counts": counts,
+		"total":  total,
+	})
+}
+
+// MarkConversationAsRead marks all messages in a conversation as read
+// @Summary Mark conversation as read
+// @Tags Chat
+// @Security BearerAuth
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200
+// @Router /api/conversations/:conversationID/read [post]
+func (ctrl *ChatController) MarkConversationAsRead(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	if err := services.Chat.MarkConversationAsRead(c.Request.Context(), userID, c.Param("conversationID")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Conversation marked as read")
+}
+
+// SyncConversation returns the messages of a conversation after a sequence
+// number, for clients catching up on what they missed
+// @Summary Sync missed messages
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Param since_seq query int false "Last seq the client has" default(0)
+// @Param limit query int false "Page size, at most 500" default(100)
+// @Success 200 {object} models.ConversationSync
+// @Router /api/conversations/:conversationID/sync [get]
+func (ctrl *ChatController) SyncConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var sinceSeq int64
+	if v := c.Query("since_seq"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed < 0 {
+			response.Error(c, http.StatusBadRequest, "since_seq must be a non-negative integer")
+			return
+		}
+		sinceSeq = parsed
+	}
+
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+
+	result, err := services.Chat.SyncConversation(c.Request.Context(), userID, c.Param("conversationID"), sinceSeq, limit)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, result)
+}
+
+// MuteConversation mutes a conversation's notifications
+// @Summary Mute conversation
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Param request body services.MuteConversationRequest false "Mute duration"
+// @Success 200 {object} models.ConversationMute
+// @Router /api/conversations/:conversationID/mute [post]
+func (ctrl *ChatController) MuteConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	// The body is optional; without it the mute lasts until lifted
+	var req services.MuteConversationRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.Error(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	mute, err := services.Chat.MuteConversation(c.Request.Context(), userID, c.Param("conversationID"), time.Duration(req.Duration)*time.Second)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, mute)
+}
+
+// UnmuteConversation lifts a conversation mute
+// @Summary Unmute conversation
+// @Tags Chat
+// @Security BearerAuth
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200
+// @Router /api/conversations/:conversationID/mute [delete]
+func (ctrl *ChatController) UnmuteConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	if err := services.Chat.UnmuteConversation(c.Request.Context(), userID, c.Param("conversationID")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"count": count})
+	response.OkWithMessage(c, "Conversation unmuted")
+}
+
+// ArchiveConversation hides a conversation from the conversation list
+// @Summary Archive conversation
+// @Description The conversation comes back when unarchived or when a new message arrives in it.
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200 {object} models.ConversationArchive
+// @Router /api/conversations/:conversationID/archive [post]
+func (ctrl *ChatController) ArchiveConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	archive, err := services.Chat.ArchiveConversation(c.Request.Context(), userID, c.Param("conversationID"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, archive)
+}
+
+// UnarchiveConversation brings an archived conversation back
+// @Summary Unarchive conversation
+// @Tags Chat
+// @Security BearerAuth
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200
+// @Router /api/conversations/:conversationID/archive [delete]
+func (ctrl *ChatController) UnarchiveConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	if err := services.Chat.UnarchiveConversation(c.Request.Context(), userID, c.Param("conversationID")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Conversation unarchived")
+}
+
+// SaveDraft stores the text being typed in a conversation
+// @Summary Save draft
+// @Description Empty content removes the draft. The user's other devices get a draft_updated event.
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Param request body services.SaveDraftRequest true "Draft"
+// @Success 200 {object} models.Draft
+// @Router /api/conversations/:conversationID/draft [put]
+func (ctrl *ChatController) SaveDraft(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.SaveDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	draft, err := services.Chat.SaveDraft(c.Request.Context(), userID, c.Param("conversationID"), req.Content)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if draft == nil {
+		response.OkWithMessage(c, "Draft removed")
+		return
+	}
+
+	response.OkWithData(c, draft)
+}
+
+// GetDraft returns the draft of a conversation
+// @Summary Get draft
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200 {object} models.Draft
+// @Router /api/conversations/:conversationID/draft [get]
+func (ctrl *ChatController) GetDraft(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	draft, err := services.Chat.GetDraft(c.Request.Context(), userID, c.Param("conversationID"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, draft)
+}
+
+// DeleteDraft removes the draft of a conversation
+// @Summary Delete draft
+// @Tags Chat
+// @Security BearerAuth
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Success 200
+// @Router /api/conversations/:conversationID/draft [delete]
+func (ctrl *ChatController) DeleteDraft(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	if err := services.Chat.DeleteDraft(c.Request.Context(), userID, c.Param("conversationID")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Draft removed")
+}
+
+// GetTypingUsers lists who is typing in a group conversation
+// @Summary Get typing users
+// @Description Only group conversations are supported. Users drop out of the list 10 seconds after their last typing event.
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param conversationID path string true "Conversation ID (group:<groupID>)"
+// @Success 200 {array} models.TypingUser
+// @Router /api/conversations/:conversationID/typing [get]
+func (ctrl *ChatController) GetTypingUsers(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	users, err := services.Chat.GetTypingUsers(c.Request.Context(), userID, c.Param("conversationID"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, users)
+}
+
+// ExportConversation downloads the full history of a conversation
+// @Summary Export conversation history
+// @Description Streams every message of the conversation, oldest first, with sender, time, type and attachment URLs.
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json,text/csv
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {array} models.ExportedMessage
+// @Router /api/conversations/:conversationID/export [get]
+func (ctrl *ChatController) ExportConversation(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	format := c.DefaultQuery("format", services.ExportFormatJSON)
+	if !services.ValidExportFormat(format) {
+		response.Error(c, http.StatusBadRequest, "Invalid format, expected json or csv")
+		return
+	}
+
+	export, err := services.Export.ExportConversation(c.Request.Context(), userID, c.Param("conversationID"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	defer export.Close()
+
+	contentType := "application/json"
+	if format == services.ExportFormatCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	filename := fmt.Sprintf("%s.%s", strings.ReplaceAll(export.ConversationID, ":", "-"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	// The status is already sent, so a failure can only cut the body short
+	if err := export.Write(c.Writer, format); err != nil {
+		logrus.Errorf("Failed to export conversation %s for user %d: %v", export.ConversationID, userID, err)
+	}
+}
+
+// SetDisappearing sets the disappearing message timer of a conversation
+// @Summary Set disappearing messages timer
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param conversationID path string true "Conversation ID (private:<userID> or group:<groupID>)"
+// @Param request body services.SetDisappearingRequest true "Timer in seconds, 0 turns it off"
+// @Success 200 {object} models.DisappearingSetting
+// @Router /api/conversations/:conversationID/disappearing [put]
+func (ctrl *ChatController) SetDisappearing(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.SetDisappearingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	setting, err := services.Chat.SetDisappearing(c.Request.Context(), userID, c.Param("conversationID"), time.Duration(req.DisappearAfter)*time.Second)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, setting)
+}
+
+// SearchMessages searches the user's messages
+// @Summary Search messages
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param q query string true "Search text"
+// @Param scope query string false "private, group or all" default(all)
+// @Param limit query int false "Limit" default(50)
+// @Param offset query int false "Offset" default(0)
+// @Success 200 {array} services.MessageSearchResult
+// @Router /api/messages/search [get]
+func (ctrl *ChatController) SearchMessages(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	results, err := services.Chat.SearchMessages(c.Request.Context(), userID, c.Query("q"), c.Query("scope"), limit, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"results": results,
+		"count":   len(results),
+	})
+}
+
+// GetMessageContext returns a message with the messages around it
+// @Summary Get message context
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param chat_type query string false "private or group; detected when omitted"
+// @Param before query int false "Older messages to include" default(20)
+// @Param after query int false "Newer messages to include" default(20)
+// @Success 200 {object} services.MessageContext
+// @Router /api/messages/:messageID/context [get]
+func (ctrl *ChatController) GetMessageContext(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	chatType := models.ChatType(c.Query("chat_type"))
+	if chatType != "" && chatType != models.ChatTypePrivate && chatType != models.ChatTypeGroup {
+		response.Error(c, http.StatusBadRequest, "chat_type must be private or group")
+		return
+	}
+
+	before := 20
+	after := 20
+
+	if b := c.Query("before"); b != "" {
+		if parsed, err := strconv.Atoi(b); err == nil && parsed >= 0 {
+			before = parsed
+		}
+	}
+	if a := c.Query("after"); a != "" {
+		if parsed, err := strconv.Atoi(a); err == nil && parsed >= 0 {
+			after = parsed
+		}
+	}
+
+	result, err := services.Chat.GetMessageContext(c.Request.Context(), userID, uint(messageID), chatType, before, after)
+	if err != nil {
+		// Messages the user cannot see are reported as missing
+		if errors.Is(err, errs.ErrMessageNotFound) || errors.Is(err, errs.ErrNotGroupMember) {
+			response.ErrorWithCode(c, http.StatusNotFound, response.CodeMessageNotFound, "Message not found")
+			return
+		}
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, result)
+}
+
+// GetLinkPreview returns the Open Graph preview of a URL
+// @Summary Preview a link
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param url query string true "Page URL"
+// @Success 200 {object} linkpreview.Preview
+// @Router /api/link-preview [post]
+func (ctrl *ChatController) GetLinkPreview(c *gin.Context) {
+	rawURL := c.Query("url")
+	if rawURL == "" {
+		response.Error(c, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	preview, err := services.LinkPreview.GetPreview(rawURL)
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	response.OkWithData(c, preview)
+}
+
+// GetMentions lists the group messages that mention the current user
+// @Summary Get mentions
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Limit" default(50)
+// @Param offset query int false "Offset" default(0)
+// @Success 200 {array} models.GroupMessage
+// @Router /api/messages/mentions [get]
+func (ctrl *ChatController) GetMentions(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	messages, err := services.Chat.GetMentions(c.Request.Context(), userID, limit, offset)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"messages": messages,
+		"count":    len(messages),
+	})
+}
+
+// StarMessage saves a message to the current user's starred messages
+// @Summary Star message
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param message_type query string false "private or group" default(private)
+// @Success 201 {object} models.StarredMessage
+// @Router /api/messages/:messageID/star [post]
+func (ctrl *ChatController) StarMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	chatType := models.ChatType(c.DefaultQuery("message_type", string(models.ChatTypePrivate)))
+
+	star, err := services.Chat.StarMessage(c.Request.Context(), userID, uint(messageID), chatType)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, star)
+}
+
+// UnstarMessage removes a message from the current user's starred messages
+// @Summary Unstar message
+// @Tags Chat
+// @Security BearerAuth
+// @Param messageID path int true "Message ID"
+// @Param message_type query string false "private or group" default(private)
+// @Success 200
+// @Router /api/messages/:messageID/star [delete]
+func (ctrl *ChatController) UnstarMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	chatType := models.ChatType(c.DefaultQuery("message_type", string(models.ChatTypePrivate)))
+
+	if err := services.Chat.UnstarMessage(c.Request.Context(), userID, uint(messageID), chatType); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Message unstarred")
+}
+
+// ReportMessage reports a message to the site admins
+// @Summary Report message
+// @Description The reporter must be able to see the message and can report it once.
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param messageID path int true "Message ID"
+// @Param message_type query string false "private or group" default(private)
+// @Param request body services.ReportMessageRequest true "Reason"
+// @Success 201 {object} models.MessageReport
+// @Router /api/messages/:messageID/report [post]
+func (ctrl *ChatController) ReportMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req services.ReportMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chatType := models.ChatType(c.DefaultQuery("message_type", string(models.ChatTypePrivate)))
+
+	report, err := services.Chat.ReportMessage(c.Request.Context(), userID, uint(messageID), chatType, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, report)
+}
+
+// GetStarredMessages lists the current user's starred messages
+// @Summary Get starred messages
+// @Description Most recently starred first. Messages the user can no longer see are left out.
+// @Tags Chat
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Limit (max 100)" default(50)
+// @Param offset query int false "Offset" default(0)
+// @Success 200 {array} models.StarredMessage
+// @Router /api/messages/starred [get]
+func (ctrl *ChatController) GetStarredMessages(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	stars, err := services.Chat.ListStarred(c.Request.Context(), userID, limit, offset)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"starred": stars,
+		"count":   len(stars),
+	})
 }
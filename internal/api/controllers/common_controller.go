@@ -1,7 +1,11 @@
 package controllers
 
 import (
+	"context"
 	"net/http"
+	"time"
+
+	"web-api/internal/api/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,10 +14,50 @@ type CommonController struct{}
 
 var Common = &CommonController{}
 
-// Ping handles health check endpoint
+// healthTimeout bounds how long the readiness probe waits on dependencies
+const healthTimeout = 3 * time.Second
+
+// Ping is the liveness probe: it answers as long as the process serves HTTP
 func (c *CommonController) Ping(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{
 		"message": "pong",
 		"status":  "ok",
 	})
 }
+
+// Health is the readiness probe
+// @Summary Readiness check
+// @Description Pings the database and Redis and reports the hub's connection
+// @Description count. Responds 503, naming the failing dependencies, when one is down.
+// @Tags Common
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /api/health [get]
+func (c *CommonController) Health(ctx *gin.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx.Request.Context(), healthTimeout)
+	defer cancel()
+
+	checks, failing := services.Common.Health(probeCtx)
+
+	connections := 0
+	if Hub != nil {
+		connections = Hub.ConnectionCount()
+	}
+
+	if len(failing) > 0 {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":      "unavailable",
+			"failing":     failing,
+			"checks":      checks,
+			"connections": connections,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":      "ok",
+		"checks":      checks,
+		"connections": connections,
+	})
+}
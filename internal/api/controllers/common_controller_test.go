@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/testutil"
+)
+
+func TestHealthNamesTheFailingDependency(t *testing.T) {
+	testutil.Setup(t)
+	prev := services.Common
+	services.Common = &services.CommonService{}
+	t.Cleanup(func() { services.Common = prev })
+
+	var redisDown error
+	services.Common.UseHealthCheck("database", database.Ping)
+	services.Common.UseHealthCheck("redis", func(ctx context.Context) error { return redisDown })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/health", Common.Health)
+	router.GET("/ping", Common.Ping)
+	check := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode %s: %v", rec.Body, err)
+		}
+		return rec.Code, body
+	}
+
+	if status, body := check(); status != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("healthy: status %d, body %v", status, body)
+	}
+
+	redisDown = errors.New("dial tcp: connection refused")
+	status, body := check()
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("redis down: status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if !reflect.DeepEqual(body["failing"], []interface{}{"redis"}) {
+		t.Fatalf("failing %v, want [redis]", body["failing"])
+	}
+	checks := body["checks"].(map[string]interface{})
+	if checks["database"] != "ok" || checks["redis"] != redisDown.Error() {
+		t.Fatalf("checks %v, want database ok and the redis error", checks)
+	}
+
+	// Liveness does not depend on anything
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ping: status %d while redis is down", rec.Code)
+	}
+}
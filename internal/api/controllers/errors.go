@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/models/response"
+	"web-api/internal/pkg/webhook"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// serviceError is the HTTP status and error code a service error maps to
+type serviceError struct {
+	err    error
+	status int
+	code   string
+}
+
+// serviceErrors maps the errors services return to their status and code,
+// matching with errors.Is so wrapped errors map too. Errors missing from the
+// table answer with the status the handler picked.
+var serviceErrors = []serviceError{
+	{errs.ErrInvalidCredentials, http.StatusUnauthorized, response.CodeInvalidCredentials},
+	{errs.ErrInvalidRefreshToken, http.StatusUnauthorized, response.CodeInvalidRefreshToken},
+	{errs.ErrRefreshTokenRevoked, http.StatusUnauthorized, response.CodeInvalidRefreshToken},
+	{errs.ErrInvalidResetToken, http.StatusBadRequest, response.CodeInvalidResetToken},
+	{errs.ErrWrongPassword, http.StatusBadRequest, response.CodeWrongPassword},
+	{errs.ErrUserExists, http.StatusConflict, response.CodeUserExists},
+	{errs.ErrEmailInUse, http.StatusConflict, response.CodeEmailInUse},
+
+	{errs.ErrUserNotFound, http.StatusNotFound, response.CodeUserNotFound},
+	{errs.ErrReceiverNotFound, http.StatusNotFound, response.CodeReceiverNotFound},
+	{errs.ErrGroupNotFound, http.StatusNotFound, response.CodeGroupNotFound},
+	{errs.ErrMemberNotFound, http.StatusNotFound, response.CodeMemberNotFound},
+	{errs.ErrMessageNotFound, http.StatusNotFound, response.CodeMessageNotFound},
+	{errs.ErrReactionNotFound, http.StatusNotFound, response.CodeReactionNotFound},
+	{errs.ErrPollNotFound, http.StatusNotFound, response.CodePollNotFound},
+	{errs.ErrFileNotFound, http.StatusNotFound, response.CodeFileNotFound},
+	{errs.ErrCallNotFound, http.StatusNotFound, response.CodeCallNotFound},
+	{errs.ErrInviteNotFound, http.StatusNotFound, response.CodeInviteNotFound},
+	{errs.ErrJoinRequestNotFound, http.StatusNotFound, response.CodeRequestNotFound},
+	{errs.ErrWebhookNotFound, http.StatusNotFound, response.CodeWebhookNotFound},
+	{errs.ErrBotTokenNotFound, http.StatusNotFound, response.CodeBotTokenNotFound},
+	{errs.ErrSubscriptionNotFound, http.StatusNotFound, response.CodePushNotFound},
+	{errs.ErrReportNotFound, http.StatusNotFound, response.CodeReportNotFound},
+	{errs.ErrContactNotFound, http.StatusNotFound, response.CodeContactNotFound},
+	{errs.ErrDraftNotFound, http.StatusNotFound, response.CodeDraftNotFound},
+
+	{errs.ErrNotGroupMember, http.StatusForbidden, response.CodeNotGroupMember},
+	{errs.ErrNotMemberOfAll, http.StatusForbidden, response.CodeNotGroupMember},
+	{errs.ErrGroupAdminRequired, http.StatusForbidden, response.CodeAdminRequired},
+	{errs.ErrAdminsUpdateGroup, http.StatusForbidden, response.CodeAdminRequired},
+	{errs.ErrNotAllowedToUpdate, http.StatusForbidden, response.CodeAdminRequired},
+	{errs.ErrOwnerDeletesGroup, http.StatusForbidden, response.CodeOwnerRequired},
+	{errs.ErrSenderEdits, http.StatusForbidden, response.CodeNotMessageSender},
+	{errs.ErrSenderDeletes, http.StatusForbidden, response.CodeNotMessageSender},
+	{errs.ErrMarkReadDenied, http.StatusForbidden, response.CodeForbidden},
+	{errs.ErrFileNotOwned, http.StatusForbidden, response.CodeForbidden},
+	{errs.ErrAvatarNotOwned, http.StatusForbidden, response.CodeForbidden},
+	{errs.ErrNotInCall, http.StatusForbidden, response.CodeNotCallParticipant},
+	{errs.ErrGroupPrivate, http.StatusForbidden, response.CodeGroupPrivate},
+	{errs.ErrPrivateNoInvites, http.StatusForbidden, response.CodeGroupPrivate},
+	{errs.ErrEditWindowExpired, http.StatusForbidden, response.CodeWindowExpired},
+	{errs.ErrDeleteWindowExpired, http.StatusForbidden, response.CodeWindowExpired},
+	{errs.ErrBotScopeDenied, http.StatusForbidden, response.CodeForbidden},
+	{errs.ErrChannelAdminsPost, http.StatusForbidden, response.CodeChannelReadOnly},
+	{errs.ErrOwnerProtected, http.StatusForbidden, response.CodeOwnerProtected},
+	{errs.ErrOwnerLeaves, http.StatusForbidden, response.CodeOwnerProtected},
+	{errs.ErrAttachmentNotOwned, http.StatusForbidden, response.CodeForbidden},
+
+	{errs.ErrAlreadyMember, http.StatusConflict, response.CodeAlreadyMember},
+	{errs.ErrUserAlreadyMember, http.StatusConflict, response.CodeAlreadyMember},
+	{errs.ErrGroupFull, http.StatusConflict, response.CodeGroupFull},
+	{errs.ErrJoinRequestPending, http.StatusConflict, response.CodeJoinRequestPending},
+	{errs.ErrAlreadyPinned, http.StatusConflict, response.CodeAlreadyPinned},
+	{errs.ErrAlreadyInCall, http.StatusConflict, response.CodeAlreadyInCall},
+	{errs.ErrAlreadyReported, http.StatusConflict, response.CodeAlreadyReported},
+	{errs.ErrAlreadyContact, http.StatusConflict, response.CodeAlreadyContact},
+	{errs.ErrContactPending, http.StatusConflict, response.CodeContactPending},
+	{errs.ErrCallEnded, http.StatusConflict, response.CodeCallEnded},
+	{errs.ErrCallNotRinging, http.StatusConflict, response.CodeCallNotRinging},
+	{errs.ErrPollClosed, http.StatusConflict, response.CodePollClosed},
+	{errs.ErrBotTokenRevoked, http.StatusConflict, response.CodeAlreadyRevoked},
+
+	{errs.ErrMessageDeleted, http.StatusGone, response.CodeMessageDeleted},
+	{errs.ErrInviteExpired, http.StatusGone, response.CodeInviteExpired},
+	{errs.ErrInviteExhausted, http.StatusGone, response.CodeInviteExpired},
+	{errs.ErrPushEndpointInUse, http.StatusConflict, response.CodeConflict},
+
+	{errs.ErrNotAnImage, http.StatusBadRequest, response.CodeInvalidImage},
+	{errs.ErrSelfContact, http.StatusBadRequest, response.CodeSelfContact},
+	{errs.ErrContentRejected, http.StatusUnprocessableEntity, response.CodeContentRejected},
+	{errs.ErrTypingGroupOnly, http.StatusBadRequest, response.CodeGroupOnly},
+	{errs.ErrPushEndpoint, http.StatusBadRequest, response.CodeInvalidRequest},
+	{errs.ErrBatchTooLarge, http.StatusBadRequest, response.CodeInvalidRequest},
+	{errs.ErrReplyOutside, http.StatusBadRequest, response.CodeInvalidReply},
+	{errs.ErrPollEndpoint, http.StatusBadRequest, response.CodePollEndpoint},
+	{errs.ErrDuplicateFile, http.StatusBadRequest, response.CodeInvalidRequest},
+	{errs.ErrInvalidChatType, http.StatusBadRequest, response.CodeInvalidChatType},
+
+	{errs.ErrPushDisabled, http.StatusServiceUnavailable, response.CodePushDisabled},
+	{webhook.ErrQueueFull, http.StatusServiceUnavailable, response.CodeQueueFull},
+
+	{errs.ErrFloodWait, http.StatusTooManyRequests, response.CodeFloodWait},
+}
+
+// respondError answers with a service error. Known errors get their own
+// status and code; others get fallback. Server errors are logged rather than
+// sent, as their text is not meant for clients.
+func respondError(c *gin.Context, fallback int, err error) {
+	var flood *errs.FloodWaitError
+	if errors.As(err, &flood) {
+		c.Header("Retry-After", strconv.Itoa(flood.RetryAfter()))
+	}
+
+	status, code, message := describeError(c, fallback, err)
+	response.ErrorWithCode(c, status, code, message)
+}
+
+// describeError returns the status, code and message respondError answers
+// a service error with
+func describeError(c *gin.Context, fallback int, err error) (int, string, string) {
+	for _, mapped := range serviceErrors {
+		if errors.Is(err, mapped.err) {
+			return mapped.status, mapped.code, err.Error()
+		}
+	}
+
+	if fallback >= http.StatusInternalServerError {
+		logrus.Errorf("%s %s: %v", c.Request.Method, c.FullPath(), err)
+		return fallback, response.StatusCode(fallback), http.StatusText(fallback)
+	}
+
+	return fallback, response.StatusCode(fallback), err.Error()
+}
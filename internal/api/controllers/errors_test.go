@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/models/response"
+)
+
+// respond runs respondError for err and returns the response
+func respond(t *testing.T, fallback int, err error) (*httptest.ResponseRecorder, response.CommonResponse) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	respondError(c, fallback, err)
+
+	var envelope response.CommonResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	return rec, envelope
+}
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback int
+		err      error
+		status   int
+		code     string
+		message  string
+	}{
+		{"known error ignores the fallback", http.StatusBadRequest, errs.ErrNotGroupMember,
+			http.StatusForbidden, response.CodeNotGroupMember, errs.ErrNotGroupMember.Error()},
+		{"unknown client error", http.StatusBadRequest, errors.New("content is required"),
+			http.StatusBadRequest, response.CodeInvalidRequest, "content is required"},
+		{"unknown server error is not leaked", http.StatusInternalServerError, errors.New("database is locked"),
+			http.StatusInternalServerError, response.CodeInternal, http.StatusText(http.StatusInternalServerError)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, envelope := respond(t, tt.fallback, tt.err)
+			if rec.Code != tt.status || envelope.Code != tt.status || envelope.Error != tt.code || envelope.Message != tt.message {
+				t.Fatalf("status %d, envelope %+v; want %d, %s, %q", rec.Code, envelope, tt.status, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestRespondErrorTellsFloodedSendersWhenToRetry(t *testing.T) {
+	rec, envelope := respond(t, http.StatusBadRequest, &errs.FloodWaitError{Wait: 1500 * time.Millisecond})
+
+	if rec.Code != http.StatusTooManyRequests || envelope.Error != response.CodeFloodWait {
+		t.Fatalf("status %d, envelope %+v; want %d with %s", rec.Code, envelope, http.StatusTooManyRequests, response.CodeFloodWait)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After %q, want 2", got)
+	}
+}
+
+func TestServiceErrorsMatchWrappedErrors(t *testing.T) {
+	for i, mapped := range serviceErrors {
+		wrapped := fmt.Errorf("load group 7: %w", mapped.err)
+		rec, envelope := respond(t, http.StatusInternalServerError, wrapped)
+
+		// An earlier entry matching the error would shadow this one
+		if rec.Code != mapped.status || envelope.Error != mapped.code {
+			t.Errorf("entry %d (%v) answers %d %s, want %d %s", i, mapped.err, rec.Code, envelope.Error, mapped.status, mapped.code)
+		}
+		if envelope.Message != wrapped.Error() {
+			t.Errorf("entry %d (%v) answers %q, want the wrapped message", i, mapped.err, envelope.Message)
+		}
+	}
+}
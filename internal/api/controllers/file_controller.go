@@ -1,11 +1,13 @@
 package controllers
 
 import (
+	"mime"
 	"net/http"
 	"strconv"
 
 	"web-api/internal/api/middlewares"
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,23 +28,17 @@ func (ctrl *FileController) UploadFile(c *gin.Context) {
 
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
-		return
-	}
-
-	// Validate file type
-	if !services.FileServ.ValidateFileType(file.Header.Get("Content-Type")) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File type not allowed"})
+		response.Error(c, http.StatusBadRequest, "No file uploaded")
 		return
 	}
 
 	fileRecord, err := services.FileServ.UploadFile(userID, file)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, fileRecord)
+	response.Created(c, fileRecord)
 }
 
 // GetFile retrieves file information
@@ -54,19 +50,62 @@ func (ctrl *FileController) UploadFile(c *gin.Context) {
 // @Success 200 {object} models.File
 // @Router /api/files/:id [get]
 func (ctrl *FileController) GetFile(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	fileID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	file, err := services.FileServ.GetAccessibleFile(uint(fileID), userID)
+	if err != nil {
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodeFileNotFound, "File not found")
+		return
+	}
+
+	response.OkWithData(c, file)
+}
+
+// DownloadFile streams a file's content
+// @Summary Download file
+// @Description Supports HTTP Range requests
+// @Tags Files
+// @Security BearerAuth
+// @Produce octet-stream
+// @Param id path int true "File ID"
+// @Success 200
+// @Success 206
+// @Router /api/files/:id/download [get]
+func (ctrl *FileController) DownloadFile(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
 	fileID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid file ID")
 		return
 	}
 
-	file, err := services.FileServ.GetFileByID(uint(fileID))
+	file, err := services.FileServ.GetAccessibleFile(uint(fileID), userID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodeFileNotFound, "File not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, file)
+	content, err := services.FileServ.OpenFile(file)
+	if err != nil {
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodeFileNotFound, "File content not found")
+		return
+	}
+	defer content.Close()
+
+	if file.MimeType != "" {
+		c.Header("Content-Type", file.MimeType)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": file.OriginalName}))
+
+	// ServeContent handles Range and conditional requests
+	http.ServeContent(c.Writer, c.Request, file.OriginalName, file.UpdatedAt, content)
 }
 
 // DeleteFile deletes a file
@@ -81,16 +120,16 @@ func (ctrl *FileController) DeleteFile(c *gin.Context) {
 
 	fileID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid file ID")
 		return
 	}
 
 	if err := services.FileServ.DeleteFile(uint(fileID), userID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	response.OkWithMessage(c, "File deleted successfully")
 }
 
 // GetUserFiles retrieves all files uploaded by the user
@@ -121,9 +160,9 @@ func (ctrl *FileController) GetUserFiles(c *gin.Context) {
 
 	files, err := services.FileServ.GetUserFiles(userID, limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	response.OkWithData(c, gin.H{"files": files})
 }
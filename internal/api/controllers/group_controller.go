@@ -6,6 +6,8 @@ import (
 
 	"web-api/internal/api/middlewares"
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,24 +21,24 @@ type GroupController struct{}
 // @Accept json
 // @Produce json
 // @Param request body services.CreateGroupRequest true "Group request"
-// @Success 201 {object} models.Group
+// @Success 201 {object} models.GroupResponse
 // @Router /api/groups/create [post]
 func (ctrl *GroupController) CreateGroup(c *gin.Context) {
 	userID, _ := middlewares.GetUserID(c)
 
 	var req services.CreateGroupRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	group, err := services.Group.CreateGroup(userID, req)
+	group, err := services.Group.CreateGroup(c.Request.Context(), userID, req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, group)
+	response.Created(c, group)
 }
 
 // AddMember adds a member to a group
@@ -50,26 +52,24 @@ func (ctrl *GroupController) CreateGroup(c *gin.Context) {
 // @Success 200
 // @Router /api/groups/:id/add-member [post]
 func (ctrl *GroupController) AddMember(c *gin.Context) {
-	userID, _ := middlewares.GetUserID(c)
-
 	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
 		return
 	}
 
 	var req services.AddMemberRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if err := services.Group.AddMember(uint(groupID), userID, req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := services.Group.AddMember(c.Request.Context(), uint(groupID), req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+	response.OkWithMessage(c, "Member added successfully")
 }
 
 // RemoveMember removes a member from a group
@@ -81,26 +81,258 @@ func (ctrl *GroupController) AddMember(c *gin.Context) {
 // @Success 200
 // @Router /api/groups/:id/remove-member/:userID [delete]
 func (ctrl *GroupController) RemoveMember(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := services.Group.RemoveMember(c.Request.Context(), uint(groupID), uint(userID)); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Member removed successfully")
+}
+
+// UpdateMemberRole changes a member's role
+// @Summary Promote or demote a group member
+// @Tags Groups
+// @Security BearerAuth
+// @Accept json
+// @Param id path int true "Group ID"
+// @Param userID path int true "User ID"
+// @Param request body services.UpdateMemberRoleRequest true "New role"
+// @Success 200
+// @Router /api/groups/:id/members/:userID/role [patch]
+func (ctrl *GroupController) UpdateMemberRole(c *gin.Context) {
 	requestorID, _ := middlewares.GetUserID(c)
 
 	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
 		return
 	}
 
 	userID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req services.UpdateMemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.Group.UpdateMemberRole(c.Request.Context(), uint(groupID), requestorID, uint(userID), req.Role); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Member role updated successfully")
+}
+
+// CreateInvite creates an invite code for a group
+// @Summary Create group invite
+// @Tags Groups
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Group ID"
+// @Param request body services.CreateInviteRequest false "Invite options"
+// @Success 201 {object} models.GroupInvite
+// @Router /api/groups/:id/invites [post]
+func (ctrl *GroupController) CreateInvite(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
 		return
 	}
 
-	if err := services.Group.RemoveMember(uint(groupID), requestorID, uint(userID)); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// The body is optional; defaults apply when it is empty
+	var req services.CreateInviteRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.Error(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	invite, err := services.Group.CreateInvite(c.Request.Context(), uint(groupID), userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+	response.Created(c, invite)
+}
+
+// JoinByInvite joins a group with an invite code
+// @Summary Join group by invite
+// @Tags Groups
+// @Security BearerAuth
+// @Produce json
+// @Param code path string true "Invite code"
+// @Success 200 {object} models.Group
+// @Router /api/groups/join/:code [post]
+func (ctrl *GroupController) JoinByInvite(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	group, pending, err := services.Group.JoinByInvite(c.Request.Context(), c.Param("code"), userID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJoin(c, group, pending)
+}
+
+// JoinGroup joins an open group or asks to join one that needs approval
+// @Summary Join group
+// @Tags Groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Group ID"
+// @Success 200 {object} models.Group
+// @Success 202
+// @Router /api/groups/:id/join [post]
+func (ctrl *GroupController) JoinGroup(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	group, pending, err := services.Group.RequestToJoin(c.Request.Context(), uint(groupID), userID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJoin(c, group, pending)
+}
+
+// respondJoin answers a join with the group, or 202 when the join awaits an
+// admin's approval
+func respondJoin(c *gin.Context, group *models.Group, pending bool) {
+	if pending {
+		response.Result(c, http.StatusAccepted, gin.H{"group_id": group.ID},
+			"Join request sent, waiting for an admin's approval")
+		return
+	}
+
+	response.OkWithData(c, group)
+}
+
+// GetJoinRequests lists a group's pending join requests
+// @Summary List pending join requests
+// @Tags Groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Group ID"
+// @Success 200 {array} models.GroupJoinRequest
+// @Router /api/groups/:id/requests [get]
+func (ctrl *GroupController) GetJoinRequests(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	requests, err := services.Group.GetJoinRequests(c.Request.Context(), uint(groupID))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, requests)
+}
+
+// ApproveJoinRequest approves a user's join request
+// @Summary Approve join request
+// @Tags Groups
+// @Security BearerAuth
+// @Param id path int true "Group ID"
+// @Param userID path int true "Requesting user ID"
+// @Success 200
+// @Router /api/groups/:id/requests/:userID/approve [post]
+func (ctrl *GroupController) ApproveJoinRequest(c *gin.Context) {
+	ctrl.reviewJoinRequest(c, true)
+}
+
+// RejectJoinRequest rejects a user's join request
+// @Summary Reject join request
+// @Tags Groups
+// @Security BearerAuth
+// @Param id path int true "Group ID"
+// @Param userID path int true "Requesting user ID"
+// @Success 200
+// @Router /api/groups/:id/requests/:userID/reject [post]
+func (ctrl *GroupController) RejectJoinRequest(c *gin.Context) {
+	ctrl.reviewJoinRequest(c, false)
+}
+
+func (ctrl *GroupController) reviewJoinRequest(c *gin.Context, approve bool) {
+	requestorID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := services.Group.ReviewJoinRequest(c.Request.Context(), uint(groupID), requestorID, uint(userID), approve); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	message := "Join request rejected"
+	if approve {
+		message = "Join request approved"
+	}
+	response.OkWithMessage(c, message)
+}
+
+// LeaveGroup removes the current user from a group
+// @Summary Leave group
+// @Tags Groups
+// @Security BearerAuth
+// @Param id path int true "Group ID"
+// @Success 200
+// @Router /api/groups/:id/leave [post]
+func (ctrl *GroupController) LeaveGroup(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	if err := services.Group.LeaveGroup(c.Request.Context(), uint(groupID), userID); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Left group successfully")
 }
 
 // GetGroupMembers retrieves all members of a group
@@ -112,21 +344,19 @@ func (ctrl *GroupController) RemoveMember(c *gin.Context) {
 // @Success 200 {array} models.GroupMember
 // @Router /api/groups/:id/members [get]
 func (ctrl *GroupController) GetGroupMembers(c *gin.Context) {
-	userID, _ := middlewares.GetUserID(c)
-
 	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
 		return
 	}
 
-	members, err := services.Group.GetGroupMembers(uint(groupID), userID)
+	members, err := services.Group.GetGroupMembers(c.Request.Context(), uint(groupID))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"members": members})
+	response.OkWithData(c, gin.H{"members": members})
 }
 
 // GetUserGroups retrieves all groups a user is member of
@@ -134,18 +364,18 @@ func (ctrl *GroupController) GetGroupMembers(c *gin.Context) {
 // @Tags Groups
 // @Security BearerAuth
 // @Produce json
-// @Success 200 {array} models.Group
+// @Success 200 {array} models.GroupResponse
 // @Router /api/groups [get]
 func (ctrl *GroupController) GetUserGroups(c *gin.Context) {
 	userID, _ := middlewares.GetUserID(c)
 
-	groups, err := services.Group.GetUserGroups(userID)
+	groups, err := services.Group.GetUserGroups(c.Request.Context(), userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"groups": groups})
+	response.OkWithData(c, gin.H{"groups": groups})
 }
 
 // GetGroupByID retrieves a group by ID
@@ -154,24 +384,58 @@ func (ctrl *GroupController) GetUserGroups(c *gin.Context) {
 // @Security BearerAuth
 // @Produce json
 // @Param id path int true "Group ID"
-// @Success 200 {object} models.Group
+// @Success 200 {object} models.GroupResponse
 // @Router /api/groups/:id [get]
 func (ctrl *GroupController) GetGroupByID(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	group, err := services.Group.GetGroupByID(c.Request.Context(), uint(groupID))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, group)
+}
+
+// UploadAvatar sets the group's avatar from an uploaded image
+// @Summary Upload group avatar
+// @Description Admins only. The image must be a JPEG, PNG or GIF; it is
+// @Description scaled down and stored as PNG.
+// @Tags Groups
+// @Security BearerAuth
+// @Accept multipart/form-data
+// @Produce json
+// @Param id path int true "Group ID"
+// @Param file formData file true "Image"
+// @Success 200 {object} models.GroupResponse
+// @Router /api/groups/:id/avatar [post]
+func (ctrl *GroupController) UploadAvatar(c *gin.Context) {
 	userID, _ := middlewares.GetUserID(c)
 
 	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
 		return
 	}
 
-	group, err := services.Group.GetGroupByID(uint(groupID), userID)
+	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		response.Error(c, http.StatusBadRequest, "No file uploaded")
 		return
 	}
 
-	c.JSON(http.StatusOK, group)
+	group, err := services.Group.SetAvatar(c.Request.Context(), uint(groupID), userID, file)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, group)
 }
 
 // DeleteGroup deletes a group
@@ -186,14 +450,103 @@ func (ctrl *GroupController) DeleteGroup(c *gin.Context) {
 
 	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	if err := services.Group.DeleteGroup(c.Request.Context(), uint(groupID), userID); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Group deleted successfully")
+}
+
+// PinMessage pins a group message
+// @Summary Pin message
+// @Tags Groups
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Group ID"
+// @Param request body services.PinMessageRequest true "Message to pin"
+// @Success 201 {object} models.PinnedMessage
+// @Router /api/groups/:id/pins [post]
+func (ctrl *GroupController) PinMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	var req services.PinMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pin, err := services.Group.PinMessage(c.Request.Context(), uint(groupID), userID, req.MessageID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	if err := services.Group.DeleteGroup(uint(groupID), userID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	response.Created(c, pin)
+}
+
+// UnpinMessage unpins a group message
+// @Summary Unpin message
+// @Tags Groups
+// @Security BearerAuth
+// @Param id path int true "Group ID"
+// @Param messageID path int true "Message ID"
+// @Success 200
+// @Router /api/groups/:id/pins/:messageID [delete]
+func (ctrl *GroupController) UnpinMessage(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	if err := services.Group.UnpinMessage(c.Request.Context(), uint(groupID), userID, uint(messageID)); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Message unpinned")
+}
+
+// GetPinnedMessages lists a group's pinned messages
+// @Summary List pinned messages
+// @Tags Groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Group ID"
+// @Success 200 {array} models.PinnedMessage
+// @Router /api/groups/:id/pins [get]
+func (ctrl *GroupController) GetPinnedMessages(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	pins, err := services.Group.GetPinnedMessages(c.Request.Context(), uint(groupID))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
+	response.OkWithData(c, pins)
 }
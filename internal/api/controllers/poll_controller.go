@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PollController struct{}
+
+// SendPoll posts a poll to a private chat or a group
+// @Summary Send poll
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.SendPollRequest true "Poll"
+// @Success 201 {object} models.PrivateMessage
+// @Router /api/messages/poll [post]
+func (ctrl *PollController) SendPoll(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.SendPollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message, err := services.Poll.SendPoll(c.Request.Context(), userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, message)
+}
+
+// Vote toggles the current user's vote for a poll option
+// @Summary Vote in poll
+// @Tags Chat
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Poll ID"
+// @Param request body services.VoteRequest true "Option"
+// @Success 200 {object} models.Poll
+// @Router /api/polls/:id/vote [post]
+func (ctrl *PollController) Vote(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	pollID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid poll ID")
+		return
+	}
+
+	var req services.VoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	poll, err := services.Poll.Vote(c.Request.Context(), userID, uint(pollID), req.OptionID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, poll)
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"net/http"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PushController struct{}
+
+// GetVAPIDPublicKey returns the key browsers need to subscribe to push
+// @Summary Get the VAPID public key
+// @Tags Push
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Router /api/push/vapid-public-key [get]
+func (ctrl *PushController) GetVAPIDPublicKey(c *gin.Context) {
+	key := services.Push.PublicKey()
+	if key == "" {
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodePushDisabled, "push notifications are not enabled")
+		return
+	}
+
+	response.OkWithData(c, gin.H{"public_key": key})
+}
+
+// Subscribe registers the browser's push subscription for the current user
+// @Summary Subscribe to push notifications
+// @Tags Push
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.PushSubscribeRequest true "Subscription from PushManager.subscribe()"
+// @Success 201 {object} models.PushSubscription
+// @Router /api/push/subscribe [post]
+func (ctrl *PushController) Subscribe(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.PushSubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subscription, err := services.Push.Subscribe(userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, subscription)
+}
+
+// Unsubscribe removes one of the current user's push subscriptions
+// @Summary Unsubscribe from push notifications
+// @Tags Push
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.PushUnsubscribeRequest true "Subscription endpoint"
+// @Success 200 {object} map[string]string
+// @Router /api/push/subscribe [delete]
+func (ctrl *PushController) Unsubscribe(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.PushUnsubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := services.Push.Unsubscribe(userID, req.Endpoint); err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Unsubscribed from push notifications")
+}
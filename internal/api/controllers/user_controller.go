@@ -3,8 +3,12 @@ package controllers
 import (
 	"net/http"
 	"strconv"
+	"strings"
 
+	"web-api/internal/api/middlewares"
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,13 +23,15 @@ type UserController struct{}
 // @Success 200 {array} models.UserResponse
 // @Router /api/users/online [get]
 func (ctrl *UserController) GetOnlineUsers(c *gin.Context) {
-	users, err := services.User.GetOnlineUsers()
+	viewerID, _ := middlewares.GetUserID(c)
+
+	users, err := services.User.GetOnlineUsers(c.Request.Context(), viewerID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response.OkWithData(c, gin.H{
 		"users": users,
 		"count": len(users),
 	})
@@ -38,29 +44,42 @@ func (ctrl *UserController) GetOnlineUsers(c *gin.Context) {
 // @Produce json
 // @Param q query string true "Search query"
 // @Param limit query int false "Limit" default(10)
+// @Param offset query int false "Offset" default(0)
 // @Success 200 {array} models.UserResponse
 // @Router /api/users/search [get]
 func (ctrl *UserController) SearchUsers(c *gin.Context) {
-	query := c.Query("q")
+	query := strings.TrimSpace(c.Query("q"))
 	if query == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query required"})
+		response.Error(c, http.StatusBadRequest, "Search query required")
 		return
 	}
 
 	limit := 10
+	offset := 0
+
 	if l := c.Query("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil {
 			limit = parsed
 		}
 	}
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil {
+			offset = parsed
+		}
+	}
+
+	viewerID, _ := middlewares.GetUserID(c)
 
-	users, err := services.User.SearchUsers(query, limit)
+	users, total, err := services.User.SearchUsers(c.Request.Context(), viewerID, query, limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"users": users})
+	response.OkWithData(c, gin.H{
+		"users": users,
+		"total": total,
+	})
 }
 
 // GetUserByID returns user by ID
@@ -74,15 +93,151 @@ func (ctrl *UserController) SearchUsers(c *gin.Context) {
 func (ctrl *UserController) GetUserByID(c *gin.Context) {
 	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	user, err := services.User.GetUserByID(c.Request.Context(), uint(userID))
+	if err != nil {
+		response.ErrorWithCode(c, http.StatusNotFound, response.CodeUserNotFound, "User not found")
+		return
+	}
+
+	viewerID, _ := middlewares.GetUserID(c)
+	response.OkWithData(c, services.User.PublicResponse(c.Request.Context(), viewerID, user))
+}
+
+// GetLastSeen returns when a user was last online
+// @Summary Get last seen
+// @Description last_seen is null if unknown or hidden by the user's privacy setting
+// @Tags Users
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} services.LastSeenResponse
+// @Router /api/users/:id/last-seen [get]
+func (ctrl *UserController) GetLastSeen(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	viewerID, _ := middlewares.GetUserID(c)
+
+	lastSeen, err := services.User.GetLastSeen(c.Request.Context(), viewerID, uint(userID))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithData(c, lastSeen)
+}
+
+// GetContacts lists the current user's contacts
+// @Summary Get contacts
+// @Description Accepted contacts by default; with status=pending, the requests sent and received
+// @Tags Users
+// @Security BearerAuth
+// @Produce json
+// @Param status query string false "accepted or pending" default(accepted)
+// @Success 200 {array} models.ContactResponse
+// @Router /api/contacts [get]
+func (ctrl *UserController) GetContacts(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	status := models.ContactStatus(c.DefaultQuery("status", string(models.ContactStatusAccepted)))
+	if status != models.ContactStatusAccepted && status != models.ContactStatusPending {
+		response.Error(c, http.StatusBadRequest, "Invalid contact status")
+		return
+	}
+
+	contacts, err := services.User.ListContacts(c.Request.Context(), userID, status)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"contacts": contacts,
+		"count":    len(contacts),
+	})
+}
+
+// SendContactRequest asks a user to become the current user's contact
+// @Summary Send contact request
+// @Description If the user already asked the current user, their request is accepted instead
+// @Tags Users
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.ContactRequest true "User to add"
+// @Success 201 {object} models.ContactResponse
+// @Router /api/contacts [post]
+func (ctrl *UserController) SendContactRequest(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contact, err := services.User.SendContactRequest(c.Request.Context(), userID, req.UserID)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, contact)
+}
+
+// AcceptContactRequest accepts a contact request sent to the current user
+// @Summary Accept contact request
+// @Tags Users
+// @Security BearerAuth
+// @Produce json
+// @Param userID path int true "ID of the user who sent the request"
+// @Success 200 {object} models.ContactResponse
+// @Router /api/contacts/:userID/accept [post]
+func (ctrl *UserController) AcceptContactRequest(c *gin.Context) {
+	requesterID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
 
-	user, err := services.User.GetUserByID(uint(userID))
+	userID, _ := middlewares.GetUserID(c)
+
+	contact, err := services.User.AcceptContactRequest(c.Request.Context(), userID, uint(requesterID))
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, contact)
+}
+
+// RemoveContact removes a contact, or withdraws or declines a request
+// @Summary Remove contact
+// @Tags Users
+// @Security BearerAuth
+// @Param userID path int true "Contact user ID"
+// @Success 200
+// @Router /api/contacts/:userID [delete]
+func (ctrl *UserController) RemoveContact(c *gin.Context) {
+	otherID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	userID, _ := middlewares.GetUserID(c)
+
+	if err := services.User.RemoveContact(c.Request.Context(), userID, uint(otherID)); err != nil {
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, user.ToResponse())
+	response.OkWithMessage(c, "Contact removed")
 }
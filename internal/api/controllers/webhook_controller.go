@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"web-api/internal/api/middlewares"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookController struct{}
+
+// CreateWebhook registers a webhook for the current user. The response is
+// the only time the secret is shown.
+// @Summary Create webhook
+// @Tags Webhooks
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body services.CreateWebhookRequest true "Webhook"
+// @Success 201 {object} map[string]interface{}
+// @Router /api/webhooks [post]
+func (ctrl *WebhookController) CreateWebhook(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	var req services.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hook, err := services.Webhook.CreateWebhook(userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.Created(c, gin.H{
+		"webhook": hook,
+		"secret":  hook.Secret,
+	})
+}
+
+// GetWebhooks lists the current user's webhooks
+// @Summary List webhooks
+// @Tags Webhooks
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} models.Webhook
+// @Router /api/webhooks [get]
+func (ctrl *WebhookController) GetWebhooks(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	hooks, err := services.Webhook.GetWebhooks(userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"webhooks": hooks,
+		"count":    len(hooks),
+	})
+}
+
+// GetWebhook retrieves one of the current user's webhooks
+// @Summary Get webhook
+// @Tags Webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} models.Webhook
+// @Router /api/webhooks/:id [get]
+func (ctrl *WebhookController) GetWebhook(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	hook, err := services.Webhook.GetWebhook(userID, uint(webhookID))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithData(c, hook)
+}
+
+// UpdateWebhook changes one of the current user's webhooks
+// @Summary Update webhook
+// @Tags Webhooks
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param request body services.UpdateWebhookRequest true "Fields to change"
+// @Success 200 {object} models.Webhook
+// @Router /api/webhooks/:id [put]
+func (ctrl *WebhookController) UpdateWebhook(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var req services.UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hook, err := services.Webhook.UpdateWebhook(userID, uint(webhookID), req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	response.OkWithData(c, hook)
+}
+
+// DeleteWebhook removes one of the current user's webhooks
+// @Summary Delete webhook
+// @Tags Webhooks
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Success 200
+// @Router /api/webhooks/:id [delete]
+func (ctrl *WebhookController) DeleteWebhook(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	if err := services.Webhook.DeleteWebhook(userID, uint(webhookID)); err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithMessage(c, "Webhook deleted")
+}
+
+// GetDeadLetters lists deliveries to a webhook that failed every attempt
+// @Summary Get failed webhook deliveries
+// @Tags Webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param limit query int false "Limit" default(50)
+// @Success 200 {array} models.WebhookDeadLetter
+// @Router /api/webhooks/:id/dead-letters [get]
+func (ctrl *WebhookController) GetDeadLetters(c *gin.Context) {
+	userID, _ := middlewares.GetUserID(c)
+
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.Error(c, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	limit := 50
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+
+	letters, err := services.Webhook.GetDeadLetters(userID, uint(webhookID), limit)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	response.OkWithData(c, gin.H{
+		"dead_letters": letters,
+		"count":        len(letters),
+	})
+}
@@ -2,8 +2,11 @@ package controllers
 
 import (
 	"net/http"
+	"strings"
 
 	"web-api/internal/api/services"
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/models/response"
 	"web-api/internal/pkg/redis"
 	"web-api/internal/pkg/utils"
 	"web-api/internal/pkg/websocket"
@@ -17,9 +20,11 @@ var (
 	upgrader = gorillaws.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		// Clients offering permessage-deflate get large frames compressed,
+		// see websocket.compression_threshold
+		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
-			// In production, implement proper origin checking
-			return true
+			return originAllowed(r.Header.Get("Origin"))
 		},
 	}
 
@@ -29,64 +34,158 @@ var (
 
 // InitWebSocketHub initializes the WebSocket hub
 func InitWebSocketHub() {
-	Hub = websocket.NewHub()
+	Hub = websocket.NewHub(services.Chat, services.Call)
+	Hub.UseContactCheck(services.User.IsContact)
+	Hub.UseContactList(services.User.AcceptedContactIDs)
 	go Hub.Run()
 	logrus.Info("✓ WebSocket hub initialized")
 }
 
 type WebSocketController struct{}
 
+// bearerSubprotocol is the subprotocol name that precedes the token in
+// Sec-WebSocket-Protocol, since browsers cannot set headers on WebSockets
+const bearerSubprotocol = "bearer"
+
 // HandleWebSocket handles WebSocket connections
 // @Summary WebSocket endpoint
-// @Description Establishes WebSocket connection for realtime chat
+// @Description Establishes WebSocket connection for realtime chat. The JWT is
+// @Description read from, in order: the Authorization: Bearer header, the
+// @Description Sec-WebSocket-Protocol header as "bearer, <token>", and the
+// @Description token query parameter (kept for compatibility; it ends up in logs).
 // @Tags WebSocket
 // @Security BearerAuth
-// @Param token query string true "JWT token"
+// @Param token query string false "JWT token"
 // @Router /ws [get]
 func (ctrl *WebSocketController) HandleWebSocket(c *gin.Context) {
-	// Get token from query parameter
-	token := c.Query("token")
+	// Refuse cross-site handshakes before doing any other work
+	if !originAllowed(c.GetHeader("Origin")) {
+		response.Error(c, http.StatusForbidden, "Origin not allowed")
+		return
+	}
+
+	token, subprotocol := webSocketToken(c.Request)
 	if token == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token required"})
+		response.Error(c, http.StatusUnauthorized, "Token required")
 		return
 	}
 
 	// Validate token
 	claims, err := utils.ValidateToken(token)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		response.Error(c, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if claims.IsBot() {
+		response.Error(c, http.StatusForbidden, "Bot tokens cannot open WebSockets")
 		return
 	}
 
+	// Fails closed like middlewares.AuthMiddleware
+	revoked, err := redis.IsTokenRevoked(claims.UserID, claims.ID, claims.IssuedAtMicro())
+	if err != nil {
+		logrus.Errorf("Token revocation check unavailable: %v", err)
+		response.Error(c, http.StatusServiceUnavailable, "Authentication is temporarily unavailable")
+		return
+	}
+	if revoked {
+		response.Error(c, http.StatusUnauthorized, "Token has been revoked")
+		return
+	}
+
+	// Echo the subprotocol the token came with, or browsers drop the socket
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
+	}
+
 	// Upgrade connection to WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := upgrader.Upgrade(websocket.MeteredResponse(c.Writer), c.Request, responseHeader)
 	if err != nil {
 		logrus.Errorf("Failed to upgrade connection: %v", err)
 		return
 	}
 
 	// Create client
-	client := &websocket.Client{
-		Hub:      Hub,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		UserID:   claims.UserID,
-		Username: claims.Username,
-	}
+	client := websocket.NewClient(Hub, conn, claims.UserID, claims.Username, c.Query("acks") == "true")
 
-	// Register client
-	client.Hub.Register <- client
+	// Register client; the hub closes the connection if it is shutting down
+	if err := client.Hub.RegisterClient(client); err != nil {
+		return
+	}
 
 	// Start Redis subscriber for this user
 	go client.StartRedisSubscriber()
 
-	// Update user status in database and Redis
-	services.User.UpdateUserStatus(claims.UserID, true)
-	if err := redis.SetUserOnline(claims.UserID); err != nil {
-		logrus.Errorf("Failed to set user online in Redis: %v", err)
-	}
+	// Update user status in database; the hub marks the user online in
+	// Redis when it registers the client
+	services.User.UpdateUserStatus(c.Request.Context(), claims.UserID, true)
 
 	// Start client goroutines
 	go client.WritePump()
 	go client.ReadPump()
 }
+
+// webSocketToken extracts the JWT of a WebSocket handshake and, when it was
+// sent as a subprotocol, the subprotocol to accept
+func webSocketToken(r *http.Request) (string, string) {
+	if parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1], ""
+	}
+
+	protocols := gorillaws.Subprotocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == bearerSubprotocol {
+			return protocols[i+1], bearerSubprotocol
+		}
+	}
+
+	return r.URL.Query().Get("token"), ""
+}
+
+// originAllowed checks a handshake's Origin against the configured allow
+// list. Requests without an Origin do not come from a browser and cannot be
+// hijacked cross-site, so they are accepted.
+func originAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	cfg := config.GetConfig()
+	if cfg.Server.AllowAllOrigins {
+		return true
+	}
+
+	allowed := cfg.Server.AllowedOrigins
+	if len(allowed) == 0 {
+		allowed = strings.Split(cfg.Cors.Ips, ",")
+	}
+
+	for _, pattern := range allowed {
+		if matchOrigin(strings.TrimSpace(pattern), origin) {
+			return true
+		}
+	}
+
+	logrus.Warnf("Rejected WebSocket handshake from origin %s", origin)
+	return false
+}
+
+// matchOrigin reports whether origin matches pattern, where pattern is "*",
+// an exact origin, or an origin with a leading wildcard host label
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+
+	// "https://*.example.com" matches "https://chat.example.com"
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	prefix := scheme + "://"
+	if !strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(host))
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"web-api/internal/pkg/config"
+)
+
+func TestWebSocketToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		subprotocols string
+		query        string
+		wantToken    string
+		wantProtocol string
+	}{
+		{"authorization header", "Bearer header-jwt", "", "", "header-jwt", ""},
+		{"subprotocol", "", "bearer, protocol-jwt", "", "protocol-jwt", bearerSubprotocol},
+		{"query", "", "", "query-jwt", "query-jwt", ""},
+		{"header beats subprotocol and query", "Bearer header-jwt", "bearer, protocol-jwt", "query-jwt", "header-jwt", ""},
+		{"subprotocol beats query", "", "bearer, protocol-jwt", "query-jwt", "protocol-jwt", bearerSubprotocol},
+		{"other auth scheme is ignored", "Basic abc", "", "query-jwt", "query-jwt", ""},
+		{"bearer subprotocol without a token", "", "bearer", "", "", ""},
+		{"nothing", "", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/ws"
+			if tt.query != "" {
+				target += "?token=" + tt.query
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.subprotocols != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tt.subprotocols)
+			}
+
+			token, protocol := webSocketToken(req)
+			if token != tt.wantToken || protocol != tt.wantProtocol {
+				t.Errorf("webSocketToken = %q, %q, want %q, %q", token, protocol, tt.wantToken, tt.wantProtocol)
+			}
+		})
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+
+	tests := []struct {
+		name   string
+		server config.ServerConfiguration
+		cors   string
+		origin string
+		want   bool
+	}{
+		{"no origin", config.ServerConfiguration{AllowedOrigins: []string{"https://app.example.com"}}, "", "", true},
+		{"allowed", config.ServerConfiguration{AllowedOrigins: []string{"https://app.example.com"}}, "", "https://app.example.com", true},
+		{"allowed ignoring case", config.ServerConfiguration{AllowedOrigins: []string{"https://App.Example.com"}}, "", "https://app.example.com", true},
+		{"disallowed", config.ServerConfiguration{AllowedOrigins: []string{"https://app.example.com"}}, "", "https://evil.com", false},
+		{"other scheme", config.ServerConfiguration{AllowedOrigins: []string{"https://app.example.com"}}, "", "http://app.example.com", false},
+		{"wildcard subdomain", config.ServerConfiguration{AllowedOrigins: []string{"https://*.example.com"}}, "", "https://chat.example.com", true},
+		{"wildcard needs a subdomain", config.ServerConfiguration{AllowedOrigins: []string{"https://*.example.com"}}, "", "https://example.com", false},
+		{"wildcard is not a suffix match", config.ServerConfiguration{AllowedOrigins: []string{"https://*.example.com"}}, "", "https://evilexample.com", false},
+		{"wildcard keeps the scheme", config.ServerConfiguration{AllowedOrigins: []string{"https://*.example.com"}}, "", "http://chat.example.com", false},
+		{"star", config.ServerConfiguration{AllowedOrigins: []string{"*"}}, "", "https://anything.io", true},
+		{"allow all", config.ServerConfiguration{AllowAllOrigins: true}, "", "https://anything.io", true},
+		{"falls back to CORS", config.ServerConfiguration{}, "https://a.example.com, https://b.example.com", "https://b.example.com", true},
+		{"CORS fallback disallows", config.ServerConfiguration{}, "https://a.example.com", "https://evil.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config = &config.Configuration{Server: tt.server, Cors: config.CorsConfiguration{Ips: tt.cors}}
+			if got := originAllowed(tt.origin); got != tt.want {
+				t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
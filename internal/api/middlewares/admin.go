@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireAdmin only lets site administrators through. It must run after
+// AuthMiddleware. The flag is read from the database rather than the token,
+// so revoking it takes effect on the next request.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := GetUserID(c)
+		if !ok {
+			response.Error(c, http.StatusUnauthorized, "Unauthorized")
+			c.Abort()
+			return
+		}
+
+		var user models.User
+		err := database.GetDB().WithContext(c.Request.Context()).
+			Select("id", "admin").
+			First(&user, userID).Error
+		if err != nil || !user.Admin {
+			response.Error(c, http.StatusForbidden, "Admin access required")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,43 @@
+package middlewares
+
+import (
+	"net/http"
+	"testing"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/testutil"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	testutil.Setup(t)
+	admin, user := testutil.CreateUser(t, "admin"), testutil.CreateUser(t, "user")
+	database.DB.Model(admin).Update("admin", true)
+
+	// Group roles have nothing to do with site administration
+	group := testutil.CreateGroup(t, user)
+
+	revoked := testutil.CreateUser(t, "revoked")
+	database.DB.Model(revoked).Update("admin", true)
+	database.DB.Model(revoked).Update("admin", false)
+
+	tests := []struct {
+		name   string
+		userID uint
+		want   int
+	}{
+		{"site admin", admin.ID, http.StatusOK},
+		{"regular user", user.ID, http.StatusForbidden},
+		{"admin of a group", group.OwnerID, http.StatusForbidden},
+		{"admin flag revoked", revoked.ID, http.StatusForbidden},
+		{"deleted user", 9999, http.StatusForbidden},
+		{"unauthenticated", 0, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := serveAs(t, tt.userID, "/admin", "/admin", RequireAdmin()); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+}
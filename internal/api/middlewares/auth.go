@@ -4,9 +4,12 @@ import (
 	"net/http"
 	"strings"
 
+	"web-api/internal/pkg/models/response"
+	"web-api/internal/pkg/redis"
 	"web-api/internal/pkg/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 // AuthMiddleware validates JWT token and adds user info to context
@@ -15,9 +18,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		authHeader := c.GetHeader("Authorization")
 		
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Authorization header is required",
-			})
+			response.Error(c, http.StatusUnauthorized, "Authorization header is required")
 			c.Abort()
 			return
 		}
@@ -25,9 +26,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		// Extract token from "Bearer <token>"
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Authorization header format must be Bearer {token}",
-			})
+			response.Error(c, http.StatusUnauthorized, "Authorization header format must be Bearer {token}")
 			c.Abort()
 			return
 		}
@@ -37,14 +36,39 @@ func AuthMiddleware() gin.HandlerFunc {
 		// Validate token
 		claims, err := utils.ValidateToken(token)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid or expired token",
-			})
+			response.Error(c, http.StatusUnauthorized, "Invalid or expired token")
 			c.Abort()
 			return
 		}
 
+		// Reject tokens that were logged out or revoked. Unlike RateLimit
+		// this fails closed: while Redis is unreachable a revoked token
+		// cannot be told apart, so the request is refused with 503 rather
+		// than let through or answered as if the token were revoked.
+		revoked, err := redis.IsTokenRevoked(claims.UserID, claims.ID, claims.IssuedAtMicro())
+		if err != nil {
+			logrus.Errorf("Token revocation check unavailable: %v", err)
+			response.Error(c, http.StatusServiceUnavailable, "Authentication is temporarily unavailable")
+			c.Abort()
+			return
+		}
+		if revoked {
+			response.Error(c, http.StatusUnauthorized, "Token has been revoked")
+			c.Abort()
+			return
+		}
+
+		// Bot tokens only reach the bot endpoints, and only until revoked
+		if claims.IsBot() {
+			if status, message := authorizeBot(c, claims); status != 0 {
+				response.Error(c, status, message)
+				c.Abort()
+				return
+			}
+		}
+
 		// Add user info to context
+		c.Set("claims", claims)
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("email", claims.Email)
@@ -64,6 +88,17 @@ func GetUserID(c *gin.Context) (uint, bool) {
 	return id, ok
 }
 
+// GetClaims retrieves the validated token claims from context
+func GetClaims(c *gin.Context) (*utils.Claims, bool) {
+	claims, exists := c.Get("claims")
+	if !exists {
+		return nil, false
+	}
+
+	tokenClaims, ok := claims.(*utils.Claims)
+	return tokenClaims, ok
+}
+
 // GetUsername retrieves username from context
 func GetUsername(c *gin.Context) (string, bool) {
 	username, exists := c.Get("username")
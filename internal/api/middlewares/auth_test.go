@@ -0,0 +1,54 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+	"web-api/internal/pkg/utils"
+)
+
+func TestAuthMiddlewareRevocation(t *testing.T) {
+	mr := testutil.Setup(t)
+	alice := testutil.CreateUser(t, "alice")
+	token := testutil.Token(t, alice)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/me", AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	status := func() int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("valid token: status %d, want %d", got, http.StatusOK)
+	}
+
+	// An unreachable Redis is not reported as a revoked token
+	mr.Close()
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Fatalf("redis down: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("restart redis: %v", err)
+	}
+
+	claims, err := utils.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if err := redis.BlacklistToken(claims.ID, claims.ExpiresIn()); err != nil {
+		t.Fatalf("BlacklistToken: %v", err)
+	}
+	if got := status(); got != http.StatusUnauthorized {
+		t.Fatalf("revoked token: status %d, want %d", got, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// botLastUsedInterval keeps a busy bot from writing last_used_at on every
+// request
+const botLastUsedInterval = time.Minute
+
+// botRoutes are the only endpoints bot tokens may call, keyed by method and
+// route pattern
+var botRoutes = map[string]bool{
+	"POST /api/messages/private":       true,
+	"POST /api/messages/group":         true,
+	"POST /api/messages/batch":         true,
+	"GET /api/messages/group/:groupID": true,
+}
+
+// authorizeBot checks a bot token against the route allowlist and its
+// stored record. It returns the status to abort with, or 0 if the request
+// may go on.
+func authorizeBot(c *gin.Context, claims *utils.Claims) (int, string) {
+	if !botRoutes[c.Request.Method+" "+c.FullPath()] {
+		return http.StatusForbidden, "Bot tokens cannot call this endpoint"
+	}
+
+	db := database.GetDB()
+
+	var token models.BotToken
+	if err := db.Where("token_id = ? AND user_id = ?", claims.ID, claims.UserID).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return http.StatusUnauthorized, "Token has been revoked"
+		}
+		return http.StatusInternalServerError, "Failed to verify token"
+	}
+	if token.RevokedAt != nil {
+		return http.StatusUnauthorized, "Token has been revoked"
+	}
+
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > botLastUsedInterval {
+		if err := db.Model(&token).UpdateColumn("last_used_at", now).Error; err != nil {
+			logrus.Warnf("Failed to record use of bot token %d: %v", token.ID, err)
+		}
+	}
+
+	c.Set("bot_token", &token)
+	return 0, ""
+}
+
+// GetBotToken retrieves the bot token the request authenticated with, if
+// it used one
+func GetBotToken(c *gin.Context) (*models.BotToken, bool) {
+	token, exists := c.Get("bot_token")
+	if !exists {
+		return nil, false
+	}
+
+	botToken, ok := token.(*models.BotToken)
+	return botToken, ok
+}
+
+// BotScopeAllows reports whether the request may act in a group, or in a
+// private chat when groupID is 0. User tokens may act anywhere; bot tokens
+// limited to groups only in those groups.
+func BotScopeAllows(c *gin.Context, groupID uint) bool {
+	token, ok := GetBotToken(c)
+	if !ok || len(token.GroupIDs) == 0 {
+		return true
+	}
+	return groupID != 0 && token.AllowsGroup(groupID)
+}
@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/models/response"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RequireGroupRole only lets members of the group named by the :id route
+// param through whose role is at least role: models.GroupRoleMember admits
+// every member, models.GroupRoleAdmin only admins. It must run after
+// AuthMiddleware.
+func RequireGroupRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := GetUserID(c)
+		if !ok {
+			response.Error(c, http.StatusUnauthorized, "Unauthorized")
+			c.Abort()
+			return
+		}
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			response.Error(c, http.StatusBadRequest, "Invalid group ID")
+			c.Abort()
+			return
+		}
+
+		var member models.GroupMember
+		if err := database.GetDB().WithContext(c.Request.Context()).
+			Where("group_id = ? AND user_id = ?", groupID, userID).
+			First(&member).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				response.ErrorWithCode(c, http.StatusForbidden, response.CodeNotGroupMember, errs.ErrNotGroupMember.Error())
+			} else {
+				response.Error(c, http.StatusInternalServerError, "Failed to verify group membership")
+			}
+			c.Abort()
+			return
+		}
+
+		if !models.HasGroupRole(member.Role, role) {
+			response.ErrorWithCode(c, http.StatusForbidden, response.CodeAdminRequired, errs.ErrGroupAdminRequired.Error())
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
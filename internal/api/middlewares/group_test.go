@@ -0,0 +1,85 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/testutil"
+)
+
+// serveAs runs a request through the handlers as the given user, the way
+// AuthMiddleware leaves the context, and returns the response status
+func serveAs(t *testing.T, userID uint, path, pattern string, handlers ...gin.HandlerFunc) int {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	setUser := func(c *gin.Context) {
+		if userID != 0 {
+			c.Set("user_id", userID)
+		}
+	}
+	handlers = append([]gin.HandlerFunc{setUser}, handlers...)
+	handlers = append(handlers, func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET(pattern, handlers...)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestRequireGroupRole(t *testing.T) {
+	testutil.Setup(t)
+	owner, admin, member, outsider := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "admin"),
+		testutil.CreateUser(t, "member"), testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, owner, member)
+	testutil.AddMember(t, group, admin, models.GroupRoleAdmin)
+	path := fmt.Sprintf("/groups/%d", group.ID)
+
+	tests := []struct {
+		name string
+		user *models.User
+		role string
+		want int
+	}{
+		{"owner needs admin", owner, models.GroupRoleAdmin, http.StatusOK},
+		{"admin needs admin", admin, models.GroupRoleAdmin, http.StatusOK},
+		{"member needs admin", member, models.GroupRoleAdmin, http.StatusForbidden},
+		{"outsider needs admin", outsider, models.GroupRoleAdmin, http.StatusForbidden},
+		{"owner needs member", owner, models.GroupRoleMember, http.StatusOK},
+		{"admin needs member", admin, models.GroupRoleMember, http.StatusOK},
+		{"member needs member", member, models.GroupRoleMember, http.StatusOK},
+		{"outsider needs member", outsider, models.GroupRoleMember, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := serveAs(t, tt.user.ID, path, "/groups/:id", RequireGroupRole(tt.role)); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	t.Run("removed member", func(t *testing.T) {
+		gone := testutil.CreateUser(t, "gone")
+		testutil.AddMember(t, group, gone, models.GroupRoleAdmin)
+		testutil.RemoveMember(t, group, gone)
+		if status := serveAs(t, gone.ID, path, "/groups/:id", RequireGroupRole(models.GroupRoleMember)); status != http.StatusForbidden {
+			t.Errorf("status %d, want %d", status, http.StatusForbidden)
+		}
+	})
+	t.Run("unauthenticated", func(t *testing.T) {
+		if status := serveAs(t, 0, path, "/groups/:id", RequireGroupRole(models.GroupRoleMember)); status != http.StatusUnauthorized {
+			t.Errorf("status %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("invalid group ID", func(t *testing.T) {
+		if status := serveAs(t, owner.ID, "/groups/abc", "/groups/:id", RequireGroupRole(models.GroupRoleMember)); status != http.StatusBadRequest {
+			t.Errorf("status %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+}
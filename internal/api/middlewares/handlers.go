@@ -2,6 +2,8 @@ package middlewares
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,14 +14,26 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// Middleware log và lưu lại raw request body vào context
+// sensitiveFields are request body fields whose values never reach the log
+var sensitiveFields = map[string]bool{
+	"password":      true,
+	"old_password":  true,
+	"new_password":  true,
+	"token":         true,
+	"refresh_token": true,
+	"bot_token":     true,
+	"secret":        true,
+}
+
+// Middleware log và lưu lại raw request body vào context. Mật khẩu, token
+// và secret trong body được che trước khi log.
 func RequestLogger() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		if ctx.Request.Method == "POST" || ctx.Request.Method == "PUT" {
 			bodyBytes, err := io.ReadAll(ctx.Request.Body)
 			if err == nil {
 				ctx.Set("raw_body", string(bodyBytes))
-				log.Printf("[RequestLogger] %s %s body: %s", ctx.Request.Method, ctx.Request.URL.Path, string(bodyBytes))
+				log.Printf("[RequestLogger] %s %s body: %s", ctx.Request.Method, ctx.Request.URL.Path, redactBody(bodyBytes))
 				ctx.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 			}
 		}
@@ -27,6 +41,44 @@ func RequestLogger() gin.HandlerFunc {
 	}
 }
 
+// redactBody renders a request body for the log with the values of
+// sensitiveFields replaced, at any depth. Bodies that are not JSON, such as
+// forms and uploads, are logged by size only.
+func redactBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+
+	redacted, err := json.Marshal(redactValue(decoded))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	return string(redacted)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveFields[key] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
+
 func NoMethodHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		response.FailWithDetailed(ctx, http.StatusMethodNotAllowed, nil, "Method Not Allowed")
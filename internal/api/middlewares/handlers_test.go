@@ -0,0 +1,75 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestLoggerRedactsSecrets(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	var received string
+	router.Use(RequestLogger())
+	router.POST("/*path", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		received = string(body)
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		secrets []string
+		kept    []string
+	}{
+		{"reset password", "/api/reset-password",
+			`{"token":"reset-token-123","new_password":"hunter22"}`,
+			[]string{"reset-token-123", "hunter22"}, nil},
+		{"forgot password", "/api/forgot-password",
+			`{"email":"alice@example.com"}`,
+			nil, []string{"alice@example.com"}},
+		{"login", "/api/login",
+			`{"username":"alice","password":"hunter22"}`,
+			[]string{"hunter22"}, []string{"alice"}},
+		{"nested", "/api/webhooks",
+			`{"hooks":[{"url":"https://example.com","secret":"s3cr3t"}]}`,
+			[]string{"s3cr3t"}, []string{"https://example.com"}},
+		{"not JSON", "/api/login",
+			`username=alice&password=hunter22`,
+			[]string{"hunter22", "alice"}, []string{"<32 bytes>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged.Reset()
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+
+			if received != tt.body {
+				t.Errorf("handler read %q, want the body untouched", received)
+			}
+			for _, secret := range tt.secrets {
+				if strings.Contains(logged.String(), secret) {
+					t.Errorf("log %q contains %q", logged.String(), secret)
+				}
+			}
+			for _, kept := range tt.kept {
+				if !strings.Contains(logged.String(), kept) {
+					t.Errorf("log %q is missing %q", logged.String(), kept)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/testutil"
+)
+
+// slowQuery counts far enough to keep SQLite busy for a long time
+const slowQuery = `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1000000000) SELECT count(*) FROM n`
+
+func TestQueryTimeoutCancelsSlowQuery(t *testing.T) {
+	testutil.Setup(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	var queryErr error
+	router.GET("/slow", QueryTimeout(50*time.Millisecond), func(c *gin.Context) {
+		var counts []int64
+		queryErr = database.GetDB().WithContext(c.Request.Context()).Raw(slowQuery).Find(&counts).Error
+		c.Status(http.StatusOK)
+	})
+
+	start := time.Now()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if !errors.Is(queryErr, context.DeadlineExceeded) {
+		t.Fatalf("query err = %v, want %v", queryErr, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("query ran for %v, want it stopped after about 50ms", elapsed)
+	}
+}
+
+func TestQueryStopsWhenClientGoesAway(t *testing.T) {
+	testutil.Setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	var counts []int64
+	err := database.GetDB().WithContext(ctx).Raw(slowQuery).Find(&counts).Error
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("query err = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("query ran for %v after the cancel", elapsed)
+	}
+}
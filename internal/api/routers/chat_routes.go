@@ -3,6 +3,9 @@ package routers
 import (
 	"web-api/internal/api/controllers"
 	"web-api/internal/api/middlewares"
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/metrics"
+	"web-api/internal/pkg/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,59 +17,175 @@ func SetupChatRoutes(router *gin.Engine) {
 	chatCtrl := &controllers.ChatController{}
 	groupCtrl := &controllers.GroupController{}
 	fileCtrl := &controllers.FileController{}
+	callCtrl := &controllers.CallController{}
+	pushCtrl := &controllers.PushController{}
+	webhookCtrl := &controllers.WebhookController{}
+	botCtrl := &controllers.BotController{}
+	pollCtrl := &controllers.PollController{}
+	adminCtrl := &controllers.AdminController{}
 	wsCtrl := &controllers.WebSocketController{}
 
+	limits := config.GetConfig().RateLimit
+	authLimit := middlewares.RateLimit(limits.Auth.RPS, limits.Auth.Burst)
+	writeLimit := middlewares.RateLimit(limits.Write.RPS, limits.Write.Burst)
+	broadcastLimit := middlewares.RateLimit(limits.Broadcast.RPS, limits.Broadcast.Burst)
+
+	groupMember := middlewares.RequireGroupRole(models.GroupRoleMember)
+	groupAdmin := middlewares.RequireGroupRole(models.GroupRoleAdmin)
+
 	api := router.Group("/api")
 	{
 		// Public routes
-		api.POST("/register", authCtrl.Register)
-		api.POST("/login", authCtrl.Login)
+		api.POST("/register", authLimit, authCtrl.Register)
+		api.POST("/login", authLimit, authCtrl.Login)
+		api.POST("/refresh", authLimit, authCtrl.Refresh)
+		api.POST("/forgot-password", authLimit, authCtrl.ForgotPassword)
+		api.POST("/reset-password", authLimit, authCtrl.ResetPassword)
 
 		// Protected routes
 		protected := api.Group("")
 		protected.Use(middlewares.AuthMiddleware())
+		protected.Use(middlewares.RateLimit(limits.Read.RPS, limits.Read.Burst))
 		{
 			// Auth/Profile
 			protected.GET("/profile", authCtrl.GetProfile)
+			protected.GET("/profile/export", authCtrl.ExportPersonalData)
+			protected.PUT("/profile", authCtrl.UpdateProfile)
+			protected.DELETE("/profile", authLimit, authCtrl.DeleteAccount)
+			protected.PUT("/profile/status", authCtrl.UpdateStatus)
+			protected.POST("/profile/avatar", authCtrl.UploadAvatar)
+			protected.POST("/profile/password", authLimit, authCtrl.ChangePassword)
+			protected.POST("/logout", authCtrl.Logout)
 
 			// Users
 			protected.GET("/users/online", userCtrl.GetOnlineUsers)
 			protected.GET("/users/search", userCtrl.SearchUsers)
 			protected.GET("/users/:id", userCtrl.GetUserByID)
+			protected.GET("/users/:id/last-seen", userCtrl.GetLastSeen)
+
+			// Contacts
+			protected.GET("/contacts", userCtrl.GetContacts)
+			protected.POST("/contacts", writeLimit, userCtrl.SendContactRequest)
+			protected.POST("/contacts/:userID/accept", userCtrl.AcceptContactRequest)
+			protected.DELETE("/contacts/:userID", userCtrl.RemoveContact)
 
 			// Private Messages
-			protected.POST("/messages/private", chatCtrl.SendPrivateMessage)
+			protected.POST("/messages/private", writeLimit, chatCtrl.SendPrivateMessage)
 			protected.GET("/messages/private/:userID", chatCtrl.GetPrivateMessages)
+			protected.PUT("/messages/private/:messageID", chatCtrl.EditPrivateMessage)
+			protected.DELETE("/messages/private/:messageID", chatCtrl.DeletePrivateMessage)
+			protected.POST("/messages/read", chatCtrl.MarkMessagesAsRead)
 			protected.POST("/messages/:messageID/read", chatCtrl.MarkMessageAsRead)
 			protected.GET("/messages/unread/count", chatCtrl.GetUnreadCount)
+			protected.GET("/messages/unread/by-conversation", chatCtrl.GetUnreadCountsByConversation)
+			protected.GET("/messages/search", chatCtrl.SearchMessages)
+			protected.GET("/messages/mentions", chatCtrl.GetMentions)
+			protected.GET("/messages/starred", chatCtrl.GetStarredMessages)
+			protected.POST("/messages/:messageID/star", chatCtrl.StarMessage)
+			protected.DELETE("/messages/:messageID/star", chatCtrl.UnstarMessage)
+			protected.POST("/messages/:messageID/report", writeLimit, chatCtrl.ReportMessage)
+			protected.GET("/messages/:messageID/context", chatCtrl.GetMessageContext)
+			protected.POST("/link-preview", writeLimit, chatCtrl.GetLinkPreview)
+			protected.POST("/messages/poll", writeLimit, pollCtrl.SendPoll)
+			protected.POST("/polls/:id/vote", pollCtrl.Vote)
+			protected.POST("/messages/:messageID/reactions", chatCtrl.AddReaction)
+			protected.DELETE("/messages/:messageID/reactions/:emoji", chatCtrl.RemoveReaction)
 
 			// Group Messages
-			protected.POST("/messages/group", chatCtrl.SendGroupMessage)
+			protected.POST("/messages/group", writeLimit, chatCtrl.SendGroupMessage)
+			protected.POST("/messages/batch", writeLimit, chatCtrl.SendBatch)
 			protected.GET("/messages/group/:groupID", chatCtrl.GetGroupMessages)
+			protected.GET("/messages/group/:groupID/seen-by", chatCtrl.GetMessageSeenBy)
+			protected.PUT("/messages/group/:messageID", chatCtrl.EditGroupMessage)
+			protected.DELETE("/messages/group/:messageID", chatCtrl.DeleteGroupMessage)
 
 			// Conversations
 			protected.GET("/conversations", chatCtrl.GetConversations)
+			protected.POST("/conversations/:conversationID/read", chatCtrl.MarkConversationAsRead)
+			protected.GET("/conversations/:conversationID/sync", chatCtrl.SyncConversation)
+			protected.POST("/conversations/:conversationID/mute", chatCtrl.MuteConversation)
+			protected.DELETE("/conversations/:conversationID/mute", chatCtrl.UnmuteConversation)
+			protected.POST("/conversations/:conversationID/archive", chatCtrl.ArchiveConversation)
+			protected.DELETE("/conversations/:conversationID/archive", chatCtrl.UnarchiveConversation)
+			protected.GET("/conversations/:conversationID/draft", chatCtrl.GetDraft)
+			protected.PUT("/conversations/:conversationID/draft", chatCtrl.SaveDraft)
+			protected.DELETE("/conversations/:conversationID/draft", chatCtrl.DeleteDraft)
+			protected.GET("/conversations/:conversationID/typing", chatCtrl.GetTypingUsers)
+			protected.GET("/conversations/:conversationID/export", chatCtrl.ExportConversation)
+			protected.PUT("/conversations/:conversationID/disappearing", chatCtrl.SetDisappearing)
 
 			// Groups
 			protected.POST("/groups/create", groupCtrl.CreateGroup)
 			protected.GET("/groups", groupCtrl.GetUserGroups)
-			protected.GET("/groups/:id", groupCtrl.GetGroupByID)
-			protected.POST("/groups/:id/add-member", groupCtrl.AddMember)
-			protected.DELETE("/groups/:id/remove-member/:userID", groupCtrl.RemoveMember)
-			protected.GET("/groups/:id/members", groupCtrl.GetGroupMembers)
+			protected.GET("/groups/:id", groupMember, groupCtrl.GetGroupByID)
+			protected.POST("/groups/:id/add-member", groupAdmin, groupCtrl.AddMember)
+			protected.DELETE("/groups/:id/remove-member/:userID", groupAdmin, groupCtrl.RemoveMember)
+			protected.POST("/groups/:id/leave", groupCtrl.LeaveGroup)
+			protected.POST("/groups/:id/invites", groupAdmin, groupCtrl.CreateInvite)
+			protected.POST("/groups/join/:code", groupCtrl.JoinByInvite)
+			protected.POST("/groups/:id/join", groupCtrl.JoinGroup)
+			protected.GET("/groups/:id/requests", groupAdmin, groupCtrl.GetJoinRequests)
+			protected.POST("/groups/:id/requests/:userID/approve", groupAdmin, groupCtrl.ApproveJoinRequest)
+			protected.POST("/groups/:id/requests/:userID/reject", groupAdmin, groupCtrl.RejectJoinRequest)
+			protected.GET("/groups/:id/pins", groupMember, groupCtrl.GetPinnedMessages)
+			protected.POST("/groups/:id/pins", groupAdmin, groupCtrl.PinMessage)
+			protected.DELETE("/groups/:id/pins/:messageID", groupAdmin, groupCtrl.UnpinMessage)
+			protected.GET("/groups/:id/members", groupMember, groupCtrl.GetGroupMembers)
+			protected.PATCH("/groups/:id/members/:userID/role", groupAdmin, groupCtrl.UpdateMemberRole)
+			protected.POST("/groups/:id/avatar", groupAdmin, groupCtrl.UploadAvatar)
 			protected.DELETE("/groups/:id", groupCtrl.DeleteGroup)
 
 			// Files
 			protected.POST("/files/upload", fileCtrl.UploadFile)
 			protected.GET("/files", fileCtrl.GetUserFiles)
 			protected.GET("/files/:id", fileCtrl.GetFile)
+			protected.GET("/files/:id/download", fileCtrl.DownloadFile)
 			protected.DELETE("/files/:id", fileCtrl.DeleteFile)
+
+			// Calls
+			protected.POST("/calls", callCtrl.InitiateCall)
+			protected.GET("/calls/history", callCtrl.GetCallHistory)
+			protected.GET("/calls/:id", callCtrl.GetCall)
+			protected.POST("/calls/:id/accept", callCtrl.AcceptCall)
+			protected.POST("/calls/:id/reject", callCtrl.RejectCall)
+			protected.POST("/calls/:id/end", callCtrl.EndCall)
+			protected.POST("/calls/:id/join", callCtrl.JoinCall)
+			protected.POST("/calls/:id/leave", callCtrl.LeaveCall)
+			protected.GET("/calls/:id/participants", callCtrl.GetCallParticipants)
+
+			// Push notifications
+			protected.GET("/push/vapid-public-key", pushCtrl.GetVAPIDPublicKey)
+			protected.POST("/push/subscribe", pushCtrl.Subscribe)
+			protected.DELETE("/push/subscribe", pushCtrl.Unsubscribe)
+
+			// Webhooks
+			protected.POST("/webhooks", webhookCtrl.CreateWebhook)
+			protected.GET("/webhooks", webhookCtrl.GetWebhooks)
+			protected.GET("/webhooks/:id", webhookCtrl.GetWebhook)
+			protected.PUT("/webhooks/:id", webhookCtrl.UpdateWebhook)
+			protected.DELETE("/webhooks/:id", webhookCtrl.DeleteWebhook)
+			protected.GET("/webhooks/:id/dead-letters", webhookCtrl.GetDeadLetters)
+
+			// Bot tokens
+			protected.POST("/bot-tokens", botCtrl.CreateBotToken)
+			protected.GET("/bot-tokens", botCtrl.GetBotTokens)
+			protected.DELETE("/bot-tokens/:id", botCtrl.RevokeBotToken)
+
+			// Admin
+			admin := protected.Group("/admin")
+			admin.Use(middlewares.RequireAdmin())
+			admin.POST("/users/:id/disconnect", adminCtrl.DisconnectUser)
+			admin.POST("/broadcast", broadcastLimit, adminCtrl.Broadcast)
+			admin.GET("/reports", adminCtrl.GetReports)
+			admin.PUT("/reports/:id", adminCtrl.ReviewReport)
 		}
 	}
 
-	// WebSocket endpoint (authentication via query parameter)
+	// WebSocket endpoint (authentication via header, subprotocol or query parameter)
 	router.GET("/ws", wsCtrl.HandleWebSocket)
 
-	// Serve uploaded files
-	router.Static("/uploads", "./uploads")
+	// Prometheus metrics, only when enabled in the configuration
+	if cfg := config.GetConfig().Metrics; cfg.Enabled {
+		router.GET("/metrics", middlewares.MetricsAuth(cfg.Token), gin.WrapH(metrics.Handler()))
+	}
 }
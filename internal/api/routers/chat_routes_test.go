@@ -0,0 +1,524 @@
+package routers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"web-api/internal/api/controllers"
+	"web-api/internal/api/services"
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/metrics"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/response"
+	"web-api/internal/pkg/testutil"
+	"web-api/internal/pkg/websocket"
+)
+
+// newTestRouter sets up the chat routes on a bare engine
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	SetupChatRoutes(router)
+	return router
+}
+
+// do sends a JSON request with a bearer token and decodes the data of the
+// response into out, if given
+func do(t *testing.T, router *gin.Engine, method, path, token string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatalf("encode body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if out != nil {
+		envelope := struct {
+			Data interface{} `json:"data"`
+		}{Data: out}
+		if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("decode %s %s response: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+// mintBotToken creates a bot token for the user, limited to the groups
+func mintBotToken(t *testing.T, router *gin.Engine, user *models.User, groupIDs ...uint) (uint, string) {
+	t.Helper()
+
+	var minted struct {
+		BotToken models.BotToken `json:"bot_token"`
+		Token    string          `json:"token"`
+	}
+	status := do(t, router, http.MethodPost, "/api/bot-tokens", testutil.Token(t, user),
+		map[string]interface{}{"name": "bot", "group_ids": groupIDs}, &minted)
+	if status != http.StatusCreated {
+		t.Fatalf("mint bot token: status %d", status)
+	}
+	return minted.BotToken.ID, minted.Token
+}
+
+func TestBotPostsToGroupAndMembersReceiveIt(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	bobEvents := testutil.Subscribe(t, bob.ID)
+
+	_, botToken := mintBotToken(t, router, alice, group.ID)
+
+	var message models.GroupMessage
+	status := do(t, router, http.MethodPost, "/api/messages/group", botToken,
+		map[string]interface{}{"group_id": group.ID, "content": "from the bot"}, &message)
+	if status != http.StatusCreated {
+		t.Fatalf("bot send: status %d", status)
+	}
+
+	ev := testutil.NextEvent(t, bobEvents)
+	if ev.Event != "group_message" || uint(ev.Data["message_id"].(float64)) != message.ID {
+		t.Fatalf("member got %+v, want group_message %d", ev, message.ID)
+	}
+	if ev.Data["content"] != "from the bot" || uint(ev.Data["sender_id"].(float64)) != alice.ID {
+		t.Fatalf("member got %+v, want the bot's message sent as its owner", ev.Data)
+	}
+}
+
+func TestBotTokenScope(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	otherGroup := testutil.CreateGroup(t, alice)
+
+	tokenID, botToken := mintBotToken(t, router, alice, group.ID)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{"allowed group", http.MethodPost, "/api/messages/group",
+			map[string]interface{}{"group_id": group.ID, "content": "hi"}, http.StatusCreated},
+		{"read allowed group", http.MethodGet, fmt.Sprintf("/api/messages/group/%d", group.ID), nil, http.StatusOK},
+		{"other group", http.MethodPost, "/api/messages/group",
+			map[string]interface{}{"group_id": otherGroup.ID, "content": "hi"}, http.StatusForbidden},
+		{"private chat", http.MethodPost, "/api/messages/private",
+			map[string]interface{}{"receiver_id": bob.ID, "content": "hi"}, http.StatusForbidden},
+		{"endpoint outside the allowlist", http.MethodGet, "/api/groups", nil, http.StatusForbidden},
+		{"minting more tokens", http.MethodPost, "/api/bot-tokens",
+			map[string]interface{}{"name": "another"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := do(t, router, tt.method, tt.path, botToken, tt.body, nil); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	status := do(t, router, http.MethodDelete, fmt.Sprintf("/api/bot-tokens/%d", tokenID), testutil.Token(t, alice), nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("revoke: status %d", status)
+	}
+	status = do(t, router, http.MethodPost, "/api/messages/group", botToken,
+		map[string]interface{}{"group_id": group.ID, "content": "after revoking"}, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestGroupMessageSeenBy(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	carol, dave := testutil.CreateUser(t, "carol"), testutil.CreateUser(t, "dave")
+	outsider := testutil.CreateUser(t, "outsider")
+	// Three members besides the sender: bob and carol read, dave does not
+	group := testutil.CreateGroup(t, alice, bob, carol, dave)
+
+	var message models.GroupMessage
+	status := do(t, router, http.MethodPost, "/api/messages/group", testutil.Token(t, alice),
+		map[string]interface{}{"group_id": group.ID, "content": "read me"}, &message)
+	if status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	for _, reader := range []*models.User{bob, carol} {
+		if _, _, err := services.Chat.MarkGroupMessageRead(context.Background(), message.ID, group.ID, reader.ID); err != nil {
+			t.Fatalf("MarkGroupMessageRead: %v", err)
+		}
+		// The sender hears of each reader as they read
+		for {
+			ev := testutil.NextEvent(t, aliceEvents)
+			if ev.Event != "seen_by" {
+				continue
+			}
+			if uint(ev.Data["user_id"].(float64)) != reader.ID || ev.Data["read_at"] == nil {
+				t.Fatalf("seen_by %+v, want %s's read", ev.Data, reader.Username)
+			}
+			break
+		}
+	}
+
+	path := fmt.Sprintf("/api/messages/group/%d/seen-by", message.ID)
+	var seen struct {
+		SeenBy []services.MessageReader `json:"seen_by"`
+		Count  int                      `json:"count"`
+	}
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, dave), nil, &seen); status != http.StatusOK {
+		t.Fatalf("seen-by: status %d", status)
+	}
+	if seen.Count != 2 || len(seen.SeenBy) != 2 || seen.SeenBy[0].User.ID != bob.ID || seen.SeenBy[1].User.ID != carol.ID {
+		t.Fatalf("seen by %+v, want bob then carol", seen)
+	}
+	if seen.SeenBy[0].ReadAt.IsZero() || seen.SeenBy[1].ReadAt.Before(seen.SeenBy[0].ReadAt) {
+		t.Fatalf("read times %v, %v; want them set, earliest first", seen.SeenBy[0].ReadAt, seen.SeenBy[1].ReadAt)
+	}
+
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, outsider), nil, nil); status != http.StatusForbidden {
+		t.Errorf("outsider: status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestLoggedOutTokenIsRejected(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+
+	credentials := map[string]interface{}{"email": "alice@example.com", "password": "secret-password"}
+	if status := do(t, router, http.MethodPost, "/api/register", "",
+		map[string]interface{}{"username": "alice", "email": credentials["email"], "password": credentials["password"]}, nil); status != http.StatusCreated {
+		t.Fatalf("register: status %d", status)
+	}
+	var phone, laptop services.AuthResponse
+	for _, session := range []*services.AuthResponse{&phone, &laptop} {
+		if status := do(t, router, http.MethodPost, "/api/login", "", credentials, session); status != http.StatusOK {
+			t.Fatalf("login: status %d", status)
+		}
+	}
+
+	if status := do(t, router, http.MethodPost, "/api/logout", phone.Token,
+		map[string]interface{}{"refresh_token": phone.RefreshToken}, nil); status != http.StatusOK {
+		t.Fatalf("logout: status %d", status)
+	}
+
+	if status := do(t, router, http.MethodGet, "/api/profile", phone.Token, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("logged out access token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := do(t, router, http.MethodPost, "/api/refresh", "",
+		map[string]interface{}{"refresh_token": phone.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Errorf("logged out refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Other sessions stay signed in
+	if status := do(t, router, http.MethodGet, "/api/profile", laptop.Token, nil, nil); status != http.StatusOK {
+		t.Errorf("other session: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+// registerMetrics adds the collectors to the registry once per test binary
+var registerMetrics sync.Once
+
+func TestMetricsEndpoint(t *testing.T) {
+	testutil.Setup(t)
+	registerMetrics.Do(metrics.Register)
+	if err := metrics.InstrumentDB(database.GetDB()); err != nil {
+		t.Fatalf("InstrumentDB: %v", err)
+	}
+
+	// Off unless the configuration opts in
+	if status := do(t, newTestRouter(t), http.MethodGet, "/metrics", "", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("disabled: status %d, want %d", status, http.StatusNotFound)
+	}
+
+	config.Config.Metrics = config.MetricsConfiguration{Enabled: true, Token: "scraper-token"}
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	if status := do(t, router, http.MethodPost, "/api/messages/private", testutil.Token(t, alice),
+		map[string]interface{}{"receiver_id": bob.ID, "content": "count me"}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+
+	if status := do(t, router, http.MethodGet, "/metrics", "wrong-token", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("wrong token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scraper-token")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: status %d", rec.Code)
+	}
+	for _, want := range []string{
+		"# TYPE ws_active_connections gauge",
+		`db_query_duration_seconds_count{operation="create"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("scrape has no %s", want)
+		}
+	}
+}
+
+func TestErrorsAnswerWithTheEnvelope(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   *models.User
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown receiver", http.MethodPost, "/api/messages/private", alice,
+			`{"receiver_id":9999,"content":"hi"}`, http.StatusNotFound, response.CodeReceiverNotFound},
+		{"malformed body", http.MethodPost, "/api/messages/private", alice,
+			`{"receiver_id":`, http.StatusBadRequest, response.CodeInvalidRequest},
+		{"member deletes the group", http.MethodDelete, fmt.Sprintf("/api/groups/%d", group.ID), bob,
+			"", http.StatusForbidden, response.CodeOwnerRequired},
+		{"owner leaves", http.MethodPost, fmt.Sprintf("/api/groups/%d/leave", group.ID), alice,
+			"", http.StatusForbidden, response.CodeOwnerProtected},
+		{"reply from another conversation", http.MethodPost, "/api/messages/private", bob,
+			`{"receiver_id":` + fmt.Sprint(alice.ID) + `,"content":"hi","reply_to_id":9999}`, http.StatusBadRequest, response.CodeInvalidReply},
+		{"unknown invite", http.MethodPost, "/api/groups/join/no-such-code", bob,
+			"", http.StatusNotFound, response.CodeInviteNotFound},
+		{"unknown file", http.MethodGet, "/api/files/9999", alice,
+			"", http.StatusNotFound, response.CodeFileNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+testutil.Token(t, tt.user))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			var envelope response.CommonResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("decode %s: %v", rec.Body, err)
+			}
+			if rec.Code != tt.status || envelope.Code != tt.status || envelope.Error != tt.code || envelope.Message == "" {
+				t.Fatalf("status %d, envelope %+v; want %d with code %s", rec.Code, envelope, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestAdminDisconnectsUser(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	prev := controllers.Hub
+	controllers.Hub = websocket.NewHub(services.Chat, nil)
+	t.Cleanup(func() { controllers.Hub = prev })
+	admin, mod, target := testutil.CreateUser(t, "admin"), testutil.CreateUser(t, "mod"), testutil.CreateUser(t, "target")
+	if err := database.GetDB().Model(admin).Update("admin", true).Error; err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	targetEvents := testutil.Subscribe(t, target.ID)
+	path := fmt.Sprintf("/api/admin/users/%d/disconnect", target.ID)
+	body := map[string]string{"reason": "spamming"}
+
+	if status := do(t, router, http.MethodPost, path, "", body, nil); status != http.StatusUnauthorized {
+		t.Fatalf("without a token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := do(t, router, http.MethodPost, path, testutil.Token(t, mod), body, nil); status != http.StatusForbidden {
+		t.Fatalf("as a non-admin: status %d, want %d", status, http.StatusForbidden)
+	}
+	testutil.NoEvent(t, targetEvents)
+
+	if status := do(t, router, http.MethodPost, "/api/admin/users/999999/disconnect", testutil.Token(t, admin), body, nil); status != http.StatusNotFound {
+		t.Fatalf("unknown user: status %d, want %d", status, http.StatusNotFound)
+	}
+
+	// Every instance hears to close the target's connections
+	if status := do(t, router, http.MethodPost, path, testutil.Token(t, admin), body, nil); status != http.StatusOK {
+		t.Fatalf("as an admin: status %d, want %d", status, http.StatusOK)
+	}
+	if ev := testutil.NextEvent(t, targetEvents); ev.Event != "ws_disconnect" || ev.Data["reason"] != "spamming" {
+		t.Fatalf("target's channel got %+v, want ws_disconnect for spamming", ev)
+	}
+}
+
+func TestAdminBroadcastIsRateLimited(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.RateLimit.Broadcast = config.RateLimitRule{RPS: 1, Burst: 2}
+	router := newTestRouter(t)
+	admin, user := testutil.CreateUser(t, "admin"), testutil.CreateUser(t, "user")
+	if err := database.GetDB().Model(admin).Update("admin", true).Error; err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	body := map[string]interface{}{"content": "maintenance at noon"}
+
+	if status := do(t, router, http.MethodPost, "/api/admin/broadcast", testutil.Token(t, user), body, nil); status != http.StatusForbidden {
+		t.Fatalf("as a non-admin: status %d, want %d", status, http.StatusForbidden)
+	}
+	unknownGroup := map[string]interface{}{"content": "hi", "group_id": 999999}
+	if status := do(t, router, http.MethodPost, "/api/admin/broadcast", testutil.Token(t, admin), unknownGroup, nil); status != http.StatusNotFound {
+		t.Fatalf("unknown group: status %d, want %d", status, http.StatusNotFound)
+	}
+
+	var sent map[string]interface{}
+	if status := do(t, router, http.MethodPost, "/api/admin/broadcast", testutil.Token(t, admin), body, &sent); status != http.StatusOK {
+		t.Fatalf("as an admin: status %d, want %d", status, http.StatusOK)
+	}
+	if sent["id"] == nil || sent["content"] != body["content"] {
+		t.Fatalf("answered %v, want the sent system message", sent)
+	}
+
+	// The burst of 2 was used up by the unknown group and the first broadcast
+	if status := do(t, router, http.MethodPost, "/api/admin/broadcast", testutil.Token(t, admin), body, nil); status != http.StatusTooManyRequests {
+		t.Fatalf("third broadcast in a row: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestGroupMembersHideLastSeen(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	if err := database.GetDB().Model(bob).Updates(map[string]interface{}{
+		"last_seen": time.Now(), "last_seen_visibility": models.LastSeenNobody, "admin": true,
+	}).Error; err != nil {
+		t.Fatalf("update bob: %v", err)
+	}
+
+	var got struct {
+		Members []map[string]interface{} `json:"members"`
+	}
+	path := fmt.Sprintf("/api/groups/%d/members", group.ID)
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, alice), nil, &got); status != http.StatusOK {
+		t.Fatalf("members: status %d", status)
+	}
+	if len(got.Members) != 2 {
+		t.Fatalf("got %d members, want 2", len(got.Members))
+	}
+	for _, member := range got.Members {
+		user, _ := member["user"].(map[string]interface{})
+		if user == nil {
+			t.Fatalf("member %v has no user", member)
+		}
+		for _, field := range []string{"last_seen", "last_seen_visibility", "admin"} {
+			if value, ok := user[field]; ok {
+				t.Errorf("member %v shows %s = %v", user["username"], field, value)
+			}
+		}
+	}
+}
+
+// The group services leave role checks to these routes, so each of them
+// must turn away whoever lacks the role
+func TestGroupRoutesCheckRoles(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	owner, member, outsider := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "member"), testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, owner, member)
+
+	routes := []struct {
+		method string
+		path   string
+		role   string
+	}{
+		{http.MethodGet, "/api/groups/%d", models.GroupRoleMember},
+		{http.MethodGet, "/api/groups/%d/members", models.GroupRoleMember},
+		{http.MethodGet, "/api/groups/%d/pins", models.GroupRoleMember},
+		{http.MethodPost, "/api/groups/%d/add-member", models.GroupRoleAdmin},
+		{http.MethodDelete, "/api/groups/%d/remove-member/1", models.GroupRoleAdmin},
+		{http.MethodPost, "/api/groups/%d/invites", models.GroupRoleAdmin},
+		{http.MethodGet, "/api/groups/%d/requests", models.GroupRoleAdmin},
+		{http.MethodPost, "/api/groups/%d/requests/1/approve", models.GroupRoleAdmin},
+		{http.MethodPost, "/api/groups/%d/requests/1/reject", models.GroupRoleAdmin},
+		{http.MethodPost, "/api/groups/%d/pins", models.GroupRoleAdmin},
+		{http.MethodDelete, "/api/groups/%d/pins/1", models.GroupRoleAdmin},
+		{http.MethodPatch, "/api/groups/%d/members/1/role", models.GroupRoleAdmin},
+		{http.MethodPost, "/api/groups/%d/avatar", models.GroupRoleAdmin},
+	}
+	errorCode := func(user *models.User, method, path string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testutil.Token(t, user))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var envelope response.CommonResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("decode %s: %v", rec.Body, err)
+		}
+		return rec.Code, envelope.Error
+	}
+
+	for _, route := range routes {
+		path := fmt.Sprintf(route.path, group.ID)
+		t.Run(route.method+" "+path, func(t *testing.T) {
+			if status, code := errorCode(outsider, route.method, path); status != http.StatusForbidden || code != response.CodeNotGroupMember {
+				t.Errorf("outsider: %d %s, want %d %s", status, code, http.StatusForbidden, response.CodeNotGroupMember)
+			}
+
+			status, code := errorCode(member, route.method, path)
+			if route.role == models.GroupRoleAdmin && (status != http.StatusForbidden || code != response.CodeAdminRequired) {
+				t.Errorf("member: %d %s, want %d %s", status, code, http.StatusForbidden, response.CodeAdminRequired)
+			}
+			if route.role == models.GroupRoleMember && status != http.StatusOK {
+				t.Errorf("member: %d %s, want access", status, code)
+			}
+		})
+	}
+}
+
+func TestMessageContextHidesOnlyMissingMessages(t *testing.T) {
+	testutil.Setup(t)
+	router := newTestRouter(t)
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	message, err := services.Chat.SendPrivateMessage(context.Background(), alice.ID, services.SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	path := fmt.Sprintf("/api/messages/%d/context", message.ID)
+
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, bob), nil, nil); status != http.StatusOK {
+		t.Fatalf("bob: status %d, want %d", status, http.StatusOK)
+	}
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, carol), nil, nil); status != http.StatusNotFound {
+		t.Fatalf("carol: status %d, want %d", status, http.StatusNotFound)
+	}
+
+	// A failing query is a server error, not a missing message
+	if err := database.GetDB().Migrator().DropTable(&models.MessageHidden{}); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	if status := do(t, router, http.MethodGet, path, testutil.Token(t, bob), nil, nil); status != http.StatusInternalServerError {
+		t.Fatalf("broken database: status %d, want %d", status, http.StatusInternalServerError)
+	}
+}
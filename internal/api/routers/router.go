@@ -7,6 +7,7 @@ import (
 
 	"web-api/internal/api/middlewares"
 	router_v1 "web-api/internal/api/routers/v1"
+	"web-api/internal/pkg/database"
 
 	"github.com/gin-gonic/gin"
 )
@@ -36,6 +37,7 @@ func Setup() *gin.Engine {
 	app.Use(middlewares.RequestLogger())
 	app.Use(middlewares.RecoveryHandler)
 	app.Use(middlewares.CORS())
+	app.Use(middlewares.QueryTimeout(database.QueryTimeout()))
 	app.NoMethod(middlewares.NoMethodHandler())
 	app.NoRoute(middlewares.NoRouteHandler())
 
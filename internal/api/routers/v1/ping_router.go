@@ -8,4 +8,5 @@ import (
 
 func PingRouter(router *gin.RouterGroup) {
 	router.GET("/ping", controllers.Common.Ping)
+	router.GET("/health", controllers.Common.Health)
 }
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/websocket"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// AdminService implements the site administration endpoints
+type AdminService struct{}
+
+var Admin = &AdminService{}
+
+// DisconnectUserRequest carries the reason an admin gives for dropping a
+// user's connections; it is sent to the client in the close frame
+type DisconnectUserRequest struct {
+	Reason string `json:"reason" binding:"max=100"`
+}
+
+// SystemMessageRequest is an announcement to the connected users, or only
+// to the members of GroupID when set
+type SystemMessageRequest struct {
+	Content string `json:"content" binding:"required,max=2000"`
+	GroupID uint   `json:"group_id"`
+}
+
+// BroadcastSystemMessage sends a system_message event to the connected
+// users. It is not stored as a chat message, only logged, and users who
+// are offline do not get it.
+func (s *AdminService) BroadcastSystemMessage(ctx context.Context, adminID uint, req SystemMessageRequest) (map[string]interface{}, error) {
+	var userIDs []uint
+	if req.GroupID != 0 {
+		var group models.Group
+		if err := database.GetDB().WithContext(ctx).Select("id").First(&group, req.GroupID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errs.ErrGroupNotFound
+			}
+			return nil, err
+		}
+
+		memberIDs, err := Group.getMemberIDs(ctx, req.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = memberIDs
+	}
+
+	data := map[string]interface{}{
+		"id":         uuid.New().String(),
+		"content":    req.Content,
+		"created_at": time.Now(),
+	}
+	if req.GroupID != 0 {
+		data["group_id"] = req.GroupID
+	}
+
+	// An empty list would address everyone, so a group without members
+	// gets nothing
+	if req.GroupID == 0 || len(userIDs) > 0 {
+		if err := websocket.PublishSystemMessage(data, userIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Infof("Admin %d broadcast system message %s (group %d): %q", adminID, data["id"], req.GroupID, req.Content)
+	return data, nil
+}
+
+// maxReportPage bounds one page of message reports
+const maxReportPage = 100
+
+// ReviewReportRequest is an admin's verdict on a message report
+type ReviewReportRequest struct {
+	Status models.ReportStatus `json:"status" binding:"required,oneof=open resolved dismissed"`
+}
+
+// ListReports returns message reports, newest first, optionally only those
+// with status. Each report carries the reported message as stored, even if
+// it was since deleted, so admins can judge it. Deleting a group deletes the
+// reports of its messages with them.
+func (s *AdminService) ListReports(ctx context.Context, status models.ReportStatus, limit, offset int) ([]models.MessageReport, int64, error) {
+	if limit <= 0 || limit > maxReportPage {
+		limit = maxReportPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	query := db.Model(&models.MessageReport{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var reports []models.MessageReport
+	if err := query.Preload("Reporter").
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&reports).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var privateIDs, groupIDs []uint
+	for _, report := range reports {
+		if report.MessageType == models.ChatTypeGroup {
+			groupIDs = append(groupIDs, report.MessageID)
+		} else {
+			privateIDs = append(privateIDs, report.MessageID)
+		}
+	}
+
+	found := make(map[models.ChatType]map[uint]interface{}, 2)
+
+	var privateMessages []models.PrivateMessage
+	if len(privateIDs) > 0 {
+		if err := db.Unscoped().Where("id IN ?", privateIDs).
+			Preload("Sender").
+			Preload("Receiver").
+			Preload("File").
+			Find(&privateMessages).Error; err != nil {
+			return nil, 0, err
+		}
+	}
+	found[models.ChatTypePrivate] = make(map[uint]interface{}, len(privateMessages))
+	for i := range privateMessages {
+		found[models.ChatTypePrivate][privateMessages[i].ID] = &privateMessages[i]
+	}
+
+	var groupMessages []models.GroupMessage
+	if len(groupIDs) > 0 {
+		if err := db.Unscoped().Where("id IN ?", groupIDs).
+			Preload("Sender").
+			Preload("Group").
+			Preload("File").
+			Find(&groupMessages).Error; err != nil {
+			return nil, 0, err
+		}
+	}
+	found[models.ChatTypeGroup] = make(map[uint]interface{}, len(groupMessages))
+	for i := range groupMessages {
+		found[models.ChatTypeGroup][groupMessages[i].ID] = &groupMessages[i]
+	}
+
+	for i := range reports {
+		if message, ok := found[reports[i].MessageType][reports[i].MessageID]; ok {
+			reports[i].Message = message
+		}
+	}
+
+	return reports, total, nil
+}
+
+// ReviewReport sets the triage status of a message report and records the
+// admin who reviewed it
+func (s *AdminService) ReviewReport(ctx context.Context, adminID, reportID uint, req ReviewReportRequest) (*models.MessageReport, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var report models.MessageReport
+	if err := db.First(&report, reportID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrReportNotFound
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":      req.Status,
+		"reviewed_by": adminID,
+		"reviewed_at": now,
+	}
+	if req.Status == models.ReportStatusOpen {
+		updates["reviewed_by"] = nil
+		updates["reviewed_at"] = nil
+	}
+	if err := db.Model(&report).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Admin %d marked report %d as %s", adminID, report.ID, req.Status)
+	return &report, nil
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+// maxBotTokensPerUser bounds the live bot tokens one user can hold
+const maxBotTokensPerUser = 20
+
+// BotService mints and revokes bot tokens
+type BotService struct{}
+
+var Bot = &BotService{}
+
+// CreateBotTokenRequest mints a bot token
+type CreateBotTokenRequest struct {
+	Name      string `json:"name" binding:"required,max=100"`
+	GroupIDs  []uint `json:"group_ids"`  // Limit the token to these groups; empty allows all of the user's groups and private chats
+	ExpiresIn int    `json:"expires_in"` // Seconds until the token expires; 0 never expires
+}
+
+// CreateBotToken mints a bot token for the user and returns it with the
+// signed token, which is not stored and cannot be shown again
+func (s *BotService) CreateBotToken(userID uint, req CreateBotTokenRequest) (*models.BotToken, string, error) {
+	if req.ExpiresIn < 0 {
+		return nil, "", errors.New("expires_in cannot be negative")
+	}
+
+	db := database.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, "", err
+	}
+
+	var count int64
+	if err := db.Model(&models.BotToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Count(&count).Error; err != nil {
+		return nil, "", err
+	}
+	if count >= maxBotTokensPerUser {
+		return nil, "", errors.New("too many bot tokens, revoke one first")
+	}
+
+	// A token can only be limited to groups its owner is in
+	if len(req.GroupIDs) > 0 {
+		var memberOf int64
+		if err := db.Model(&models.GroupMember{}).
+			Where("user_id = ? AND group_id IN ?", userID, req.GroupIDs).
+			Distinct("group_id").
+			Count(&memberOf).Error; err != nil {
+			return nil, "", err
+		}
+		if int(memberOf) != len(uniqueIDs(req.GroupIDs)) {
+			return nil, "", errs.ErrNotMemberOfAll
+		}
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	signed, tokenID, err := utils.GenerateBotToken(user.ID, user.Username, user.Email, ttl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := models.BotToken{
+		UserID:   userID,
+		Name:     req.Name,
+		TokenID:  tokenID,
+		GroupIDs: uniqueIDs(req.GroupIDs),
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return nil, "", err
+	}
+
+	return &token, signed, nil
+}
+
+// GetBotTokens lists the user's bot tokens, revoked ones included
+func (s *BotService) GetBotTokens(userID uint) ([]models.BotToken, error) {
+	var tokens []models.BotToken
+	err := database.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeBotToken revokes one of the user's bot tokens
+func (s *BotService) RevokeBotToken(userID, tokenID uint) error {
+	db := database.GetDB()
+
+	var token models.BotToken
+	if err := db.Where("id = ? AND user_id = ?", tokenID, userID).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrBotTokenNotFound
+		}
+		return err
+	}
+	if token.RevokedAt != nil {
+		return errs.ErrBotTokenRevoked
+	}
+
+	return db.Model(&token).Update("revoked_at", time.Now()).Error
+}
+
+// revokeAllBotTokens revokes every live bot token of a user
+func (s *BotService) revokeAllBotTokens(userID uint) error {
+	return database.GetDB().Model(&models.BotToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// uniqueIDs returns ids without duplicates, keeping their order
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,684 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/websocket"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRingTimeout = 45 * time.Second
+	missedCallInterval = 5 * time.Second
+)
+
+type CallService struct{}
+
+var Call = &CallService{}
+
+// InitiateCallRequest represents a call initiation request
+type InitiateCallRequest struct {
+	Type       models.CallType `json:"type" binding:"required,oneof=private group"`
+	ReceiverID *uint           `json:"receiver_id"`
+	GroupID    *uint           `json:"group_id"`
+	OfferSDP   string          `json:"sdp"`
+}
+
+// AnswerCallRequest represents a call answer request
+type AnswerCallRequest struct {
+	AnswerSDP string `json:"sdp"`
+}
+
+// InitiateCall creates a call, sends the offer to the callee(s) and starts ringing
+func (s *CallService) InitiateCall(initiatorID uint, req InitiateCallRequest) (*models.VideoCall, error) {
+	db := database.GetDB()
+
+	call := models.VideoCall{
+		InitiatorID: initiatorID,
+		Type:        req.Type,
+		Status:      models.CallStatusInitiating,
+		OfferSDP:    req.OfferSDP,
+	}
+
+	switch req.Type {
+	case models.CallTypePrivate:
+		if req.ReceiverID == nil {
+			return nil, errors.New("private call must have receiver_id")
+		}
+		if *req.ReceiverID == initiatorID {
+			return nil, errors.New("cannot call yourself")
+		}
+
+		var receiver models.User
+		if err := db.First(&receiver, *req.ReceiverID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errs.ErrReceiverNotFound
+			}
+			return nil, err
+		}
+		call.ReceiverID = req.ReceiverID
+
+	case models.CallTypeGroup:
+		if req.GroupID == nil {
+			return nil, errors.New("group call must have group_id")
+		}
+
+		var member models.GroupMember
+		if err := db.Where("group_id = ? AND user_id = ?", *req.GroupID, initiatorID).First(&member).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errs.ErrNotGroupMember
+			}
+			return nil, err
+		}
+		call.GroupID = req.GroupID
+
+	default:
+		return nil, errors.New("invalid call type")
+	}
+
+	if err := db.Create(&call).Error; err != nil {
+		return nil, err
+	}
+
+	db.Preload("Initiator").First(&call, call.ID)
+
+	s.notifyParties(&call, initiatorID, "call_offer", map[string]interface{}{
+		"call_id":         call.ID,
+		"call_type":       string(call.Type),
+		"caller_id":       call.InitiatorID,
+		"caller_username": call.Initiator.Username,
+		"group_id":        call.GroupID,
+		"sdp":             call.OfferSDP,
+	})
+
+	// Candidates trickled before this point are buffered until the answer
+	if err := db.Model(&call).Update("status", models.CallStatusRinging).Error; err != nil {
+		return nil, err
+	}
+
+	if call.Type == models.CallTypeGroup {
+		if _, err := s.activateParticipant(call.ID, initiatorID); err != nil {
+			return nil, err
+		}
+	}
+
+	s.emitWebhook(&call, models.WebhookEventCallStarted, map[string]interface{}{
+		"call_id":      call.ID,
+		"call_type":    string(call.Type),
+		"initiator_id": call.InitiatorID,
+		"receiver_id":  call.ReceiverID,
+		"group_id":     call.GroupID,
+		"created_at":   call.CreatedAt,
+	})
+
+	return &call, nil
+}
+
+// InitiateCallFromEvent initiates a call requested over WebSocket
+func (s *CallService) InitiateCallFromEvent(initiatorID uint, data map[string]interface{}) (*models.VideoCall, error) {
+	var req InitiateCallRequest
+	if err := decodeEventData(data, &req); err != nil {
+		return nil, err
+	}
+
+	if req.Type == "" {
+		req.Type = models.CallTypePrivate
+		if req.GroupID != nil {
+			req.Type = models.CallTypeGroup
+		}
+	}
+
+	return s.InitiateCall(initiatorID, req)
+}
+
+// AcceptCall answers a ringing call and relays the answer SDP to the caller
+func (s *CallService) AcceptCall(callID, userID uint, answerSDP string) (*models.VideoCall, error) {
+	db := database.GetDB()
+
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if call.InitiatorID == userID {
+		return nil, errors.New("cannot accept your own call")
+	}
+
+	if call.Status != models.CallStatusRinging {
+		return nil, errs.ErrCallNotRinging
+	}
+
+	now := time.Now()
+	if err := db.Model(call).Updates(map[string]interface{}{
+		"status":     models.CallStatusConnected,
+		"started_at": now,
+		"answer_sdp": answerSDP,
+	}).Error; err != nil {
+		return nil, err
+	}
+	call.Status = models.CallStatusConnected
+	call.StartedAt = &now
+	call.AnswerSDP = answerSDP
+
+	if call.Type == models.CallTypeGroup {
+		if _, err := s.activateParticipant(call.ID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	websocket.PublishToUser(call.InitiatorID, "call_answer", map[string]interface{}{
+		"call_id": call.ID,
+		"user_id": userID,
+		"sdp":     answerSDP,
+	})
+
+	s.flushICECandidates(call.ID)
+
+	return call, nil
+}
+
+// RejectCall declines a ringing call
+func (s *CallService) RejectCall(callID, userID uint) (*models.VideoCall, error) {
+	db := database.GetDB()
+
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if call.InitiatorID == userID {
+		return nil, errors.New("cannot reject your own call")
+	}
+
+	if call.Status != models.CallStatusRinging {
+		return nil, errs.ErrCallNotRinging
+	}
+
+	// A group call keeps ringing for the other members
+	if call.Type == models.CallTypeGroup {
+		websocket.PublishToUser(call.InitiatorID, "call_reject", map[string]interface{}{
+			"call_id": call.ID,
+			"user_id": userID,
+		})
+		return call, nil
+	}
+
+	now := time.Now()
+	if err := db.Model(call).Updates(map[string]interface{}{
+		"status":   models.CallStatusRejected,
+		"ended_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	call.Status = models.CallStatusRejected
+	call.EndedAt = &now
+
+	websocket.PublishToUser(call.InitiatorID, "call_reject", map[string]interface{}{
+		"call_id": call.ID,
+		"user_id": userID,
+	})
+
+	return call, nil
+}
+
+// EndCall hangs up a call, computing its duration if it was connected
+func (s *CallService) EndCall(callID, userID uint) (*models.VideoCall, error) {
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if call.Status != models.CallStatusRinging && call.Status != models.CallStatusConnected {
+		return nil, errs.ErrCallEnded
+	}
+
+	if err := s.finishCall(call, userID); err != nil {
+		return nil, err
+	}
+
+	return call, nil
+}
+
+// JoinCall adds the user as an active participant of a group call
+func (s *CallService) JoinCall(callID, userID uint) (*models.CallParticipant, error) {
+	db := database.GetDB()
+
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if call.Type != models.CallTypeGroup {
+		return nil, errors.New("only group calls can be joined")
+	}
+
+	if call.Status != models.CallStatusRinging && call.Status != models.CallStatusConnected {
+		return nil, errs.ErrCallEnded
+	}
+
+	participant, err := s.activateParticipant(call.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if call.Status == models.CallStatusRinging {
+		now := time.Now()
+		if err := db.Model(call).Updates(map[string]interface{}{
+			"status":     models.CallStatusConnected,
+			"started_at": now,
+		}).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	db.Preload("User").First(participant, participant.ID)
+
+	s.notifyActiveParticipants(call.ID, userID, "participant_joined", map[string]interface{}{
+		"call_id":   call.ID,
+		"user_id":   userID,
+		"username":  participant.User.Username,
+		"joined_at": participant.JoinedAt,
+	})
+
+	return participant, nil
+}
+
+// LeaveCall marks the user as no longer active in a group call. The call
+// ends once its last active participant has left.
+func (s *CallService) LeaveCall(callID, userID uint) error {
+	db := database.GetDB()
+
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return err
+	}
+
+	var participant models.CallParticipant
+	if err := db.Where("call_id = ? AND user_id = ? AND is_active = ?", callID, userID, true).First(&participant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrNotInCall
+		}
+		return err
+	}
+
+	now := time.Now()
+	if err := db.Model(&participant).Updates(map[string]interface{}{
+		"left_at":   now,
+		"is_active": false,
+	}).Error; err != nil {
+		return err
+	}
+
+	s.notifyActiveParticipants(call.ID, userID, "participant_left", map[string]interface{}{
+		"call_id": call.ID,
+		"user_id": userID,
+		"left_at": now,
+	})
+
+	var activeCount int64
+	if err := db.Model(&models.CallParticipant{}).
+		Where("call_id = ? AND is_active = ?", callID, true).
+		Count(&activeCount).Error; err != nil {
+		return err
+	}
+
+	if activeCount == 0 && call.Type == models.CallTypeGroup &&
+		(call.Status == models.CallStatusRinging || call.Status == models.CallStatusConnected) {
+		return s.finishCall(call, userID)
+	}
+
+	return nil
+}
+
+// GetParticipants lists everyone who has joined a call
+func (s *CallService) GetParticipants(callID, userID uint) ([]models.CallParticipant, error) {
+	db := database.GetDB()
+
+	if _, err := s.getCallForParty(callID, userID); err != nil {
+		return nil, err
+	}
+
+	var participants []models.CallParticipant
+	err := db.Where("call_id = ?", callID).
+		Preload("User").
+		Order("joined_at ASC").
+		Find(&participants).Error
+
+	return participants, err
+}
+
+// activateParticipant creates or reactivates the participant row of a user
+func (s *CallService) activateParticipant(callID, userID uint) (*models.CallParticipant, error) {
+	db := database.GetDB()
+
+	now := time.Now()
+
+	var participant models.CallParticipant
+	err := db.Where("call_id = ? AND user_id = ?", callID, userID).First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		participant = models.CallParticipant{
+			CallID:   callID,
+			UserID:   userID,
+			JoinedAt: &now,
+			IsActive: true,
+		}
+		if err := db.Create(&participant).Error; err != nil {
+			return nil, err
+		}
+		return &participant, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if participant.IsActive {
+		return nil, errs.ErrAlreadyInCall
+	}
+
+	if err := db.Model(&participant).Updates(map[string]interface{}{
+		"joined_at": now,
+		"left_at":   nil,
+		"is_active": true,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return &participant, nil
+}
+
+// notifyActiveParticipants sends a call event to every active participant
+// except the acting user
+func (s *CallService) notifyActiveParticipants(callID, actorID uint, event string, data map[string]interface{}) {
+	db := database.GetDB()
+
+	var userIDs []uint
+	if err := db.Model(&models.CallParticipant{}).
+		Where("call_id = ? AND is_active = ?", callID, true).
+		Pluck("user_id", &userIDs).Error; err != nil {
+		logrus.Errorf("Failed to load participants of call %d: %v", callID, err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if userID != actorID {
+			websocket.PublishToUser(userID, event, data)
+		}
+	}
+}
+
+// finishCall marks a call as ended and notifies its parties
+func (s *CallService) finishCall(call *models.VideoCall, actorID uint) error {
+	db := database.GetDB()
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":   models.CallStatusEnded,
+		"ended_at": now,
+	}
+	if call.StartedAt != nil {
+		duration := int(now.Sub(*call.StartedAt).Seconds())
+		updates["duration"] = duration
+		call.Duration = &duration
+	}
+
+	if err := db.Model(call).Updates(updates).Error; err != nil {
+		return err
+	}
+	call.Status = models.CallStatusEnded
+	call.EndedAt = &now
+
+	// Anyone still in a group call is dropped with it
+	if err := db.Model(&models.CallParticipant{}).
+		Where("call_id = ? AND is_active = ?", call.ID, true).
+		Updates(map[string]interface{}{"left_at": now, "is_active": false}).Error; err != nil {
+		return err
+	}
+
+	s.notifyParties(call, actorID, "call_end", map[string]interface{}{
+		"call_id":  call.ID,
+		"user_id":  actorID,
+		"duration": call.Duration,
+	})
+
+	s.emitWebhook(call, models.WebhookEventCallEnded, map[string]interface{}{
+		"call_id":   call.ID,
+		"call_type": string(call.Type),
+		"ended_by":  actorID,
+		"group_id":  call.GroupID,
+		"duration":  call.Duration,
+		"ended_at":  now,
+	})
+
+	return nil
+}
+
+// SaveICECandidate stores an ICE candidate sent by a call party
+func (s *CallService) SaveICECandidate(callID, userID uint, candidate string) error {
+	db := database.GetDB()
+
+	return db.Create(&models.ICECandidate{
+		CallID:    callID,
+		UserID:    userID,
+		Candidate: candidate,
+	}).Error
+}
+
+// CheckICERoute verifies that both users take part in the call and returns
+// its current status
+func (s *CallService) CheckICERoute(callID, fromUserID, targetUserID uint) (models.CallStatus, error) {
+	call, err := s.getCallForParty(callID, fromUserID)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.getCallForParty(callID, targetUserID); err != nil {
+		return "", errors.New("target user is not part of this call")
+	}
+
+	return call.Status, nil
+}
+
+// flushICECandidates delivers ICE candidates buffered before the call was ready
+func (s *CallService) flushICECandidates(callID uint) {
+	payloads, err := redis.PopICECandidates(callID)
+	if err != nil {
+		logrus.Errorf("Failed to load buffered ICE candidates for call %d: %v", callID, err)
+		return
+	}
+
+	for _, payload := range payloads {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &data); err != nil {
+			logrus.Errorf("Failed to unmarshal buffered ICE candidate: %v", err)
+			continue
+		}
+
+		targetUserID, ok := data["target_user_id"].(float64)
+		if !ok {
+			continue
+		}
+
+		websocket.PublishToUser(uint(targetUserID), "call_ice_candidate", data)
+	}
+}
+
+// GetCall retrieves a call the user is a party to
+func (s *CallService) GetCall(callID, userID uint) (*models.VideoCall, error) {
+	db := database.GetDB()
+
+	call, err := s.getCallForParty(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Preload("Initiator").Preload("Receiver").Preload("Group").First(call, call.ID)
+
+	return call, nil
+}
+
+// GetCallHistory lists the calls a user initiated, received or joined,
+// newest first
+func (s *CallService) GetCallHistory(userID uint, limit, offset int) ([]models.VideoCall, error) {
+	db := database.GetDB()
+
+	joined := db.Model(&models.CallParticipant{}).Select("call_id").Where("user_id = ?", userID)
+
+	var calls []models.VideoCall
+	err := db.Where("initiator_id = ? OR receiver_id = ? OR id IN (?)", userID, userID, joined).
+		Preload("Initiator").
+		Preload("Receiver").
+		Preload("Group").
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&calls).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Ongoing calls report how long they have been connected so far
+	now := time.Now()
+	for i := range calls {
+		if calls[i].Status == models.CallStatusConnected && calls[i].StartedAt != nil {
+			duration := int(now.Sub(*calls[i].StartedAt).Seconds())
+			calls[i].Duration = &duration
+		}
+	}
+
+	return calls, nil
+}
+
+// RunMissedCallSweeper periodically marks unanswered calls as missed. It
+// blocks and is meant to be started in its own goroutine.
+func (s *CallService) RunMissedCallSweeper() {
+	ticker := time.NewTicker(missedCallInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.markMissedCalls(); err != nil {
+			logrus.Errorf("Failed to mark missed calls: %v", err)
+		}
+	}
+}
+
+// markMissedCalls ends every call that has been ringing longer than the
+// configured ring timeout
+func (s *CallService) markMissedCalls() error {
+	db := database.GetDB()
+
+	var calls []models.VideoCall
+	if err := db.Where("status = ? AND created_at < ?", models.CallStatusRinging, time.Now().Add(-ringTimeout())).
+		Find(&calls).Error; err != nil {
+		return err
+	}
+
+	for i := range calls {
+		call := &calls[i]
+		now := time.Now()
+
+		// The status condition guards against a concurrent accept
+		result := db.Model(&models.VideoCall{}).
+			Where("id = ? AND status = ?", call.ID, models.CallStatusRinging).
+			Updates(map[string]interface{}{
+				"status":   models.CallStatusMissed,
+				"ended_at": now,
+			})
+		if result.Error != nil {
+			logrus.Errorf("Failed to mark call %d as missed: %v", call.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		db.Model(&models.CallParticipant{}).
+			Where("call_id = ? AND is_active = ?", call.ID, true).
+			Updates(map[string]interface{}{"left_at": now, "is_active": false})
+
+		// The initiator learns the call was missed, callees stop ringing
+		s.notifyParties(call, 0, "call_missed", map[string]interface{}{
+			"call_id": call.ID,
+		})
+	}
+
+	return nil
+}
+
+// ringTimeout returns the configured ring timeout, falling back to the default
+func ringTimeout() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Call.RingTimeout > 0 {
+		return cfg.Call.RingTimeout
+	}
+	return defaultRingTimeout
+}
+
+// getCallForParty loads a call and verifies the user takes part in it
+func (s *CallService) getCallForParty(callID, userID uint) (*models.VideoCall, error) {
+	db := database.GetDB()
+
+	var call models.VideoCall
+	if err := db.First(&call, callID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrCallNotFound
+		}
+		return nil, err
+	}
+
+	partyIDs, err := s.partyIDs(&call)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, partyID := range partyIDs {
+		if partyID == userID {
+			return &call, nil
+		}
+	}
+
+	return nil, errs.ErrCallNotFound
+}
+
+// partyIDs returns every user who may take part in a call
+func (s *CallService) partyIDs(call *models.VideoCall) ([]uint, error) {
+	if call.Type == models.CallTypeGroup && call.GroupID != nil {
+		return Group.getMemberIDs(context.Background(), *call.GroupID)
+	}
+
+	partyIDs := []uint{call.InitiatorID}
+	if call.ReceiverID != nil {
+		partyIDs = append(partyIDs, *call.ReceiverID)
+	}
+
+	return partyIDs, nil
+}
+
+// emitWebhook sends a call event to the webhooks of every call party
+func (s *CallService) emitWebhook(call *models.VideoCall, event string, data map[string]interface{}) {
+	snapshot := *call
+	Webhook.emit(event, func() ([]uint, error) { return s.partyIDs(&snapshot) }, data)
+}
+
+// notifyParties sends a call event to every party except the acting user
+func (s *CallService) notifyParties(call *models.VideoCall, actorID uint, event string, data map[string]interface{}) {
+	partyIDs, err := s.partyIDs(call)
+	if err != nil {
+		logrus.Errorf("Failed to resolve parties of call %d: %v", call.ID, err)
+		return
+	}
+
+	for _, partyID := range partyIDs {
+		if partyID != actorID {
+			websocket.PublishToUser(partyID, event, data)
+		}
+	}
+}
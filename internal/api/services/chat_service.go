@@ -1,283 +1,3517 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
 	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/moderation"
+	"web-api/internal/pkg/redis"
 	"web-api/internal/pkg/websocket"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type ChatService struct{}
+type ChatService struct {
+	filter moderation.ContentFilter
+}
 
 var Chat = &ChatService{}
 
+// defaultEditWindow applies when no edit window is configured
+const defaultEditWindow = 15 * time.Minute
+
+// maxAttachments bounds the number of files attached to one message
+const maxAttachments = 10
+
+// maxMentions bounds the @username tokens resolved in one message
+const maxMentions = 50
+
+// mentionPattern matches "@username" tokens that do not follow a word
+// character, so e-mail addresses are not mentions
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_.\-]+)`)
+
 // SendPrivateMessageRequest represents a private message request
 type SendPrivateMessageRequest struct {
-	ReceiverID uint               `json:"receiver_id" binding:"required"`
-	Content    string             `json:"content" binding:"required"`
-	Type       models.MessageType `json:"type"`
-	FileID     *uint              `json:"file_id"`
+	ReceiverID  uint               `json:"receiver_id" binding:"required"`
+	Content     string             `json:"content" binding:"required"`
+	Type        models.MessageType `json:"type"`
+	FileID      *uint              `json:"file_id"`     // Single attachment, kept for older clients
+	FileIDs     []uint             `json:"file_ids"`    // Attachments in display order
+	DurationMs  *int               `json:"duration_ms"` // Audio/video messages only
+	ReplyToID   *uint              `json:"reply_to_id"`
+	TTL         int                `json:"ttl"`                                    // Seconds until the message disappears; 0 uses the conversation's timer
+	ClientMsgID string             `json:"client_msg_id" binding:"omitempty,uuid"` // Retried sends with the same ID return the first message
+	Poll        *models.Poll       `json:"-"`                                      // Poll messages only, set by PollService
 }
 
 // SendGroupMessageRequest represents a group message request
 type SendGroupMessageRequest struct {
-	GroupID uint               `json:"group_id" binding:"required"`
-	Content string             `json:"content" binding:"required"`
-	Type    models.MessageType `json:"type"`
-	FileID  *uint              `json:"file_id"`
+	GroupID     uint               `json:"group_id" binding:"required"`
+	Content     string             `json:"content" binding:"required"`
+	Type        models.MessageType `json:"type"`
+	FileID      *uint              `json:"file_id"`     // Single attachment, kept for older clients
+	FileIDs     []uint             `json:"file_ids"`    // Attachments in display order
+	DurationMs  *int               `json:"duration_ms"` // Audio/video messages only
+	ReplyToID   *uint              `json:"reply_to_id"`
+	TTL         int                `json:"ttl"`                                    // Seconds until the message disappears; 0 uses the conversation's timer
+	ClientMsgID string             `json:"client_msg_id" binding:"omitempty,uuid"` // Retried sends with the same ID return the first message
+	Poll        *models.Poll       `json:"-"`                                      // Poll messages only, set by PollService
+}
+
+// UseContentFilter swaps the filter message content goes through; nil
+// disables filtering
+func (s *ChatService) UseContentFilter(filter moderation.ContentFilter) {
+	s.filter = filter
+}
+
+// filterContent runs content through the content filter, returning the
+// content to store and whether it was masked. Rejected content fails with
+// errs.ErrContentRejected.
+func (s *ChatService) filterContent(content string) (string, bool, error) {
+	if s.filter == nil {
+		return content, false, nil
+	}
+
+	verdict := s.filter.Filter(content)
+	switch verdict.Action {
+	case moderation.Reject:
+		return "", false, errs.ErrContentRejected
+	case moderation.Mask:
+		return verdict.Content, true, nil
+	}
+	return content, false, nil
 }
 
 // SendPrivateMessage sends a private message
-func (s *ChatService) SendPrivateMessage(senderID uint, req SendPrivateMessageRequest) (*models.PrivateMessage, error) {
-	db := database.GetDB()
+func (s *ChatService) SendPrivateMessage(ctx context.Context, senderID uint, req SendPrivateMessageRequest) (*models.PrivateMessage, error) {
+	return s.sendPrivateMessage(ctx, database.GetDB().WithContext(ctx), senderID, req)
+}
+
+// sendPrivateMessage is SendPrivateMessage on the given database handle
+func (s *ChatService) sendPrivateMessage(ctx context.Context, db *gorm.DB, senderID uint, req SendPrivateMessageRequest) (*models.PrivateMessage, error) {
+	message, created, err := s.createPrivateMessage(ctx, db, senderID, req)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return message, nil
+	}
+
+	s.deliverPrivateMessage(ctx, message)
+	return message, nil
+}
+
+// deliverPrivateMessage broadcasts a new private message: the receiver gets
+// private_message, and the sender's devices get message_sent to confirm it
+func (s *ChatService) deliverPrivateMessage(ctx context.Context, message *models.PrivateMessage) {
+	messageData := privateMessageData(message)
+
+	// The receiver sees the message either way; muted only drops the
+	// notification sound and push
+	conversationID := models.ConversationID(models.ChatTypePrivate, message.SenderID)
+	muted, err := s.MutedUserIDs(ctx, conversationID, []uint{message.ReceiverID})
+	if err != nil {
+		logrus.Errorf("Failed to load mute of user %d: %v", message.ReceiverID, err)
+	}
+
+	receiverData := messageData
+	if muted[message.ReceiverID] {
+		receiverData = withMuted(messageData)
+	}
+	websocket.PublishToUser(message.ReceiverID, "private_message", receiverData)
+	websocket.PublishToUser(message.SenderID, "message_sent", messageData)
+
+	if !muted[message.ReceiverID] {
+		Push.NotifyMessage([]uint{message.ReceiverID}, conversationID, message.Preview())
+	}
+}
+
+// privateMessageData is the event payload of a private message
+func privateMessageData(message *models.PrivateMessage) map[string]interface{} {
+	data := map[string]interface{}{
+		"message_id":  message.ID,
+		"sender_id":   message.SenderID,
+		"receiver_id": message.ReceiverID,
+		"content":     message.Content, // As stored, masked by the content filter
+		"filtered":    message.Filtered,
+		"type":        string(message.Type),
+		"file_id":     message.FileID,
+		"attachments": message.Attachments,
+		"duration_ms": message.DurationMs,
+		"reply_to_id": message.ReplyToID,
+		"poll":        message.Poll,
+		"expires_at":  message.ExpiresAt,
+		"seq":         message.Seq,
+		"status":      message.Status,
+		"created_at":  message.CreatedAt,
+		"updated_at":  message.UpdatedAt,
+	}
+	if message.ClientMsgID != nil {
+		data["client_msg_id"] = *message.ClientMsgID
+	}
+	if message.ReplyTo != nil {
+		data["reply_to"] = message.ReplyTo.Preview()
+	}
+	return data
+}
+
+// withMuted copies event data and adds the muted hint, telling clients to
+// skip sounds and notifications for it
+func withMuted(data map[string]interface{}) map[string]interface{} {
+	muted := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		muted[k] = v
+	}
+	muted["muted"] = true
+	return muted
+}
+
+// CreatePrivateMessage persists a private message. It is the single write
+// path for private messages, shared by the REST API and the WebSocket hub.
+// A send retried with the same client_msg_id returns the first message.
+func (s *ChatService) CreatePrivateMessage(ctx context.Context, senderID uint, req SendPrivateMessageRequest) (*models.PrivateMessage, error) {
+	message, _, err := s.createPrivateMessage(ctx, database.GetDB().WithContext(ctx), senderID, req)
+	return message, err
+}
+
+// createPrivateMessage is CreatePrivateMessage, also reporting whether the
+// message was created rather than found by its client_msg_id
+func (s *ChatService) createPrivateMessage(ctx context.Context, db *gorm.DB, senderID uint, req SendPrivateMessageRequest) (*models.PrivateMessage, bool, error) {
+	clientID, err := parseClientMsgID(req.ClientMsgID)
+	if err != nil {
+		return nil, false, err
+	}
+	if clientID != nil {
+		existing, err := findPrivateMessageByClientID(db, senderID, *clientID)
+		if err != nil || existing != nil {
+			return existing, false, err
+		}
+	}
 
 	// Verify receiver exists
 	var receiver models.User
 	if err := db.First(&receiver, req.ReceiverID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("receiver not found")
+			return nil, false, errs.ErrReceiverNotFound
 		}
-		return nil, err
+		return nil, false, err
+	}
+
+	// A reply must quote a message from the same conversation
+	if req.ReplyToID != nil {
+		var quoted models.PrivateMessage
+		if err := db.Where(
+			"id = ? AND ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))",
+			*req.ReplyToID, senderID, req.ReceiverID, req.ReceiverID, senderID,
+		).First(&quoted).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, false, errs.ErrReplyOutside
+			}
+			return nil, false, err
+		}
+	}
+
+	if err := models.ValidateMessageContent(req.Content, req.Type, maxMessageLength()); err != nil {
+		return nil, false, err
+	}
+
+	content, filtered, err := s.filterContent(req.Content)
+	if err != nil {
+		return nil, false, err
+	}
+
+	attachments, fileID, err := buildAttachments(db, senderID, req.FileIDs, req.FileID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := validateMediaMessage(db, req.Type, fileID, req.DurationMs); err != nil {
+		return nil, false, err
+	}
+
+	if (req.Type == models.MessageTypePoll) != (req.Poll != nil) {
+		return nil, false, errs.ErrPollEndpoint
+	}
+
+	expiresAt, err := messageExpiry(db, req.TTL, disappearingKey(senderID, models.ChatTypePrivate, req.ReceiverID))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Only a message about to be stored counts against the flood limit
+	if err := checkFlood(ctx, db, senderID); err != nil {
+		return nil, false, err
 	}
 
 	// Create message
 	message := models.PrivateMessage{
-		SenderID:   senderID,
-		ReceiverID: req.ReceiverID,
-		Content:    req.Content,
-		Type:       req.Type,
-		FileID:     req.FileID,
-		IsRead:     false,
+		SenderID:    senderID,
+		ReceiverID:  req.ReceiverID,
+		Content:     content,
+		Filtered:    filtered,
+		Type:        req.Type,
+		FileID:      fileID,
+		Attachments: attachments,
+		ReplyToID:   req.ReplyToID,
+		Poll:        req.Poll,
+		IsRead:      false,
+		ExpiresAt:   expiresAt,
+		ClientMsgID: clientID,
 	}
 
 	if message.Type == "" {
 		message.Type = models.MessageTypeText
 	}
+	if message.Type.IsMedia() {
+		message.DurationMs = req.DurationMs
+	}
+
+	if message.Seq, err = nextPrivateSeq(db, senderID, req.ReceiverID); err != nil {
+		return nil, false, err
+	}
 
 	if err := db.Create(&message).Error; err != nil {
-		return nil, err
+		// A concurrent retry may have inserted the message first
+		if clientID != nil {
+			if existing, findErr := findPrivateMessageByClientID(db, senderID, *clientID); findErr == nil && existing != nil {
+				return existing, false, nil
+			}
+		}
+		return nil, false, err
 	}
 
-	// Broadcast message to WebSocket clients
-	messageData := map[string]interface{}{
+	unarchiveOnMessage(db, models.ChatTypePrivate, senderID, req.ReceiverID)
+	clearDraft(db, senderID, models.ConversationID(models.ChatTypePrivate, req.ReceiverID))
+
+	// Load sender and receiver info
+	db.Preload("Sender").Preload("Receiver").Preload("File").Scopes(preloadAttachments).Preload("ReplyTo.Sender").First(&message, message.ID)
+	message.Status = models.MessageStatusSent
+
+	Webhook.Emit(models.WebhookEventMessageCreated, []uint{senderID, req.ReceiverID}, map[string]interface{}{
 		"message_id":  message.ID,
+		"chat_type":   string(models.ChatTypePrivate),
 		"sender_id":   message.SenderID,
 		"receiver_id": message.ReceiverID,
 		"content":     message.Content,
 		"type":        string(message.Type),
-		"file_id":     message.FileID,
 		"created_at":  message.CreatedAt,
-	}
-	logrus.Infof("Broadcasting private message: %+v", messageData)
-	websocket.BroadcastPrivateMessage(senderID, req.ReceiverID, messageData)
+	})
+	LinkPreview.UnfurlPrivateMessage(&message)
 
-	// Load sender and receiver info
-	db.Preload("Sender").Preload("Receiver").Preload("File").First(&message, message.ID)
+	return &message, true, nil
+}
 
-	return &message, nil
+// SendPrivateMessageFromEvent sends a private message received over
+// WebSocket, the same way as SendPrivateMessage
+func (s *ChatService) SendPrivateMessageFromEvent(ctx context.Context, senderID uint, data map[string]interface{}) (*models.PrivateMessage, error) {
+	var req SendPrivateMessageRequest
+	if err := decodeEventData(data, &req); err != nil {
+		return nil, err
+	}
+
+	return s.SendPrivateMessage(ctx, senderID, req)
 }
 
 // GetPrivateMessages retrieves private messages between two users
-func (s *ChatService) GetPrivateMessages(userID, otherUserID uint, limit, offset int) ([]models.PrivateMessage, error) {
-	db := database.GetDB()
+func (s *ChatService) GetPrivateMessages(ctx context.Context, userID, otherUserID uint, limit, offset int) ([]models.PrivateMessage, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	var messages []models.PrivateMessage
 	if err := db.Where(
 		"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
 		userID, otherUserID, otherUserID, userID,
 	).
+		Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+		Scopes(notExpired).
 		Preload("Sender").
 		Preload("Receiver").
 		Preload("File").
-		Order("created_at DESC").
+		Scopes(preloadAttachments).
+		Preload("ReplyTo.Sender").
+		Order("seq DESC, created_at DESC").
 		Limit(limit).
 		Offset(offset).
 		Find(&messages).Error; err != nil {
 		return nil, err
 	}
 
+	if err := decoratePrivateMessages(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
 	return messages, nil
 }
 
 // MarkMessageAsRead marks a message as read
-func (s *ChatService) MarkMessageAsRead(messageID, userID uint) error {
-	db := database.GetDB()
+func (s *ChatService) MarkMessageAsRead(ctx context.Context, messageID, userID uint) error {
+	_, err := s.MarkPrivateMessageRead(ctx, messageID, userID)
+	return err
+}
+
+// maxBulkRead bounds the messages marked as read by one request
+const maxBulkRead = 500
+
+// MarkMessagesReadRequest lists private messages to mark as read
+type MarkMessagesReadRequest struct {
+	MessageIDs []uint `json:"message_ids" binding:"required,min=1,max=500"`
+}
+
+// MarkMessagesAsRead marks the listed private messages as read in one
+// update and returns the IDs that were marked. Messages the user did not
+// receive, or already read, are skipped. Each sender gets one messages_read
+// event for their messages.
+func (s *ChatService) MarkMessagesAsRead(ctx context.Context, userID uint, messageIDs []uint) ([]uint, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	if len(messageIDs) == 0 {
+		return []uint{}, nil
+	}
+	if len(messageIDs) > maxBulkRead {
+		return nil, fmt.Errorf("at most %d messages can be marked at once", maxBulkRead)
+	}
+
+	var unread []models.PrivateMessage
+	if err := db.Select("id", "sender_id").
+		Where("id IN ? AND receiver_id = ? AND is_read = ?", messageIDs, userID, false).
+		Order("id").
+		Find(&unread).Error; err != nil {
+		return nil, err
+	}
+
+	marked := make([]uint, len(unread))
+	bySender := make(map[uint][]uint)
+	for i, m := range unread {
+		marked[i] = m.ID
+		bySender[m.SenderID] = append(bySender[m.SenderID], m.ID)
+	}
+	if len(marked) == 0 {
+		return marked, nil
+	}
+
+	now := time.Now()
+	if err := db.Model(&models.PrivateMessage{}).
+		Where("id IN ? AND is_read = ?", marked, false).
+		Updates(map[string]interface{}{
+			"is_read":      true,
+			"read_at":      now,
+			"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now),
+		}).Error; err != nil {
+		return nil, err
+	}
+
+	for senderID, ids := range bySender {
+		websocket.PublishToUser(senderID, "messages_read", map[string]interface{}{
+			"chat_type":       "private",
+			"conversation_id": models.ConversationID(models.ChatTypePrivate, userID),
+			"reader_id":       userID,
+			"message_ids":     ids,
+			"status":          "read",
+			"read_at":         now,
+		})
+	}
+
+	return marked, nil
+}
+
+// MarkPrivateMessageRead marks a private message as read by its receiver and
+// returns the updated message. Already-read messages are returned unchanged.
+func (s *ChatService) MarkPrivateMessageRead(ctx context.Context, messageID, userID uint) (*models.PrivateMessage, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	// Verify user is the receiver
 	var message models.PrivateMessage
 	if err := db.First(&message, messageID).Error; err != nil {
-		return err
+		return nil, err
 	}
 
 	if message.ReceiverID != userID {
-		return errors.New("unauthorized to mark this message as read")
+		return nil, errs.ErrMarkReadDenied
 	}
 
-	return db.Model(&message).Updates(map[string]interface{}{
-		"is_read": true,
-		"read_at": gorm.Expr("NOW()"),
-	}).Error
-}
-
-// GetUnreadMessageCount returns count of unread messages for a user
-func (s *ChatService) GetUnreadMessageCount(userID uint) (int64, error) {
-	db := database.GetDB()
+	if message.IsRead {
+		return &message, nil
+	}
 
-	var count int64
-	if err := db.Model(&models.PrivateMessage{}).
-		Where("receiver_id = ? AND is_read = ?", userID, false).
-		Count(&count).Error; err != nil {
-		return 0, err
+	now := time.Now()
+	if err := db.Model(&message).Updates(map[string]interface{}{
+		"is_read":      true,
+		"read_at":      now,
+		"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now),
+	}).Error; err != nil {
+		return nil, err
 	}
+	message.IsRead = true
+	message.ReadAt = &now
+	if message.DeliveredAt == nil {
+		message.DeliveredAt = &now
+	}
+	message.Status = models.MessageStatusRead
 
-	return count, nil
+	return &message, nil
 }
 
-// SendGroupMessage sends a message to a group
-func (s *ChatService) SendGroupMessage(senderID uint, req SendGroupMessageRequest) (*models.GroupMessage, error) {
-	db := database.GetDB()
+// MarkGroupMessageRead verifies that a group message can be acknowledged by
+// the user, i.e. it belongs to the group and the user is a member, marks it
+// read and returns it with the stored read time of the user's copy. The
+// read time is nil if the message has no delivery record for the user.
+func (s *ChatService) MarkGroupMessageRead(ctx context.Context, messageID, groupID, userID uint) (*models.GroupMessage, *time.Time, error) {
+	db := database.GetDB().WithContext(ctx)
 
-	// Verify user is a member of the group
 	var member models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", req.GroupID, senderID).First(&member).Error; err != nil {
+	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("you are not a member of this group")
+			return nil, nil, errs.ErrNotGroupMember
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Create message
-	message := models.GroupMessage{
-		GroupID:  req.GroupID,
-		SenderID: senderID,
-		Content:  req.Content,
-		Type:     req.Type,
-		FileID:   req.FileID,
+	var message models.GroupMessage
+	if err := db.Where("id = ? AND group_id = ?", messageID, groupID).First(&message).Error; err != nil {
+		return nil, nil, err
 	}
 
-	if message.Type == "" {
-		message.Type = models.MessageTypeText
+	if message.SenderID == userID {
+		return nil, nil, errors.New("cannot mark your own message as read")
 	}
 
-	if err := db.Create(&message).Error; err != nil {
-		return nil, err
+	// Advance the member's read marker up to this message
+	if err := db.Model(&member).
+		Where("last_read_at IS NULL OR last_read_at < ?", message.CreatedAt).
+		Update("last_read_at", message.CreatedAt).Error; err != nil {
+		return nil, nil, err
 	}
 
-	// Broadcast message to WebSocket clients
-	messageData := map[string]interface{}{
-		"message_id": message.ID,
-		"group_id":   message.GroupID,
-		"sender_id":  message.SenderID,
-		"content":    message.Content,
-		"type":       string(message.Type),
-		"file_id":    message.FileID,
-		"created_at": message.CreatedAt,
+	if err := markDeliveriesRead(ctx, db, groupID, userID, message.ID); err != nil {
+		return nil, nil, err
 	}
-	logrus.Infof("Broadcasting group message: %+v", messageData)
-	// TODO: Implement group message saving via WebSocket for consistency
-	// For now, use the old REST API approach for group messages
-	// websocket.BroadcastGroupMessage(senderID, req.GroupID, messageData)
 
-	// Load relations
-	db.Preload("Sender").Preload("Group").Preload("File").First(&message, message.ID)
+	// A message read before keeps its first read time
+	var readAt []*time.Time
+	if err := db.Model(&models.MessageDelivery{}).
+		Where("message_id = ? AND user_id = ?", message.ID, userID).
+		Limit(1).Pluck("read_at", &readAt).Error; err != nil {
+		return nil, nil, err
+	}
+	if len(readAt) == 0 {
+		return &message, nil, nil
+	}
 
-	return &message, nil
+	return &message, readAt[0], nil
 }
 
-// GetGroupMessages retrieves messages from a group
-func (s *ChatService) GetGroupMessages(userID, groupID uint, limit, offset int) ([]models.GroupMessage, error) {
-	db := database.GetDB()
+// MarkMessageDelivered records that the recipient's client received a
+// message; groupID is zero for private messages. It returns when the
+// message was delivered, or nil if it was already delivered before.
+func (s *ChatService) MarkMessageDelivered(ctx context.Context, messageID, groupID, userID uint) (*time.Time, error) {
+	db := database.GetDB().WithContext(ctx)
+	now := time.Now()
 
-	// Verify user is a member
-	var member models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+	var result *gorm.DB
+	if groupID == 0 {
+		result = db.Model(&models.PrivateMessage{}).
+			Where("id = ? AND receiver_id = ? AND delivered_at IS NULL", messageID, userID).
+			Update("delivered_at", now)
+	} else {
+		result = db.Model(&models.MessageDelivery{}).
+			Where("message_id = ? AND group_id = ? AND user_id = ? AND delivered_at IS NULL", messageID, groupID, userID).
+			Update("delivered_at", now)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &now, nil
+}
+
+// markDeliveriesRead marks the user's copies of group messages up to and
+// including upToID as read, which also counts them as delivered. Zero
+// marks every message. The other members get a seen_by update.
+func markDeliveriesRead(ctx context.Context, db *gorm.DB, groupID, userID, upToID uint) error {
+	query := db.Model(&models.MessageDelivery{}).
+		Where("group_id = ? AND user_id = ? AND read_at IS NULL", groupID, userID)
+	if upToID != 0 {
+		query = query.Where("message_id <= ?", upToID)
+	}
+
+	var messageIDs []uint
+	if err := query.Pluck("message_id", &messageIDs).Error; err != nil {
+		return err
+	}
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if err := db.Model(&models.MessageDelivery{}).
+		Where("group_id = ? AND user_id = ? AND message_id IN ?", groupID, userID, messageIDs).
+		Updates(map[string]interface{}{
+			"read_at":      now,
+			"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now),
+		}).Error; err != nil {
+		return err
+	}
+
+	memberIDs, err := Group.getMemberIDs(ctx, groupID)
+	if err != nil {
+		logrus.Errorf("Failed to load members of group %d: %v", groupID, err)
+		return nil
+	}
+	recipientIDs := make([]uint, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		if memberID != userID {
+			recipientIDs = append(recipientIDs, memberID)
+		}
+	}
+	websocket.PublishToUsers(recipientIDs, "seen_by", map[string]interface{}{
+		"chat_type":       "group",
+		"conversation_id": models.ConversationID(models.ChatTypeGroup, groupID),
+		"group_id":        groupID,
+		"message_ids":     messageIDs,
+		"user_id":         userID,
+		"read_at":         now,
+	})
+
+	return nil
+}
+
+// MessageReader is a group member who read a message
+type MessageReader struct {
+	User   models.UserResponse `json:"user"`
+	ReadAt time.Time           `json:"read_at"`
+}
+
+// GetMessageSeenBy lists the members who read a group message, earliest
+// reader first. Only members of the message's group may ask.
+func (s *ChatService) GetMessageSeenBy(ctx context.Context, userID, messageID uint) ([]MessageReader, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.GroupMessage
+	if err := db.Select("id", "group_id").Scopes(notExpired).First(&message, messageID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("you are not a member of this group")
+			return nil, errs.ErrMessageNotFound
 		}
 		return nil, err
 	}
 
-	var messages []models.GroupMessage
-	if err := db.Where("group_id = ?", groupID).
-		Preload("Sender").
-		Preload("File").
-		Order("created_at DESC").
-		Limit(limit).
-		Offset(offset).
-		Find(&messages).Error; err != nil {
+	var count int64
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", message.GroupID, userID).
+		Count(&count).Error; err != nil {
 		return nil, err
 	}
+	if count == 0 {
+		return nil, errs.ErrNotGroupMember
+	}
 
-	return messages, nil
+	var deliveries []models.MessageDelivery
+	if err := db.Where("message_id = ? AND read_at IS NOT NULL", messageID).
+		Preload("User").
+		Order("read_at, user_id").
+		Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+
+	readers := make([]MessageReader, len(deliveries))
+	for i, d := range deliveries {
+		readers[i] = MessageReader{
+			User:   d.User.ToResponse(),
+			ReadAt: *d.ReadAt,
+		}
+	}
+
+	return readers, nil
 }
 
-// GetConversations returns list of conversations for a user
-func (s *ChatService) GetConversations(userID uint) ([]map[string]interface{}, error) {
-	db := database.GetDB()
+// loadDeliveryStatuses aggregates the status of group messages over their
+// recipients: read once everyone read it, delivered once everyone
+// received it. Messages without recipients stay sent.
+func loadDeliveryStatuses(ctx context.Context, messageIDs []uint) (map[uint]models.MessageStatus, error) {
+	statuses := make(map[uint]models.MessageStatus)
+	if len(messageIDs) == 0 {
+		return statuses, nil
+	}
 
-	// Get latest message with each user
-	var conversations []map[string]interface{}
+	var rows []struct {
+		MessageID      uint
+		Recipients     int64
+		DeliveredCount int64
+		ReadCount      int64
+	}
+	if err := database.GetDB().WithContext(ctx).Model(&models.MessageDelivery{}).
+		Select("message_id, COUNT(*) AS recipients, COUNT(delivered_at) AS delivered_count, COUNT(read_at) AS read_count").
+		Where("message_id IN ?", messageIDs).
+		Group("message_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
 
-	// Query for private conversations
-	query := `
-    WITH conversations AS (
-        SELECT 
-            CASE 
-                WHEN sender_id = ? THEN receiver_id 
-                ELSE sender_id 
-            END as other_user_id,
-            MAX(created_at) as last_message_at
-        FROM private_messages
-        WHERE sender_id = ? OR receiver_id = ?
-        GROUP BY other_user_id
-    )
-    SELECT 
-        c.other_user_id,
-        c.last_message_at,
-        (
-            SELECT pm2.content
-            FROM private_messages pm2
-            WHERE (pm2.sender_id = ? AND pm2.receiver_id = c.other_user_id)
-               OR (pm2.sender_id = c.other_user_id AND pm2.receiver_id = ?)
-            ORDER BY pm2.created_at DESC
-            LIMIT 1
-        ) as last_message
-    FROM conversations c
-    ORDER BY c.last_message_at DESC
-`
+	for _, row := range rows {
+		switch {
+		case row.ReadCount == row.Recipients:
+			statuses[row.MessageID] = models.MessageStatusRead
+		case row.DeliveredCount == row.Recipients:
+			statuses[row.MessageID] = models.MessageStatusDelivered
+		}
+	}
 
-	rows, err := db.Raw(query, userID, userID, userID, userID, userID).Rows()
+	return statuses, nil
+}
+
+// groupMessageStatus looks up a message's aggregated status, defaulting to sent
+func groupMessageStatus(statuses map[uint]models.MessageStatus, messageID uint) models.MessageStatus {
+	if status, ok := statuses[messageID]; ok {
+		return status
+	}
+	return models.MessageStatusSent
+}
+
+// GetUnreadMessageCount returns count of unread messages for a user, in
+// private chats and groups. It is the sum of GetUnreadCounts, so the badge
+// always matches the per-conversation counts.
+func (s *ChatService) GetUnreadMessageCount(ctx context.Context, userID uint) (int64, error) {
+	counts, err := s.GetUnreadCounts(ctx, userID)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var conv map[string]interface{}
-		var otherUserID uint
-		var lastMessageAt, lastMessage string
+	var count int64
+	for _, n := range counts {
+		count += n
+	}
+	return count, nil
+}
 
-		if err := rows.Scan(&otherUserID, &lastMessageAt, &lastMessage); err != nil {
-			continue
-		}
+// GetUnreadCounts returns the number of unread messages per conversation,
+// keyed by conversation ID ("private:<userID>" or "group:<groupID>"). Like
+// the history, it leaves out unsent, hidden and expired messages.
+func (s *ChatService) GetUnreadCounts(ctx context.Context, userID uint) (map[string]int64, error) {
+	db := database.GetDB().WithContext(ctx)
 
-		// Get other user info
-		var otherUser models.User
-		db.First(&otherUser, otherUserID)
+	counts := make(map[string]int64)
 
-		conv = map[string]interface{}{
-			"type":            "private",
-			"user":            otherUser.ToResponse(),
-			"last_message":    lastMessage,
-			"last_message_at": lastMessageAt,
-		}
+	var privateRows []struct {
+		SenderID uint
+		Count    int64
+	}
+	if err := db.Model(&models.PrivateMessage{}).
+		Select("sender_id, COUNT(*) AS count").
+		Where("receiver_id = ? AND is_read = ?", userID, false).
+		Where("deleted_for_everyone = ?", false).
+		Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+		Scopes(notExpired).
+		Group("sender_id").
+		Scan(&privateRows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range privateRows {
+		counts[models.ConversationID(models.ChatTypePrivate, row.SenderID)] = row.Count
+	}
 
-		conversations = append(conversations, conv)
+	var groupRows []struct {
+		GroupID uint
+		Count   int64
+	}
+	if err := db.Model(&models.GroupMessage{}).
+		Select("group_messages.group_id, COUNT(*) AS count").
+		Joins("JOIN group_members ON group_members.group_id = group_messages.group_id AND group_members.user_id = ? AND group_members.deleted_at IS NULL", userID).
+		Where("group_messages.sender_id <> ?", userID).
+		Where("group_messages.created_at > COALESCE(group_members.last_read_at, group_members.joined_at)").
+		Where("group_messages.deleted_for_everyone = ?", false).
+		Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+		Where("group_messages.expires_at IS NULL OR group_messages.expires_at > ?", time.Now()).
+		Group("group_messages.group_id").
+		Scan(&groupRows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range groupRows {
+		counts[models.ConversationID(models.ChatTypeGroup, row.GroupID)] = row.Count
 	}
 
-	return conversations, nil
+	return counts, nil
+}
+
+// MuteConversationRequest represents a mute request
+type MuteConversationRequest struct {
+	Duration int `json:"duration"` // Seconds to stay muted; 0 mutes until unmuted
+}
+
+// MuteConversation silences notifications of a conversation for the user,
+// for the given duration or, if it is zero, until unmuted
+func (s *ChatService) MuteConversation(ctx context.Context, userID uint, conversationID string, duration time.Duration) (*models.ConversationMute, error) {
+	if duration < 0 {
+		return nil, errors.New("duration cannot be negative")
+	}
+
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkConversationAccess(db, userID, chatType, chatID); err != nil {
+		return nil, err
+	}
+
+	mute := models.ConversationMute{
+		UserID:         userID,
+		ConversationID: models.ConversationID(chatType, chatID),
+	}
+	if duration > 0 {
+		until := time.Now().Add(duration)
+		mute.MutedUntil = &until
+	}
+
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"muted_until", "updated_at"}),
+	}).Create(&mute).Error; err != nil {
+		return nil, err
+	}
+
+	return &mute, nil
+}
+
+// UnmuteConversation lifts the user's mute of a conversation
+func (s *ChatService) UnmuteConversation(ctx context.Context, userID uint, conversationID string) error {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return err
+	}
+
+	return database.GetDB().WithContext(ctx).
+		Where("user_id = ? AND conversation_id = ?", userID, models.ConversationID(chatType, chatID)).
+		Delete(&models.ConversationMute{}).Error
+}
+
+// checkConversationAccess verifies that the user can have settings for a
+// conversation: a member of the group, or the other user of a private chat
+// exists
+func checkConversationAccess(db *gorm.DB, userID uint, chatType models.ChatType, chatID uint) error {
+	if chatType == models.ChatTypeGroup {
+		var member models.GroupMember
+		if err := db.Where("group_id = ? AND user_id = ?", chatID, userID).First(&member).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrNotGroupMember
+			}
+			return err
+		}
+		return nil
+	}
+
+	if err := db.Select("id").First(&models.User{}, chatID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrUserNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// ArchiveConversation hides a conversation from the user's conversation
+// list until they unarchive it or a new message arrives in it
+func (s *ChatService) ArchiveConversation(ctx context.Context, userID uint, conversationID string) (*models.ConversationArchive, error) {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkConversationAccess(db, userID, chatType, chatID); err != nil {
+		return nil, err
+	}
+
+	archive := models.ConversationArchive{
+		UserID:         userID,
+		ConversationID: models.ConversationID(chatType, chatID),
+		ArchivedAt:     time.Now(),
+	}
+
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"archived_at"}),
+	}).Create(&archive).Error; err != nil {
+		return nil, err
+	}
+
+	return &archive, nil
+}
+
+// UnarchiveConversation brings an archived conversation back into the
+// user's conversation list
+func (s *ChatService) UnarchiveConversation(ctx context.Context, userID uint, conversationID string) error {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return err
+	}
+
+	return database.GetDB().WithContext(ctx).
+		Where("user_id = ? AND conversation_id = ?", userID, models.ConversationID(chatType, chatID)).
+		Delete(&models.ConversationArchive{}).Error
+}
+
+// unarchiveOnMessage brings a conversation that got a new message back into
+// the lists of the participants who archived it. For private chats chatID
+// is the receiver.
+func unarchiveOnMessage(db *gorm.DB, chatType models.ChatType, senderID, chatID uint) {
+	query := db.Where("conversation_id = ?", models.ConversationID(models.ChatTypeGroup, chatID))
+	if chatType == models.ChatTypePrivate {
+		query = db.Where("(user_id = ? AND conversation_id = ?) OR (user_id = ? AND conversation_id = ?)",
+			senderID, models.ConversationID(models.ChatTypePrivate, chatID),
+			chatID, models.ConversationID(models.ChatTypePrivate, senderID))
+	}
+
+	if err := query.Delete(&models.ConversationArchive{}).Error; err != nil {
+		logrus.Warnf("Failed to unarchive %s conversation %d: %v", chatType, chatID, err)
+	}
+}
+
+// SaveDraftRequest carries the text being typed in a conversation; empty
+// content clears the draft
+type SaveDraftRequest struct {
+	Content string `json:"content" binding:"max=10000"`
+}
+
+// SaveDraft stores what the user is typing in a conversation and tells
+// their other devices with a draft_updated event. Blank content removes the
+// draft, and nil is returned.
+func (s *ChatService) SaveDraft(ctx context.Context, userID uint, conversationID, content string) (*models.Draft, error) {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(content) == "" {
+		if err := s.DeleteDraft(ctx, userID, conversationID); err != nil && !errors.Is(err, errs.ErrDraftNotFound) {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkConversationAccess(db, userID, chatType, chatID); err != nil {
+		return nil, err
+	}
+
+	draft := models.Draft{
+		UserID:         userID,
+		ConversationID: models.ConversationID(chatType, chatID),
+		Content:        content,
+		UpdatedAt:      time.Now(),
+	}
+
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"content", "updated_at"}),
+	}).Create(&draft).Error; err != nil {
+		return nil, err
+	}
+
+	publishDraft(userID, draft.ConversationID, draft.Content, draft.UpdatedAt)
+	return &draft, nil
+}
+
+// GetDraft returns the user's draft of a conversation
+func (s *ChatService) GetDraft(ctx context.Context, userID uint, conversationID string) (*models.Draft, error) {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var draft models.Draft
+	if err := database.GetDB().WithContext(ctx).
+		Where("user_id = ? AND conversation_id = ?", userID, models.ConversationID(chatType, chatID)).
+		First(&draft).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrDraftNotFound
+		}
+		return nil, err
+	}
+
+	return &draft, nil
+}
+
+// DeleteDraft removes the user's draft of a conversation and tells their
+// other devices
+func (s *ChatService) DeleteDraft(ctx context.Context, userID uint, conversationID string) error {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return err
+	}
+
+	if !clearDraft(database.GetDB().WithContext(ctx), userID, models.ConversationID(chatType, chatID)) {
+		return errs.ErrDraftNotFound
+	}
+	return nil
+}
+
+// clearDraft removes a user's draft of a conversation, e.g. once they sent
+// the message, and reports whether there was one
+func clearDraft(db *gorm.DB, userID uint, conversationID string) bool {
+	result := db.Where("user_id = ? AND conversation_id = ?", userID, conversationID).Delete(&models.Draft{})
+	if result.Error != nil {
+		logrus.Warnf("Failed to clear draft of user %d in %s: %v", userID, conversationID, result.Error)
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+
+	publishDraft(userID, conversationID, "", time.Now())
+	return true
+}
+
+// publishDraft sends a draft_updated event to the user's devices; empty
+// content means the draft is gone
+func publishDraft(userID uint, conversationID, content string, updatedAt time.Time) {
+	websocket.PublishToUser(userID, "draft_updated", map[string]interface{}{
+		"conversation_id": conversationID,
+		"content":         content,
+		"updated_at":      updatedAt,
+	})
+}
+
+// GetTypingUsers lists who is typing in a group right now. Typing state
+// lives in Redis and expires on its own, so users who went quiet drop out
+// without a typing_stopped event.
+func (s *ChatService) GetTypingUsers(ctx context.Context, userID uint, conversationID string) ([]models.TypingUser, error) {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if chatType != models.ChatTypeGroup {
+		return nil, errs.ErrTypingGroupOnly
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkConversationAccess(db, userID, chatType, chatID); err != nil {
+		return nil, err
+	}
+
+	typingIDs, err := redis.GetTypingUsers(models.ConversationID(chatType, chatID))
+	if err != nil {
+		return nil, err
+	}
+
+	typing := make([]models.TypingUser, 0, len(typingIDs))
+	if len(typingIDs) == 0 {
+		return typing, nil
+	}
+
+	// Members who left since they started typing are not listed
+	if err := db.Model(&models.User{}).
+		Select("users.id AS user_id, users.username").
+		Joins("JOIN group_members ON group_members.user_id = users.id AND group_members.group_id = ? AND group_members.deleted_at IS NULL", chatID).
+		Where("users.id IN ?", typingIDs).
+		Order("users.username").
+		Scan(&typing).Error; err != nil {
+		return nil, err
+	}
+
+	return typing, nil
+}
+
+// MutedUserIDs returns which of the users currently mute the conversation
+func (s *ChatService) MutedUserIDs(ctx context.Context, conversationID string, userIDs []uint) (map[uint]bool, error) {
+	muted := make(map[uint]bool)
+	if len(userIDs) == 0 {
+		return muted, nil
+	}
+
+	var mutedIDs []uint
+	if err := database.GetDB().WithContext(ctx).Model(&models.ConversationMute{}).
+		Where("conversation_id = ? AND user_id IN ?", conversationID, userIDs).
+		Where("muted_until IS NULL OR muted_until > ?", time.Now()).
+		Pluck("user_id", &mutedIDs).Error; err != nil {
+		return nil, err
+	}
+
+	for _, id := range mutedIDs {
+		muted[id] = true
+	}
+	return muted, nil
+}
+
+// MarkConversationAsRead marks every unread message in a conversation as read
+// and notifies the other participants
+func (s *ChatService) MarkConversationAsRead(ctx context.Context, userID uint, conversationID string) error {
+	db := database.GetDB().WithContext(ctx)
+
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if chatType == models.ChatTypePrivate {
+		var messageIDs []uint
+		if err := db.Model(&models.PrivateMessage{}).
+			Where("sender_id = ? AND receiver_id = ? AND is_read = ?", chatID, userID, false).
+			Pluck("id", &messageIDs).Error; err != nil {
+			return err
+		}
+
+		if len(messageIDs) == 0 {
+			return nil
+		}
+
+		if err := db.Model(&models.PrivateMessage{}).
+			Where("id IN ?", messageIDs).
+			Updates(map[string]interface{}{
+				"is_read":      true,
+				"read_at":      now,
+				"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now),
+			}).Error; err != nil {
+			return err
+		}
+
+		websocket.PublishToUser(chatID, "messages_read", map[string]interface{}{
+			"chat_type":       "private",
+			"conversation_id": models.ConversationID(models.ChatTypePrivate, userID),
+			"reader_id":       userID,
+			"message_ids":     messageIDs,
+			"status":          "read",
+			"read_at":         now,
+		})
+
+		return nil
+	}
+
+	result := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", chatID, userID).
+		Update("last_read_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrNotGroupMember
+	}
+
+	if err := markDeliveriesRead(ctx, db, chatID, userID, 0); err != nil {
+		return err
+	}
+
+	memberIDs, err := Group.getMemberIDs(ctx, chatID)
+	if err != nil {
+		logrus.Errorf("Failed to load members of group %d: %v", chatID, err)
+		return nil
+	}
+
+	readData := map[string]interface{}{
+		"chat_type":       "group",
+		"conversation_id": conversationID,
+		"group_id":        chatID,
+		"reader_id":       userID,
+		"status":          "read",
+		"read_at":         now,
+	}
+	otherIDs := make([]uint, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		if memberID != userID {
+			otherIDs = append(otherIDs, memberID)
+		}
+	}
+	websocket.PublishToUsers(otherIDs, "messages_read", readData)
+
+	return nil
+}
+
+// SendGroupMessage sends a message to a group
+func (s *ChatService) SendGroupMessage(ctx context.Context, senderID uint, req SendGroupMessageRequest) (*models.GroupMessage, error) {
+	return s.sendGroupMessage(ctx, database.GetDB().WithContext(ctx), senderID, req)
+}
+
+// sendGroupMessage is SendGroupMessage on the given database handle
+func (s *ChatService) sendGroupMessage(ctx context.Context, db *gorm.DB, senderID uint, req SendGroupMessageRequest) (*models.GroupMessage, error) {
+	message, created, err := s.createGroupMessage(ctx, db, senderID, req)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return message, nil
+	}
+
+	s.deliverGroupMessage(ctx, db, message)
+	return message, nil
+}
+
+// deliverGroupMessage broadcasts a new group message to every member, the
+// sender's devices included. Members who muted the group still get the
+// message, flagged as muted, but no push notification.
+func (s *ChatService) deliverGroupMessage(ctx context.Context, db *gorm.DB, message *models.GroupMessage) {
+	var memberIDs []uint
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id = ?", message.GroupID).
+		Pluck("user_id", &memberIDs).Error; err != nil {
+		logrus.Errorf("Failed to get members of group %d: %v", message.GroupID, err)
+		return
+	}
+
+	conversationID := models.ConversationID(models.ChatTypeGroup, message.GroupID)
+	muted, err := s.MutedUserIDs(ctx, conversationID, memberIDs)
+	if err != nil {
+		logrus.Errorf("Failed to load mutes of group %d: %v", message.GroupID, err)
+	}
+
+	var unmutedIDs, mutedIDs, pushIDs []uint
+	for _, memberID := range memberIDs {
+		if muted[memberID] {
+			mutedIDs = append(mutedIDs, memberID)
+			continue
+		}
+		unmutedIDs = append(unmutedIDs, memberID)
+		if memberID != message.SenderID {
+			pushIDs = append(pushIDs, memberID)
+		}
+	}
+
+	messageData := groupMessageData(message)
+	if len(unmutedIDs) > 0 {
+		websocket.PublishToUsers(unmutedIDs, "group_message", messageData)
+	}
+	if len(mutedIDs) > 0 {
+		websocket.PublishToUsers(mutedIDs, "group_message", withMuted(messageData))
+	}
+	Push.NotifyMessage(pushIDs, conversationID, message.Preview())
+}
+
+// groupMessageData is the event payload of a group message
+func groupMessageData(message *models.GroupMessage) map[string]interface{} {
+	data := map[string]interface{}{
+		"message_id":  message.ID,
+		"group_id":    message.GroupID,
+		"sender_id":   message.SenderID,
+		"content":     message.Content, // As stored, masked by the content filter
+		"filtered":    message.Filtered,
+		"type":        string(message.Type),
+		"file_id":     message.FileID,
+		"attachments": message.Attachments,
+		"duration_ms": message.DurationMs,
+		"reply_to_id": message.ReplyToID,
+		"mentions":    message.Mentions,
+		"poll":        message.Poll,
+		"expires_at":  message.ExpiresAt,
+		"seq":         message.Seq,
+		"status":      message.Status,
+		"created_at":  message.CreatedAt,
+		"updated_at":  message.UpdatedAt,
+	}
+	if message.ClientMsgID != nil {
+		data["client_msg_id"] = *message.ClientMsgID
+	}
+	if message.ReplyTo != nil {
+		data["reply_to"] = message.ReplyTo.Preview()
+	}
+	return data
+}
+
+// CreateGroupMessage persists a group message. It is the single write path
+// for group messages, shared by the REST API and the WebSocket hub. A send
+// retried with the same client_msg_id returns the first message.
+func (s *ChatService) CreateGroupMessage(ctx context.Context, senderID uint, req SendGroupMessageRequest) (*models.GroupMessage, error) {
+	message, _, err := s.createGroupMessage(ctx, database.GetDB().WithContext(ctx), senderID, req)
+	return message, err
+}
+
+// createGroupMessage is CreateGroupMessage, also reporting whether the
+// message was created rather than found by its client_msg_id
+func (s *ChatService) createGroupMessage(ctx context.Context, db *gorm.DB, senderID uint, req SendGroupMessageRequest) (*models.GroupMessage, bool, error) {
+	clientID, err := parseClientMsgID(req.ClientMsgID)
+	if err != nil {
+		return nil, false, err
+	}
+	if clientID != nil {
+		existing, err := findGroupMessageByClientID(ctx, db, senderID, *clientID)
+		if err != nil || existing != nil {
+			return existing, false, err
+		}
+	}
+
+	// Verify user is a member of the group
+	var member models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", req.GroupID, senderID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, errs.ErrNotGroupMember
+		}
+		return nil, false, err
+	}
+
+	// Only admins post in channels
+	if member.Role != models.GroupRoleAdmin {
+		var group models.Group
+		if err := db.Select("id", "type").First(&group, req.GroupID).Error; err != nil {
+			return nil, false, err
+		}
+		if group.Type == models.GroupTypeChannel {
+			return nil, false, errs.ErrChannelAdminsPost
+		}
+	}
+
+	// A reply must quote a message from the same group
+	if req.ReplyToID != nil {
+		var quoted models.GroupMessage
+		if err := db.Where("id = ? AND group_id = ?", *req.ReplyToID, req.GroupID).First(&quoted).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, false, errs.ErrReplyOutside
+			}
+			return nil, false, err
+		}
+	}
+
+	if err := models.ValidateMessageContent(req.Content, req.Type, maxMessageLength()); err != nil {
+		return nil, false, err
+	}
+
+	content, filtered, err := s.filterContent(req.Content)
+	if err != nil {
+		return nil, false, err
+	}
+
+	attachments, fileID, err := buildAttachments(db, senderID, req.FileIDs, req.FileID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := validateMediaMessage(db, req.Type, fileID, req.DurationMs); err != nil {
+		return nil, false, err
+	}
+
+	if (req.Type == models.MessageTypePoll) != (req.Poll != nil) {
+		return nil, false, errs.ErrPollEndpoint
+	}
+
+	expiresAt, err := messageExpiry(db, req.TTL, disappearingKey(senderID, models.ChatTypeGroup, req.GroupID))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Create message
+	message := models.GroupMessage{
+		GroupID:     req.GroupID,
+		SenderID:    senderID,
+		Content:     content,
+		Filtered:    filtered,
+		Type:        req.Type,
+		FileID:      fileID,
+		Attachments: attachments,
+		ReplyToID:   req.ReplyToID,
+		Poll:        req.Poll,
+		ExpiresAt:   expiresAt,
+		ClientMsgID: clientID,
+	}
+
+	if message.Type == "" {
+		message.Type = models.MessageTypeText
+	}
+	if message.Type.IsMedia() {
+		message.DurationMs = req.DurationMs
+	}
+
+	mentions, err := resolveMentions(db, req.GroupID, message.Content)
+	if err != nil {
+		return nil, false, err
+	}
+	message.Mentions = mentions
+
+	// Only a message about to be stored counts against the flood limit
+	if err := checkFlood(ctx, db, senderID); err != nil {
+		return nil, false, err
+	}
+
+	if message.Seq, err = nextGroupSeq(db, req.GroupID); err != nil {
+		return nil, false, err
+	}
+
+	// Every other member gets a delivery row to track the message's status
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+
+		var recipientIDs []uint
+		if err := tx.Model(&models.GroupMember{}).
+			Where("group_id = ? AND user_id <> ?", req.GroupID, senderID).
+			Pluck("user_id", &recipientIDs).Error; err != nil {
+			return err
+		}
+		if len(recipientIDs) == 0 {
+			return nil
+		}
+
+		deliveries := make([]models.MessageDelivery, len(recipientIDs))
+		for i, recipientID := range recipientIDs {
+			deliveries[i] = models.MessageDelivery{
+				MessageID: message.ID,
+				GroupID:   req.GroupID,
+				UserID:    recipientID,
+			}
+		}
+		return tx.Create(&deliveries).Error
+	})
+	if err != nil {
+		// A concurrent retry may have inserted the message first
+		if clientID != nil {
+			if existing, findErr := findGroupMessageByClientID(ctx, db, senderID, *clientID); findErr == nil && existing != nil {
+				return existing, false, nil
+			}
+		}
+		return nil, false, err
+	}
+
+	unarchiveOnMessage(db, models.ChatTypeGroup, senderID, req.GroupID)
+	clearDraft(db, senderID, models.ConversationID(models.ChatTypeGroup, req.GroupID))
+
+	// Load relations
+	db.Preload("Sender").Preload("Group").Preload("File").Scopes(preloadAttachments).Preload("ReplyTo.Sender").First(&message, message.ID)
+	message.Status = models.MessageStatusSent
+
+	Webhook.EmitToGroup(models.WebhookEventMessageCreated, message.GroupID, map[string]interface{}{
+		"message_id": message.ID,
+		"chat_type":  string(models.ChatTypeGroup),
+		"sender_id":  message.SenderID,
+		"group_id":   message.GroupID,
+		"content":    message.Content,
+		"type":       string(message.Type),
+		"created_at": message.CreatedAt,
+	})
+	LinkPreview.UnfurlGroupMessage(&message)
+	s.notifyMentions(ctx, &message)
+
+	return &message, true, nil
+}
+
+// maxBatchSend bounds the messages sent by one batch request. It is the
+// default flood limit, so a full batch fits in an empty flood window.
+const maxBatchSend = defaultFloodLimit
+
+// batchLimit returns how many messages one batch may carry: maxBatchSend,
+// lowered to the flood limit when that is configured below it
+func batchLimit() int {
+	if limit, _, _ := floodSettings(); limit >= 0 && limit < maxBatchSend {
+		return limit
+	}
+	return maxBatchSend
+}
+
+// BatchSendRequest lists messages to send in one request, in order. The
+// upper bound is batchLimit, checked by SendBatch.
+type BatchSendRequest struct {
+	Messages []BatchSendItem `json:"messages" binding:"required,min=1"`
+}
+
+// BatchSendItem is one message of a batch: either a private or a group
+// message
+type BatchSendItem struct {
+	Private *SendPrivateMessageRequest `json:"private,omitempty"`
+	Group   *SendGroupMessageRequest   `json:"group,omitempty"`
+}
+
+// BatchSendOutcome is the result of one message of a batch: the created
+// *models.PrivateMessage or *models.GroupMessage, or the error it failed
+// with
+type BatchSendOutcome struct {
+	Message interface{}
+	Err     error
+}
+
+// SendBatch sends several messages for the same sender, returning one
+// outcome per item in the same order. Each message is saved on its own, so
+// one failing does not stop the others, and is broadcast as soon as it is
+// saved. All of them go through a single database connection. allowed
+// reports whether the caller may post to a group, or to private chats when
+// given 0.
+func (s *ChatService) SendBatch(ctx context.Context, senderID uint, items []BatchSendItem, allowed func(groupID uint) bool) ([]BatchSendOutcome, error) {
+	if limit := batchLimit(); len(items) > limit {
+		return nil, fmt.Errorf("%w, send at most %d", errs.ErrBatchTooLarge, limit)
+	}
+
+	// The whole batch is counted against the flood limit up front, so it is
+	// either sent or held off as a whole
+	db := database.GetDB().WithContext(ctx)
+	if err := chargeFlood(db, senderID, len(items)); err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, floodChargedKey{}, true)
+
+	outcomes := make([]BatchSendOutcome, len(items))
+	err := db.Connection(func(tx *gorm.DB) error {
+		conn := tx.Session(&gorm.Session{})
+		for i, item := range items {
+			outcomes[i] = s.sendBatchItem(ctx, conn, senderID, item, allowed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return outcomes, nil
+}
+
+// sendBatchItem sends one message of a batch on conn
+func (s *ChatService) sendBatchItem(ctx context.Context, conn *gorm.DB, senderID uint, item BatchSendItem, allowed func(groupID uint) bool) BatchSendOutcome {
+	switch {
+	case (item.Private == nil) == (item.Group == nil):
+		return BatchSendOutcome{Err: errors.New("each message must be either private or group")}
+
+	case item.Private != nil:
+		if !allowed(0) {
+			return BatchSendOutcome{Err: errs.ErrBotScopeDenied}
+		}
+		message, err := s.sendPrivateMessage(ctx, conn, senderID, *item.Private)
+		if err != nil {
+			return BatchSendOutcome{Err: err}
+		}
+		return BatchSendOutcome{Message: message}
+
+	default:
+		if !allowed(item.Group.GroupID) {
+			return BatchSendOutcome{Err: errs.ErrBotScopeDenied}
+		}
+		message, err := s.sendGroupMessage(ctx, conn, senderID, *item.Group)
+		if err != nil {
+			return BatchSendOutcome{Err: err}
+		}
+		return BatchSendOutcome{Message: message}
+	}
+}
+
+// SendGroupMessageFromEvent sends a group message received over
+// WebSocket, the same way as SendGroupMessage
+func (s *ChatService) SendGroupMessageFromEvent(ctx context.Context, senderID uint, data map[string]interface{}) (*models.GroupMessage, error) {
+	var req SendGroupMessageRequest
+	if err := decodeEventData(data, &req); err != nil {
+		return nil, err
+	}
+
+	return s.SendGroupMessage(ctx, senderID, req)
+}
+
+// GetGroupMessages retrieves messages from a group
+func (s *ChatService) GetGroupMessages(ctx context.Context, userID, groupID uint, limit, offset int) ([]models.GroupMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	// Verify user is a member
+	var member models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrNotGroupMember
+		}
+		return nil, err
+	}
+
+	var messages []models.GroupMessage
+	if err := db.Where("group_id = ?", groupID).
+		Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+		Scopes(notExpired).
+		Preload("Sender").
+		Preload("File").
+		Scopes(preloadAttachments).
+		Preload("Mentions").
+		Preload("ReplyTo.Sender").
+		Order("seq DESC, created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	if err := decorateGroupMessages(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// ReactionRequest represents an add-reaction request
+type ReactionRequest struct {
+	Emoji       string          `json:"emoji" binding:"required,max=32"`
+	MessageType models.ChatType `json:"message_type"` // private (default) or group
+}
+
+// AddReaction adds the user's emoji reaction to a message. Adding the same
+// emoji twice is a no-op.
+func (s *ChatService) AddReaction(ctx context.Context, userID, messageID uint, chatType models.ChatType, emoji string) (*models.MessageReaction, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	participantIDs, err := messageParticipants(ctx, userID, messageID, chatType)
+	if err != nil {
+		return nil, err
+	}
+
+	reaction := models.MessageReaction{
+		MessageID:   messageID,
+		MessageType: chatType,
+		UserID:      userID,
+		Emoji:       emoji,
+	}
+
+	result := db.Where(reaction).FirstOrCreate(&reaction)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		reactionData := map[string]interface{}{
+			"message_id": messageID,
+			"chat_type":  string(chatType),
+			"user_id":    userID,
+			"emoji":      emoji,
+		}
+		for _, participantID := range participantIDs {
+			websocket.PublishToUser(participantID, "reaction_added", reactionData)
+		}
+	}
+
+	return &reaction, nil
+}
+
+// RemoveReaction removes the user's emoji reaction from a message
+func (s *ChatService) RemoveReaction(ctx context.Context, userID, messageID uint, chatType models.ChatType, emoji string) error {
+	db := database.GetDB().WithContext(ctx)
+
+	participantIDs, err := messageParticipants(ctx, userID, messageID, chatType)
+	if err != nil {
+		return err
+	}
+
+	result := db.Where("message_id = ? AND message_type = ? AND user_id = ? AND emoji = ?", messageID, chatType, userID, emoji).
+		Delete(&models.MessageReaction{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errs.ErrReactionNotFound
+	}
+
+	reactionData := map[string]interface{}{
+		"message_id": messageID,
+		"chat_type":  string(chatType),
+		"user_id":    userID,
+		"emoji":      emoji,
+	}
+	for _, participantID := range participantIDs {
+		websocket.PublishToUser(participantID, "reaction_removed", reactionData)
+	}
+
+	return nil
+}
+
+// loadReactionCounts aggregates reaction counts per message
+func loadReactionCounts(ctx context.Context, messageIDs []uint, chatType models.ChatType) (map[uint][]models.ReactionCount, error) {
+	counts := make(map[uint][]models.ReactionCount)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+	}
+	if err := database.GetDB().WithContext(ctx).Model(&models.MessageReaction{}).
+		Select("message_id, emoji, COUNT(*) AS count").
+		Where("message_type = ? AND message_id IN ?", chatType, messageIDs).
+		Group("message_id, emoji").
+		Order("message_id, MIN(created_at)").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		counts[row.MessageID] = append(counts[row.MessageID], models.ReactionCount{
+			Emoji: row.Emoji,
+			Count: row.Count,
+		})
+	}
+
+	return counts, nil
+}
+
+// decoratePrivateMessages fills in the reactions, status and poll results
+// of loaded private messages, as seen by the user
+func decoratePrivateMessages(ctx context.Context, userID uint, messages []models.PrivateMessage) error {
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	reactions, err := loadReactionCounts(ctx, ids, models.ChatTypePrivate)
+	if err != nil {
+		return err
+	}
+
+	var polls []*models.Poll
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].Status = messages[i].DeliveryStatus()
+		if messages[i].Poll != nil {
+			polls = append(polls, messages[i].Poll)
+		}
+	}
+	return loadPollResults(ctx, polls, userID)
+}
+
+// decorateGroupMessages fills in the reactions, aggregated status and poll
+// results of loaded group messages, as seen by the user
+func decorateGroupMessages(ctx context.Context, userID uint, messages []models.GroupMessage) error {
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	reactions, err := loadReactionCounts(ctx, ids, models.ChatTypeGroup)
+	if err != nil {
+		return err
+	}
+	statuses, err := loadDeliveryStatuses(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var polls []*models.Poll
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].Status = groupMessageStatus(statuses, messages[i].ID)
+		if messages[i].Poll != nil {
+			polls = append(polls, messages[i].Poll)
+		}
+	}
+	return loadPollResults(ctx, polls, userID)
+}
+
+// messageParticipants verifies that the user can see a message and returns
+// the IDs of everyone in its conversation
+func messageParticipants(ctx context.Context, userID, messageID uint, chatType models.ChatType) ([]uint, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	switch chatType {
+	case models.ChatTypePrivate:
+		var message models.PrivateMessage
+		if err := db.First(&message, messageID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errs.ErrMessageNotFound
+			}
+			return nil, err
+		}
+
+		if message.SenderID != userID && message.ReceiverID != userID {
+			return nil, errs.ErrMessageNotFound
+		}
+
+		return []uint{message.SenderID, message.ReceiverID}, nil
+
+	case models.ChatTypeGroup:
+		var message models.GroupMessage
+		if err := db.First(&message, messageID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errs.ErrMessageNotFound
+			}
+			return nil, err
+		}
+
+		memberIDs, err := Group.getMemberIDs(ctx, message.GroupID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, memberID := range memberIDs {
+			if memberID == userID {
+				return memberIDs, nil
+			}
+		}
+
+		return nil, errs.ErrNotGroupMember
+
+	default:
+		return nil, errs.ErrInvalidChatType
+	}
+}
+
+// EditMessageRequest represents a message edit request
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// EditPrivateMessage updates the content of a private message sent by the user
+func (s *ChatService) EditPrivateMessage(ctx context.Context, userID, messageID uint, newContent string) (*models.PrivateMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.PrivateMessage
+	if err := db.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	if message.DeletedForEveryone {
+		return nil, errs.ErrMessageDeleted
+	}
+
+	if err := checkEditable(message.SenderID, userID, message.Type, message.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := models.ValidateMessageContent(newContent, message.Type, maxMessageLength()); err != nil {
+		return nil, err
+	}
+
+	newContent, filtered, err := s.filterContent(newContent)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := db.Model(&message).Updates(map[string]interface{}{
+		"content":   newContent,
+		"filtered":  filtered,
+		"edited_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	message.Content = newContent
+	message.Filtered = filtered
+	message.EditedAt = &now
+
+	editData := map[string]interface{}{
+		"message_id":  message.ID,
+		"chat_type":   "private",
+		"sender_id":   message.SenderID,
+		"receiver_id": message.ReceiverID,
+		"content":     message.Content,
+		"filtered":    message.Filtered,
+		"edited_at":   message.EditedAt,
+	}
+	websocket.PublishToUser(message.ReceiverID, "message_edited", editData)
+	websocket.PublishToUser(message.SenderID, "message_edited", editData)
+
+	return &message, nil
+}
+
+// EditGroupMessage updates the content of a group message sent by the user
+func (s *ChatService) EditGroupMessage(ctx context.Context, userID, messageID uint, newContent string) (*models.GroupMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.GroupMessage
+	if err := db.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	if message.DeletedForEveryone {
+		return nil, errs.ErrMessageDeleted
+	}
+
+	if err := checkEditable(message.SenderID, userID, message.Type, message.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := models.ValidateMessageContent(newContent, message.Type, maxMessageLength()); err != nil {
+		return nil, err
+	}
+
+	newContent, filtered, err := s.filterContent(newContent)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := db.Model(&message).Updates(map[string]interface{}{
+		"content":   newContent,
+		"filtered":  filtered,
+		"edited_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	message.Content = newContent
+	message.Filtered = filtered
+	message.EditedAt = &now
+
+	memberIDs, err := Group.getMemberIDs(ctx, message.GroupID)
+	if err != nil {
+		logrus.Errorf("Failed to load members of group %d: %v", message.GroupID, err)
+		return &message, nil
+	}
+
+	editData := map[string]interface{}{
+		"message_id": message.ID,
+		"chat_type":  "group",
+		"group_id":   message.GroupID,
+		"sender_id":  message.SenderID,
+		"content":    message.Content,
+		"filtered":   message.Filtered,
+		"edited_at":  message.EditedAt,
+	}
+	websocket.PublishToUsers(memberIDs, "message_edited", editData)
+
+	return &message, nil
+}
+
+// DeletePrivateMessage deletes a private message. With forEveryone the sender
+// unsends it for both participants; otherwise it is only hidden for the user.
+func (s *ChatService) DeletePrivateMessage(ctx context.Context, userID, messageID uint, forEveryone bool) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.PrivateMessage
+	if err := db.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrMessageNotFound
+		}
+		return err
+	}
+
+	if message.SenderID != userID && message.ReceiverID != userID {
+		return errs.ErrMessageNotFound
+	}
+
+	if !forEveryone {
+		return hideMessage(ctx, userID, message.ID, models.ChatTypePrivate)
+	}
+
+	if err := checkDeletableForEveryone(message.SenderID, userID, message.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return unsendMessage(tx, &message, message.ID, models.ChatTypePrivate)
+	}); err != nil {
+		return err
+	}
+
+	deleteData := map[string]interface{}{
+		"message_id":  message.ID,
+		"chat_type":   "private",
+		"sender_id":   message.SenderID,
+		"receiver_id": message.ReceiverID,
+	}
+	websocket.PublishToUser(message.ReceiverID, "message_deleted", deleteData)
+	websocket.PublishToUser(message.SenderID, "message_deleted", deleteData)
+
+	return nil
+}
+
+// DeleteGroupMessage deletes a group message. With forEveryone the sender
+// unsends it for all members; otherwise it is only hidden for the user.
+func (s *ChatService) DeleteGroupMessage(ctx context.Context, userID, messageID uint, forEveryone bool) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.GroupMessage
+	if err := db.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrMessageNotFound
+		}
+		return err
+	}
+
+	var member models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", message.GroupID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrNotGroupMember
+		}
+		return err
+	}
+
+	if !forEveryone {
+		return hideMessage(ctx, userID, message.ID, models.ChatTypeGroup)
+	}
+
+	if err := checkDeletableForEveryone(message.SenderID, userID, message.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return unsendMessage(tx, &message, message.ID, models.ChatTypeGroup)
+	}); err != nil {
+		return err
+	}
+
+	memberIDs, err := Group.getMemberIDs(ctx, message.GroupID)
+	if err != nil {
+		logrus.Errorf("Failed to load members of group %d: %v", message.GroupID, err)
+		return nil
+	}
+
+	deleteData := map[string]interface{}{
+		"message_id": message.ID,
+		"chat_type":  "group",
+		"group_id":   message.GroupID,
+		"sender_id":  message.SenderID,
+	}
+	websocket.PublishToUsers(memberIDs, "message_deleted", deleteData)
+
+	return nil
+}
+
+// unsendMessage blanks a message for everyone within tx and deletes what
+// hangs off it (attachments, link preview and poll), so none of it can be
+// read or downloaded afterwards. message is the loaded PrivateMessage or
+// GroupMessage.
+func unsendMessage(tx *gorm.DB, message interface{}, messageID uint, chatType models.ChatType) error {
+	if err := tx.Model(message).Updates(map[string]interface{}{
+		"content":              "",
+		"file_id":              nil,
+		"deleted_for_everyone": true,
+	}).Error; err != nil {
+		return err
+	}
+
+	tx = tx.Unscoped().Session(&gorm.Session{})
+	pollIDs := func() *gorm.DB {
+		return tx.Model(&models.Poll{}).Select("id").
+			Where("message_type = ? AND message_id = ?", chatType, messageID)
+	}
+
+	if err := tx.Where("poll_id IN (?)", pollIDs()).Delete(&models.PollVote{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("poll_id IN (?)", pollIDs()).Delete(&models.PollOption{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id = ?", chatType, messageID).Delete(&models.Poll{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id = ?", chatType, messageID).Delete(&models.MessageAttachment{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("message_type = ? AND message_id = ?", chatType, messageID).Delete(&models.LinkPreview{}).Error
+}
+
+// hideMessage hides a message for a single user
+func hideMessage(ctx context.Context, userID, messageID uint, chatType models.ChatType) error {
+	db := database.GetDB().WithContext(ctx)
+
+	hidden := models.MessageHidden{
+		UserID:      userID,
+		MessageID:   messageID,
+		MessageType: chatType,
+	}
+
+	return db.Where(hidden).FirstOrCreate(&hidden).Error
+}
+
+// notHiddenClause builds a condition excluding messages the user has hidden.
+// It takes the user ID as its only argument.
+func notHiddenClause(table string, chatType models.ChatType) string {
+	return "NOT EXISTS (SELECT 1 FROM message_hidden mh WHERE mh.message_id = " + table +
+		".id AND mh.message_type = '" + string(chatType) + "' AND mh.user_id = ?)"
+}
+
+// notExpired excludes disappearing messages past their expiry that the
+// sweeper has not removed yet
+func notExpired(db *gorm.DB) *gorm.DB {
+	return db.Where("expires_at IS NULL OR expires_at > ?", time.Now())
+}
+
+// checkDeletableForEveryone verifies that the user may unsend a message
+func checkDeletableForEveryone(senderID, userID uint, createdAt time.Time) error {
+	if senderID != userID {
+		return errs.ErrSenderDeletes
+	}
+
+	if time.Since(createdAt) > editWindow() {
+		return errs.ErrDeleteWindowExpired
+	}
+
+	return nil
+}
+
+// buildAttachments turns the requested file IDs into ordered attachments,
+// checking that the sender uploaded each file. The legacy single file_id is
+// treated as a one-file list; otherwise it is set to the first attachment
+// so older clients still see a file.
+func buildAttachments(db *gorm.DB, senderID uint, fileIDs []uint, fileID *uint) ([]models.MessageAttachment, *uint, error) {
+	if len(fileIDs) == 0 {
+		if fileID == nil {
+			return nil, nil, nil
+		}
+		fileIDs = []uint{*fileID}
+	}
+	if len(fileIDs) > maxAttachments {
+		return nil, nil, fmt.Errorf("a message can carry at most %d attachments", maxAttachments)
+	}
+
+	seen := make(map[uint]bool, len(fileIDs))
+	for _, id := range fileIDs {
+		if seen[id] {
+			return nil, nil, errs.ErrDuplicateFile
+		}
+		seen[id] = true
+	}
+
+	var owned int64
+	if err := db.Model(&models.File{}).
+		Where("id IN ? AND uploader_id = ?", fileIDs, senderID).
+		Count(&owned).Error; err != nil {
+		return nil, nil, err
+	}
+	if owned != int64(len(fileIDs)) {
+		return nil, nil, errs.ErrAttachmentNotOwned
+	}
+
+	attachments := make([]models.MessageAttachment, len(fileIDs))
+	for i, id := range fileIDs {
+		attachments[i] = models.MessageAttachment{FileID: id, Order: i}
+	}
+
+	first := fileIDs[0]
+	return attachments, &first, nil
+}
+
+// preloadAttachments loads a message's attachments with their files in
+// display order, its link preview and its poll
+func preloadAttachments(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("Attachments", func(tx *gorm.DB) *gorm.DB {
+			return tx.Order(clause.OrderByColumn{Column: clause.Column{Name: "order"}})
+		}).
+		Preload("Attachments.File").
+		Preload("LinkPreview").
+		Preload("Poll.Options", func(tx *gorm.DB) *gorm.DB {
+			return tx.Order(clause.OrderByColumn{Column: clause.Column{Name: "order"}})
+		})
+}
+
+// validateMediaMessage checks that an audio or video message references an
+// uploaded file of the matching kind and carries a sane duration
+func validateMediaMessage(db *gorm.DB, msgType models.MessageType, fileID *uint, durationMs *int) error {
+	if !msgType.IsMedia() {
+		return nil
+	}
+
+	if fileID == nil {
+		return fmt.Errorf("%s messages require a file_id", msgType)
+	}
+	if durationMs != nil && *durationMs < 0 {
+		return errors.New("duration_ms cannot be negative")
+	}
+
+	var file models.File
+	if err := db.Select("id", "mime_type").First(&file, *fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrFileNotFound
+		}
+		return err
+	}
+
+	if !strings.HasPrefix(file.MimeType, string(msgType)+"/") {
+		return fmt.Errorf("%s messages require a %s/* file, got %s", msgType, msgType, file.MimeType)
+	}
+
+	return nil
+}
+
+// checkEditable verifies that a message may still be changed by the user
+func checkEditable(senderID, userID uint, msgType models.MessageType, createdAt time.Time) error {
+	if senderID != userID {
+		return errs.ErrSenderEdits
+	}
+
+	if msgType == models.MessageTypeFile || msgType.IsMedia() {
+		return errors.New("file messages cannot be edited")
+	}
+
+	if msgType == models.MessageTypePoll {
+		return errors.New("polls cannot be edited")
+	}
+
+	if time.Since(createdAt) > editWindow() {
+		return errs.ErrEditWindowExpired
+	}
+
+	return nil
+}
+
+// editWindow returns the configured message edit window
+func editWindow() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Chat.EditWindow > 0 {
+		return cfg.Chat.EditWindow
+	}
+	return defaultEditWindow
+}
+
+// maxMessageLength returns the configured content limit, falling back to
+// the default
+func maxMessageLength() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Chat.MaxMessageLength > 0 {
+		return cfg.Chat.MaxMessageLength
+	}
+	return models.DefaultMaxMessageLength
+}
+
+// Flood control applied when none is configured
+const (
+	defaultFloodLimit    = 20
+	defaultFloodWindow   = 10 * time.Second
+	defaultFloodCooldown = 30 * time.Second
+)
+
+// floodSettings returns the configured flood control, falling back to the
+// defaults. A negative limit disables it.
+func floodSettings() (int, time.Duration, time.Duration) {
+	limit, window, cooldown := defaultFloodLimit, defaultFloodWindow, defaultFloodCooldown
+	if cfg := config.GetConfig(); cfg != nil {
+		if cfg.Chat.FloodLimit != 0 {
+			limit = cfg.Chat.FloodLimit
+		}
+		if cfg.Chat.FloodWindow > 0 {
+			window = cfg.Chat.FloodWindow
+		}
+		if cfg.Chat.FloodCooldown > 0 {
+			cooldown = cfg.Chat.FloodCooldown
+		}
+	}
+	return limit, window, cooldown
+}
+
+// floodChargedKey marks a context whose sends were already counted against
+// the sender's flood window, as a batch's are
+type floodChargedKey struct{}
+
+// checkFlood counts a message against the sender's flood window, unless ctx
+// says it was counted already
+func checkFlood(ctx context.Context, db *gorm.DB, senderID uint) error {
+	if ctx.Value(floodChargedKey{}) != nil {
+		return nil
+	}
+	return chargeFlood(db, senderID, 1)
+}
+
+// chargeFlood counts count messages against the sender's flood window, all
+// or none of them. A sender over the limit gets an errs.FloodWaitError until
+// their cooldown ends, and each rejected send sends a flood_wait hint to
+// their connections. Site admins are exempt. Messages go through when Redis
+// is unavailable.
+func chargeFlood(db *gorm.DB, senderID uint, count int) error {
+	limit, window, cooldown := floodSettings()
+	if limit < 0 {
+		return nil
+	}
+
+	wait, err := redis.CheckFlood(senderID, count, limit, window, cooldown)
+	if err != nil {
+		logrus.Errorf("Flood control unavailable: %v", err)
+		return nil
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	var sender models.User
+	if err := db.Select("id", "admin").First(&sender, senderID).Error; err == nil && sender.Admin {
+		return nil
+	}
+
+	floodErr := &errs.FloodWaitError{Wait: wait}
+	websocket.PublishToUsers([]uint{senderID}, "flood_wait", map[string]interface{}{
+		"retry_after": floodErr.RetryAfter(),
+	})
+	return floodErr
+}
+
+// GetConversations returns list of conversations for a user. Archived
+// conversations are left out unless includeArchived is set.
+func (s *ChatService) GetConversations(ctx context.Context, userID uint, includeArchived bool) ([]map[string]interface{}, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var archivedIDs []string
+	if err := db.Model(&models.ConversationArchive{}).
+		Where("user_id = ?", userID).
+		Pluck("conversation_id", &archivedIDs).Error; err != nil {
+		return nil, err
+	}
+	archived := make(map[string]bool, len(archivedIDs))
+	for _, id := range archivedIDs {
+		archived[id] = true
+	}
+
+	// Get latest message with each user
+	var conversations []map[string]interface{}
+
+	// Query for private conversations. It skips deleted and unsent messages,
+	// those the user hid and expired ones, so a preview never shows a
+	// message whose content is gone for the user.
+	visible := `%[1]s.deleted_at IS NULL
+            AND %[1]s.deleted_for_everyone = false
+            AND (%[1]s.expires_at IS NULL OR %[1]s.expires_at > @now)
+            AND NOT EXISTS (
+                SELECT 1 FROM message_hidden mh
+                WHERE mh.message_id = %[1]s.id AND mh.message_type = 'private' AND mh.user_id = @user
+            )`
+	query := `
+    WITH conversations AS (
+        SELECT 
+            CASE 
+                WHEN sender_id = @user THEN receiver_id 
+                ELSE sender_id 
+            END as other_user_id,
+            MAX(created_at) as last_message_at
+        FROM private_messages
+        WHERE (sender_id = @user OR receiver_id = @user)
+            AND ` + fmt.Sprintf(visible, "private_messages") + `
+        GROUP BY other_user_id
+    )
+    SELECT 
+        c.other_user_id,
+        c.last_message_at,
+        (
+            SELECT pm2.content
+            FROM private_messages pm2
+            WHERE ((pm2.sender_id = @user AND pm2.receiver_id = c.other_user_id)
+               OR (pm2.sender_id = c.other_user_id AND pm2.receiver_id = @user))
+              AND ` + fmt.Sprintf(visible, "pm2") + `
+            ORDER BY pm2.created_at DESC
+            LIMIT 1
+        ) as last_message
+    FROM conversations c
+    ORDER BY c.last_message_at DESC
+`
+
+	rows, err := db.Raw(query, sql.Named("user", userID), sql.Named("now", time.Now())).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type conversationRow struct {
+		otherUserID   uint
+		lastMessageAt string
+		lastMessage   string
+	}
+
+	var convRows []conversationRow
+	var otherUserIDs []uint
+	for rows.Next() {
+		var row conversationRow
+		if err := rows.Scan(&row.otherUserID, &row.lastMessageAt, &row.lastMessage); err != nil {
+			return nil, err
+		}
+
+		conversationID := models.ConversationID(models.ChatTypePrivate, row.otherUserID)
+		if archived[conversationID] && !includeArchived {
+			continue
+		}
+
+		convRows = append(convRows, row)
+		otherUserIDs = append(otherUserIDs, row.otherUserID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(convRows) == 0 {
+		return conversations, nil
+	}
+
+	// Get other users' info in one query rather than one per conversation
+	var otherUsers []models.User
+	if err := db.Where("id IN ?", otherUserIDs).Find(&otherUsers).Error; err != nil {
+		return nil, err
+	}
+
+	userResponses, err := User.PublicResponses(ctx, userID, otherUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range convRows {
+		conversationID := models.ConversationID(models.ChatTypePrivate, row.otherUserID)
+
+		conversations = append(conversations, map[string]interface{}{
+			"type":            "private",
+			"conversation_id": conversationID,
+			"user":            userResponses[row.otherUserID],
+			"last_message":    row.lastMessage,
+			"last_message_at": row.lastMessageAt,
+			"archived":        archived[conversationID],
+		})
+	}
+
+	return conversations, nil
+}
+
+// decodeEventData converts a WebSocket event payload into a request struct
+func decodeEventData(data map[string]interface{}, out interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw, out); err != nil {
+		return errors.New("invalid message payload")
+	}
+
+	return nil
+}
+
+// parseClientMsgID validates a client-supplied message ID and returns it in
+// canonical form, or nil when none was given
+func parseClientMsgID(id string) (*string, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, errors.New("client_msg_id must be a UUID")
+	}
+
+	canonical := parsed.String()
+	return &canonical, nil
+}
+
+// findPrivateMessageByClientID returns the private message the sender sent
+// with the client ID, or nil if there is none
+func findPrivateMessageByClientID(db *gorm.DB, senderID uint, clientID string) (*models.PrivateMessage, error) {
+	var message models.PrivateMessage
+	if err := db.Where("sender_id = ? AND client_msg_id = ?", senderID, clientID).
+		Preload("Sender").
+		Preload("Receiver").
+		Preload("File").
+		Scopes(preloadAttachments).
+		Preload("ReplyTo.Sender").
+		First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	message.Status = message.DeliveryStatus()
+	return &message, nil
+}
+
+// findGroupMessageByClientID returns the group message the sender sent with
+// the client ID, or nil if there is none
+func findGroupMessageByClientID(ctx context.Context, db *gorm.DB, senderID uint, clientID string) (*models.GroupMessage, error) {
+	var message models.GroupMessage
+	if err := db.Where("sender_id = ? AND client_msg_id = ?", senderID, clientID).
+		Preload("Sender").
+		Preload("Group").
+		Preload("File").
+		Scopes(preloadAttachments).
+		Preload("Mentions").
+		Preload("ReplyTo.Sender").
+		First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	statuses, err := loadDeliveryStatuses(ctx, []uint{message.ID})
+	if err != nil {
+		return nil, err
+	}
+	message.Status = groupMessageStatus(statuses, message.ID)
+	return &message, nil
+}
+
+// Search scopes
+const (
+	SearchScopeAll     = "all"
+	SearchScopePrivate = "private"
+	SearchScopeGroup   = "group"
+)
+
+// maxSearchResults bounds how many results one search page may return
+const maxSearchResults = 100
+
+// SearchHighlight marks a match within a result's content, as character
+// offsets [Start, End)
+type SearchHighlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// MessageSearchResult is a message matching a search, with the conversation
+// it belongs to
+type MessageSearchResult struct {
+	MessageID      uint               `json:"message_id"`
+	ChatType       models.ChatType    `json:"chat_type"`
+	ConversationID string             `json:"conversation_id"`
+	GroupName      string             `json:"group_name,omitempty"`
+	SenderID       uint               `json:"sender_id"`
+	SenderUsername string             `json:"sender_username"`
+	Content        string             `json:"content"`
+	Type           models.MessageType `json:"type"`
+	CreatedAt      time.Time          `json:"created_at"`
+	Highlights     []SearchHighlight  `json:"highlights"`
+}
+
+// SearchMessages finds messages containing the query in the user's private
+// conversations and groups, newest first. Only conversations the user takes
+// part in are searched.
+func (s *ChatService) SearchMessages(ctx context.Context, userID uint, query, scope string, limit, offset int) ([]MessageSearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("search query cannot be empty")
+	}
+	if scope == "" {
+		scope = SearchScopeAll
+	}
+	if scope != SearchScopeAll && scope != SearchScopePrivate && scope != SearchScopeGroup {
+		return nil, errors.New("scope must be private, group or all")
+	}
+	if limit <= 0 || limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	db := database.GetDB().WithContext(ctx)
+	matchSQL, matchArgs := searchMatchClause(db, query)
+
+	// Each side is fetched up to the end of the page, then merged by date
+	window := offset + limit
+	var results []MessageSearchResult
+
+	if scope != SearchScopeGroup {
+		var messages []models.PrivateMessage
+		if err := db.Where("sender_id = ? OR receiver_id = ?", userID, userID).
+			Where("deleted_for_everyone = ?", false).
+			Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+			Where(matchSQL, matchArgs...).
+			Scopes(notExpired).
+			Preload("Sender").
+			Order("created_at DESC").
+			Limit(window).
+			Find(&messages).Error; err != nil {
+			return nil, err
+		}
+
+		for _, m := range messages {
+			otherID := m.ReceiverID
+			if otherID == userID {
+				otherID = m.SenderID
+			}
+			results = append(results, MessageSearchResult{
+				MessageID:      m.ID,
+				ChatType:       models.ChatTypePrivate,
+				ConversationID: models.ConversationID(models.ChatTypePrivate, otherID),
+				SenderID:       m.SenderID,
+				SenderUsername: m.Sender.Username,
+				Content:        m.Content,
+				Type:           m.Type,
+				CreatedAt:      m.CreatedAt,
+			})
+		}
+	}
+
+	if scope != SearchScopePrivate {
+		memberGroups := db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+
+		var messages []models.GroupMessage
+		if err := db.Where("group_id IN (?)", memberGroups).
+			Where("deleted_for_everyone = ?", false).
+			Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+			Where(matchSQL, matchArgs...).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("Group").
+			Order("created_at DESC").
+			Limit(window).
+			Find(&messages).Error; err != nil {
+			return nil, err
+		}
+
+		for _, m := range messages {
+			results = append(results, MessageSearchResult{
+				MessageID:      m.ID,
+				ChatType:       models.ChatTypeGroup,
+				ConversationID: models.ConversationID(models.ChatTypeGroup, m.GroupID),
+				GroupName:      m.Group.Name,
+				SenderID:       m.SenderID,
+				SenderUsername: m.Sender.Username,
+				Content:        m.Content,
+				Type:           m.Type,
+				CreatedAt:      m.CreatedAt,
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+
+	if offset >= len(results) {
+		return []MessageSearchResult{}, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	for i := range results {
+		results[i].Highlights = highlightTerms(results[i].Content, query)
+	}
+
+	return results, nil
+}
+
+// likeEscaper escapes LIKE wildcards, for patterns used with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// searchMatchClause builds the condition matching message content against
+// a query. Postgres uses full-text search, falling back to a trigram-indexed
+// substring match for partial words; other databases use LIKE.
+func searchMatchClause(db *gorm.DB, query string) (string, []interface{}) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+
+	if db.Dialector.Name() == "postgres" {
+		return `(to_tsvector('simple', content) @@ plainto_tsquery('simple', ?) OR content ILIKE ? ESCAPE '\')`,
+			[]interface{}{query, pattern}
+	}
+
+	return `LOWER(content) LIKE LOWER(?) ESCAPE '\'`, []interface{}{pattern}
+}
+
+// highlightTerms returns the character ranges where the query's words occur
+// in content, ignoring case
+func highlightTerms(content, query string) []SearchHighlight {
+	text := []rune(strings.ToLower(content))
+	if len(text) != len([]rune(content)) {
+		// Lowercasing changed the length; offsets would not line up
+		return []SearchHighlight{}
+	}
+
+	highlights := []SearchHighlight{}
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		needle := []rune(term)
+		for i := 0; i+len(needle) <= len(text); i++ {
+			if string(text[i:i+len(needle)]) == term {
+				highlights = append(highlights, SearchHighlight{Start: i, End: i + len(needle)})
+				i += len(needle) - 1
+			}
+		}
+	}
+
+	sort.Slice(highlights, func(i, j int) bool {
+		return highlights[i].Start < highlights[j].Start
+	})
+
+	return highlights
+}
+
+const (
+	// defaultSyncMessages is the sync page size when none is requested
+	defaultSyncMessages = 100
+
+	// maxSyncMessages bounds the messages returned by one sync page
+	maxSyncMessages = 500
+)
+
+// SyncConversation returns the messages of a conversation numbered after
+// sinceSeq, oldest first and at most limit of them, so a client can fill
+// the gap it missed. The conversation ID is seen from the user's side.
+func (s *ChatService) SyncConversation(ctx context.Context, userID uint, conversationID string, sinceSeq int64, limit int) (*models.ConversationSync, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if sinceSeq < 0 {
+		sinceSeq = 0
+	}
+	if limit <= 0 {
+		limit = defaultSyncMessages
+	}
+	if limit > maxSyncMessages {
+		limit = maxSyncMessages
+	}
+
+	result := &models.ConversationSync{
+		ChatType:       chatType,
+		ConversationID: conversationID,
+	}
+
+	if chatType == models.ChatTypePrivate {
+		var messages []models.PrivateMessage
+		if err := db.Where(
+			"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+			userID, chatID, chatID, userID,
+		).
+			Where("seq > ?", sinceSeq).
+			Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("Receiver").
+			Preload("File").
+			Scopes(preloadAttachments).
+			Preload("ReplyTo.Sender").
+			Order("seq ASC").
+			Limit(limit + 1).
+			Find(&messages).Error; err != nil {
+			return nil, err
+		}
+
+		if len(messages) > limit {
+			messages = messages[:limit]
+			result.HasMore = true
+		}
+		if err := decoratePrivateMessages(ctx, userID, messages); err != nil {
+			return nil, err
+		}
+		result.Messages = messages
+		return result, nil
+	}
+
+	var count int64
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", chatID, userID).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errs.ErrNotGroupMember
+	}
+
+	var messages []models.GroupMessage
+	if err := db.Where("group_id = ? AND seq > ?", chatID, sinceSeq).
+		Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+		Scopes(notExpired).
+		Preload("Sender").
+		Preload("File").
+		Scopes(preloadAttachments).
+		Preload("Mentions").
+		Preload("ReplyTo.Sender").
+		Order("seq ASC").
+		Limit(limit + 1).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	if len(messages) > limit {
+		messages = messages[:limit]
+		result.HasMore = true
+	}
+	if err := decorateGroupMessages(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+	result.Messages = messages
+	return result, nil
+}
+
+// maxContextMessages bounds how many messages are loaded on each side of a
+// context target
+const maxContextMessages = 100
+
+// MessageContext is a message with its neighbours in the conversation,
+// oldest first
+type MessageContext struct {
+	ChatType       models.ChatType `json:"chat_type"`
+	ConversationID string          `json:"conversation_id"`
+	TargetID       uint            `json:"target_id"`
+	Messages       interface{}     `json:"messages"` // []models.PrivateMessage or []models.GroupMessage
+}
+
+// GetMessageContext returns the message plus up to before older and after
+// newer messages of the same conversation. Message IDs are per chat type,
+// so chatType picks the table; when empty the user's private messages are
+// tried first, then their groups' messages.
+func (s *ChatService) GetMessageContext(ctx context.Context, userID, messageID uint, chatType models.ChatType, before, after int) (*MessageContext, error) {
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+	if before > maxContextMessages {
+		before = maxContextMessages
+	}
+	if after > maxContextMessages {
+		after = maxContextMessages
+	}
+
+	if chatType != models.ChatTypeGroup {
+		result, err := s.privateMessageContext(ctx, userID, messageID, before, after)
+		if err == nil || chatType == models.ChatTypePrivate || !errors.Is(err, errs.ErrMessageNotFound) {
+			return result, err
+		}
+	}
+
+	return s.groupMessageContext(ctx, userID, messageID, before, after)
+}
+
+func (s *ChatService) privateMessageContext(ctx context.Context, userID, messageID uint, before, after int) (*MessageContext, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var target models.PrivateMessage
+	if err := db.Where("id = ? AND (sender_id = ? OR receiver_id = ?)", messageID, userID, userID).
+		Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+		Scopes(notExpired).
+		First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	otherID := target.ReceiverID
+	if otherID == userID {
+		otherID = target.SenderID
+	}
+
+	conversation := func() *gorm.DB {
+		return db.Where(
+			"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+			userID, otherID, otherID, userID,
+		).
+			Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("Receiver").
+			Preload("File").
+			Scopes(preloadAttachments).
+			Preload("ReplyTo.Sender")
+	}
+
+	var older, rest []models.PrivateMessage
+	if before > 0 {
+		if err := conversation().
+			Where("created_at < ? OR (created_at = ? AND id < ?)", target.CreatedAt, target.CreatedAt, target.ID).
+			Order("created_at DESC, id DESC").
+			Limit(before).
+			Find(&older).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := conversation().
+		Where("created_at > ? OR (created_at = ? AND id >= ?)", target.CreatedAt, target.CreatedAt, target.ID).
+		Order("created_at ASC, id ASC").
+		Limit(after + 1).
+		Find(&rest).Error; err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.PrivateMessage, 0, len(older)+len(rest))
+	for i := len(older) - 1; i >= 0; i-- {
+		messages = append(messages, older[i])
+	}
+	messages = append(messages, rest...)
+
+	if err := decoratePrivateMessages(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
+	return &MessageContext{
+		ChatType:       models.ChatTypePrivate,
+		ConversationID: models.ConversationID(models.ChatTypePrivate, otherID),
+		TargetID:       target.ID,
+		Messages:       messages,
+	}, nil
+}
+
+func (s *ChatService) groupMessageContext(ctx context.Context, userID, messageID uint, before, after int) (*MessageContext, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	memberGroups := db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+
+	var target models.GroupMessage
+	if err := db.Where("id = ? AND group_id IN (?)", messageID, memberGroups).
+		Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+		Scopes(notExpired).
+		First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	conversation := func() *gorm.DB {
+		return db.Where("group_id = ?", target.GroupID).
+			Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("File").
+			Scopes(preloadAttachments).
+			Preload("Mentions").
+			Preload("ReplyTo.Sender")
+	}
+
+	var older, rest []models.GroupMessage
+	if before > 0 {
+		if err := conversation().
+			Where("created_at < ? OR (created_at = ? AND id < ?)", target.CreatedAt, target.CreatedAt, target.ID).
+			Order("created_at DESC, id DESC").
+			Limit(before).
+			Find(&older).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := conversation().
+		Where("created_at > ? OR (created_at = ? AND id >= ?)", target.CreatedAt, target.CreatedAt, target.ID).
+		Order("created_at ASC, id ASC").
+		Limit(after + 1).
+		Find(&rest).Error; err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.GroupMessage, 0, len(older)+len(rest))
+	for i := len(older) - 1; i >= 0; i-- {
+		messages = append(messages, older[i])
+	}
+	messages = append(messages, rest...)
+
+	if err := decorateGroupMessages(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
+	return &MessageContext{
+		ChatType:       models.ChatTypeGroup,
+		ConversationID: models.ConversationID(models.ChatTypeGroup, target.GroupID),
+		TargetID:       target.ID,
+		Messages:       messages,
+	}, nil
+}
+
+const (
+	// maxDisappearAfter bounds disappearing timers and per-message TTLs
+	maxDisappearAfter = 90 * 24 * time.Hour
+
+	// expirySweepInterval is how often expired messages are removed
+	expirySweepInterval = 5 * time.Second
+
+	// expirySweepBatch bounds the messages of each kind removed per sweep
+	expirySweepBatch = 500
+)
+
+// SetDisappearingRequest represents a disappearing timer update
+type SetDisappearingRequest struct {
+	DisappearAfter int `json:"disappear_after"` // Seconds new messages live; 0 turns the timer off
+}
+
+// SetDisappearing sets how long new messages in a conversation live. Both
+// participants of a private chat may change it; in groups only admins can.
+func (s *ChatService) SetDisappearing(ctx context.Context, userID uint, conversationID string, after time.Duration) (*models.DisappearingSetting, error) {
+	if after < 0 {
+		return nil, errors.New("disappear_after cannot be negative")
+	}
+	if after > maxDisappearAfter {
+		return nil, fmt.Errorf("disappear_after cannot exceed %d seconds", int(maxDisappearAfter/time.Second))
+	}
+
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if chatType == models.ChatTypeGroup {
+		if err := Group.requireRole(ctx, chatID, userID, models.GroupRoleAdmin); err != nil {
+			return nil, err
+		}
+	} else if err := db.Select("id").First(&models.User{}, chatID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	setting := models.DisappearingSetting{
+		ConversationKey: disappearingKey(userID, chatType, chatID),
+		DisappearAfter:  int(after / time.Second),
+		UpdatedBy:       userID,
+	}
+
+	if after == 0 {
+		if err := db.Where("conversation_key = ?", setting.ConversationKey).
+			Delete(&models.DisappearingSetting{}).Error; err != nil {
+			return nil, err
+		}
+	} else if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "conversation_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"disappear_after", "updated_by", "updated_at"}),
+	}).Create(&setting).Error; err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"chat_type":       string(chatType),
+		"disappear_after": setting.DisappearAfter,
+		"updated_by":      userID,
+	}
+	if chatType == models.ChatTypeGroup {
+		data["conversation_id"] = models.ConversationID(models.ChatTypeGroup, chatID)
+		data["group_id"] = chatID
+		Group.broadcastToMembers(ctx, chatID, "disappearing_updated", data)
+	} else {
+		publishToPair(userID, chatID, "disappearing_updated", data)
+	}
+
+	return &setting, nil
+}
+
+// disappearingKey identifies the disappearing setting of the conversation
+// the user has with a group or another user. It also keys the
+// conversation's message counter.
+func disappearingKey(userID uint, chatType models.ChatType, chatID uint) string {
+	if chatType == models.ChatTypeGroup {
+		return models.ConversationID(models.ChatTypeGroup, chatID)
+	}
+
+	low, high := userID, chatID
+	if low > high {
+		low, high = high, low
+	}
+	return fmt.Sprintf("%s:%d:%d", models.ChatTypePrivate, low, high)
+}
+
+// nextPrivateSeq numbers the next message between two users. Deleted
+// messages keep their numbers, so they count when seeding the counter.
+func nextPrivateSeq(db *gorm.DB, senderID, receiverID uint) (int64, error) {
+	return redis.NextSequence(disappearingKey(senderID, models.ChatTypePrivate, receiverID), func() (int64, error) {
+		var highest int64
+		err := db.Unscoped().Model(&models.PrivateMessage{}).
+			Where(
+				"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+				senderID, receiverID, receiverID, senderID,
+			).
+			Select("COALESCE(MAX(seq), 0)").
+			Scan(&highest).Error
+		return highest, err
+	})
+}
+
+// nextGroupSeq numbers the next message of a group
+func nextGroupSeq(db *gorm.DB, groupID uint) (int64, error) {
+	return redis.NextSequence(disappearingKey(0, models.ChatTypeGroup, groupID), func() (int64, error) {
+		var highest int64
+		err := db.Unscoped().Model(&models.GroupMessage{}).
+			Where("group_id = ?", groupID).
+			Select("COALESCE(MAX(seq), 0)").
+			Scan(&highest).Error
+		return highest, err
+	})
+}
+
+// messageExpiry returns when a new message disappears: after its own TTL if
+// one is given, otherwise after the conversation's timer, if set
+func messageExpiry(db *gorm.DB, ttl int, conversationKey string) (*time.Time, error) {
+	if ttl < 0 {
+		return nil, errors.New("ttl cannot be negative")
+	}
+	if ttl > int(maxDisappearAfter/time.Second) {
+		return nil, fmt.Errorf("ttl cannot exceed %d seconds", int(maxDisappearAfter/time.Second))
+	}
+
+	after := time.Duration(ttl) * time.Second
+	if ttl == 0 {
+		var setting models.DisappearingSetting
+		if err := db.Where("conversation_key = ?", conversationKey).First(&setting).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		after = time.Duration(setting.DisappearAfter) * time.Second
+	}
+
+	expiresAt := time.Now().Add(after)
+	return &expiresAt, nil
+}
+
+// publishToPair sends a private conversation event to both participants,
+// each seeing the other as the conversation
+func publishToPair(userID, otherID uint, event string, data map[string]interface{}) {
+	for _, pair := range [][2]uint{{userID, otherID}, {otherID, userID}} {
+		recipientData := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			recipientData[k] = v
+		}
+		recipientData["conversation_id"] = models.ConversationID(models.ChatTypePrivate, pair[1])
+		websocket.PublishToUser(pair[0], event, recipientData)
+
+		if userID == otherID {
+			return
+		}
+	}
+}
+
+// RunExpiredMessageSweeper periodically removes disappearing messages past
+// their expiry. It blocks and is meant to be started in its own goroutine.
+func (s *ChatService) RunExpiredMessageSweeper() {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), expirySweepInterval)
+		if err := s.sweepExpiredMessages(ctx); err != nil {
+			logrus.Errorf("Failed to sweep expired messages: %v", err)
+		}
+		cancel()
+	}
+}
+
+// sweepExpiredMessages soft-deletes expired messages and tells the
+// participants with message_expired so clients drop them
+func (s *ChatService) sweepExpiredMessages(ctx context.Context) error {
+	db := database.GetDB().WithContext(ctx)
+	now := time.Now()
+
+	var private []models.PrivateMessage
+	if err := db.Select("id", "sender_id", "receiver_id").
+		Where("expires_at <= ?", now).
+		Limit(expirySweepBatch).
+		Find(&private).Error; err != nil {
+		return err
+	}
+
+	if len(private) > 0 {
+		ids := make([]uint, len(private))
+		byPair := make(map[[2]uint][]uint)
+		for i, m := range private {
+			ids[i] = m.ID
+			pair := [2]uint{m.SenderID, m.ReceiverID}
+			if pair[0] > pair[1] {
+				pair[0], pair[1] = pair[1], pair[0]
+			}
+			byPair[pair] = append(byPair[pair], m.ID)
+		}
+
+		if err := db.Delete(&models.PrivateMessage{}, ids).Error; err != nil {
+			return err
+		}
+
+		for pair, messageIDs := range byPair {
+			publishToPair(pair[0], pair[1], "message_expired", map[string]interface{}{
+				"chat_type":   "private",
+				"message_ids": messageIDs,
+			})
+		}
+	}
+
+	var group []models.GroupMessage
+	if err := db.Select("id", "group_id").
+		Where("expires_at <= ?", now).
+		Limit(expirySweepBatch).
+		Find(&group).Error; err != nil {
+		return err
+	}
+
+	if len(group) > 0 {
+		ids := make([]uint, len(group))
+		byGroup := make(map[uint][]uint)
+		for i, m := range group {
+			ids[i] = m.ID
+			byGroup[m.GroupID] = append(byGroup[m.GroupID], m.ID)
+		}
+
+		if err := db.Delete(&models.GroupMessage{}, ids).Error; err != nil {
+			return err
+		}
+
+		for groupID, messageIDs := range byGroup {
+			Group.broadcastToMembers(ctx, groupID, "message_expired", map[string]interface{}{
+				"chat_type":       "group",
+				"conversation_id": models.ConversationID(models.ChatTypeGroup, groupID),
+				"group_id":        groupID,
+				"message_ids":     messageIDs,
+			})
+		}
+	}
+
+	return nil
+}
+
+// resolveMentions finds the @username tokens in content that name members
+// of the group, matching usernames case-insensitively. Unknown names are
+// plain text.
+func resolveMentions(db *gorm.DB, groupID uint, content string) ([]models.MessageMention, error) {
+	matches := mentionPattern.FindAllStringSubmatchIndex(content, maxMentions)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	type token struct {
+		name   string
+		offset int
+	}
+	tokens := make([]token, 0, len(matches))
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		// A trailing dot or dash ends the sentence, not the username
+		name := strings.TrimRight(content[m[2]:m[3]], ".-")
+		if name == "" {
+			continue
+		}
+		lower := strings.ToLower(name)
+		tokens = append(tokens, token{name: lower, offset: utf8.RuneCountInString(content[:m[2]-1])})
+		names = append(names, lower)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var members []struct {
+		UserID   uint
+		Username string
+	}
+	if err := db.Model(&models.GroupMember{}).
+		Select("group_members.user_id, users.username").
+		Joins("JOIN users ON users.id = group_members.user_id").
+		Where("group_members.group_id = ? AND LOWER(users.username) IN ?", groupID, names).
+		Scan(&members).Error; err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]int, len(members))
+	for i, member := range members {
+		byName[strings.ToLower(member.Username)] = i
+	}
+
+	var mentions []models.MessageMention
+	mentionOf := make(map[uint]int)
+	for _, t := range tokens {
+		i, ok := byName[t.name]
+		if !ok {
+			continue
+		}
+		member := members[i]
+
+		if j, ok := mentionOf[member.UserID]; ok {
+			mentions[j].Offsets = append(mentions[j].Offsets, t.offset)
+			continue
+		}
+		mentionOf[member.UserID] = len(mentions)
+		mentions = append(mentions, models.MessageMention{
+			GroupID:  groupID,
+			UserID:   member.UserID,
+			Username: member.Username,
+			Offsets:  []int{t.offset},
+			Length:   utf8.RuneCountInString(member.Username) + 1,
+		})
+	}
+
+	return mentions, nil
+}
+
+// notifyMentions sends a mentioned event to every member the message
+// mentions. Mentions get through a mute, push notifications included.
+func (s *ChatService) notifyMentions(ctx context.Context, message *models.GroupMessage) {
+	mentionedIDs := make([]uint, 0, len(message.Mentions))
+	for _, mention := range message.Mentions {
+		if mention.UserID != message.SenderID {
+			mentionedIDs = append(mentionedIDs, mention.UserID)
+		}
+	}
+	if len(mentionedIDs) == 0 {
+		return
+	}
+
+	preview := message.Preview()
+	conversationID := models.ConversationID(models.ChatTypeGroup, message.GroupID)
+	mentionData := map[string]interface{}{
+		"conversation_id": conversationID,
+		"group_id":        message.GroupID,
+		"message_id":      message.ID,
+		"sender_id":       message.SenderID,
+		"sender_username": preview.SenderUsername,
+		"content":         preview.Content,
+		"created_at":      message.CreatedAt,
+	}
+	for _, userID := range mentionedIDs {
+		websocket.PublishToUser(userID, "mentioned", mentionData)
+	}
+
+	// Members who did not mute the group are pushed the message itself
+	muted, err := s.MutedUserIDs(ctx, conversationID, mentionedIDs)
+	if err != nil {
+		logrus.Errorf("Failed to load mutes of group %d: %v", message.GroupID, err)
+		return
+	}
+	var pushIDs []uint
+	for _, userID := range mentionedIDs {
+		if muted[userID] {
+			pushIDs = append(pushIDs, userID)
+		}
+	}
+	Push.NotifyMessage(pushIDs, conversationID, preview)
+}
+
+// GetMentions lists the group messages that mention the user, newest first
+func (s *ChatService) GetMentions(ctx context.Context, userID uint, limit, offset int) ([]models.GroupMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	memberGroups := db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+
+	var messages []models.GroupMessage
+	if err := db.Joins("JOIN message_mentions ON message_mentions.message_id = group_messages.id").
+		Where("message_mentions.user_id = ?", userID).
+		Where("group_messages.group_id IN (?)", memberGroups).
+		Where("group_messages.deleted_for_everyone = ?", false).
+		Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+		Where("group_messages.expires_at IS NULL OR group_messages.expires_at > ?", time.Now()).
+		Preload("Sender").
+		Preload("Group").
+		Preload("Mentions").
+		Order("group_messages.created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// maxStarredPage bounds one page of starred messages
+const maxStarredPage = 100
+
+// StarMessage saves a message the user can see to their starred messages.
+// Starring a message twice is a no-op.
+func (s *ChatService) StarMessage(ctx context.Context, userID, messageID uint, chatType models.ChatType) (*models.StarredMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkMessageVisible(db, userID, messageID, chatType); err != nil {
+		return nil, err
+	}
+
+	star := models.StarredMessage{
+		UserID:      userID,
+		MessageID:   messageID,
+		MessageType: chatType,
+	}
+	if err := db.Where(star).FirstOrCreate(&star).Error; err != nil {
+		return nil, err
+	}
+
+	return &star, nil
+}
+
+// UnstarMessage removes a message from the user's starred messages
+func (s *ChatService) UnstarMessage(ctx context.Context, userID, messageID uint, chatType models.ChatType) error {
+	return database.GetDB().WithContext(ctx).
+		Where("user_id = ? AND message_id = ? AND message_type = ?", userID, messageID, chatType).
+		Delete(&models.StarredMessage{}).Error
+}
+
+// ListStarred returns the user's starred messages, most recently starred
+// first. Stars of messages the user can no longer see, e.g. in a group they
+// left, are skipped.
+func (s *ChatService) ListStarred(ctx context.Context, userID uint, limit, offset int) ([]models.StarredMessage, error) {
+	if limit <= 0 || limit > maxStarredPage {
+		limit = maxStarredPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	var stars []models.StarredMessage
+	if err := db.Where("user_id = ?", userID).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&stars).Error; err != nil {
+		return nil, err
+	}
+
+	var privateIDs, groupIDs []uint
+	for _, star := range stars {
+		if star.MessageType == models.ChatTypeGroup {
+			groupIDs = append(groupIDs, star.MessageID)
+		} else {
+			privateIDs = append(privateIDs, star.MessageID)
+		}
+	}
+
+	found := make(map[models.ChatType]map[uint]interface{}, 2)
+
+	var privateMessages []models.PrivateMessage
+	if len(privateIDs) > 0 {
+		if err := db.Where("id IN ? AND (sender_id = ? OR receiver_id = ?)", privateIDs, userID, userID).
+			Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("Receiver").
+			Preload("File").
+			Scopes(preloadAttachments).
+			Preload("ReplyTo.Sender").
+			Find(&privateMessages).Error; err != nil {
+			return nil, err
+		}
+		if err := decoratePrivateMessages(ctx, userID, privateMessages); err != nil {
+			return nil, err
+		}
+	}
+	found[models.ChatTypePrivate] = make(map[uint]interface{}, len(privateMessages))
+	for i := range privateMessages {
+		found[models.ChatTypePrivate][privateMessages[i].ID] = &privateMessages[i]
+	}
+
+	var groupMessages []models.GroupMessage
+	if len(groupIDs) > 0 {
+		memberGroups := db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+		if err := db.Where("id IN ? AND group_id IN (?)", groupIDs, memberGroups).
+			Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+			Scopes(notExpired).
+			Preload("Sender").
+			Preload("Group").
+			Preload("File").
+			Scopes(preloadAttachments).
+			Preload("Mentions").
+			Preload("ReplyTo.Sender").
+			Find(&groupMessages).Error; err != nil {
+			return nil, err
+		}
+		if err := decorateGroupMessages(ctx, userID, groupMessages); err != nil {
+			return nil, err
+		}
+	}
+	found[models.ChatTypeGroup] = make(map[uint]interface{}, len(groupMessages))
+	for i := range groupMessages {
+		found[models.ChatTypeGroup][groupMessages[i].ID] = &groupMessages[i]
+	}
+
+	visible := make([]models.StarredMessage, 0, len(stars))
+	for _, star := range stars {
+		if message, ok := found[star.MessageType][star.MessageID]; ok {
+			star.Message = message
+			visible = append(visible, star)
+		}
+	}
+
+	return visible, nil
+}
+
+// ReportMessageRequest is a user's complaint about a message
+type ReportMessageRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// ReportMessage files a report of a message for the site admins to triage.
+// The reporter must be able to see the message, and can report it only
+// once. The admins are told through a message_reported event and webhook.
+func (s *ChatService) ReportMessage(ctx context.Context, reporterID, messageID uint, chatType models.ChatType, req ReportMessageRequest) (*models.MessageReport, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkMessageVisible(db, reporterID, messageID, chatType); err != nil {
+		return nil, err
+	}
+
+	reported := func() (bool, error) {
+		var count int64
+		err := db.Model(&models.MessageReport{}).
+			Where("reporter_id = ? AND message_id = ? AND message_type = ?", reporterID, messageID, chatType).
+			Count(&count).Error
+		return count > 0, err
+	}
+
+	if ok, err := reported(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, errs.ErrAlreadyReported
+	}
+
+	report := models.MessageReport{
+		ReporterID:  reporterID,
+		MessageID:   messageID,
+		MessageType: chatType,
+		Reason:      strings.TrimSpace(req.Reason),
+		Status:      models.ReportStatusOpen,
+	}
+	if err := db.Create(&report).Error; err != nil {
+		// A concurrent report of the same message hit the unique index
+		if ok, _ := reported(); ok {
+			return nil, errs.ErrAlreadyReported
+		}
+		return nil, err
+	}
+
+	var adminIDs []uint
+	if err := db.Model(&models.User{}).Where("admin = ?", true).Pluck("id", &adminIDs).Error; err != nil {
+		logrus.Errorf("Failed to load admins for report %d: %v", report.ID, err)
+	} else if len(adminIDs) > 0 {
+		data := map[string]interface{}{
+			"report_id":    report.ID,
+			"reporter_id":  report.ReporterID,
+			"message_id":   report.MessageID,
+			"message_type": string(report.MessageType),
+			"reason":       report.Reason,
+			"created_at":   report.CreatedAt,
+		}
+		websocket.PublishToUsers(adminIDs, "message_reported", data)
+		Webhook.Emit(models.WebhookEventMessageReported, adminIDs, data)
+	}
+
+	return &report, nil
+}
+
+// checkMessageVisible verifies that the user can see a message: they take
+// part in its conversation, and it is not hidden for them, unsent or expired
+func checkMessageVisible(db *gorm.DB, userID, messageID uint, chatType models.ChatType) error {
+	var deleted bool
+
+	switch chatType {
+	case models.ChatTypePrivate:
+		var message models.PrivateMessage
+		if err := db.Where("id = ? AND (sender_id = ? OR receiver_id = ?)", messageID, userID, userID).
+			Where(notHiddenClause("private_messages", models.ChatTypePrivate), userID).
+			Scopes(notExpired).
+			First(&message).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrMessageNotFound
+			}
+			return err
+		}
+		deleted = message.DeletedForEveryone
+
+	case models.ChatTypeGroup:
+		var message models.GroupMessage
+		if err := db.Where("id = ?", messageID).
+			Where(notHiddenClause("group_messages", models.ChatTypeGroup), userID).
+			Scopes(notExpired).
+			First(&message).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrMessageNotFound
+			}
+			return err
+		}
+
+		var member models.GroupMember
+		if err := db.Where("group_id = ? AND user_id = ?", message.GroupID, userID).First(&member).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrNotGroupMember
+			}
+			return err
+		}
+		deleted = message.DeletedForEveryone
+
+	default:
+		return errs.ErrInvalidChatType
+	}
+
+	if deleted {
+		return errs.ErrMessageDeleted
+	}
+	return nil
 }
@@ -0,0 +1,1918 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/moderation"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+	"web-api/internal/pkg/websocket"
+)
+
+// startHub runs a hub backed by the chat service, as the WebSocket
+// controller does, until the test ends
+func startHub(t *testing.T) *websocket.Hub {
+	t.Helper()
+
+	hub := websocket.NewHub(Chat, nil)
+	stopped := make(chan struct{})
+	go func() {
+		hub.Run()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		hub.Shutdown(context.Background())
+		<-stopped
+	})
+	return hub
+}
+
+// sendOverSocket hands an event to the hub the way a connection's read
+// pump does
+func sendOverSocket(hub *websocket.Hub, senderID uint, name string, data map[string]interface{}) {
+	hub.Broadcast <- websocket.BroadcastMessage{
+		Message:  websocket.Message{Event: name, Data: data},
+		SenderID: senderID,
+	}
+}
+
+func TestSendPrivateMessageOverRESTAndSocketInsertsOnce(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	aliceEvents, bobEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID)
+
+	clientMsgID := uuid.NewString()
+	message, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{
+		ReceiverID:  bob.ID,
+		Content:     "hello",
+		ClientMsgID: clientMsgID,
+	})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	received := testutil.NextEvent(t, bobEvents)
+	if received.Event != "private_message" || uint(received.Data["message_id"].(float64)) != message.ID {
+		t.Fatalf("receiver got %+v, want private_message %d", received, message.ID)
+	}
+	if sent := testutil.NextEvent(t, aliceEvents); sent.Event != "message_sent" {
+		t.Fatalf("sender got %s, want message_sent", sent.Event)
+	}
+
+	// The client echoes the same message over the socket
+	sendOverSocket(hub, alice.ID, "send_private_message", map[string]interface{}{
+		"receiver_id":   float64(bob.ID),
+		"content":       "hello",
+		"client_msg_id": clientMsgID,
+	})
+
+	// The hub handles events in order, so once the next message arrives
+	// the echo has been handled too
+	sendOverSocket(hub, alice.ID, "send_private_message", map[string]interface{}{
+		"receiver_id": float64(bob.ID),
+		"content":     "next",
+	})
+	if received := testutil.NextEvent(t, bobEvents); received.Data["content"] != "next" {
+		t.Fatalf("receiver got %+v, want only the next message", received)
+	}
+
+	var count int64
+	database.DB.Model(&models.PrivateMessage{}).Where("client_msg_id = ?", clientMsgID).Count(&count)
+	if count != 1 {
+		t.Fatalf("got %d private_messages rows for the message, want 1", count)
+	}
+}
+
+func TestSendPrivateMessageOverSocketDeliversLikeREST(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	aliceEvents, bobEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID)
+
+	sendOverSocket(hub, alice.ID, "send_private_message", map[string]interface{}{
+		"receiver_id": float64(bob.ID),
+		"content":     "hello",
+	})
+
+	received := testutil.NextEvent(t, bobEvents)
+	if received.Event != "private_message" || received.Data["content"] != "hello" {
+		t.Fatalf("receiver got %+v, want private_message", received)
+	}
+	sent := testutil.NextEvent(t, aliceEvents)
+	if sent.Event != "message_sent" || sent.Data["message_id"] != received.Data["message_id"] {
+		t.Fatalf("sender got %+v, want message_sent for %v", sent, received.Data["message_id"])
+	}
+
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 1 {
+		t.Fatalf("got %d private_messages rows, want 1", n)
+	}
+}
+
+func TestSendGroupMessageOverRESTAndSocketBroadcastsToMembers(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	aliceEvents, bobEvents, carolEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID), testutil.Subscribe(t, carol.ID)
+
+	message, err := Chat.SendGroupMessage(context.Background(), alice.ID, SendGroupMessageRequest{
+		GroupID: group.ID,
+		Content: "over REST",
+	})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	for name, events := range map[string]*goredis.PubSub{"alice": aliceEvents, "bob": bobEvents, "carol": carolEvents} {
+		ev := testutil.NextEvent(t, events)
+		if ev.Event != "group_message" || uint(ev.Data["message_id"].(float64)) != message.ID {
+			t.Fatalf("%s got %+v, want group_message %d", name, ev, message.ID)
+		}
+	}
+
+	sendOverSocket(hub, bob.ID, "send_group_message", map[string]interface{}{
+		"group_id": float64(group.ID),
+		"content":  "over the socket",
+	})
+	for name, events := range map[string]*goredis.PubSub{"alice": aliceEvents, "bob": bobEvents, "carol": carolEvents} {
+		ev := testutil.NextEvent(t, events)
+		if ev.Event != "group_message" || ev.Data["content"] != "over the socket" {
+			t.Fatalf("%s got %+v, want the socket message", name, ev)
+		}
+	}
+
+	if n := testutil.CountRows(t, &models.GroupMessage{}); n != 2 {
+		t.Fatalf("got %d group_messages rows, want 2", n)
+	}
+}
+
+func TestSendBatchMixedItems(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob)
+	otherGroup := testutil.CreateGroup(t, carol)
+	bobEvents := testutil.Subscribe(t, bob.ID)
+
+	outcomes, err := Chat.SendBatch(context.Background(), alice.ID, []BatchSendItem{
+		{Group: &SendGroupMessageRequest{GroupID: group.ID, Content: "first"}},
+		{Group: &SendGroupMessageRequest{GroupID: otherGroup.ID, Content: "not a member"}},
+		{Private: &SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "private"}},
+		{},
+		{Group: &SendGroupMessageRequest{GroupID: group.ID, Content: "last"}},
+	}, func(uint) bool { return true })
+	if err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+
+	if len(outcomes) != 5 {
+		t.Fatalf("got %d outcomes, want 5", len(outcomes))
+	}
+	for i, failed := range []bool{false, true, false, true, false} {
+		if (outcomes[i].Err != nil) != failed {
+			t.Errorf("item %d: err = %v, want failed = %v", i, outcomes[i].Err, failed)
+		}
+	}
+	if !errors.Is(outcomes[1].Err, errs.ErrNotGroupMember) {
+		t.Errorf("non-member group item: err = %v, want %v", outcomes[1].Err, errs.ErrNotGroupMember)
+	}
+
+	// Each successful item is broadcast as it is sent, in order
+	for _, want := range []struct{ event, content string }{
+		{"group_message", "first"},
+		{"private_message", "private"},
+		{"group_message", "last"},
+	} {
+		ev := testutil.NextEvent(t, bobEvents)
+		if ev.Event != want.event || ev.Data["content"] != want.content {
+			t.Fatalf("bob got %s %v, want %s %q", ev.Event, ev.Data["content"], want.event, want.content)
+		}
+	}
+
+	if n := testutil.CountRows(t, &models.GroupMessage{}); n != 2 {
+		t.Fatalf("got %d group_messages rows, want 2", n)
+	}
+}
+
+func TestSendBatchFitsTheFloodLimit(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	batch := func(n int) []BatchSendItem {
+		items := make([]BatchSendItem, n)
+		for i := range items {
+			items[i] = BatchSendItem{Private: &SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"}}
+		}
+		return items
+	}
+	allowAll := func(uint) bool { return true }
+
+	if maxBatchSend > defaultFloodLimit {
+		t.Fatalf("maxBatchSend = %d exceeds the default flood limit %d", maxBatchSend, defaultFloodLimit)
+	}
+	if _, err := Chat.SendBatch(context.Background(), alice.ID, batch(maxBatchSend+1), allowAll); !errors.Is(err, errs.ErrBatchTooLarge) {
+		t.Fatalf("batch over the cap: err = %v, want %v", err, errs.ErrBatchTooLarge)
+	}
+
+	// A flood limit below the cap lowers it
+	config.Config.Chat.FloodLimit = 3
+	if _, err := Chat.SendBatch(context.Background(), alice.ID, batch(4), allowAll); !errors.Is(err, errs.ErrBatchTooLarge) {
+		t.Fatalf("batch over the flood limit: err = %v, want %v", err, errs.ErrBatchTooLarge)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 0 {
+		t.Fatalf("rejected batches stored %d messages", n)
+	}
+}
+
+func TestSendBatchCountsAgainstTheFloodLimitOnce(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	ctx := context.Background()
+	allowAll := func(uint) bool { return true }
+
+	// A full batch fits the default flood limit
+	items := make([]BatchSendItem, maxBatchSend)
+	for i := range items {
+		if i%2 == 0 {
+			items[i] = BatchSendItem{Private: &SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"}}
+		} else {
+			items[i] = BatchSendItem{Group: &SendGroupMessageRequest{GroupID: group.ID, Content: "hi all"}}
+		}
+	}
+	outcomes, err := Chat.SendBatch(ctx, alice.ID, items, allowAll)
+	if err != nil {
+		t.Fatalf("full batch: %v", err)
+	}
+	for i, outcome := range outcomes {
+		if outcome.Err != nil {
+			t.Fatalf("item %d of a full batch: %v", i, outcome.Err)
+		}
+	}
+
+	// A batch that does not fit is held off as a whole
+	config.Config.Chat.FloodLimit = maxBatchSend + 2
+	_, err = Chat.SendBatch(ctx, alice.ID, items[:3], allowAll)
+	var floodErr *errs.FloodWaitError
+	if !errors.As(err, &floodErr) {
+		t.Fatalf("batch over the limit: err = %v, want a FloodWaitError", err)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}) + testutil.CountRows(t, &models.GroupMessage{}); n != maxBatchSend {
+		t.Fatalf("%d messages stored, want the %d of the first batch", n, maxBatchSend)
+	}
+}
+
+func TestFailedSendsDoNotCountAgainstTheFloodLimit(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Chat.FloodLimit = 2
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	otherGroup := testutil.CreateGroup(t, carol)
+
+	for i := 0; i < 5; i++ {
+		if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: otherGroup.ID, Content: "hi"}); !errors.Is(err, errs.ErrNotGroupMember) {
+			t.Fatalf("send to a group alice is not in: err = %v, want %v", err, errs.ErrNotGroupMember)
+		}
+		if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID}); err == nil || errors.Is(err, errs.ErrFloodWait) {
+			t.Fatalf("empty message: err = %v, want a validation error", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"}); err != nil {
+			t.Fatalf("message %d within the limit after failed sends: %v", i+1, err)
+		}
+	}
+}
+
+// nextEventNamed skips events until one with the name arrives
+func nextEventNamed(t *testing.T, ps *goredis.PubSub, name string) testutil.Event {
+	t.Helper()
+
+	for {
+		if ev := testutil.NextEvent(t, ps); ev.Event == name {
+			return ev
+		}
+	}
+}
+
+func TestGroupReadReceiptCarriesStoredReadTime(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	message, err := Chat.SendGroupMessage(context.Background(), alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "read me"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+
+	read := map[string]interface{}{"message_id": float64(message.ID), "group_id": float64(group.ID)}
+	sendOverSocket(hub, bob.ID, "message_read", read)
+	first := nextEventNamed(t, aliceEvents, "message_read")
+
+	var delivery models.MessageDelivery
+	if err := database.GetDB().Where("message_id = ? AND user_id = ?", message.ID, bob.ID).First(&delivery).Error; err != nil {
+		t.Fatalf("load delivery: %v", err)
+	}
+	readAt, err := time.Parse(time.RFC3339Nano, first.Data["read_at"].(string))
+	if err != nil {
+		t.Fatalf("parse read_at %v: %v", first.Data["read_at"], err)
+	}
+	if delivery.ReadAt == nil || !readAt.Equal(*delivery.ReadAt) {
+		t.Fatalf("broadcast read_at %v, stored %v", readAt, delivery.ReadAt)
+	}
+
+	// Reading again reports the time of the first read
+	sendOverSocket(hub, bob.ID, "message_read", read)
+	if again := nextEventNamed(t, aliceEvents, "message_read"); again.Data["read_at"] != first.Data["read_at"] {
+		t.Fatalf("second read broadcast read_at %v, want %v", again.Data["read_at"], first.Data["read_at"])
+	}
+}
+
+func TestPrivateReadReceiptReachesTheSender(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	carol := testutil.CreateUser(t, "carol")
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	message, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "read me"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	read := map[string]interface{}{"message_id": float64(message.ID)}
+
+	// Carol never received the message, so her receipt is ignored
+	sendOverSocket(hub, carol.ID, "message_read", read)
+	sendOverSocket(hub, bob.ID, "message_read", read)
+
+	ev := nextEventNamed(t, aliceEvents, "message_read")
+	if uint(ev.Data["reader_id"].(float64)) != bob.ID || ev.Data["chat_type"] != "private" || ev.Data["read_at"] == nil {
+		t.Fatalf("sender got %+v, want bob's private read receipt", ev.Data)
+	}
+
+	var stored models.PrivateMessage
+	if err := database.GetDB().First(&stored, message.ID).Error; err != nil {
+		t.Fatalf("load message: %v", err)
+	}
+	if !stored.IsRead || stored.ReadAt == nil {
+		t.Fatal("message not marked read")
+	}
+}
+
+func TestGroupReadReceiptFromOutsiderIsIgnored(t *testing.T) {
+	testutil.Setup(t)
+	hub := startHub(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	outsider := testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob)
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	message, err := Chat.SendGroupMessage(context.Background(), alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "members only"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	testutil.NextEvent(t, aliceEvents) // her own group_message
+
+	sendOverSocket(hub, outsider.ID, "message_read", map[string]interface{}{"message_id": float64(message.ID), "group_id": float64(group.ID)})
+	testutil.NoEvent(t, aliceEvents)
+}
+
+// createFile stores the metadata of an upload by the user
+func createFile(t *testing.T, uploader *models.User, mimeType string) *models.File {
+	t.Helper()
+
+	file := &models.File{UploaderID: uploader.ID, Filename: "f", OriginalName: "f", MimeType: mimeType, URL: "/f", Path: "f"}
+	if err := database.GetDB().Create(file).Error; err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+	return file
+}
+
+func TestInvalidSendsReturnServiceErrors(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob)
+	mine, bobs := createFile(t, alice, "text/plain"), createFile(t, bob, "text/plain")
+
+	elsewhere, err := Chat.SendPrivateMessage(ctx, carol.ID, SendPrivateMessageRequest{ReceiverID: alice.ID, Content: "hi"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		send func() error
+		want error
+	}{
+		{"private reply from another conversation", func() error {
+			_, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "re", ReplyToID: &elsewhere.ID})
+			return err
+		}, errs.ErrReplyOutside},
+		{"group reply from another conversation", func() error {
+			_, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "re", ReplyToID: &elsewhere.ID})
+			return err
+		}, errs.ErrReplyOutside},
+		{"poll without the poll endpoint", func() error {
+			_, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "vote", Type: models.MessageTypePoll})
+			return err
+		}, errs.ErrPollEndpoint},
+		{"duplicate attachment", func() error {
+			_, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "files", FileIDs: []uint{mine.ID, mine.ID}})
+			return err
+		}, errs.ErrDuplicateFile},
+		{"someone else's attachment", func() error {
+			_, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "files", FileIDs: []uint{bobs.ID}})
+			return err
+		}, errs.ErrAttachmentNotOwned},
+	}
+	for _, tt := range tests {
+		if err := tt.send(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMediaMessagesNeedAMatchingFile(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	audio, video := createFile(t, alice, "audio/ogg"), createFile(t, alice, "video/mp4")
+	image := createFile(t, alice, "image/png")
+	duration, negative := 4200, -1
+
+	tests := []struct {
+		name     string
+		msgType  models.MessageType
+		fileID   *uint
+		duration *int
+		ok       bool
+	}{
+		{"audio", models.MessageTypeAudio, &audio.ID, &duration, true},
+		{"video", models.MessageTypeVideo, &video.ID, &duration, true},
+		{"audio without duration", models.MessageTypeAudio, &audio.ID, nil, true},
+		{"audio with a video file", models.MessageTypeAudio, &video.ID, &duration, false},
+		{"video with an image file", models.MessageTypeVideo, &image.ID, &duration, false},
+		{"audio without a file", models.MessageTypeAudio, nil, &duration, false},
+		{"negative duration", models.MessageTypeVideo, &video.ID, &negative, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{
+				ReceiverID: bob.ID, Content: "media", Type: tt.msgType, FileID: tt.fileID, DurationMs: tt.duration,
+			})
+			if tt.ok && err != nil {
+				t.Fatalf("SendPrivateMessage: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("SendPrivateMessage accepted the message")
+			}
+		})
+	}
+}
+
+func TestMediaMessageBroadcastsItsDuration(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	audio := createFile(t, alice, "audio/mpeg")
+	bobEvents := testutil.Subscribe(t, bob.ID)
+	duration := 1500
+
+	message, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{
+		ReceiverID: bob.ID, Content: "voice note", Type: models.MessageTypeAudio, FileID: &audio.ID, DurationMs: &duration,
+	})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if message.DurationMs == nil || *message.DurationMs != duration {
+		t.Fatalf("stored duration %v, want %d", message.DurationMs, duration)
+	}
+
+	ev := nextEventNamed(t, bobEvents, "private_message")
+	if ev.Data["duration_ms"] != float64(duration) || ev.Data["type"] != string(models.MessageTypeAudio) {
+		t.Fatalf("receiver got %+v, want an audio message lasting %dms", ev.Data, duration)
+	}
+}
+
+func TestTimedMuteLapses(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	bobEvents := testutil.Subscribe(t, bob.ID)
+	send := func() testutil.Event {
+		t.Helper()
+		if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "ping"}); err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+		return nextEventNamed(t, bobEvents, "private_message")
+	}
+
+	mute, err := Chat.MuteConversation(ctx, bob.ID, models.ConversationID(models.ChatTypePrivate, alice.ID), time.Hour)
+	if err != nil {
+		t.Fatalf("MuteConversation: %v", err)
+	}
+	if mute.MutedUntil == nil {
+		t.Fatal("timed mute has no end")
+	}
+	// The message is still delivered, flagged as muted
+	if ev := send(); ev.Data["muted"] != true {
+		t.Fatalf("muted receiver got %+v, want muted:true", ev.Data)
+	}
+
+	if err := database.GetDB().Model(mute).Update("muted_until", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatalf("lapse mute: %v", err)
+	}
+	if ev := send(); ev.Data["muted"] != nil {
+		t.Fatalf("receiver got %+v after the mute lapsed, want no muted hint", ev.Data)
+	}
+}
+
+func TestIndefiniteMuteLastsUntilUnmuted(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	bobEvents, carolEvents := testutil.Subscribe(t, bob.ID), testutil.Subscribe(t, carol.ID)
+	conversationID := models.ConversationID(models.ChatTypeGroup, group.ID)
+	send := func() (bobs, carols testutil.Event) {
+		t.Helper()
+		if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "ping"}); err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+		return nextEventNamed(t, bobEvents, "group_message"), nextEventNamed(t, carolEvents, "group_message")
+	}
+
+	mute, err := Chat.MuteConversation(ctx, bob.ID, conversationID, 0)
+	if err != nil {
+		t.Fatalf("MuteConversation: %v", err)
+	}
+	if mute.MutedUntil != nil {
+		t.Fatalf("indefinite mute ends at %v", mute.MutedUntil)
+	}
+	// Only the member who muted the group gets the hint
+	if bobs, carols := send(); bobs.Data["muted"] != true || carols.Data["muted"] != nil {
+		t.Fatalf("bob got %+v and carol %+v, want only bob's muted", bobs.Data, carols.Data)
+	}
+
+	if err := Chat.UnmuteConversation(ctx, bob.ID, conversationID); err != nil {
+		t.Fatalf("UnmuteConversation: %v", err)
+	}
+	if bobs, _ := send(); bobs.Data["muted"] != nil {
+		t.Fatalf("bob got %+v after unmuting, want no muted hint", bobs.Data)
+	}
+
+	if _, err := Chat.MuteConversation(ctx, bob.ID, conversationID, -time.Second); err == nil {
+		t.Fatal("MuteConversation accepted a negative duration")
+	}
+}
+
+func TestExpiredMessagesAreSweptAndAnnounced(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	bobEvents := testutil.Subscribe(t, bob.ID)
+
+	// A message TTL, and a group timer that applies to every message
+	fleeting, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "gone soon", TTL: 1})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "here to stay"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if _, err := Chat.SetDisappearing(ctx, alice.ID, models.ConversationID(models.ChatTypeGroup, group.ID), time.Second); err != nil {
+		t.Fatalf("SetDisappearing: %v", err)
+	}
+	groupMessage, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "gone soon"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	if fleeting.ExpiresAt == nil || groupMessage.ExpiresAt == nil {
+		t.Fatalf("expiries %v and %v, want both set", fleeting.ExpiresAt, groupMessage.ExpiresAt)
+	}
+
+	if messages, err := Chat.GetPrivateMessages(ctx, bob.ID, alice.ID, 50, 0); err != nil || len(messages) != 2 {
+		t.Fatalf("GetPrivateMessages = %d message(s), %v; want 2 before expiry", len(messages), err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Expired messages are hidden even before the sweeper gets to them
+	messages, err := Chat.GetPrivateMessages(ctx, bob.ID, alice.ID, 50, 0)
+	if err != nil || len(messages) != 1 || messages[0].ID == fleeting.ID {
+		t.Fatalf("GetPrivateMessages = %+v, %v; want only the lasting message", messages, err)
+	}
+	if messages, err := Chat.GetGroupMessages(ctx, bob.ID, group.ID, 50, 0); err != nil || len(messages) != 0 {
+		t.Fatalf("GetGroupMessages = %d message(s), %v; want none after expiry", len(messages), err)
+	}
+
+	if err := Chat.sweepExpiredMessages(ctx); err != nil {
+		t.Fatalf("sweepExpiredMessages: %v", err)
+	}
+
+	private := nextEventNamed(t, bobEvents, "message_expired")
+	if ids := private.Data["message_ids"].([]interface{}); private.Data["chat_type"] != "private" || len(ids) != 1 || uint(ids[0].(float64)) != fleeting.ID {
+		t.Fatalf("bob got %+v, want message_expired for message %d", private.Data, fleeting.ID)
+	}
+	grouped := nextEventNamed(t, bobEvents, "message_expired")
+	if ids := grouped.Data["message_ids"].([]interface{}); grouped.Data["chat_type"] != "group" || len(ids) != 1 || uint(ids[0].(float64)) != groupMessage.ID {
+		t.Fatalf("bob got %+v, want message_expired for group message %d", grouped.Data, groupMessage.ID)
+	}
+
+	// Swept messages are soft-deleted
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 1 {
+		t.Fatalf("got %d private message(s) after the sweep, want 1", n)
+	}
+	var all int64
+	database.GetDB().Unscoped().Model(&models.PrivateMessage{}).Count(&all)
+	if all != 2 {
+		t.Fatalf("got %d private_messages rows, want 2 with the deleted one", all)
+	}
+
+	// A second sweep finds nothing to announce
+	if err := Chat.sweepExpiredMessages(ctx); err != nil {
+		t.Fatalf("sweepExpiredMessages: %v", err)
+	}
+	testutil.NoEvent(t, bobEvents)
+}
+
+func TestGroupMessageMentions(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	dave := testutil.CreateUser(t, "dave")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	bobEvents, carolEvents, daveEvents := testutil.Subscribe(t, bob.ID), testutil.Subscribe(t, carol.ID), testutil.Subscribe(t, dave.ID)
+
+	// Mentions get through a mute
+	if _, err := Chat.MuteConversation(ctx, bob.ID, models.ConversationID(models.ChatTypeGroup, group.ID), 0); err != nil {
+		t.Fatalf("MuteConversation: %v", err)
+	}
+
+	// Dave is no member, @ghost is nobody, and mail addresses are no mentions
+	content := "hi @bob and @Carol, then @bob. again; @ghost @dave mail me at x@bob.com"
+	message, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: content})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+
+	want := map[uint][]int{
+		bob.ID:   {strings.Index(content, "@bob"), strings.Index(content, "@bob. ")},
+		carol.ID: {strings.Index(content, "@Carol")},
+	}
+	if len(message.Mentions) != len(want) {
+		t.Fatalf("got %d mentions, want bob and carol: %+v", len(message.Mentions), message.Mentions)
+	}
+	for _, mention := range message.Mentions {
+		offsets := want[mention.UserID]
+		if len(mention.Offsets) != len(offsets) || mention.Offsets[0] != offsets[0] || mention.Offsets[len(offsets)-1] != offsets[len(offsets)-1] {
+			t.Errorf("%s mentioned at %v, want %v", mention.Username, mention.Offsets, offsets)
+		}
+		if mention.Length != len(mention.Username)+1 {
+			t.Errorf("%s mention length %d, want %d", mention.Username, mention.Length, len(mention.Username)+1)
+		}
+	}
+	if n := testutil.CountRows(t, &models.MessageMention{}); n != 2 {
+		t.Fatalf("got %d message_mentions rows, want 2", n)
+	}
+
+	for name, events := range map[string]*goredis.PubSub{"bob": bobEvents, "carol": carolEvents} {
+		if ev := nextEventNamed(t, events, "mentioned"); uint(ev.Data["message_id"].(float64)) != message.ID {
+			t.Errorf("%s got %+v, want mentioned for message %d", name, ev.Data, message.ID)
+		}
+	}
+	testutil.NoEvent(t, daveEvents)
+
+	mentions, err := Chat.GetMentions(ctx, bob.ID, 20, 0)
+	if err != nil {
+		t.Fatalf("GetMentions: %v", err)
+	}
+	if len(mentions) != 1 || mentions[0].ID != message.ID {
+		t.Fatalf("bob's mentions %+v, want message %d", mentions, message.ID)
+	}
+	if mentions, err := Chat.GetMentions(ctx, dave.ID, 20, 0); err != nil || len(mentions) != 0 {
+		t.Fatalf("dave's mentions = %d, %v; want none", len(mentions), err)
+	}
+}
+
+func TestCancelledContextAbortsQueries(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	if _, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	// The caller goes away once the service has started querying
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	database.DB.Callback().Query().Before("gorm:query").Register("test:cancel", func(*gorm.DB) { cancel() })
+
+	messages, err := Chat.GetPrivateMessages(ctx, bob.ID, alice.ID, 10, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetPrivateMessages = %d message(s), err %v; want %v", len(messages), err, context.Canceled)
+	}
+}
+
+func TestServicesReturnSentinelErrors(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	outsider := testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob)
+	message, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"unknown receiver", func() error {
+			_, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: 9999, Content: "hi"})
+			return err
+		}, errs.ErrReceiverNotFound},
+		{"outsider posts to the group", func() error {
+			_, err := Chat.SendGroupMessage(ctx, outsider.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi"})
+			return err
+		}, errs.ErrNotGroupMember},
+		{"receiver edits the sender's message", func() error {
+			_, err := Chat.EditPrivateMessage(ctx, bob.ID, message.ID, "edited")
+			return err
+		}, errs.ErrSenderEdits},
+		{"unknown group loads", func() error {
+			_, err := Group.GetGroupByID(ctx, 9999)
+			return err
+		}, errs.ErrGroupNotFound},
+		{"member deletes the group", func() error {
+			return Group.DeleteGroup(ctx, group.ID, bob.ID)
+		}, errs.ErrOwnerDeletesGroup},
+		{"unknown group", func() error {
+			return Group.DeleteGroup(ctx, 9999, alice.ID)
+		}, errs.ErrGroupNotFound},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestPrivateMessageStatusTransitions(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	message, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	statusOf := func() models.MessageStatus {
+		t.Helper()
+		messages, err := Chat.GetPrivateMessages(ctx, alice.ID, bob.ID, 10, 0)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("GetPrivateMessages = %d message(s), %v", len(messages), err)
+		}
+		return messages[0].Status
+	}
+
+	if got := statusOf(); got != models.MessageStatusSent {
+		t.Fatalf("after sending: %s, want %s", got, models.MessageStatusSent)
+	}
+
+	// Only the receiver's client acknowledges delivery, and only once
+	if at, err := Chat.MarkMessageDelivered(ctx, message.ID, 0, alice.ID); err != nil || at != nil {
+		t.Fatalf("sender's ack = %v, %v; want it ignored", at, err)
+	}
+	if at, err := Chat.MarkMessageDelivered(ctx, message.ID, 0, bob.ID); err != nil || at == nil {
+		t.Fatalf("receiver's ack = %v, %v; want the delivery time", at, err)
+	}
+	if at, _ := Chat.MarkMessageDelivered(ctx, message.ID, 0, bob.ID); at != nil {
+		t.Fatal("second ack was reported as a new delivery")
+	}
+	if got := statusOf(); got != models.MessageStatusDelivered {
+		t.Fatalf("after the ack: %s, want %s", got, models.MessageStatusDelivered)
+	}
+
+	if err := Chat.MarkMessageAsRead(ctx, message.ID, bob.ID); err != nil {
+		t.Fatalf("MarkMessageAsRead: %v", err)
+	}
+	if got := statusOf(); got != models.MessageStatusRead {
+		t.Fatalf("after reading: %s, want %s", got, models.MessageStatusRead)
+	}
+}
+
+func TestGroupMessageStatusWaitsForEveryRecipient(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	message, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	statusOf := func() models.MessageStatus {
+		t.Helper()
+		messages, err := Chat.GetGroupMessages(ctx, alice.ID, group.ID, 10, 0)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("GetGroupMessages = %d message(s), %v", len(messages), err)
+		}
+		return messages[0].Status
+	}
+	deliver := func(user *models.User) {
+		t.Helper()
+		if at, err := Chat.MarkMessageDelivered(ctx, message.ID, group.ID, user.ID); err != nil || at == nil {
+			t.Fatalf("%s's ack = %v, %v; want the delivery time", user.Username, at, err)
+		}
+	}
+	read := func(user *models.User) {
+		t.Helper()
+		if _, _, err := Chat.MarkGroupMessageRead(ctx, message.ID, group.ID, user.ID); err != nil {
+			t.Fatalf("MarkGroupMessageRead: %v", err)
+		}
+	}
+
+	steps := []struct {
+		name string
+		do   func()
+		want models.MessageStatus
+	}{
+		{"sent", func() {}, models.MessageStatusSent},
+		{"bob's client got it", func() { deliver(bob) }, models.MessageStatusSent},
+		{"carol's client got it", func() { deliver(carol) }, models.MessageStatusDelivered},
+		{"bob read it", func() { read(bob) }, models.MessageStatusDelivered},
+		{"carol read it", func() { read(carol) }, models.MessageStatusRead},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := statusOf(); got != step.want {
+			t.Fatalf("%s: status %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	// The sender has no copy of their own to acknowledge
+	if at, err := Chat.MarkMessageDelivered(ctx, message.ID, group.ID, alice.ID); err != nil || at != nil {
+		t.Fatalf("sender's ack = %v, %v; want it ignored", at, err)
+	}
+}
+
+func TestRetriedSendsWithTheSameClientMsgIDInsertOnce(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	clientMsgID := uuid.NewString()
+
+	first, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hello", ClientMsgID: clientMsgID})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	retried, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hello", ClientMsgID: clientMsgID})
+	if err != nil {
+		t.Fatalf("retried SendPrivateMessage: %v", err)
+	}
+	if retried.ID != first.ID || retried.ClientMsgID == nil || *retried.ClientMsgID != clientMsgID {
+		t.Fatalf("retry returned message %d (client_msg_id %v), want %d", retried.ID, retried.ClientMsgID, first.ID)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 1 {
+		t.Fatalf("got %d private_messages rows, want 1", n)
+	}
+
+	// The ID is only unique per sender
+	if _, err := Chat.SendPrivateMessage(ctx, bob.ID, SendPrivateMessageRequest{ReceiverID: alice.ID, Content: "hello", ClientMsgID: clientMsgID}); err != nil {
+		t.Fatalf("SendPrivateMessage from bob: %v", err)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 2 {
+		t.Fatalf("got %d private_messages rows, want bob's message too", n)
+	}
+
+	groupFirst, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all", ClientMsgID: clientMsgID})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	groupRetried, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all", ClientMsgID: clientMsgID})
+	if err != nil {
+		t.Fatalf("retried SendGroupMessage: %v", err)
+	}
+	if groupRetried.ID != groupFirst.ID {
+		t.Fatalf("group retry returned message %d, want %d", groupRetried.ID, groupFirst.ID)
+	}
+	if n := testutil.CountRows(t, &models.GroupMessage{}); n != 1 {
+		t.Fatalf("got %d group_messages rows, want 1", n)
+	}
+
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hello", ClientMsgID: "not-a-uuid"}); err == nil {
+		t.Fatal("malformed client_msg_id was accepted")
+	}
+}
+
+// seqsOf loads the sequence numbers of a conversation's messages in order
+func seqsOf(t *testing.T, model interface{}, where string, args ...interface{}) []int64 {
+	t.Helper()
+
+	var seqs []int64
+	if err := database.DB.Model(model).Where(where, args...).Order("seq").Pluck("seq", &seqs).Error; err != nil {
+		t.Fatalf("load seqs: %v", err)
+	}
+	return seqs
+}
+
+// contiguous reports whether seqs run 1, 2, ... len(seqs)
+func contiguous(seqs []int64) bool {
+	for i, seq := range seqs {
+		if seq != int64(i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConcurrentSendsGetContiguousSeqs(t *testing.T) {
+	mr := testutil.Setup(t)
+	config.Config.Chat.FloodLimit = -1
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+
+	const sends = 30
+	var wg sync.WaitGroup
+	errc := make(chan error, 2*sends)
+	for i := 0; i < sends; i++ {
+		wg.Add(2)
+		// Both sides of the private conversation share one counter
+		sender, receiver := alice, bob
+		if i%2 == 1 {
+			sender, receiver = bob, alice
+		}
+		groupSender := []*models.User{alice, bob, carol}[i%3]
+		go func(i int) {
+			defer wg.Done()
+			_, err := Chat.SendPrivateMessage(ctx, sender.ID, SendPrivateMessageRequest{ReceiverID: receiver.ID, Content: fmt.Sprintf("private %d", i)})
+			errc <- err
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := Chat.SendGroupMessage(ctx, groupSender.ID, SendGroupMessageRequest{GroupID: group.ID, Content: fmt.Sprintf("group %d", i)})
+			errc <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	if seqs := seqsOf(t, &models.PrivateMessage{}, "1 = 1"); len(seqs) != sends || !contiguous(seqs) {
+		t.Fatalf("private seqs %v, want 1..%d", seqs, sends)
+	}
+	if seqs := seqsOf(t, &models.GroupMessage{}, "group_id = ?", group.ID); len(seqs) != sends || !contiguous(seqs) {
+		t.Fatalf("group seqs %v, want 1..%d", seqs, sends)
+	}
+
+	// Messages load newest first by seq
+	messages, err := Chat.GetGroupMessages(ctx, alice.ID, group.ID, 3, 0)
+	if err != nil {
+		t.Fatalf("GetGroupMessages: %v", err)
+	}
+	if len(messages) != 3 || messages[0].Seq != sends || messages[2].Seq != sends-2 {
+		t.Fatalf("loaded seqs %d..%d, want %d down to %d", messages[0].Seq, messages[len(messages)-1].Seq, sends, sends-2)
+	}
+
+	// A lost counter picks up after the highest number already stored
+	mr.FlushAll()
+	next, err := Chat.SendGroupMessage(ctx, carol.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "after the flush"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	if next.Seq != sends+1 {
+		t.Fatalf("seq after losing the counter %d, want %d", next.Seq, sends+1)
+	}
+}
+
+func TestSyncConversationFillsTheGap(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Chat.FloodLimit = -1
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	outsider := testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob)
+	for i := 1; i <= 5; i++ {
+		if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: fmt.Sprintf("private %d", i)}); err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+		if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: fmt.Sprintf("group %d", i)}); err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+	}
+	privateID := models.ConversationID(models.ChatTypePrivate, alice.ID)
+	groupID := models.ConversationID(models.ChatTypeGroup, group.ID)
+
+	// Bob saw up to 2 of his chat with alice: 3, 4 and 5 come back in order
+	page, err := Chat.SyncConversation(ctx, bob.ID, privateID, 2, 0)
+	if err != nil {
+		t.Fatalf("SyncConversation: %v", err)
+	}
+	private := page.Messages.([]models.PrivateMessage)
+	if len(private) != 3 || private[0].Seq != 3 || private[2].Seq != 5 || page.HasMore {
+		t.Fatalf("synced %d message(s) from seq %d, has_more %v; want 3..5 and no more", len(private), private[0].Seq, page.HasMore)
+	}
+
+	// Pages end with has_more until the client catches up
+	page, err = Chat.SyncConversation(ctx, bob.ID, groupID, 0, 2)
+	if err != nil {
+		t.Fatalf("SyncConversation: %v", err)
+	}
+	if grouped := page.Messages.([]models.GroupMessage); len(grouped) != 2 || grouped[1].Seq != 2 || !page.HasMore {
+		t.Fatalf("first page has %d message(s), has_more %v; want 1..2 and more", len(grouped), page.HasMore)
+	}
+
+	// No gap: nothing to replay
+	for _, id := range []string{privateID, groupID} {
+		page, err := Chat.SyncConversation(ctx, bob.ID, id, 5, 0)
+		if err != nil {
+			t.Fatalf("SyncConversation(%s): %v", id, err)
+		}
+		if n := reflect.ValueOf(page.Messages).Len(); n != 0 || page.HasMore {
+			t.Fatalf("%s up to date: synced %d message(s), has_more %v", id, n, page.HasMore)
+		}
+	}
+
+	if _, err := Chat.SyncConversation(ctx, outsider.ID, groupID, 0, 0); !errors.Is(err, errs.ErrNotGroupMember) {
+		t.Fatalf("outsider: err = %v, want %v", err, errs.ErrNotGroupMember)
+	}
+	// An outsider naming someone else's private chat only sees their own
+	page, err = Chat.SyncConversation(ctx, outsider.ID, privateID, 0, 0)
+	if err != nil || len(page.Messages.([]models.PrivateMessage)) != 0 {
+		t.Fatalf("outsider's private sync = %+v, %v; want nothing", page, err)
+	}
+}
+
+func TestMarkMessagesAsReadSkipsMessagesNotReceived(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	carol, dave := testutil.CreateUser(t, "carol"), testutil.CreateUser(t, "dave")
+	send := func(from, to *models.User) uint {
+		t.Helper()
+		message, err := Chat.SendPrivateMessage(ctx, from.ID, SendPrivateMessageRequest{ReceiverID: to.ID, Content: "hi"})
+		if err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+		return message.ID
+	}
+	fromAlice := []uint{send(alice, bob), send(alice, bob)}
+	fromDave := send(dave, bob)
+	sentByBob := send(bob, alice)
+	toSomeoneElse := send(carol, alice)
+	aliceEvents, carolEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, carol.ID)
+	daveEvents := testutil.Subscribe(t, dave.ID)
+
+	ids := []uint{toSomeoneElse, fromAlice[1], sentByBob, fromDave, 999999, fromAlice[0]}
+	marked, err := Chat.MarkMessagesAsRead(ctx, bob.ID, ids)
+	if err != nil {
+		t.Fatalf("MarkMessagesAsRead: %v", err)
+	}
+	if want := []uint{fromAlice[0], fromAlice[1], fromDave}; !reflect.DeepEqual(marked, want) {
+		t.Fatalf("marked %v, want only bob's messages %v", marked, want)
+	}
+
+	// Each sender hears once about their own messages
+	ev := nextEventNamed(t, aliceEvents, "messages_read")
+	if got := ev.Data["message_ids"]; !reflect.DeepEqual(got, []interface{}{float64(fromAlice[0]), float64(fromAlice[1])}) {
+		t.Fatalf("alice told about %v, want %v", got, fromAlice)
+	}
+	if uint(ev.Data["reader_id"].(float64)) != bob.ID {
+		t.Fatalf("reader %v, want bob", ev.Data["reader_id"])
+	}
+	if got := nextEventNamed(t, daveEvents, "messages_read").Data["message_ids"]; !reflect.DeepEqual(got, []interface{}{float64(fromDave)}) {
+		t.Fatalf("dave told about %v, want [%d]", got, fromDave)
+	}
+	testutil.NoEvent(t, carolEvents)
+
+	var unread int64
+	if err := database.GetDB().Model(&models.PrivateMessage{}).Where("id IN ? AND is_read = ?", []uint{sentByBob, toSomeoneElse}, false).Count(&unread).Error; err != nil {
+		t.Fatalf("count unread: %v", err)
+	}
+	if unread != 2 {
+		t.Fatalf("%d of the messages bob did not receive are unread, want 2", unread)
+	}
+
+	// Already read messages are skipped
+	if again, err := Chat.MarkMessagesAsRead(ctx, bob.ID, ids); err != nil || len(again) != 0 {
+		t.Fatalf("second MarkMessagesAsRead = %v, %v; want nothing marked", again, err)
+	}
+}
+
+func TestNewMessageUnarchivesConversation(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	withAlice := models.ConversationID(models.ChatTypePrivate, alice.ID)
+	withCarol := models.ConversationID(models.ChatTypePrivate, carol.ID)
+	groupChat := models.ConversationID(models.ChatTypeGroup, group.ID)
+
+	sendPrivate := func(from, to *models.User) {
+		t.Helper()
+		if _, err := Chat.SendPrivateMessage(ctx, from.ID, SendPrivateMessageRequest{ReceiverID: to.ID, Content: "hi"}); err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+	}
+	archive := func(user *models.User, conversationID string) {
+		t.Helper()
+		if _, err := Chat.ArchiveConversation(ctx, user.ID, conversationID); err != nil {
+			t.Fatalf("ArchiveConversation(%s): %v", conversationID, err)
+		}
+	}
+	// listed maps the private chats in bob's list to whether they are
+	// archived
+	listed := func(includeArchived bool) map[string]bool {
+		t.Helper()
+		conversations, err := Chat.GetConversations(ctx, bob.ID, includeArchived)
+		if err != nil {
+			t.Fatalf("GetConversations: %v", err)
+		}
+		got := make(map[string]bool, len(conversations))
+		for _, c := range conversations {
+			got[c["conversation_id"].(string)] = c["archived"].(bool)
+		}
+		return got
+	}
+
+	sendPrivate(alice, bob)
+	sendPrivate(carol, bob)
+	archive(bob, withAlice)
+	archive(bob, withCarol)
+
+	if got := listed(false); len(got) != 0 {
+		t.Fatalf("bob lists %v, want both chats hidden", got)
+	}
+	if got, want := listed(true), map[string]bool{withAlice: true, withCarol: true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("bob lists %v with archived ones, want %v", got, want)
+	}
+
+	// A reply in one chat brings back only that one
+	sendPrivate(alice, bob)
+	if got, want := listed(false), map[string]bool{withAlice: false}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after alice's message bob lists %v, want %v", got, want)
+	}
+
+	// So does a message the archiving user sends themselves
+	sendPrivate(bob, carol)
+	if got, want := listed(false), map[string]bool{withAlice: false, withCarol: false}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after bob's message bob lists %v, want %v", got, want)
+	}
+
+	// A group message brings the group back for every member who hid it
+	archive(bob, groupChat)
+	archive(carol, groupChat)
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all"}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	var archived int64
+	if err := database.GetDB().Model(&models.ConversationArchive{}).Where("conversation_id = ?", groupChat).Count(&archived).Error; err != nil {
+		t.Fatalf("count archives: %v", err)
+	}
+	if archived != 0 {
+		t.Fatalf("group still archived by %d member(s) after a new message", archived)
+	}
+}
+
+func TestStarringNeedsAccessToTheMessage(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob)
+	sendGroup := func() uint {
+		t.Helper()
+		message, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "keep this"})
+		if err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+		return message.ID
+	}
+	starredBy := func(user *models.User) []uint {
+		t.Helper()
+		stars, err := Chat.ListStarred(ctx, user.ID, 0, 0)
+		if err != nil {
+			t.Fatalf("ListStarred: %v", err)
+		}
+		ids := []uint{}
+		for _, star := range stars {
+			ids = append(ids, star.MessageID)
+		}
+		return ids
+	}
+	before, after := sendGroup(), sendGroup()
+	private, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "just us"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := Chat.StarMessage(ctx, bob.ID, before, models.ChatTypeGroup); err != nil {
+			t.Fatalf("StarMessage #%d: %v", i+1, err)
+		}
+	}
+	if _, err := Chat.StarMessage(ctx, carol.ID, private.ID, models.ChatTypePrivate); !errors.Is(err, errs.ErrMessageNotFound) {
+		t.Fatalf("outsider starring a private message: err = %v, want %v", err, errs.ErrMessageNotFound)
+	}
+	if got := starredBy(bob); !reflect.DeepEqual(got, []uint{before}) {
+		t.Fatalf("bob starred %v, want [%d] once", got, before)
+	}
+	if got := starredBy(alice); len(got) != 0 {
+		t.Fatalf("alice sees stars %v, want stars kept private to each user", got)
+	}
+
+	if err := Group.LeaveGroup(ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	if _, err := Chat.StarMessage(ctx, bob.ID, after, models.ChatTypeGroup); !errors.Is(err, errs.ErrNotGroupMember) {
+		t.Fatalf("starring after leaving the group: err = %v, want %v", err, errs.ErrNotGroupMember)
+	}
+	if got := starredBy(bob); len(got) != 0 {
+		t.Fatalf("bob still sees stars %v after leaving the group", got)
+	}
+}
+
+func TestFloodedSenderWaitsOutTheCooldown(t *testing.T) {
+	mr := testutil.Setup(t)
+	config.Config.Chat.FloodLimit = 3
+	config.Config.Chat.FloodWindow = 10 * time.Second
+	config.Config.Chat.FloodCooldown = 30 * time.Second
+	ctx := context.Background()
+	alice, bob, admin := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "admin")
+	if err := database.GetDB().Model(admin).Update("admin", true).Error; err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	group := testutil.CreateGroup(t, alice, bob)
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	sendPrivate := func(from, to *models.User) error {
+		_, err := Chat.SendPrivateMessage(ctx, from.ID, SendPrivateMessageRequest{ReceiverID: to.ID, Content: "hi"})
+		return err
+	}
+	sendGroup := func(from *models.User) error {
+		_, err := Chat.SendGroupMessage(ctx, from.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all"})
+		return err
+	}
+
+	// Private and group messages count against the same window
+	for i, send := range []func() error{
+		func() error { return sendPrivate(alice, bob) },
+		func() error { return sendGroup(alice) },
+		func() error { return sendPrivate(alice, bob) },
+	} {
+		if err := send(); err != nil {
+			t.Fatalf("message %d within the limit: %v", i+1, err)
+		}
+	}
+
+	var floodErr *errs.FloodWaitError
+	if err := sendGroup(alice); !errors.As(err, &floodErr) || floodErr.Wait != 30*time.Second {
+		t.Fatalf("message over the limit: err = %v, want a 30s FloodWaitError", err)
+	}
+	if ev := nextEventNamed(t, aliceEvents, "flood_wait"); ev.Data["retry_after"] != float64(30) {
+		t.Fatalf("flood_wait hint %+v, want retry_after 30", ev.Data)
+	}
+
+	// The cooldown holds even though the window would have room
+	mr.FastForward(10 * time.Second)
+	if err := sendPrivate(alice, bob); !errors.As(err, &floodErr) || floodErr.Wait > 20*time.Second {
+		t.Fatalf("message during the cooldown: err = %v, want at most 20s left", err)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}) + testutil.CountRows(t, &models.GroupMessage{}); n != 3 {
+		t.Fatalf("%d messages stored, want the 3 within the limit", n)
+	}
+
+	// Others are not held up, and admins are exempt
+	if err := sendPrivate(bob, alice); err != nil {
+		t.Fatalf("another sender: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sendPrivate(admin, bob); err != nil {
+			t.Fatalf("admin's message %d: %v", i+1, err)
+		}
+	}
+
+	mr.FastForward(21 * time.Second)
+	if err := sendPrivate(alice, bob); err != nil {
+		t.Fatalf("message after the cooldown: %v", err)
+	}
+}
+
+func TestContentFilterMasksAndRejects(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+
+	filter, err := moderation.ParseWordList(strings.NewReader("darn\n!scam\n"))
+	if err != nil {
+		t.Fatalf("ParseWordList: %v", err)
+	}
+	Chat.UseContentFilter(filter)
+	t.Cleanup(func() { Chat.UseContentFilter(nil) })
+
+	private, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "oh Darn"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	var stored models.PrivateMessage
+	database.GetDB().First(&stored, private.ID)
+	if stored.Content != "oh ****" || !stored.Filtered {
+		t.Fatalf("stored %q filtered=%v, want the word masked", stored.Content, stored.Filtered)
+	}
+
+	clean, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "all good"})
+	if err != nil || clean.Content != "all good" || clean.Filtered {
+		t.Fatalf("clean message stored as %+v, %v; want it unchanged", clean, err)
+	}
+
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "a scam"}); !errors.Is(err, errs.ErrContentRejected) {
+		t.Fatalf("rejected group message: err = %v, want %v", err, errs.ErrContentRejected)
+	}
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "SCAM"}); !errors.Is(err, errs.ErrContentRejected) {
+		t.Fatalf("rejected private message: err = %v, want %v", err, errs.ErrContentRejected)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}) + testutil.CountRows(t, &models.GroupMessage{}); n != 2 {
+		t.Fatalf("%d messages stored, want no rejected ones", n)
+	}
+
+	// Edits go through the filter too
+	edited, err := Chat.EditGroupMessage(ctx, alice.ID, clean.ID, "darn it")
+	if err != nil || edited.Content != "**** it" || !edited.Filtered {
+		t.Fatalf("edited to %+v, %v; want the word masked", edited, err)
+	}
+	if _, err := Chat.EditPrivateMessage(ctx, alice.ID, private.ID, "scam"); !errors.Is(err, errs.ErrContentRejected) {
+		t.Fatalf("rejected edit: err = %v, want %v", err, errs.ErrContentRejected)
+	}
+	database.GetDB().First(&stored, private.ID)
+	if stored.Content != "oh ****" {
+		t.Fatalf("rejected edit changed the message to %q", stored.Content)
+	}
+}
+
+func TestReportMessageOnceIfVisible(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, outsider := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "outsider")
+	admin := testutil.CreateUser(t, "admin")
+	database.GetDB().Model(admin).Update("admin", true)
+	group := testutil.CreateGroup(t, alice, bob)
+	adminEvents := testutil.Subscribe(t, admin.ID)
+
+	private, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "rude"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	public, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "rude"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	req := ReportMessageRequest{Reason: "  abusive  "}
+
+	report, err := Chat.ReportMessage(ctx, bob.ID, private.ID, models.ChatTypePrivate, req)
+	if err != nil {
+		t.Fatalf("ReportMessage: %v", err)
+	}
+	if report.Reason != "abusive" || report.Status != models.ReportStatusOpen {
+		t.Fatalf("report %+v, want an open report with the trimmed reason", report)
+	}
+	if ev := nextEventNamed(t, adminEvents, "message_reported"); ev.Data["report_id"] != float64(report.ID) {
+		t.Fatalf("admins told %+v, want report %d", ev.Data, report.ID)
+	}
+
+	// The same user reports a message once, whatever the reason
+	if _, err := Chat.ReportMessage(ctx, bob.ID, private.ID, models.ChatTypePrivate, ReportMessageRequest{Reason: "again"}); !errors.Is(err, errs.ErrAlreadyReported) {
+		t.Fatalf("second report: err = %v, want %v", err, errs.ErrAlreadyReported)
+	}
+	// A message ID is only a duplicate within its chat type
+	if _, err := Chat.ReportMessage(ctx, bob.ID, public.ID, models.ChatTypeGroup, req); err != nil {
+		t.Fatalf("report of the group message: %v", err)
+	}
+
+	// Only those who can see a message can report it
+	for _, tt := range []struct {
+		messageID uint
+		chatType  models.ChatType
+		want      error
+	}{
+		{private.ID, models.ChatTypePrivate, errs.ErrMessageNotFound},
+		{public.ID, models.ChatTypeGroup, errs.ErrNotGroupMember},
+		{public.ID + 100, models.ChatTypeGroup, errs.ErrMessageNotFound},
+	} {
+		if _, err := Chat.ReportMessage(ctx, outsider.ID, tt.messageID, tt.chatType, req); !errors.Is(err, tt.want) {
+			t.Errorf("outsider's report of %s message %d: err = %v, want %v", tt.chatType, tt.messageID, err, tt.want)
+		}
+	}
+
+	// Hidden messages are out of reach too
+	if err := Chat.DeleteGroupMessage(ctx, bob.ID, public.ID, false); err != nil {
+		t.Fatalf("DeleteGroupMessage: %v", err)
+	}
+	if _, err := Chat.ReportMessage(ctx, bob.ID, public.ID, models.ChatTypeGroup, ReportMessageRequest{Reason: "x"}); err == nil {
+		t.Fatal("reported a message hidden for the reporter")
+	}
+
+	if n := testutil.CountRows(t, &models.MessageReport{}); n != 2 {
+		t.Fatalf("%d reports stored, want 2", n)
+	}
+	reports, total, err := Admin.ListReports(ctx, models.ReportStatusOpen, 0, 0)
+	if err != nil || total != 2 || len(reports) != 2 || reports[0].Message == nil {
+		t.Fatalf("ListReports = %d of %d, %v; want both open reports with their messages", len(reports), total, err)
+	}
+}
+
+func TestDraftUpsertAndSync(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, outsider := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob)
+	privateID := models.ConversationID(models.ChatTypePrivate, bob.ID)
+	groupID := models.ConversationID(models.ChatTypeGroup, group.ID)
+
+	// Each of alice's devices listens on alice's channel
+	phone, laptop := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, alice.ID)
+	bobEvents := testutil.Subscribe(t, bob.ID)
+
+	expectSync := func(content string) {
+		t.Helper()
+		for _, device := range []*goredis.PubSub{phone, laptop} {
+			ev := nextEventNamed(t, device, "draft_updated")
+			if ev.Data["conversation_id"] != privateID || ev.Data["content"] != content {
+				t.Fatalf("device told %+v, want draft %q of %s", ev.Data, content, privateID)
+			}
+		}
+	}
+
+	if _, err := Chat.SaveDraft(ctx, alice.ID, privateID, "Hel"); err != nil {
+		t.Fatalf("SaveDraft: %v", err)
+	}
+	expectSync("Hel")
+	if _, err := Chat.SaveDraft(ctx, alice.ID, privateID, "Hello th"); err != nil {
+		t.Fatalf("SaveDraft: %v", err)
+	}
+	expectSync("Hello th")
+	if _, err := Chat.SaveDraft(ctx, alice.ID, groupID, "to the group"); err != nil {
+		t.Fatalf("SaveDraft: %v", err)
+	}
+	nextEventNamed(t, phone, "draft_updated")
+	nextEventNamed(t, laptop, "draft_updated")
+
+	// Saving again updates the draft in place
+	if n := testutil.CountRows(t, &models.Draft{}); n != 2 {
+		t.Fatalf("%d drafts stored, want one per conversation", n)
+	}
+	if draft, err := Chat.GetDraft(ctx, alice.ID, privateID); err != nil || draft.Content != "Hello th" {
+		t.Fatalf("GetDraft = %+v, %v; want the latest content", draft, err)
+	}
+	// Drafts are the user's own
+	if _, err := Chat.GetDraft(ctx, bob.ID, privateID); !errors.Is(err, errs.ErrDraftNotFound) {
+		t.Fatalf("bob's draft: err = %v, want %v", err, errs.ErrDraftNotFound)
+	}
+	testutil.NoEvent(t, bobEvents)
+	if _, err := Chat.SaveDraft(ctx, outsider.ID, groupID, "let me in"); !errors.Is(err, errs.ErrNotGroupMember) {
+		t.Fatalf("outsider's draft: err = %v, want %v", err, errs.ErrNotGroupMember)
+	}
+
+	// Sending the message clears the draft on every device
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "Hello there"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	expectSync("")
+	if _, err := Chat.GetDraft(ctx, alice.ID, privateID); !errors.Is(err, errs.ErrDraftNotFound) {
+		t.Fatalf("draft after sending: err = %v, want %v", err, errs.ErrDraftNotFound)
+	}
+
+	// So does clearing the input
+	if draft, err := Chat.SaveDraft(ctx, alice.ID, groupID, "   "); err != nil || draft != nil {
+		t.Fatalf("blank draft = %+v, %v; want it removed", draft, err)
+	}
+	if n := testutil.CountRows(t, &models.Draft{}); n != 0 {
+		t.Fatalf("%d drafts left, want none", n)
+	}
+	if err := Chat.DeleteDraft(ctx, alice.ID, groupID); !errors.Is(err, errs.ErrDraftNotFound) {
+		t.Fatalf("deleting a missing draft: err = %v, want %v", err, errs.ErrDraftNotFound)
+	}
+}
+
+func TestOnlyAdminsPostInChannels(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, editor, reader := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "editor"), testutil.CreateUser(t, "reader")
+
+	if _, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "news", Type: "forum"}); err == nil {
+		t.Fatal("created a group of an unknown type")
+	}
+	created, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "news", Type: models.GroupTypeChannel})
+	if err != nil || created.Type != models.GroupTypeChannel {
+		t.Fatalf("CreateGroup = %+v, %v; want a channel", created, err)
+	}
+	channel := &created.Group
+	testutil.AddMember(t, channel, editor, models.GroupRoleAdmin)
+	testutil.AddMember(t, channel, reader, models.GroupRoleMember)
+	chat := testutil.CreateGroup(t, owner, reader)
+
+	post := func(user *models.User, group *models.Group) (*models.GroupMessage, error) {
+		return Chat.SendGroupMessage(ctx, user.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "news from " + user.Username})
+	}
+
+	announcement, err := post(owner, channel)
+	if err != nil {
+		t.Fatalf("owner posting in the channel: %v", err)
+	}
+	if _, err := post(editor, channel); err != nil {
+		t.Fatalf("admin posting in the channel: %v", err)
+	}
+	if _, err := post(reader, channel); !errors.Is(err, errs.ErrChannelAdminsPost) {
+		t.Fatalf("member posting in the channel: err = %v, want %v", err, errs.ErrChannelAdminsPost)
+	}
+	if _, err := post(reader, chat); err != nil {
+		t.Fatalf("member posting in a chat: %v", err)
+	}
+
+	// Members still read, react and see who else is there
+	if messages, err := Chat.GetGroupMessages(ctx, reader.ID, channel.ID, 10, 0); err != nil || len(messages) != 2 {
+		t.Fatalf("member reading the channel: %d message(s), %v; want the 2 posts", len(messages), err)
+	}
+	if _, err := Chat.AddReaction(ctx, reader.ID, announcement.ID, models.ChatTypeGroup, "👍"); err != nil {
+		t.Fatalf("member reacting in the channel: %v", err)
+	}
+	if members, err := Group.GetGroupMembers(ctx, channel.ID); err != nil || len(members) != 3 {
+		t.Fatalf("member listing the channel: %d member(s), %v; want 3", len(members), err)
+	}
+
+	// Promotion is all it takes to post
+	if err := Group.UpdateMemberRole(ctx, channel.ID, owner.ID, reader.ID, models.GroupRoleAdmin); err != nil {
+		t.Fatalf("UpdateMemberRole: %v", err)
+	}
+	if _, err := post(reader, channel); err != nil {
+		t.Fatalf("promoted member posting in the channel: %v", err)
+	}
+}
+
+func TestGetTypingUsers(t *testing.T) {
+	mr := testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol, dave := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol"), testutil.CreateUser(t, "dave")
+	outsider := testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob, carol, dave)
+	conversationID := models.ConversationID(models.ChatTypeGroup, group.ID)
+
+	typing := func() []string {
+		t.Helper()
+		users, err := Chat.GetTypingUsers(ctx, alice.ID, conversationID)
+		if err != nil {
+			t.Fatalf("GetTypingUsers: %v", err)
+		}
+		names := make([]string, len(users))
+		for i, user := range users {
+			names[i] = user.Username
+		}
+		return names
+	}
+
+	if got := typing(); len(got) != 0 {
+		t.Fatalf("typing %v before anyone typed", got)
+	}
+	for _, user := range []*models.User{dave, bob, carol} {
+		if err := redis.SetUserTyping(user.ID, conversationID); err != nil {
+			t.Fatalf("SetUserTyping: %v", err)
+		}
+	}
+	if err := redis.SetUserTyping(outsider.ID, models.ConversationID(models.ChatTypeGroup, group.ID+1)); err != nil {
+		t.Fatalf("SetUserTyping: %v", err)
+	}
+	if got := typing(); !reflect.DeepEqual(got, []string{"bob", "carol", "dave"}) {
+		t.Fatalf("typing %v, want bob, carol and dave by name", got)
+	}
+
+	// Those who left the group since are not listed
+	testutil.RemoveMember(t, group, carol)
+	if got := typing(); !reflect.DeepEqual(got, []string{"bob", "dave"}) {
+		t.Fatalf("typing %v, want carol gone with the membership", got)
+	}
+
+	// Nor those whose indicator expired
+	mr.FastForward(6 * time.Second)
+	if err := redis.SetUserTyping(bob.ID, conversationID); err != nil {
+		t.Fatalf("SetUserTyping: %v", err)
+	}
+	mr.FastForward(5 * time.Second)
+	if got := typing(); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Fatalf("typing %v, want only bob, who kept typing", got)
+	}
+
+	if _, err := Chat.GetTypingUsers(ctx, outsider.ID, conversationID); !errors.Is(err, errs.ErrNotGroupMember) {
+		t.Fatalf("outsider: err = %v, want %v", err, errs.ErrNotGroupMember)
+	}
+	if _, err := Chat.GetTypingUsers(ctx, alice.ID, models.ConversationID(models.ChatTypePrivate, bob.ID)); !errors.Is(err, errs.ErrTypingGroupOnly) {
+		t.Fatalf("private chat: err = %v, want %v", err, errs.ErrTypingGroupOnly)
+	}
+}
+
+func TestGetConversationsRunsBoundedQueries(t *testing.T) {
+	testutil.Setup(t)
+	viewer := testutil.CreateUser(t, "viewer")
+
+	const total = 100
+	others := make(map[uint]string, total)
+	messages := make([]models.PrivateMessage, 0, total)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < total; i++ {
+		other := testutil.CreateUser(t, fmt.Sprintf("user%03d", i))
+		others[other.ID] = other.Username
+		// Some share last seen only with contacts, which needs a lookup
+		if i%3 == 0 {
+			database.GetDB().Model(other).Update("last_seen_visibility", models.LastSeenContacts)
+		}
+		sender, receiver := viewer.ID, other.ID
+		if i%2 == 0 {
+			sender, receiver = receiver, sender
+		}
+		messages = append(messages, models.PrivateMessage{
+			SenderID: sender, ReceiverID: receiver, Type: models.MessageTypeText,
+			Content: fmt.Sprintf("message %d", i), CreatedAt: start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	if err := database.GetDB().CreateInBatches(messages, 50).Error; err != nil {
+		t.Fatalf("create messages: %v", err)
+	}
+
+	var conversations []map[string]interface{}
+	queries := countQueries(t, func() {
+		var err error
+		if conversations, err = Chat.GetConversations(context.Background(), viewer.ID, false); err != nil {
+			t.Fatalf("GetConversations: %v", err)
+		}
+	})
+	// Archives, conversations, users and the viewer's contacts both ways
+	if queries > 5 {
+		t.Errorf("GetConversations ran %d queries for %d conversations, want at most 5", queries, len(conversations))
+	}
+
+	if len(conversations) != total {
+		t.Fatalf("got %d conversations, want %d", len(conversations), total)
+	}
+	for i, conversation := range conversations {
+		user := conversation["user"].(models.UserResponse)
+		if others[user.ID] == "" || user.Username != others[user.ID] {
+			t.Fatalf("conversation %d is with %+v, want one of the users written to", i, user)
+		}
+		// Newest first
+		if want := fmt.Sprintf("message %d", total-1-i); conversation["last_message"] != want {
+			t.Fatalf("conversation %d ends with %v, want %q", i, conversation["last_message"], want)
+		}
+	}
+}
+
+func TestConversationPreviewSkipsInvisibleMessages(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	start := time.Now().Add(-time.Hour)
+	messages := make([]models.PrivateMessage, 0, 5)
+	for i, content := range []string{"first", "visible", "hidden by bob", "expired", "deleted"} {
+		messages = append(messages, models.PrivateMessage{
+			SenderID: alice.ID, ReceiverID: bob.ID, Type: models.MessageTypeText,
+			Content: content, CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	if err := database.GetDB().Create(&messages).Error; err != nil {
+		t.Fatalf("create messages: %v", err)
+	}
+	if err := Chat.DeletePrivateMessage(ctx, bob.ID, messages[2].ID, false); err != nil {
+		t.Fatalf("DeletePrivateMessage: %v", err)
+	}
+	database.GetDB().Model(&messages[3]).Update("expires_at", time.Now().Add(-time.Second))
+	database.GetDB().Delete(&messages[4])
+	unsent, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "unsent"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if err := Chat.DeletePrivateMessage(ctx, alice.ID, unsent.ID, true); err != nil {
+		t.Fatalf("unsend: %v", err)
+	}
+
+	preview := func(user *models.User) interface{} {
+		t.Helper()
+		conversations, err := Chat.GetConversations(ctx, user.ID, false)
+		if err != nil {
+			t.Fatalf("GetConversations: %v", err)
+		}
+		if len(conversations) != 1 {
+			t.Fatalf("got %d conversations, want 1", len(conversations))
+		}
+		return conversations[0]["last_message"]
+	}
+
+	// The preview falls back to the newest message the user can still see
+	if got := preview(bob); got != "visible" {
+		t.Fatalf("bob's preview %q, want \"visible\"", got)
+	}
+	if got := preview(alice); got != "hidden by bob" {
+		t.Fatalf("alice's preview %q, want \"hidden by bob\", which only bob hid", got)
+	}
+
+	// A conversation with nothing left to show is not listed
+	database.GetDB().Where("id IN ?", []uint{messages[0].ID, messages[1].ID, messages[2].ID}).Delete(&models.PrivateMessage{})
+	if conversations, err := Chat.GetConversations(ctx, bob.ID, false); err != nil || len(conversations) != 0 {
+		t.Fatalf("GetConversations = %v, %v; want no conversations", conversations, err)
+	}
+}
+
+func TestGroupMessageUpdatesReachEveryMember(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+
+	message, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi"})
+	if err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	// Carol stays offline; start from an empty queue
+	if _, err := redis.PopPendingEvents(carol.ID); err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	aliceEvents, bobEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID)
+
+	if _, err := Chat.EditGroupMessage(ctx, alice.ID, message.ID, "hello"); err != nil {
+		t.Fatalf("EditGroupMessage: %v", err)
+	}
+	nextEventNamed(t, aliceEvents, "message_edited")
+	if got := nextEventNamed(t, bobEvents, "message_edited").Data["content"]; got != "hello" {
+		t.Fatalf("bob saw the edit as %v, want hello", got)
+	}
+
+	if err := Chat.MarkConversationAsRead(ctx, bob.ID, models.ConversationID(models.ChatTypeGroup, group.ID)); err != nil {
+		t.Fatalf("MarkConversationAsRead: %v", err)
+	}
+	if uint(nextEventNamed(t, aliceEvents, "messages_read").Data["reader_id"].(float64)) != bob.ID {
+		t.Fatal("alice was not told that bob read the group")
+	}
+	testutil.NoEvent(t, bobEvents) // The reader is not told about themselves
+
+	if err := Chat.DeleteGroupMessage(ctx, alice.ID, message.ID, true); err != nil {
+		t.Fatalf("DeleteGroupMessage: %v", err)
+	}
+	nextEventNamed(t, aliceEvents, "message_deleted")
+	nextEventNamed(t, bobEvents, "message_deleted")
+
+	// Offline members find every update waiting when they reconnect
+	pending, err := redis.PopPendingEvents(carol.ID)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	var events []string
+	for _, payload := range pending {
+		for _, event := range []string{"message_edited", "messages_read", "message_deleted"} {
+			if strings.Contains(payload, `"`+event+`"`) {
+				events = append(events, event)
+			}
+		}
+	}
+	if want := []string{"message_edited", "messages_read", "message_deleted"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("carol's queue holds %v, want %v", events, want)
+	}
+}
+
+func TestUnsentMessageKeepsNoAttachmentsOrPoll(t *testing.T) {
+	testutil.Setup(t)
+	useMemoryStorage(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+
+	var fileIDs []uint
+	for _, name := range []string{"one.png", "two.png"} {
+		file, err := FileServ.UploadFile(alice.ID, formFile(t, name, "image/png", pngImage(t, 4, 4)))
+		if err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+		fileIDs = append(fileIDs, file.ID)
+	}
+	album, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{
+		ReceiverID: bob.ID, Content: "album", Type: models.MessageTypeFile, FileIDs: fileIDs,
+	})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	poll := sendGroupPoll(t, alice, group, false)
+	vote(t, bob, poll.Poll, 0)
+
+	if err := Chat.DeletePrivateMessage(ctx, alice.ID, album.ID, true); err != nil {
+		t.Fatalf("DeletePrivateMessage: %v", err)
+	}
+	if err := Chat.DeleteGroupMessage(ctx, alice.ID, poll.ID, true); err != nil {
+		t.Fatalf("DeleteGroupMessage: %v", err)
+	}
+
+	history, err := Chat.GetPrivateMessages(ctx, bob.ID, alice.ID, 50, 0)
+	if err != nil || len(history) != 1 {
+		t.Fatalf("GetPrivateMessages = %d messages, %v; want the unsent one", len(history), err)
+	}
+	if unsent := history[0]; unsent.FileID != nil || len(unsent.Attachments) != 0 || unsent.Content != "" {
+		t.Fatalf("unsent message still has file %v, %d attachments and content %q", unsent.FileID, len(unsent.Attachments), unsent.Content)
+	}
+	for _, fileID := range fileIDs {
+		if _, err := FileServ.GetAccessibleFile(fileID, bob.ID); !errors.Is(err, errs.ErrFileNotFound) {
+			t.Fatalf("bob downloads file %d of the unsent album: err = %v, want %v", fileID, err, errs.ErrFileNotFound)
+		}
+	}
+
+	for _, table := range []interface{}{&models.MessageAttachment{}, &models.Poll{}, &models.PollOption{}, &models.PollVote{}} {
+		if n := testutil.CountRows(t, table); n != 0 {
+			t.Errorf("%d %T rows survive the unsend", n, table)
+		}
+	}
+
+	unsent := models.PrivateMessage{ID: album.ID, Content: "album", DeletedForEveryone: true}
+	if preview := unsent.Preview(); preview.Content != "" {
+		t.Fatalf("unsent message previews as %q", preview.Content)
+	}
+}
+
+func TestUnreadCountsSkipMessagesHistoryLeavesOut(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	if err := database.GetDB().Model(&models.GroupMember{}).Where("group_id = ?", group.ID).
+		Update("joined_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("backdate membership: %v", err)
+	}
+
+	// Of four unread messages per conversation, alice unsends one, bob hides
+	// one and one has expired
+	var private, grouped []uint
+	for i := 0; i < 4; i++ {
+		p, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"})
+		if err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+		g, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi"})
+		if err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+		private, grouped = append(private, p.ID), append(grouped, g.ID)
+	}
+	if err := Chat.DeletePrivateMessage(ctx, alice.ID, private[0], true); err != nil {
+		t.Fatalf("DeletePrivateMessage: %v", err)
+	}
+	if err := Chat.DeleteGroupMessage(ctx, alice.ID, grouped[0], true); err != nil {
+		t.Fatalf("DeleteGroupMessage: %v", err)
+	}
+	if err := Chat.DeletePrivateMessage(ctx, bob.ID, private[1], false); err != nil {
+		t.Fatalf("DeletePrivateMessage: %v", err)
+	}
+	if err := Chat.DeleteGroupMessage(ctx, bob.ID, grouped[1], false); err != nil {
+		t.Fatalf("DeleteGroupMessage: %v", err)
+	}
+	expired := time.Now().Add(-time.Minute)
+	database.GetDB().Model(&models.PrivateMessage{}).Where("id = ?", private[2]).Update("expires_at", expired)
+	database.GetDB().Model(&models.GroupMessage{}).Where("id = ?", grouped[2]).Update("expires_at", expired)
+
+	counts, err := Chat.GetUnreadCounts(ctx, bob.ID)
+	if err != nil {
+		t.Fatalf("GetUnreadCounts: %v", err)
+	}
+	want := map[string]int64{
+		models.ConversationID(models.ChatTypePrivate, alice.ID): 1,
+		models.ConversationID(models.ChatTypeGroup, group.ID):   1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("unread counts %v, want %v", counts, want)
+	}
+
+	// The overall badge adds up the same counts
+	total, err := Chat.GetUnreadMessageCount(ctx, bob.ID)
+	if err != nil {
+		t.Fatalf("GetUnreadMessageCount: %v", err)
+	}
+	if total != 2 {
+		t.Fatalf("unread total %d, want 2", total)
+	}
+}
@@ -1,6 +1,45 @@
 package services
 
+import (
+	"context"
+	"sort"
+)
+
+// HealthCheck probes one dependency, returning why it is unusable
+type HealthCheck func(ctx context.Context) error
+
 type CommonService struct {
+	checks map[string]HealthCheck
 }
 
 var Common = &CommonService{}
+
+// UseHealthCheck adds a dependency probed by Health
+func (s *CommonService) UseHealthCheck(name string, check HealthCheck) {
+	if s.checks == nil {
+		s.checks = make(map[string]HealthCheck)
+	}
+	s.checks[name] = check
+}
+
+// Health probes every dependency. It returns "ok" or the error of each, by
+// name, and the names of those that failed.
+func (s *CommonService) Health(ctx context.Context) (map[string]string, []string) {
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make(map[string]string, len(names))
+	var failing []string
+	for _, name := range names {
+		if err := s.checks[name](ctx); err != nil {
+			results[name] = err.Error()
+			failing = append(failing, name)
+			continue
+		}
+		results[name] = "ok"
+	}
+	return results, failing
+}
@@ -0,0 +1,414 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+
+	"gorm.io/gorm"
+)
+
+// Export formats of a conversation's history
+const (
+	ExportFormatJSON = "json"
+	ExportFormatCSV  = "csv"
+)
+
+// exportFlushEvery is how many messages are written between flushes of the
+// response, so that a long export reaches the client as it is produced
+const exportFlushEvery = 200
+
+type ExportService struct{}
+
+var Export = &ExportService{}
+
+// exportRow is one row of an export query: a message joined with one of
+// its attachments, so a message with several attachments spans several
+// consecutive rows
+type exportRow struct {
+	ID             uint
+	ChatID         uint // Other participant of a private message, group of a group message
+	Seq            int64
+	SenderID       uint
+	SenderUsername string
+	Type           models.MessageType
+	Content        string
+	CreatedAt      time.Time
+	FileURL        *string
+	AttachmentID   *uint // Nil when the message has no attachment rows
+	AttachmentURL  *string
+}
+
+// messageCursor reads exported messages off an export query one at a time
+type messageCursor struct {
+	db       *gorm.DB
+	chatType models.ChatType
+	rows     *sql.Rows
+	pending  *exportRow // First row of the next message, already read
+}
+
+// ConversationExport is an open cursor over the history of a conversation.
+// It must be closed once written.
+type ConversationExport struct {
+	ConversationID string
+	messages       *messageCursor
+}
+
+// ValidExportFormat reports whether format is a supported export format
+func ValidExportFormat(format string) bool {
+	return format == ExportFormatJSON || format == ExportFormatCSV
+}
+
+// ExportConversation opens the full history of a conversation the user takes
+// part in, oldest first, leaving out the messages they hid and those that
+// expired. The messages are read from the database while they are written,
+// so the history is never held in memory as a whole.
+func (s *ExportService) ExportConversation(ctx context.Context, userID uint, conversationID string) (*ConversationExport, error) {
+	chatType, chatID, err := models.ParseConversationID(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	if err := checkConversationAccess(db, userID, chatType, chatID); err != nil {
+		return nil, err
+	}
+
+	query := exportMessagesQuery(db, chatType, userID).
+		Where(notHiddenClause("m", chatType), userID)
+	if chatType == models.ChatTypePrivate {
+		query = query.Where(
+			"(m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?)",
+			userID, chatID, chatID, userID,
+		)
+	} else {
+		query = query.Where("m.group_id = ?", chatID)
+	}
+
+	messages, err := openMessageCursor(db, chatType, query, "m.seq ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConversationExport{ConversationID: conversationID, messages: messages}, nil
+}
+
+// exportMessagesQuery selects the unexpired messages of a chat type with
+// their sender and attachment URLs, as scanned into exportRow. The file
+// in file_id is the first attachment, so it only stands in for messages
+// without attachment rows. Private messages are placed in the
+// conversation with the participant other than viewerID. Callers narrow it
+// down to the messages they export.
+func exportMessagesQuery(db *gorm.DB, chatType models.ChatType, viewerID uint) *gorm.DB {
+	table, chatColumn, chatArgs := "private_messages", "CASE WHEN m.sender_id = ? THEN m.receiver_id ELSE m.sender_id END", []interface{}{viewerID}
+	if chatType == models.ChatTypeGroup {
+		table, chatColumn, chatArgs = "group_messages", "m.group_id", nil
+	}
+
+	return db.Table(table+" AS m").
+		Select("m.id, "+chatColumn+" AS chat_id, m.seq, m.sender_id, u.username AS sender_username, m.type, m.content, m.created_at, "+
+			"f.url AS file_url, a.id AS attachment_id, af.url AS attachment_url", chatArgs...).
+		Joins("JOIN users u ON u.id = m.sender_id").
+		Joins("LEFT JOIN files f ON f.id = m.file_id AND f.deleted_at IS NULL").
+		Joins("LEFT JOIN message_attachments a ON a.message_id = m.id AND a.message_type = ?", chatType).
+		Joins("LEFT JOIN files af ON af.id = a.file_id AND af.deleted_at IS NULL").
+		Where("m.deleted_at IS NULL").
+		Where("m.expires_at IS NULL OR m.expires_at > ?", time.Now())
+}
+
+// openMessageCursor runs an export query in the given order, breaking ties
+// so that the rows of one message are adjacent
+func openMessageCursor(db *gorm.DB, chatType models.ChatType, query *gorm.DB, order string) (*messageCursor, error) {
+	rows, err := query.Order(order + `, m.id ASC, a."order" ASC`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	return &messageCursor{db: db, chatType: chatType, rows: rows}, nil
+}
+
+// Close releases the database cursor
+func (e *ConversationExport) Close() error {
+	return e.messages.Close()
+}
+
+// Write encodes the whole history to w in format
+func (e *ConversationExport) Write(w io.Writer, format string) error {
+	switch format {
+	case ExportFormatJSON:
+		return e.writeJSON(w)
+	case ExportFormatCSV:
+		return e.writeCSV(w)
+	}
+	return fmt.Errorf("unsupported export format: %s", format)
+}
+
+// Close releases the database cursor
+func (c *messageCursor) Close() error {
+	return c.rows.Close()
+}
+
+// next reads the next message with its attachment URLs, returning nil once
+// the cursor is exhausted
+func (c *messageCursor) next() (*models.ExportedMessage, error) {
+	row := c.pending
+	c.pending = nil
+	if row == nil {
+		var err error
+		if row, err = c.scan(); err != nil || row == nil {
+			return nil, err
+		}
+	}
+
+	message := &models.ExportedMessage{
+		ID:             row.ID,
+		ConversationID: models.ConversationID(c.chatType, row.ChatID),
+		Seq:            row.Seq,
+		SenderID:       row.SenderID,
+		SenderUsername: row.SenderUsername,
+		Type:           row.Type,
+		Content:        row.Content,
+		CreatedAt:      row.CreatedAt,
+		Attachments:    []string{},
+	}
+	if row.AttachmentID == nil && row.FileURL != nil {
+		message.Attachments = append(message.Attachments, *row.FileURL)
+	}
+	if row.AttachmentURL != nil {
+		message.Attachments = append(message.Attachments, *row.AttachmentURL)
+	}
+
+	for {
+		row, err := c.scan()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		if row.ID != message.ID {
+			c.pending = row
+			break
+		}
+		if row.AttachmentURL != nil {
+			message.Attachments = append(message.Attachments, *row.AttachmentURL)
+		}
+	}
+
+	return message, nil
+}
+
+// scan reads one row of the cursor, returning nil at its end
+func (c *messageCursor) scan() (*exportRow, error) {
+	if !c.rows.Next() {
+		return nil, c.rows.Err()
+	}
+	var row exportRow
+	if err := c.db.ScanRows(c.rows, &row); err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// writeJSON writes the history as a JSON array
+func (e *ConversationExport) writeJSON(w io.Writer) error {
+	if err := writeMessagesJSON(w, e.messages); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeMessagesJSON writes the messages of a cursor as a JSON array, one
+// message at a time
+func writeMessagesJSON(w io.Writer, messages *messageCursor) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	for count := 0; ; count++ {
+		message, err := messages.next()
+		if err != nil {
+			return err
+		}
+		if message == nil {
+			break
+		}
+
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		raw, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		if count%exportFlushEvery == exportFlushEvery-1 {
+			flush(w)
+		}
+	}
+
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// writeCSV writes the history as CSV with a header row. Attachment URLs
+// are separated by spaces.
+func (e *ConversationExport) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"id", "seq", "sender_id", "sender", "type", "content", "created_at", "attachments"}); err != nil {
+		return err
+	}
+
+	for count := 0; ; count++ {
+		message, err := e.messages.next()
+		if err != nil {
+			return err
+		}
+		if message == nil {
+			break
+		}
+
+		if err := writer.Write([]string{
+			strconv.FormatUint(uint64(message.ID), 10),
+			strconv.FormatInt(message.Seq, 10),
+			strconv.FormatUint(uint64(message.SenderID), 10),
+			message.SenderUsername,
+			string(message.Type),
+			message.Content,
+			message.CreatedAt.UTC().Format(time.RFC3339),
+			strings.Join(message.Attachments, " "),
+		}); err != nil {
+			return err
+		}
+		if count%exportFlushEvery == exportFlushEvery-1 {
+			writer.Flush()
+			flush(w)
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// PersonalDataExport is everything stored about a user: their profile, the
+// groups they own or belong to, their uploads, their calls and every message
+// they sent. The messages are only read from the database while Write runs.
+type PersonalDataExport struct {
+	ExportedAt time.Time              `json:"exported_at"`
+	Profile    models.UserResponse    `json:"profile"`
+	Groups     []models.ExportedGroup `json:"groups"`
+	Files      []models.ExportedFile  `json:"files"`
+	Calls      []models.ExportedCall  `json:"calls"`
+
+	db     *gorm.DB
+	userID uint
+}
+
+// ExportPersonalData gathers the data of the user for download. Only rows
+// tied to the user are included; of other users, only IDs and the usernames
+// of message senders appear.
+func (s *ExportService) ExportPersonalData(ctx context.Context, userID uint) (*PersonalDataExport, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	export := &PersonalDataExport{
+		ExportedAt: time.Now(),
+		Profile:    user.ToResponse(),
+		Groups:     []models.ExportedGroup{},
+		Files:      []models.ExportedFile{},
+		Calls:      []models.ExportedCall{},
+		db:         db,
+		userID:     userID,
+	}
+
+	if err := db.Table("groups AS g").
+		Select("g.id, g.name, g.description, g.privacy, g.owner_id = ? AS owner, "+
+			"COALESCE(gm.role, '') AS role, gm.joined_at, g.created_at", userID).
+		Joins("LEFT JOIN group_members gm ON gm.group_id = g.id AND gm.user_id = ? AND gm.deleted_at IS NULL", userID).
+		Where("g.deleted_at IS NULL").
+		Where("g.owner_id = ? OR gm.id IS NOT NULL", userID).
+		Order("g.id ASC").
+		Scan(&export.Groups).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(&models.File{}).
+		Where("uploader_id = ?", userID).
+		Order("id ASC").
+		Find(&export.Files).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(&models.VideoCall{}).
+		Where("initiator_id = ? OR receiver_id = ? OR id IN (?)", userID, userID,
+			db.Model(&models.CallParticipant{}).Select("call_id").Where("user_id = ?", userID)).
+		Order("id ASC").
+		Find(&export.Calls).Error; err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// Write encodes the export to w as one JSON object, streaming the private
+// and group messages the user sent after the rest
+func (e *PersonalDataExport) Write(w io.Writer) error {
+	head, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Reopen the object to append the message arrays
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+
+	for _, chatType := range []models.ChatType{models.ChatTypePrivate, models.ChatTypeGroup} {
+		if _, err := fmt.Fprintf(w, `,"%s_messages":`, chatType); err != nil {
+			return err
+		}
+
+		query := exportMessagesQuery(e.db, chatType, e.userID).Where("m.sender_id = ?", e.userID)
+		messages, err := openMessageCursor(e.db, chatType, query, "m.created_at ASC")
+		if err != nil {
+			return err
+		}
+		err = writeMessagesJSON(w, messages)
+		messages.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "}\n")
+	return err
+}
+
+// flush pushes buffered output to the client when w supports it
+func flush(w io.Writer) {
+	if flusher, ok := w.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+}
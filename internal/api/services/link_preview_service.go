@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/linkpreview"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultPreviewCacheTTL applies when no cache TTL is configured
+	defaultPreviewCacheTTL = 24 * time.Hour
+
+	// failedPreviewCacheTTL keeps pages without a preview from being
+	// fetched over and over
+	failedPreviewCacheTTL = 10 * time.Minute
+)
+
+// LinkPreviewService builds previews of links shared in messages
+type LinkPreviewService struct {
+	fetcher *linkpreview.Fetcher
+}
+
+var LinkPreview = &LinkPreviewService{}
+
+// UseFetcher sets the fetcher pages are downloaded with; nil disables
+// link previews
+func (s *LinkPreviewService) UseFetcher(fetcher *linkpreview.Fetcher) {
+	s.fetcher = fetcher
+}
+
+// GetPreview returns the preview of a URL, from the cache if possible
+func (s *LinkPreviewService) GetPreview(rawURL string) (*linkpreview.Preview, error) {
+	if s.fetcher == nil {
+		return nil, linkpreview.ErrNoPreview
+	}
+
+	if cached, err := redis.GetLinkPreview(rawURL); err != nil {
+		logrus.Warnf("Failed to read cached link preview: %v", err)
+	} else if cached != nil {
+		var preview *linkpreview.Preview
+		if err := json.Unmarshal(cached, &preview); err == nil {
+			if preview == nil {
+				return nil, linkpreview.ErrNoPreview
+			}
+			return preview, nil
+		}
+	}
+
+	preview, err := s.fetcher.Fetch(rawURL)
+
+	// A failure is cached as null, for a shorter time
+	ttl := previewCacheTTL()
+	if err != nil {
+		preview, ttl = nil, failedPreviewCacheTTL
+	}
+	if payload, marshalErr := json.Marshal(preview); marshalErr == nil {
+		if cacheErr := redis.CacheLinkPreview(rawURL, payload, ttl); cacheErr != nil {
+			logrus.Warnf("Failed to cache link preview: %v", cacheErr)
+		}
+	}
+
+	return preview, err
+}
+
+// UnfurlPrivateMessage previews the first link of a private message in the
+// background, then sends message_preview to both participants
+func (s *LinkPreviewService) UnfurlPrivateMessage(message *models.PrivateMessage) {
+	if !s.unfurls(message.Type, message.Content) {
+		return
+	}
+
+	go func() {
+		record := s.unfurl(message.ID, models.ChatTypePrivate, message.Content)
+		if record == nil {
+			return
+		}
+
+		data := map[string]interface{}{
+			"chat_type":    string(models.ChatTypePrivate),
+			"message_id":   message.ID,
+			"sender_id":    message.SenderID,
+			"receiver_id":  message.ReceiverID,
+			"link_preview": record,
+		}
+		websocket.PublishToUser(message.SenderID, "message_preview", data)
+		websocket.PublishToUser(message.ReceiverID, "message_preview", data)
+	}()
+}
+
+// UnfurlGroupMessage previews the first link of a group message in the
+// background, then sends message_preview to the group
+func (s *LinkPreviewService) UnfurlGroupMessage(message *models.GroupMessage) {
+	if !s.unfurls(message.Type, message.Content) {
+		return
+	}
+
+	go func() {
+		record := s.unfurl(message.ID, models.ChatTypeGroup, message.Content)
+		if record == nil {
+			return
+		}
+
+		Group.broadcastToMembers(context.Background(), message.GroupID, "message_preview", map[string]interface{}{
+			"chat_type":    string(models.ChatTypeGroup),
+			"message_id":   message.ID,
+			"group_id":     message.GroupID,
+			"link_preview": record,
+		})
+	}()
+}
+
+// unfurls reports whether a message gets a link preview
+func (s *LinkPreviewService) unfurls(msgType models.MessageType, content string) bool {
+	if s.fetcher == nil {
+		return false
+	}
+	if msgType != "" && msgType != models.MessageTypeText {
+		return false
+	}
+	return linkpreview.FirstURL(content) != ""
+}
+
+// unfurl fetches the preview of the first link in content and stores it
+// for the message
+func (s *LinkPreviewService) unfurl(messageID uint, chatType models.ChatType, content string) *models.LinkPreview {
+	rawURL := linkpreview.FirstURL(content)
+
+	preview, err := s.GetPreview(rawURL)
+	if err != nil {
+		logrus.Debugf("No link preview for message %d: %v", messageID, err)
+		return nil
+	}
+
+	record := models.LinkPreview{
+		MessageID:   messageID,
+		MessageType: chatType,
+		URL:         preview.URL,
+		Title:       preview.Title,
+		Description: preview.Description,
+		Image:       preview.Image,
+		SiteName:    preview.SiteName,
+	}
+	if err := database.GetDB().Create(&record).Error; err != nil {
+		logrus.Errorf("Failed to save link preview of message %d: %v", messageID, err)
+		return nil
+	}
+
+	return &record
+}
+
+// previewCacheTTL returns the configured cache TTL, falling back to the
+// default
+func previewCacheTTL() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.LinkPreview.CacheTTL > 0 {
+		return cfg.LinkPreview.CacheTTL
+	}
+	return defaultPreviewCacheTTL
+}
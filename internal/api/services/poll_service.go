@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/websocket"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PollService creates poll messages and records their votes
+type PollService struct{}
+
+var Poll = &PollService{}
+
+// SendPollRequest posts a poll to a private chat (receiver_id) or a group
+// (group_id)
+type SendPollRequest struct {
+	ReceiverID     *uint      `json:"receiver_id"`
+	GroupID        *uint      `json:"group_id"`
+	Question       string     `json:"question" binding:"required,max=500"`
+	Options        []string   `json:"options" binding:"required,min=2,max=10,dive,max=200"`
+	MultipleChoice bool       `json:"multiple_choice"`
+	ClosesAt       *time.Time `json:"closes_at"`
+	TTL            int        `json:"ttl"` // Seconds until the message disappears; 0 uses the conversation's timer
+}
+
+// VoteRequest toggles the user's vote for an option
+type VoteRequest struct {
+	OptionID uint `json:"option_id" binding:"required"`
+}
+
+// SendPoll posts a poll message and returns it, as a *models.PrivateMessage
+// or a *models.GroupMessage
+func (s *PollService) SendPoll(ctx context.Context, senderID uint, req SendPollRequest) (interface{}, error) {
+	if (req.ReceiverID == nil) == (req.GroupID == nil) {
+		return nil, errors.New("exactly one of receiver_id and group_id is required")
+	}
+
+	question := strings.TrimSpace(req.Question)
+	if question == "" {
+		return nil, errors.New("question cannot be empty")
+	}
+	if req.ClosesAt != nil && !req.ClosesAt.After(time.Now()) {
+		return nil, errors.New("closes_at must be in the future")
+	}
+
+	poll := &models.Poll{
+		Question:       question,
+		MultipleChoice: req.MultipleChoice,
+		ClosesAt:       req.ClosesAt,
+		CreatedBy:      senderID,
+	}
+	seen := make(map[string]bool, len(req.Options))
+	for i, text := range req.Options {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return nil, errors.New("poll options cannot be empty")
+		}
+		if seen[strings.ToLower(text)] {
+			return nil, errors.New("poll options must be different")
+		}
+		seen[strings.ToLower(text)] = true
+		poll.Options = append(poll.Options, models.PollOption{Text: text, Order: i})
+	}
+
+	if req.GroupID != nil {
+		return Chat.SendGroupMessage(ctx, senderID, SendGroupMessageRequest{
+			GroupID: *req.GroupID,
+			Content: question,
+			Type:    models.MessageTypePoll,
+			TTL:     req.TTL,
+			Poll:    poll,
+		})
+	}
+	return Chat.SendPrivateMessage(ctx, senderID, SendPrivateMessageRequest{
+		ReceiverID: *req.ReceiverID,
+		Content:    question,
+		Type:       models.MessageTypePoll,
+		TTL:        req.TTL,
+		Poll:       poll,
+	})
+}
+
+// Vote toggles the user's vote for an option: voting for an option the
+// user already picked takes the vote back. On single choice polls a new
+// vote replaces the previous one. The poll with its current results is
+// returned and sent to the conversation as poll_updated.
+func (s *PollService) Vote(ctx context.Context, userID, pollID, optionID uint) (*models.Poll, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var poll models.Poll
+	if err := db.Preload("Options", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order(clause.OrderByColumn{Column: clause.Column{Name: "order"}})
+	}).First(&poll, pollID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrPollNotFound
+		}
+		return nil, err
+	}
+
+	participantIDs, err := messageParticipants(ctx, userID, poll.MessageID, poll.MessageType)
+	if err != nil {
+		return nil, err
+	}
+
+	if poll.IsClosed(time.Now()) {
+		return nil, errs.ErrPollClosed
+	}
+	if !poll.HasOption(optionID) {
+		return nil, errors.New("option is not part of this poll")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Votes of one poll are serialised, so a single choice poll can
+		// never end up with two votes from the same user
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&models.Poll{}, poll.ID).Error; err != nil {
+			return err
+		}
+
+		result := tx.Where("poll_id = ? AND option_id = ? AND user_id = ?", poll.ID, optionID, userID).
+			Delete(&models.PollVote{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return nil
+		}
+
+		if !poll.MultipleChoice {
+			if err := tx.Where("poll_id = ? AND user_id = ?", poll.ID, userID).
+				Delete(&models.PollVote{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&models.PollVote{PollID: poll.ID, OptionID: optionID, UserID: userID}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadPollResults(ctx, []*models.Poll{&poll}, userID); err != nil {
+		return nil, err
+	}
+
+	options := make([]map[string]interface{}, len(poll.Options))
+	for i, option := range poll.Options {
+		options[i] = map[string]interface{}{
+			"id":    option.ID,
+			"votes": option.Votes,
+		}
+	}
+	pollData := map[string]interface{}{
+		"poll_id":      poll.ID,
+		"message_id":   poll.MessageID,
+		"chat_type":    string(poll.MessageType),
+		"user_id":      userID,
+		"option_ids":   poll.MyVotes, // The voter's choices after this vote
+		"options":      options,
+		"total_voters": poll.TotalVoters,
+	}
+	for _, participantID := range participantIDs {
+		websocket.PublishToUser(participantID, "poll_updated", pollData)
+	}
+
+	return &poll, nil
+}
+
+// loadPollResults fills in the vote counts of each option, the number of
+// voters, and the options viewerID voted for
+func loadPollResults(ctx context.Context, polls []*models.Poll, viewerID uint) error {
+	if len(polls) == 0 {
+		return nil
+	}
+
+	pollIDs := make([]uint, len(polls))
+	for i, poll := range polls {
+		pollIDs[i] = poll.ID
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	var optionCounts []struct {
+		OptionID uint
+		Count    int64
+	}
+	if err := db.Model(&models.PollVote{}).
+		Select("option_id, COUNT(*) AS count").
+		Where("poll_id IN ?", pollIDs).
+		Group("option_id").
+		Scan(&optionCounts).Error; err != nil {
+		return err
+	}
+
+	var voterCounts []struct {
+		PollID uint
+		Count  int64
+	}
+	if err := db.Model(&models.PollVote{}).
+		Select("poll_id, COUNT(DISTINCT user_id) AS count").
+		Where("poll_id IN ?", pollIDs).
+		Group("poll_id").
+		Scan(&voterCounts).Error; err != nil {
+		return err
+	}
+
+	var myVotes []models.PollVote
+	if err := db.Where("poll_id IN ? AND user_id = ?", pollIDs, viewerID).
+		Find(&myVotes).Error; err != nil {
+		return err
+	}
+
+	votes := make(map[uint]int64, len(optionCounts))
+	for _, row := range optionCounts {
+		votes[row.OptionID] = row.Count
+	}
+	voters := make(map[uint]int64, len(voterCounts))
+	for _, row := range voterCounts {
+		voters[row.PollID] = row.Count
+	}
+	mine := make(map[uint][]uint)
+	for _, vote := range myVotes {
+		mine[vote.PollID] = append(mine[vote.PollID], vote.OptionID)
+	}
+
+	for _, poll := range polls {
+		for i := range poll.Options {
+			poll.Options[i].Votes = votes[poll.Options[i].ID]
+		}
+		poll.TotalVoters = voters[poll.ID]
+		poll.MyVotes = mine[poll.ID]
+	}
+
+	return nil
+}
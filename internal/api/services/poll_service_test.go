@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/testutil"
+)
+
+// sendGroupPoll posts a poll with the options "a" and "b" to the group
+func sendGroupPoll(t *testing.T, sender *models.User, group *models.Group, multipleChoice bool) *models.GroupMessage {
+	t.Helper()
+
+	closesAt := time.Now().Add(time.Hour)
+	sent, err := Poll.SendPoll(context.Background(), sender.ID, SendPollRequest{
+		GroupID:        &group.ID,
+		Question:       "a or b?",
+		Options:        []string{"a", "b"},
+		MultipleChoice: multipleChoice,
+		ClosesAt:       &closesAt,
+	})
+	if err != nil {
+		t.Fatalf("SendPoll: %v", err)
+	}
+	return sent.(*models.GroupMessage)
+}
+
+// vote votes and returns the votes per option afterwards
+func vote(t *testing.T, user *models.User, poll *models.Poll, option int) []int64 {
+	t.Helper()
+
+	result, err := Poll.Vote(context.Background(), user.ID, poll.ID, poll.Options[option].ID)
+	if err != nil {
+		t.Fatalf("Vote: %v", err)
+	}
+	votes := make([]int64, len(result.Options))
+	for i, option := range result.Options {
+		votes[i] = option.Votes
+	}
+	return votes
+}
+
+func TestSingleChoiceVotesToggle(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	outsider := testutil.CreateUser(t, "outsider")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	message := sendGroupPoll(t, alice, group, false)
+	poll := message.Poll
+	aliceEvents := testutil.Subscribe(t, alice.ID)
+
+	steps := []struct {
+		name   string
+		voter  *models.User
+		option int
+		want   []int64
+	}{
+		{"bob votes a", bob, 0, []int64{1, 0}},
+		{"bob switches to b", bob, 1, []int64{0, 1}},
+		{"carol votes b", carol, 1, []int64{0, 2}},
+		{"bob takes his vote back", bob, 1, []int64{0, 1}},
+	}
+	for _, step := range steps {
+		if got := vote(t, step.voter, poll, step.option); got[0] != step.want[0] || got[1] != step.want[1] {
+			t.Fatalf("%s: votes %v, want %v", step.name, got, step.want)
+		}
+		// Everyone in the conversation sees the live tally
+		ev := nextEventNamed(t, aliceEvents, "poll_updated")
+		if uint(ev.Data["user_id"].(float64)) != step.voter.ID || ev.Data["total_voters"] == nil {
+			t.Fatalf("%s: alice got %+v", step.name, ev.Data)
+		}
+	}
+
+	if _, err := Poll.Vote(context.Background(), outsider.ID, poll.ID, poll.Options[0].ID); err == nil {
+		t.Fatal("outsider voted")
+	}
+
+	// Loading the message carries the results, and the loader's own votes
+	messages, err := Chat.GetGroupMessages(context.Background(), carol.ID, group.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("GetGroupMessages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Poll == nil {
+		t.Fatalf("got %+v, want the poll message", messages)
+	}
+	loaded := messages[0].Poll
+	if loaded.TotalVoters != 1 || loaded.Options[1].Votes != 1 || len(loaded.MyVotes) != 1 || loaded.MyVotes[0] != poll.Options[1].ID {
+		t.Fatalf("loaded poll %+v, want carol's vote for b", loaded)
+	}
+}
+
+func TestMultipleChoiceVotesAddUp(t *testing.T) {
+	testutil.Setup(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	poll := sendGroupPoll(t, alice, group, true).Poll
+
+	vote(t, bob, poll, 0)
+	if got := vote(t, bob, poll, 1); got[0] != 1 || got[1] != 1 {
+		t.Fatalf("votes %v, want one for each option", got)
+	}
+	result, err := Poll.Vote(context.Background(), bob.ID, poll.ID, poll.Options[0].ID)
+	if err != nil {
+		t.Fatalf("Vote: %v", err)
+	}
+	if result.Options[0].Votes != 0 || result.Options[1].Votes != 1 || result.TotalVoters != 1 {
+		t.Fatalf("after taking a back: %+v, want only b with one voter", result)
+	}
+}
+
+func TestClosedPollTakesNoVotes(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, alice, bob)
+	poll := sendGroupPoll(t, alice, group, false).Poll
+	vote(t, bob, poll, 0)
+
+	if err := database.GetDB().Model(poll).Update("closes_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatalf("close poll: %v", err)
+	}
+	for _, option := range poll.Options {
+		if _, err := Poll.Vote(ctx, bob.ID, poll.ID, option.ID); !errors.Is(err, errs.ErrPollClosed) {
+			t.Fatalf("vote on a closed poll: err = %v, want %v", err, errs.ErrPollClosed)
+		}
+	}
+	if n := testutil.CountRows(t, &models.PollVote{}); n != 1 {
+		t.Fatalf("got %d votes, want the one cast before closing", n)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := Poll.SendPoll(ctx, alice.ID, SendPollRequest{GroupID: &group.ID, Question: "late?", Options: []string{"a", "b"}, ClosesAt: &past}); err == nil {
+		t.Fatal("SendPoll accepted a poll closing in the past")
+	}
+	if _, err := Poll.Vote(ctx, bob.ID, 9999, poll.Options[0].ID); !errors.Is(err, errs.ErrPollNotFound) {
+		t.Fatalf("unknown poll: err = %v, want %v", err, errs.ErrPollNotFound)
+	}
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/netguard"
+	"web-api/internal/pkg/push"
+	"web-api/internal/pkg/redis"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// PushService sends web push notifications to users who are not connected
+type PushService struct {
+	sender push.Sender
+}
+
+var Push = &PushService{}
+
+// PushSubscribeRequest is the subscription a browser's PushManager returns
+type PushSubscribeRequest struct {
+	Endpoint string `json:"endpoint" binding:"required,url"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys" binding:"required"`
+}
+
+// PushUnsubscribeRequest names the subscription to remove
+type PushUnsubscribeRequest struct {
+	Endpoint string `json:"endpoint" binding:"required"`
+}
+
+// PushNotification is the JSON payload the service worker receives
+type PushNotification struct {
+	Title          string `json:"title"`
+	Body           string `json:"body"`
+	ConversationID string `json:"conversation_id"`
+	MessageID      uint   `json:"message_id"`
+}
+
+// UseSender swaps the push sender; nil disables web push
+func (s *PushService) UseSender(sender push.Sender) {
+	s.sender = sender
+}
+
+// PublicKey returns the VAPID public key browsers subscribe with
+func (s *PushService) PublicKey() string {
+	if cfg := config.GetConfig(); cfg != nil {
+		return cfg.Push.VAPIDPublicKey
+	}
+	return ""
+}
+
+// Subscribe registers a browser for the user's notifications. The endpoint
+// must be a public https URL, since the server posts to it. Registering it
+// again updates its keys; an endpoint of another user is not taken over.
+func (s *PushService) Subscribe(userID uint, req PushSubscribeRequest) (*models.PushSubscription, error) {
+	if s.sender == nil {
+		return nil, errs.ErrPushDisabled
+	}
+
+	endpoint, err := url.Parse(req.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || netguard.CheckURL(endpoint) != nil {
+		return nil, errs.ErrPushEndpoint
+	}
+
+	subscription := models.PushSubscription{
+		UserID:   userID,
+		Endpoint: req.Endpoint,
+		P256dh:   req.Keys.P256dh,
+		Auth:     req.Keys.Auth,
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var existing models.PushSubscription
+		err := tx.Where("endpoint = ?", req.Endpoint).First(&existing).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return tx.Create(&subscription).Error
+		case err != nil:
+			return err
+		case existing.UserID != userID:
+			return errs.ErrPushEndpointInUse
+		}
+
+		subscription.ID, subscription.CreatedAt = existing.ID, existing.CreatedAt
+		return tx.Model(&existing).Updates(map[string]interface{}{
+			"p256dh": req.Keys.P256dh,
+			"auth":   req.Keys.Auth,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// Unsubscribe removes one of the user's browser subscriptions
+func (s *PushService) Unsubscribe(userID uint, endpoint string) error {
+	result := database.GetDB().
+		Where("user_id = ? AND endpoint = ?", userID, endpoint).
+		Delete(&models.PushSubscription{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// NotifyMessage pushes a new message to those recipients who have no live
+// connection. Callers leave out recipients who muted the conversation. It
+// returns immediately; delivery happens in the background.
+func (s *PushService) NotifyMessage(recipientIDs []uint, conversationID string, preview *models.MessagePreview) {
+	if s.sender == nil || len(recipientIDs) == 0 {
+		return
+	}
+
+	go func() {
+		online, err := redis.OnlineStatuses(recipientIDs)
+		if err != nil {
+			logrus.Errorf("Failed to check presence for push: %v", err)
+			return
+		}
+
+		var offline []uint
+		for _, userID := range recipientIDs {
+			if !online[userID] {
+				offline = append(offline, userID)
+			}
+		}
+		if len(offline) == 0 {
+			return
+		}
+
+		payload, err := json.Marshal(PushNotification{
+			Title:          preview.SenderUsername,
+			Body:           preview.Content,
+			ConversationID: conversationID,
+			MessageID:      preview.MessageID,
+		})
+		if err != nil {
+			logrus.Errorf("Failed to marshal push notification: %v", err)
+			return
+		}
+
+		s.send(offline, payload)
+	}()
+}
+
+// send delivers a payload to every subscription of the users, forgetting
+// subscriptions the push service reports as gone
+func (s *PushService) send(userIDs []uint, payload []byte) {
+	db := database.GetDB()
+
+	var subscriptions []models.PushSubscription
+	if err := db.Where("user_id IN ?", userIDs).Find(&subscriptions).Error; err != nil {
+		logrus.Errorf("Failed to load push subscriptions: %v", err)
+		return
+	}
+
+	for _, sub := range subscriptions {
+		err := s.sender.Send(push.Subscription{
+			Endpoint: sub.Endpoint,
+			P256dh:   sub.P256dh,
+			Auth:     sub.Auth,
+		}, payload)
+
+		switch {
+		case errors.Is(err, push.ErrSubscriptionGone):
+			db.Delete(&models.PushSubscription{}, sub.ID)
+		case err != nil:
+			logrus.Warnf("Failed to push to user %d: %v", sub.UserID, err)
+		}
+	}
+}
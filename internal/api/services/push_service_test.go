@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/push"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+)
+
+// sentPush is a notification the fake sender was asked to deliver
+type sentPush struct {
+	endpoint     string
+	notification PushNotification
+}
+
+// fakeSender stands in for the push services. Endpoints containing "gone"
+// report the subscription as revoked.
+type fakeSender chan sentPush
+
+func (s fakeSender) Send(sub push.Subscription, payload []byte) error {
+	var notification PushNotification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return err
+	}
+	s <- sentPush{endpoint: sub.Endpoint, notification: notification}
+
+	if strings.Contains(sub.Endpoint, "gone") {
+		return push.ErrSubscriptionGone
+	}
+	return nil
+}
+
+// useFakeSender enables web push with a fake sender for the test
+func useFakeSender(t *testing.T) fakeSender {
+	t.Helper()
+
+	sender := make(fakeSender, 8)
+	Push.UseSender(sender)
+	t.Cleanup(func() { Push.UseSender(nil) })
+	return sender
+}
+
+// subscribePush registers a browser endpoint for the user's notifications
+func subscribePush(t *testing.T, user *models.User, endpoint string) {
+	t.Helper()
+
+	req := PushSubscribeRequest{Endpoint: endpoint}
+	req.Keys.P256dh, req.Keys.Auth = "p256dh", "auth"
+	if _, err := Push.Subscribe(user.ID, req); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+}
+
+// nextPush returns the next notification sent
+func nextPush(t *testing.T, sender fakeSender) sentPush {
+	t.Helper()
+
+	select {
+	case sent := <-sender:
+		return sent
+	case <-time.After(2 * time.Second):
+		t.Fatal("no push sent")
+		return sentPush{}
+	}
+}
+
+// noPush fails the test if a notification is sent shortly
+func noPush(t *testing.T, sender fakeSender) {
+	t.Helper()
+
+	select {
+	case sent := <-sender:
+		t.Fatalf("unexpected push to %s: %+v", sent.endpoint, sent.notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Each message is pushed from one goroutine, so the tests below always
+// expect a push last: receiving it means the goroutine is done
+func TestPushReachesOfflineRecipients(t *testing.T) {
+	testutil.Setup(t)
+	sender := useFakeSender(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	subscribePush(t, bob, "https://push.example.com/bob")
+	subscribePush(t, carol, "https://push.example.com/carol")
+
+	message, err := Chat.SendPrivateMessage(ctx, alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "are you there?"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	sent := nextPush(t, sender)
+	want := PushNotification{
+		Title:          "alice",
+		Body:           "are you there?",
+		ConversationID: models.ConversationID(models.ChatTypePrivate, alice.ID),
+		MessageID:      message.ID,
+	}
+	if sent.endpoint != "https://push.example.com/bob" || sent.notification != want {
+		t.Fatalf("pushed %+v to %s, want %+v to bob", sent.notification, sent.endpoint, want)
+	}
+
+	// Connected users get the message over their socket instead
+	if err := redis.SetUserOnline(carol.ID, "instance"); err != nil {
+		t.Fatalf("SetUserOnline: %v", err)
+	}
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi all"}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	if sent := nextPush(t, sender); sent.endpoint != "https://push.example.com/bob" {
+		t.Fatalf("pushed to %s, want only bob, who is offline", sent.endpoint)
+	}
+	noPush(t, sender)
+}
+
+func TestPushSkipsMutedConversations(t *testing.T) {
+	testutil.Setup(t)
+	sender := useFakeSender(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	subscribePush(t, bob, "https://push.example.com/bob")
+	subscribePush(t, carol, "https://push.example.com/carol")
+
+	if _, err := Chat.MuteConversation(ctx, bob.ID, models.ConversationID(models.ChatTypeGroup, group.ID), 0); err != nil {
+		t.Fatalf("MuteConversation: %v", err)
+	}
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "meeting at 3"}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+
+	if sent := nextPush(t, sender); sent.endpoint != "https://push.example.com/carol" {
+		t.Fatalf("pushed to %s, want only carol", sent.endpoint)
+	}
+	noPush(t, sender)
+}
+
+func TestPushForgetsGoneSubscriptions(t *testing.T) {
+	testutil.Setup(t)
+	sender := useFakeSender(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	subscribePush(t, bob, "https://push.example.com/gone")
+	subscribePush(t, bob, "https://push.example.com/phone")
+
+	if _, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hi"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	// The gone endpoint is tried first, so it is forgotten by the time
+	// the phone's push arrives
+	if sent := nextPush(t, sender); sent.endpoint != "https://push.example.com/gone" {
+		t.Fatalf("pushed to %s first, want the gone endpoint", sent.endpoint)
+	}
+	nextPush(t, sender)
+
+	var endpoints []string
+	database.GetDB().Model(&models.PushSubscription{}).Pluck("endpoint", &endpoints)
+	if len(endpoints) != 1 || endpoints[0] != "https://push.example.com/phone" {
+		t.Fatalf("subscriptions %v, want only the phone", endpoints)
+	}
+}
+
+func TestSubscribeRefusesInternalAndTakenEndpoints(t *testing.T) {
+	testutil.Setup(t)
+	useFakeSender(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	subscribe := func(user *models.User, endpoint string) error {
+		req := PushSubscribeRequest{Endpoint: endpoint}
+		req.Keys.P256dh, req.Keys.Auth = "p256dh", "auth"
+		_, err := Push.Subscribe(user.ID, req)
+		return err
+	}
+
+	for _, endpoint := range []string{
+		"http://push.example.com/alice",
+		"https://127.0.0.1/push",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[fd00::1]/push",
+	} {
+		if err := subscribe(alice, endpoint); !errors.Is(err, errs.ErrPushEndpoint) {
+			t.Errorf("Subscribe(%s): err = %v, want %v", endpoint, err, errs.ErrPushEndpoint)
+		}
+	}
+
+	// Alice may renew her own endpoint, but bob cannot take it over
+	subscribePush(t, alice, "https://push.example.com/alice")
+	subscribePush(t, alice, "https://push.example.com/alice")
+	if err := subscribe(bob, "https://push.example.com/alice"); !errors.Is(err, errs.ErrPushEndpointInUse) {
+		t.Fatalf("bob subscribing alice's endpoint: err = %v, want %v", err, errs.ErrPushEndpointInUse)
+	}
+	var subscriptions []models.PushSubscription
+	database.GetDB().Find(&subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].UserID != alice.ID {
+		t.Fatalf("subscriptions %+v, want only alice's", subscriptions)
+	}
+}
@@ -1,19 +1,32 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"mime/multipart"
+	"strings"
 	"time"
 
+	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/mail"
 	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
 	"web-api/internal/pkg/redis"
 	"web-api/internal/pkg/utils"
+	"web-api/internal/pkg/websocket"
 
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type UserService struct{}
+type UserService struct {
+	mailer mail.Mailer
+}
 
 var User = &UserService{}
 
@@ -31,20 +44,70 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
-// AuthResponse represents authentication response
+// UpdateProfileRequest represents a profile update; omitted fields are
+// left unchanged
+type UpdateProfileRequest struct {
+	FullName *string `json:"full_name" binding:"omitempty,max=255"`
+	Avatar   *string `json:"avatar" binding:"omitempty,max=500"`
+	Email    *string `json:"email" binding:"omitempty,email"`
+
+	LastSeenVisibility *string `json:"last_seen_visibility" binding:"omitempty,oneof=everyone contacts nobody"`
+}
+
+// UpdateStatusRequest represents a presence status change
+type UpdateStatusRequest struct {
+	Status models.PresenceStatus `json:"status" binding:"required"` // online, away, busy or invisible
+}
+
+// ChangePasswordRequest represents a password change request
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// DeleteAccountRequest confirms an account deletion with the password
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ForgotPasswordRequest asks for a password reset link
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest sets a new password with a reset token
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// ContactRequest asks a user to become contacts
+type ContactRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// RefreshRequest represents a token refresh request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// AuthResponse represents authentication response. Token is the
+// short-lived access token; RefreshToken obtains a new pair once it expires.
 type AuthResponse struct {
-	Token string               `json:"token"`
-	User  models.UserResponse  `json:"user"`
+	Token        string              `json:"token"`
+	RefreshToken string              `json:"refresh_token"`
+	ExpiresIn    int64               `json:"expires_in"` // Access token lifetime in seconds
+	User         models.UserResponse `json:"user"`
 }
 
 // Register creates a new user account
-func (s *UserService) Register(req RegisterRequest) (*AuthResponse, error) {
-	db := database.GetDB()
+func (s *UserService) Register(ctx context.Context, req RegisterRequest) (*AuthResponse, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	// Check if user already exists
 	var existingUser models.User
 	if err := db.Where("email = ? OR username = ?", req.Email, req.Username).First(&existingUser).Error; err == nil {
-		return nil, errors.New("user with this email or username already exists")
+		return nil, errs.ErrUserExists
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, err
 	}
@@ -68,34 +131,25 @@ func (s *UserService) Register(req RegisterRequest) (*AuthResponse, error) {
 		return nil, err
 	}
 
-	// Generate JWT token
-	token, err := utils.GenerateToken(user.ID, user.Username, user.Email)
-	if err != nil {
-		return nil, errors.New("failed to generate token")
-	}
-
-	return &AuthResponse{
-		Token: token,
-		User:  user.ToResponse(),
-	}, nil
+	return s.issueTokens(ctx, &user)
 }
 
 // Login authenticates a user
-func (s *UserService) Login(req LoginRequest) (*AuthResponse, error) {
-	db := database.GetDB()
+func (s *UserService) Login(ctx context.Context, req LoginRequest) (*AuthResponse, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	// Find user by email
 	var user models.User
 	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("invalid email or password")
+			return nil, errs.ErrInvalidCredentials
 		}
 		return nil, err
 	}
 
 	// Check password
 	if !utils.CheckPassword(user.Password, req.Password) {
-		return nil, errors.New("invalid email or password")
+		return nil, errs.ErrInvalidCredentials
 	}
 
 	// Update last seen
@@ -103,23 +157,123 @@ func (s *UserService) Login(req LoginRequest) (*AuthResponse, error) {
 	user.LastSeen = &now
 	db.Save(&user)
 
-	// Generate JWT token
+	return s.issueTokens(ctx, &user)
+}
+
+// Refresh exchanges a refresh token for a new access/refresh token pair.
+// The used refresh token is revoked, so each one works only once.
+func (s *UserService) Refresh(ctx context.Context, refreshToken string) (*AuthResponse, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	claims, err := utils.ValidateRefreshToken(refreshToken)
+	if err != nil {
+		return nil, errs.ErrInvalidRefreshToken
+	}
+
+	revoked, err := redis.RevokeRefreshToken(claims.UserID, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !revoked {
+		return nil, errs.ErrRefreshTokenRevoked
+	}
+
+	var user models.User
+	if err := db.First(&user, claims.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	// Claims come from the user as stored now, not from the refresh token,
+	// which may predate a username or email change
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.withRefreshToken(&user, token)
+}
+
+// LogoutRequest represents a logout request. The refresh token is optional
+// and is revoked along with the access token when given.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Logout revokes the access token described by claims and, if given, the
+// matching refresh token
+func (s *UserService) Logout(ctx context.Context, claims *utils.Claims, refreshToken string) error {
+	if err := redis.BlacklistToken(claims.ID, claims.ExpiresIn()); err != nil {
+		return err
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+
+	refreshClaims, err := utils.ValidateRefreshToken(refreshToken)
+	if err != nil || refreshClaims.UserID != claims.UserID {
+		// The access token is already revoked; an unusable refresh token
+		// needs no further action
+		return nil
+	}
+
+	_, err = redis.RevokeRefreshToken(refreshClaims.UserID, refreshClaims.ID)
+	return err
+}
+
+// RevokeAllTokens invalidates every access and refresh token of a user, e.g.
+// after a password change
+func (s *UserService) RevokeAllTokens(ctx context.Context, userID uint) error {
+	if err := redis.RevokeUserTokens(userID, utils.RefreshTokenTTL); err != nil {
+		return err
+	}
+	if err := redis.RevokeUserRefreshTokens(userID); err != nil {
+		return err
+	}
+	// Bot tokens outlive the Redis cutoff, so they are revoked for good
+	return Bot.revokeAllBotTokens(userID)
+}
+
+// issueTokens generates an access/refresh token pair for a user
+func (s *UserService) issueTokens(ctx context.Context, user *models.User) (*AuthResponse, error) {
 	token, err := utils.GenerateToken(user.ID, user.Username, user.Email)
 	if err != nil {
 		return nil, errors.New("failed to generate token")
 	}
 
+	return s.withRefreshToken(user, token)
+}
+
+// withRefreshToken pairs an access token with a new refresh token for the
+// user
+func (s *UserService) withRefreshToken(user *models.User, token string) (*AuthResponse, error) {
+	refreshToken, refreshID, err := utils.GenerateRefreshToken(user.ID, user.Username, user.Email)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	if err := redis.StoreRefreshToken(user.ID, refreshID, utils.RefreshTokenTTL); err != nil {
+		return nil, errors.New("failed to store refresh token")
+	}
+
 	return &AuthResponse{
-		Token: token,
-		User:  user.ToResponse(),
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(utils.AccessTokenTTL.Seconds()),
+		User:         user.ToResponse(),
 	}, nil
 }
 
-// GetOnlineUsers returns list of online users
-func (s *UserService) GetOnlineUsers() ([]models.UserResponse, error) {
-	db := database.GetDB()
+// GetOnlineUsers returns viewerID's contacts who are online, as viewerID
+// sees them
+func (s *UserService) GetOnlineUsers(ctx context.Context, viewerID uint) ([]models.UserResponse, error) {
+	db := database.GetDB().WithContext(ctx)
 
-	// Get online user IDs from Redis
+	// Redis knows who is online on every instance, the local hub only its
+	// own connections
 	onlineUserIDs, err := redis.GetOnlineUsers()
 	if err != nil {
 		return nil, err
@@ -129,46 +283,498 @@ func (s *UserService) GetOnlineUsers() ([]models.UserResponse, error) {
 		return []models.UserResponse{}, nil
 	}
 
-	// Convert string IDs to uint
+	contactIDs, err := s.AcceptedContactIDs(ctx, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[uint]bool, len(contactIDs))
+	for _, id := range contactIDs {
+		contacts[id] = true
+	}
+
+	// Keep only contacts
 	var userIDs []uint
-	for _, idStr := range onlineUserIDs {
-		var id uint
-		if _, err := fmt.Sscanf(idStr, "%d", &id); err == nil {
+	for _, id := range onlineUserIDs {
+		if contacts[id] {
 			userIDs = append(userIDs, id)
 		}
 	}
 
-	// Fetch users from database
+	if len(userIDs) == 0 {
+		return []models.UserResponse{}, nil
+	}
+
+	// Fetch users from database in one query
 	var users []models.User
 	if err := db.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
 		return nil, err
 	}
 
-	// Convert to response format
-	responses := make([]models.UserResponse, len(users))
-	for i, user := range users {
-		responses[i] = user.ToResponse()
-		responses[i].IsOnline = true
+	statuses, err := redis.PresenceStatuses(userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to response format, leaving out invisible users
+	responses := make([]models.UserResponse, 0, len(users))
+	for _, user := range users {
+		status := models.PresenceOnline
+		if stored := statuses[user.ID]; stored != "" {
+			status = models.PresenceStatus(stored)
+		}
+		if status.Visible() == models.PresenceOffline {
+			continue
+		}
+
+		// Everyone listed is the viewer's contact, so last seen shared with
+		// contacts is visible without asking the database again
+		response := user.ToResponse()
+		response.LastSeenVisibility = ""
+		if !lastSeenVisible(viewerID, &user, true) {
+			response.LastSeen = nil
+		}
+		response.IsOnline = true
+		response.Status = status
+		responses = append(responses, response)
 	}
 
 	return responses, nil
 }
 
+// SetPresenceStatus changes the user's presence status
+func (s *UserService) SetPresenceStatus(ctx context.Context, userID uint, status models.PresenceStatus) error {
+	return websocket.SetPresenceStatus(userID, status)
+}
+
 // GetUserByID retrieves a user by ID
-func (s *UserService) GetUserByID(userID uint) (*models.User, error) {
-	db := database.GetDB()
+func (s *UserService) GetUserByID(ctx context.Context, userID uint) (*models.User, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateProfile updates the user's profile fields
+func (s *UserService) UpdateProfile(ctx context.Context, userID uint, req UpdateProfileRequest) (*models.User, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if req.FullName != nil {
+		updates["full_name"] = *req.FullName
+	}
+	if req.Avatar != nil && *req.Avatar != user.Avatar {
+		if err := FileServ.checkAvatarOwner(*req.Avatar, userID); err != nil {
+			return nil, err
+		}
+		updates["avatar"] = *req.Avatar
+	}
+	if req.Email != nil && *req.Email != user.Email {
+		var count int64
+		if err := db.Model(&models.User{}).
+			Where("email = ? AND id <> ?", *req.Email, userID).
+			Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errs.ErrEmailInUse
+		}
+		updates["email"] = *req.Email
+	}
+	if req.LastSeenVisibility != nil {
+		updates["last_seen_visibility"] = *req.LastSeenVisibility
+	}
+
+	if len(updates) == 0 {
+		return &user, nil
+	}
+
+	previousAvatar := user.Avatar
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if user.Avatar != previousAvatar {
+		FileServ.ReleaseAvatar(previousAvatar, userID)
+	}
+
+	return &user, nil
+}
+
+// SetAvatar replaces the user's avatar with an uploaded image, deleting the
+// previous one if it was uploaded too
+func (s *UserService) SetAvatar(ctx context.Context, userID uint, fileHeader *multipart.FileHeader) (*models.User, error) {
+	db := database.GetDB().WithContext(ctx)
 
 	var user models.User
 	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	file, err := FileServ.UploadAvatar(userID, fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	previousAvatar := user.Avatar
+	if err := db.Model(&user).Update("avatar", file.URL).Error; err != nil {
 		return nil, err
 	}
+	FileServ.ReleaseAvatar(previousAvatar, userID)
 
 	return &user, nil
 }
 
+// ChangePassword replaces the user's password after verifying the old one.
+// All existing tokens are revoked and a fresh pair is returned.
+func (s *UserService) ChangePassword(ctx context.Context, userID uint, oldPassword, newPassword string) (*AuthResponse, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	if !utils.CheckPassword(user.Password, oldPassword) {
+		return nil, errs.ErrWrongPassword
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return nil, errors.New("failed to hash password")
+	}
+
+	if err := db.Model(&user).Update("password", hashedPassword).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.RevokeAllTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(ctx, &user)
+}
+
+// DeleteAccount erases a user after checking their password. Their tokens
+// are revoked; their private conversations, group messages, uploads,
+// memberships and settings are deleted; and the user row is anonymized
+// before being soft-deleted, so the username and email become free again.
+// Each group they own passes to its longest-standing admin, or member if
+// there is none, and is deleted when no one else is left. Everyone who
+// shared a conversation with them gets user_deleted.
+func (s *UserService) DeleteAccount(ctx context.Context, userID uint, password string) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrUserNotFound
+		}
+		return err
+	}
+
+	if !utils.CheckPassword(user.Password, password) {
+		return errs.ErrWrongPassword
+	}
+
+	affected, err := s.contactIDs(db, userID)
+	if err != nil {
+		return err
+	}
+
+	var files []models.File
+	if err := db.Where("uploader_id = ?", userID).Find(&files).Error; err != nil {
+		return err
+	}
+
+	var owned []models.Group
+	if err := db.Where("owner_id = ?", userID).Find(&owned).Error; err != nil {
+		return err
+	}
+
+	// Sessions go first: should the deletion fail, the user only has to
+	// log in again
+	if err := s.RevokeAllTokens(ctx, userID); err != nil {
+		return err
+	}
+
+	newOwners := make(map[uint]uint)
+	var purged []models.Group
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range owned {
+			successor, err := groupSuccessor(tx, owned[i].ID, userID)
+			if err != nil {
+				return err
+			}
+			if successor == 0 {
+				if err := purgeGroup(tx, &owned[i]); err != nil {
+					return err
+				}
+				purged = append(purged, owned[i])
+				continue
+			}
+
+			if err := tx.Model(&owned[i]).Update("owner_id", successor).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.GroupMember{}).
+				Where("group_id = ? AND user_id = ?", owned[i].ID, successor).
+				Update("role", models.GroupRoleAdmin).Error; err != nil {
+				return err
+			}
+			newOwners[owned[i].ID] = successor
+		}
+
+		return deleteUserData(tx, &user)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := redis.ClearPresence(userID); err != nil {
+		logrus.Errorf("Failed to clear presence of deleted user %d: %v", userID, err)
+	}
+	FileServ.deleteStored(files)
+	for _, group := range purged {
+		FileServ.ReleaseAvatar(group.Avatar, userID)
+	}
+
+	for groupID, ownerID := range newOwners {
+		Group.broadcastToMembers(ctx, groupID, "group_updated", map[string]interface{}{
+			"group_id":   groupID,
+			"owner_id":   ownerID,
+			"updated_by": userID,
+		})
+	}
+	websocket.PublishToUsers(affected, "user_deleted", map[string]interface{}{
+		"user_id":    userID,
+		"deleted_at": time.Now(),
+	})
+
+	logrus.Infof("Deleted account of user %d", userID)
+	return nil
+}
+
+// contactIDs returns the users who share a private conversation or a group
+// with userID
+func (s *UserService) contactIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	var partners, senders, members []uint
+	if err := db.Model(&models.PrivateMessage{}).Where("sender_id = ?", userID).
+		Distinct().Pluck("receiver_id", &partners).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&models.PrivateMessage{}).Where("receiver_id = ?", userID).
+		Distinct().Pluck("sender_id", &senders).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&models.GroupMember{}).
+		Where("group_id IN (?) AND user_id <> ?",
+			db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID), userID).
+		Distinct().Pluck("user_id", &members).Error; err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint]bool)
+	var ids []uint
+	for _, id := range append(append(partners, senders...), members...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// groupSuccessor picks who takes over a group from its departing owner: the
+// admin who joined first, else the member who joined first. It returns 0 if
+// the owner is the only member.
+func groupSuccessor(tx *gorm.DB, groupID, ownerID uint) (uint, error) {
+	var member models.GroupMember
+	err := tx.Where("group_id = ? AND user_id <> ?", groupID, ownerID).
+		Order("CASE WHEN role = '" + models.GroupRoleAdmin + "' THEN 0 ELSE 1 END, joined_at ASC, id ASC").
+		First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return member.UserID, nil
+}
+
+// deleteUserData removes the rows of a user within tx and anonymizes and
+// soft-deletes the user
+func deleteUserData(tx *gorm.DB, user *models.User) error {
+	userID := user.ID
+
+	// Messages are soft-deleted like any other; a private conversation goes
+	// with both sides since its other participant is gone
+	if err := tx.Where("sender_id = ? OR receiver_id = ?", userID, userID).Delete(&models.PrivateMessage{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("sender_id = ?", userID).Delete(&models.GroupMessage{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("uploader_id = ?", userID).Delete(&models.File{}).Error; err != nil {
+		return err
+	}
+
+	// Per-user rows
+	if err := tx.Where("webhook_id IN (?)", tx.Model(&models.Webhook{}).Select("id").Where("user_id = ?", userID)).
+		Delete(&models.WebhookDeadLetter{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ? OR contact_user_id = ?", userID, userID).Delete(&models.Contact{}).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{
+		&models.GroupMember{},
+		&models.GroupJoinRequest{},
+		&models.MessageDelivery{},
+		&models.MessageMention{},
+		&models.MessageHidden{},
+		&models.StarredMessage{},
+		&models.MessageReaction{},
+		&models.PollVote{},
+		&models.ConversationMute{},
+		&models.ConversationArchive{},
+		&models.Draft{},
+		&models.PushSubscription{},
+		&models.BotToken{},
+		&models.Webhook{},
+	} {
+		if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Model(user).Updates(map[string]interface{}{
+		"username":  fmt.Sprintf("deleted_user_%d", userID),
+		"email":     fmt.Sprintf("deleted_user_%d@deleted.invalid", userID),
+		"password":  "",
+		"full_name": "",
+		"avatar":    "",
+		"is_online": false,
+		"admin":     false,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(user).Error
+}
+
+// defaultPasswordResetTTL applies when auth.password_reset_ttl is not set
+const defaultPasswordResetTTL = 30 * time.Minute
+
+// UseMailer swaps the mailer; nil disables email
+func (s *UserService) UseMailer(mailer mail.Mailer) {
+	s.mailer = mailer
+}
+
+// ForgotPassword emails a password reset link to the user with this email.
+// Unknown emails are ignored without an error, and the email is sent in the
+// background, so callers cannot tell which addresses have an account.
+func (s *UserService) ForgotPassword(ctx context.Context, email string) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var user models.User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if s.mailer == nil {
+		logrus.Warnf("Password reset requested for user %d, but mail is not configured", user.ID)
+		return nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+
+	cfg := config.GetConfig().Auth
+	ttl := cfg.PasswordResetTTL
+	if ttl <= 0 {
+		ttl = defaultPasswordResetTTL
+	}
+	if err := redis.StorePasswordResetToken(user.ID, token, ttl); err != nil {
+		return err
+	}
+
+	link := cfg.PasswordResetURL
+	if strings.Contains(link, "?") {
+		link += "&token=" + token
+	} else {
+		link += "?token=" + token
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link to choose a new password:\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask for it, ignore this email.\n",
+			user.Username, link, ttl),
+	}
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			logrus.Errorf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. The
+// token is used up, and every session of the user is signed out.
+func (s *UserService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	userID, ok, err := redis.ConsumePasswordResetToken(token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errs.ErrInvalidResetToken
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return errors.New("failed to hash password")
+	}
+
+	result := database.GetDB().WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", userID).
+		Update("password", hashedPassword)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrInvalidResetToken
+	}
+
+	return s.RevokeAllTokens(ctx, userID)
+}
+
 // UpdateUserStatus updates user online status
-func (s *UserService) UpdateUserStatus(userID uint, isOnline bool) error {
-	db := database.GetDB()
+func (s *UserService) UpdateUserStatus(ctx context.Context, userID uint, isOnline bool) error {
+	db := database.GetDB().WithContext(ctx)
 
 	updates := map[string]interface{}{
 		"is_online": isOnline,
@@ -182,21 +788,383 @@ func (s *UserService) UpdateUserStatus(userID uint, isOnline bool) error {
 	return db.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error
 }
 
-// SearchUsers searches for users by username or email
-func (s *UserService) SearchUsers(query string, limit int) ([]models.UserResponse, error) {
-	db := database.GetDB()
+// SearchUsers searches other users by username or email, returning one
+// page of matches and the total number of matches
+func (s *UserService) SearchUsers(ctx context.Context, viewerID uint, query string, limit, offset int) ([]models.UserResponse, int64, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, 0, errors.New("search query cannot be empty")
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	// Wildcards in the query are matched literally. On Postgres the
+	// substring match is served by the trigram indexes on both columns.
+	escaped := likeEscaper.Replace(query)
+	pattern := "%" + escaped + "%"
+	match := `LOWER(username) LIKE LOWER(?) ESCAPE '\' OR LOWER(email) LIKE LOWER(?) ESCAPE '\'`
+	if db.Dialector.Name() == "postgres" {
+		match = `username ILIKE ? ESCAPE '\' OR email ILIKE ? ESCAPE '\'`
+	}
+
+	// The caller never shows up in their own results
+	matching := db.Model(&models.User{}).Where("id <> ?", viewerID).Where(match, pattern, pattern)
+
+	var total int64
+	if err := matching.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
 
+	// Usernames starting with the query come first
 	var users []models.User
-	if err := db.Where("username LIKE ? OR email LIKE ?", "%"+query+"%", "%"+query+"%").
+	if err := matching.Session(&gorm.Session{}).
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                `CASE WHEN LOWER(username) LIKE LOWER(?) ESCAPE '\' THEN 0 ELSE 1 END, username`,
+			Vars:               []interface{}{escaped + "%"},
+			WithoutParentheses: true,
+		}}).
 		Limit(limit).
+		Offset(offset).
 		Find(&users).Error; err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	responses := make([]models.UserResponse, len(users))
-	for i, user := range users {
-		responses[i] = user.ToResponse()
+	for i := range users {
+		responses[i] = s.PublicResponse(ctx, viewerID, &users[i])
+	}
+
+	return responses, total, nil
+}
+
+// LastSeenResponse tells when a user was last online; LastSeen is nil if
+// unknown or hidden by the user's privacy setting
+type LastSeenResponse struct {
+	UserID   uint       `json:"user_id"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// GetLastSeen returns when a user was last online, as far as their
+// privacy setting lets viewerID know
+func (s *UserService) GetLastSeen(ctx context.Context, viewerID, userID uint) (*LastSeenResponse, error) {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	response := &LastSeenResponse{UserID: user.ID}
+	if s.CanSeeLastSeen(ctx, viewerID, user) {
+		response.LastSeen = user.LastSeen
+	}
+
+	return response, nil
+}
+
+// CanSeeLastSeen reports whether viewerID may see when user was last online
+func (s *UserService) CanSeeLastSeen(ctx context.Context, viewerID uint, user *models.User) bool {
+	// Only ask the database about contacts when the answer matters
+	isContact := viewerID != user.ID && user.LastSeenVisibility == models.LastSeenContacts &&
+		s.IsContact(ctx, user.ID, viewerID)
+	return lastSeenVisible(viewerID, user, isContact)
+}
+
+// lastSeenVisible applies user's last seen privacy setting to viewerID,
+// who is one of the user's contacts if isContact is set
+func lastSeenVisible(viewerID uint, user *models.User, isContact bool) bool {
+	if viewerID == user.ID {
+		return true
+	}
+
+	switch user.LastSeenVisibility {
+	case models.LastSeenNobody:
+		return false
+	case models.LastSeenContacts:
+		return isContact
+	}
+	return true
+}
+
+// IsContact reports whether two users are accepted contacts
+func (s *UserService) IsContact(ctx context.Context, userID, otherID uint) bool {
+	var count int64
+	if err := contactPair(database.GetDB().WithContext(ctx).Model(&models.Contact{}), userID, otherID).
+		Where("status = ?", models.ContactStatusAccepted).
+		Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// PublicResponse converts a user for display to viewerID, leaving out
+// what the user's privacy settings withhold
+func (s *UserService) PublicResponse(ctx context.Context, viewerID uint, user *models.User) models.UserResponse {
+	response := user.ToResponse()
+	if viewerID == user.ID {
+		return response
+	}
+
+	response.LastSeenVisibility = ""
+	if !s.CanSeeLastSeen(ctx, viewerID, user) {
+		response.LastSeen = nil
+	}
+	return response
+}
+
+// PublicResponses is PublicResponse for many users, keyed by user ID. The
+// viewer's contacts are looked up once rather than per user.
+func (s *UserService) PublicResponses(ctx context.Context, viewerID uint, users []models.User) (map[uint]models.UserResponse, error) {
+	var contacts map[uint]bool
+	for _, user := range users {
+		if user.ID == viewerID || user.LastSeenVisibility != models.LastSeenContacts {
+			continue
+		}
+
+		contactIDs, err := s.AcceptedContactIDs(ctx, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		contacts = make(map[uint]bool, len(contactIDs))
+		for _, id := range contactIDs {
+			contacts[id] = true
+		}
+		break
+	}
+
+	responses := make(map[uint]models.UserResponse, len(users))
+	for _, user := range users {
+		response := user.ToResponse()
+		if user.ID != viewerID {
+			response.LastSeenVisibility = ""
+			if !lastSeenVisible(viewerID, &user, contacts[user.ID]) {
+				response.LastSeen = nil
+			}
+		}
+		responses[user.ID] = response
 	}
 
 	return responses, nil
 }
+
+// contactPair narrows a query to the contact row between two users,
+// whichever of them asked
+func contactPair(db *gorm.DB, userID, otherID uint) *gorm.DB {
+	return db.Where("(user_id = ? AND contact_user_id = ?) OR (user_id = ? AND contact_user_id = ?)",
+		userID, otherID, otherID, userID)
+}
+
+// SendContactRequest asks contactUserID to become userID's contact. If
+// contactUserID already asked userID, their request is accepted instead.
+func (s *UserService) SendContactRequest(ctx context.Context, userID, contactUserID uint) (*models.ContactResponse, error) {
+	if userID == contactUserID {
+		return nil, errs.ErrSelfContact
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	target, err := s.GetUserByID(ctx, contactUserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	var existing models.Contact
+	err = contactPair(db, userID, contactUserID).First(&existing).Error
+	switch {
+	case err == nil:
+		if existing.Status == models.ContactStatusAccepted {
+			return nil, errs.ErrAlreadyContact
+		}
+		if existing.UserID == userID {
+			return nil, errs.ErrContactPending
+		}
+		return s.AcceptContactRequest(ctx, userID, contactUserID)
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	contact := models.Contact{
+		UserID:        userID,
+		ContactUserID: contactUserID,
+		Status:        models.ContactStatusPending,
+	}
+	if err := db.Create(&contact).Error; err != nil {
+		// The other user asked at the same time and hit the unique index
+		var count int64
+		if contactPair(db.Model(&models.Contact{}), userID, contactUserID).Count(&count); count > 0 {
+			return nil, errs.ErrContactPending
+		}
+		return nil, err
+	}
+
+	if requester, err := s.GetUserByID(ctx, userID); err == nil {
+		websocket.PublishToUser(contactUserID, "contact_request", map[string]interface{}{
+			"user":       s.PublicResponse(ctx, contactUserID, requester),
+			"created_at": contact.CreatedAt,
+		})
+	}
+
+	return &models.ContactResponse{
+		User:      s.PublicResponse(ctx, userID, target),
+		Status:    contact.Status,
+		Direction: "outgoing",
+		CreatedAt: contact.CreatedAt,
+	}, nil
+}
+
+// AcceptContactRequest accepts the contact request requesterID sent to
+// userID and tells the requester
+func (s *UserService) AcceptContactRequest(ctx context.Context, userID, requesterID uint) (*models.ContactResponse, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var contact models.Contact
+	if err := db.Where("user_id = ? AND contact_user_id = ?", requesterID, userID).First(&contact).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrContactNotFound
+		}
+		return nil, err
+	}
+	if contact.Status == models.ContactStatusAccepted {
+		return nil, errs.ErrAlreadyContact
+	}
+
+	now := time.Now()
+	result := db.Model(&contact).Where("status = ?", models.ContactStatusPending).
+		Updates(map[string]interface{}{"status": models.ContactStatusAccepted, "accepted_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errs.ErrAlreadyContact
+	}
+
+	requester, err := s.GetUserByID(ctx, requesterID)
+	if err != nil {
+		return nil, err
+	}
+	if accepter, err := s.GetUserByID(ctx, userID); err == nil {
+		websocket.PublishToUser(requesterID, "contact_accepted", map[string]interface{}{
+			"user":        s.PublicResponse(ctx, requesterID, accepter),
+			"accepted_at": now,
+		})
+	}
+
+	return &models.ContactResponse{
+		User:       s.PublicResponse(ctx, userID, requester),
+		Status:     models.ContactStatusAccepted,
+		AcceptedAt: &now,
+		CreatedAt:  contact.CreatedAt,
+	}, nil
+}
+
+// RemoveContact ends the relationship between userID and otherID: it
+// removes an accepted contact, withdraws a request userID sent or declines
+// one they received. Only removing an accepted contact is announced, with
+// a contact_removed event to both users.
+func (s *UserService) RemoveContact(ctx context.Context, userID, otherID uint) error {
+	db := database.GetDB().WithContext(ctx)
+
+	var contact models.Contact
+	if err := contactPair(db, userID, otherID).First(&contact).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errs.ErrContactNotFound
+		}
+		return err
+	}
+
+	result := db.Delete(&contact)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.ErrContactNotFound
+	}
+
+	if contact.Status == models.ContactStatusAccepted {
+		websocket.PublishToUser(otherID, "contact_removed", map[string]interface{}{"user_id": userID})
+		websocket.PublishToUser(userID, "contact_removed", map[string]interface{}{"user_id": otherID})
+	}
+	return nil
+}
+
+// ListContacts returns the user's accepted contacts, or their pending
+// requests in both directions when status is pending. Most recently
+// changed come first.
+func (s *UserService) ListContacts(ctx context.Context, userID uint, status models.ContactStatus) ([]models.ContactResponse, error) {
+	if status == "" {
+		status = models.ContactStatusAccepted
+	}
+
+	db := database.GetDB().WithContext(ctx)
+
+	var contacts []models.Contact
+	if err := db.Where("(user_id = ? OR contact_user_id = ?) AND status = ?", userID, userID, status).
+		Order("updated_at DESC, id DESC").
+		Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+
+	otherIDs := make([]uint, len(contacts))
+	for i, contact := range contacts {
+		otherIDs[i] = contact.ContactUserID
+		if contact.ContactUserID == userID {
+			otherIDs[i] = contact.UserID
+		}
+	}
+
+	users := make(map[uint]*models.User, len(otherIDs))
+	if len(otherIDs) > 0 {
+		var found []models.User
+		if err := db.Where("id IN ?", otherIDs).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for i := range found {
+			users[found[i].ID] = &found[i]
+		}
+	}
+
+	responses := make([]models.ContactResponse, 0, len(contacts))
+	for i, contact := range contacts {
+		user, ok := users[otherIDs[i]]
+		if !ok {
+			continue
+		}
+
+		response := models.ContactResponse{
+			User:       s.PublicResponse(ctx, userID, user),
+			Status:     contact.Status,
+			AcceptedAt: contact.AcceptedAt,
+			CreatedAt:  contact.CreatedAt,
+		}
+		if contact.Status == models.ContactStatusPending {
+			response.Direction = "outgoing"
+			if contact.ContactUserID == userID {
+				response.Direction = "incoming"
+			}
+		}
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+// AcceptedContactIDs returns the IDs of the user's accepted contacts
+func (s *UserService) AcceptedContactIDs(ctx context.Context, userID uint) ([]uint, error) {
+	db := database.GetDB().WithContext(ctx)
+
+	var asked, answered []uint
+	if err := db.Model(&models.Contact{}).Where("user_id = ? AND status = ?", userID, models.ContactStatusAccepted).
+		Pluck("contact_user_id", &asked).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&models.Contact{}).Where("contact_user_id = ? AND status = ?", userID, models.ContactStatusAccepted).
+		Pluck("user_id", &answered).Error; err != nil {
+		return nil, err
+	}
+
+	return append(asked, answered...), nil
+}
@@ -0,0 +1,775 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/mail"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+	"web-api/internal/pkg/utils"
+)
+
+func TestLastSeenVisible(t *testing.T) {
+	tests := []struct {
+		visibility string
+		self       bool
+		isContact  bool
+		want       bool
+	}{
+		{models.LastSeenEveryone, false, false, true},
+		{models.LastSeenContacts, false, false, false},
+		{models.LastSeenContacts, false, true, true},
+		{models.LastSeenNobody, false, true, false},
+		{models.LastSeenNobody, true, false, true},
+	}
+	for _, tt := range tests {
+		user := &models.User{ID: 1, LastSeenVisibility: tt.visibility}
+		viewerID := uint(2)
+		if tt.self {
+			viewerID = user.ID
+		}
+		if got := lastSeenVisible(viewerID, user, tt.isContact); got != tt.want {
+			t.Errorf("lastSeenVisible(%s, self=%v, contact=%v) = %v, want %v",
+				tt.visibility, tt.self, tt.isContact, got, tt.want)
+		}
+	}
+}
+
+// CanSeeLastSeen, PublicResponse and PublicResponses look up contacts
+// differently and must still agree
+func TestLastSeenLookupsAgree(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	viewer, contact := testutil.CreateUser(t, "viewer"), testutil.CreateUser(t, "contact")
+	stranger := testutil.CreateUser(t, "stranger")
+	now := time.Now()
+	if err := database.DB.Create(&models.Contact{UserID: viewer.ID, ContactUserID: contact.ID, Status: models.ContactStatusAccepted, AcceptedAt: &now}).Error; err != nil {
+		t.Fatalf("create contact: %v", err)
+	}
+
+	for _, visibility := range []string{models.LastSeenEveryone, models.LastSeenContacts, models.LastSeenNobody} {
+		users := []models.User{*viewer, *contact, *stranger}
+		for i := range users {
+			users[i].LastSeenVisibility = visibility
+			users[i].LastSeen = &now
+		}
+
+		responses, err := User.PublicResponses(ctx, viewer.ID, users)
+		if err != nil {
+			t.Fatalf("PublicResponses: %v", err)
+		}
+		for i := range users {
+			user := &users[i]
+			canSee := User.CanSeeLastSeen(ctx, viewer.ID, user)
+			want := lastSeenVisible(viewer.ID, user, user.ID == contact.ID)
+			if canSee != want {
+				t.Errorf("%s: CanSeeLastSeen(%s) = %v, want %v", visibility, user.Username, canSee, want)
+			}
+			if shown := User.PublicResponse(ctx, viewer.ID, user).LastSeen != nil; shown != want {
+				t.Errorf("%s: PublicResponse shows last seen of %s = %v, want %v", visibility, user.Username, shown, want)
+			}
+			if shown := responses[user.ID].LastSeen != nil; shown != want {
+				t.Errorf("%s: PublicResponses shows last seen of %s = %v, want %v", visibility, user.Username, shown, want)
+			}
+		}
+	}
+}
+
+func TestGetLastSeenHonoursVisibility(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	owner, contact := testutil.CreateUser(t, "owner"), testutil.CreateUser(t, "contact")
+	stranger := testutil.CreateUser(t, "stranger")
+	now := time.Now()
+	if err := database.DB.Create(&models.Contact{UserID: contact.ID, ContactUserID: owner.ID, Status: models.ContactStatusAccepted, AcceptedAt: &now}).Error; err != nil {
+		t.Fatalf("create contact: %v", err)
+	}
+	if err := database.DB.Model(owner).Update("last_seen", now).Error; err != nil {
+		t.Fatalf("set last seen: %v", err)
+	}
+
+	tests := []struct {
+		visibility string
+		viewer     *models.User
+		want       bool
+	}{
+		{models.LastSeenEveryone, stranger, true},
+		{models.LastSeenEveryone, contact, true},
+		{models.LastSeenContacts, stranger, false},
+		{models.LastSeenContacts, contact, true},
+		{models.LastSeenNobody, contact, false},
+		{models.LastSeenNobody, owner, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.visibility+"/"+tt.viewer.Username, func(t *testing.T) {
+			if err := database.DB.Model(owner).Update("last_seen_visibility", tt.visibility).Error; err != nil {
+				t.Fatalf("set visibility: %v", err)
+			}
+
+			response, err := User.GetLastSeen(ctx, tt.viewer.ID, owner.ID)
+			if err != nil {
+				t.Fatalf("GetLastSeen: %v", err)
+			}
+			if shown := response.LastSeen != nil; shown != tt.want {
+				t.Fatalf("last seen shown = %v, want %v", shown, tt.want)
+			}
+			if tt.want && !response.LastSeen.Equal(now) {
+				t.Fatalf("last seen %v, want %v", response.LastSeen, now)
+			}
+		})
+	}
+
+	if _, err := User.GetLastSeen(ctx, stranger.ID, 9999); !errors.Is(err, errs.ErrUserNotFound) {
+		t.Fatalf("unknown user: err = %v, want %v", err, errs.ErrUserNotFound)
+	}
+}
+
+// fakeMailer hands sent emails to the test
+type fakeMailer chan mail.Message
+
+func (m fakeMailer) Send(msg mail.Message) error {
+	m <- msg
+	return nil
+}
+
+// useFakeMailer makes the user service send emails to the returned mailer
+// for the duration of the test
+func useFakeMailer(t *testing.T) fakeMailer {
+	t.Helper()
+
+	mailer := make(fakeMailer, 1)
+	prev := User.mailer
+	User.UseMailer(mailer)
+	t.Cleanup(func() { User.UseMailer(prev) })
+	return mailer
+}
+
+// passwordOf reloads the user's stored password hash
+func passwordOf(t *testing.T, user *models.User) string {
+	t.Helper()
+
+	var stored models.User
+	if err := database.DB.First(&stored, user.ID).Error; err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	return stored.Password
+}
+
+func TestResetPasswordWithEmailedToken(t *testing.T) {
+	testutil.Setup(t)
+	config.Config.Auth.PasswordResetURL = "https://app.example.com/reset"
+	mailer := useFakeMailer(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+
+	if err := User.ForgotPassword(ctx, alice.Email); err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	var msg mail.Message
+	select {
+	case msg = <-mailer:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reset email sent")
+	}
+	match := regexp.MustCompile(`\?token=([0-9a-f]+)`).FindStringSubmatch(msg.Body)
+	if msg.To != alice.Email || match == nil {
+		t.Fatalf("sent %+v, want a reset link to %s", msg, alice.Email)
+	}
+
+	if err := User.ResetPassword(ctx, match[1], "new-password"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+	if !utils.CheckPassword(passwordOf(t, alice), "new-password") {
+		t.Fatal("password was not changed")
+	}
+
+	// A token works once
+	if err := User.ResetPassword(ctx, match[1], "another-password"); !errors.Is(err, errs.ErrInvalidResetToken) {
+		t.Fatalf("reused token: err = %v, want %v", err, errs.ErrInvalidResetToken)
+	}
+	if !utils.CheckPassword(passwordOf(t, alice), "new-password") {
+		t.Fatal("reused token changed the password")
+	}
+}
+
+func TestResetPasswordWithExpiredToken(t *testing.T) {
+	mr := testutil.Setup(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	before := passwordOf(t, alice)
+
+	if err := redis.StorePasswordResetToken(alice.ID, "expired-token", time.Minute); err != nil {
+		t.Fatalf("StorePasswordResetToken: %v", err)
+	}
+	mr.FastForward(2 * time.Minute)
+
+	if err := User.ResetPassword(ctx, "expired-token", "new-password"); !errors.Is(err, errs.ErrInvalidResetToken) {
+		t.Fatalf("expired token: err = %v, want %v", err, errs.ErrInvalidResetToken)
+	}
+	if passwordOf(t, alice) != before {
+		t.Fatal("expired token changed the password")
+	}
+}
+
+func TestResetPasswordWithUnknownToken(t *testing.T) {
+	testutil.Setup(t)
+
+	if err := User.ResetPassword(context.Background(), "made-up", "new-password"); !errors.Is(err, errs.ErrInvalidResetToken) {
+		t.Fatalf("unknown token: err = %v, want %v", err, errs.ErrInvalidResetToken)
+	}
+}
+
+// usernames lists the usernames of a page of search results
+func usernames(users []models.UserResponse) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names
+}
+
+func TestSearchUsersExcludesTheCaller(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	for _, name := range []string{"malice", "alicia", "bob"} {
+		testutil.CreateUser(t, name)
+	}
+
+	users, total, err := User.SearchUsers(ctx, alice.ID, "ALI", 10, 0)
+	if err != nil {
+		t.Fatalf("SearchUsers: %v", err)
+	}
+	// Usernames starting with the query come first
+	if got := strings.Join(usernames(users), ","); got != "alicia,malice" || total != 2 {
+		t.Fatalf("found %s (total %d), want alicia,malice without the caller", got, total)
+	}
+
+	page, total, err := User.SearchUsers(ctx, alice.ID, "ali", 1, 1)
+	if err != nil {
+		t.Fatalf("SearchUsers: %v", err)
+	}
+	if got := strings.Join(usernames(page), ","); got != "malice" || total != 2 {
+		t.Fatalf("second page %s (total %d), want malice of 2", got, total)
+	}
+}
+
+func TestSearchUsersMatchesWildcardsLiterally(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	viewer := testutil.CreateUser(t, "viewer")
+	for _, name := range []string{"a_b", "axb", "100%", "1000", `back\slash`, "backslash"} {
+		testutil.CreateUser(t, name)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"a_b", "a_b"},
+		{"_", "a_b"},
+		{"100%", "100%"},
+		{"%", "100%"},
+		{`k\s`, `back\slash`},
+	}
+	for _, tt := range tests {
+		users, total, err := User.SearchUsers(ctx, viewer.ID, tt.query, 10, 0)
+		if err != nil {
+			t.Fatalf("SearchUsers(%q): %v", tt.query, err)
+		}
+		if got := strings.Join(usernames(users), ","); got != tt.want || total != 1 {
+			t.Errorf("SearchUsers(%q) found %s (total %d), want only %s", tt.query, got, total, tt.want)
+		}
+	}
+
+	if _, _, err := User.SearchUsers(ctx, viewer.ID, "   ", 10, 0); err == nil {
+		t.Error("blank query was searched")
+	}
+}
+
+func TestSetAvatarReleasesTheReplacedUpload(t *testing.T) {
+	testutil.Setup(t)
+	store := useMemoryStorage(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+
+	first, err := User.SetAvatar(ctx, alice.ID, formFile(t, "me.png", "image/png", pngImage(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("SetAvatar: %v", err)
+	}
+	var firstFile models.File
+	if err := database.DB.Where("url = ?", first.Avatar).First(&firstFile).Error; err != nil {
+		t.Fatalf("load first avatar: %v", err)
+	}
+
+	second, err := User.SetAvatar(ctx, alice.ID, formFile(t, "me-again.png", "image/png", pngImage(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("SetAvatar: %v", err)
+	}
+	if second.Avatar == first.Avatar {
+		t.Fatal("second upload did not replace the avatar")
+	}
+	if _, err := store.Open(firstFile.Path); err == nil {
+		t.Fatal("replaced avatar is still stored")
+	}
+	if n := testutil.CountRows(t, &models.File{}); n != 1 {
+		t.Fatalf("%d file rows, want only the current avatar", n)
+	}
+
+	// Switching to a linked avatar releases the upload; the link itself is
+	// not a file to release
+	external := "https://cdn.example.com/alice.png"
+	if _, err := User.UpdateProfile(ctx, alice.ID, UpdateProfileRequest{Avatar: &external}); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if n := testutil.CountRows(t, &models.File{}); n != 0 {
+		t.Fatalf("%d file rows after linking an avatar, want none", n)
+	}
+	other := "https://cdn.example.com/alice-2.png"
+	if _, err := User.UpdateProfile(ctx, alice.ID, UpdateProfileRequest{Avatar: &other}); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	// Only images, and within the avatar limit
+	config.Config.Files.MaxAvatarSize = 64
+	if _, err := User.SetAvatar(ctx, alice.ID, formFile(t, "big.png", "image/png", pngImage(t, 512, 512))); err == nil {
+		t.Fatal("avatar over the size limit was accepted")
+	}
+	if _, err := User.SetAvatar(ctx, alice.ID, formFile(t, "me.png", "image/png", []byte("plain text"))); !errors.Is(err, errs.ErrNotAnImage) {
+		t.Fatalf("text avatar: err = %v, want %v", err, errs.ErrNotAnImage)
+	}
+}
+
+func TestAvatarOfAnotherUserIsNeverReleased(t *testing.T) {
+	testutil.Setup(t)
+	store := useMemoryStorage(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	bob := testutil.CreateUser(t, "bob")
+	group := testutil.CreateGroup(t, bob)
+
+	aliceProfile, err := User.SetAvatar(ctx, alice.ID, formFile(t, "me.png", "image/png", pngImage(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("SetAvatar: %v", err)
+	}
+	var aliceFile models.File
+	if err := database.DB.Where("url = ?", aliceProfile.Avatar).First(&aliceFile).Error; err != nil {
+		t.Fatalf("load alice's avatar: %v", err)
+	}
+
+	// Bob cannot point his profile or his group at Alice's upload
+	if _, err := User.UpdateProfile(ctx, bob.ID, UpdateProfileRequest{Avatar: &aliceFile.URL}); !errors.Is(err, errs.ErrAvatarNotOwned) {
+		t.Fatalf("UpdateProfile with alice's avatar: err = %v, want %v", err, errs.ErrAvatarNotOwned)
+	}
+	if err := Group.UpdateGroup(ctx, group.ID, bob.ID, map[string]interface{}{"avatar": aliceFile.URL}); !errors.Is(err, errs.ErrAvatarNotOwned) {
+		t.Fatalf("UpdateGroup with alice's avatar: err = %v, want %v", err, errs.ErrAvatarNotOwned)
+	}
+
+	// Even when the URL got there anyway, clearing it or deleting the group
+	// leaves Alice's upload alone
+	if err := database.DB.Model(&models.User{}).Where("id = ?", bob.ID).Update("avatar", aliceFile.URL).Error; err != nil {
+		t.Fatalf("point bob's avatar at alice's: %v", err)
+	}
+	if err := database.DB.Model(&models.Group{}).Where("id = ?", group.ID).Update("avatar", aliceFile.URL).Error; err != nil {
+		t.Fatalf("point the group avatar at alice's: %v", err)
+	}
+	cleared := ""
+	if _, err := User.UpdateProfile(ctx, bob.ID, UpdateProfileRequest{Avatar: &cleared}); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if err := Group.DeleteGroup(ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+
+	if _, err := store.Open(aliceFile.Path); err != nil {
+		t.Fatalf("alice's avatar is no longer stored: %v", err)
+	}
+	if n := testutil.CountRows(t, &models.File{}); n != 1 {
+		t.Fatalf("%d file rows, want alice's avatar", n)
+	}
+}
+
+// withPassword stores the hash of password as the user's password
+func withPassword(t *testing.T, user *models.User, password string) {
+	t.Helper()
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	if err := database.DB.Model(user).Update("password", hash).Error; err != nil {
+		t.Fatalf("set password: %v", err)
+	}
+}
+
+func TestDeleteAccountOfAGroupOwner(t *testing.T) {
+	mr := testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	withPassword(t, alice, "secret")
+
+	// Carol joined after bob but is an admin, so carol takes over
+	shared := testutil.CreateGroup(t, alice, bob)
+	testutil.AddMember(t, shared, carol, models.GroupRoleAdmin)
+	solo := testutil.CreateGroup(t, alice)
+	if _, err := Chat.SendGroupMessage(ctx, alice.ID, SendGroupMessageRequest{GroupID: shared.ID, Content: "bye"}); err != nil {
+		t.Fatalf("SendGroupMessage: %v", err)
+	}
+	bobEvents, carolEvents := testutil.Subscribe(t, bob.ID), testutil.Subscribe(t, carol.ID)
+
+	if err := User.DeleteAccount(ctx, alice.ID, "wrong"); !errors.Is(err, errs.ErrWrongPassword) {
+		t.Fatalf("wrong password: err = %v, want %v", err, errs.ErrWrongPassword)
+	}
+	if testutil.CountRows(t, &models.User{}) != 3 {
+		t.Fatal("account deleted with a wrong password")
+	}
+
+	if err := User.DeleteAccount(ctx, alice.ID, "secret"); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+
+	var group models.Group
+	if err := database.DB.First(&group, shared.ID).Error; err != nil {
+		t.Fatalf("load shared group: %v", err)
+	}
+	if group.OwnerID != carol.ID || roleOf(t, shared, carol) != models.GroupRoleAdmin {
+		t.Fatalf("shared group owned by %d, want carol (%d) as admin", group.OwnerID, carol.ID)
+	}
+	if isMember(t, shared, alice) {
+		t.Fatal("deleted owner is still a member")
+	}
+	if ev := nextEventNamed(t, carolEvents, "group_updated"); uint(ev.Data["owner_id"].(float64)) != carol.ID {
+		t.Fatalf("carol got %+v, want the new owner announced", ev.Data)
+	}
+
+	// No one was left to take over the other group
+	var left int64
+	if err := database.DB.Unscoped().Model(&models.Group{}).Where("id = ?", solo.ID).Count(&left).Error; err != nil {
+		t.Fatalf("count groups: %v", err)
+	}
+	if left != 0 {
+		t.Fatal("group without other members was not deleted")
+	}
+
+	if n := testutil.CountRows(t, &models.GroupMessage{}); n != 0 {
+		t.Fatalf("%d group message(s) of the deleted user left", n)
+	}
+	if ev := nextEventNamed(t, bobEvents, "user_deleted"); uint(ev.Data["user_id"].(float64)) != alice.ID {
+		t.Fatalf("bob got %+v, want alice's user_deleted", ev.Data)
+	}
+	if !mr.Exists("revoked:user:" + fmt.Sprint(alice.ID)) {
+		t.Fatal("tokens of the deleted user were not revoked")
+	}
+
+	// The row is anonymized, so the username is free again
+	testutil.CreateUser(t, "alice")
+}
+
+func TestDeleteAccountOfAGroupMember(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	withPassword(t, carol, "secret")
+	group := testutil.CreateGroup(t, alice, bob, carol)
+	for _, sender := range []*models.User{alice, carol} {
+		if _, err := Chat.SendGroupMessage(ctx, sender.ID, SendGroupMessageRequest{GroupID: group.ID, Content: "hi"}); err != nil {
+			t.Fatalf("SendGroupMessage: %v", err)
+		}
+	}
+	if _, err := Chat.SendPrivateMessage(ctx, carol.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "psst"}); err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+	aliceEvents, bobEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID)
+
+	if err := User.DeleteAccount(ctx, carol.ID, "secret"); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+
+	// The group carries on without the member
+	var stored models.Group
+	if err := database.DB.First(&stored, group.ID).Error; err != nil {
+		t.Fatalf("load group: %v", err)
+	}
+	if stored.OwnerID != alice.ID || !isMember(t, group, bob) || isMember(t, group, carol) {
+		t.Fatal("deleting a member changed the group beyond their membership")
+	}
+	var senders []uint
+	if err := database.DB.Model(&models.GroupMessage{}).Pluck("sender_id", &senders).Error; err != nil {
+		t.Fatalf("load messages: %v", err)
+	}
+	if len(senders) != 1 || senders[0] != alice.ID {
+		t.Fatalf("group messages left from %v, want only alice's", senders)
+	}
+	if n := testutil.CountRows(t, &models.PrivateMessage{}); n != 0 {
+		t.Fatalf("%d private message(s) with the deleted user left", n)
+	}
+
+	for _, events := range []*goredis.PubSub{aliceEvents, bobEvents} {
+		if ev := nextEventNamed(t, events, "user_deleted"); uint(ev.Data["user_id"].(float64)) != carol.ID {
+			t.Fatalf("got %+v, want carol's user_deleted", ev.Data)
+		}
+	}
+
+	if err := User.DeleteAccount(ctx, carol.ID, "secret"); !errors.Is(err, errs.ErrUserNotFound) {
+		t.Fatalf("deleting twice: err = %v, want %v", err, errs.ErrUserNotFound)
+	}
+}
+
+func TestContactRequestLifecycle(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice, bob, carol := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol")
+	aliceEvents, bobEvents := testutil.Subscribe(t, alice.ID), testutil.Subscribe(t, bob.ID)
+
+	if _, err := User.SendContactRequest(ctx, alice.ID, alice.ID); !errors.Is(err, errs.ErrSelfContact) {
+		t.Fatalf("request to oneself: err = %v, want %v", err, errs.ErrSelfContact)
+	}
+	if _, err := User.SendContactRequest(ctx, alice.ID, carol.ID+100); !errors.Is(err, errs.ErrUserNotFound) {
+		t.Fatalf("request to an unknown user: err = %v, want %v", err, errs.ErrUserNotFound)
+	}
+
+	sent, err := User.SendContactRequest(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("SendContactRequest: %v", err)
+	}
+	if sent.Status != models.ContactStatusPending || sent.Direction != "outgoing" || sent.User.ID != bob.ID {
+		t.Fatalf("request %+v, want a pending outgoing request to bob", sent)
+	}
+	if ev := nextEventNamed(t, bobEvents, "contact_request"); ev.Data["user"].(map[string]interface{})["id"] != float64(alice.ID) {
+		t.Fatalf("bob told %+v, want alice's request", ev.Data)
+	}
+	if _, err := User.SendContactRequest(ctx, alice.ID, bob.ID); !errors.Is(err, errs.ErrContactPending) {
+		t.Fatalf("duplicate request: err = %v, want %v", err, errs.ErrContactPending)
+	}
+
+	// Each side sees the request from their end; it is not yet a contact
+	if pending, err := User.ListContacts(ctx, bob.ID, models.ContactStatusPending); err != nil || len(pending) != 1 || pending[0].Direction != "incoming" {
+		t.Fatalf("bob's pending requests %+v, %v; want alice's incoming one", pending, err)
+	}
+	if contacts, err := User.ListContacts(ctx, alice.ID, ""); err != nil || len(contacts) != 0 {
+		t.Fatalf("alice's contacts %+v, %v; want none before bob accepts", contacts, err)
+	}
+	if User.IsContact(ctx, alice.ID, bob.ID) {
+		t.Fatal("a pending request counts as a contact")
+	}
+
+	// Only the recipient can accept
+	if _, err := User.AcceptContactRequest(ctx, alice.ID, bob.ID); !errors.Is(err, errs.ErrContactNotFound) {
+		t.Fatalf("requester accepting: err = %v, want %v", err, errs.ErrContactNotFound)
+	}
+	accepted, err := User.AcceptContactRequest(ctx, bob.ID, alice.ID)
+	if err != nil || accepted.Status != models.ContactStatusAccepted || accepted.AcceptedAt == nil {
+		t.Fatalf("AcceptContactRequest = %+v, %v; want an accepted contact", accepted, err)
+	}
+	if ev := nextEventNamed(t, aliceEvents, "contact_accepted"); ev.Data["user"].(map[string]interface{})["id"] != float64(bob.ID) {
+		t.Fatalf("alice told %+v, want bob's acceptance", ev.Data)
+	}
+	if _, err := User.AcceptContactRequest(ctx, bob.ID, alice.ID); !errors.Is(err, errs.ErrAlreadyContact) {
+		t.Fatalf("accepting twice: err = %v, want %v", err, errs.ErrAlreadyContact)
+	}
+	if _, err := User.SendContactRequest(ctx, bob.ID, alice.ID); !errors.Is(err, errs.ErrAlreadyContact) {
+		t.Fatalf("request to a contact: err = %v, want %v", err, errs.ErrAlreadyContact)
+	}
+	for _, user := range []*models.User{alice, bob} {
+		if ids, err := User.AcceptedContactIDs(ctx, user.ID); err != nil || len(ids) != 1 {
+			t.Fatalf("%s's contacts %v, %v; want just the other", user.Username, ids, err)
+		}
+	}
+
+	// Asking someone who already asked accepts their request
+	if _, err := User.SendContactRequest(ctx, carol.ID, alice.ID); err != nil {
+		t.Fatalf("SendContactRequest: %v", err)
+	}
+	if crossed, err := User.SendContactRequest(ctx, alice.ID, carol.ID); err != nil || crossed.Status != models.ContactStatusAccepted {
+		t.Fatalf("crossed request = %+v, %v; want it accepted", crossed, err)
+	}
+
+	// Either side can remove a contact, and both are told
+	if err := User.RemoveContact(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveContact: %v", err)
+	}
+	for _, events := range []*goredis.PubSub{aliceEvents, bobEvents} {
+		nextEventNamed(t, events, "contact_removed")
+	}
+	if User.IsContact(ctx, bob.ID, alice.ID) {
+		t.Fatal("removed contact is still a contact")
+	}
+	if err := User.RemoveContact(ctx, bob.ID, alice.ID); !errors.Is(err, errs.ErrContactNotFound) {
+		t.Fatalf("removing twice: err = %v, want %v", err, errs.ErrContactNotFound)
+	}
+
+	// A declined request can be sent again
+	if _, err := User.SendContactRequest(ctx, bob.ID, carol.ID); err != nil {
+		t.Fatalf("SendContactRequest: %v", err)
+	}
+	if err := User.RemoveContact(ctx, carol.ID, bob.ID); err != nil {
+		t.Fatalf("declining: %v", err)
+	}
+	if _, err := User.SendContactRequest(ctx, bob.ID, carol.ID); err != nil {
+		t.Fatalf("request after a decline: %v", err)
+	}
+}
+
+func TestGetOnlineUsersWithoutLocalConnections(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	viewer, stranger := testutil.CreateUser(t, "viewer"), testutil.CreateUser(t, "stranger")
+
+	// Ten contacts, all connected to other instances; the odd ones online
+	now := time.Now()
+	var online []*models.User
+	for i := 0; i < 10; i++ {
+		contact := testutil.CreateUser(t, fmt.Sprintf("contact%d", i))
+		if err := database.DB.Create(&models.Contact{UserID: viewer.ID, ContactUserID: contact.ID, Status: models.ContactStatusAccepted, AcceptedAt: &now}).Error; err != nil {
+			t.Fatalf("create contact: %v", err)
+		}
+		if i%2 == 1 {
+			if err := redis.SetUserOnline(contact.ID, fmt.Sprintf("instance-%d", i)); err != nil {
+				t.Fatalf("SetUserOnline: %v", err)
+			}
+			online = append(online, contact)
+		}
+	}
+	if err := redis.SetUserOnline(stranger.ID, "instance-x"); err != nil {
+		t.Fatalf("SetUserOnline: %v", err)
+	}
+	// Invisible users look offline
+	if err := redis.SetPresenceStatus(online[0].ID, string(models.PresenceInvisible), false); err != nil {
+		t.Fatalf("SetPresenceStatus: %v", err)
+	}
+
+	var users []models.UserResponse
+	queries := countQueries(t, func() {
+		var err error
+		if users, err = User.GetOnlineUsers(ctx, viewer.ID); err != nil {
+			t.Fatalf("GetOnlineUsers: %v", err)
+		}
+	})
+	// The contacts, each way, and one fetch of the users
+	if queries > 3 {
+		t.Errorf("GetOnlineUsers ran %d queries for %d users, want at most 3", queries, len(users))
+	}
+
+	got := usernames(users)
+	sort.Strings(got)
+	want := []string{"contact3", "contact5", "contact7", "contact9"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("online users %v, want the visible contacts online elsewhere %v", got, want)
+	}
+}
+
+func TestRefreshRotatesTheRefreshToken(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	withPassword(t, alice, "correct horse")
+
+	login, err := User.Login(ctx, LoginRequest{Email: alice.Email, Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	refreshed, err := User.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if claims, err := utils.ValidateToken(refreshed.Token); err != nil || claims.UserID != alice.ID {
+		t.Fatalf("refreshed access token: %+v, %v; want alice's", claims, err)
+	}
+	if refreshed.RefreshToken == login.RefreshToken || refreshed.User.ID != alice.ID {
+		t.Fatalf("Refresh = %+v, want a new refresh token for alice", refreshed)
+	}
+
+	// Each refresh token works once
+	if _, err := User.Refresh(ctx, login.RefreshToken); !errors.Is(err, errs.ErrRefreshTokenRevoked) {
+		t.Fatalf("reused refresh token: err = %v, want %v", err, errs.ErrRefreshTokenRevoked)
+	}
+	if _, err := User.Refresh(ctx, refreshed.RefreshToken); err != nil {
+		t.Fatalf("rotated refresh token: %v", err)
+	}
+
+	// Access tokens are not refresh tokens
+	if _, err := User.Refresh(ctx, login.Token); !errors.Is(err, errs.ErrInvalidRefreshToken) {
+		t.Fatalf("access token: err = %v, want %v", err, errs.ErrInvalidRefreshToken)
+	}
+}
+
+func TestChangePasswordRevokesTokensOfTheSameSecond(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	withPassword(t, alice, "correct horse")
+
+	login, err := User.Login(ctx, LoginRequest{Email: alice.Email, Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	changed, err := User.ChangePassword(ctx, alice.ID, "correct horse", "battery staple")
+	if err != nil {
+		t.Fatalf("ChangePassword: %v", err)
+	}
+
+	revoked := func(token string) bool {
+		t.Helper()
+		claims, err := utils.ValidateToken(token)
+		if err != nil {
+			t.Fatalf("ValidateToken: %v", err)
+		}
+		revoked, err := redis.IsTokenRevoked(claims.UserID, claims.ID, claims.IssuedAtMicro())
+		if err != nil {
+			t.Fatalf("IsTokenRevoked: %v", err)
+		}
+		return revoked
+	}
+
+	// Both tokens are minted within the same second of the change
+	if !revoked(login.Token) {
+		t.Fatal("token from before the change still works")
+	}
+	if revoked(changed.Token) {
+		t.Fatal("token issued by the change is revoked")
+	}
+}
+
+func TestRefreshCarriesTheCurrentProfile(t *testing.T) {
+	testutil.Setup(t)
+	ctx := context.Background()
+	alice := testutil.CreateUser(t, "alice")
+	withPassword(t, alice, "correct horse")
+
+	login, err := User.Login(ctx, LoginRequest{Email: alice.Email, Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := database.GetDB().Model(alice).Updates(map[string]interface{}{
+		"username": "alice2", "email": "alice2@example.com",
+	}).Error; err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	refreshed, err := User.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	claims, err := utils.ValidateToken(refreshed.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.Username != "alice2" || claims.Email != "alice2@example.com" {
+		t.Fatalf("refreshed token names %s <%s>, want alice2 <alice2@example.com>", claims.Username, claims.Email)
+	}
+}
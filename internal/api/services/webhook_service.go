@@ -0,0 +1,303 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/models/errs"
+	"web-api/internal/pkg/netguard"
+	"web-api/internal/pkg/webhook"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// maxWebhooksPerUser bounds the webhooks one user can register
+const maxWebhooksPerUser = 10
+
+// WebhookService manages webhooks and feeds events to their dispatcher
+type WebhookService struct {
+	dispatcher *webhook.Dispatcher
+}
+
+var Webhook = &WebhookService{}
+
+// CreateWebhookRequest registers a webhook. A secret is generated when
+// none is given.
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events" binding:"required,min=1"`
+	Secret string   `json:"secret"`
+}
+
+// UpdateWebhookRequest changes the given fields of a webhook
+type UpdateWebhookRequest struct {
+	URL    *string  `json:"url" binding:"omitempty,url"`
+	Events []string `json:"events"`
+	Secret *string  `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	Event     string                 `json:"event"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// UseDispatcher sets the dispatcher events are handed to; nil disables
+// delivery
+func (s *WebhookService) UseDispatcher(dispatcher *webhook.Dispatcher) {
+	s.dispatcher = dispatcher
+}
+
+// CreateWebhook registers a webhook for the user
+func (s *WebhookService) CreateWebhook(userID uint, req CreateWebhookRequest) (*models.Webhook, error) {
+	if err := validateWebhookURL(req.URL); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	var count int64
+	if err := db.Model(&models.Webhook{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= maxWebhooksPerUser {
+		return nil, fmt.Errorf("you can register at most %d webhooks", maxWebhooksPerUser)
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	hook := models.Webhook{
+		UserID: userID,
+		URL:    req.URL,
+		Secret: secret,
+		Events: req.Events,
+		Active: true,
+	}
+	if err := db.Create(&hook).Error; err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// GetWebhooks lists the user's webhooks
+func (s *WebhookService) GetWebhooks(userID uint) ([]models.Webhook, error) {
+	var hooks []models.Webhook
+	err := database.GetDB().Where("user_id = ?", userID).Order("id").Find(&hooks).Error
+	return hooks, err
+}
+
+// GetWebhook returns one of the user's webhooks
+func (s *WebhookService) GetWebhook(userID, webhookID uint) (*models.Webhook, error) {
+	var hook models.Webhook
+	if err := database.GetDB().Where("id = ? AND user_id = ?", webhookID, userID).First(&hook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errs.ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// UpdateWebhook changes one of the user's webhooks
+func (s *WebhookService) UpdateWebhook(userID, webhookID uint, req UpdateWebhookRequest) (*models.Webhook, error) {
+	hook, err := s.GetWebhook(userID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL != nil {
+		if err := validateWebhookURL(*req.URL); err != nil {
+			return nil, err
+		}
+		hook.URL = *req.URL
+	}
+	if req.Events != nil {
+		if err := validateWebhookEvents(req.Events); err != nil {
+			return nil, err
+		}
+		hook.Events = req.Events
+	}
+	if req.Secret != nil {
+		if *req.Secret == "" {
+			return nil, errors.New("secret cannot be empty")
+		}
+		hook.Secret = *req.Secret
+	}
+	if req.Active != nil {
+		hook.Active = *req.Active
+	}
+
+	if err := database.GetDB().Save(hook).Error; err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// DeleteWebhook removes one of the user's webhooks and its dead letters
+func (s *WebhookService) DeleteWebhook(userID, webhookID uint) error {
+	hook, err := s.GetWebhook(userID, webhookID)
+	if err != nil {
+		return err
+	}
+
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDeadLetter{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+}
+
+// GetDeadLetters lists the most recent deliveries to one of the user's
+// webhooks that failed every attempt
+func (s *WebhookService) GetDeadLetters(userID, webhookID uint, limit int) ([]models.WebhookDeadLetter, error) {
+	if _, err := s.GetWebhook(userID, webhookID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var letters []models.WebhookDeadLetter
+	err := database.GetDB().
+		Where("webhook_id = ?", webhookID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&letters).Error
+	return letters, err
+}
+
+// Emit queues an event for the active webhooks of the given users that
+// subscribe to it. It returns immediately, so it is safe to call from the
+// hub.
+func (s *WebhookService) Emit(event string, userIDs []uint, data map[string]interface{}) {
+	s.emit(event, func() ([]uint, error) { return userIDs, nil }, data)
+}
+
+// EmitToGroup queues an event for the webhooks of a group's members
+func (s *WebhookService) EmitToGroup(event string, groupID uint, data map[string]interface{}) {
+	s.emit(event, func() ([]uint, error) { return Group.getMemberIDs(context.Background(), groupID) }, data)
+}
+
+// emit resolves the webhook owners and queues the deliveries in the
+// background
+func (s *WebhookService) emit(event string, owners func() ([]uint, error), data map[string]interface{}) {
+	if s.dispatcher == nil {
+		return
+	}
+	createdAt := time.Now()
+
+	go func() {
+		userIDs, err := owners()
+		if err != nil {
+			logrus.Errorf("Failed to resolve webhook owners for %s: %v", event, err)
+			return
+		}
+		if len(userIDs) == 0 {
+			return
+		}
+
+		var hooks []models.Webhook
+		if err := database.GetDB().
+			Where("user_id IN ? AND active = ?", userIDs, true).
+			Find(&hooks).Error; err != nil {
+			logrus.Errorf("Failed to load webhooks for %s: %v", event, err)
+			return
+		}
+
+		var body []byte
+		for _, hook := range hooks {
+			if !hook.Subscribes(event) {
+				continue
+			}
+
+			if body == nil {
+				body, err = json.Marshal(WebhookPayload{Event: event, CreatedAt: createdAt, Data: data})
+				if err != nil {
+					logrus.Errorf("Failed to marshal %s webhook payload: %v", event, err)
+					return
+				}
+			}
+
+			delivery := webhook.Delivery{
+				ID:        uuid.New().String(),
+				WebhookID: hook.ID,
+				URL:       hook.URL,
+				Secret:    hook.Secret,
+				Event:     event,
+				Body:      body,
+			}
+			if err := s.dispatcher.Enqueue(delivery); err != nil {
+				s.DeadLetter(delivery, err)
+			}
+		}
+	}()
+}
+
+// DeadLetter stores a delivery that will not be retried
+func (s *WebhookService) DeadLetter(d webhook.Delivery, err error) {
+	letter := models.WebhookDeadLetter{
+		WebhookID:  d.WebhookID,
+		DeliveryID: d.ID,
+		Event:      d.Event,
+		Payload:    string(d.Body),
+		Attempts:   d.Attempts,
+		LastError:  err.Error(),
+	}
+	if dbErr := database.GetDB().Create(&letter).Error; dbErr != nil {
+		logrus.Errorf("Failed to store dead letter of webhook %d: %v", d.WebhookID, dbErr)
+	}
+}
+
+// validateWebhookURL only accepts absolute http(s) URLs whose host is not
+// an internal address. Hostnames are checked again by the dispatcher every
+// time it connects.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("url must be an http or https URL")
+	}
+	if err := netguard.CheckURL(u); err != nil {
+		if errors.Is(err, netguard.ErrForbiddenAddress) {
+			return errors.New("url must point to a public address")
+		}
+		return errors.New("url must be an http or https URL")
+	}
+	return nil
+}
+
+// validateWebhookEvents rejects unknown or missing events
+func validateWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return errors.New("events cannot be empty")
+	}
+	for _, event := range events {
+		if !models.IsValidWebhookEvent(event) {
+			return fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+	return nil
+}
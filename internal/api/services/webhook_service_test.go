@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/testutil"
+	"web-api/internal/pkg/webhook"
+)
+
+// hookRequest is a delivery a test receiver got
+type hookRequest struct {
+	body      []byte
+	event     string
+	signature string
+}
+
+// hookReceiver starts an endpoint that hands every request to the test.
+// Its URL names loopback as localhost: literal internal addresses are
+// refused when a webhook is registered, names only when they are dialled,
+// which the dispatcher of useDispatcher lets through.
+func hookReceiver(t *testing.T) (chan hookRequest, string) {
+	t.Helper()
+
+	requests := make(chan hookRequest, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- hookRequest{body: body, event: r.Header.Get(webhook.EventHeader), signature: r.Header.Get(webhook.SignatureHeader)}
+	}))
+	t.Cleanup(srv.Close)
+	return requests, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+}
+
+// useDispatcher turns on webhook delivery for the test
+func useDispatcher(t *testing.T) {
+	t.Helper()
+
+	dispatcher := webhook.NewDispatcher(config.WebhookConfiguration{Workers: 1}, Webhook.DeadLetter)
+	dispatcher.UseClient(&http.Client{Timeout: time.Second})
+	dispatcher.Start()
+	Webhook.UseDispatcher(dispatcher)
+	t.Cleanup(func() { Webhook.UseDispatcher(nil) })
+}
+
+func TestWebhookReceivesSignedEvents(t *testing.T) {
+	testutil.Setup(t)
+	useDispatcher(t)
+	requests, url := hookReceiver(t)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	// Only the first webhook subscribes to new messages
+	if _, err := Webhook.CreateWebhook(bob.ID, CreateWebhookRequest{
+		URL: url + "/messages", Secret: "s3cret", Events: []string{models.WebhookEventMessageCreated},
+	}); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	if _, err := Webhook.CreateWebhook(bob.ID, CreateWebhookRequest{
+		URL: url + "/members", Secret: "other", Events: []string{models.WebhookEventMemberJoined},
+	}); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+
+	message, err := Chat.SendPrivateMessage(context.Background(), alice.ID, SendPrivateMessageRequest{ReceiverID: bob.ID, Content: "hook me"})
+	if err != nil {
+		t.Fatalf("SendPrivateMessage: %v", err)
+	}
+
+	var req hookRequest
+	select {
+	case req = <-requests:
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook got no delivery")
+	}
+	if !webhook.Verify("s3cret", req.body, req.signature) {
+		t.Fatalf("signature %q does not match the body under the webhook's secret", req.signature)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("decode payload %s: %v", req.body, err)
+	}
+	if req.event != models.WebhookEventMessageCreated || payload.Event != models.WebhookEventMessageCreated ||
+		uint(payload.Data["message_id"].(float64)) != message.ID {
+		t.Fatalf("delivery %s with %+v, want message_created for message %d", req.event, payload, message.ID)
+	}
+
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected delivery of %s", req.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRefusesInternalAddresses(t *testing.T) {
+	testutil.Setup(t)
+	bob := testutil.CreateUser(t, "bob")
+	events := []string{models.WebhookEventMessageCreated}
+
+	for _, url := range []string{
+		"http://127.0.0.1:6379/",
+		"http://[::1]/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/hook",
+	} {
+		if _, err := Webhook.CreateWebhook(bob.ID, CreateWebhookRequest{URL: url, Events: events}); err == nil {
+			t.Errorf("webhook to %s was registered", url)
+		}
+	}
+
+	hook, err := Webhook.CreateWebhook(bob.ID, CreateWebhookRequest{URL: "https://hooks.example.com/bob", Events: events})
+	if err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	loopback := "http://127.0.0.1:8080/"
+	if _, err := Webhook.UpdateWebhook(bob.ID, hook.ID, UpdateWebhookRequest{URL: &loopback}); err == nil {
+		t.Fatal("webhook was moved to loopback")
+	}
+}
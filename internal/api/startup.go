@@ -1,17 +1,35 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"web-api/internal/api/controllers"
 	"web-api/internal/api/routers"
+	"web-api/internal/api/services"
 	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/linkpreview"
+	"web-api/internal/pkg/mail"
+	"web-api/internal/pkg/metrics"
+	"web-api/internal/pkg/moderation"
+	"web-api/internal/pkg/push"
 	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/storage"
 	"web-api/internal/pkg/utils"
+	"web-api/internal/pkg/webhook"
 	"web-api/pkg/logger"
 )
 
+// shutdownTimeout bounds how long the server waits for clients on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func Run(configPath string) {
 	if configPath == "" {
 		configPath = "data/config.yml"
@@ -25,27 +43,80 @@ func Run(configPath string) {
 	cfg := config.GetConfig()
 	
 	// Initialize JWT secret
-	utils.SetJWTSecret(cfg.Server.Secret)
+	if err := utils.SetJWTSecrets(cfg.Server.Secret, cfg.Server.PreviousSecrets); err != nil {
+		logger.Fatalf("invalid server secret, %s", err)
+	}
+	utils.SetTokenLifetimes(cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
 
 	// Setup database
 	if err := database.Setup(); err != nil {
 		logger.Fatalf("failed to setup database, %s", err)
 	}
 
+	// Collect metrics, including database statement timings
+	metrics.Register()
+	if err := metrics.InstrumentDB(database.GetDB()); err != nil {
+		logger.Fatalf("failed to instrument database, %s", err)
+	}
+
 	// Setup Redis
-	redisConfig := redis.Config{
-		Host:     "redis", // Redis container hostname
-		Port:     "6379",
-		Password: "",
-		DB:       0,
+	redisConfig, err := loadRedisConfig(cfg)
+	if err != nil {
+		logger.Fatalf("invalid Redis configuration, %s", err)
 	}
 	if err := redis.Setup(redisConfig); err != nil {
 		logger.Fatalf("failed to setup Redis, %s", err)
 	}
 
+	// Setup file storage
+	store, err := storage.New(cfg.Storage, services.UploadDir)
+	if err != nil {
+		logger.Fatalf("failed to setup file storage, %s", err)
+	}
+	services.FileServ.UseStorage(store)
+
+	// Setup web push
+	sender, err := push.New(cfg.Push)
+	if err != nil {
+		logger.Fatalf("invalid push configuration, %s", err)
+	}
+	services.Push.UseSender(sender)
+
+	// Setup email for password resets
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		logger.Fatalf("invalid mail configuration, %s", err)
+	}
+	services.User.UseMailer(mailer)
+
+	// Filter message content
+	filter, err := moderation.New(cfg.Moderation)
+	if err != nil {
+		logger.Fatalf("invalid moderation configuration, %s", err)
+	}
+	services.Chat.UseContentFilter(filter)
+
+	// Deliver webhooks in the background
+	dispatcher := webhook.NewDispatcher(cfg.Webhook, services.Webhook.DeadLetter)
+	dispatcher.Start()
+	services.Webhook.UseDispatcher(dispatcher)
+
+	// Preview links shared in messages
+	services.LinkPreview.UseFetcher(linkpreview.NewFetcher(cfg.LinkPreview))
+
 	// Initialize WebSocket hub
 	controllers.InitWebSocketHub()
 
+	// Dependencies probed by the readiness check
+	services.Common.UseHealthCheck("database", database.Ping)
+	services.Common.UseHealthCheck("redis", redis.Ping)
+
+	// Mark calls nobody answered as missed
+	go services.Call.RunMissedCallSweeper()
+
+	// Remove disappearing messages once they expire
+	go services.Chat.RunExpiredMessageSweeper()
+
 	// Setup router
 	web := routers.Setup()
 	
@@ -59,5 +130,71 @@ func Run(configPath string) {
 	fmt.Println("   WebSocket: ws://localhost:" + cfg.Server.Port + "/ws")
 	fmt.Println("================================>")
 	
-	logger.Fatalf("%v", web.Run(":"+cfg.Server.Port))
+	srv := &http.Server{
+		Addr:    ":" + cfg.Server.Port,
+		Handler: web,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("%v", err)
+		}
+	}()
+
+	// Wait for an interrupt, then drain WebSocket clients before exiting
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logger.Infof("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Errorf("HTTP server shutdown: %v", err)
+	}
+	if err := controllers.Hub.Shutdown(ctx); err != nil {
+		logger.Errorf("WebSocket hub shutdown: %v", err)
+	}
+
+	logger.Infof("Server stopped")
+}
+
+// loadRedisConfig reads the Redis settings from the config file, lets the
+// environment override them and falls back to the Docker defaults
+func loadRedisConfig(cfg *config.Configuration) (redis.Config, error) {
+	redisConfig := redis.Config{
+		Host:     cfg.Redis.Host,
+		Port:     cfg.Redis.Port,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	}
+
+	env := config.LoadFileENV()
+	if env.REDIS_HOST != "" {
+		redisConfig.Host = env.REDIS_HOST
+	}
+	if env.REDIS_PORT != "" {
+		redisConfig.Port = env.REDIS_PORT
+	}
+	if env.REDIS_PASSWORD != "" {
+		redisConfig.Password = env.REDIS_PASSWORD
+	}
+	if env.REDIS_DB != "" {
+		db, err := strconv.Atoi(env.REDIS_DB)
+		if err != nil {
+			return redisConfig, fmt.Errorf("invalid REDIS_DB %q", env.REDIS_DB)
+		}
+		redisConfig.DB = db
+	}
+
+	if redisConfig.Host == "" {
+		redisConfig.Host = "redis" // Redis container hostname
+	}
+	if redisConfig.Port == "" {
+		redisConfig.Port = "6379"
+	}
+
+	return redisConfig, redisConfig.Validate()
 }
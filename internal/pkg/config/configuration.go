@@ -2,20 +2,57 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Configuration struct {
-	Server   ServerConfiguration
-	Cors     CorsConfiguration
-	Database DatabaseConfiguration
+	Server      ServerConfiguration
+	Cors        CorsConfiguration
+	Database    DatabaseConfiguration
+	Auth        AuthConfiguration
+	Redis       RedisConfiguration
+	Chat        ChatConfiguration
+	Call        CallConfiguration
+	Files       FileConfiguration
+	Storage     StorageConfiguration
+	Push        PushConfiguration
+	Mail        MailConfiguration
+	Moderation  ModerationConfiguration
+	Webhook     WebhookConfiguration
+	LinkPreview LinkPreviewConfiguration `mapstructure:"link_preview"`
+	Metrics     MetricsConfiguration
+	WebSocket   WebSocketConfiguration
+	RateLimit   RateLimitConfiguration `mapstructure:"rate_limit"`
 }
 
 type ServerConfiguration struct {
 	Port   string
 	Secret string
 	Mode   string
+
+	// Secrets tokens were signed with before Secret was rotated; tokens
+	// signed with them are accepted until they expire
+	PreviousSecrets []string `mapstructure:"previous_secrets"`
+
+	// Origins allowed to open WebSockets. Entries may be "*" or use a
+	// leading wildcard host such as "https://*.example.com". Falls back to
+	// Cors.Ips when empty.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// Accept WebSockets from any origin; for local development only
+	AllowAllOrigins bool `mapstructure:"allow_all_origins"`
+}
+
+type AuthConfiguration struct {
+	AccessTokenTTL  time.Duration `mapstructure:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `mapstructure:"refresh_token_ttl"`
+
+	// How long a password reset link stays valid
+	PasswordResetTTL time.Duration `mapstructure:"password_reset_ttl"`
+	// Page of the client that resets passwords; the emailed link is this URL
+	// with the reset token appended as the token query parameter
+	PasswordResetURL string `mapstructure:"password_reset_url"`
 }
 
 type CorsConfiguration struct {
@@ -32,6 +69,168 @@ type DatabaseConfiguration struct {
 	Port     string
 	Sslmode  bool
 	Logmode  bool
+
+	// How long the queries made for one request or WebSocket event may run
+	// before they are cancelled
+	QueryTimeout time.Duration `mapstructure:"query_timeout"`
+}
+
+type RedisConfiguration struct {
+	Host     string
+	Port     string
+	Password string
+	DB       int
+}
+
+type ChatConfiguration struct {
+	// How long after sending a message its sender may still edit it
+	EditWindow time.Duration `mapstructure:"edit_window"`
+	// Maximum message content length in bytes
+	MaxMessageLength int `mapstructure:"max_message_length"`
+	// Maximum number of pinned messages per group
+	MaxPinsPerGroup int `mapstructure:"max_pins_per_group"`
+	// Maximum number of members per group; groups may set a lower limit
+	MaxGroupMembers int `mapstructure:"max_group_members"`
+	// Messages one user may send within FloodWindow before having to wait
+	// FloodCooldown; a negative limit disables flood control
+	FloodLimit    int           `mapstructure:"flood_limit"`
+	FloodWindow   time.Duration `mapstructure:"flood_window"`
+	FloodCooldown time.Duration `mapstructure:"flood_cooldown"`
+}
+
+type ModerationConfiguration struct {
+	// File of words masked in, or rejecting, message content. An empty path
+	// disables the content filter.
+	WordList string `mapstructure:"word_list"`
+}
+
+type CallConfiguration struct {
+	// How long a call may ring unanswered before it is marked as missed
+	RingTimeout time.Duration `mapstructure:"ring_timeout"`
+}
+
+type FileConfiguration struct {
+	// Maximum upload size in bytes
+	MaxSize int64 `mapstructure:"max_size"`
+	// Maximum size in bytes of an image uploaded as an avatar
+	MaxAvatarSize int64 `mapstructure:"max_avatar_size"`
+	// MIME types accepted for upload, as detected from the file content
+	AllowedTypes []string `mapstructure:"allowed_types"`
+}
+
+type StorageConfiguration struct {
+	// Where uploaded files are kept: "local" (default) or "s3"
+	Driver string
+	Local  LocalStorageConfiguration
+	S3     S3Configuration
+}
+
+type LocalStorageConfiguration struct {
+	// Directory holding uploads; defaults to ./uploads
+	Root string
+}
+
+type S3Configuration struct {
+	// Host and optional port of an S3-compatible service, e.g. s3.amazonaws.com
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	UseSSL    bool   `mapstructure:"use_ssl"`
+}
+
+type PushConfiguration struct {
+	// VAPID key pair identifying this server to push services, base64url
+	// encoded. Web push is off while both are empty.
+	VAPIDPublicKey  string `mapstructure:"vapid_public_key"`
+	VAPIDPrivateKey string `mapstructure:"vapid_private_key"`
+	// Contact push services can reach the operator at, a mailto: or https: URL
+	Subject string
+	// How long push services keep a notification for an unreachable browser
+	TTL time.Duration
+}
+
+type MailConfiguration struct {
+	// SMTP relay; email, and with it password reset, is off while Host is
+	// empty
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// Sender address of outgoing emails
+	From string
+}
+
+type WebhookConfiguration struct {
+	// Deliveries sent concurrently, and how many may wait for a worker
+	Workers   int
+	QueueSize int `mapstructure:"queue_size"`
+	// Attempts before a delivery goes to the dead letters
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Wait before the first retry; it doubles with every further attempt
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	// How long one delivery attempt may take
+	Timeout time.Duration
+}
+
+type LinkPreviewConfiguration struct {
+	// How long fetching one page may take
+	Timeout time.Duration
+	// Bytes of a page read while looking for its metadata
+	MaxBodySize int64 `mapstructure:"max_body_size"`
+	// How long previews are cached per URL
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+}
+
+type MetricsConfiguration struct {
+	// Serve Prometheus metrics on /metrics
+	Enabled bool
+	// Bearer token scrapers must send; leave empty only when /metrics is
+	// not reachable from outside
+	Token string
+}
+
+type WebSocketConfiguration struct {
+	// How many undelivered events are kept for an offline user
+	PendingQueueSize int `mapstructure:"pending_queue_size"`
+
+	// Inbound messages per second allowed on one connection, and the burst
+	// on top of that
+	MessageRate  float64 `mapstructure:"message_rate"`
+	MessageBurst int     `mapstructure:"message_burst"`
+
+	// Inbound binary frames per second allowed on one connection, and the
+	// burst on top of that
+	BinaryRate  float64 `mapstructure:"binary_rate"`
+	BinaryBurst int     `mapstructure:"binary_burst"`
+
+	// Throttled messages tolerated before the connection is dropped
+	MaxRateViolations int `mapstructure:"max_rate_violations"`
+
+	// Inactivity after which an online user is shown as away
+	IdleAwayAfter time.Duration `mapstructure:"idle_away_after"`
+
+	// Smallest outgoing frame, in bytes, compressed for clients that
+	// negotiated permessage-deflate
+	CompressionThreshold int `mapstructure:"compression_threshold"`
+}
+
+type RateLimitConfiguration struct {
+	// Login and registration
+	Auth RateLimitRule
+	// Sending messages
+	Write RateLimitRule
+	// Everything else behind authentication
+	Read RateLimitRule
+	// Admin system message broadcasts
+	Broadcast RateLimitRule
+}
+
+type RateLimitRule struct {
+	// Requests per second; 0 disables the limit
+	RPS   int `mapstructure:"rps"`
+	Burst int
 }
 
 var Config *Configuration
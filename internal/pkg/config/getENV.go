@@ -15,6 +15,11 @@ type ENV struct {
 	PASSWORD  string `mapstructure:"DB_PASSWORD"`
 	DB_NAME   string `mapstructure:"DB_NAME"`
 	URL_DIR   string `mapstructure:"URL_DIR"`
+
+	REDIS_HOST     string `mapstructure:"REDIS_HOST"`
+	REDIS_PORT     string `mapstructure:"REDIS_PORT"`
+	REDIS_PASSWORD string `mapstructure:"REDIS_PASSWORD"`
+	REDIS_DB       string `mapstructure:"REDIS_DB"`
 }
 
 func LoadFileENV() *ENV {
@@ -36,5 +41,10 @@ func LoadFileENV() *ENV {
 		PASSWORD:  os.Getenv("DB_PASSWORD"),
 		DB_NAME:   os.Getenv("DB_NAME"),
 		URL_DIR:   os.Getenv("URL_DIR"),
+
+		REDIS_HOST:     os.Getenv("REDIS_HOST"),
+		REDIS_PORT:     os.Getenv("REDIS_PORT"),
+		REDIS_PASSWORD: os.Getenv("REDIS_PASSWORD"),
+		REDIS_DB:       os.Getenv("REDIS_DB"),
 	}
 }
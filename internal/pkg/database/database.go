@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -126,28 +127,105 @@ func getWriter() io.Writer {
 	}
 }
 
+// Models lists every model the schema is migrated for
+var Models = []interface{}{
+	&models.User{},
+	&models.PushSubscription{},
+	&models.BotToken{},
+	&models.Contact{},
+	&models.PrivateMessage{},
+	&models.Group{},
+	&models.GroupMember{},
+	&models.GroupInvite{},
+	&models.GroupJoinRequest{},
+	&models.PinnedMessage{},
+	&models.GroupMessage{},
+	&models.MessageDelivery{},
+	&models.File{},
+	&models.MessageHidden{},
+	&models.StarredMessage{},
+	&models.MessageReport{},
+	&models.MessageReaction{},
+	&models.MessageAttachment{},
+	&models.LinkPreview{},
+	&models.MessageMention{},
+	&models.Poll{},
+	&models.PollOption{},
+	&models.PollVote{},
+	&models.ConversationMute{},
+	&models.ConversationArchive{},
+	&models.Draft{},
+	&models.DisappearingSetting{},
+	&models.VideoCall{},
+	&models.CallParticipant{},
+	&models.ICECandidate{},
+	&models.Webhook{},
+	&models.WebhookDeadLetter{},
+}
+
 func migration() {
 	// Auto-migrate chat application models
-	err := DB.AutoMigrate(
-		&models.User{},
-		&models.PrivateMessage{},
-		&models.Group{},
-		&models.GroupMember{},
-		&models.GroupMessage{},
-		&models.File{},
-	)
+	err := DB.AutoMigrate(Models...)
 	
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+
+	createSearchIndexes()
 	
 	log.Println("✓ Database migration completed successfully")
 }
 
+// searchIndexes back message and user search on Postgres: GIN indexes over
+// the full-text vector, and trigram indexes for partial-word matches
+var searchIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_private_messages_content_fts ON private_messages USING GIN (to_tsvector('simple', content))`,
+	`CREATE INDEX IF NOT EXISTS idx_group_messages_content_fts ON group_messages USING GIN (to_tsvector('simple', content))`,
+	`CREATE INDEX IF NOT EXISTS idx_private_messages_content_trgm ON private_messages USING GIN (content gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS idx_group_messages_content_trgm ON group_messages USING GIN (content gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING GIN (username gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING GIN (email gin_trgm_ops)`,
+}
+
+// createSearchIndexes adds the search indexes. Other databases
+// search without them, so failures only cost performance.
+func createSearchIndexes() {
+	if DB.Dialector.Name() != "postgres" {
+		return
+	}
+
+	if err := DB.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("Warning: pg_trgm unavailable, partial-word search will be slow: %v", err)
+	}
+
+	for _, stmt := range searchIndexes {
+		if err := DB.Exec(stmt).Error; err != nil {
+			log.Printf("Warning: failed to create search index: %v", err)
+		}
+	}
+}
+
 func GetDB() *gorm.DB {
 	return DB
 }
 
+// Ping checks that the database answers queries
+func Ping(ctx context.Context) error {
+	return DB.WithContext(ctx).Exec("SELECT 1").Error
+}
+
+// defaultQueryTimeout applies when no query timeout is configured
+const defaultQueryTimeout = 10 * time.Second
+
+// QueryTimeout returns how long the queries of one request or WebSocket
+// event may run, falling back to the default
+func QueryTimeout() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Database.QueryTimeout > 0 {
+		return cfg.Database.QueryTimeout
+	}
+	return defaultQueryTimeout
+}
+
 func DatabaseConnection() (*gorm.DB, error) {
 	env := config.LoadFileENV()
 	configuration := config.GetConfig()
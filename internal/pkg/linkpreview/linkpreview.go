@@ -0,0 +1,234 @@
+package linkpreview
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/netguard"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultMaxBodySize = 1 << 20
+
+	// maxFieldLength bounds each text field taken from a page
+	maxFieldLength = 500
+)
+
+var (
+	// ErrForbiddenAddress is returned for URLs resolving to private,
+	// loopback or otherwise internal addresses
+	ErrForbiddenAddress = netguard.ErrForbiddenAddress
+
+	// ErrNoPreview is returned when a page has nothing to preview
+	ErrNoPreview = errors.New("page has no preview metadata")
+
+	// urlPattern finds http(s) URLs in message text
+	urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+)
+
+// Preview is the Open Graph summary of a page
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// Fetcher downloads pages and extracts their previews. It refuses to
+// connect to internal addresses, including through redirects.
+type Fetcher struct {
+	client      *http.Client
+	maxBodySize int64
+}
+
+// NewFetcher creates a fetcher from the configuration, filling in defaults
+// for unset values
+func NewFetcher(cfg config.LinkPreviewConfiguration) *Fetcher {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	maxBodySize := cfg.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	return &Fetcher{
+		client:      netguard.NewClient(timeout),
+		maxBodySize: maxBodySize,
+	}
+}
+
+// Fetch downloads a page and returns its preview
+func (f *Fetcher) Fetch(rawURL string) (*Preview, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScheme(target); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "web-api-linkpreview/1.0")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("page answered %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return nil, ErrNoPreview
+	}
+
+	preview := parse(io.LimitReader(resp.Body, f.maxBodySize), resp.Request.URL)
+	if preview.Title == "" {
+		return nil, ErrNoPreview
+	}
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// FirstURL returns the first http(s) URL in text, or "" if there is none
+func FirstURL(text string) string {
+	found := urlPattern.FindString(text)
+	// Punctuation closing a sentence is not part of the link
+	return strings.TrimRight(found, ".,;:!?)]}")
+}
+
+// parse reads Open Graph tags from the page head, falling back to the
+// <title> and description meta tags
+func parse(body io.Reader, base *url.URL) *Preview {
+	var preview Preview
+	var title, description string
+
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return finish(&preview, title, description, base)
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				return finish(&preview, title, description, base)
+			case "title":
+				inTitle = true
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				key, content := metaAttributes(tokenizer)
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:image":
+					preview.Image = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "description":
+					description = content
+				}
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "head":
+				return finish(&preview, title, description, base)
+			case "title":
+				inTitle = false
+			}
+
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// metaAttributes returns the property (or name) and content of a meta tag
+func metaAttributes(tokenizer *html.Tokenizer) (string, string) {
+	var key, content string
+	for {
+		attr, value, more := tokenizer.TagAttr()
+		switch string(attr) {
+		case "property", "name":
+			if key == "" || string(attr) == "property" {
+				key = strings.ToLower(string(value))
+			}
+		case "content":
+			content = string(value)
+		}
+		if !more {
+			return key, content
+		}
+	}
+}
+
+// finish applies fallbacks, trims fields and makes the image URL absolute
+func finish(preview *Preview, title, description string, base *url.URL) *Preview {
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+
+	preview.Title = clean(preview.Title)
+	preview.Description = clean(preview.Description)
+	preview.SiteName = clean(preview.SiteName)
+
+	if preview.Image != "" {
+		image, err := base.Parse(strings.TrimSpace(preview.Image))
+		if err != nil || checkScheme(image) != nil {
+			preview.Image = ""
+		} else {
+			preview.Image = image.String()
+		}
+	}
+
+	return preview
+}
+
+// clean collapses whitespace and truncates a text field
+func clean(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > maxFieldLength {
+		s = string(runes[:maxFieldLength]) + "…"
+	}
+	return s
+}
+
+// checkScheme only lets http and https URLs through
+func checkScheme(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("only http and https URLs can be previewed")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package linkpreview
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/config"
+)
+
+const ogPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Fallback title</title>
+  <meta property="og:title" content="  The   Real
+    Title ">
+  <meta property="og:description" content="What the page is about">
+  <meta property="og:image" content="/images/card.png">
+  <meta property="og:site_name" content="Example">
+</head>
+<body><meta property="og:title" content="Not in the head"></body>
+</html>`
+
+// fakeSite serves pages by path until the test ends
+func fakeSite(t *testing.T, pages map[string]http.HandlerFunc) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	for path, handler := range pages {
+		mux.HandleFunc(path, handler)
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// htmlPage answers with an HTML page
+func htmlPage(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(body))
+	}
+}
+
+// loopbackFetcher creates a fetcher that may reach the fake site, which
+// listens on loopback, like the real fetcher reaches public hosts
+func loopbackFetcher(cfg config.LinkPreviewConfiguration) *Fetcher {
+	f := NewFetcher(cfg)
+	f.client.Transport.(*http.Transport).DialContext = (&net.Dialer{}).DialContext
+	return f
+}
+
+func TestFetchReadsOpenGraph(t *testing.T) {
+	site := fakeSite(t, map[string]http.HandlerFunc{"/post": htmlPage(ogPage)})
+
+	preview, err := loopbackFetcher(config.LinkPreviewConfiguration{}).Fetch(site + "/post")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	want := Preview{
+		URL:         site + "/post",
+		Title:       "The Real Title",
+		Description: "What the page is about",
+		Image:       site + "/images/card.png",
+		SiteName:    "Example",
+	}
+	if *preview != want {
+		t.Fatalf("preview %+v, want %+v", *preview, want)
+	}
+}
+
+func TestFetchFallsBackToTitleAndDescription(t *testing.T) {
+	site := fakeSite(t, map[string]http.HandlerFunc{
+		"/plain": htmlPage(`<html><head><title>Plain page</title><meta name="description" content="Plain words"></head></html>`),
+	})
+
+	preview, err := loopbackFetcher(config.LinkPreviewConfiguration{}).Fetch(site + "/plain")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.Title != "Plain page" || preview.Description != "Plain words" || preview.Image != "" {
+		t.Fatalf("preview %+v, want the title and description tags", *preview)
+	}
+}
+
+func TestFetchWithoutPreview(t *testing.T) {
+	site := fakeSite(t, map[string]http.HandlerFunc{
+		"/untitled": htmlPage(`<html><head></head><body>Nothing here</body></html>`),
+		"/json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"title":"not html"}`))
+		},
+		// The title comes after more than the fetcher reads
+		"/huge": htmlPage(`<html><head><!--` + strings.Repeat("x", 4096) + `--><title>Too far</title></head></html>`),
+	})
+	f := loopbackFetcher(config.LinkPreviewConfiguration{MaxBodySize: 1024})
+
+	for _, path := range []string{"/untitled", "/json", "/huge"} {
+		if _, err := f.Fetch(site + path); !errors.Is(err, ErrNoPreview) {
+			t.Errorf("%s: err = %v, want %v", path, err, ErrNoPreview)
+		}
+	}
+	if _, err := f.Fetch(site + "/missing"); err == nil {
+		t.Error("/missing: fetched a preview of a 404 page")
+	}
+}
+
+func TestFetchTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	site := fakeSite(t, map[string]http.HandlerFunc{
+		"/slow": func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		},
+	})
+	defer close(release)
+
+	start := time.Now()
+	if _, err := loopbackFetcher(config.LinkPreviewConfiguration{Timeout: 50 * time.Millisecond}).Fetch(site + "/slow"); err == nil {
+		t.Fatal("Fetch of a page that never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Fetch gave up after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestFetchRefusesInternalAddresses(t *testing.T) {
+	site := fakeSite(t, map[string]http.HandlerFunc{
+		"/post": htmlPage(ogPage),
+		"/ftp": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "ftp://example.com/file", http.StatusFound)
+		},
+	})
+
+	// The real fetcher will not talk to the fake site on loopback
+	if _, err := NewFetcher(config.LinkPreviewConfiguration{}).Fetch(site + "/post"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("loopback: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+
+	f := loopbackFetcher(config.LinkPreviewConfiguration{})
+	for _, rawURL := range []string{"file:///etc/passwd", "gopher://example.com", site + "/ftp"} {
+		if _, err := f.Fetch(rawURL); err == nil {
+			t.Errorf("Fetch(%s) succeeded, want only http(s) URLs", rawURL)
+		}
+	}
+}
+
+func TestFirstURL(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"see https://example.com/a?b=1.", "https://example.com/a?b=1"},
+		{"(http://example.com/x) and https://example.org", "http://example.com/x"},
+		{"no links, ftp://example.com neither", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := FirstURL(tt.text); got != tt.want {
+			t.Errorf("FirstURL(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
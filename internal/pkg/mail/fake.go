@@ -0,0 +1,31 @@
+package mail
+
+import "sync"
+
+// FakeMailer records emails instead of sending them. It is meant for tests.
+type FakeMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+// NewFakeMailer creates a mailer that records emails
+func NewFakeMailer() *FakeMailer {
+	return &FakeMailer{}
+}
+
+// Send records the message
+func (m *FakeMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the emails recorded so far
+func (m *FakeMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,25 @@
+package mail
+
+import "web-api/internal/pkg/config"
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	// Send delivers the message to its recipient
+	Send(msg Message) error
+}
+
+// New creates a mailer from the configuration. It returns nil when no SMTP
+// host is configured, which disables email.
+func New(cfg config.MailConfiguration) (Mailer, error) {
+	if cfg.Host == "" {
+		return nil, nil
+	}
+	return NewSMTPMailer(cfg)
+}
@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"web-api/internal/pkg/config"
+)
+
+// SMTPMailer sends emails through an SMTP relay
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer for the configured relay. It
+// authenticates only when a username is set.
+func NewSMTPMailer(cfg config.MailConfiguration) (*SMTPMailer, error) {
+	if cfg.From == "" {
+		return nil, errors.New("mail needs a from address")
+	}
+
+	port := cfg.Port
+	if port == "" {
+		port = "587"
+	}
+
+	mailer := &SMTPMailer{
+		addr: net.JoinHostPort(cfg.Host, port),
+		from: cfg.From,
+	}
+	if cfg.Username != "" {
+		mailer.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return mailer, nil
+}
+
+// Send delivers the message, upgrading to TLS when the relay offers it
+func (m *SMTPMailer) Send(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errors.New("mail headers cannot contain line breaks")
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.from, msg.To, msg.Subject, msg.Body)
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(body))
+}
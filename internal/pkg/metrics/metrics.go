@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// Registry holds the collectors exposed on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ActiveConnections is the number of WebSocket connections held by this
+	// instance
+	ActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_active_connections",
+		Help: "WebSocket connections open on this instance.",
+	})
+
+	// MessagesReceived counts events received from clients, by event
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_messages_received_total",
+		Help: "WebSocket events received from clients, by event.",
+	}, []string{"event"})
+
+	// MessagesSent counts events handed to client connections, by event
+	MessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_messages_sent_total",
+		Help: "WebSocket events sent to client connections, by event.",
+	}, []string{"event"})
+
+	// BroadcastDuration measures how long the hub takes to handle a client
+	// event, delivery to the recipients included
+	BroadcastDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_broadcast_duration_seconds",
+		Help:    "Time the hub spends handling a client event, by event.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"event"})
+
+	// DroppedMessages counts events that did not fit a client's Send buffer
+	DroppedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ws_dropped_messages_total",
+		Help: "Events that missed a client's send buffer and were queued instead.",
+	})
+
+	// CompressionSavedBytes counts the bytes compression kept off the wire
+	CompressionSavedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ws_compression_saved_bytes_total",
+		Help: "Bytes permessage-deflate saved on outgoing WebSocket frames.",
+	})
+
+	// RedisPublishErrors counts failed Redis publishes
+	RedisPublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_publish_errors_total",
+		Help: "Redis PUBLISH calls that failed.",
+	})
+
+	// RedisDeadLetters counts messages dead lettered after every publish
+	// attempt failed
+	RedisDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_dead_letters_total",
+		Help: "Messages moved to the dead letter list after failing to publish.",
+	})
+
+	// DBQueryDuration measures database statements, by operation
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Database statement duration, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// Register adds the application and runtime collectors to Registry
+func Register() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ActiveConnections,
+		MessagesReceived,
+		MessagesSent,
+		BroadcastDuration,
+		DroppedMessages,
+		CompressionSavedBytes,
+		RedisPublishErrors,
+		RedisDeadLetters,
+		DBQueryDuration,
+	)
+}
+
+// Handler serves the collectors of Registry in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentDB times every statement run through db
+func InstrumentDB(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("metrics:before_create", startTimer),
+		cb.Create().After("gorm:create").Register("metrics:after_create", observe("create")),
+		cb.Query().Before("gorm:query").Register("metrics:before_query", startTimer),
+		cb.Query().After("gorm:query").Register("metrics:after_query", observe("query")),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", startTimer),
+		cb.Update().After("gorm:update").Register("metrics:after_update", observe("update")),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", startTimer),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", observe("delete")),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", startTimer),
+		cb.Row().After("gorm:row").Register("metrics:after_row", observe("row")),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", startTimer),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", observe("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startKey is where a statement's start time is kept between callbacks
+const startKey = "metrics:start"
+
+func startTimer(tx *gorm.DB) {
+	tx.InstanceSet(startKey, time.Now())
+}
+
+func observe(operation string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		if start, ok := tx.InstanceGet(startKey); ok {
+			DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start.(time.Time)).Seconds())
+		}
+	}
+}
@@ -1,31 +1,129 @@
+// Package errs holds the errors services return for conditions callers
+// handle, so they can tell them apart with errors.Is instead of comparing
+// messages.
 package errs
 
 import (
 	"errors"
 	"fmt"
+	"math"
+	"time"
 )
 
-type OrderNotExistsError struct {
-	OrderID int64
-}
-type ErrProductNotExists struct {
-	ProductID int64
-}
-type ErrProductExists struct {
-	ProductID int64
-}
+// Authentication and accounts
+var (
+	ErrInvalidCredentials  = errors.New("invalid email or password")
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	ErrInvalidResetToken   = errors.New("invalid or expired password reset token")
+	ErrWrongPassword       = errors.New("current password is incorrect")
+	ErrUserExists          = errors.New("user with this email or username already exists")
+	ErrEmailInUse          = errors.New("email is already in use")
+)
+
+// Missing records
+var (
+	ErrUserNotFound         = errors.New("user not found")
+	ErrReceiverNotFound     = errors.New("receiver not found")
+	ErrGroupNotFound        = errors.New("group not found")
+	ErrMemberNotFound       = errors.New("user is not a member of this group")
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrReactionNotFound     = errors.New("reaction not found")
+	ErrPollNotFound         = errors.New("poll not found")
+	ErrFileNotFound         = errors.New("file not found")
+	ErrCallNotFound         = errors.New("call not found")
+	ErrInviteNotFound       = errors.New("invite not found")
+	ErrJoinRequestNotFound  = errors.New("join request not found")
+	ErrWebhookNotFound      = errors.New("webhook not found")
+	ErrBotTokenNotFound     = errors.New("bot token not found")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrReportNotFound       = errors.New("report not found")
+	ErrContactNotFound      = errors.New("contact not found")
+	ErrDraftNotFound        = errors.New("draft not found")
+)
+
+// Permissions
+var (
+	ErrNotGroupMember      = errors.New("you are not a member of this group")
+	ErrNotMemberOfAll      = errors.New("you are not a member of every listed group")
+	ErrGroupAdminRequired  = errors.New("only group admins can do this")
+	ErrAdminsUpdateGroup   = errors.New("only admins can update group information")
+	ErrNotAllowedToUpdate  = errors.New("you are not authorized to update this group")
+	ErrOwnerDeletesGroup   = errors.New("only group owner can delete the group")
+	ErrSenderEdits         = errors.New("only the sender can edit this message")
+	ErrSenderDeletes       = errors.New("only the sender can delete this message for everyone")
+	ErrMarkReadDenied      = errors.New("unauthorized to mark this message as read")
+	ErrFileNotOwned        = errors.New("unauthorized to delete this file")
+	ErrAvatarNotOwned      = errors.New("avatar must be a file you uploaded")
+	ErrNotInCall           = errors.New("you are not in this call")
+	ErrGroupPrivate        = errors.New("this group is private, ask an admin to add you")
+	ErrPrivateNoInvites    = errors.New("private groups do not accept invites")
+	ErrEditWindowExpired   = errors.New("edit window has expired")
+	ErrDeleteWindowExpired = errors.New("delete window has expired")
+	ErrBotScopeDenied      = errors.New("this token cannot access this chat")
+	ErrChannelAdminsPost   = errors.New("only admins can post in this channel")
+	ErrOwnerProtected      = errors.New("the group owner cannot be removed or demoted")
+	ErrOwnerLeaves         = errors.New("the group owner cannot leave the group, delete it instead")
+	ErrAttachmentNotOwned  = errors.New("attachments must be files you uploaded")
+)
+
+// Conflicting state
+var (
+	ErrAlreadyMember      = errors.New("you are already a member of this group")
+	ErrUserAlreadyMember  = errors.New("user is already a member of this group")
+	ErrGroupFull          = errors.New("group has reached its member limit")
+	ErrJoinRequestPending = errors.New("you already asked to join this group")
+	ErrAlreadyPinned      = errors.New("message is already pinned")
+	ErrAlreadyInCall      = errors.New("you are already in this call")
+	ErrAlreadyReported    = errors.New("you already reported this message")
+	ErrAlreadyContact     = errors.New("user is already your contact")
+	ErrContactPending     = errors.New("you already asked this user to be contacts")
+	ErrCallEnded          = errors.New("call has already ended")
+	ErrCallNotRinging     = errors.New("call is not ringing")
+	ErrPollClosed         = errors.New("poll is closed")
+	ErrBotTokenRevoked    = errors.New("bot token is already revoked")
+	ErrMessageDeleted     = errors.New("message has been deleted")
+	ErrInviteExpired      = errors.New("invite has expired")
+	ErrInviteExhausted    = errors.New("invite has reached its maximum number of uses")
+	ErrPushDisabled       = errors.New("push notifications are not enabled")
+	ErrPushEndpointInUse  = errors.New("push endpoint is registered to another account")
+)
+
+// Invalid input
+var (
+	ErrNotAnImage      = errors.New("file must be a JPEG, PNG or GIF image")
+	ErrSelfContact     = errors.New("you cannot add yourself as a contact")
+	ErrContentRejected = errors.New("message content is not allowed")
+	ErrTypingGroupOnly = errors.New("typing users can only be listed for groups")
+	ErrPushEndpoint    = errors.New("push endpoint must be a public https URL")
+	ErrBatchTooLarge   = errors.New("too many messages in one batch")
+	ErrReplyOutside    = errors.New("replied message is not in this conversation")
+	ErrPollEndpoint    = errors.New("polls are sent with their own endpoint")
+	ErrDuplicateFile   = errors.New("duplicate file in attachments")
+	ErrInvalidChatType = errors.New("message type must be private or group")
+)
+
+// Throttling
+var (
+	ErrFloodWait = errors.New("you are sending messages too fast")
+)
 
-func (e *OrderNotExistsError) Error() string {
-	return fmt.Sprintf("order with ID %d does not exist", e.OrderID)
+// FloodWaitError is ErrFloodWait with how long the sender must wait before
+// sending again
+type FloodWaitError struct {
+	Wait time.Duration
 }
-func (e *ErrProductNotExists) Error() string {
-	return fmt.Sprintf("product with ID %d does not exist", e.ProductID)
+
+func (e *FloodWaitError) Error() string {
+	return fmt.Sprintf("%s, wait %d seconds", ErrFloodWait, e.RetryAfter())
 }
 
-func (e *ErrProductExists) Error() string {
-	return fmt.Sprintf("product with ID %d already exists", e.ProductID)
+// Is makes errors.Is(err, ErrFloodWait) hold
+func (e *FloodWaitError) Is(target error) bool {
+	return target == ErrFloodWait
 }
 
-var (
-	ErrMaterialExists = errors.New("material already exists")
-)
+// RetryAfter returns the wait in whole seconds, rounded up
+func (e *FloodWaitError) RetryAfter() int {
+	return int(math.Ceil(e.Wait.Seconds()))
+}
@@ -17,6 +17,7 @@ type File struct {
 	Size       int64          `gorm:"not null" json:"size"` // in bytes
 	URL        string         `gorm:"not null;size:500" json:"url"`
 	Path       string         `gorm:"not null;size:500" json:"path"`
+	Avatar     bool           `gorm:"not null;default:false" json:"avatar"` // Readable by every user
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
@@ -26,3 +27,14 @@ type File struct {
 func (File) TableName() string {
 	return "files"
 }
+
+// ExportedFile is the metadata of an upload in a user's personal data export
+type ExportedFile struct {
+	ID           uint      `json:"id"`
+	OriginalName string    `json:"original_name"`
+	MimeType     string    `json:"mime_type"`
+	Size         int64     `json:"size"` // in bytes
+	URL          string    `json:"url"`
+	Avatar       bool      `json:"avatar"`
+	CreatedAt    time.Time `json:"created_at"`
+}
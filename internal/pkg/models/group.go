@@ -12,7 +12,10 @@ type Group struct {
 	Name        string         `gorm:"not null;size:255" json:"name"`
 	Description string         `gorm:"type:text" json:"description"`
 	Avatar      string         `gorm:"size:500" json:"avatar"`
+	Privacy     string         `gorm:"type:varchar(20);not null;default:'open'" json:"privacy"` // open, approval, private
+	Type        string         `gorm:"type:varchar(20);not null;default:'chat'" json:"type"`    // chat, or channel where only admins post
 	OwnerID     uint           `gorm:"not null;index" json:"owner_id"`
+	MaxMembers  int            `gorm:"not null;default:0" json:"max_members"` // Member limit below the configured one; 0 uses the configured one
 	Owner       User           `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
 	Members     []GroupMember  `gorm:"foreignKey:GroupID" json:"members,omitempty"`
 	CreatedAt   time.Time      `json:"created_at"`
@@ -25,18 +28,73 @@ func (Group) TableName() string {
 	return "groups"
 }
 
+// ExportedGroup is a group as listed in a user's personal data export
+type ExportedGroup struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Privacy     string     `json:"privacy"`
+	Owner       bool       `json:"owner"`     // The user owns the group
+	Role        string     `json:"role"`      // The user's role, empty if they are no longer a member
+	JoinedAt    *time.Time `json:"joined_at"` // When the user joined, if they are a member
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Group privacy modes
+const (
+	GroupPrivacyOpen     = "open"     // Anyone with an invite or the group ID joins right away
+	GroupPrivacyApproval = "approval" // Joining needs an admin's approval
+	GroupPrivacyPrivate  = "private"  // Only admins can add members
+)
+
+// IsValidGroupPrivacy reports whether p is a known privacy mode
+func IsValidGroupPrivacy(p string) bool {
+	return p == GroupPrivacyOpen || p == GroupPrivacyApproval || p == GroupPrivacyPrivate
+}
+
+// Group types
+const (
+	GroupTypeChat    = "chat"    // Every member may post
+	GroupTypeChannel = "channel" // Only admins post; members read and react
+)
+
+// IsValidGroupType reports whether t is a known group type
+func IsValidGroupType(t string) bool {
+	return t == GroupTypeChat || t == GroupTypeChannel
+}
+
+// Roles of group members
+const (
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+// groupRoleRank orders group roles; a role includes every role ranked at
+// or below it
+var groupRoleRank = map[string]int{
+	GroupRoleMember: 1,
+	GroupRoleAdmin:  2,
+}
+
+// HasGroupRole reports whether a member with memberRole has at least role:
+// admins have the member role too
+func HasGroupRole(memberRole, role string) bool {
+	return groupRoleRank[memberRole] >= groupRoleRank[role]
+}
+
 // GroupMember represents a member of a group
 type GroupMember struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	GroupID   uint           `gorm:"not null;index" json:"group_id"`
-	Group     Group          `gorm:"foreignKey:GroupID" json:"group,omitempty"`
-	UserID    uint           `gorm:"not null;index" json:"user_id"`
-	User      User           `gorm:"foreignKey:UserID" json:"user,omitempty"`
-	Role      string         `gorm:"type:varchar(50);default:'member'" json:"role"` // admin, member
-	JoinedAt  time.Time      `gorm:"autoCreateTime" json:"joined_at"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	GroupID    uint           `gorm:"not null;index" json:"group_id"`
+	Group      Group          `gorm:"foreignKey:GroupID" json:"group,omitempty"`
+	UserID     uint           `gorm:"not null;index" json:"user_id"`
+	User       User           `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Role       string         `gorm:"type:varchar(50);default:'member'" json:"role"` // admin, member
+	JoinedAt   time.Time      `gorm:"autoCreateTime" json:"joined_at"`
+	LastReadAt *time.Time     `json:"last_read_at"` // Messages up to this time count as read
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name
@@ -44,13 +102,68 @@ func (GroupMember) TableName() string {
 	return "group_members"
 }
 
-// GroupResponse is used for API responses
+// GroupInvite is a shareable code that lets users join a group
+type GroupInvite struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	GroupID   uint      `gorm:"not null;index" json:"group_id"`
+	Group     Group     `gorm:"foreignKey:GroupID" json:"group,omitempty"`
+	Code      string    `gorm:"size:64;not null;uniqueIndex" json:"code"`
+	CreatedBy uint      `gorm:"not null" json:"created_by"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	MaxUses   int       `gorm:"not null;default:0" json:"max_uses"` // 0 means unlimited
+	Uses      int       `gorm:"not null;default:0" json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (GroupInvite) TableName() string {
+	return "group_invites"
+}
+
+// Statuses of join requests
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestApproved = "approved"
+	JoinRequestRejected = "rejected"
+)
+
+// GroupJoinRequest is a request to join a group that needs approval
+type GroupJoinRequest struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	GroupID    uint       `gorm:"not null;index" json:"group_id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	User       User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	InviteID   *uint      `json:"invite_id,omitempty"` // Invite the request was made with, if any
+	Status     string     `gorm:"type:varchar(20);not null;default:'pending';index" json:"status"`
+	ReviewedBy *uint      `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (GroupJoinRequest) TableName() string {
+	return "group_join_requests"
+}
+
+// PinnedMessage is a group message pinned by an admin
+type PinnedMessage struct {
+	ID        uint          `gorm:"primaryKey" json:"id"`
+	GroupID   uint          `gorm:"not null;uniqueIndex:idx_pinned_message_unique" json:"group_id"`
+	MessageID uint          `gorm:"not null;uniqueIndex:idx_pinned_message_unique" json:"message_id"`
+	Message   *GroupMessage `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+	PinnedBy  uint          `gorm:"not null" json:"pinned_by"`
+	PinnedAt  time.Time     `gorm:"autoCreateTime" json:"pinned_at"`
+}
+
+// TableName specifies the table name
+func (PinnedMessage) TableName() string {
+	return "pinned_messages"
+}
+
+// GroupResponse is a group with how many members it has and may have
 type GroupResponse struct {
-	ID          uint       `json:"id"`
-	Name        string     `json:"name"`
-	Description string     `json:"description"`
-	Avatar      string     `json:"avatar"`
-	OwnerID     uint       `json:"owner_id"`
-	MemberCount int64      `json:"member_count"`
-	CreatedAt   time.Time  `json:"created_at"`
+	Group
+	MemberCount int64 `json:"member_count"`
+	MemberLimit int   `json:"member_limit"`
 }
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -10,26 +14,121 @@ import (
 type MessageType string
 
 const (
-	MessageTypeText MessageType = "text"
-	MessageTypeFile MessageType = "file"
+	MessageTypeText  MessageType = "text"
+	MessageTypeFile  MessageType = "file"
+	MessageTypeAudio MessageType = "audio" // Voice note, plays the attached audio file
+	MessageTypeVideo MessageType = "video" // Video clip, plays the attached video file
+	MessageTypePoll  MessageType = "poll"  // Content is the question; see Poll
+)
+
+// IsMedia reports whether messages of this type play an attached recording
+func (t MessageType) IsMedia() bool {
+	return t == MessageTypeAudio || t == MessageTypeVideo
+}
+
+// IsValid reports whether t is a known message type
+func (t MessageType) IsValid() bool {
+	switch t {
+	case MessageTypeText, MessageTypeFile, MessageTypeAudio, MessageTypeVideo, MessageTypePoll:
+		return true
+	}
+	return false
+}
+
+// DefaultMaxMessageLength bounds message content, in bytes, when no limit
+// is configured
+const DefaultMaxMessageLength = 8 * 1024
+
+// ValidateMessageContent checks the content and type of a message before
+// it is stored. An empty type stands for text.
+func ValidateMessageContent(content string, msgType MessageType, maxLength int) error {
+	if msgType != "" && !msgType.IsValid() {
+		return fmt.Errorf("unknown message type: %s", msgType)
+	}
+	if strings.TrimSpace(content) == "" {
+		return errors.New("message content cannot be empty")
+	}
+	if len(content) > maxLength {
+		return fmt.Errorf("message content exceeds %d bytes", maxLength)
+	}
+	return nil
+}
+
+// ChatType identifies the kind of conversation a message belongs to
+type ChatType string
+
+const (
+	ChatTypePrivate ChatType = "private"
+	ChatTypeGroup   ChatType = "group"
+)
+
+// ConversationID builds the conversation identifier used by clients,
+// e.g. "private:42" or "group:7"
+func ConversationID(chatType ChatType, id uint) string {
+	return fmt.Sprintf("%s:%d", chatType, id)
+}
+
+// ParseConversationID splits a "private:<userID>" or "group:<groupID>"
+// conversation identifier into its type and ID
+func ParseConversationID(conversationID string) (ChatType, uint, error) {
+	parts := strings.SplitN(conversationID, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid conversation ID format: %s", conversationID)
+	}
+
+	chatType := ChatType(parts[0])
+	if chatType != ChatTypePrivate && chatType != ChatTypeGroup {
+		return "", 0, fmt.Errorf("invalid conversation type: %s", parts[0])
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || id == 0 {
+		return "", 0, fmt.Errorf("invalid conversation ID: %s", conversationID)
+	}
+
+	return chatType, uint(id), nil
+}
+
+// MessageStatus is how far a message got towards its recipients
+type MessageStatus string
+
+const (
+	MessageStatusSent      MessageStatus = "sent"      // Persisted
+	MessageStatusDelivered MessageStatus = "delivered" // Acked by the recipients' clients
+	MessageStatusRead      MessageStatus = "read"
 )
 
 // PrivateMessage represents a one-to-one message
 type PrivateMessage struct {
-	ID         uint            `gorm:"primaryKey" json:"id"`
-	SenderID   uint            `gorm:"not null;index" json:"sender_id"`
-	Sender     User            `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
-	ReceiverID uint            `gorm:"not null;index" json:"receiver_id"`
-	Receiver   User            `gorm:"foreignKey:ReceiverID" json:"receiver,omitempty"`
-	Content    string          `gorm:"type:text;not null" json:"content"`
-	Type       MessageType     `gorm:"type:varchar(20);default:'text'" json:"type"`
-	FileID     *uint           `gorm:"index" json:"file_id,omitempty"`
-	File       *File           `gorm:"foreignKey:FileID" json:"file,omitempty"`
-	IsRead     bool            `gorm:"default:false" json:"is_read"`
-	ReadAt     *time.Time      `json:"read_at"`
-	CreatedAt  time.Time       `json:"created_at"`
-	UpdatedAt  time.Time       `json:"updated_at"`
-	DeletedAt  gorm.DeletedAt  `gorm:"index" json:"-"`
+	ID                 uint                `gorm:"primaryKey" json:"id"`
+	SenderID           uint                `gorm:"not null;index;uniqueIndex:idx_private_message_client_msg" json:"sender_id"`
+	Sender             User                `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
+	ReceiverID         uint                `gorm:"not null;index" json:"receiver_id"`
+	Receiver           User                `gorm:"foreignKey:ReceiverID" json:"receiver,omitempty"`
+	ClientMsgID        *string             `gorm:"size:36;uniqueIndex:idx_private_message_client_msg" json:"client_msg_id,omitempty"` // Sender-chosen UUID making retried sends idempotent
+	Content            string              `gorm:"type:text;not null" json:"content"`
+	Type               MessageType         `gorm:"type:varchar(20);default:'text'" json:"type"`
+	FileID             *uint               `gorm:"index" json:"file_id,omitempty"`
+	File               *File               `gorm:"foreignKey:FileID" json:"file,omitempty"`
+	DurationMs         *int                `json:"duration_ms,omitempty"` // Length of audio/video messages
+	Attachments        []MessageAttachment `gorm:"polymorphic:Message;polymorphicValue:private" json:"attachments,omitempty"`
+	LinkPreview        *LinkPreview        `gorm:"polymorphic:Message;polymorphicValue:private" json:"link_preview,omitempty"`
+	Poll               *Poll               `gorm:"polymorphic:Message;polymorphicValue:private" json:"poll,omitempty"`
+	ReplyToID          *uint               `gorm:"index" json:"reply_to_id,omitempty"`
+	ReplyTo            *PrivateMessage     `gorm:"foreignKey:ReplyToID" json:"reply_to,omitempty"`
+	IsRead             bool                `gorm:"default:false" json:"is_read"`
+	ReadAt             *time.Time          `json:"read_at"`
+	DeliveredAt        *time.Time          `json:"delivered_at"`
+	Status             MessageStatus       `gorm:"-" json:"status"`
+	EditedAt           *time.Time          `json:"edited_at,omitempty"`
+	DeletedForEveryone bool                `gorm:"default:false" json:"deleted_for_everyone"` // Unsent by the sender; content is blanked
+	Filtered           bool                `gorm:"default:false" json:"filtered"`             // Content was masked by the content filter
+	ExpiresAt          *time.Time          `gorm:"index" json:"expires_at,omitempty"`         // Disappearing messages are removed after this
+	Reactions          []ReactionCount     `gorm:"-" json:"reactions,omitempty"`
+	Seq                int64               `gorm:"not null;default:0" json:"seq"` // Position in the conversation, counting up from 1
+	CreatedAt          time.Time           `json:"created_at"`
+	UpdatedAt          time.Time           `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt      `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name
@@ -37,23 +136,346 @@ func (PrivateMessage) TableName() string {
 	return "private_messages"
 }
 
+// DeliveryStatus derives the message's status from its read and delivery times
+func (m *PrivateMessage) DeliveryStatus() MessageStatus {
+	switch {
+	case m.IsRead:
+		return MessageStatusRead
+	case m.DeliveredAt != nil:
+		return MessageStatusDelivered
+	}
+	return MessageStatusSent
+}
+
 // GroupMessage represents a message in a group chat
 type GroupMessage struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	GroupID   uint           `gorm:"not null;index" json:"group_id"`
-	Group     Group          `gorm:"foreignKey:GroupID" json:"group,omitempty"`
-	SenderID  uint           `gorm:"not null;index" json:"sender_id"`
-	Sender    User           `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
-	Content   string         `gorm:"type:text;not null" json:"content"`
-	Type      MessageType    `gorm:"type:varchar(20);default:'text'" json:"type"`
-	FileID    *uint          `gorm:"index" json:"file_id,omitempty"`
-	File      *File          `gorm:"foreignKey:FileID" json:"file,omitempty"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                 uint                `gorm:"primaryKey" json:"id"`
+	GroupID            uint                `gorm:"not null;index;index:idx_group_message_seq" json:"group_id"`
+	Group              Group               `gorm:"foreignKey:GroupID" json:"group,omitempty"`
+	SenderID           uint                `gorm:"not null;index;uniqueIndex:idx_group_message_client_msg" json:"sender_id"`
+	Sender             User                `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
+	ClientMsgID        *string             `gorm:"size:36;uniqueIndex:idx_group_message_client_msg" json:"client_msg_id,omitempty"` // Sender-chosen UUID making retried sends idempotent
+	Content            string              `gorm:"type:text;not null" json:"content"`
+	Type               MessageType         `gorm:"type:varchar(20);default:'text'" json:"type"`
+	FileID             *uint               `gorm:"index" json:"file_id,omitempty"`
+	File               *File               `gorm:"foreignKey:FileID" json:"file,omitempty"`
+	DurationMs         *int                `json:"duration_ms,omitempty"` // Length of audio/video messages
+	Attachments        []MessageAttachment `gorm:"polymorphic:Message;polymorphicValue:group" json:"attachments,omitempty"`
+	LinkPreview        *LinkPreview        `gorm:"polymorphic:Message;polymorphicValue:group" json:"link_preview,omitempty"`
+	Poll               *Poll               `gorm:"polymorphic:Message;polymorphicValue:group" json:"poll,omitempty"`
+	Mentions           []MessageMention    `gorm:"foreignKey:MessageID" json:"mentions,omitempty"`
+	ReplyToID          *uint               `gorm:"index" json:"reply_to_id,omitempty"`
+	ReplyTo            *GroupMessage       `gorm:"foreignKey:ReplyToID" json:"reply_to,omitempty"`
+	EditedAt           *time.Time          `json:"edited_at,omitempty"`
+	DeletedForEveryone bool                `gorm:"default:false" json:"deleted_for_everyone"` // Unsent by the sender; content is blanked
+	Filtered           bool                `gorm:"default:false" json:"filtered"`             // Content was masked by the content filter
+	ExpiresAt          *time.Time          `gorm:"index" json:"expires_at,omitempty"`         // Disappearing messages are removed after this
+	Status             MessageStatus       `gorm:"-" json:"status"`                           // Aggregated over all recipients
+	Reactions          []ReactionCount     `gorm:"-" json:"reactions,omitempty"`
+	Seq                int64               `gorm:"not null;default:0;index:idx_group_message_seq" json:"seq"` // Position in the conversation, counting up from 1
+	CreatedAt          time.Time           `json:"created_at"`
+	UpdatedAt          time.Time           `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt      `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name
 func (GroupMessage) TableName() string {
 	return "group_messages"
 }
+
+// MessageDelivery tracks one recipient's copy of a group message. Rows are
+// created with the message for every member but the sender.
+type MessageDelivery struct {
+	ID          uint       `gorm:"primaryKey" json:"-"`
+	MessageID   uint       `gorm:"not null;uniqueIndex:idx_message_delivery_unique" json:"message_id"`
+	GroupID     uint       `gorm:"not null;index:idx_message_delivery_recipient" json:"group_id"`
+	UserID      uint       `gorm:"not null;uniqueIndex:idx_message_delivery_unique;index:idx_message_delivery_recipient" json:"user_id"`
+	User        User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	CreatedAt   time.Time  `json:"-"`
+}
+
+// TableName specifies the table name
+func (MessageDelivery) TableName() string {
+	return "message_deliveries"
+}
+
+// ConversationSync is a page of the messages of a conversation that a
+// client missed, oldest first
+type ConversationSync struct {
+	ChatType       ChatType    `json:"chat_type"`
+	ConversationID string      `json:"conversation_id"`
+	Messages       interface{} `json:"messages"` // []PrivateMessage or []GroupMessage
+	HasMore        bool        `json:"has_more"` // More messages follow the last one returned
+}
+
+// ExportedMessage is a message as written to a conversation export
+type ExportedMessage struct {
+	ID             uint        `json:"id"`
+	ConversationID string      `json:"conversation_id"`
+	Seq            int64       `json:"seq"`
+	SenderID       uint        `json:"sender_id"`
+	SenderUsername string      `json:"sender"`
+	Type           MessageType `json:"type"`
+	Content        string      `json:"content"`
+	CreatedAt      time.Time   `json:"created_at"`
+	Attachments    []string    `json:"attachments"` // URLs of the attached files
+}
+
+// previewLength is the maximum number of characters quoted in a preview
+const previewLength = 100
+
+// MessagePreview is a compact quote of a message, used for reply previews
+type MessagePreview struct {
+	MessageID      uint        `json:"message_id"`
+	SenderID       uint        `json:"sender_id"`
+	SenderUsername string      `json:"sender_username"`
+	Content        string      `json:"content"`
+	Type           MessageType `json:"type"`
+}
+
+// Preview returns a compact quote of the message
+func (m *PrivateMessage) Preview() *MessagePreview {
+	return newMessagePreview(m.ID, m.SenderID, m.Sender.Username, m.Content, m.Type, m.DeletedForEveryone)
+}
+
+// Preview returns a compact quote of the message
+func (m *GroupMessage) Preview() *MessagePreview {
+	return newMessagePreview(m.ID, m.SenderID, m.Sender.Username, m.Content, m.Type, m.DeletedForEveryone)
+}
+
+func newMessagePreview(id, senderID uint, senderUsername, content string, msgType MessageType, unsent bool) *MessagePreview {
+	// An unsent message quotes nothing of what it said
+	if unsent {
+		content = ""
+	}
+	if runes := []rune(content); len(runes) > previewLength {
+		content = string(runes[:previewLength]) + "…"
+	}
+
+	return &MessagePreview{
+		MessageID:      id,
+		SenderID:       senderID,
+		SenderUsername: senderUsername,
+		Content:        content,
+		Type:           msgType,
+	}
+}
+
+// MessageAttachment links one of several files to a message, e.g. the
+// pictures of an album
+type MessageAttachment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MessageID   uint      `gorm:"not null;index:idx_message_attachment_message" json:"message_id"`
+	MessageType ChatType  `gorm:"type:varchar(20);not null;index:idx_message_attachment_message" json:"message_type"`
+	FileID      uint      `gorm:"not null;index" json:"file_id"`
+	File        *File     `gorm:"foreignKey:FileID" json:"file,omitempty"`
+	Order       int       `gorm:"not null;default:0" json:"order"` // Position within the message
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (MessageAttachment) TableName() string {
+	return "message_attachments"
+}
+
+// LinkPreview is the Open Graph card of the first link in a message
+type LinkPreview struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MessageID   uint      `gorm:"not null;uniqueIndex:idx_link_preview_message" json:"message_id"`
+	MessageType ChatType  `gorm:"type:varchar(20);not null;uniqueIndex:idx_link_preview_message" json:"message_type"`
+	URL         string    `gorm:"size:2048;not null" json:"url"`
+	Title       string    `gorm:"size:1024;not null" json:"title"`
+	Description string    `gorm:"type:text" json:"description,omitempty"`
+	Image       string    `gorm:"size:2048" json:"image,omitempty"`
+	SiteName    string    `gorm:"size:1024" json:"site_name,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (LinkPreview) TableName() string {
+	return "link_previews"
+}
+
+// MessageMention records that a group message @mentions a member. Offsets
+// locate each "@username" in the content, counted in characters.
+type MessageMention struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_mention_unique" json:"-"`
+	GroupID   uint      `gorm:"not null;index" json:"-"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_mention_unique;index" json:"user_id"`
+	Username  string    `gorm:"size:100;not null" json:"username"`
+	Offsets   []int     `gorm:"serializer:json;type:text;not null" json:"offsets"`
+	Length    int       `gorm:"not null" json:"length"` // Characters of each mention, "@" included
+	CreatedAt time.Time `json:"-"`
+}
+
+// TableName specifies the table name
+func (MessageMention) TableName() string {
+	return "message_mentions"
+}
+
+// ConversationMute silences notifications of a conversation for one user.
+// For private chats the conversation ID names the other participant.
+type ConversationMute struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         uint       `gorm:"not null;uniqueIndex:idx_conversation_mute_unique" json:"user_id"`
+	ConversationID string     `gorm:"size:64;not null;uniqueIndex:idx_conversation_mute_unique" json:"conversation_id"`
+	MutedUntil     *time.Time `json:"muted_until"` // nil mutes until unmuted
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (ConversationMute) TableName() string {
+	return "conversation_mutes"
+}
+
+// Draft is the text a user was typing in a conversation, kept so they can
+// pick it up on another device. For private chats the conversation ID
+// names the other participant.
+type Draft struct {
+	ID             uint      `gorm:"primaryKey" json:"-"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_draft_unique" json:"-"`
+	ConversationID string    `gorm:"size:64;not null;uniqueIndex:idx_draft_unique" json:"conversation_id"`
+	Content        string    `gorm:"type:text;not null" json:"content"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (Draft) TableName() string {
+	return "drafts"
+}
+
+// TypingUser is a group member who is typing right now
+type TypingUser struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// ConversationArchive hides a conversation from one user's conversation
+// list until they unarchive it or a new message arrives in it. For private
+// chats the conversation ID names the other participant.
+type ConversationArchive struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_conversation_archive_unique" json:"user_id"`
+	ConversationID string    `gorm:"size:64;not null;uniqueIndex:idx_conversation_archive_unique;index" json:"conversation_id"`
+	ArchivedAt     time.Time `gorm:"not null" json:"archived_at"`
+}
+
+// TableName specifies the table name
+func (ConversationArchive) TableName() string {
+	return "conversation_archives"
+}
+
+// DisappearingSetting is the default lifetime of new messages in a
+// conversation. Private chats share one setting between both participants,
+// keyed by their sorted user IDs.
+type DisappearingSetting struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	ConversationKey string    `gorm:"size:64;not null;uniqueIndex" json:"-"` // "group:<id>" or "private:<low>:<high>"
+	DisappearAfter  int       `gorm:"not null" json:"disappear_after"`       // Seconds
+	UpdatedBy       uint      `gorm:"not null" json:"updated_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (DisappearingSetting) TableName() string {
+	return "disappearing_settings"
+}
+
+// MessageHidden records a message a user deleted for themselves only
+type MessageHidden struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;uniqueIndex:idx_message_hidden_unique" json:"user_id"`
+	MessageID   uint      `gorm:"not null;uniqueIndex:idx_message_hidden_unique" json:"message_id"`
+	MessageType ChatType  `gorm:"type:varchar(20);not null;uniqueIndex:idx_message_hidden_unique" json:"message_type"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (MessageHidden) TableName() string {
+	return "message_hidden"
+}
+
+// StarredMessage is a message a user saved for later. Stars are private to
+// the user.
+type StarredMessage struct {
+	ID          uint        `gorm:"primaryKey" json:"id"`
+	UserID      uint        `gorm:"not null;uniqueIndex:idx_starred_message_unique;index:idx_starred_message_user,priority:1" json:"user_id"`
+	MessageID   uint        `gorm:"not null;uniqueIndex:idx_starred_message_unique" json:"message_id"`
+	MessageType ChatType    `gorm:"type:varchar(20);not null;uniqueIndex:idx_starred_message_unique" json:"message_type"`
+	CreatedAt   time.Time   `gorm:"index:idx_starred_message_user,priority:2" json:"created_at"`
+	Message     interface{} `gorm:"-" json:"message,omitempty"` // *PrivateMessage or *GroupMessage, when listed
+}
+
+// TableName specifies the table name
+func (StarredMessage) TableName() string {
+	return "starred_messages"
+}
+
+// ReportStatus is where a message report is in triage
+type ReportStatus string
+
+const (
+	ReportStatusOpen      ReportStatus = "open"
+	ReportStatusResolved  ReportStatus = "resolved"
+	ReportStatusDismissed ReportStatus = "dismissed"
+)
+
+// MessageReport is a user's complaint about a message, triaged by the site
+// admins. A user reports a message at most once.
+type MessageReport struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	ReporterID  uint         `gorm:"not null;uniqueIndex:idx_message_report_unique" json:"reporter_id"`
+	Reporter    User         `gorm:"foreignKey:ReporterID" json:"reporter,omitempty"`
+	MessageID   uint         `gorm:"not null;uniqueIndex:idx_message_report_unique;index:idx_message_report_message,priority:1" json:"message_id"`
+	MessageType ChatType     `gorm:"type:varchar(20);not null;uniqueIndex:idx_message_report_unique;index:idx_message_report_message,priority:2" json:"message_type"`
+	Reason      string       `gorm:"size:500;not null" json:"reason"`
+	Status      ReportStatus `gorm:"type:varchar(20);not null;default:'open';index" json:"status"`
+	ReviewedBy  *uint        `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time   `json:"reviewed_at,omitempty"`
+	CreatedAt   time.Time    `gorm:"index" json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Message     interface{}  `gorm:"-" json:"message,omitempty"` // *PrivateMessage or *GroupMessage, when listed
+}
+
+// TableName specifies the table name
+func (MessageReport) TableName() string {
+	return "message_reports"
+}
+
+// MessageReaction represents an emoji reaction to a message
+type MessageReaction struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MessageID   uint      `gorm:"not null;uniqueIndex:idx_message_reaction_unique" json:"message_id"`
+	MessageType ChatType  `gorm:"type:varchar(20);not null;uniqueIndex:idx_message_reaction_unique" json:"message_type"`
+	UserID      uint      `gorm:"not null;uniqueIndex:idx_message_reaction_unique" json:"user_id"`
+	User        User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Emoji       string    `gorm:"size:32;not null;uniqueIndex:idx_message_reaction_unique" json:"emoji"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (MessageReaction) TableName() string {
+	return "message_reactions"
+}
+
+// ReactionCount is the aggregated count of one emoji on a message
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+}
+
+// BatchSendResult is the outcome of one message of a batch send. Status is
+// the HTTP status the message would have been answered with if sent alone;
+// failed messages carry the error code and message instead of the message.
+type BatchSendResult struct {
+	Status  int         `json:"status"`
+	Message interface{} `json:"message,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Detail  string      `json:"detail,omitempty"`
+}
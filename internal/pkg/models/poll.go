@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+// Poll is the question and options of a poll message
+type Poll struct {
+	ID             uint         `gorm:"primaryKey" json:"id"`
+	MessageID      uint         `gorm:"not null;uniqueIndex:idx_poll_message" json:"message_id"`
+	MessageType    ChatType     `gorm:"type:varchar(20);not null;uniqueIndex:idx_poll_message" json:"message_type"`
+	Question       string       `gorm:"size:500;not null" json:"question"`
+	Options        []PollOption `gorm:"foreignKey:PollID" json:"options"`
+	MultipleChoice bool         `gorm:"not null;default:false" json:"multiple_choice"`
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"` // nil keeps the poll open
+	CreatedBy      uint         `gorm:"not null" json:"created_by"`
+	TotalVoters    int64        `gorm:"-" json:"total_voters"`
+	MyVotes        []uint       `gorm:"-" json:"my_votes,omitempty"` // Option IDs the loading user voted for
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (Poll) TableName() string {
+	return "polls"
+}
+
+// IsClosed reports whether the poll stopped taking votes at now
+func (p *Poll) IsClosed(now time.Time) bool {
+	return p.ClosesAt != nil && !now.Before(*p.ClosesAt)
+}
+
+// HasOption reports whether optionID is one of the poll's options
+func (p *Poll) HasOption(optionID uint) bool {
+	for _, option := range p.Options {
+		if option.ID == optionID {
+			return true
+		}
+	}
+	return false
+}
+
+// PollOption is one answer of a poll
+type PollOption struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	PollID uint   `gorm:"not null;index" json:"-"`
+	Text   string `gorm:"size:200;not null" json:"text"`
+	Order  int    `gorm:"not null;default:0" json:"order"` // Position within the poll
+	Votes  int64  `gorm:"-" json:"votes"`
+}
+
+// TableName specifies the table name
+func (PollOption) TableName() string {
+	return "poll_options"
+}
+
+// PollVote records a user's vote for one option of a poll
+type PollVote struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PollID    uint      `gorm:"not null;uniqueIndex:idx_poll_vote_unique;index" json:"poll_id"`
+	OptionID  uint      `gorm:"not null;uniqueIndex:idx_poll_vote_unique" json:"option_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_poll_vote_unique" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (PollVote) TableName() string {
+	return "poll_votes"
+}
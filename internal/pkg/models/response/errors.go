@@ -0,0 +1,124 @@
+package response
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes sent in CommonResponse.Error. Clients branch
+// on them, so a code must never change meaning once released.
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeGone           = "gone"
+	CodeUnprocessable  = "unprocessable"
+	CodeRateLimited    = "rate_limited"
+	CodeInternal       = "internal_error"
+	CodeUnavailable    = "unavailable"
+
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeInvalidRefreshToken = "invalid_refresh_token"
+	CodeInvalidResetToken   = "invalid_reset_token"
+	CodeWrongPassword       = "wrong_password"
+	CodeUserExists          = "user_exists"
+	CodeEmailInUse          = "email_in_use"
+
+	CodeUserNotFound     = "user_not_found"
+	CodeReceiverNotFound = "receiver_not_found"
+	CodeGroupNotFound    = "group_not_found"
+	CodeMemberNotFound   = "member_not_found"
+	CodeMessageNotFound  = "message_not_found"
+	CodeReactionNotFound = "reaction_not_found"
+	CodePollNotFound     = "poll_not_found"
+	CodeFileNotFound     = "file_not_found"
+	CodeCallNotFound     = "call_not_found"
+	CodeInviteNotFound   = "invite_not_found"
+	CodeRequestNotFound  = "join_request_not_found"
+	CodeWebhookNotFound  = "webhook_not_found"
+	CodeBotTokenNotFound = "bot_token_not_found"
+	CodePushNotFound     = "subscription_not_found"
+	CodeReportNotFound   = "report_not_found"
+	CodeContactNotFound  = "contact_not_found"
+	CodeDraftNotFound    = "draft_not_found"
+
+	CodeNotGroupMember     = "not_group_member"
+	CodeAdminRequired      = "admin_required"
+	CodeOwnerRequired      = "owner_required"
+	CodeNotMessageSender   = "not_message_sender"
+	CodeNotCallParticipant = "not_call_participant"
+	CodeGroupPrivate       = "group_private"
+	CodeWindowExpired      = "window_expired"
+	CodeChannelReadOnly    = "channel_read_only"
+	CodeOwnerProtected     = "owner_protected"
+
+	CodeAlreadyMember      = "already_member"
+	CodeGroupFull          = "group_full"
+	CodeJoinRequestPending = "join_request_pending"
+	CodeAlreadyPinned      = "already_pinned"
+	CodeAlreadyInCall      = "already_in_call"
+	CodeAlreadyReported    = "already_reported"
+	CodeAlreadyContact     = "already_contact"
+	CodeContactPending     = "contact_pending"
+	CodeCallEnded          = "call_ended"
+	CodeCallNotRinging     = "call_not_ringing"
+	CodePollClosed         = "poll_closed"
+	CodeAlreadyRevoked     = "already_revoked"
+
+	CodeMessageDeleted = "message_deleted"
+	CodeInviteExpired  = "invite_expired"
+
+	CodeInvalidImage    = "invalid_image"
+	CodeContentRejected = "content_rejected"
+	CodeSelfContact     = "self_contact"
+	CodeGroupOnly       = "group_only"
+	CodeInvalidReply    = "invalid_reply"
+	CodePollEndpoint    = "use_poll_endpoint"
+	CodeInvalidChatType = "invalid_chat_type"
+
+	CodePushDisabled = "push_disabled"
+	CodeQueueFull    = "queue_full"
+
+	CodeFloodWait = "flood_wait"
+)
+
+// statusCodes holds the generic code of each error status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          CodeInvalidRequest,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusForbidden:           CodeForbidden,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusConflict:            CodeConflict,
+	http.StatusGone:                CodeGone,
+	http.StatusUnprocessableEntity: CodeUnprocessable,
+	http.StatusTooManyRequests:     CodeRateLimited,
+	http.StatusServiceUnavailable:  CodeUnavailable,
+}
+
+// StatusCode returns the generic error code of an HTTP status
+func StatusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// Error answers with the generic error code of status
+func Error(ctx *gin.Context, status int, message string) {
+	ErrorWithCode(ctx, status, StatusCode(status), message)
+}
+
+// ErrorWithCode answers with an error envelope carrying code
+func ErrorWithCode(ctx *gin.Context, status int, code string, message string) {
+	ctx.JSON(status, CommonResponse{
+		Code:    status,
+		Message: message,
+		Error:   code,
+	})
+}
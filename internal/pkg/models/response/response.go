@@ -10,13 +10,14 @@ type CommonResponse struct {
 	Code    int         `json:"code"`
 	Data    interface{} `json:"data"`
 	Message string      `json:"message"`
+	Error   string      `json:"error,omitempty"` // Machine-readable error code, set on failures
 }
 
 func Result(ctx *gin.Context, code int, data interface{}, message string) {
 	ctx.JSON(code, CommonResponse{
-		code,
-		data,
-		message,
+		Code:    code,
+		Data:    data,
+		Message: message,
 	})
 }
 
@@ -32,6 +33,10 @@ func OkWithData(ctx *gin.Context, data interface{}) {
 	Result(ctx, http.StatusOK, data, "success")
 }
 
+func Created(ctx *gin.Context, data interface{}) {
+	Result(ctx, http.StatusCreated, data, "success")
+}
+
 func OkWithDetailed(ctx *gin.Context, code int, data interface{}, message string) {
 	Result(ctx, code, data, message)
 }
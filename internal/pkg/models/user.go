@@ -7,17 +7,19 @@ import (
 )
 
 type User struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	Username  string         `gorm:"uniqueIndex;not null;size:100" json:"username"`
-	Email     string         `gorm:"uniqueIndex;not null;size:255" json:"email"`
-	Password  string         `gorm:"not null;size:255" json:"-"` // Hide password in JSON
-	FullName  string         `gorm:"size:255" json:"full_name"`
-	Avatar    string         `gorm:"size:500" json:"avatar"`
-	IsOnline  bool           `gorm:"default:false" json:"is_online"`
-	LastSeen  *time.Time     `json:"last_seen"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                 uint           `gorm:"primaryKey" json:"id"`
+	Username           string         `gorm:"uniqueIndex;not null;size:100" json:"username"`
+	Email              string         `gorm:"uniqueIndex;not null;size:255" json:"email"`
+	Password           string         `gorm:"not null;size:255" json:"-"` // Hide password in JSON
+	FullName           string         `gorm:"size:255" json:"full_name"`
+	Avatar             string         `gorm:"size:500" json:"avatar"`
+	IsOnline           bool           `gorm:"default:false" json:"is_online"`
+	LastSeen           *time.Time     `json:"-"`                                                     // Shown through UserResponse, subject to LastSeenVisibility
+	LastSeenVisibility string         `gorm:"type:varchar(20);not null;default:'everyone'" json:"-"` // everyone, contacts or nobody
+	Admin              bool           `gorm:"not null;default:false" json:"-"`                       // Site administrator, may use the /api/admin endpoints
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name for User model
@@ -25,28 +27,152 @@ func (User) TableName() string {
 	return "users"
 }
 
+// PushSubscription is a browser registered to receive web push
+// notifications for a user
+type PushSubscription struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	Endpoint  string    `gorm:"size:1024;not null;uniqueIndex" json:"endpoint"`
+	P256dh    string    `gorm:"size:255;not null" json:"-"`
+	Auth      string    `gorm:"size:255;not null" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (PushSubscription) TableName() string {
+	return "push_subscriptions"
+}
+
+// BotToken is a long-lived, bot-scoped token a user minted for an
+// integration. Only the token's ID is stored; the token itself is shown once.
+type BotToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"size:100;not null" json:"name"`
+	TokenID    string     `gorm:"size:36;not null;uniqueIndex" json:"-"`      // jti of the JWT
+	GroupIDs   []uint     `gorm:"serializer:json;type:text" json:"group_ids"` // Groups the token is limited to; empty allows all
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (BotToken) TableName() string {
+	return "bot_tokens"
+}
+
+// AllowsGroup reports whether the token may act in the group
+func (t *BotToken) AllowsGroup(groupID uint) bool {
+	if len(t.GroupIDs) == 0 {
+		return true
+	}
+	for _, id := range t.GroupIDs {
+		if id == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+// ContactStatus is the state of a contact relationship
+type ContactStatus string
+
+const (
+	ContactStatusPending  ContactStatus = "pending"
+	ContactStatusAccepted ContactStatus = "accepted"
+)
+
+// Contact links two users. UserID asked ContactUserID to become contacts;
+// once accepted the relationship holds both ways. There is at most one row
+// per pair of users, whichever of them asked.
+type Contact struct {
+	ID            uint          `gorm:"primaryKey" json:"id"`
+	UserID        uint          `gorm:"not null;uniqueIndex:idx_contact_pair" json:"user_id"`
+	ContactUserID uint          `gorm:"not null;uniqueIndex:idx_contact_pair;index" json:"contact_user_id"`
+	Status        ContactStatus `gorm:"type:varchar(20);not null;default:'pending'" json:"status"`
+	AcceptedAt    *time.Time    `json:"accepted_at"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (Contact) TableName() string {
+	return "contacts"
+}
+
+// ContactResponse is a contact or contact request as one of its users sees
+// it. Direction tells pending requests apart: incoming ones await the
+// viewer's answer.
+type ContactResponse struct {
+	User       UserResponse  `json:"user"`
+	Status     ContactStatus `json:"status"`
+	Direction  string        `json:"direction,omitempty"` // incoming or outgoing, for pending requests
+	AcceptedAt *time.Time    `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// Last seen visibility settings
+const (
+	LastSeenEveryone = "everyone"
+	LastSeenContacts = "contacts" // The owner's accepted contacts
+	LastSeenNobody   = "nobody"
+)
+
+// PresenceStatus is the availability a user shows to others
+type PresenceStatus string
+
+const (
+	PresenceOnline    PresenceStatus = "online"
+	PresenceAway      PresenceStatus = "away"
+	PresenceBusy      PresenceStatus = "busy"
+	PresenceInvisible PresenceStatus = "invisible" // Connected, but shown as offline
+	PresenceOffline   PresenceStatus = "offline"   // Shown for disconnected users; cannot be set
+)
+
+// IsSettable reports whether users can pick s as their status
+func (s PresenceStatus) IsSettable() bool {
+	switch s {
+	case PresenceOnline, PresenceAway, PresenceBusy, PresenceInvisible:
+		return true
+	}
+	return false
+}
+
+// Visible returns the status others see for a connected user with status s
+func (s PresenceStatus) Visible() PresenceStatus {
+	if s == PresenceInvisible {
+		return PresenceOffline
+	}
+	return s
+}
+
 // UserResponse is used for API responses without sensitive data
 type UserResponse struct {
-	ID        uint       `json:"id"`
-	Username  string     `json:"username"`
-	Email     string     `json:"email"`
-	FullName  string     `json:"full_name"`
-	Avatar    string     `json:"avatar"`
-	IsOnline  bool       `json:"is_online"`
-	LastSeen  *time.Time `json:"last_seen"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID                 uint           `json:"id"`
+	Username           string         `json:"username"`
+	Email              string         `json:"email"`
+	FullName           string         `json:"full_name"`
+	Avatar             string         `json:"avatar"`
+	IsOnline           bool           `json:"is_online"`
+	Status             PresenceStatus `json:"status,omitempty"`
+	LastSeen           *time.Time     `json:"last_seen"`
+	LastSeenVisibility string         `json:"last_seen_visibility,omitempty"` // Only shown to the user themselves
+	CreatedAt          time.Time      `json:"created_at"`
 }
 
 // ToResponse converts User to UserResponse
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:        u.ID,
-		Username:  u.Username,
-		Email:     u.Email,
-		FullName:  u.FullName,
-		Avatar:    u.Avatar,
-		IsOnline:  u.IsOnline,
-		LastSeen:  u.LastSeen,
-		CreatedAt: u.CreatedAt,
+		ID:                 u.ID,
+		Username:           u.Username,
+		Email:              u.Email,
+		FullName:           u.FullName,
+		Avatar:             u.Avatar,
+		IsOnline:           u.IsOnline,
+		LastSeen:           u.LastSeen,
+		LastSeenVisibility: u.LastSeenVisibility,
+		CreatedAt:          u.CreatedAt,
 	}
 }
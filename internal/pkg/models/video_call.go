@@ -61,6 +61,20 @@ func (VideoCall) TableName() string {
 	return "video_calls"
 }
 
+// ExportedCall is a call as listed in a user's personal data export
+type ExportedCall struct {
+	ID          uint       `json:"id"`
+	Type        CallType   `json:"type"`
+	Status      CallStatus `json:"status"`
+	InitiatorID uint       `json:"initiator_id"`
+	ReceiverID  *uint      `json:"receiver_id,omitempty"`
+	GroupID     *uint      `json:"group_id,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	Duration    *int       `json:"duration,omitempty"` // Duration in seconds
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
 // CallParticipant represents a participant in a video call
 type CallParticipant struct {
 	ID        uint           `gorm:"primaryKey" json:"id"`
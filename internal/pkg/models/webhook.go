@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// Events a webhook can subscribe to
+const (
+	WebhookEventMessageCreated  = "message_created"
+	WebhookEventMemberJoined    = "member_joined"
+	WebhookEventMemberLeft      = "member_left"
+	WebhookEventCallStarted     = "call_started"
+	WebhookEventCallEnded       = "call_ended"
+	WebhookEventMessageReported = "message_reported"
+)
+
+// IsValidWebhookEvent reports whether e is an event webhooks can subscribe to
+func IsValidWebhookEvent(e string) bool {
+	switch e {
+	case WebhookEventMessageCreated, WebhookEventMemberJoined, WebhookEventMemberLeft,
+		WebhookEventCallStarted, WebhookEventCallEnded, WebhookEventMessageReported:
+		return true
+	}
+	return false
+}
+
+// Webhook is a URL that receives the events of conversations its owner
+// takes part in
+type Webhook struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	URL       string    `gorm:"size:2048;not null" json:"url"`
+	Secret    string    `gorm:"size:255;not null" json:"-"` // Key of the X-Signature HMAC
+	Events    []string  `gorm:"serializer:json;type:text;not null" json:"events"`
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name
+func (Webhook) TableName() string {
+	return "webhooks"
+}
+
+// Subscribes reports whether the webhook wants the event
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeadLetter is a delivery that failed every attempt, kept so the
+// owner can inspect or replay it
+type WebhookDeadLetter struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	WebhookID  uint      `gorm:"not null;index" json:"webhook_id"`
+	DeliveryID string    `gorm:"size:36;not null" json:"delivery_id"`
+	Event      string    `gorm:"size:50;not null" json:"event"`
+	Payload    string    `gorm:"type:text;not null" json:"payload"`
+	Attempts   int       `gorm:"not null" json:"attempts"`
+	LastError  string    `gorm:"type:text" json:"last_error"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name
+func (WebhookDeadLetter) TableName() string {
+	return "webhook_dead_letters"
+}
@@ -0,0 +1,37 @@
+package moderation
+
+import "web-api/internal/pkg/config"
+
+// Action is what a content filter decided about a message
+type Action int
+
+const (
+	// Allow keeps the content as sent
+	Allow Action = iota
+	// Mask keeps the message with the offending parts hidden
+	Mask
+	// Reject refuses the message
+	Reject
+)
+
+// Verdict is the outcome of filtering a message's content
+type Verdict struct {
+	Action  Action
+	Content string // Content to store when masked
+}
+
+// ContentFilter checks message content before it is stored
+type ContentFilter interface {
+	// Filter decides whether content may be sent as is, masked or not at
+	// all
+	Filter(content string) Verdict
+}
+
+// New creates a content filter from the configuration. It returns nil when
+// no word list is configured, which disables filtering.
+func New(cfg config.ModerationConfiguration) (ContentFilter, error) {
+	if cfg.WordList == "" {
+		return nil, nil
+	}
+	return LoadWordList(cfg.WordList)
+}
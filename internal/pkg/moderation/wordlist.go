@@ -0,0 +1,89 @@
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// wordPattern matches the words content is split into
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+// WordListFilter masks or rejects messages containing banned words. Words
+// match whole and case-insensitively; a message with a rejected word is
+// refused, while masked words are replaced with asterisks.
+type WordListFilter struct {
+	masked   map[string]bool
+	rejected map[string]bool
+}
+
+// LoadWordList reads a word list file
+func LoadWordList(path string) (*WordListFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open word list: %w", err)
+	}
+	defer file.Close()
+
+	return ParseWordList(file)
+}
+
+// ParseWordList reads a word list: one word per line, blank lines and lines
+// starting with # ignored. Words prefixed with ! reject the message instead
+// of being masked.
+func ParseWordList(r io.Reader) (*WordListFilter, error) {
+	f := &WordListFilter{masked: make(map[string]bool), rejected: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+
+		words := f.masked
+		if strings.HasPrefix(word, "!") {
+			word, words = strings.TrimSpace(word[1:]), f.rejected
+		}
+		if word == "" || wordPattern.FindString(word) != word {
+			return nil, fmt.Errorf("word list line %d: %q is not a single word", line, word)
+		}
+		words[strings.ToLower(word)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Filter rejects content containing a rejected word and masks the masked
+// words it contains
+func (f *WordListFilter) Filter(content string) Verdict {
+	var masked strings.Builder
+	last := 0
+
+	for _, loc := range wordPattern.FindAllStringIndex(content, -1) {
+		word := strings.ToLower(content[loc[0]:loc[1]])
+		if f.rejected[word] {
+			return Verdict{Action: Reject}
+		}
+		if !f.masked[word] {
+			continue
+		}
+
+		masked.WriteString(content[last:loc[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(content[loc[0]:loc[1]])))
+		last = loc[1]
+	}
+
+	if last == 0 {
+		return Verdict{Action: Allow, Content: content}
+	}
+	masked.WriteString(content[last:])
+	return Verdict{Action: Mask, Content: masked.String()}
+}
@@ -0,0 +1,82 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"web-api/internal/pkg/config"
+)
+
+const testWordList = `
+# masked words
+darn
+heck
+
+# rejected words
+!scam
+`
+
+func TestWordListFilter(t *testing.T) {
+	filter, err := ParseWordList(strings.NewReader(testWordList))
+	if err != nil {
+		t.Fatalf("ParseWordList: %v", err)
+	}
+
+	tests := []struct {
+		content string
+		want    Verdict
+	}{
+		{"hello there", Verdict{Action: Allow, Content: "hello there"}},
+		{"well darn it", Verdict{Action: Mask, Content: "well **** it"}},
+		{"DARN, Heck!", Verdict{Action: Mask, Content: "****, ****!"}},
+		{"darned heckler", Verdict{Action: Allow, Content: "darned heckler"}}, // Only whole words
+		{"darn, a SCAM", Verdict{Action: Reject}},
+	}
+	for _, tt := range tests {
+		if got := filter.Filter(tt.content); got != tt.want {
+			t.Errorf("Filter(%q) = %+v, want %+v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestWordListMasksCharactersNotBytes(t *testing.T) {
+	filter, err := ParseWordList(strings.NewReader("über\n"))
+	if err != nil {
+		t.Fatalf("ParseWordList: %v", err)
+	}
+	if got := filter.Filter("so Über cool"); got.Content != "so **** cool" {
+		t.Fatalf("masked to %q, want one asterisk per character", got.Content)
+	}
+}
+
+func TestParseWordListRejectsPhrases(t *testing.T) {
+	for _, list := range []string{"two words\n", "!\n", "ok\nno-way\n"} {
+		if _, err := ParseWordList(strings.NewReader(list)); err == nil {
+			t.Errorf("ParseWordList(%q) accepted an entry that is not a single word", list)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if filter, err := New(config.ModerationConfiguration{}); filter != nil || err != nil {
+		t.Fatalf("New without a word list = %v, %v; want no filter", filter, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte(testWordList), 0o600); err != nil {
+		t.Fatalf("write word list: %v", err)
+	}
+	filter, err := New(config.ModerationConfiguration{WordList: path})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := filter.Filter("scam"); got.Action != Reject {
+		t.Fatalf("loaded filter let %+v through, want the listed word rejected", got)
+	}
+
+	if _, err := New(config.ModerationConfiguration{WordList: filepath.Join(t.TempDir(), "missing.txt")}); err == nil {
+		t.Fatal("New with a missing word list succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+// Package netguard keeps the requests the server makes to URLs chosen by
+// users, such as link previews, webhooks and push endpoints, away from
+// loopback, private and other internal addresses.
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxRedirects bounds the redirects a guarded client follows
+const maxRedirects = 5
+
+// ErrForbiddenAddress is returned for URLs resolving to private, loopback
+// or otherwise internal addresses
+var ErrForbiddenAddress = errors.New("address is not publicly routable")
+
+// NewClient creates an HTTP client that only connects to public addresses,
+// including when it follows redirects
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: Control,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// No proxy: the guard has to see the real destination
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return CheckURL(req.URL)
+		},
+	}
+}
+
+// CheckURL only lets absolute http(s) URLs through whose host, when it is
+// an IP address, is public. Hostnames are checked when they are dialled.
+func CheckURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("only http and https URLs are allowed")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !IsPublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Control is a net.Dialer Control hook. It runs after DNS resolution and
+// before connecting, so it sees the address actually dialled, whatever the
+// hostname resolved to.
+func Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP reports whether ip is a publicly routable unicast address
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
@@ -0,0 +1,71 @@
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34:8080/", true},
+		{"http://127.0.0.1:6379/", false},
+		{"http://[::1]/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.0.0.5/", false},
+		{"ftp://example.com/", false},
+		{"/relative", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tt.url, err)
+		}
+		if err := CheckURL(u); (err == nil) != tt.want {
+			t.Errorf("CheckURL(%s) = %v, want allowed %v", tt.url, err, tt.want)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	if _, err := NewClient(time.Second).Get(srv.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("GET %s: err = %v, want %v", srv.URL, err, ErrForbiddenAddress)
+	}
+}
@@ -0,0 +1,51 @@
+package push
+
+import "sync"
+
+// FakeSender records notifications instead of sending them. It is meant
+// for tests.
+type FakeSender struct {
+	mu   sync.Mutex
+	sent []FakeNotification
+	gone map[string]bool
+}
+
+// FakeNotification is a notification recorded by FakeSender
+type FakeNotification struct {
+	Subscription Subscription
+	Payload      []byte
+}
+
+// NewFakeSender creates a sender that records notifications
+func NewFakeSender() *FakeSender {
+	return &FakeSender{gone: make(map[string]bool)}
+}
+
+// Send records the notification, or fails for endpoints marked gone
+func (s *FakeSender) Send(sub Subscription, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gone[sub.Endpoint] {
+		return ErrSubscriptionGone
+	}
+	s.sent = append(s.sent, FakeNotification{Subscription: sub, Payload: payload})
+	return nil
+}
+
+// Sent returns the notifications recorded so far
+func (s *FakeSender) Sent() []FakeNotification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]FakeNotification(nil), s.sent...)
+}
+
+// MarkGone makes later sends to the endpoint fail as if the subscription
+// had expired
+func (s *FakeSender) MarkGone(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gone[endpoint] = true
+}
@@ -0,0 +1,38 @@
+package push
+
+import (
+	"errors"
+
+	"web-api/internal/pkg/config"
+)
+
+// ErrSubscriptionGone is returned when the push service no longer knows a
+// subscription, e.g. because the user revoked permission
+var ErrSubscriptionGone = errors.New("push subscription is gone")
+
+// Subscription is where a browser receives push messages, as reported by
+// its PushManager
+type Subscription struct {
+	Endpoint string
+	P256dh   string // Public key of the browser, base64url encoded
+	Auth     string // Authentication secret, base64url encoded
+}
+
+// Sender delivers notifications to push services
+type Sender interface {
+	// Send encrypts payload for the subscription and posts it to the
+	// subscription's endpoint
+	Send(sub Subscription, payload []byte) error
+}
+
+// New creates a sender from the configuration. It returns nil when no
+// VAPID keys are configured, which disables web push.
+func New(cfg config.PushConfiguration) (Sender, error) {
+	if cfg.VAPIDPublicKey == "" && cfg.VAPIDPrivateKey == "" {
+		return nil, nil
+	}
+	if cfg.VAPIDPublicKey == "" || cfg.VAPIDPrivateKey == "" {
+		return nil, errors.New("push needs both vapid_public_key and vapid_private_key")
+	}
+	return NewVAPIDSender(cfg), nil
+}
@@ -0,0 +1,103 @@
+package push
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/netguard"
+)
+
+// browserSubscription makes a subscription with keys a browser could have
+// generated, pointing at the endpoint
+func browserSubscription(t *testing.T, endpoint string) Subscription {
+	t.Helper()
+
+	_, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatalf("generate auth: %v", err)
+	}
+
+	return Subscription{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)),
+		Auth:     base64.RawURLEncoding.EncodeToString(auth),
+	}
+}
+
+func TestVAPIDSenderPostsSignedPayload(t *testing.T) {
+	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("GenerateVAPIDKeys: %v", err)
+	}
+
+	status := http.StatusCreated
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sender := NewVAPIDSender(config.PushConfiguration{
+		VAPIDPublicKey:  publicKey,
+		VAPIDPrivateKey: privateKey,
+		Subject:         "mailto:ops@example.com",
+		TTL:             time.Minute,
+	})
+	sub := browserSubscription(t, srv.URL)
+
+	// The push service listens on loopback, which the real client refuses
+	if err := sender.Send(sub, []byte("{}")); !errors.Is(err, netguard.ErrForbiddenAddress) {
+		t.Fatalf("Send to loopback: err = %v, want %v", err, netguard.ErrForbiddenAddress)
+	}
+	sender.options.HTTPClient = &http.Client{Timeout: time.Second}
+
+	if err := sender.Send(sub, []byte(`{"title":"alice"}`)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	r := <-requests
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "vapid t=") || !strings.Contains(auth, "k="+publicKey) {
+		t.Fatalf("Authorization %q, want a VAPID header with our public key", auth)
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") != "60" {
+		t.Fatalf("headers %v, want an aes128gcm payload kept for 60s", r.Header)
+	}
+
+	status = http.StatusGone
+	if err := sender.Send(sub, []byte("{}")); !errors.Is(err, ErrSubscriptionGone) {
+		t.Fatalf("Send to a gone subscription: err = %v, want %v", err, ErrSubscriptionGone)
+	}
+	<-requests
+
+	status = http.StatusInternalServerError
+	if err := sender.Send(sub, []byte("{}")); err == nil || errors.Is(err, ErrSubscriptionGone) {
+		t.Fatalf("Send to a failing push service: err = %v, want a plain error", err)
+	}
+	<-requests
+}
+
+func TestNewNeedsBothKeys(t *testing.T) {
+	if sender, err := New(config.PushConfiguration{}); sender != nil || err != nil {
+		t.Fatalf("New without keys = %v, %v; want push disabled", sender, err)
+	}
+	if _, err := New(config.PushConfiguration{VAPIDPublicKey: "public"}); err == nil {
+		t.Fatal("New accepted a public key without its private key")
+	}
+	if sender, err := New(config.PushConfiguration{VAPIDPublicKey: "public", VAPIDPrivateKey: "private"}); sender == nil || err != nil {
+		t.Fatalf("New with both keys = %v, %v; want a sender", sender, err)
+	}
+}
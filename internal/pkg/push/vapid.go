@@ -0,0 +1,63 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/netguard"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// defaultTTL is how long push services keep a notification for an
+// unreachable browser when no TTL is configured
+const defaultTTL = 24 * time.Hour
+
+// VAPIDSender sends notifications signed with the server's VAPID keys
+type VAPIDSender struct {
+	options webpush.Options
+}
+
+// NewVAPIDSender creates a sender using the configured VAPID key pair. It
+// only connects to public addresses, whatever endpoint a browser gave.
+func NewVAPIDSender(cfg config.PushConfiguration) *VAPIDSender {
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	return &VAPIDSender{
+		options: webpush.Options{
+			HTTPClient:      netguard.NewClient(10 * time.Second),
+			Subscriber:      cfg.Subject,
+			VAPIDPublicKey:  cfg.VAPIDPublicKey,
+			VAPIDPrivateKey: cfg.VAPIDPrivateKey,
+			TTL:             int(ttl / time.Second),
+		},
+	}
+}
+
+// Send encrypts and posts the payload
+func (s *VAPIDSender) Send(sub Subscription, payload []byte) error {
+	options := s.options
+	resp, err := webpush.SendNotification(payload, &webpush.Subscription{
+		Endpoint: sub.Endpoint,
+		Keys:     webpush.Keys{P256dh: sub.P256dh, Auth: sub.Auth},
+	}, &options)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
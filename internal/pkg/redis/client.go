@@ -2,15 +2,23 @@ package redis
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
+// PresenceTTL is how long a user stays online without a heartbeat. It
+// covers instances that crash before they can mark their users offline.
+const PresenceTTL = 90 * time.Second
+
 var (
 	Client *redis.Client
 	ctx    = context.Background()
@@ -24,8 +32,26 @@ type Config struct {
 	DB       int
 }
 
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.Host == "" {
+		return errors.New("redis host is required")
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid redis port %q", c.Port)
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("invalid redis db %d", c.DB)
+	}
+	return nil
+}
+
 // Setup initializes Redis client
 func Setup(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
 	addr := fmt.Sprintf("%s:%s", config.Host, config.Port)
 
 	Client = redis.NewClient(&redis.Options{
@@ -38,104 +64,233 @@ func Setup(config Config) error {
 	// Test connection
 	_, err := Client.Ping(ctx).Result()
 	if err != nil {
-		return fmt.Errorf("failed to connect to Redis: %w", err)
+		return fmt.Errorf("failed to connect to Redis at %s: %w", addr, err)
 	}
 
 	logrus.Info("✓ Connected to Redis successfully")
+	startPublishWorkers()
 	return nil
 }
 
-// SetUserOnline sets user as online in Redis
-func SetUserOnline(userID uint) error {
-	key := fmt.Sprintf("user:online:%d", userID)
-	return Client.Set(ctx, key, "1", 0).Err()
+// Ping checks that Redis answers commands
+func Ping(c context.Context) error {
+	return Client.Ping(c).Err()
 }
 
-// SetUserOffline removes user from online list
-func SetUserOffline(userID uint) error {
-	key := fmt.Sprintf("user:online:%d", userID)
-	return Client.Del(ctx, key).Err()
+// SetUserOnline marks a user online on an instance. Each instance holding
+// a connection of the user has its own entry in the user's online set,
+// which lapses after PresenceTTL unless a heartbeat renews it, so a crashed
+// instance cannot keep the user online.
+func SetUserOnline(userID uint, instanceID string) error {
+	key := onlineKey(userID)
+	now := time.Now()
+
+	pipe := Client.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Add(PresenceTTL).Unix()), Member: instanceID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Unix(), 10))
+	pipe.Expire(ctx, key, PresenceTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// SetUserOffline removes an instance from the user's online set and
+// reports whether the user is still online through another instance
+func SetUserOffline(userID uint, instanceID string) (bool, error) {
+	key := onlineKey(userID)
+
+	pipe := Client.TxPipeline()
+	pipe.ZRem(ctx, key, instanceID)
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+	remaining := pipe.ZCard(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return remaining.Val() > 0, nil
+}
+
+// onlineKey is the set of instances a user is connected to
+func onlineKey(userID uint) string {
+	return fmt.Sprintf("user:online:%d", userID)
+}
+
+// liveInstances counts the entries of an online set that have not lapsed
+func liveInstances(pipe redis.Pipeliner, key string) *redis.IntCmd {
+	return pipe.ZCount(ctx, key, "("+strconv.FormatInt(time.Now().Unix(), 10), "+inf")
 }
 
-// IsUserOnline checks if user is online
+// ClearPresence removes every presence key of a user: online flag, status
+// and connection info
+func ClearPresence(userID uint) error {
+	return Client.Del(ctx,
+		onlineKey(userID),
+		fmt.Sprintf("user:status:%d", userID),
+		fmt.Sprintf("user:status:auto:%d", userID),
+		fmt.Sprintf("ws:connection:%d", userID),
+	).Err()
+}
+
+// IsUserOnline checks if user is online, i.e. some instance sent a
+// heartbeat for them within PresenceTTL
 func IsUserOnline(userID uint) (bool, error) {
-	key := fmt.Sprintf("user:online:%d", userID)
-	result, err := Client.Exists(ctx, key).Result()
+	statuses, err := OnlineStatuses([]uint{userID})
 	if err != nil {
 		return false, err
 	}
-	return result > 0, nil
+	return statuses[userID], nil
 }
 
-// GetOnlineUsers returns list of online user IDs
-func GetOnlineUsers() ([]string, error) {
-	pattern := "user:online:*"
-	var userIDs []string
-
-	iter := Client.Scan(ctx, 0, pattern, 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-		// Extract user ID from key (user:online:123 -> 123)
-		var userID string
-		fmt.Sscanf(key, "user:online:%s", &userID)
-		userIDs = append(userIDs, userID)
+// OnlineStatuses reports which of the given users are online, in one round
+// trip
+func OnlineStatuses(userIDs []uint) (map[uint]bool, error) {
+	statuses := make(map[uint]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return statuses, nil
 	}
 
-	if err := iter.Err(); err != nil {
+	pipe := Client.Pipeline()
+	counts := make([]*redis.IntCmd, len(userIDs))
+	for i, userID := range userIDs {
+		counts[i] = liveInstances(pipe, onlineKey(userID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, err
 	}
 
-	return userIDs, nil
+	for i, userID := range userIDs {
+		statuses[userID] = counts[i].Val() > 0
+	}
+	return statuses, nil
 }
 
-// SetUserTyping sets user as typing in a conversation
-func SetUserTyping(userID uint, conversationID string) error {
-	key := fmt.Sprintf("typing:%s:%d", conversationID, userID)
-	return Client.Set(ctx, key, "1", 10*time.Second).Err()
+// SetPresenceStatus stores a user's presence status. auto marks a status
+// set by idle detection rather than by the user. The status outlives the
+// user's connections.
+func SetPresenceStatus(userID uint, status string, auto bool) error {
+	autoKey := fmt.Sprintf("user:status:auto:%d", userID)
+
+	pipe := Client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("user:status:%d", userID), status, 0)
+	if auto {
+		pipe.Set(ctx, autoKey, "1", 0)
+	} else {
+		pipe.Del(ctx, autoKey)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-// CleanupExpiredTyping removes expired typing indicators
-func CleanupExpiredTyping() error {
-	pattern := "typing:*:*"
-	var keysToDelete []string
+// GetPresenceStatus returns a user's stored presence status, empty if none
+// was set, and whether idle detection set it
+func GetPresenceStatus(userID uint) (string, bool, error) {
+	values, err := Client.MGet(ctx,
+		fmt.Sprintf("user:status:%d", userID),
+		fmt.Sprintf("user:status:auto:%d", userID),
+	).Result()
+	if err != nil {
+		return "", false, err
+	}
 
-	iter := Client.Scan(ctx, 0, pattern, 0).Iterator()
+	status, _ := values[0].(string)
+	return status, values[1] != nil, nil
+}
+
+// PresenceStatuses returns the stored presence statuses of several users,
+// empty for those who never set one
+func PresenceStatuses(userIDs []uint) (map[uint]string, error) {
+	statuses := make(map[uint]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return statuses, nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = fmt.Sprintf("user:status:%d", userID)
+	}
+
+	values, err := Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, userID := range userIDs {
+		statuses[userID], _ = values[i].(string)
+	}
+	return statuses, nil
+}
+
+// GetOnlineUsers returns list of online user IDs across all instances.
+// Users whose heartbeats lapsed on every instance are not listed.
+func GetOnlineUsers() ([]uint, error) {
+	prefix := "user:online:"
+	var keys []string
+	var userIDs []uint
+
+	iter := Client.Scan(ctx, 0, prefix+"*", 0).Iterator()
 	for iter.Next(ctx) {
-		key := iter.Val()
-		// Check if key has expired TTL
-		ttl, err := Client.TTL(ctx, key).Result()
-		if err != nil {
-			continue
-		}
-		// If TTL is -2, key doesn't exist (expired and deleted)
-		// If TTL is -1, key exists but has no expiration
-		// Only delete keys that have expired (TTL < 0 and exists)
-		if ttl < 0 && ttl != -1 {
-			keysToDelete = append(keysToDelete, key)
-		}
+		keys = append(keys, iter.Val())
 	}
 
 	if err := iter.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(keysToDelete) > 0 {
-		return Client.Del(ctx, keysToDelete...).Err()
+	if len(keys) == 0 {
+		return userIDs, nil
 	}
-	return nil
+
+	// Online sets outlive a crashed instance until their key expires
+	pipe := Client.Pipeline()
+	counts := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		counts[i] = liveInstances(pipe, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if counts[i].Val() == 0 {
+			continue
+		}
+
+		// Extract user ID from key (user:online:123 -> 123)
+		userID, err := strconv.ParseUint(strings.TrimPrefix(key, prefix), 10, 32)
+		if err != nil {
+			logrus.Warnf("Ignoring malformed online key %q", key)
+			continue
+		}
+		userIDs = append(userIDs, uint(userID))
+	}
+
+	return userIDs, nil
 }
 
-// GetTypingUsers gets users currently typing in a conversation
-func GetTypingUsers(conversationID string) ([]string, error) {
-	pattern := fmt.Sprintf("typing:%s:*", conversationID)
-	var userIDs []string
+// SetUserTyping sets user as typing in a conversation. The key expires on
+// its own after 10 seconds without a follow-up typing event.
+func SetUserTyping(userID uint, conversationID string) error {
+	key := fmt.Sprintf("typing:%s:%d", conversationID, userID)
+	return Client.Set(ctx, key, "1", 10*time.Second).Err()
+}
 
-	iter := Client.Scan(ctx, 0, pattern, 0).Iterator()
+// ClearUserTyping removes a user's typing status in a conversation
+func ClearUserTyping(userID uint, conversationID string) error {
+	key := fmt.Sprintf("typing:%s:%d", conversationID, userID)
+	return Client.Del(ctx, key).Err()
+}
+
+// GetTypingUsers gets users currently typing in a conversation. Expired
+// typing keys are gone from Redis, so only active typists are returned.
+func GetTypingUsers(conversationID string) ([]uint, error) {
+	prefix := fmt.Sprintf("typing:%s:", conversationID)
+	var userIDs []uint
+
+	iter := Client.Scan(ctx, 0, prefix+"*", 0).Iterator()
 	for iter.Next(ctx) {
-		key := iter.Val()
-		var userID string
-		fmt.Sscanf(key, "typing:"+conversationID+":%s", &userID)
-		userIDs = append(userIDs, userID)
+		userID, err := strconv.ParseUint(strings.TrimPrefix(iter.Val(), prefix), 10, 32)
+		if err != nil {
+			continue
+		}
+		userIDs = append(userIDs, uint(userID))
 	}
 
 	if err := iter.Err(); err != nil {
@@ -147,7 +302,8 @@ func GetTypingUsers(conversationID string) ([]string, error) {
 
 // PublishMessage publishes a message to a channel for pub/sub
 func PublishMessage(channel string, message interface{}) error {
-	return Client.Publish(ctx, channel, message).Err()
+	_, err := publish(channel, message)
+	return err
 }
 
 // Subscribe subscribes to a channel
@@ -179,7 +335,8 @@ func PublishWebSocketMessage(channel string, messageData map[string]interface{})
 	if err != nil {
 		return err
 	}
-	return Client.Publish(ctx, channel, string(jsonData)).Err()
+	_, err = publish(channel, string(jsonData))
+	return err
 }
 
 // SubscribeWebSocket subscribes to WebSocket message channel
@@ -212,18 +369,59 @@ func GetUserSession(userID uint) (map[string]interface{}, error) {
 
 // BroadcastToChannel broadcasts a message to a specific channel
 func BroadcastToChannel(channel string, event string, data map[string]interface{}) error {
+	_, err := PublishEvent(channel, event, data)
+	return err
+}
+
+// PublishEvent broadcasts a message to a specific channel and returns the
+// number of subscribers that received it
+func PublishEvent(channel string, event string, data map[string]interface{}) (int64, error) {
+	return PublishEventFrom(channel, "", event, data)
+}
+
+// PublishEventFrom is like PublishEvent but tags the message with the
+// instance that published it, so that instance's subscribers can skip it
+func PublishEventFrom(channel, origin, event string, data map[string]interface{}) (int64, error) {
 	message := map[string]interface{}{
 		"event":     event,
 		"data":      data,
 		"timestamp": time.Now().Unix(),
 	}
+	if origin != "" {
+		message["origin"] = origin
+	}
 
 	jsonData, err := json.Marshal(message)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	return publish(channel, string(jsonData))
+}
+
+// PublishEventToChannels publishes one event to several channels in a
+// single round trip, marshalling it once. It returns the number of
+// subscribers that received it on each channel, in order.
+func PublishEventToChannels(channels []string, origin, event string, data map[string]interface{}) ([]int64, error) {
+	if len(channels) == 0 {
+		return nil, nil
+	}
+
+	message := map[string]interface{}{
+		"event":     event,
+		"data":      data,
+		"timestamp": time.Now().Unix(),
+	}
+	if origin != "" {
+		message["origin"] = origin
 	}
 
-	return Client.Publish(ctx, channel, string(jsonData)).Err()
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return publishToChannels(channels, string(jsonData))
 }
 
 // GetActiveConnections gets all active WebSocket connections
@@ -248,3 +446,321 @@ func GetActiveConnections() ([]uint, error) {
 
 	return userIDs, nil
 }
+
+// BufferICECandidate queues an ICE candidate that arrived before its call
+// was ready to receive it
+func BufferICECandidate(callID uint, payload string) error {
+	key := fmt.Sprintf("call:ice:%d", callID)
+
+	pipe := Client.TxPipeline()
+	pipe.RPush(ctx, key, payload)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// PopICECandidates returns and clears the buffered ICE candidates of a call
+func PopICECandidates(callID uint) ([]string, error) {
+	key := fmt.Sprintf("call:ice:%d", callID)
+
+	pipe := Client.TxPipeline()
+	values := pipe.LRange(ctx, key, 0, -1)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return values.Val(), nil
+}
+
+// QueuePendingEvent stores an event for an offline user. Only the newest
+// maxLen events are kept.
+func QueuePendingEvent(userID uint, payload []byte, maxLen int) error {
+	key := fmt.Sprintf("ws:pending:%d", userID)
+
+	pipe := Client.TxPipeline()
+	pipe.RPush(ctx, key, payload)
+	pipe.LTrim(ctx, key, int64(-maxLen), -1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// PopPendingEvents returns and clears the queued events of a user, oldest first
+func PopPendingEvents(userID uint) ([]string, error) {
+	key := fmt.Sprintf("ws:pending:%d", userID)
+
+	pipe := Client.TxPipeline()
+	values := pipe.LRange(ctx, key, 0, -1)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return values.Val(), nil
+}
+
+// tokenBucketScript refills a bucket by elapsed time, then tries to take one
+// token. It returns {allowed, milliseconds until a token is available}.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+
+return {allowed, retry}
+`)
+
+// AllowRequest takes a token from the rate-limit bucket at key, refilled at
+// rate tokens per second up to burst. When no token is left it reports how
+// long until one is.
+func AllowRequest(key string, rate float64, burst int) (bool, time.Duration, error) {
+	result, err := tokenBucketScript.Run(ctx, Client, []string{key}, rate, burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// floodScript counts ARGV[5] messages in a sender's sliding window, a
+// sorted set scored by send time. When the window has no room for all of
+// them, none is counted and the sender is held off for ARGV[4] ms. It
+// returns the milliseconds left to wait, or 0 when the messages were counted.
+var floodScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local count = tonumber(ARGV[5])
+
+local wait = redis.call("PTTL", KEYS[2])
+if wait > 0 then
+	return wait
+end
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) + count > tonumber(ARGV[3]) then
+	redis.call("SET", KEYS[2], "1", "PX", ARGV[4])
+	return tonumber(ARGV[4])
+end
+
+for i = 1, count do
+	redis.call("ZADD", KEYS[1], now, ARGV[6] .. ":" .. i)
+end
+redis.call("PEXPIRE", KEYS[1], window)
+return 0
+`)
+
+// CheckFlood counts count messages sent by a user against limit messages
+// per window, all or none of them. A user over the limit must wait cooldown
+// before sending again; the time left is returned, or 0 when the messages
+// may be sent.
+func CheckFlood(userID uint, count, limit int, window, cooldown time.Duration) (time.Duration, error) {
+	now := time.Now()
+	keys := []string{fmt.Sprintf("flood:%d", userID), fmt.Sprintf("flood:wait:%d", userID)}
+
+	wait, err := floodScript.Run(ctx, Client, keys,
+		now.UnixMilli(), window.Milliseconds(), limit, cooldown.Milliseconds(), count, now.UnixNano()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// StoreRefreshToken records a refresh token ID as valid for ttl
+func StoreRefreshToken(userID uint, tokenID string, ttl time.Duration) error {
+	userKey := fmt.Sprintf("refresh:user:%d", userID)
+
+	pipe := Client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("refresh:%s", tokenID), userID, ttl)
+	pipe.SAdd(ctx, userKey, tokenID)
+	pipe.Expire(ctx, userKey, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// IsRefreshTokenValid checks that a refresh token ID has not been revoked
+func IsRefreshTokenValid(tokenID string) (bool, error) {
+	result, err := Client.Exists(ctx, fmt.Sprintf("refresh:%s", tokenID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return result > 0, nil
+}
+
+// RevokeRefreshToken invalidates a single refresh token. It reports whether
+// the token was still valid, so concurrent refreshes cannot both succeed.
+func RevokeRefreshToken(userID uint, tokenID string) (bool, error) {
+	pipe := Client.TxPipeline()
+	deleted := pipe.Del(ctx, fmt.Sprintf("refresh:%s", tokenID))
+	pipe.SRem(ctx, fmt.Sprintf("refresh:user:%d", userID), tokenID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return deleted.Val() > 0, nil
+}
+
+// RevokeUserRefreshTokens invalidates every refresh token of a user
+func RevokeUserRefreshTokens(userID uint) error {
+	userKey := fmt.Sprintf("refresh:user:%d", userID)
+
+	tokenIDs, err := Client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userKey}
+	for _, tokenID := range tokenIDs {
+		keys = append(keys, fmt.Sprintf("refresh:%s", tokenID))
+	}
+
+	return Client.Del(ctx, keys...).Err()
+}
+
+// BlacklistToken rejects a token ID until the token would have expired anyway
+func BlacklistToken(tokenID string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return Client.Set(ctx, fmt.Sprintf("blacklist:%s", tokenID), "1", ttl).Err()
+}
+
+// RevokeUserTokens rejects every token of a user issued up to now, to the
+// microsecond. The marker only has to outlive the longest-lived token.
+func RevokeUserTokens(userID uint, ttl time.Duration) error {
+	key := fmt.Sprintf("revoked:user:%d", userID)
+	return Client.Set(ctx, key, time.Now().UnixMicro(), ttl).Err()
+}
+
+// IsTokenRevoked checks whether a token was logged out or issued before its
+// user revoked all tokens. issuedAt is a Unix time in microseconds.
+func IsTokenRevoked(userID uint, tokenID string, issuedAt int64) (bool, error) {
+	pipe := Client.Pipeline()
+	blacklisted := pipe.Exists(ctx, fmt.Sprintf("blacklist:%s", tokenID))
+	revokedAt := pipe.Get(ctx, fmt.Sprintf("revoked:user:%d", userID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	if blacklisted.Val() > 0 {
+		return true, nil
+	}
+
+	if cutoff, err := revokedAt.Int64(); err == nil && issuedAt <= cutoff {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// passwordResetKey hashes a reset token into its key, so Redis never holds
+// a token that could be used as is
+func passwordResetKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "password_reset:" + hex.EncodeToString(sum[:])
+}
+
+// StorePasswordResetToken records token as resetting userID's password for
+// ttl. The user's previous token stops working.
+func StorePasswordResetToken(userID uint, token string, ttl time.Duration) error {
+	userKey := fmt.Sprintf("password_reset:user:%d", userID)
+
+	previous, err := Client.Get(ctx, userKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	pipe := Client.TxPipeline()
+	if previous != "" {
+		pipe.Del(ctx, previous)
+	}
+	pipe.Set(ctx, passwordResetKey(token), userID, ttl)
+	pipe.Set(ctx, userKey, passwordResetKey(token), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ConsumePasswordResetToken redeems a reset token and returns the user it
+// was issued to. A token works once: ok is false when it is unknown,
+// expired or already used.
+func ConsumePasswordResetToken(token string) (userID uint, ok bool, err error) {
+	id, err := Client.GetDel(ctx, passwordResetKey(token)).Uint64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if err := Client.Del(ctx, fmt.Sprintf("password_reset:user:%d", id)).Err(); err != nil {
+		return 0, false, err
+	}
+	return uint(id), true, nil
+}
+
+// linkPreviewKey hashes the URL, which may be long, into the cache key
+func linkPreviewKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "linkpreview:" + hex.EncodeToString(sum[:])
+}
+
+// CacheLinkPreview stores the JSON preview of a URL
+func CacheLinkPreview(url string, payload []byte, ttl time.Duration) error {
+	return Client.Set(ctx, linkPreviewKey(url), payload, ttl).Err()
+}
+
+// GetLinkPreview returns the cached JSON preview of a URL, or nil if none
+// is cached
+func GetLinkPreview(url string) ([]byte, error) {
+	payload, err := Client.Get(ctx, linkPreviewKey(url)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return payload, err
+}
+
+// nextSequenceScript increments a conversation's message counter. A missing
+// counter is seeded with ARGV[1] first, or nil is returned when no seed was
+// given so the caller can load one.
+var nextSequenceScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	if ARGV[1] == "" then
+		return false
+	end
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return redis.call("INCR", KEYS[1])
+`)
+
+// NextSequence returns the next message sequence number of a conversation.
+// If the counter was lost, it continues from the highest number already
+// assigned, as loaded by highest.
+func NextSequence(conversationKey string, highest func() (int64, error)) (int64, error) {
+	key := "seq:" + conversationKey
+
+	seq, err := nextSequenceScript.Run(ctx, Client, []string{key}, "").Int64()
+	if err != redis.Nil {
+		return seq, err
+	}
+
+	floor, err := highest()
+	if err != nil {
+		return 0, err
+	}
+	return nextSequenceScript.Run(ctx, Client, []string{key}, floor).Int64()
+}
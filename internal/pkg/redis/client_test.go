@@ -0,0 +1,137 @@
+package redis
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// setupClient points the package at an in-process Redis for the duration
+// of the test
+func setupClient(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), Protocol: 2, MaxRetries: -1})
+
+	prev := Client
+	Client = client
+	t.Cleanup(func() {
+		Client = prev
+		client.Close()
+	})
+	return mr
+}
+
+func TestOnlineKeyExpiresWithoutHeartbeat(t *testing.T) {
+	mr := setupClient(t)
+
+	for _, userID := range []uint{1, 2} {
+		if err := SetUserOnline(userID, "instance-a"); err != nil {
+			t.Fatalf("SetUserOnline: %v", err)
+		}
+	}
+	if online, err := GetOnlineUsers(); err != nil || len(online) != 2 {
+		t.Fatalf("GetOnlineUsers = %v, %v, want both users", online, err)
+	}
+
+	// The instance crashed: nothing renews the keys
+	mr.FastForward(PresenceTTL + time.Second)
+
+	if online, err := GetOnlineUsers(); err != nil || len(online) != 0 {
+		t.Fatalf("GetOnlineUsers = %v, %v, want nobody after the TTL", online, err)
+	}
+	if online, err := IsUserOnline(1); err != nil || online {
+		t.Fatalf("IsUserOnline = %v, %v, want false after the TTL", online, err)
+	}
+}
+
+func TestLapsedInstanceDoesNotKeepUserOnline(t *testing.T) {
+	mr := setupClient(t)
+
+	if err := SetUserOnline(1, "instance-a"); err != nil {
+		t.Fatalf("SetUserOnline: %v", err)
+	}
+	// instance-b crashed after its last heartbeat lapsed, while the key
+	// itself is kept alive by instance-a
+	lapsed := float64(time.Now().Add(-time.Second).Unix())
+	if _, err := mr.ZAdd(onlineKey(1), lapsed, "instance-b"); err != nil {
+		t.Fatalf("ZAdd: %v", err)
+	}
+
+	stillOnline, err := SetUserOffline(1, "instance-a")
+	if err != nil {
+		t.Fatalf("SetUserOffline: %v", err)
+	}
+	if stillOnline {
+		t.Fatal("user still online through a lapsed instance")
+	}
+	if online, err := GetOnlineUsers(); err != nil || len(online) != 0 {
+		t.Fatalf("GetOnlineUsers = %v, %v, want nobody", online, err)
+	}
+}
+
+func TestGetTypingUsersDropsExpiredTypists(t *testing.T) {
+	mr := setupClient(t)
+
+	for _, userID := range []uint{1, 2} {
+		if err := SetUserTyping(userID, "group_5"); err != nil {
+			t.Fatalf("SetUserTyping: %v", err)
+		}
+	}
+	if err := SetUserTyping(3, "group_50"); err != nil {
+		t.Fatalf("SetUserTyping: %v", err)
+	}
+
+	// User 2 keeps typing, user 1 went quiet
+	mr.FastForward(6 * time.Second)
+	if err := SetUserTyping(2, "group_5"); err != nil {
+		t.Fatalf("SetUserTyping: %v", err)
+	}
+	mr.FastForward(5 * time.Second)
+
+	typing, err := GetTypingUsers("group_5")
+	if err != nil {
+		t.Fatalf("GetTypingUsers: %v", err)
+	}
+	if len(typing) != 1 || typing[0] != 2 {
+		t.Fatalf("typing = %v, want only user 2", typing)
+	}
+
+	if err := ClearUserTyping(2, "group_5"); err != nil {
+		t.Fatalf("ClearUserTyping: %v", err)
+	}
+	if typing, err := GetTypingUsers("group_5"); err != nil || len(typing) != 0 {
+		t.Fatalf("typing = %v, %v, want nobody after clearing", typing, err)
+	}
+}
+
+func TestGetOnlineUsersSkipsMalformedKeys(t *testing.T) {
+	mr := setupClient(t)
+
+	for _, userID := range []uint{1, 42, 4000000000} {
+		if err := SetUserOnline(userID, "instance-a"); err != nil {
+			t.Fatalf("SetUserOnline: %v", err)
+		}
+	}
+	// Keys under the prefix that name no user, each with a live instance
+	live := float64(time.Now().Add(PresenceTTL).Unix())
+	for _, key := range []string{"user:online:", "user:online:abc", "user:online:12x", "user:online:-3", "user:online:99999999999"} {
+		if _, err := mr.ZAdd(key, live, "instance-a"); err != nil {
+			t.Fatalf("ZAdd: %v", err)
+		}
+	}
+
+	online, err := GetOnlineUsers()
+	if err != nil {
+		t.Fatalf("GetOnlineUsers: %v", err)
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i] < online[j] })
+	if want := []uint{1, 42, 4000000000}; !reflect.DeepEqual(online, want) {
+		t.Fatalf("GetOnlineUsers = %v, want %v", online, want)
+	}
+}
@@ -0,0 +1,323 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"web-api/internal/pkg/metrics"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// publishAttempts is how often a publish is tried before it is dead
+	// lettered
+	publishAttempts = 3
+
+	// publishBackoff is the wait before the first retry, doubled after
+	// each further failure
+	publishBackoff = 50 * time.Millisecond
+
+	// retryQueueSize bounds the publishes waiting for a retry; a publish
+	// that does not fit is dead lettered right away
+	retryQueueSize = 1024
+
+	// DeadLetterKey is the list of messages that could not be published
+	DeadLetterKey = "ws:deadletter"
+
+	// deadLetterMaxLen caps the dead letter list, dropping the oldest
+	deadLetterMaxLen = 10000
+
+	// deadLetterRedeliverInterval is how often dead letters are published
+	// again
+	deadLetterRedeliverInterval = 30 * time.Second
+
+	// deadLetterRedeliverBatch bounds the dead letters taken per pass
+	deadLetterRedeliverBatch = 500
+
+	// deadLetterMaxAge drops dead letters too old to be worth delivering;
+	// clients catch up on older messages by resyncing
+	deadLetterMaxAge = 10 * time.Minute
+)
+
+// Publisher sends a payload on pub/sub channels and returns the number of
+// subscribers reached on each. It is implemented by the Redis client and
+// replaced in tests.
+type Publisher interface {
+	Publish(ctx context.Context, channels []string, payload string) ([]int64, error)
+}
+
+// clientPublisher publishes with the Redis client, pipelining publishes
+// to several channels into one round trip
+type clientPublisher struct{}
+
+func (clientPublisher) Publish(ctx context.Context, channels []string, payload string) ([]int64, error) {
+	if len(channels) == 1 {
+		receivers, err := Client.Publish(ctx, channels[0], payload).Result()
+		if err != nil {
+			return nil, err
+		}
+		return []int64{receivers}, nil
+	}
+
+	pipe := Client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(channels))
+	for i, channel := range channels {
+		cmds[i] = pipe.Publish(ctx, channel, payload)
+	}
+	// A failed publish fails the whole pipeline, so the batch is retried
+	// as a whole
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	receivers := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		receivers[i] = cmd.Val()
+	}
+	return receivers, nil
+}
+
+// DeadLetter is a message that failed to publish, kept so it can be
+// redelivered later
+type DeadLetter struct {
+	Channel  string `json:"channel"`
+	Payload  string `json:"payload"`
+	Error    string `json:"error"`
+	FailedAt int64  `json:"failed_at"`
+}
+
+// failedPublish is a publish waiting for its next attempt
+type failedPublish struct {
+	channels []string
+	payload  string
+	attempts int
+}
+
+var (
+	// publisher sends every published message
+	publisher Publisher = clientPublisher{}
+
+	// retryQueue feeds failed publishes to the retry worker
+	retryQueue = make(chan failedPublish, retryQueueSize)
+
+	// startWorkers starts the retry and redelivery workers once
+	startWorkers sync.Once
+
+	// localDeadLetters keeps dead letters that could not be written to
+	// Redis until it is back
+	localDeadLetters deadLetterBuffer
+)
+
+// startPublishWorkers starts the workers that retry failed publishes and
+// redeliver dead letters, if they are not running yet
+func startPublishWorkers() {
+	startWorkers.Do(func() {
+		go retryPublishes()
+		go redeliverDeadLetters()
+	})
+}
+
+// publish sends a message on a channel. A failed publish is retried with
+// backoff in the background, so callers never wait for Redis to recover.
+func publish(channel string, message interface{}) (int64, error) {
+	receivers, err := publishToChannels([]string{channel}, payloadString(message))
+	if err != nil {
+		return 0, err
+	}
+	return receivers[0], nil
+}
+
+// publishToChannels makes one attempt at publishing a payload on the
+// channels, handing a failure to the retry worker
+func publishToChannels(channels []string, payload string) ([]int64, error) {
+	receivers, err := publisher.Publish(ctx, channels, payload)
+	if err != nil {
+		metrics.RedisPublishErrors.Inc()
+		retryPublish(failedPublish{channels: channels, payload: payload, attempts: 1}, err)
+		return nil, err
+	}
+	return receivers, nil
+}
+
+// retryPublish schedules the next attempt of a failed publish once its
+// backoff passed, or dead letters it when it is out of attempts
+func retryPublish(job failedPublish, cause error) {
+	if job.attempts >= publishAttempts {
+		deadLetter(cause, job.letters()...)
+		return
+	}
+
+	startPublishWorkers()
+	backoff := publishBackoff << (job.attempts - 1)
+	time.AfterFunc(backoff, func() {
+		select {
+		case retryQueue <- job:
+		default:
+			deadLetter(fmt.Errorf("retry queue full: %w", cause), job.letters()...)
+		}
+	})
+}
+
+// retryPublishes makes the retry attempts of failed publishes
+func retryPublishes() {
+	for job := range retryQueue {
+		if _, err := publisher.Publish(ctx, job.channels, job.payload); err != nil {
+			metrics.RedisPublishErrors.Inc()
+			job.attempts++
+			retryPublish(job, err)
+		}
+	}
+}
+
+// letters is the publish as dead letters, one per channel
+func (job failedPublish) letters() []DeadLetter {
+	letters := make([]DeadLetter, len(job.channels))
+	for i, channel := range job.channels {
+		letters[i] = DeadLetter{Channel: channel, Payload: job.payload}
+	}
+	return letters
+}
+
+// deadLetter stores messages that failed every publish attempt. Redis may
+// be the reason they failed, in which case they are kept in memory until
+// it is back.
+func deadLetter(cause error, letters ...DeadLetter) {
+	metrics.RedisDeadLetters.Add(float64(len(letters)))
+
+	values := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		letter.Error = cause.Error()
+		letter.FailedAt = time.Now().Unix()
+		encoded, err := json.Marshal(letter)
+		if err != nil {
+			continue
+		}
+		values = append(values, string(encoded))
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	if err := pushDeadLetters(values); err != nil {
+		localDeadLetters.add(values)
+		logrus.Errorf("Failed to dead letter %d message(s) after publish error %v, keeping them in memory: %v", len(values), cause, err)
+		return
+	}
+	logrus.Warnf("Dead lettered %d message(s) after publish error: %v", len(values), cause)
+}
+
+// pushDeadLetters appends encoded dead letters to the Redis list
+func pushDeadLetters(values []string) error {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+
+	pipe := Client.TxPipeline()
+	pipe.RPush(ctx, DeadLetterKey, args...)
+	pipe.LTrim(ctx, DeadLetterKey, -deadLetterMaxLen, -1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// payloadString renders a published message for the dead letter list
+func payloadString(message interface{}) string {
+	switch m := message.(type) {
+	case string:
+		return m
+	case []byte:
+		return string(m)
+	}
+	return fmt.Sprint(message)
+}
+
+// PopDeadLetters removes and returns up to count dead letters, oldest
+// first, for redelivery
+func PopDeadLetters(count int64) ([]DeadLetter, error) {
+	pipe := Client.TxPipeline()
+	values := pipe.LRange(ctx, DeadLetterKey, 0, count-1)
+	pipe.LTrim(ctx, DeadLetterKey, count, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(values.Val()))
+	for _, value := range values.Val() {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(value), &letter); err != nil {
+			logrus.Warnf("Dropping malformed dead letter: %v", err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// redeliverDeadLetters periodically publishes dead letters again
+func redeliverDeadLetters() {
+	ticker := time.NewTicker(deadLetterRedeliverInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		redeliverDeadLettersOnce()
+	}
+}
+
+// redeliverDeadLettersOnce moves dead letters kept in memory to Redis,
+// then publishes a batch of the dead letters again. Letters that fail
+// again go back to the list through the usual retries; stale ones are
+// dropped.
+func redeliverDeadLettersOnce() {
+	if values := localDeadLetters.take(); len(values) > 0 {
+		if err := pushDeadLetters(values); err != nil {
+			localDeadLetters.add(values)
+			logrus.Errorf("Failed to move %d dead letter(s) to Redis: %v", len(values), err)
+			return
+		}
+	}
+
+	letters, err := PopDeadLetters(deadLetterRedeliverBatch)
+	if err != nil {
+		logrus.Errorf("Failed to load dead letters: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-deadLetterMaxAge).Unix()
+	for _, letter := range letters {
+		if letter.FailedAt < cutoff {
+			continue
+		}
+		publishToChannels([]string{letter.Channel}, letter.Payload)
+	}
+}
+
+// deadLetterBuffer holds encoded dead letters in memory, keeping the
+// newest deadLetterMaxLen
+type deadLetterBuffer struct {
+	mu      sync.Mutex
+	letters []string
+}
+
+func (b *deadLetterBuffer) add(values []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.letters = append(b.letters, values...)
+	if over := len(b.letters) - deadLetterMaxLen; over > 0 {
+		b.letters = append([]string(nil), b.letters[over:]...)
+	}
+}
+
+func (b *deadLetterBuffer) take() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	letters := b.letters
+	b.letters = nil
+	return letters
+}
@@ -0,0 +1,166 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// fakePublisher fails its first failures publishes, then records the
+// published payloads
+type fakePublisher struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	published []string
+}
+
+func (p *fakePublisher) Publish(_ context.Context, channels []string, payload string) ([]int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	if p.failures != 0 {
+		p.failures--
+		return nil, errors.New("publish failed")
+	}
+	for _, channel := range channels {
+		p.published = append(p.published, channel+" "+payload)
+	}
+	return make([]int64, len(channels)), nil
+}
+
+func (p *fakePublisher) state() (int, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls, append([]string(nil), p.published...)
+}
+
+// setupPublish points the package at an in-process Redis and the given
+// publisher for the duration of the test
+func setupPublish(t *testing.T, p Publisher) *miniredis.Miniredis {
+	t.Helper()
+
+	mr := setupClient(t)
+	prevPublisher := publisher
+	publisher = p
+	localDeadLetters.take()
+	t.Cleanup(func() { publisher = prevPublisher })
+	return mr
+}
+
+// eventually fails the test if cond does not hold within a second
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishRetriesInTheBackground(t *testing.T) {
+	p := &fakePublisher{failures: 1}
+	mr := setupPublish(t, p)
+
+	start := time.Now()
+	if _, err := publish("ws:user:1", "event"); err == nil {
+		t.Fatal("publish succeeded, want the first attempt's error")
+	}
+	if elapsed := time.Since(start); elapsed >= publishBackoff {
+		t.Fatalf("publish blocked for %v, want it to return before any backoff", elapsed)
+	}
+
+	eventually(t, func() bool {
+		calls, published := p.state()
+		return calls == 2 && len(published) == 1
+	})
+	if _, published := p.state(); published[0] != "ws:user:1 event" {
+		t.Fatalf("published %q, want the retried event", published[0])
+	}
+	if mr.Exists(DeadLetterKey) {
+		t.Fatal("a publish that succeeded on retry was dead lettered")
+	}
+}
+
+func TestFailingPublishLandsInDeadLetters(t *testing.T) {
+	p := &fakePublisher{failures: -1}
+	mr := setupPublish(t, p)
+
+	if _, err := PublishEventToChannels([]string{"ws:user:1", "ws:user:2"}, "", "group_message", map[string]interface{}{"message_id": 7}); err == nil {
+		t.Fatal("publish succeeded, want an error")
+	}
+
+	eventually(t, func() bool {
+		values, _ := mr.List(DeadLetterKey)
+		return len(values) == 2
+	})
+	if calls, _ := p.state(); calls != publishAttempts {
+		t.Fatalf("publish tried %d times, want %d", calls, publishAttempts)
+	}
+
+	letters, err := PopDeadLetters(10)
+	if err != nil {
+		t.Fatalf("PopDeadLetters: %v", err)
+	}
+	for i, channel := range []string{"ws:user:1", "ws:user:2"} {
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(letters[i].Payload), &payload); err != nil {
+			t.Fatalf("decode dead letter payload: %v", err)
+		}
+		if letters[i].Channel != channel || payload["event"] != "group_message" || letters[i].Error != "publish failed" {
+			t.Errorf("dead letter %d = %+v, want group_message on %s", i, letters[i], channel)
+		}
+	}
+	if mr.Exists(DeadLetterKey) {
+		t.Fatal("PopDeadLetters left the letters in the list")
+	}
+}
+
+func TestDeadLettersAreKeptLocallyWhileRedisIsDown(t *testing.T) {
+	p := &fakePublisher{}
+	mr := setupPublish(t, p)
+
+	mr.Close()
+	deadLetter(errors.New("publish failed"), DeadLetter{Channel: "ws:user:1", Payload: "event"})
+	if n := len(localDeadLetters.letters); n != 1 {
+		t.Fatalf("kept %d dead letter(s) locally, want 1", n)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("restart Redis: %v", err)
+	}
+	redeliverDeadLettersOnce()
+
+	if _, published := p.state(); len(published) != 1 || published[0] != "ws:user:1 event" {
+		t.Fatalf("redelivered %q, want the local dead letter", published)
+	}
+	if n := len(localDeadLetters.take()); n != 0 {
+		t.Fatalf("%d dead letter(s) still kept locally", n)
+	}
+}
+
+func TestRedeliverSkipsStaleDeadLetters(t *testing.T) {
+	p := &fakePublisher{}
+	setupPublish(t, p)
+
+	stale, _ := json.Marshal(DeadLetter{Channel: "ws:user:1", Payload: "stale", FailedAt: time.Now().Add(-2 * deadLetterMaxAge).Unix()})
+	fresh, _ := json.Marshal(DeadLetter{Channel: "ws:user:2", Payload: "fresh", FailedAt: time.Now().Unix()})
+	if err := pushDeadLetters([]string{string(stale), string(fresh)}); err != nil {
+		t.Fatalf("push dead letters: %v", err)
+	}
+
+	redeliverDeadLettersOnce()
+
+	if _, published := p.state(); len(published) != 1 || published[0] != "ws:user:2 fresh" {
+		t.Fatalf("redelivered %q, want only the fresh letter", published)
+	}
+}
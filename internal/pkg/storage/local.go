@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage keeps files on the local disk below a root directory
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a local-disk storage rooted at root
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+// Save writes the content to a file, creating parent directories
+func (s *LocalStorage) Save(key string, r io.Reader, size int64, contentType string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, r); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+// Open opens the file stored under key
+func (s *LocalStorage) Open(key string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// Delete removes the file stored under key
+func (s *LocalStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// URL returns the file's path on disk
+func (s *LocalStorage) URL(key string) string {
+	return s.path(key)
+}
+
+// path maps a key to a file path. Files uploaded before storage backends
+// existed recorded their full path, which is used as is.
+func (s *LocalStorage) path(key string) string {
+	root := filepath.Clean(s.root)
+	if clean := filepath.Clean(key); strings.HasPrefix(clean, root+string(filepath.Separator)) {
+		return clean
+	}
+	return filepath.Join(root, filepath.Clean("/"+key))
+}
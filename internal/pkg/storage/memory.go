@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// MemoryStorage keeps files in memory. It is meant for tests.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string][]byte)}
+}
+
+// Save reads the whole content into memory
+func (s *MemoryStorage) Save(key string, r io.Reader, size int64, contentType string) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.files[key] = content
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Open returns a reader over the stored content
+func (s *MemoryStorage) Open(key string) (io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	content, ok := s.files[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return memoryFile{bytes.NewReader(content)}, nil
+}
+
+// Delete forgets the stored content
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, key)
+
+	return nil
+}
+
+// URL returns a memory:// URL for the key
+func (s *MemoryStorage) URL(key string) string {
+	return "memory://" + key
+}
+
+// memoryFile adds a no-op Close to a bytes.Reader
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
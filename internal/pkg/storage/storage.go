@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"web-api/internal/pkg/config"
+)
+
+// Storage stores the content of uploaded files under opaque keys
+type Storage interface {
+	// Save writes size bytes from r under key
+	Save(key string, r io.Reader, size int64, contentType string) error
+	// Open returns the content stored under key. It is seekable so that
+	// downloads can serve Range requests.
+	Open(key string) (io.ReadSeekCloser, error)
+	// Delete removes the content stored under key
+	Delete(key string) error
+	// URL returns where the content stored under key lives in the backend
+	URL(key string) string
+}
+
+// New creates the storage backend selected in the configuration. The local
+// disk is used when no driver is set.
+func New(cfg config.StorageConfiguration, defaultRoot string) (Storage, error) {
+	switch cfg.Driver {
+	case "", "local":
+		root := cfg.Local.Root
+		if root == "" {
+			root = defaultRoot
+		}
+		return NewLocalStorage(root), nil
+	case "s3":
+		return NewS3Storage(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
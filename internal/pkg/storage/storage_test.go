@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"web-api/internal/pkg/config"
+)
+
+// testStorage checks the behaviour every backend must share
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+
+	const key = "2024-01-02/file.txt"
+	content := "hello, storage"
+	if err := s.Save(key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	f, err := s.Open(key)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Downloads seek to serve Range requests
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(rest) != "storage" {
+		t.Fatalf("read after seek = %q, %v, want \"storage\"", rest, err)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Open(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Open after Delete: err = %v, want %v", err, os.ErrNotExist)
+	}
+	if err := s.Delete(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("second Delete: err = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, NewLocalStorage(t.TempDir()))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestLocalStorageKeepsKeysBelowRoot(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStorage(root)
+
+	if err := s.Save("../../escape.txt", strings.NewReader("x"), 1, "text/plain"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatalf("file not stored below the root: %v", err)
+	}
+
+	// Files uploaded before storage backends recorded their full path
+	legacy := filepath.Join(root, "old", "file.txt")
+	if got := s.URL(legacy); got != legacy {
+		t.Fatalf("URL(%q) = %q, want the path unchanged", legacy, got)
+	}
+}
+
+func TestNewSelectsTheDriver(t *testing.T) {
+	root := t.TempDir()
+
+	s, err := New(config.StorageConfiguration{}, root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if local, ok := s.(*LocalStorage); !ok || local.root != root {
+		t.Fatalf("default driver = %#v, want local storage at %s", s, root)
+	}
+
+	if _, err := New(config.StorageConfiguration{Driver: "ftp"}, root); err == nil {
+		t.Fatal("New accepted an unknown driver")
+	}
+}
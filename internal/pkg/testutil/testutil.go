@@ -0,0 +1,181 @@
+// Package testutil sets up the database, Redis and configuration the
+// services rely on, for tests across packages
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/utils"
+)
+
+// jwtSecret signs the tokens of tests
+const jwtSecret = "test-secret-test-secret-test-secret"
+
+// Setup gives the test a fresh in-memory database with the full schema,
+// an in-process Redis, an empty configuration and a JWT secret, and puts
+// the previous ones back when the test ends
+func Setup(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.AutoMigrate(database.Models...); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	sqlDB, _ := db.DB()
+
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr(), Protocol: 2})
+
+	if err := utils.SetJWTSecrets(jwtSecret, nil); err != nil {
+		t.Fatalf("set JWT secret: %v", err)
+	}
+
+	prevDB, prevRedis, prevConfig := database.DB, redis.Client, config.Config
+	database.DB, redis.Client, config.Config = db, client, &config.Configuration{}
+	t.Cleanup(func() {
+		database.DB, redis.Client, config.Config = prevDB, prevRedis, prevConfig
+		client.Close()
+		sqlDB.Close()
+	})
+
+	return mr
+}
+
+// CreateUser adds a user with the given username
+func CreateUser(t testing.TB, username string) *models.User {
+	t.Helper()
+
+	user := &models.User{Username: username, Email: username + "@example.com", Password: "x"}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("create user %s: %v", username, err)
+	}
+	return user
+}
+
+// CreateGroup adds a group owned by owner, who joins as admin, with the
+// other users as plain members
+func CreateGroup(t testing.TB, owner *models.User, members ...*models.User) *models.Group {
+	t.Helper()
+
+	group := &models.Group{Name: "group", OwnerID: owner.ID}
+	if err := database.DB.Create(group).Error; err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	AddMember(t, group, owner, models.GroupRoleAdmin)
+	for _, member := range members {
+		AddMember(t, group, member, models.GroupRoleMember)
+	}
+	return group
+}
+
+// AddMember adds a user to a group with the given role
+func AddMember(t testing.TB, group *models.Group, user *models.User, role string) {
+	t.Helper()
+
+	member := &models.GroupMember{GroupID: group.ID, UserID: user.ID, Role: role}
+	if err := database.DB.Create(member).Error; err != nil {
+		t.Fatalf("add member %d to group %d: %v", user.ID, group.ID, err)
+	}
+}
+
+// RemoveMember removes a user from a group, the way leaving or being
+// removed does
+func RemoveMember(t testing.TB, group *models.Group, user *models.User) {
+	t.Helper()
+
+	if err := database.DB.Where("group_id = ? AND user_id = ?", group.ID, user.ID).
+		Delete(&models.GroupMember{}).Error; err != nil {
+		t.Fatalf("remove member %d from group %d: %v", user.ID, group.ID, err)
+	}
+}
+
+// Token signs a user token for the user
+func Token(t testing.TB, user *models.User) string {
+	t.Helper()
+
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Email)
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	return token
+}
+
+// CountRows counts the live rows of a model's table
+func CountRows(t testing.TB, model interface{}) int64 {
+	t.Helper()
+
+	var count int64
+	if err := database.DB.Model(model).Count(&count).Error; err != nil {
+		t.Fatalf("count rows: %v", err)
+	}
+	return count
+}
+
+// Event is a WebSocket event as published on a user's Redis channel
+type Event struct {
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// Subscribe listens on a user's Redis channel, where every event meant
+// for the user's connections is published
+func Subscribe(t testing.TB, userID uint) *goredis.PubSub {
+	t.Helper()
+
+	pubsub := redis.Client.Subscribe(context.Background(), fmt.Sprintf("ws:user:%d", userID))
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		t.Fatalf("subscribe user %d: %v", userID, err)
+	}
+	t.Cleanup(func() { pubsub.Close() })
+	return pubsub
+}
+
+// NextEvent returns the next event on the subscription, failing the test
+// if none arrives in time
+func NextEvent(t testing.TB, pubsub *goredis.PubSub) Event {
+	t.Helper()
+
+	select {
+	case msg := <-pubsub.Channel():
+		var ev Event
+		if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+// NoEvent fails the test if an event arrives on the subscription shortly
+func NoEvent(t testing.TB, pubsub *goredis.PubSub) {
+	t.Helper()
+
+	select {
+	case msg := <-pubsub.Channel():
+		t.Fatalf("unexpected event: %s", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,83 +2,215 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// TokenTypeAccess authenticates API and WebSocket requests
+	TokenTypeAccess = "access"
+	// TokenTypeRefresh may only be exchanged for a new token pair
+	TokenTypeRefresh = "refresh"
+
+	// ScopeBot marks access tokens minted for integrations, which may only
+	// call the bot endpoints
+	ScopeBot = "bot"
+
+	// MinSecretLength is the shortest signing secret accepted, in bytes
+	MinSecretLength = 32
+
+	// TokenIssuer and TokenAudience are stamped on every token and required
+	// when verifying one
+	TokenIssuer   = "realtime"
+	TokenAudience = "realtime-api"
 )
 
 var (
 	// JWTSecret is the secret key for JWT signing
 	JWTSecret []byte
+
+	// previousSecrets still verify tokens signed before the secret rotated
+	previousSecrets [][]byte
+
+	// AccessTokenTTL is the lifetime of access tokens
+	AccessTokenTTL = 15 * time.Minute
+
+	// RefreshTokenTTL is the lifetime of refresh tokens
+	RefreshTokenTTL = 7 * 24 * time.Hour
 )
 
+func init() {
+	// Issue times carry microseconds, so a token minted right after its user
+	// revoked all tokens is told apart from those minted in the same second
+	// before it
+	jwt.TimePrecision = time.Microsecond
+}
+
 // Claims represents JWT claims
 type Claims struct {
-	UserID   uint   `json:"user_id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	jwt.StandardClaims
+	UserID    uint   `json:"user_id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	TokenType string `json:"token_type"`
+	Scope     string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
 }
 
-// SetJWTSecret sets the JWT secret key
-func SetJWTSecret(secret string) {
+// IssuedAtMicro returns when the token was issued as a Unix time in
+// microseconds, 0 if it does not say
+func (c *Claims) IssuedAtMicro() int64 {
+	if c.IssuedAt == nil {
+		return 0
+	}
+	return c.IssuedAt.UnixMicro()
+}
+
+// ExpiresIn returns how long the token remains valid, 0 for tokens that
+// never expire
+func (c *Claims) ExpiresIn() time.Duration {
+	if c.ExpiresAt == nil {
+		return 0
+	}
+	return time.Until(c.ExpiresAt.Time)
+}
+
+// IsBot reports whether the token is a bot token
+func (c *Claims) IsBot() bool {
+	return c.Scope == ScopeBot
+}
+
+// SetJWTSecrets sets the secret tokens are signed with, along with the
+// previous secrets still accepted when verifying them, so that tokens issued
+// before a rotation stay valid until they expire. Every secret must be at
+// least MinSecretLength bytes long.
+func SetJWTSecrets(secret string, previous []string) error {
+	if err := checkSecret(secret); err != nil {
+		return err
+	}
+
+	keys := make([][]byte, 0, len(previous))
+	for i, p := range previous {
+		if err := checkSecret(p); err != nil {
+			return fmt.Errorf("previous secret %d: %w", i+1, err)
+		}
+		keys = append(keys, []byte(p))
+	}
+
 	JWTSecret = []byte(secret)
+	previousSecrets = keys
+	return nil
+}
+
+// checkSecret rejects secrets too weak to sign tokens with
+func checkSecret(secret string) error {
+	if secret == "" {
+		return errors.New("secret is empty")
+	}
+	if len(secret) < MinSecretLength {
+		return fmt.Errorf("secret must be at least %d bytes long", MinSecretLength)
+	}
+	return nil
 }
 
-// GenerateToken generates a new JWT token for a user
+// SetTokenLifetimes overrides the token lifetimes; zero values keep the
+// defaults
+func SetTokenLifetimes(access, refresh time.Duration) {
+	if access > 0 {
+		AccessTokenTTL = access
+	}
+	if refresh > 0 {
+		RefreshTokenTTL = refresh
+	}
+}
+
+// GenerateToken generates a new access token for a user
 func GenerateToken(userID uint, username, email string) (string, error) {
+	token, _, err := generateToken(userID, username, email, TokenTypeAccess, "", AccessTokenTTL)
+	return token, err
+}
+
+// GenerateRefreshToken generates a new refresh token for a user and returns
+// it along with its ID
+func GenerateRefreshToken(userID uint, username, email string) (string, string, error) {
+	return generateToken(userID, username, email, TokenTypeRefresh, "", RefreshTokenTTL)
+}
+
+// GenerateBotToken generates a bot-scoped access token for a user and
+// returns it along with its ID. A zero ttl never expires.
+func GenerateBotToken(userID uint, username, email string, ttl time.Duration) (string, string, error) {
+	return generateToken(userID, username, email, TokenTypeAccess, ScopeBot, ttl)
+}
+
+// generateToken signs a token of the given type and returns it with its ID
+func generateToken(userID uint, username, email, tokenType, scope string, ttl time.Duration) (string, string, error) {
 	if len(JWTSecret) == 0 {
-		return "", errors.New("JWT secret not configured")
+		return "", "", errors.New("JWT secret not configured")
 	}
 
-	expirationTime := time.Now().Add(24 * 7 * time.Hour) // 7 days
-	
+	now := time.Now()
+	tokenID := uuid.New().String()
+
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
-		Email:    email,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
+		UserID:    userID,
+		Username:  username,
+		Email:     email,
+		TokenType: tokenType,
+		Scope:     scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       tokenID,
+			Issuer:   TokenIssuer,
+			Audience: jwt.ClaimStrings{TokenAudience},
+			IssuedAt: jwt.NewNumericDate(now),
 		},
 	}
+	if ttl > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString(JWTSecret)
-	
+
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return tokenString, nil
+	return tokenString, tokenID, nil
 }
 
-// ValidateToken validates a JWT token and returns claims
+// ValidateToken validates an access token and returns claims
 func ValidateToken(tokenString string) (*Claims, error) {
-	if len(JWTSecret) == 0 {
-		return nil, errors.New("JWT secret not configured")
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
 	}
 
-	claims := &Claims{}
+	if claims.TokenType == TokenTypeRefresh {
+		return nil, errors.New("refresh token cannot be used for authentication")
+	}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return JWTSecret, nil
-	})
+	return claims, nil
+}
 
+// ValidateRefreshToken validates a refresh token and returns claims
+func ValidateRefreshToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
 	if err != nil {
 		return nil, err
 	}
 
-	if !token.Valid {
-		return nil, errors.New("invalid token")
+	if claims.TokenType != TokenTypeRefresh {
+		return nil, errors.New("not a refresh token")
 	}
 
 	return claims, nil
 }
 
-// RefreshToken generates a new token from an existing valid token
+// RefreshToken generates a new access token from a valid refresh token
 func RefreshToken(tokenString string) (string, error) {
-	claims, err := ValidateToken(tokenString)
+	claims, err := ValidateRefreshToken(tokenString)
 	if err != nil {
 		return "", err
 	}
@@ -86,3 +218,52 @@ func RefreshToken(tokenString string) (string, error) {
 	// Generate new token with same user info
 	return GenerateToken(claims.UserID, claims.Username, claims.Email)
 }
+
+// parseToken verifies a token's signature and expiry and returns its
+// claims. The current secret is tried first, then the previous ones.
+func parseToken(tokenString string) (*Claims, error) {
+	if len(JWTSecret) == 0 {
+		return nil, errors.New("JWT secret not configured")
+	}
+
+	var err error
+	for _, secret := range append([][]byte{JWTSecret}, previousSecrets...) {
+		var claims *Claims
+		if claims, err = parseTokenWith(tokenString, secret); err == nil {
+			return claims, nil
+		}
+
+		// Only a signature mismatch means another secret may have signed it
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// parseTokenWith verifies a token against one secret. Besides the
+// signature and expiry, the token must be HS256-signed for TokenIssuer and
+// TokenAudience and not issued in the future.
+func parseTokenWith(tokenString string, secret []byte) (*Claims, error) {
+	claims := &Claims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(TokenIssuer),
+		jwt.WithAudience(TokenAudience),
+		jwt.WithIssuedAt(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
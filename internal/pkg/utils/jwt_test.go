@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	oldSecret = strings.Repeat("o", MinSecretLength)
+	newSecret = strings.Repeat("n", MinSecretLength)
+)
+
+// useSecrets sets the signing secrets for the duration of the test
+func useSecrets(t *testing.T, secret string, previous ...string) {
+	t.Helper()
+
+	prevSecret, prevPrevious := JWTSecret, previousSecrets
+	t.Cleanup(func() { JWTSecret, previousSecrets = prevSecret, prevPrevious })
+	if err := SetJWTSecrets(secret, previous); err != nil {
+		t.Fatalf("SetJWTSecrets: %v", err)
+	}
+}
+
+func TestSetJWTSecretsRejectsWeakSecrets(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	tests := []struct {
+		name     string
+		secret   string
+		previous []string
+	}{
+		{"empty", "", nil},
+		{"short", newSecret[1:], nil},
+		{"short previous", newSecret, []string{oldSecret, "hunter2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetJWTSecrets(tt.secret, tt.previous); err == nil {
+				t.Fatal("SetJWTSecrets accepted a weak secret")
+			}
+			// A rejected configuration leaves the secrets as they were
+			if string(JWTSecret) != newSecret || len(previousSecrets) != 0 {
+				t.Fatal("rejected secrets were applied")
+			}
+		})
+	}
+}
+
+func TestTokensSurviveSecretRotation(t *testing.T) {
+	useSecrets(t, oldSecret)
+	before, err := GenerateToken(1, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	refresh, _, err := GenerateRefreshToken(1, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken: %v", err)
+	}
+
+	// Rotate, keeping the old secret for verification only
+	useSecrets(t, newSecret, oldSecret)
+	if claims, err := ValidateToken(before); err != nil || claims.UserID != 1 {
+		t.Fatalf("token from before the rotation: %v, %v", claims, err)
+	}
+	if _, err := ValidateRefreshToken(refresh); err != nil {
+		t.Fatalf("refresh token from before the rotation: %v", err)
+	}
+
+	// New tokens are signed with the new secret only
+	after, err := GenerateToken(1, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	useSecrets(t, oldSecret)
+	if _, err := ValidateToken(after); err == nil {
+		t.Fatal("token signed after the rotation verified with the old secret")
+	}
+
+	// Once the old secret is dropped its tokens stop working
+	useSecrets(t, newSecret)
+	if _, err := ValidateToken(before); err == nil {
+		t.Fatal("token of a dropped secret still verified")
+	}
+	if _, err := ValidateToken(after); err != nil {
+		t.Fatalf("token of the current secret: %v", err)
+	}
+}
+
+func TestGenerateAndValidateToken(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	token, err := GenerateToken(7, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.UserID != 7 || claims.Username != "alice" || claims.Email != "alice@example.com" || claims.TokenType != TokenTypeAccess {
+		t.Fatalf("claims %+v, want alice's access token", claims)
+	}
+	if claims.ID == "" || claims.Issuer != TokenIssuer || len(claims.Audience) != 1 || claims.Audience[0] != TokenAudience {
+		t.Fatalf("registered claims %+v, want an ID, the issuer and the audience", claims.RegisteredClaims)
+	}
+	if ttl := claims.ExpiresIn(); ttl <= 0 || ttl > AccessTokenTTL {
+		t.Fatalf("token expires in %v, want within %v", ttl, AccessTokenTTL)
+	}
+	if _, err := ValidateRefreshToken(token); err == nil {
+		t.Fatal("access token accepted as a refresh token")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	token, id, err := GenerateRefreshToken(7, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken: %v", err)
+	}
+	claims, err := ValidateRefreshToken(token)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken: %v", err)
+	}
+	if claims.ID != id || claims.TokenType != TokenTypeRefresh || claims.UserID != 7 {
+		t.Fatalf("claims %+v, want refresh token %s of user 7", claims, id)
+	}
+	if _, err := ValidateToken(token); err == nil {
+		t.Fatal("refresh token accepted for authentication")
+	}
+
+	access, err := RefreshToken(token)
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	refreshed, err := ValidateToken(access)
+	if err != nil {
+		t.Fatalf("refreshed token: %v", err)
+	}
+	if refreshed.UserID != 7 || refreshed.Username != "alice" || refreshed.TokenType != TokenTypeAccess {
+		t.Fatalf("refreshed claims %+v, want alice's access token", refreshed)
+	}
+}
+
+func TestRefreshTokenNeedsAValidRefreshToken(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	access, err := GenerateToken(7, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if _, err := RefreshToken(access); err == nil {
+		t.Fatal("access token exchanged for a new one")
+	}
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:    7,
+		TokenType: TokenTypeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    TokenIssuer,
+			Audience:  jwt.ClaimStrings{TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Second)),
+		},
+	}).SignedString([]byte(newSecret))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := RefreshToken(expired); err == nil {
+		t.Fatal("expired refresh token exchanged for a new one")
+	}
+}
+
+func TestValidateTokenRejectsForgeries(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	// sign builds a token from the claims of a valid one, changed by edit
+	sign := func(method jwt.SigningMethod, key interface{}, edit func(*Claims)) string {
+		t.Helper()
+		claims := &Claims{
+			UserID:    7,
+			TokenType: TokenTypeAccess,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "id",
+				Issuer:    TokenIssuer,
+				Audience:  jwt.ClaimStrings{TokenAudience},
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+		edit(claims)
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return token
+	}
+	hs256 := func(edit func(*Claims)) string { return sign(jwt.SigningMethodHS256, []byte(newSecret), edit) }
+
+	if _, err := ValidateToken(hs256(func(*Claims) {})); err != nil {
+		t.Fatalf("well-formed token rejected: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other audience", hs256(func(c *Claims) { c.Audience = jwt.ClaimStrings{"another-api"} })},
+		{"no audience", hs256(func(c *Claims) { c.Audience = nil })},
+		{"other issuer", hs256(func(c *Claims) { c.Issuer = "someone-else" })},
+		{"expired", hs256(func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second)) })},
+		{"issued in the future", hs256(func(c *Claims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) })},
+		{"other secret", sign(jwt.SigningMethodHS256, []byte(oldSecret), func(*Claims) {})},
+		{"other method", sign(jwt.SigningMethodHS512, []byte(newSecret), func(*Claims) {})},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, func(*Claims) {})},
+		{"garbage", "not.a.token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if claims, err := ValidateToken(tt.token); err == nil {
+				t.Fatalf("accepted with claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestBotTokenWithoutTTLNeverExpires(t *testing.T) {
+	useSecrets(t, newSecret)
+
+	token, _, err := GenerateBotToken(7, "alice", "alice@example.com", 0)
+	if err != nil {
+		t.Fatalf("GenerateBotToken: %v", err)
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if !claims.IsBot() || claims.ExpiresAt != nil || claims.ExpiresIn() != 0 {
+		t.Fatalf("claims %+v, want a bot token without expiry", claims)
+	}
+}
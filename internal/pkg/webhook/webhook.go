@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/netguard"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries "sha256=<hex HMAC of the body>", keyed with
+	// the webhook's secret
+	SignatureHeader = "X-Signature"
+
+	// EventHeader names the event a delivery is about
+	EventHeader = "X-Webhook-Event"
+
+	// DeliveryHeader identifies a delivery; retries reuse it, so receivers
+	// can drop duplicates
+	DeliveryHeader = "X-Webhook-Delivery"
+
+	defaultWorkers        = 4
+	defaultQueueSize      = 1000
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultTimeout        = 10 * time.Second
+)
+
+var (
+	// ErrQueueFull is returned when a delivery does not fit the queue
+	ErrQueueFull = errors.New("webhook queue is full")
+
+	// errPermanent marks failures that retrying will not fix
+	errPermanent = errors.New("rejected by receiver")
+)
+
+// Delivery is one event on its way to one webhook
+type Delivery struct {
+	ID        string
+	WebhookID uint
+	URL       string
+	Secret    string
+	Event     string
+	Body      []byte
+
+	// Attempts made so far
+	Attempts int
+}
+
+// DeadLetterFunc is called with deliveries that failed every attempt
+type DeadLetterFunc func(d Delivery, err error)
+
+// Dispatcher posts deliveries from a queue, retrying failures with
+// exponential backoff
+type Dispatcher struct {
+	client         *http.Client
+	queue          chan Delivery
+	workers        int
+	maxAttempts    int
+	initialBackoff time.Duration
+	deadLetter     DeadLetterFunc
+}
+
+// NewDispatcher creates a dispatcher from the configuration, filling in
+// defaults for unset values. Start must be called before deliveries flow.
+func NewDispatcher(cfg config.WebhookConfiguration, deadLetter DeadLetterFunc) *Dispatcher {
+	d := &Dispatcher{
+		workers:        cfg.Workers,
+		maxAttempts:    cfg.MaxAttempts,
+		initialBackoff: cfg.InitialBackoff,
+		deadLetter:     deadLetter,
+	}
+	if d.workers <= 0 {
+		d.workers = defaultWorkers
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultMaxAttempts
+	}
+	if d.initialBackoff <= 0 {
+		d.initialBackoff = defaultInitialBackoff
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	d.queue = make(chan Delivery, queueSize)
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	d.client = netguard.NewClient(timeout)
+
+	return d
+}
+
+// UseClient replaces the HTTP client deliveries are posted with, which by
+// default only reaches public addresses. It must be called before Start.
+func (d *Dispatcher) UseClient(client *http.Client) {
+	d.client = client
+}
+
+// Start launches the delivery workers
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.workers; i++ {
+		go d.work()
+	}
+}
+
+// Enqueue schedules a delivery without blocking
+func (d *Dispatcher) Enqueue(delivery Delivery) error {
+	select {
+	case d.queue <- delivery:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// work sends queued deliveries until the process exits
+func (d *Dispatcher) work() {
+	for delivery := range d.queue {
+		err := d.send(delivery)
+		if err == nil {
+			continue
+		}
+
+		delivery.Attempts++
+		if delivery.Attempts >= d.maxAttempts || errors.Is(err, errPermanent) {
+			d.fail(delivery, err)
+			continue
+		}
+
+		logrus.Warnf("Webhook %d delivery %s failed (attempt %d), retrying: %v",
+			delivery.WebhookID, delivery.ID, delivery.Attempts, err)
+		d.retry(delivery)
+	}
+}
+
+// retry puts a failed delivery back on the queue once its backoff passed
+func (d *Dispatcher) retry(delivery Delivery) {
+	backoff := d.initialBackoff << (delivery.Attempts - 1)
+	time.AfterFunc(backoff, func() {
+		if err := d.Enqueue(delivery); err != nil {
+			d.fail(delivery, err)
+		}
+	})
+}
+
+// fail hands a delivery that will not be retried to the dead letter
+// callback
+func (d *Dispatcher) fail(delivery Delivery, err error) {
+	logrus.Errorf("Webhook %d delivery %s failed for good after %d attempts: %v",
+		delivery.WebhookID, delivery.ID, delivery.Attempts, err)
+	if d.deadLetter != nil {
+		d.deadLetter(delivery, err)
+	}
+}
+
+// send makes one delivery attempt
+func (d *Dispatcher) send(delivery Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, delivery.Body))
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		// An internal address stays internal however often it is tried
+		if errors.Is(err, netguard.ErrForbiddenAddress) {
+			return fmt.Errorf("%w: %v", errPermanent, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errPermanent, resp.Status)
+	default:
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+}
+
+// Sign returns the X-Signature value for a body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature matches the body, in constant time
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
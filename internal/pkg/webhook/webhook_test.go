@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/config"
+)
+
+// received is one request the receiver got
+type received struct {
+	body    []byte
+	headers http.Header
+}
+
+// receiver is a webhook endpoint answering with the given statuses in
+// turn, then 200
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests chan received
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+	t.Helper()
+
+	r := &receiver{statuses: statuses, requests: make(chan received, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.requests <- received{body: body, headers: req.Header}
+
+		r.mu.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+func (r *receiver) next(t *testing.T) received {
+	t.Helper()
+
+	select {
+	case req := <-r.requests:
+		return req
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiver got no request")
+		return received{}
+	}
+}
+
+// deadLetters collects the deliveries a dispatcher gave up on
+type deadLetters chan Delivery
+
+func (d deadLetters) record(delivery Delivery, err error) {
+	d <- delivery
+}
+
+// dispatcher starts a dispatcher with quick retries that may reach the
+// receivers, which listen on loopback, like the real one reaches public hosts
+func dispatcher(maxAttempts int) (*Dispatcher, deadLetters) {
+	dead := make(deadLetters, 4)
+	d := NewDispatcher(config.WebhookConfiguration{
+		Workers:        1,
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: 10 * time.Millisecond,
+	}, dead.record)
+	d.UseClient(&http.Client{Timeout: time.Second})
+	d.Start()
+	return d, dead
+}
+
+func TestDeliveryIsSigned(t *testing.T) {
+	r, url := newReceiver(t)
+	d, _ := dispatcher(3)
+	body := []byte(`{"event":"message_created","data":{"message_id":1}}`)
+
+	if err := d.Enqueue(Delivery{ID: "d1", WebhookID: 1, URL: url, Secret: "s3cret", Event: "message_created", Body: body}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	req := r.next(t)
+
+	// Receivers verify with nothing but the secret and the raw body
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.headers.Get(SignatureHeader); got != want {
+		t.Fatalf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+	if string(req.body) != string(body) {
+		t.Fatalf("body %s, want %s", req.body, body)
+	}
+	if req.headers.Get(EventHeader) != "message_created" || req.headers.Get(DeliveryHeader) != "d1" {
+		t.Fatalf("headers %v, want event message_created and delivery d1", req.headers)
+	}
+
+	if !Verify("s3cret", req.body, want) || Verify("other", req.body, want) || Verify("s3cret", []byte("{}"), want) {
+		t.Fatal("Verify accepted a wrong secret or body, or rejected the right one")
+	}
+}
+
+func TestFailingDeliveryIsRetriedThenDeadLettered(t *testing.T) {
+	r, url := newReceiver(t, 500, 500, 500)
+	d, dead := dispatcher(3)
+
+	if err := d.Enqueue(Delivery{ID: "d1", WebhookID: 1, URL: url, Secret: "s", Event: "member_joined", Body: []byte("{}")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	var arrived []time.Time
+	for i := 0; i < 3; i++ {
+		req := r.next(t)
+		arrived = append(arrived, time.Now())
+		// Retries keep the delivery ID so receivers can drop duplicates
+		if id := req.headers.Get(DeliveryHeader); id != "d1" {
+			t.Fatalf("attempt %d has delivery %q, want d1", i+1, id)
+		}
+	}
+	// The backoff doubles: 10ms, then 20ms
+	if first, second := arrived[1].Sub(arrived[0]), arrived[2].Sub(arrived[1]); first < 10*time.Millisecond || second < 20*time.Millisecond {
+		t.Fatalf("retried after %v and %v, want at least 10ms and 20ms", first, second)
+	}
+
+	select {
+	case delivery := <-dead:
+		if delivery.ID != "d1" || delivery.Attempts != 3 {
+			t.Fatalf("dead letter %+v, want d1 after 3 attempts", delivery)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("failed delivery was not dead-lettered")
+	}
+}
+
+func TestRecoveredDeliveryIsNotDeadLettered(t *testing.T) {
+	r, url := newReceiver(t, 503, http.StatusTooManyRequests)
+	d, dead := dispatcher(3)
+
+	if err := d.Enqueue(Delivery{ID: "d1", URL: url, Body: []byte("{}")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		r.next(t)
+	}
+
+	select {
+	case delivery := <-dead:
+		t.Fatalf("delivered event was dead-lettered: %+v", delivery)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRejectedDeliveryIsNotRetried(t *testing.T) {
+	r, url := newReceiver(t, http.StatusBadRequest)
+	d, dead := dispatcher(5)
+
+	if err := d.Enqueue(Delivery{ID: "d1", URL: url, Body: []byte("{}")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	r.next(t)
+
+	select {
+	case delivery := <-dead:
+		if delivery.Attempts != 1 {
+			t.Fatalf("dead letter after %d attempts, want 1", delivery.Attempts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rejected delivery was not dead-lettered")
+	}
+	select {
+	case <-r.requests:
+		t.Fatal("rejected delivery was retried")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeliveryToLoopbackIsRefused(t *testing.T) {
+	r, url := newReceiver(t)
+	dead := make(deadLetters, 1)
+	d := NewDispatcher(config.WebhookConfiguration{Workers: 1, MaxAttempts: 5}, dead.record)
+	d.Start()
+
+	if err := d.Enqueue(Delivery{ID: "d1", URL: url, Body: []byte("{}")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// Refused without connecting, and not retried
+	select {
+	case delivery := <-dead:
+		if delivery.Attempts != 1 {
+			t.Fatalf("dead letter after %d attempts, want 1", delivery.Attempts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("delivery to loopback was not dead-lettered")
+	}
+	select {
+	case <-r.requests:
+		t.Fatal("receiver on loopback got the delivery")
+	default:
+	}
+}
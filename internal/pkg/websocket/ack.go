@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ackTimeout is how long a client has to acknowledge an event before it
+	// is sent again
+	ackTimeout = 10 * time.Second
+
+	// maxAckRetries is how often an unacknowledged event is resent before
+	// it is moved to the offline queue
+	maxAckRetries = 3
+)
+
+// ackedEvents are message deliveries that clients opting into acks must
+// confirm with a message_ack event carrying the event's ack_id
+var ackedEvents = map[string]bool{
+	"private_message": true,
+	"group_message":   true,
+}
+
+// pendingAck is an event sent to a client and not acknowledged yet
+type pendingAck struct {
+	event   string
+	data    map[string]interface{}
+	payload []byte
+	sentAt  time.Time
+	retries int
+}
+
+// ackTracker holds the unacknowledged events of one connection
+type ackTracker struct {
+	mu      sync.Mutex
+	pending map[string]*pendingAck
+}
+
+func (t *ackTracker) add(ackID string, p *pendingAck) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = make(map[string]*pendingAck)
+	}
+	t.pending[ackID] = p
+}
+
+func (t *ackTracker) remove(ackID string) *pendingAck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.pending[ackID]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, ackID)
+	return p
+}
+
+// due returns the payloads to resend and removes the events that ran out
+// of retries, returning them as expired
+func (t *ackTracker) due(now time.Time) (resend [][]byte, expired []*pendingAck) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for ackID, p := range t.pending {
+		if now.Sub(p.sentAt) < ackTimeout {
+			continue
+		}
+		if p.retries >= maxAckRetries {
+			delete(t.pending, ackID)
+			expired = append(expired, p)
+			continue
+		}
+		p.retries++
+		p.sentAt = now
+		resend = append(resend, p.payload)
+	}
+
+	return resend, expired
+}
+
+// drain removes and returns every unacknowledged event
+func (t *ackTracker) drain() []*pendingAck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	drained := make([]*pendingAck, 0, len(t.pending))
+	for _, p := range t.pending {
+		drained = append(drained, p)
+	}
+	t.pending = nil
+	return drained
+}
+
+// encode marshals an outbound event. Message deliveries to clients that opted
+// into acks get an ack_id and are tracked until acknowledged.
+func (c *Client) encode(event string, data map[string]interface{}) ([]byte, error) {
+	if !c.AckEnabled || !ackedEvents[event] {
+		return json.Marshal(Message{Event: event, Data: data})
+	}
+
+	// The data map is shared between recipients, so tag a copy
+	ackID := uuid.New().String()
+	tagged := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		tagged[k] = v
+	}
+	tagged["ack_id"] = ackID
+
+	payload, err := json.Marshal(Message{Event: event, Data: tagged})
+	if err != nil {
+		return nil, err
+	}
+
+	c.acks.add(ackID, &pendingAck{
+		event:   event,
+		data:    data,
+		payload: payload,
+		sentAt:  time.Now(),
+	})
+
+	return payload, nil
+}
+
+// handleAck confirms delivery of an event, records the message as delivered
+// and tells its sender
+func (c *Client) handleAck(data map[string]interface{}) {
+	ackID, _ := data["ack_id"].(string)
+	p := c.acks.remove(ackID)
+	if p == nil {
+		return
+	}
+
+	messageID := numericID(p.data["message_id"])
+	senderID := numericID(p.data["sender_id"])
+	if messageID == 0 || senderID == 0 || senderID == c.UserID {
+		return
+	}
+	groupID := numericID(p.data["group_id"])
+
+	ctx, cancel := c.queryContext()
+	defer cancel()
+
+	// Resent events are acked again; only the first ack is reported
+	deliveredAt, err := c.Hub.store.MarkMessageDelivered(ctx, messageID, groupID, c.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to record delivery of message %d to user %d: %v", messageID, c.UserID, err)
+		return
+	}
+	if deliveredAt == nil {
+		return
+	}
+
+	delivered := map[string]interface{}{
+		"message_id":   messageID,
+		"chat_type":    "private",
+		"recipient_id": c.UserID,
+		"status":       "delivered",
+		"delivered_at": *deliveredAt,
+	}
+	if groupID != 0 {
+		delivered["chat_type"] = "group"
+		delivered["group_id"] = groupID
+	}
+
+	c.Hub.SendToUser(senderID, "message_delivered", delivered)
+}
+
+// expireAcks resends events that were not acknowledged in time, and queues
+// those that ran out of retries for the next connection
+func (c *Client) expireAcks() [][]byte {
+	resend, expired := c.acks.due(time.Now())
+
+	for _, p := range expired {
+		logrus.Warnf("User %d did not acknowledge %s, queueing it", c.UserID, p.event)
+		queuePendingEvent(c.UserID, p.event, p.data)
+	}
+
+	return resend
+}
+
+// numericID reads an ID from event data, which holds uints for events built
+// locally and float64s for events decoded from Redis
+func numericID(v interface{}) uint {
+	switch id := v.(type) {
+	case uint:
+		return id
+	case float64:
+		return uint(id)
+	case int:
+		return uint(id)
+	}
+	return 0
+}
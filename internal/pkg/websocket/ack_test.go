@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"web-api/internal/pkg/redis"
+)
+
+// deliveryStore records deliveries; the hub calls nothing else of it here
+type deliveryStore struct {
+	MessageStore
+	delivered []uint
+}
+
+func (s *deliveryStore) MarkMessageDelivered(ctx context.Context, messageID, groupID, userID uint) (*time.Time, error) {
+	s.delivered = append(s.delivered, messageID)
+	now := time.Now()
+	return &now, nil
+}
+
+// ackedClient registers a connection of the user that acknowledges
+// deliveries
+func ackedClient(t *testing.T, h *Hub, userID uint) *Client {
+	t.Helper()
+
+	client, _ := addClient(t, h, userID, 8)
+	client.AckEnabled = true
+	return client
+}
+
+// ackID reads the ack_id the client was sent with its next event
+func ackID(t *testing.T, client *Client) string {
+	t.Helper()
+
+	msg := nextFrame(t, client)
+	id, _ := msg.Data["ack_id"].(string)
+	if msg.Event != "private_message" || id == "" {
+		t.Fatalf("client got %+v, want a private_message with an ack_id", msg)
+	}
+	return id
+}
+
+func TestAckedDeliveryIsReportedToTheSender(t *testing.T) {
+	setupRedis(t)
+	store := &deliveryStore{}
+	h := NewHub(store, nil)
+	sender := ackedClient(t, h, 1)
+	receiver := ackedClient(t, h, 2)
+
+	h.SendToUser(2, "private_message", map[string]interface{}{"message_id": uint(7), "sender_id": uint(1)})
+	id := ackID(t, receiver)
+
+	receiver.handleAck(map[string]interface{}{"ack_id": id})
+	if len(store.delivered) != 1 || store.delivered[0] != 7 {
+		t.Fatalf("recorded deliveries %v, want message 7", store.delivered)
+	}
+	msg := nextFrame(t, sender)
+	if msg.Event != "message_delivered" || msg.Data["status"] != "delivered" || uint(msg.Data["recipient_id"].(float64)) != 2 {
+		t.Fatalf("sender got %+v, want message_delivered to user 2", msg)
+	}
+
+	// A repeated ack is not reported again
+	receiver.handleAck(map[string]interface{}{"ack_id": id})
+	if len(store.delivered) != 1 || len(sender.Send) != 0 {
+		t.Fatalf("repeated ack recorded %d deliveries and sent %d frame(s)", len(store.delivered), len(sender.Send))
+	}
+	if resend := receiver.expireAcks(); len(resend) != 0 {
+		t.Fatalf("acknowledged event resent %d time(s)", len(resend))
+	}
+}
+
+func TestUnackedDeliveryIsResentThenQueued(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(&deliveryStore{}, nil)
+	receiver := ackedClient(t, h, 2)
+
+	h.SendToUser(2, "private_message", map[string]interface{}{"message_id": uint(7), "sender_id": uint(1)})
+	id := ackID(t, receiver)
+
+	// overdue backdates every unacknowledged event past the timeout
+	overdue := func() {
+		receiver.acks.mu.Lock()
+		for _, p := range receiver.acks.pending {
+			p.sentAt = time.Now().Add(-ackTimeout)
+		}
+		receiver.acks.mu.Unlock()
+	}
+
+	if resend := receiver.expireAcks(); len(resend) != 0 {
+		t.Fatalf("resent %d event(s) before the timeout", len(resend))
+	}
+	for i := 0; i < maxAckRetries; i++ {
+		overdue()
+		resend := receiver.expireAcks()
+		if len(resend) != 1 || !strings.Contains(string(resend[0]), id) {
+			t.Fatalf("retry %d resent %q, want the event with ack_id %s", i+1, resend, id)
+		}
+	}
+
+	overdue()
+	if resend := receiver.expireAcks(); len(resend) != 0 {
+		t.Fatalf("resent %d event(s) after the last retry", len(resend))
+	}
+	pending, err := redis.PopPendingEvents(2)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	// The queued event gets a fresh ack_id when it is delivered
+	if len(pending) != 1 || !strings.Contains(pending[0], `"private_message"`) || strings.Contains(pending[0], id) {
+		t.Fatalf("pending events %q, want the private_message without its old ack_id", pending)
+	}
+}
@@ -0,0 +1,236 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/metrics"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Binary frames carry media that would bloat as JSON, such as audio chunks.
+// A frame starts with the length of its event name in one byte, followed by
+// the name and the event's body:
+//
+//	[len(event)] [event] [body]
+//
+// The layout of the body depends on the event.
+
+const (
+	// binaryControl is published on a user's channel to deliver a binary
+	// event through another instance. Subscribers turn it back into a
+	// binary frame.
+	binaryControl = "ws_binary"
+
+	// Default inbound rate limit for binary frames, which arrive far more
+	// often than chat events while media is streamed
+	defaultBinaryRate  = 50
+	defaultBinaryBurst = 100
+
+	// How long a checked voice_chunk route is trusted before the call is
+	// looked up again
+	voiceRouteTTL = 5 * time.Second
+)
+
+// Frame is an outbound WebSocket message waiting in a client's Send buffer
+type Frame struct {
+	Opcode  int // websocket.TextMessage or websocket.BinaryMessage
+	Payload []byte
+}
+
+// voiceRoute is a sender's call and the peer it streams audio to
+type voiceRoute struct {
+	callID       uint
+	targetUserID uint
+}
+
+var errInvalidBinaryFrame = errors.New("invalid binary frame")
+
+// encodeBinary builds a binary frame carrying body as event
+func encodeBinary(event string, body []byte) ([]byte, error) {
+	if event == "" || len(event) > 255 {
+		return nil, fmt.Errorf("invalid binary event name %q", event)
+	}
+
+	frame := make([]byte, 0, 1+len(event)+len(body))
+	frame = append(frame, byte(len(event)))
+	frame = append(frame, event...)
+	return append(frame, body...), nil
+}
+
+// decodeBinary splits a binary frame into its event and body
+func decodeBinary(frame []byte) (string, []byte, error) {
+	if len(frame) == 0 || frame[0] == 0 || len(frame) < 1+int(frame[0]) {
+		return "", nil, errInvalidBinaryFrame
+	}
+	end := 1 + int(frame[0])
+	return string(frame[1:end]), frame[end:], nil
+}
+
+// SendBinary sends an event to the client as a binary frame. Unlike text
+// events, binary events that cannot be handed over are dropped rather than
+// queued: stale media is of no use on the next connection.
+func (c *Client) SendBinary(event string, body []byte) error {
+	frame, err := encodeBinary(event, body)
+	if err != nil {
+		return err
+	}
+
+	err = c.trySend(Frame{Opcode: websocket.BinaryMessage, Payload: frame}, 0)
+	if err == nil {
+		metrics.MessagesSent.WithLabelValues(event).Inc()
+		return nil
+	}
+	if err == errClientClosed {
+		return err
+	}
+
+	c.Hub.recordDroppedMessage()
+	logrus.Warnf("Send buffer of user %d is full, dropped binary %s", c.UserID, event)
+	c.disconnectSlow()
+
+	return err
+}
+
+// writeBinary writes a binary frame. Binary events are media that is
+// compressed already, so the frame never is.
+func (c *Client) writeBinary(payload []byte) error {
+	c.Conn.EnableWriteCompression(false)
+	return c.Conn.WriteMessage(websocket.BinaryMessage, payload)
+}
+
+// setupBinaryRateLimit creates the connection's token bucket for binary
+// frames from config
+func (c *Client) setupBinaryRateLimit() {
+	binaryRate := float64(defaultBinaryRate)
+	binaryBurst := defaultBinaryBurst
+
+	if cfg := config.GetConfig(); cfg != nil {
+		if cfg.WebSocket.BinaryRate > 0 {
+			binaryRate = cfg.WebSocket.BinaryRate
+		}
+		if cfg.WebSocket.BinaryBurst > 0 {
+			binaryBurst = cfg.WebSocket.BinaryBurst
+		}
+	}
+
+	c.binaryLimiter = rate.NewLimiter(rate.Limit(binaryRate), binaryBurst)
+}
+
+// handleBinary routes an inbound binary frame to the handler of its event.
+// It runs on ReadPump and reports false once the connection is to be closed
+// for flooding.
+func (c *Client) handleBinary(frame []byte) bool {
+	event, body, err := decodeBinary(frame)
+	if err != nil {
+		metrics.MessagesReceived.WithLabelValues("invalid").Inc()
+		c.replyBinaryError("", "invalid_message", err)
+		return true
+	}
+
+	if !c.binaryLimiter.Allow() {
+		c.recordViolation(event)
+		return !c.flooding()
+	}
+
+	label := event
+	defer func() {
+		metrics.MessagesReceived.WithLabelValues(label).Inc()
+	}()
+
+	switch event {
+	case "voice_chunk":
+		c.handleVoiceChunk(body)
+	default:
+		label = "unknown"
+		c.replyBinaryError(event, "invalid_message", fmt.Errorf("unsupported binary event: %s", event))
+	}
+	return true
+}
+
+// handleVoiceChunk relays a chunk of call audio to a peer. The body holds
+// the call ID and the target user ID as big-endian uint32s, followed by the
+// audio. The peer receives the call ID and the sender's ID in the same
+// layout. Chunks are only relayed while the call is connected.
+func (c *Client) handleVoiceChunk(body []byte) {
+	if len(body) < 8 {
+		c.replyBinaryError("voice_chunk", "invalid_message", errors.New("voice_chunk must have call_id and target_user_id"))
+		return
+	}
+
+	route := voiceRoute{
+		callID:       uint(binary.BigEndian.Uint32(body[0:4])),
+		targetUserID: uint(binary.BigEndian.Uint32(body[4:8])),
+	}
+
+	if checked, ok := c.voiceRoutes[route]; !ok || time.Since(checked) > voiceRouteTTL {
+		status, err := c.Hub.calls.CheckICERoute(route.callID, c.UserID, route.targetUserID)
+		if err == nil && status != models.CallStatusConnected {
+			err = fmt.Errorf("call %d is not connected", route.callID)
+		}
+		if err != nil {
+			delete(c.voiceRoutes, route)
+			logrus.Debugf("Rejected voice chunk for call %d from user %d: %v", route.callID, c.UserID, err)
+			return
+		}
+		if c.voiceRoutes == nil {
+			c.voiceRoutes = make(map[voiceRoute]time.Time)
+		}
+		c.voiceRoutes[route] = time.Now()
+	}
+
+	relayed := make([]byte, len(body))
+	copy(relayed, body)
+	binary.BigEndian.PutUint32(relayed[4:8], uint32(c.UserID))
+
+	c.Hub.SendBinaryToUser(route.targetUserID, "voice_chunk", relayed)
+}
+
+// replyBinaryError tells the client a binary frame was rejected
+func (c *Client) replyBinaryError(event, code string, err error) {
+	c.SendMessage("error", map[string]interface{}{
+		"code":    code,
+		"event":   event,
+		"message": err.Error(),
+	})
+}
+
+// SendBinaryToUser sends a binary event to every live connection of a user,
+// on this instance directly and on the others through the user's Redis
+// channel, where the body travels base64-encoded. Binary events are never
+// queued for users without a connection.
+func (h *Hub) SendBinaryToUser(userID uint, event string, body []byte) {
+	for _, client := range h.getClients(userID) {
+		client.SendBinary(event, body)
+	}
+
+	channel := fmt.Sprintf("ws:user:%d", userID)
+	if _, err := redis.PublishEventFrom(channel, h.instanceID, binaryControl, map[string]interface{}{
+		"event": event,
+		"body":  body,
+	}); err != nil {
+		logrus.Errorf("Failed to publish binary %s to user %d: %v", event, userID, err)
+	}
+}
+
+// deliverBinaryControl sends a binary event published by another instance
+// to the client
+func (c *Client) deliverBinaryControl(data map[string]interface{}) error {
+	event, _ := data["event"].(string)
+	encoded, _ := data["body"].(string)
+
+	body, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid body of binary %s: %w", event, err)
+	}
+	return c.SendBinary(event, body)
+}
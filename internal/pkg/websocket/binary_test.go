@@ -0,0 +1,143 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"web-api/internal/pkg/models"
+)
+
+// callRoutes answers CheckICERoute with a fixed status for every call
+type callRoutes struct {
+	CallStore
+	status models.CallStatus
+}
+
+func (s callRoutes) CheckICERoute(callID, fromUserID, targetUserID uint) (models.CallStatus, error) {
+	if callID != 7 {
+		return "", errors.New("call not found")
+	}
+	return s.status, nil
+}
+
+// voiceChunk builds the body of a voice_chunk: the call ID and a user ID,
+// followed by the audio
+func voiceChunk(callID, userID uint32, audio []byte) []byte {
+	body := make([]byte, 8, 8+len(audio))
+	binary.BigEndian.PutUint32(body[0:4], callID)
+	binary.BigEndian.PutUint32(body[4:8], userID)
+	return append(body, audio...)
+}
+
+// readFrame reads the next frame the peer receives
+func readFrame(t *testing.T, peer *websocket.Conn) (int, []byte) {
+	t.Helper()
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	opcode, payload, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return opcode, payload
+}
+
+func TestBinaryFrameEncoding(t *testing.T) {
+	frame, err := encodeBinary("voice_chunk", []byte{0, 1, 2})
+	if err != nil {
+		t.Fatalf("encodeBinary: %v", err)
+	}
+	event, body, err := decodeBinary(frame)
+	if err != nil || event != "voice_chunk" || !bytes.Equal(body, []byte{0, 1, 2}) {
+		t.Fatalf("decoded %q %v, %v; want voice_chunk [0 1 2]", event, body, err)
+	}
+
+	for _, frame := range [][]byte{nil, {0, 'x'}, {5, 'v', 'o'}} {
+		if _, _, err := decodeBinary(frame); err != errInvalidBinaryFrame {
+			t.Errorf("decodeBinary(%v) = %v, want %v", frame, err, errInvalidBinaryFrame)
+		}
+	}
+	if _, err := encodeBinary("", nil); err == nil {
+		t.Error("encodeBinary accepted an empty event name")
+	}
+}
+
+func TestVoiceChunkRoundTrip(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, callRoutes{status: models.CallStatusConnected})
+
+	alice, alicePeer := addClient(t, h, 1, 8)
+	readPump(t, h, alice)
+	go alice.WritePump()
+	bob, bobPeer := addClient(t, h, 2, 8)
+	go bob.WritePump()
+	t.Cleanup(func() {
+		h.deleteClient(alice)
+		h.deleteClient(bob)
+	})
+
+	// A text event queued ahead of the chunk reaches bob first
+	bob.SendMessage("typing", map[string]interface{}{"user_id": 1})
+
+	audio := []byte("\x00\xffnot json at all\n")
+	frame, _ := encodeBinary("voice_chunk", voiceChunk(7, 2, audio))
+	if err := alicePeer.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if opcode, payload := readFrame(t, bobPeer); opcode != websocket.TextMessage || !bytes.Contains(payload, []byte(`"typing"`)) {
+		t.Fatalf("bob first got opcode %d %q, want the typing event", opcode, payload)
+	}
+	opcode, payload := readFrame(t, bobPeer)
+	if opcode != websocket.BinaryMessage {
+		t.Fatalf("bob got opcode %d, want a binary frame", opcode)
+	}
+	event, body, err := decodeBinary(payload)
+	if err != nil || event != "voice_chunk" {
+		t.Fatalf("bob got %q, %v; want voice_chunk", event, err)
+	}
+	// The target is replaced by the sender
+	if !bytes.Equal(body, voiceChunk(7, 1, audio)) {
+		t.Fatalf("bob got body %v, want call 7 from user 1 with the audio", body)
+	}
+
+	// Binary frames that do not decode, or name no binary event, are
+	// answered with an error rather than parsed as JSON
+	unsupported, _ := encodeBinary("sticker", []byte{1})
+	for _, frame := range [][]byte{{0}, unsupported} {
+		if err := alicePeer.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		opcode, payload := readFrame(t, alicePeer)
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); opcode != websocket.TextMessage || err != nil ||
+			msg.Event != "error" || msg.Data["code"] != "invalid_message" {
+			t.Fatalf("frame %v answered with opcode %d %q, want an invalid_message error", frame, opcode, payload)
+		}
+	}
+}
+
+func TestVoiceChunkNeedsAConnectedCall(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, callRoutes{status: models.CallStatusRinging})
+	alice, alicePeer := addClient(t, h, 1, 8)
+	readPump(t, h, alice)
+	bob, _ := addClient(t, h, 2, 8)
+
+	for _, callID := range []uint32{7, 8} {
+		frame, _ := encodeBinary("voice_chunk", voiceChunk(callID, 2, []byte("audio")))
+		if err := alicePeer.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(bob.Send); n != 0 {
+		t.Fatalf("bob got %d frame(s) of a call that is not connected", n)
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"web-api/internal/pkg/redis"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// broadcastChannel carries system messages to every instance, which
+	// sends them to its local connections
+	broadcastChannel = "ws:broadcast"
+
+	// systemMessageEvent is the event of admin announcements
+	systemMessageEvent = "system_message"
+)
+
+// systemBroadcast is what travels on broadcastChannel. An empty UserIDs
+// addresses every connected user.
+type systemBroadcast struct {
+	Data    map[string]interface{} `json:"data"`
+	UserIDs []uint                 `json:"user_ids,omitempty"`
+}
+
+// PublishSystemMessage sends a system_message event to the users connected
+// to any instance, or only to those of userIDs if any are given. Users who
+// are offline do not get it later; system messages are not persisted.
+func PublishSystemMessage(data map[string]interface{}, userIDs []uint) error {
+	return redis.PublishWebSocketMessage(broadcastChannel, map[string]interface{}{
+		"data":     data,
+		"user_ids": userIDs,
+	})
+}
+
+// listenBroadcasts delivers the system messages published by any instance
+// to the local connections. It returns when the hub stops.
+func (h *Hub) listenBroadcasts() {
+	pubsub := redis.Subscribe(broadcastChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-h.done:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var broadcast systemBroadcast
+			if err := json.Unmarshal([]byte(msg.Payload), &broadcast); err != nil {
+				logrus.Errorf("Failed to unmarshal system message: %v", err)
+				continue
+			}
+			h.deliverSystemMessage(broadcast)
+		}
+	}
+}
+
+// deliverSystemMessage sends a system message to the addressed local
+// connections, encoding it once for all of them
+func (h *Hub) deliverSystemMessage(broadcast systemBroadcast) {
+	payload, err := json.Marshal(Message{Event: systemMessageEvent, Data: broadcast.Data})
+	if err != nil {
+		logrus.Errorf("Failed to marshal system message: %v", err)
+		return
+	}
+
+	var clients []*Client
+	if len(broadcast.UserIDs) == 0 {
+		clients = h.allClients()
+	} else {
+		for _, userID := range broadcast.UserIDs {
+			clients = append(clients, h.getClients(userID)...)
+		}
+	}
+
+	for _, client := range clients {
+		client.send(systemMessageEvent, broadcast.Data, payload)
+	}
+
+	logrus.Debugf("Delivered system message to %d local connection(s)", len(clients))
+}
@@ -0,0 +1,39 @@
+package websocket
+
+import "testing"
+
+func TestSystemMessageReachesEveryConnection(t *testing.T) {
+	mr := setupRedis(t)
+	h := runHub(t)
+	within(t, func() bool { return mr.PubSubNumSub(broadcastChannel)[broadcastChannel] > 0 })
+
+	phone, _ := addClient(t, h, 1, 8)
+	laptop, _ := addClient(t, h, 1, 8)
+	bob, _ := addClient(t, h, 2, 8)
+	carol, _ := addClient(t, h, 3, 8)
+	everyone := []*Client{phone, laptop, bob, carol}
+
+	if err := PublishSystemMessage(map[string]interface{}{"content": "maintenance at noon"}, nil); err != nil {
+		t.Fatalf("PublishSystemMessage: %v", err)
+	}
+	for _, client := range everyone {
+		within(t, func() bool { return len(client.Send) > 0 })
+		if msg := nextFrame(t, client); msg.Event != systemMessageEvent || msg.Data["content"] != "maintenance at noon" {
+			t.Fatalf("user %d got %+v, want the system message", client.UserID, msg)
+		}
+	}
+
+	// Addressed to user 2 only
+	if err := PublishSystemMessage(map[string]interface{}{"content": "for the group"}, []uint{2}); err != nil {
+		t.Fatalf("PublishSystemMessage: %v", err)
+	}
+	within(t, func() bool { return len(bob.Send) > 0 })
+	if msg := nextFrame(t, bob); msg.Data["content"] != "for the group" {
+		t.Fatalf("user 2 got %+v, want the addressed system message", msg)
+	}
+	for _, client := range []*Client{phone, laptop, carol} {
+		if n := len(client.Send); n != 0 {
+			t.Fatalf("user %d got %d frame(s) of a message addressed to user 2", client.UserID, n)
+		}
+	}
+}
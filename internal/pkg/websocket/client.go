@@ -3,14 +3,22 @@ package websocket
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/metrics"
 	"web-api/internal/pkg/redis"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	redispkg "github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -25,17 +33,95 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512 * 1024 // 512 KB
+
+	// Default inbound rate limit per connection
+	defaultMessageRate  = 10
+	defaultMessageBurst = 20
+
+	// Default number of throttled messages before disconnecting
+	defaultMaxRateViolations = 50
+
+	// Rate violations older than this are forgiven
+	rateViolationWindow = 10 * time.Second
+
+	// How long the client's own goroutines may wait for room in a full
+	// Send buffer; the hub never waits
+	sendTimeout = 250 * time.Millisecond
+)
+
+var (
+	// errClientClosed is returned when sending to a client that disconnected
+	errClientClosed = errors.New("client connection closed")
+
+	// errSendBufferFull is returned when an event does not fit a client's
+	// Send buffer
+	errSendBufferFull = errors.New("send buffer full")
 )
 
 // Client represents a websocket client
 type Client struct {
 	Hub             *Hub
 	Conn            *websocket.Conn
-	Send            chan []byte
+	Send            chan Frame
 	UserID          uint
 	Username        string
+	ConnID          string // Unique per connection; a user may have several
 	redisSubscriber *redispkg.PubSub
 	stopSubscriber  chan struct{}
+
+	// AckEnabled is set for clients that confirm message deliveries with
+	// message_ack; their unacknowledged deliveries are resent
+	AckEnabled bool
+	acks       ackTracker
+
+	// sendMu guards sendClosed so that nothing is sent on a closed Send
+	sendMu     sync.RWMutex
+	sendClosed bool
+
+	// tooSlow is set once the client is disconnected for not keeping up
+	tooSlow atomic.Bool
+
+	// Inbound rate limiting, only touched by ReadPump
+	limiter       *rate.Limiter
+	binaryLimiter *rate.Limiter
+	violations    int
+	lastViolation time.Time
+	maxViolations int
+
+	// voiceRoutes caches when each voice_chunk route was last checked,
+	// only touched by ReadPump
+	voiceRoutes map[voiceRoute]time.Time
+
+	// ctx is cancelled when the connection drops, aborting the queries
+	// still running for its events
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewClient creates the client of an upgraded connection
+func NewClient(hub *Hub, conn *websocket.Conn, userID uint, username string, ackEnabled bool) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		Hub:        hub,
+		Conn:       conn,
+		Send:       make(chan Frame, 256),
+		UserID:     userID,
+		Username:   username,
+		ConnID:     uuid.New().String(),
+		AckEnabled: ackEnabled,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// queryContext returns the context for the queries made for one of the
+// client's events, bounded by the query timeout
+func (c *Client) queryContext() (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if c != nil && c.ctx != nil {
+		parent = c.ctx
+	}
+	return context.WithTimeout(parent, database.QueryTimeout())
 }
 
 // StartRedisSubscriber starts listening for Redis messages for this user
@@ -50,9 +136,7 @@ func (c *Client) StartRedisSubscriber() {
 
 	go func() {
 		defer func() {
-			if c.redisSubscriber != nil {
-				c.redisSubscriber.Close()
-			}
+			pubsub.Close()
 			logrus.Infof("Redis subscriber stopped for user %d", c.UserID)
 		}()
 
@@ -62,11 +146,7 @@ func (c *Client) StartRedisSubscriber() {
 				logrus.Infof("Stopping Redis subscriber for user %d", c.UserID)
 				return
 			default:
-				if c.redisSubscriber == nil {
-					return
-				}
-
-				msg, err := c.redisSubscriber.ReceiveMessage(context.Background())
+				msg, err := pubsub.ReceiveMessage(context.Background())
 				if err != nil {
 					logrus.Errorf("Redis subscriber error for user %d: %v", c.UserID, err)
 					return
@@ -79,6 +159,11 @@ func (c *Client) StartRedisSubscriber() {
 					continue
 				}
 
+				// Already delivered locally by this instance's SendToUser
+				if origin, _ := messageData["origin"].(string); origin == c.Hub.instanceID {
+					continue
+				}
+
 				// Create WebSocket message
 				event, ok := messageData["event"].(string)
 				if !ok {
@@ -90,24 +175,36 @@ func (c *Client) StartRedisSubscriber() {
 					data = make(map[string]interface{})
 				}
 
-				wsMessage := Message{
-					Event: event,
-					Data:  data,
+				// Another instance disconnected this user
+				if event == disconnectControl {
+					reason, _ := data["reason"].(string)
+					c.closeWithReason(websocket.ClosePolicyViolation, reason)
+					return
 				}
 
-				jsonMsg, err := json.Marshal(wsMessage)
+				// Another instance relayed a binary event
+				if event == binaryControl {
+					if err := c.deliverBinaryControl(data); err == errClientClosed {
+						return
+					} else if err != nil {
+						logrus.Errorf("Failed to deliver binary event to user %d: %v", c.UserID, err)
+					}
+					continue
+				}
+
+				// A removed contact's presence may no longer be watched
+				if event == "contact_removed" {
+					c.Hub.presence.unsubscribe(c, []uint{numericID(data["user_id"])})
+				}
+
+				jsonMsg, err := c.encode(event, data)
 				if err != nil {
 					logrus.Errorf("Failed to marshal WebSocket message: %v", err)
 					continue
 				}
 
 				// Send to client's WebSocket connection with timeout
-				select {
-				case c.Send <- jsonMsg:
-					logrus.Debugf("Sent Redis message to user %d: %s", c.UserID, event)
-				case <-time.After(1 * time.Second):
-					logrus.Warnf("Client %d send channel timeout, dropping message", c.UserID)
-				case <-c.stopSubscriber:
+				if err := c.sendWithin(event, data, jsonMsg, sendTimeout); err == errClientClosed {
 					return
 				}
 			}
@@ -134,11 +231,21 @@ func (c *Client) StopRedisSubscriber() {
 // ReadPump pumps messages from the websocket connection to the hub
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		if c.cancel != nil {
+			c.cancel()
+		}
+		select {
+		case c.Hub.Unregister <- c:
+		case <-c.Hub.done:
+			// Hub already stopped
+		}
 		c.Conn.Close()
 		c.StopRedisSubscriber()
 	}()
 
+	c.setupRateLimit()
+	c.setupBinaryRateLimit()
+
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetPongHandler(func(string) error {
@@ -147,7 +254,7 @@ func (c *Client) ReadPump() {
 	})
 
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		messageType, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logrus.Errorf("websocket error: %v", err)
@@ -155,6 +262,14 @@ func (c *Client) ReadPump() {
 			break
 		}
 
+		// Binary frames carry media, not JSON events
+		if messageType == websocket.BinaryMessage {
+			if !c.handleBinary(message) {
+				break
+			}
+			continue
+		}
+
 		// Parse message
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -162,33 +277,117 @@ func (c *Client) ReadPump() {
 			continue
 		}
 
-		// Add sender info to message data
+		// Acks concern this connection only and never reach the hub
+		if msg.Event == "message_ack" {
+			c.handleAck(msg.Data)
+			continue
+		}
+
+		// Heartbeats stay exempt so throttled clients are not marked offline
+		if msg.Event != "ping" && !c.allowMessage(msg.Event) {
+			if c.flooding() {
+				break
+			}
+			continue
+		}
+
+		// Sender info comes from the authenticated connection, replacing
+		// whatever the client claimed so nobody can speak for another user
 		if msg.Data == nil {
 			msg.Data = make(map[string]interface{})
 		}
 		msg.Data["sender_id"] = c.UserID
 		msg.Data["sender_username"] = c.Username
+		delete(msg.Data, "username")
 
 		// Send to hub for processing
-		c.Hub.Broadcast <- BroadcastMessage{
+		select {
+		case c.Hub.Broadcast <- BroadcastMessage{
 			Message:  msg,
 			SenderID: c.UserID,
+			Client:   c,
+		}:
+		case <-c.Hub.done:
+			return
 		}
 	}
 }
 
+// setupRateLimit creates the connection's token bucket from config
+func (c *Client) setupRateLimit() {
+	messageRate := float64(defaultMessageRate)
+	messageBurst := defaultMessageBurst
+	c.maxViolations = defaultMaxRateViolations
+
+	if cfg := config.GetConfig(); cfg != nil {
+		if cfg.WebSocket.MessageRate > 0 {
+			messageRate = cfg.WebSocket.MessageRate
+		}
+		if cfg.WebSocket.MessageBurst > 0 {
+			messageBurst = cfg.WebSocket.MessageBurst
+		}
+		if cfg.WebSocket.MaxRateViolations > 0 {
+			c.maxViolations = cfg.WebSocket.MaxRateViolations
+		}
+	}
+
+	c.limiter = rate.NewLimiter(rate.Limit(messageRate), messageBurst)
+}
+
+// allowMessage consumes a token for an inbound message. Throttled messages
+// are answered with a rate_limited error and counted as violations.
+func (c *Client) allowMessage(event string) bool {
+	if c.limiter.Allow() {
+		return true
+	}
+
+	c.recordViolation(event)
+	return false
+}
+
+// recordViolation counts a throttled message and answers it with a
+// rate_limited error
+func (c *Client) recordViolation(event string) {
+	if time.Since(c.lastViolation) > rateViolationWindow {
+		c.violations = 0
+	}
+	c.violations++
+	c.lastViolation = time.Now()
+
+	c.SendMessage("error", map[string]interface{}{
+		"code":  "rate_limited",
+		"event": event,
+	})
+}
+
+// flooding closes the connection once throttled messages exceed the
+// violations tolerated, reporting whether it did
+func (c *Client) flooding() bool {
+	if c.violations < c.maxViolations {
+		return false
+	}
+
+	logrus.Warnf("Closing connection of user %d after sustained flooding", c.UserID)
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+		time.Now().Add(writeWait))
+	return true
+}
+
 // WritePump pumps messages from the hub to the websocket connection
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
+	ackTicker := time.NewTicker(ackTimeout / 2)
 	defer func() {
 		ticker.Stop()
+		ackTicker.Stop()
 		c.Conn.Close()
 		c.StopRedisSubscriber()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.Send:
+		case frame, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// Hub closed the channel
@@ -196,20 +395,7 @@ func (c *Client) WritePump() {
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.Send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err := c.writeQueued(frame); err != nil {
 				return
 			}
 
@@ -218,27 +404,152 @@ func (c *Client) WritePump() {
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+			// Heartbeat: keep the user's presence key alive while connected
+			if err := redis.SetUserOnline(c.UserID, c.Hub.instanceID); err != nil {
+				logrus.Errorf("Failed to renew presence for user %d: %v", c.UserID, err)
+			}
+
+		case <-ackTicker.C:
+			for _, payload := range c.expireAcks() {
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.writeFrame(payload); err != nil {
+					return
+				}
+			}
 		}
 	}
 }
 
-// SendMessage sends a message to the client
-func (c *Client) SendMessage(event string, data map[string]interface{}) error {
-	msg := Message{
-		Event: event,
-		Data:  data,
+// writeQueued writes frame along with the frames queued behind it. Queued
+// text events are added to the current websocket message; binary frames
+// are written on their own, keeping the order of the queue.
+func (c *Client) writeQueued(frame Frame) error {
+	var events [][]byte
+	n := len(c.Send)
+	for i := 0; ; i++ {
+		if frame.Opcode == websocket.BinaryMessage {
+			if len(events) > 0 {
+				if err := c.writeFrame(events...); err != nil {
+					return err
+				}
+				events = nil
+			}
+			if err := c.writeBinary(frame.Payload); err != nil {
+				return err
+			}
+		} else {
+			events = append(events, frame.Payload)
+		}
+
+		if i == n {
+			break
+		}
+		frame = <-c.Send
 	}
 
-	jsonMsg, err := json.Marshal(msg)
+	if len(events) == 0 {
+		return nil
+	}
+	return c.writeFrame(events...)
+}
+
+// SendMessage sends a message to the client. If the client's buffer stays
+// full, the event is queued for its next connection instead of being lost.
+func (c *Client) SendMessage(event string, data map[string]interface{}) error {
+	jsonMsg, err := c.encode(event, data)
 	if err != nil {
 		return err
 	}
 
+	return c.send(event, data, jsonMsg)
+}
+
+// send hands an encoded event to WritePump without waiting, so a slow
+// client never holds up the hub or the other recipients of an event
+func (c *Client) send(event string, data map[string]interface{}, payload []byte) error {
+	return c.sendWithin(event, data, payload, 0)
+}
+
+// sendWithin is send waiting up to timeout for room in the Send buffer, for
+// the client's own goroutines. An event that cannot be handed over is
+// counted as dropped and the client is disconnected as too slow; it catches
+// up by resyncing when it reconnects.
+func (c *Client) sendWithin(event string, data map[string]interface{}, payload []byte, timeout time.Duration) error {
+	err := c.trySend(Frame{Opcode: websocket.TextMessage, Payload: payload}, timeout)
+	if err == nil {
+		metrics.MessagesSent.WithLabelValues(event).Inc()
+		return nil
+	}
+	if err == errClientClosed {
+		return err
+	}
+
+	c.Hub.recordDroppedMessage()
+
+	// The user's other connections got the event, and would get it again
+	// from the pending queue, so it is only queued for users who have no
+	// other connection here
+	if c.Hub.otherClients(c) == 0 {
+		queuePendingEvent(c.UserID, event, data)
+		logrus.Warnf("Send buffer of user %d is full, queued %s", c.UserID, event)
+	} else {
+		logrus.Warnf("Send buffer of user %d (conn %s) is full, dropped %s", c.UserID, c.ConnID, event)
+	}
+	c.disconnectSlow()
+
+	return err
+}
+
+// disconnectSlow closes the connection of a client that does not keep up.
+// The close runs in the background, since writing the close frame may
+// itself wait on the slow client.
+func (c *Client) disconnectSlow() {
+	if !c.tooSlow.CompareAndSwap(false, true) {
+		return
+	}
+
+	logrus.Warnf("Disconnecting user %d (conn %s): client too slow", c.UserID, c.ConnID)
+	go c.closeWithReason(websocket.CloseTryAgainLater, "client too slow")
+}
+
+// trySend puts a frame on the Send buffer, waiting up to timeout for room
+func (c *Client) trySend(frame Frame, timeout time.Duration) error {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+
+	if c.sendClosed {
+		return errClientClosed
+	}
+
 	select {
-	case c.Send <- jsonMsg:
+	case c.Send <- frame:
 		return nil
 	default:
-		// Channel is full or closed
+	}
+	if timeout <= 0 {
+		return errSendBufferFull
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.Send <- frame:
 		return nil
+	case <-timer.C:
+		return errSendBufferFull
+	}
+}
+
+// closeSend closes the Send buffer, which makes WritePump close the
+// connection. It is safe to call more than once.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
 	}
 }
@@ -0,0 +1,280 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	goredis "github.com/redis/go-redis/v9"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/redis"
+)
+
+// setupRedis points the redis package at an in-process Redis for the
+// duration of the test
+func setupRedis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr(), Protocol: 2})
+
+	prev := redis.Client
+	redis.Client = client
+	t.Cleanup(func() {
+		redis.Client = prev
+		client.Close()
+	})
+	return mr
+}
+
+// connect opens a WebSocket connection to a test server and returns both
+// ends: the server's, which a Client wraps, and the peer's
+func connect(t *testing.T) (server, peer *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+	return server, peer
+}
+
+// addClient registers a connection of the user with the hub, with a Send
+// buffer of the given size that nothing drains
+func addClient(t *testing.T, h *Hub, userID uint, buffer int) (*Client, *websocket.Conn) {
+	t.Helper()
+
+	server, peer := connect(t)
+	client := NewClient(h, server, userID, "user", false)
+	client.Send = make(chan Frame, buffer)
+	if _, ok := h.putClient(client); !ok {
+		t.Fatal("hub rejected the client")
+	}
+	return client, peer
+}
+
+// closeCode waits for the peer to be sent a close frame and returns its
+// code and reason
+func closeCode(t *testing.T, peer *websocket.Conn) (int, string) {
+	t.Helper()
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := peer.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				return closeErr.Code, closeErr.Text
+			}
+			t.Fatalf("read: %v, want a close frame", err)
+		}
+	}
+}
+
+func TestSlowConsumerDoesNotBlockTheHub(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	slow, peer := addClient(t, h, 1, 1)
+	slow.Send <- Frame{Opcode: websocket.TextMessage, Payload: []byte("{}")}
+
+	start := time.Now()
+	h.SendToUser(1, "private_message", map[string]interface{}{"message_id": 1})
+	if elapsed := time.Since(start); elapsed >= sendTimeout {
+		t.Fatalf("SendToUser blocked for %v on a full buffer", elapsed)
+	}
+
+	if dropped := h.droppedMessages.Load(); dropped != 1 {
+		t.Fatalf("counted %d dropped message(s), want 1", dropped)
+	}
+	if code, reason := closeCode(t, peer); code != websocket.CloseTryAgainLater || reason != "client too slow" {
+		t.Fatalf("closed with %d %q, want %d \"client too slow\"", code, reason, websocket.CloseTryAgainLater)
+	}
+
+	// The user's only connection missed the event, so it waits for the next
+	pending, err := redis.PopPendingEvents(1)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	if len(pending) != 1 || !strings.Contains(pending[0], `"private_message"`) {
+		t.Fatalf("pending events %q, want the dropped private_message", pending)
+	}
+}
+
+func TestSlowConsumerWithAnotherDeviceIsNotQueued(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	slow, slowPeer := addClient(t, h, 1, 1)
+	other, _ := addClient(t, h, 1, 8)
+	slow.Send <- Frame{Opcode: websocket.TextMessage, Payload: []byte("{}")}
+
+	h.BroadcastToUsers([]uint{1}, "group_message", map[string]interface{}{"message_id": 1})
+
+	if len(other.Send) != 1 {
+		t.Fatalf("other device has %d frame(s), want the event", len(other.Send))
+	}
+	if code, _ := closeCode(t, slowPeer); code != websocket.CloseTryAgainLater {
+		t.Fatalf("slow device closed with %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+
+	// Queueing would hand the event to the other device a second time
+	pending, err := redis.PopPendingEvents(1)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("queued %q, want nothing while another device is connected", pending)
+	}
+}
+
+func TestSendWithinWaitsForRoom(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	client, _ := addClient(t, h, 1, 1)
+	client.Send <- Frame{Opcode: websocket.TextMessage, Payload: []byte("{}")}
+
+	go func() {
+		time.Sleep(sendTimeout / 5)
+		<-client.Send
+	}()
+
+	if err := client.sendWithin("user_typing", nil, []byte("{}"), sendTimeout); err != nil {
+		t.Fatalf("sendWithin: %v, want the frame to fit once the buffer drained", err)
+	}
+	if client.tooSlow.Load() {
+		t.Fatal("client disconnected although the frame fit in time")
+	}
+}
+
+// useConfig replaces the configuration for the duration of the test
+func useConfig(t *testing.T, cfg *config.Configuration) {
+	t.Helper()
+
+	prev := config.Config
+	config.Config = cfg
+	t.Cleanup(func() { config.Config = prev })
+}
+
+// readPump starts the client's ReadPump with the hub stopped, so that
+// accepted events stay in the Broadcast channel for the test to inspect
+func readPump(t *testing.T, h *Hub, client *Client) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		client.ReadPump()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		// Nothing runs the hub to take the unregistration, and the read
+		// only ends once the connection does
+		h.doneOnce.Do(func() { close(h.done) })
+		client.Conn.Close()
+		<-done
+	})
+}
+
+func TestInboundMessagesAreThrottled(t *testing.T) {
+	setupRedis(t)
+	useConfig(t, &config.Configuration{WebSocket: config.WebSocketConfiguration{
+		MessageRate:       1,
+		MessageBurst:      3,
+		MaxRateViolations: 2,
+	}})
+	h := NewHub(nil, nil)
+	client, peer := addClient(t, h, 1, 8)
+	readPump(t, h, client)
+
+	for i := 0; i < 10; i++ {
+		if err := peer.WriteJSON(Message{Event: "typing", Data: map[string]interface{}{"conversation_id": "private:2"}}); err != nil {
+			break // the server closed the connection
+		}
+	}
+
+	if code, reason := closeCode(t, peer); code != websocket.ClosePolicyViolation || reason != "rate limit exceeded" {
+		t.Fatalf("closed with %d %q, want %d \"rate limit exceeded\"", code, reason, websocket.ClosePolicyViolation)
+	}
+	if n := len(h.Broadcast); n != 3 {
+		t.Fatalf("%d message(s) reached the hub, want the burst of 3", n)
+	}
+	for i := 0; i < 2; i++ {
+		if msg := nextFrame(t, client); msg.Event != "error" || msg.Data["code"] != "rate_limited" {
+			t.Fatalf("throttled message answered with %+v, want a rate_limited error", msg)
+		}
+	}
+}
+
+func TestInjectedUsernameWins(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	alice, peer := addClient(t, h, 1, 8)
+	alice.Username = "alice"
+	bob, _ := addClient(t, h, 2, 8)
+	readPump(t, h, alice)
+
+	// The client claims to be someone else, in every field it can
+	if err := peer.WriteJSON(Message{Event: "typing", Data: map[string]interface{}{
+		"conversation_id": "private:2",
+		"sender_id":       99,
+		"sender_username": "mallory",
+		"username":        "mallory",
+	}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var bm BroadcastMessage
+	select {
+	case bm = <-h.Broadcast:
+	case <-time.After(2 * time.Second):
+		t.Fatal("typing event did not reach the hub")
+	}
+	if bm.SenderID != 1 || bm.Message.Data["sender_id"] != uint(1) || bm.Message.Data["sender_username"] != "alice" {
+		t.Fatalf("hub got sender %d with %+v, want alice's", bm.SenderID, bm.Message.Data)
+	}
+	if _, ok := bm.Message.Data["username"]; ok {
+		t.Fatalf("client-supplied username reached the hub: %+v", bm.Message.Data)
+	}
+
+	h.handleTypingIndicator(bm)
+	if msg := nextFrame(t, bob); msg.Event != "typing" || msg.Data["username"] != "alice" || msg.Data["user_id"] != float64(1) {
+		t.Fatalf("bob got %+v, want alice typing", msg)
+	}
+}
+
+func TestQueriesEndWithTheConnection(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	client, peer := addClient(t, h, 1, 8)
+	ctx, cancel := client.queryContext()
+	defer cancel()
+	readPump(t, h, client)
+
+	peer.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("query context outlived the connection")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("query context err = %v, want %v", ctx.Err(), context.Canceled)
+	}
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"sync"
+
+	"web-api/internal/pkg/metrics"
+)
+
+// clientShards is the number of locks the connected clients are spread
+// over. Users hash to a shard by ID, so sends to different users rarely
+// wait on each other.
+const clientShards = 32
+
+// clientShard holds the connections of the users hashing to it
+// (userID -> connID -> client)
+type clientShard struct {
+	mu      sync.RWMutex
+	clients map[uint]map[string]*Client
+}
+
+// shard returns the shard holding userID's connections
+func (h *Hub) shard(userID uint) *clientShard {
+	return &h.shards[userID%clientShards]
+}
+
+// getClients returns the user's live connections on this instance
+func (h *Hub) getClients(userID uint) []*Client {
+	s := h.shard(userID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(s.clients[userID]))
+	for _, client := range s.clients[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// otherClients counts the user's connections other than client
+func (h *Hub) otherClients(client *Client) int {
+	s := h.shard(client.UserID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	others := len(s.clients[client.UserID])
+	if _, ok := s.clients[client.UserID][client.ConnID]; ok {
+		others--
+	}
+	return others
+}
+
+// putClient adds a connection and reports whether it is the user's first.
+// It refuses the connection once Shutdown has started; the check happens
+// under the shard lock, so Shutdown either sees the client or the client
+// sees the flag.
+func (h *Hub) putClient(client *Client) (firstConn, ok bool) {
+	s := h.shard(client.UserID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h.shuttingDown.Load() {
+		return false, false
+	}
+
+	conns, found := s.clients[client.UserID]
+	if !found {
+		conns = make(map[string]*Client)
+		s.clients[client.UserID] = conns
+	}
+	conns[client.ConnID] = client
+	metrics.ActiveConnections.Inc()
+	return len(conns) == 1, true
+}
+
+// deleteClient removes a connection, closing its Send channel, and reports
+// whether it was the user's last
+func (h *Hub) deleteClient(client *Client) (lastConn bool) {
+	s := h.shard(client.UserID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns, ok := s.clients[client.UserID]
+	if !ok {
+		return false
+	}
+	if _, ok := conns[client.ConnID]; ok {
+		delete(conns, client.ConnID)
+		client.closeSend()
+		metrics.ActiveConnections.Dec()
+	}
+	if len(conns) == 0 {
+		delete(s.clients, client.UserID)
+		return true
+	}
+	return false
+}
+
+// rangeClients calls fn for every connected user, one shard at a time with
+// that shard read-locked. fn must not call back into the shard helpers.
+func (h *Hub) rangeClients(fn func(userID uint, conns map[string]*Client)) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for userID, conns := range s.clients {
+			fn(userID, conns)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// allClients returns every live connection on this instance
+func (h *Hub) allClients() []*Client {
+	var clients []*Client
+	h.rangeClients(func(_ uint, conns map[string]*Client) {
+		for _, client := range conns {
+			clients = append(clients, client)
+		}
+	})
+	return clients
+}
+
+// userCount returns the number of users with a live connection
+func (h *Hub) userCount() int {
+	count := 0
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		count += len(s.clients)
+		s.mu.RUnlock()
+	}
+	return count
+}
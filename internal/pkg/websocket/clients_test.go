@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// clientMap is what the benchmark below exercises of a client registry
+type clientMap interface {
+	get(userID uint) []*Client
+	put(client *Client)
+	delete(client *Client)
+}
+
+// singleLockClients is the registry as it was before sharding: one map
+// behind one lock
+type singleLockClients struct {
+	mu      sync.RWMutex
+	clients map[uint]map[string]*Client
+}
+
+func (m *singleLockClients) get(userID uint) []*Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(m.clients[userID]))
+	for _, client := range m.clients[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (m *singleLockClients) put(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients[client.UserID] == nil {
+		m.clients[client.UserID] = make(map[string]*Client)
+	}
+	m.clients[client.UserID][client.ConnID] = client
+}
+
+func (m *singleLockClients) delete(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.clients[client.UserID], client.ConnID)
+	if len(m.clients[client.UserID]) == 0 {
+		delete(m.clients, client.UserID)
+	}
+}
+
+// shardedClients adapts the hub's sharded registry
+type shardedClients struct{ h *Hub }
+
+func (m shardedClients) get(userID uint) []*Client { return m.h.getClients(userID) }
+func (m shardedClients) put(client *Client)        { m.h.putClient(client) }
+func (m shardedClients) delete(client *Client)     { m.h.deleteClient(client) }
+
+// benchClient makes a connection of the user that nothing reads from
+func benchClient(userID uint, connID string) *Client {
+	return &Client{UserID: userID, ConnID: connID, Send: make(chan Frame, 1)}
+}
+
+// benchmarkClients runs sends (lookups) with every tenth operation a
+// connect or disconnect, from all CPUs at once, over 10,000 connected users
+func benchmarkClients(b *testing.B, m clientMap) {
+	const users = 10000
+	for userID := uint(1); userID <= users; userID++ {
+		m.put(benchClient(userID, "conn"))
+	}
+
+	var worker atomic.Uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := worker.Add(1)
+		// Each goroutine connects its own extra user, so puts and deletes
+		// always pair up
+		churn := benchClient(users+uint(id), fmt.Sprintf("churn-%d", id))
+		userID, connected := uint(id), false
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				if connected {
+					m.delete(churn)
+				} else {
+					m.put(churn)
+				}
+				connected = !connected
+				continue
+			}
+			userID = userID*7919%users + 1
+			m.get(userID)
+		}
+	})
+}
+
+// BenchmarkClients compares the single lock registry with the sharded one
+// under concurrent load:
+//
+//	go test ./internal/pkg/websocket -run '^$' -bench Clients -cpu 1,8
+func BenchmarkClients(b *testing.B) {
+	b.Run("single-lock", func(b *testing.B) {
+		benchmarkClients(b, &singleLockClients{clients: make(map[uint]map[string]*Client)})
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkClients(b, shardedClients{NewHub(nil, nil)})
+	})
+}
+
+func TestShardedClients(t *testing.T) {
+	h := NewHub(nil, nil)
+	phone, laptop := benchClient(1, "phone"), benchClient(1, "laptop")
+	// User 33 hashes to the same shard as user 1
+	other := benchClient(1+clientShards, "phone")
+
+	if first, ok := h.putClient(phone); !first || !ok {
+		t.Fatalf("putClient(phone) = %v, %v; want the user's first connection", first, ok)
+	}
+	if first, _ := h.putClient(laptop); first {
+		t.Fatal("putClient(laptop) reported the user's first connection")
+	}
+	h.putClient(other)
+
+	if got := h.getClients(1); len(got) != 2 {
+		t.Fatalf("user 1 has %d connection(s), want 2", len(got))
+	}
+	if n := h.otherClients(phone); n != 1 {
+		t.Fatalf("otherClients(phone) = %d, want 1", n)
+	}
+	if n := len(h.allClients()); n != 3 {
+		t.Fatalf("allClients has %d connection(s), want 3", n)
+	}
+
+	if last := h.deleteClient(phone); last {
+		t.Fatal("deleteClient(phone) reported the user's last connection")
+	}
+	if _, open := <-phone.Send; open {
+		t.Fatal("deleted connection's Send channel is still open")
+	}
+	if last := h.deleteClient(laptop); !last {
+		t.Fatal("deleteClient(laptop) did not report the user's last connection")
+	}
+	if got := h.getClients(1); len(got) != 0 {
+		t.Fatalf("user 1 still has %d connection(s)", len(got))
+	}
+	if got := h.getClients(other.UserID); len(got) != 1 {
+		t.Fatalf("user %d lost their connection to a neighbour's disconnect", other.UserID)
+	}
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultCompressionThreshold is the smallest frame compressed when no
+// threshold is configured. Below it the deflate overhead outweighs the
+// savings.
+const defaultCompressionThreshold = 1024
+
+// newline separates the events batched into one frame
+var newline = []byte{'\n'}
+
+// wireConn counts the bytes written to a WebSocket's network connection, so
+// that the size of compressed frames on the wire can be measured
+type wireConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Written returns the bytes written so far
+func (c *wireConn) Written() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// meteredResponse hands the upgrader a wireConn when it hijacks the
+// connection
+type meteredResponse struct {
+	http.ResponseWriter
+}
+
+// MeteredResponse wraps the response of a WebSocket handshake so that the
+// clients created on the upgraded connection can measure how much
+// compression saves
+func MeteredResponse(w http.ResponseWriter) http.ResponseWriter {
+	return &meteredResponse{ResponseWriter: w}
+}
+
+func (w *meteredResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &wireConn{Conn: conn}, rw, nil
+}
+
+// compressionThreshold returns the configured smallest compressed frame,
+// falling back to the default
+func compressionThreshold() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.WebSocket.CompressionThreshold > 0 {
+		return cfg.WebSocket.CompressionThreshold
+	}
+	return defaultCompressionThreshold
+}
+
+// writeFrame writes events as one text frame, separated by newlines. The
+// frame is compressed if the client negotiated permessage-deflate and it is
+// at least compressionThreshold bytes; control frames are never compressed.
+func (c *Client) writeFrame(events ...[]byte) error {
+	size := len(events) - 1
+	for _, event := range events {
+		size += len(event)
+	}
+
+	compress := size >= compressionThreshold()
+	c.Conn.EnableWriteCompression(compress)
+
+	wire, _ := c.Conn.UnderlyingConn().(*wireConn)
+	var before int64
+	if wire != nil {
+		before = wire.Written()
+	}
+
+	w, err := c.Conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, event := range events {
+		if i > 0 {
+			w.Write(newline)
+		}
+		w.Write(event)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// Uncompressed frames, including those of clients that did not
+	// negotiate compression, take a few header bytes more than their size
+	// and save nothing
+	if compress && wire != nil {
+		if saved := int64(size) - (wire.Written() - before); saved > 0 {
+			metrics.CompressionSavedBytes.Add(float64(saved))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"web-api/internal/pkg/metrics"
+)
+
+// connectCompressed is connect with permessage-deflate negotiated and the
+// server's end metered, as the WebSocket controller sets it up
+func connectCompressed(t *testing.T) (server, peer *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{EnableCompression: true}).Upgrade(MeteredResponse(w), r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	peer, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("negotiated extensions %q, want permessage-deflate", ext)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+	return server, peer
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	setupRedis(t)
+	server, peer := connectCompressed(t)
+	client := NewClient(NewHub(nil, nil), server, 1, "user", false)
+	go client.WritePump()
+	t.Cleanup(func() { close(client.Send) })
+
+	// receive reads the next event and the bytes compression saved on it
+	receive := func(event string, data map[string]interface{}) (Message, float64) {
+		t.Helper()
+		before := promtest.ToFloat64(metrics.CompressionSavedBytes)
+		if err := client.SendMessage(event, data); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		opcode, payload, err := peer.ReadMessage()
+		if err != nil || opcode != websocket.TextMessage {
+			t.Fatalf("read: opcode %d, %v; want a text frame", opcode, err)
+		}
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatalf("decode %q: %v", payload, err)
+		}
+		return msg, promtest.ToFloat64(metrics.CompressionSavedBytes) - before
+	}
+
+	content := strings.Repeat("the same words over and over ", 4000)
+	msg, saved := receive("sync", map[string]interface{}{"content": content})
+	if msg.Event != "sync" || msg.Data["content"] != content {
+		t.Fatalf("large event arrived as %s with %d byte(s) of content, want all %d", msg.Event, len(msg.Data["content"].(string)), len(content))
+	}
+	if saved < float64(len(content))/2 {
+		t.Fatalf("compression saved %v of %d bytes, want most of them", saved, len(content))
+	}
+
+	// Frames below the threshold are sent as they are
+	if msg, saved := receive("typing", map[string]interface{}{"user_id": 2}); msg.Event != "typing" || saved != 0 {
+		t.Fatalf("small event arrived as %+v saving %v bytes, want it uncompressed", msg, saved)
+	}
+
+	// Control frames are never compressed and still get through
+	pinged := make(chan string, 1)
+	peer.SetPingHandler(func(data string) error {
+		pinged <- data
+		return nil
+	})
+	if err := server.WriteControl(websocket.PingMessage, []byte("still there?"), time.Now().Add(writeWait)); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	client.closeWithReason(websocket.CloseGoingAway, "restarting")
+	if code, reason := closeCode(t, peer); code != websocket.CloseGoingAway || reason != "restarting" {
+		t.Fatalf("closed with %d %q, want %d \"restarting\"", code, reason, websocket.CloseGoingAway)
+	}
+	select {
+	case data := <-pinged:
+		if data != "still there?" {
+			t.Fatalf("ping carried %q", data)
+		}
+	default:
+		t.Fatal("ping did not arrive before the close")
+	}
+}
@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"web-api/internal/pkg/redis"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// disconnectControl is published on a user's channel to make every
+	// instance drop that user's connections. Subscribers act on it instead
+	// of forwarding it to the client.
+	disconnectControl = "ws_disconnect"
+
+	// maxCloseReason is the room left for the reason in a close frame,
+	// whose payload is limited to 125 bytes including the 2-byte code
+	maxCloseReason = 123
+)
+
+// DisconnectUser forcibly closes every connection of a user, on this
+// instance directly and on the others through the user's Redis channel.
+// Each client gets a close frame carrying reason; its ReadPump then fails
+// and unregisters it as for any other disconnect.
+func (h *Hub) DisconnectUser(userID uint, reason string) {
+	reason = truncateCloseReason(reason)
+
+	clients := h.getClients(userID)
+	for _, client := range clients {
+		client.closeWithReason(websocket.ClosePolicyViolation, reason)
+	}
+
+	channel := fmt.Sprintf("ws:user:%d", userID)
+	if _, err := redis.PublishEventFrom(channel, h.instanceID, disconnectControl, map[string]interface{}{
+		"reason": reason,
+	}); err != nil {
+		logrus.Errorf("Failed to publish disconnect of user %d: %v", userID, err)
+	}
+
+	logrus.Infof("Disconnected user %d on %d local connection(s): %s", userID, len(clients), reason)
+}
+
+// closeWithReason sends a close frame and closes the connection
+func (c *Client) closeWithReason(code int, reason string) {
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+	c.Conn.Close()
+}
+
+// truncateCloseReason shortens reason to fit a close frame without cutting
+// a character in half
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
@@ -1,34 +1,62 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"web-api/internal/pkg/config"
 	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/metrics"
 	"web-api/internal/pkg/models"
 	"web-api/internal/pkg/redis"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
+const (
+	// defaultPendingQueueSize caps the events queued for an offline user
+	defaultPendingQueueSize = 500
+
+	// typingTimeout is how long a typing indicator lasts without a follow-up
+	// typing event; it matches the TTL of the Redis typing key
+	typingTimeout = 10 * time.Second
+)
+
+// ephemeralEvents are not worth delivering once the user is back online
+var ephemeralEvents = map[string]bool{
+	"typing":              true,
+	"user_status":         true,
+	"user_online_status":  true,
+	"presence_subscribed": true,
+	"message_delivered":   true,
+	"draft_updated":       true,
+	"error":               true,
+}
+
+// errHubStopped is returned when registering a client with a hub that is
+// shutting down or stopped
+var errHubStopped = errors.New("hub is shutting down")
+
 var (
 	// hubInstance is the global hub instance
 	hubInstance *Hub
+
+	// InstanceID identifies this process among the instances sharing Redis
+	InstanceID = uuid.New().String()
 )
 
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
-	// Registered clients (userID -> client)
-	Clients map[uint]*Client
-
-	// Mutex for thread-safe access to clients map
-	mu sync.RWMutex
+	// Registered clients, sharded by user ID. A user may have several
+	// live connections, e.g. one per browser tab or device.
+	shards [clientShards]clientShard
 
 	// Register requests from clients
 	Register chan *Client
@@ -38,12 +66,86 @@ type Hub struct {
 
 	// Broadcast messages to clients
 	Broadcast chan BroadcastMessage
+
+	// store persists chat messages received over the socket
+	store MessageStore
+
+	// calls handles call signaling received over the socket
+	calls CallStore
+
+	// groupMembers resolves the user IDs of a group's members
+	groupMembers GroupMemberLookup
+
+	// instanceID tags what the hub publishes, so that its own subscribers
+	// skip it. It is InstanceID except in tests running several hubs.
+	instanceID string
+
+	// presence records which connections watch which users' status
+	presence presenceSubscriptions
+
+	// activity drives idle auto-away for locally connected users
+	activity map[uint]*userActivity
+
+	// isContact decides who sees last seen times limited to contacts
+	isContact ContactCheck
+
+	// contactsOf decides whose presence a user may watch
+	contactsOf ContactList
+
+	// typingTimers emit typing_stopped for typists that went silent, keyed
+	// by "<conversationID>:<userID>"
+	typingTimers map[string]*time.Timer
+	typingMu     sync.Mutex
+
+	// shuttingDown rejects new registrations once Shutdown has started
+	shuttingDown atomic.Bool
+
+	// done is closed when the hub stops running
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// droppedMessages counts events that did not fit a client's Send
+	// buffer
+	droppedMessages atomic.Int64
+}
+
+// MessageStore persists and delivers chat messages on behalf of the hub.
+// It is implemented by the service layer and injected at startup, since
+// the services package already imports websocket.
+type MessageStore interface {
+	SendPrivateMessageFromEvent(ctx context.Context, senderID uint, data map[string]interface{}) (*models.PrivateMessage, error)
+	SendGroupMessageFromEvent(ctx context.Context, senderID uint, data map[string]interface{}) (*models.GroupMessage, error)
+	MarkPrivateMessageRead(ctx context.Context, messageID, userID uint) (*models.PrivateMessage, error)
+	MarkGroupMessageRead(ctx context.Context, messageID, groupID, userID uint) (*models.GroupMessage, *time.Time, error)
+	MarkMessageDelivered(ctx context.Context, messageID, groupID, userID uint) (*time.Time, error)
+	SyncConversation(ctx context.Context, userID uint, conversationID string, sinceSeq int64, limit int) (*models.ConversationSync, error)
+}
+
+// CallStore persists call signaling state and notifies the other call
+// parties. Like MessageStore it is implemented by the service layer.
+type CallStore interface {
+	InitiateCallFromEvent(initiatorID uint, data map[string]interface{}) (*models.VideoCall, error)
+	AcceptCall(callID, userID uint, answerSDP string) (*models.VideoCall, error)
+	RejectCall(callID, userID uint) (*models.VideoCall, error)
+	EndCall(callID, userID uint) (*models.VideoCall, error)
+	SaveICECandidate(callID, userID uint, candidate string) error
+	CheckICERoute(callID, fromUserID, targetUserID uint) (models.CallStatus, error)
 }
 
+// GroupMemberLookup returns the user IDs of all members of a group
+type GroupMemberLookup func(groupID uint) ([]uint, error)
+
+// ContactCheck reports whether two users are contacts
+type ContactCheck func(ctx context.Context, userID, otherID uint) bool
+
+// ContactList returns the IDs of a user's contacts
+type ContactList func(ctx context.Context, userID uint) ([]uint, error)
+
 // BroadcastMessage represents a message to be broadcasted
 type BroadcastMessage struct {
 	Message  Message
 	SenderID uint
+	Client   *Client // Connection the message came in on
 }
 
 // Message represents a websocket message structure
@@ -53,22 +155,49 @@ type Message struct {
 }
 
 // NewHub creates a new Hub instance
-func NewHub() *Hub {
-	return &Hub{
-		Clients:    make(map[uint]*Client),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan BroadcastMessage, 256),
+func NewHub(store MessageStore, calls CallStore) *Hub {
+	h := &Hub{
+		store:        store,
+		calls:        calls,
+		groupMembers: getGroupMemberIDs,
+		instanceID:   InstanceID,
+		typingTimers: make(map[string]*time.Timer),
+		activity:     make(map[uint]*userActivity),
+		done:         make(chan struct{}),
+		Register:     make(chan *Client),
+		Unregister:   make(chan *Client),
+		Broadcast:    make(chan BroadcastMessage, 256),
+	}
+	for i := range h.shards {
+		h.shards[i].clients = make(map[uint]map[string]*Client)
 	}
+	return h
 }
 
-// Run starts the hub
+// Run starts the hub. Once it returns, the hub's Redis listeners have
+// stopped too.
 func (h *Hub) Run() {
-	// Start typing cleanup routine
-	go h.typingCleanupRoutine()
+	var listeners sync.WaitGroup
+	defer listeners.Wait()
+	for _, listen := range []func(){h.listenPresence, h.listenBroadcasts} {
+		listeners.Add(1)
+		go func(listen func()) {
+			defer listeners.Done()
+			listen()
+		}(listen)
+	}
+
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
 
 	for {
 		select {
+		case <-h.done:
+			return
+
+		case <-idleTicker.C:
+			h.checkIdle()
+
 		case client := <-h.Register:
 			h.registerClient(client)
 
@@ -81,73 +210,134 @@ func (h *Hub) Run() {
 	}
 }
 
-// typingCleanupRoutine periodically cleans up expired typing indicators
-func (h *Hub) typingCleanupRoutine() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// RegisterClient hands a new connection to the hub. It returns
+// errHubStopped, after closing the connection, instead of blocking when the
+// hub is shutting down or no longer running.
+func (h *Hub) RegisterClient(client *Client) error {
+	if h.shuttingDown.Load() {
+		h.rejectClient(client)
+		return errHubStopped
+	}
 
-	for range ticker.C {
-		if err := redis.CleanupExpiredTyping(); err != nil {
-			logrus.Errorf("Failed to cleanup expired typing indicators: %v", err)
-		}
+	select {
+	case h.Register <- client:
+		return nil
+	case <-h.done:
+		h.rejectClient(client)
+		return errHubStopped
 	}
 }
 
-// registerClient registers a new client
+// rejectClient turns away a connection because the hub is shutting down
+func (h *Hub) rejectClient(client *Client) {
+	logrus.Infof("Rejecting connection of user %d, hub is shutting down", client.UserID)
+	client.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server shutting down"),
+		time.Now().Add(writeWait))
+	client.Conn.Close()
+}
+
+// registerClient registers a new client connection
 func (h *Hub) registerClient(client *Client) {
-	h.mu.Lock()
-	h.Clients[client.UserID] = client
-	h.mu.Unlock()
+	firstConn, ok := h.putClient(client)
+	if !ok {
+		h.rejectClient(client)
+		return
+	}
+
+	logrus.Infof("User %d (%s) connected (conn %s). Total users: %d", client.UserID, client.Username, client.ConnID, h.userCount())
+
+	go deliverPendingEvents(client)
+
+	if _, ok := h.activity[client.UserID]; !ok {
+		h.activity[client.UserID] = &userActivity{}
+	}
+	h.markActive(client.UserID)
+
+	// Additional devices don't change the user's presence
+	if !firstConn {
+		return
+	}
+
+	// Users already connected to another instance are online already
+	wasOnline, err := redis.IsUserOnline(client.UserID)
+	if err != nil {
+		logrus.Errorf("failed to check if user %d is online: %v", client.UserID, err)
+	}
 
 	// Set user as online in Redis
-	if err := redis.SetUserOnline(client.UserID); err != nil {
+	if err := redis.SetUserOnline(client.UserID, h.instanceID); err != nil {
 		logrus.Errorf("failed to set user online: %v", err)
 	}
 
-	logrus.Infof("User %d (%s) connected. Total clients: %d", client.UserID, client.Username, len(h.Clients))
-
-	// Broadcast user online status via Redis
-	data := map[string]interface{}{
-		"user_id":   client.UserID,
-		"is_online": true,
+	// Coming back ends an away set by idle detection
+	status, auto := loadPresenceStatus(client.UserID)
+	if auto {
+		status = models.PresenceOnline
+		if err := redis.SetPresenceStatus(client.UserID, string(status), false); err != nil {
+			logrus.Errorf("Failed to reset status of user %d: %v", client.UserID, err)
+		}
 	}
 
-	channel := fmt.Sprintf("ws:user:%d", client.UserID)
-	if err := redis.BroadcastToChannel(channel, "user_status", data); err != nil {
-		logrus.Errorf("Failed to broadcast user online status: %v", err)
+	// Tell the users watching this one, on every instance. Invisible users
+	// stay offline to them.
+	if !wasOnline && status != models.PresenceInvisible {
+		publishPresence(presenceData(client.UserID, true, status))
 	}
 }
 
-// unregisterClient unregisters a client
+// unregisterClient unregisters a single client connection. The user is only
+// marked offline once their last connection has gone.
 func (h *Hub) unregisterClient(client *Client) {
-	h.mu.Lock()
-	if _, ok := h.Clients[client.UserID]; ok {
-		delete(h.Clients, client.UserID)
-		close(client.Send)
-	}
-	h.mu.Unlock()
+	lastConn := h.deleteClient(client)
 
 	// Stop Redis subscriber
 	client.StopRedisSubscriber()
+	h.presence.unsubscribe(client, nil)
 
-	// Set user as offline in Redis
-	if err := redis.SetUserOffline(client.UserID); err != nil {
-		logrus.Errorf("failed to set user offline: %v", err)
+	// Deliveries the last connection never confirmed wait for the next one
+	unacked := client.acks.drain()
+	if lastConn {
+		for _, p := range unacked {
+			queuePendingEvent(client.UserID, p.event, p.data)
+		}
 	}
 
-	logrus.Infof("User %d (%s) disconnected. Total clients: %d", client.UserID, client.Username, len(h.Clients))
+	logrus.Infof("User %d (%s) disconnected (conn %s). Total users: %d", client.UserID, client.Username, client.ConnID, h.userCount())
 
-	// Broadcast user offline status via Redis
-	data := map[string]interface{}{
-		"user_id":   client.UserID,
-		"is_online": false,
-		"last_seen": time.Now().Format(time.RFC3339),
+	if !lastConn {
+		return
+	}
+	delete(h.activity, client.UserID)
+
+	// Set user as offline in Redis, unless another instance still holds a
+	// connection of theirs
+	stillOnline, err := redis.SetUserOffline(client.UserID, h.instanceID)
+	if err != nil {
+		logrus.Errorf("failed to set user offline: %v", err)
+	}
+	if stillOnline {
+		return
 	}
 
-	channel := fmt.Sprintf("ws:user:%d", client.UserID)
-	if err := redis.BroadcastToChannel(channel, "user_status", data); err != nil {
-		logrus.Errorf("Failed to broadcast user offline status: %v", err)
+	// Invisible sessions neither move last seen nor announce going
+	// offline, since the user already looks offline
+	status, _ := loadPresenceStatus(client.UserID)
+	if status == models.PresenceInvisible {
+		return
+	}
+
+	now := time.Now()
+	visibility, err := recordLastSeen(client.UserID, now)
+	if err != nil {
+		logrus.Errorf("Failed to record last seen of user %d: %v", client.UserID, err)
 	}
+
+	// Tell the users watching this one, on every instance
+	data := presenceData(client.UserID, false, status)
+	data["last_seen"] = now.Format(time.RFC3339)
+	data["last_seen_visibility"] = visibility
+	publishPresence(data)
 }
 
 // validateMessage validates incoming WebSocket message structure
@@ -166,10 +356,12 @@ func validateMessage(msg Message) error {
 		if _, ok := msg.Data["receiver_id"].(float64); !ok {
 			return errors.New("private message must have valid receiver_id")
 		}
+		return validateMessageContent(msg.Data)
 	case "send_group_message":
 		if _, ok := msg.Data["group_id"].(float64); !ok {
 			return errors.New("group message must have valid group_id")
 		}
+		return validateMessageContent(msg.Data)
 	case "user_typing":
 		if _, ok := msg.Data["conversation_id"].(string); !ok {
 			return errors.New("typing message must have conversation_id")
@@ -178,19 +370,102 @@ func validateMessage(msg Message) error {
 		if _, ok := msg.Data["message_id"].(float64); !ok {
 			return errors.New("message_read must have valid message_id")
 		}
+	case "subscribe_presence":
+		if _, ok := msg.Data["user_ids"].([]interface{}); !ok {
+			return errors.New("subscribe_presence must have user_ids")
+		}
+	case "set_status":
+		if _, ok := msg.Data["status"].(string); !ok {
+			return errors.New("set_status must have status")
+		}
+	case "resync":
+		if _, ok := msg.Data["conversations"].(map[string]interface{}); !ok {
+			return errors.New("resync must have conversations")
+		}
+	case "call_offer":
+		_, hasReceiver := msg.Data["receiver_id"].(float64)
+		_, hasGroup := msg.Data["group_id"].(float64)
+		if !hasReceiver && !hasGroup {
+			return errors.New("call_offer must have receiver_id or group_id")
+		}
+	case "call_answer", "call_reject", "call_end":
+		if _, ok := msg.Data["call_id"].(float64); !ok {
+			return fmt.Errorf("%s must have valid call_id", msg.Event)
+		}
+	case "call_ice_candidate":
+		if _, ok := msg.Data["call_id"].(float64); !ok {
+			return errors.New("call_ice_candidate must have valid call_id")
+		}
+		if _, ok := msg.Data["target_user_id"].(float64); !ok {
+			return errors.New("call_ice_candidate must have valid target_user_id")
+		}
+		if _, ok := msg.Data["candidate"]; !ok {
+			return errors.New("call_ice_candidate must have candidate")
+		}
 	}
 
 	return nil
 }
 
+// validateMessageContent checks the content and type of a chat message
+func validateMessageContent(data map[string]interface{}) error {
+	content, ok := data["content"].(string)
+	if !ok {
+		return errors.New("message must have text content")
+	}
+
+	msgType, _ := data["type"].(string)
+	return models.ValidateMessageContent(content, models.MessageType(msgType), maxMessageLength())
+}
+
+// maxMessageLength returns the configured content limit, falling back to
+// the default
+func maxMessageLength() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Chat.MaxMessageLength > 0 {
+		return cfg.Chat.MaxMessageLength
+	}
+	return models.DefaultMaxMessageLength
+}
+
+// replyError tells the connection a message came in on that it was rejected
+func (h *Hub) replyError(bm BroadcastMessage, code string, err error) {
+	data := map[string]interface{}{
+		"code":    code,
+		"event":   bm.Message.Event,
+		"message": err.Error(),
+	}
+
+	if bm.Client != nil {
+		bm.Client.SendMessage("error", data)
+		return
+	}
+	h.SendToUser(bm.SenderID, "error", data)
+}
+
 // handleBroadcast processes broadcast messages
 func (h *Hub) handleBroadcast(bm BroadcastMessage) {
+	// Events are labelled by name, except invalid and unknown ones, so
+	// clients cannot blow up the metrics with made-up names
+	start := time.Now()
+	label := bm.Message.Event
+	defer func() {
+		metrics.MessagesReceived.WithLabelValues(label).Inc()
+		metrics.BroadcastDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	}()
+
 	// Validate message structure
 	if err := validateMessage(bm.Message); err != nil {
+		label = "invalid"
 		logrus.Errorf("Invalid message from user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "invalid_message", err)
 		return
 	}
 
+	// Heartbeats don't count as activity for idle detection
+	if bm.Message.Event != "ping" && bm.Message.Event != "pong" {
+		h.markActive(bm.SenderID)
+	}
+
 	switch bm.Message.Event {
 	case "send_private_message":
 		h.handlePrivateMessage(bm)
@@ -200,11 +475,26 @@ func (h *Hub) handleBroadcast(bm BroadcastMessage) {
 		h.handleTypingIndicator(bm)
 	case "message_read":
 		h.handleMessageRead(bm)
+	case "subscribe_presence":
+		h.handleSubscribePresence(bm)
+	case "unsubscribe_presence":
+		h.handleUnsubscribePresence(bm)
+	case "set_status":
+		h.handleSetStatus(bm)
+	case "resync":
+		h.handleResync(bm)
+	case "call_offer":
+		h.handleCallOffer(bm)
+	case "call_answer", "call_reject", "call_end":
+		h.handleCallSignal(bm)
+	case "call_ice_candidate":
+		h.handleICECandidate(bm)
 	case "ping":
 		h.handlePing(bm)
 	case "pong":
 		logrus.Debugf("Received pong from user %d", bm.SenderID)
 	default:
+		label = "unknown"
 		logrus.Warnf("Unknown event: %s", bm.Message.Event)
 	}
 }
@@ -212,162 +502,180 @@ func (h *Hub) handleBroadcast(bm BroadcastMessage) {
 // handlePing handles ping messages and responds with pong
 func (h *Hub) handlePing(bm BroadcastMessage) {
 	logrus.Debugf("Received ping from user %d, sending pong", bm.SenderID)
+
+	// Application-level pings double as presence heartbeats
+	if err := redis.SetUserOnline(bm.SenderID, h.instanceID); err != nil {
+		logrus.Errorf("Failed to renew presence for user %d: %v", bm.SenderID, err)
+	}
+
 	h.SendToUser(bm.SenderID, "pong", map[string]interface{}{
 		"timestamp": time.Now().Format(time.RFC3339),
 	})
 }
 
-// handlePrivateMessage handles private message sending
+// handlePrivateMessage handles private message sending. The store
+// persists and delivers the message exactly as a REST send would.
 func (h *Hub) handlePrivateMessage(bm BroadcastMessage) {
-	logrus.Infof("Handling private message broadcast: %+v", bm)
-
-	receiverID, ok := bm.Message.Data["receiver_id"].(float64)
-	if !ok {
-		logrus.Error("Invalid receiver_id in private message")
-		return
-	}
+	ctx, cancel := bm.Client.queryContext()
+	defer cancel()
 
-	content, ok := bm.Message.Data["content"].(string)
-	if !ok {
-		logrus.Error("Invalid content in private message")
-		return
-	}
-
-	logrus.Infof("Saving private message to database and sending to receiver %d", uint(receiverID))
-
-	// Save message to database first
-	message, err := savePrivateMessageToDB(bm.SenderID, uint(receiverID), content, bm.Message.Data)
-	if err != nil {
-		logrus.Errorf("Failed to save private message to database: %v", err)
-		return
+	if _, err := h.store.SendPrivateMessageFromEvent(ctx, bm.SenderID, bm.Message.Data); err != nil {
+		logrus.Errorf("Failed to send private message from user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "send_failed", err)
 	}
-
-	// Update message data with database ID and timestamps
-	updatedData := bm.Message.Data
-	updatedData["message_id"] = message.ID
-	updatedData["created_at"] = message.CreatedAt
-	updatedData["updated_at"] = message.UpdatedAt
-
-	// Send to receiver if online
-	h.SendToUser(uint(receiverID), "private_message", updatedData)
-
-	// Also send back to sender for confirmation
-	h.SendToUser(bm.SenderID, "message_sent", updatedData)
-
-	logrus.Info("Private message saved and broadcast completed")
 }
 
-// handleGroupMessage handles group message sending
+// handleGroupMessage handles group message sending. The store persists
+// the message and fans it out to the group's members.
 func (h *Hub) handleGroupMessage(bm BroadcastMessage) {
-	groupID, ok := bm.Message.Data["group_id"].(float64)
-	if !ok {
-		logrus.Error("Invalid group_id in group message")
-		return
+	ctx, cancel := bm.Client.queryContext()
+	defer cancel()
+
+	if _, err := h.store.SendGroupMessageFromEvent(ctx, bm.SenderID, bm.Message.Data); err != nil {
+		logrus.Errorf("Failed to send group message from user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "send_failed", err)
 	}
+}
 
-	content, ok := bm.Message.Data["content"].(string)
+// handleTypingIndicator handles typing indicator
+func (h *Hub) handleTypingIndicator(bm BroadcastMessage) {
+	conversationID, ok := bm.Message.Data["conversation_id"].(string)
 	if !ok {
-		logrus.Error("Invalid content in group message")
 		return
 	}
 
-	logrus.Infof("Saving group message to database and broadcasting to group %d", uint(groupID))
-
-	// Save message to database first
-	message, err := saveGroupMessageToDB(bm.SenderID, uint(groupID), content, bm.Message.Data)
+	// conversation_id is "private:<other user ID>" or "group:<group ID>",
+	// i.e. always the conversation as seen by the sender
+	parsedType, chatID, err := models.ParseConversationID(conversationID)
 	if err != nil {
-		logrus.Errorf("Failed to save group message to database: %v", err)
+		logrus.Errorf("Invalid conversation ID %q: %v", conversationID, err)
 		return
 	}
+	chatType := string(parsedType)
+	// Typing keys in Redis are looked up by the canonical form
+	conversationID = models.ConversationID(parsedType, chatID)
 
-	// Update message data with database ID and timestamps
-	updatedData := bm.Message.Data
-	updatedData["message_id"] = message.ID
-	updatedData["created_at"] = message.CreatedAt
-	updatedData["updated_at"] = message.UpdatedAt
-
-	// Broadcast to all group members via Redis
-	channel := fmt.Sprintf("ws:group:%d", uint(groupID))
-	if err := redis.BroadcastToChannel(channel, "group_message", updatedData); err != nil {
-		logrus.Errorf("Failed to broadcast group message: %v", err)
+	if parsedType == models.ChatTypePrivate && chatID == bm.SenderID {
+		logrus.Errorf("User %d sent a typing event to themselves", bm.SenderID)
 		return
 	}
 
-	logrus.Info("Group message saved and broadcast completed")
-}
-
-// handleTypingIndicator handles typing indicator
-func (h *Hub) handleTypingIndicator(bm BroadcastMessage) {
-	conversationID, ok := bm.Message.Data["conversation_id"].(string)
-	if !ok {
-		return
+	// Recipients see the conversation from their side: for a private chat
+	// that is the sender, for a group it is the group itself
+	typingChatID := chatID
+	if parsedType == models.ChatTypePrivate {
+		typingChatID = bm.SenderID
 	}
 
-	// Set typing status in Redis
-	redis.SetUserTyping(bm.SenderID, conversationID)
-
-	// Determine chat type and ID from conversation_id (format: "private:123" or "group:456")
-	var chatType string
-	var chatID uint
-
-	if strings.HasPrefix(conversationID, "private:") {
-		chatType = "private"
-		chatIDStr := strings.TrimPrefix(conversationID, "private:")
-		if chatIDInt, parseErr := strconv.ParseUint(chatIDStr, 10, 32); parseErr == nil {
-			chatID = uint(chatIDInt)
-		} else {
-			logrus.Errorf("Invalid private conversation ID: %s", conversationID)
-			return
-		}
-	} else if strings.HasPrefix(conversationID, "group:") {
-		chatType = "group"
-		chatIDStr := strings.TrimPrefix(conversationID, "group:")
-		if chatIDInt, parseErr := strconv.ParseUint(chatIDStr, 10, 32); parseErr == nil {
-			chatID = uint(chatIDInt)
-		} else {
-			logrus.Errorf("Invalid group conversation ID: %s", conversationID)
-			return
-		}
-	} else {
-		logrus.Errorf("Invalid conversation ID format: %s", conversationID)
-		return
+	// A typing event without is_typing means the user started typing
+	isTyping := true
+	if value, ok := bm.Message.Data["is_typing"].(bool); ok {
+		isTyping = value
 	}
 
-	// Prepare typing data for broadcast
-	var typingChatID uint
-	if chatType == "private" {
-		typingChatID = bm.SenderID // For recipient, chat_id should be sender's ID
+	// Track typing status in Redis
+	if isTyping {
+		redis.SetUserTyping(bm.SenderID, conversationID)
 	} else {
-		typingChatID = chatID // For groups, chat_id is the group ID
+		redis.ClearUserTyping(bm.SenderID, conversationID)
 	}
-	
+
+	// ReadPump sets sender_username from the authenticated connection
+	username, _ := bm.Message.Data["sender_username"].(string)
+
 	typingData := map[string]interface{}{
 		"user_id":   bm.SenderID,
-		"username":  bm.Message.Data["username"], // If available
-		"is_typing": bm.Message.Data["is_typing"],
+		"username":  username,
+		"is_typing": isTyping,
 		"chat_type": chatType,
 		"chat_id":   typingChatID,
 	}
 
+	h.sendTyping(chatType, chatID, bm.SenderID, "typing", typingData)
+
+	timerKey := fmt.Sprintf("%s:%d", conversationID, bm.SenderID)
+	if !isTyping {
+		h.stopTypingTimer(timerKey)
+		return
+	}
+
+	// Clear the indicator if the client goes quiet, e.g. it disconnected
+	// mid-compose
+	senderID := bm.SenderID
+	h.armTypingTimer(timerKey, func() {
+		redis.ClearUserTyping(senderID, conversationID)
+		h.sendTyping(chatType, chatID, senderID, "typing_stopped", map[string]interface{}{
+			"user_id":   senderID,
+			"username":  username,
+			"is_typing": false,
+			"chat_type": chatType,
+			"chat_id":   typingChatID,
+		})
+	})
+}
+
+// sendTyping delivers a typing event to the other side of a conversation
+func (h *Hub) sendTyping(chatType string, chatID, senderID uint, event string, data map[string]interface{}) {
 	if chatType == "private" {
 		// For private chat, broadcast to the other participant
-		h.SendToUser(chatID, "typing", typingData)
+		h.SendToUser(chatID, event, data)
 	} else if chatType == "group" {
+		// Carry everyone typing in the group, so clients can show "Alice
+		// and 2 others are typing" without tracking each user's events
+		data["typing_user_ids"] = groupTypingUserIDs(chatID)
+
 		// For group chat, broadcast to all group members except sender
-		// Get group members from database
-		db := database.GetDB()
-		var members []models.GroupMember
-		if err := db.Where("group_id = ?", chatID).Find(&members).Error; err != nil {
-			logrus.Errorf("Failed to get group members for group %d: %v", chatID, err)
-			return
+		h.BroadcastToGroup(chatID, event, data, senderID)
+	}
+}
+
+// groupTypingUserIDs returns who is typing in a group according to Redis
+func groupTypingUserIDs(groupID uint) []uint {
+	userIDs, err := redis.GetTypingUsers(models.ConversationID(models.ChatTypeGroup, groupID))
+	if err != nil {
+		logrus.Warnf("Failed to get typing users of group %d: %v", groupID, err)
+	}
+	if userIDs == nil {
+		userIDs = []uint{}
+	}
+	return userIDs
+}
+
+// armTypingTimer (re)starts the typing timeout for key, calling onExpire if
+// no further typing event arrives in time
+func (h *Hub) armTypingTimer(key string, onExpire func()) {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+
+	if timer, ok := h.typingTimers[key]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		h.typingMu.Lock()
+		current := h.typingTimers[key] == timer
+		if current {
+			delete(h.typingTimers, key)
 		}
+		h.typingMu.Unlock()
 
-		// Broadcast to all members except sender
-		for _, member := range members {
-			if member.UserID != bm.SenderID {
-				h.SendToUser(member.UserID, "typing", typingData)
-			}
+		// A newer typing event replaced this timer
+		if current {
+			onExpire()
 		}
+	})
+	h.typingTimers[key] = timer
+}
+
+// stopTypingTimer cancels the typing timeout for key
+func (h *Hub) stopTypingTimer(key string) {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+
+	if timer, ok := h.typingTimers[key]; ok {
+		timer.Stop()
+		delete(h.typingTimers, key)
 	}
 }
 
@@ -379,241 +687,428 @@ func (h *Hub) handleMessageRead(bm BroadcastMessage) {
 		return
 	}
 
-	logrus.Infof("Message %d marked as read by user %d", uint(messageID), bm.SenderID)
+	ctx, cancel := bm.Client.queryContext()
+	defer cancel()
 
-	// For now, just log the event
-	// TODO: Broadcast read status to relevant users (sender of the message)
-}
+	if groupID, ok := bm.Message.Data["group_id"].(float64); ok {
+		h.handleGroupMessageRead(ctx, bm.SenderID, uint(messageID), uint(groupID))
+		return
+	}
 
-// SendToUser sends a message to a specific user
-func (h *Hub) SendToUser(userID uint, event string, data map[string]interface{}) {
-	logrus.Infof("Attempting to send message to user %d, event: %s", userID, event)
+	message, err := h.store.MarkPrivateMessageRead(ctx, uint(messageID), bm.SenderID)
+	if err != nil {
+		logrus.Warnf("Ignoring read receipt for message %d from user %d: %v", uint(messageID), bm.SenderID, err)
+		return
+	}
 
-	h.mu.RLock()
-	client, ok := h.Clients[userID]
-	h.mu.RUnlock()
+	logrus.Infof("Message %d marked as read by user %d", message.ID, bm.SenderID)
 
-	if ok {
-		logrus.Infof("Found client for user %d, sending message", userID)
-		client.SendMessage(event, data)
-		logrus.Infof("Message sent to user %d successfully", userID)
-	} else {
-		logrus.Warnf("No client found for user %d, user may be offline", userID)
-	}
+	h.SendToUser(message.SenderID, "message_read", map[string]interface{}{
+		"message_id": message.ID,
+		"chat_type":  "private",
+		"reader_id":  bm.SenderID,
+		"status":     "read",
+		"read_at":    message.ReadAt,
+	})
 }
 
-// BroadcastToGroup sends a message to all members of a group
-func (h *Hub) BroadcastToGroup(groupID uint, event string, data map[string]interface{}, excludeUserID uint) {
-	// Note: For now, broadcast to all online users
-	// TODO: Implement proper group member lookup to avoid import cycle
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	for userID, client := range h.Clients {
-		if userID != excludeUserID {
-			client.SendMessage(event, data)
-		}
+// handleGroupMessageRead broadcasts a member's read receipt to the rest of the group
+func (h *Hub) handleGroupMessageRead(ctx context.Context, readerID, messageID, groupID uint) {
+	message, readAt, err := h.store.MarkGroupMessageRead(ctx, messageID, groupID, readerID)
+	if err != nil {
+		logrus.Warnf("Ignoring read receipt for group message %d from user %d: %v", messageID, readerID, err)
+		return
 	}
-}
 
-// broadcastUserStatus broadcasts user online/offline status
-func (h *Hub) broadcastUserStatus(userID uint, isOnline bool) {
 	data := map[string]interface{}{
-		"user_id":   userID,
-		"is_online": isOnline,
+		"message_id": message.ID,
+		"chat_type":  "group",
+		"group_id":   groupID,
+		"reader_id":  readerID,
+		"status":     "read",
+		"read_at":    readAt,
 	}
 
-	message, _ := json.Marshal(Message{
-		Event: "user_online_status",
-		Data:  data,
-	})
+	h.BroadcastToGroup(groupID, "message_read", data, readerID)
+}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// getGroupMemberIDs returns the user IDs of all members of a group
+func getGroupMemberIDs(groupID uint) ([]uint, error) {
+	var memberIDs []uint
+	err := database.GetDB().Model(&models.GroupMember{}).
+		Where("group_id = ?", groupID).
+		Pluck("user_id", &memberIDs).Error
+	return memberIDs, err
+}
 
-	for _, client := range h.Clients {
-		if client.UserID != userID {
-			select {
-			case client.Send <- message:
-			default:
-				// Channel full, skip
-			}
-		}
+// handleCallOffer starts a call and relays the offer SDP to the callee(s)
+func (h *Hub) handleCallOffer(bm BroadcastMessage) {
+	call, err := h.calls.InitiateCallFromEvent(bm.SenderID, bm.Message.Data)
+	if err != nil {
+		logrus.Errorf("Failed to initiate call from user %d: %v", bm.SenderID, err)
+		return
 	}
+
+	// Let the caller know the call ID to use for further signaling
+	h.SendToUser(bm.SenderID, "call_initiated", map[string]interface{}{
+		"call_id": call.ID,
+		"status":  string(call.Status),
+	})
 }
 
-// GetOnlineUsers returns list of online user IDs
-func (h *Hub) GetOnlineUsers() []uint {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// handleCallSignal handles answer, reject and hang-up events for a call
+func (h *Hub) handleCallSignal(bm BroadcastMessage) {
+	callID := uint(bm.Message.Data["call_id"].(float64))
 
-	users := make([]uint, 0, len(h.Clients))
-	for userID := range h.Clients {
-		users = append(users, userID)
+	var err error
+	switch bm.Message.Event {
+	case "call_answer":
+		sdp, _ := bm.Message.Data["sdp"].(string)
+		_, err = h.calls.AcceptCall(callID, bm.SenderID, sdp)
+	case "call_reject":
+		_, err = h.calls.RejectCall(callID, bm.SenderID)
+	case "call_end":
+		_, err = h.calls.EndCall(callID, bm.SenderID)
 	}
 
-	return users
+	if err != nil {
+		logrus.Errorf("Failed to handle %s for call %d from user %d: %v", bm.Message.Event, callID, bm.SenderID, err)
+	}
 }
 
-// GetConnectionStats returns WebSocket connection statistics
-func (h *Hub) GetConnectionStats() map[string]interface{} {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// handleICECandidate relays an ICE candidate to the target peer. Candidates
+// for calls that are not ringing or connected yet are buffered in Redis and
+// flushed once the call is answered. Persistence happens off the hub loop.
+func (h *Hub) handleICECandidate(bm BroadcastMessage) {
+	callID := uint(bm.Message.Data["call_id"].(float64))
+	targetUserID := uint(bm.Message.Data["target_user_id"].(float64))
 
-	stats := map[string]interface{}{
-		"total_connections": len(h.Clients),
-		"clients":          make([]map[string]interface{}, 0, len(h.Clients)),
+	status, err := h.calls.CheckICERoute(callID, bm.SenderID, targetUserID)
+	if err != nil {
+		logrus.Errorf("Rejected ICE candidate for call %d from user %d: %v", callID, bm.SenderID, err)
+		return
 	}
 
-	for _, client := range h.Clients {
-		clientStats := map[string]interface{}{
-			"user_id":  client.UserID,
-			"username": client.Username,
-		}
-		stats["clients"] = append(stats["clients"].([]map[string]interface{}), clientStats)
+	candidate, err := json.Marshal(bm.Message.Data["candidate"])
+	if err != nil {
+		logrus.Errorf("Invalid candidate in call_ice_candidate event: %v", err)
+		return
 	}
 
-	return stats
+	data := map[string]interface{}{
+		"call_id":        callID,
+		"from_user_id":   bm.SenderID,
+		"target_user_id": targetUserID,
+		"candidate":      bm.Message.Data["candidate"],
+	}
+
+	if status == models.CallStatusRinging || status == models.CallStatusConnected {
+		h.SendToUser(targetUserID, "call_ice_candidate", data)
+	} else if payload, err := json.Marshal(data); err != nil {
+		logrus.Errorf("Failed to marshal ICE candidate for call %d: %v", callID, err)
+	} else if err := redis.BufferICECandidate(callID, string(payload)); err != nil {
+		logrus.Errorf("Failed to buffer ICE candidate for call %d: %v", callID, err)
+	}
+
+	go func(senderID uint) {
+		if err := h.calls.SaveICECandidate(callID, senderID, string(candidate)); err != nil {
+			logrus.Errorf("Failed to save ICE candidate for call %d: %v", callID, err)
+		}
+	}(bm.SenderID)
 }
 
-// GetHub returns the global hub instance
-func GetHub() *Hub {
-	return hubInstance
+// SendToUser sends a message to every live connection of a specific user.
+//
+// Connections held by this instance are written to directly. The event is
+// also published on the user's Redis channel, tagged with the instance ID, so
+// connections on other instances receive it too; subscribers on this
+// instance recognise the tag and skip it, so nobody gets it twice. If no
+// connection exists anywhere, the event is queued for the next connect.
+func (h *Hub) SendToUser(userID uint, event string, data map[string]interface{}) {
+	logrus.Infof("Attempting to send message to user %d, event: %s", userID, event)
+
+	clients := h.getClients(userID)
+
+	for _, client := range clients {
+		client.SendMessage(event, data)
+	}
+
+	channel := fmt.Sprintf("ws:user:%d", userID)
+	receivers, err := redis.PublishEventFrom(channel, h.instanceID, event, data)
+	if err != nil {
+		logrus.Errorf("Failed to publish %s to user %d: %v", event, userID, err)
+	}
+
+	if len(clients) == 0 && err == nil && receivers == 0 {
+		logrus.Infof("No client found for user %d, queueing %s for later delivery", userID, event)
+		queuePendingEvent(userID, event, data)
+		return
+	}
+
+	logrus.Infof("Message sent to user %d on %d local connection(s)", userID, len(clients))
 }
 
-// BroadcastPrivateMessage broadcasts a private message using Redis pub/sub
-func BroadcastPrivateMessage(senderID, receiverID uint, messageData map[string]interface{}) {
-	logrus.Infof("Publishing private message from %d to %d via Redis", senderID, receiverID)
+// BroadcastToUsers sends the same event to several users, like SendToUser
+// for each of them, but marshals it once: local connections all get the
+// same encoded bytes, and the Redis copies go out in one pipelined round
+// trip. Only connections that acknowledge deliveries get their own
+// encoding, since each carries a distinct ack_id.
+//
+// For a 1,000-member group this is one JSON encoding per event instead of
+// 2,000 (one per connection plus one per Redis publish). BenchmarkGroupFanOut
+// measures about a third of the allocations (roughly 22,000 instead of
+// 68,000 per event) and of the time; what remains is mostly building the
+// pipelined Redis commands, one per member.
+func (h *Hub) BroadcastToUsers(userIDs []uint, event string, data map[string]interface{}) {
+	if len(userIDs) == 0 {
+		return
+	}
 
-	// Publish to Redis channel for the specific receiver
-	channel := fmt.Sprintf("ws:user:%d", receiverID)
-	if err := redis.BroadcastToChannel(channel, "private_message", messageData); err != nil {
-		logrus.Errorf("Failed to publish private message to Redis: %v", err)
+	payload, err := json.Marshal(Message{Event: event, Data: data})
+	if err != nil {
+		logrus.Errorf("Failed to marshal %s: %v", event, err)
 		return
 	}
 
-	// Also send confirmation back to sender
-	senderChannel := fmt.Sprintf("ws:user:%d", senderID)
-	confirmationData := map[string]interface{}{
-		"type":        "message_sent",
-		"message_id":  messageData["message_id"],
-		"receiver_id": receiverID,
-		"content":     messageData["content"],
-		"created_at":  messageData["created_at"],
+	local := make([]int, len(userIDs))
+	channels := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		clients := h.getClients(userID)
+		for _, client := range clients {
+			if client.AckEnabled && ackedEvents[event] {
+				client.SendMessage(event, data)
+			} else {
+				client.send(event, data, payload)
+			}
+		}
+		local[i] = len(clients)
+		channels[i] = fmt.Sprintf("ws:user:%d", userID)
 	}
-	if err := redis.BroadcastToChannel(senderChannel, "message_sent", confirmationData); err != nil {
-		logrus.Errorf("Failed to send confirmation to sender: %v", err)
+
+	receivers, err := redis.PublishEventToChannels(channels, h.instanceID, event, data)
+	if err != nil {
+		logrus.Errorf("Failed to publish %s to %d user(s): %v", event, len(userIDs), err)
 		return
 	}
 
-	logrus.Info("Private message published to Redis successfully")
+	for i, userID := range userIDs {
+		if local[i] == 0 && receivers[i] == 0 {
+			queuePendingEvent(userID, event, data)
+		}
+	}
+
+	logrus.Debugf("Broadcast %s to %d user(s)", event, len(userIDs))
 }
 
-// savePrivateMessageToDB saves a private message to the database
-func savePrivateMessageToDB(senderID, receiverID uint, content string, messageData map[string]interface{}) (*models.PrivateMessage, error) {
-	db := database.GetDB()
+// BroadcastToGroup sends a message to all members of a group except
+// excludeUserID
+func (h *Hub) BroadcastToGroup(groupID uint, event string, data map[string]interface{}, excludeUserID uint) {
+	memberIDs, err := h.groupMembers(groupID)
+	if err != nil {
+		logrus.Errorf("Failed to get group members for group %d: %v", groupID, err)
+		return
+	}
 
-	// Verify receiver exists
-	var receiver models.User
-	if err := db.First(&receiver, receiverID).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("receiver not found")
+	recipientIDs := make([]uint, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		if memberID != excludeUserID {
+			recipientIDs = append(recipientIDs, memberID)
 		}
-		return nil, err
 	}
+	h.BroadcastToUsers(recipientIDs, event, data)
+}
 
-	// Determine message type
-	msgType := models.MessageTypeText
-	if t, ok := messageData["type"].(string); ok && t != "" {
-		msgType = models.MessageType(t)
-	}
+// GetOnlineUsers returns list of online user IDs across all instances.
+// Redis is the source of truth: connections held by this instance alone do
+// not say who is online in a cluster.
+func (h *Hub) GetOnlineUsers() ([]uint, error) {
+	return redis.GetOnlineUsers()
+}
 
-	// Create message
-	message := models.PrivateMessage{
-		SenderID:   senderID,
-		ReceiverID: receiverID,
-		Content:    content,
-		Type:       msgType,
-		IsRead:     false,
+// GetConnectionStats returns WebSocket connection statistics
+func (h *Hub) GetConnectionStats() map[string]interface{} {
+	totalConnections := 0
+	clients := make([]map[string]interface{}, 0)
+
+	h.rangeClients(func(userID uint, conns map[string]*Client) {
+		username := ""
+		for _, client := range conns {
+			username = client.Username
+			break
+		}
+		clients = append(clients, map[string]interface{}{
+			"user_id":     userID,
+			"username":    username,
+			"connections": len(conns),
+		})
+		totalConnections += len(conns)
+	})
+
+	return map[string]interface{}{
+		"total_users":       len(clients),
+		"total_connections": totalConnections,
+		"dropped_messages":  h.droppedMessages.Load(),
+		"clients":           clients,
 	}
+}
 
-	// Handle file_id if present
-	if fileID, ok := messageData["file_id"].(float64); ok && fileID > 0 {
-		uintFileID := uint(fileID)
-		message.FileID = &uintFileID
+// recordDroppedMessage counts an event that missed a client's Send buffer
+func (h *Hub) recordDroppedMessage() {
+	h.droppedMessages.Add(1)
+	metrics.DroppedMessages.Inc()
+}
+
+// Shutdown stops accepting connections, flushes each client's pending
+// messages, sends it a close frame and waits for all clients to disconnect.
+// Connections still open when ctx expires are closed forcibly. Calling it
+// again is harmless.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.shuttingDown.Store(true)
+	clients := h.allClients()
+
+	logrus.Infof("Shutting down WebSocket hub, closing %d connection(s)", len(clients))
+
+	for _, client := range clients {
+		// Let WritePump flush what is already queued
+		waitUntil(ctx, func() bool { return len(client.Send) == 0 })
+
+		client.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server shutting down"),
+			time.Now().Add(writeWait))
 	}
 
-	// Use transaction to ensure data consistency
-	tx := db.Begin()
-	if err := tx.Create(&message).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	// Clients answer the close frame and unregister through ReadPump
+	err := waitUntil(ctx, func() bool { return h.clientCount() == 0 })
+	if err != nil {
+		for _, client := range h.allClients() {
+			client.Conn.Close()
+		}
 	}
 
-	// Load relations
-	if err := tx.Preload("Sender").Preload("Receiver").Preload("File").First(&message, message.ID).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	h.doneOnce.Do(func() { close(h.done) })
+	return err
+}
+
+// ConnectionCount returns the number of live connections on this instance
+func (h *Hub) ConnectionCount() int {
+	return h.clientCount()
+}
+
+// clientCount returns the number of live connections
+func (h *Hub) clientCount() int {
+	count := 0
+	h.rangeClients(func(_ uint, conns map[string]*Client) {
+		count += len(conns)
+	})
+	return count
+}
+
+// waitUntil polls cond until it holds or ctx expires
+func waitUntil(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
+	return nil
+}
 
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		return nil, err
+// GetHub returns the global hub instance
+func GetHub() *Hub {
+	return hubInstance
+}
+
+// PublishToUser publishes an event on a user's Redis channel so that it
+// reaches all of their connections, whichever instance they are on. If no
+// connection is subscribed, the event is queued until the user reconnects.
+func PublishToUser(userID uint, event string, data map[string]interface{}) {
+	channel := fmt.Sprintf("ws:user:%d", userID)
+	receivers, err := redis.PublishEvent(channel, event, data)
+	if err != nil {
+		logrus.Errorf("Failed to publish %s to user %d: %v", event, userID, err)
+		return
 	}
 
-	return &message, nil
+	if receivers == 0 {
+		queuePendingEvent(userID, event, data)
+	}
 }
 
-// saveGroupMessageToDB saves a group message to the database
-func saveGroupMessageToDB(senderID, groupID uint, content string, messageData map[string]interface{}) (*models.GroupMessage, error) {
-	db := database.GetDB()
+// PublishToUsers is PublishToUser for several users, with the event
+// marshalled once and published in a single Redis round trip
+func PublishToUsers(userIDs []uint, event string, data map[string]interface{}) {
+	channels := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		channels[i] = fmt.Sprintf("ws:user:%d", userID)
+	}
 
-	// Verify user is a member of the group
-	var member models.GroupMember
-	if err := db.Where("group_id = ? AND user_id = ?", groupID, senderID).First(&member).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("you are not a member of this group")
+	receivers, err := redis.PublishEventToChannels(channels, "", event, data)
+	if err != nil {
+		logrus.Errorf("Failed to publish %s to %d user(s): %v", event, len(userIDs), err)
+		return
+	}
+
+	for i, userID := range userIDs {
+		if receivers[i] == 0 {
+			queuePendingEvent(userID, event, data)
 		}
-		return nil, err
 	}
+}
 
-	// Determine message type
-	msgType := models.MessageTypeText
-	if t, ok := messageData["type"].(string); ok && t != "" {
-		msgType = models.MessageType(t)
+// queuePendingEvent stores an event in the user's offline queue
+func queuePendingEvent(userID uint, event string, data map[string]interface{}) {
+	if ephemeralEvents[event] {
+		return
 	}
 
-	// Create message
-	message := models.GroupMessage{
-		GroupID:  groupID,
-		SenderID: senderID,
-		Content:  content,
-		Type:     msgType,
+	payload, err := json.Marshal(Message{Event: event, Data: data})
+	if err != nil {
+		logrus.Errorf("Failed to marshal pending %s for user %d: %v", event, userID, err)
+		return
 	}
 
-	// Handle file_id if present
-	if fileID, ok := messageData["file_id"].(float64); ok && fileID > 0 {
-		uintFileID := uint(fileID)
-		message.FileID = &uintFileID
+	if err := redis.QueuePendingEvent(userID, payload, pendingQueueSize()); err != nil {
+		logrus.Errorf("Failed to queue %s for user %d: %v", event, userID, err)
 	}
+}
 
-	// Use transaction to ensure data consistency
-	tx := db.Begin()
-	if err := tx.Create(&message).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+// deliverPendingEvents replays the events queued while the user was offline,
+// in the order they were queued
+func deliverPendingEvents(client *Client) {
+	payloads, err := redis.PopPendingEvents(client.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to load pending events for user %d: %v", client.UserID, err)
+		return
 	}
 
-	// Load relations
-	if err := tx.Preload("Sender").Preload("Group").Preload("File").First(&message, message.ID).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	for i, payload := range payloads {
+		if err := client.trySend(Frame{Opcode: websocket.TextMessage, Payload: []byte(payload)}, sendTimeout); err != nil {
+			// Put the rest back, in order, for the next connection
+			logrus.Warnf("Client %d cannot take pending events, requeueing %d", client.UserID, len(payloads)-i)
+			for _, rest := range payloads[i:] {
+				if err := redis.QueuePendingEvent(client.UserID, []byte(rest), pendingQueueSize()); err != nil {
+					logrus.Errorf("Failed to requeue pending event for user %d: %v", client.UserID, err)
+				}
+			}
+			return
+		}
 	}
 
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		return nil, err
+	if len(payloads) > 0 {
+		logrus.Infof("Delivered %d pending event(s) to user %d", len(payloads), client.UserID)
 	}
+}
 
-	return &message, nil
+// pendingQueueSize returns the configured offline queue cap, falling back to
+// the default
+func pendingQueueSize() int {
+	if cfg := config.GetConfig(); cfg != nil && cfg.WebSocket.PendingQueueSize > 0 {
+		return cfg.WebSocket.PendingQueueSize
+	}
+	return defaultPendingQueueSize
 }
@@ -0,0 +1,529 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+)
+
+func TestShutdownTwice(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	stopped := make(chan struct{})
+	go func() {
+		h.Run()
+		close(stopped)
+	}()
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+}
+
+func TestRegisterAfterShutdownDoesNotBlock(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	stopped := make(chan struct{})
+	go func() {
+		h.Run()
+		close(stopped)
+	}()
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	<-stopped
+
+	server, peer := connect(t)
+	registered := make(chan error, 1)
+	go func() {
+		registered <- h.RegisterClient(NewClient(h, server, 1, "user", false))
+	}()
+
+	select {
+	case err := <-registered:
+		if err != errHubStopped {
+			t.Fatalf("RegisterClient: %v, want %v", err, errHubStopped)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RegisterClient blocked on a stopped hub")
+	}
+	if code, _ := closeCode(t, peer); code != websocket.CloseServiceRestart {
+		t.Fatalf("closed with %d, want %d", code, websocket.CloseServiceRestart)
+	}
+}
+
+func TestBroadcastToGroupReachesOnlyMembers(t *testing.T) {
+	testutil.Setup(t)
+	h := NewHub(nil, nil)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+	carol := testutil.CreateUser(t, "carol")
+	group := testutil.CreateGroup(t, alice, bob)
+
+	clients := map[string]*Client{}
+	for _, user := range []*models.User{alice, bob, carol} {
+		clients[user.Username], _ = addClient(t, h, user.ID, 8)
+	}
+
+	h.BroadcastToGroup(group.ID, "group_updated", map[string]interface{}{"group_id": group.ID}, 0)
+
+	for name, want := range map[string]int{"alice": 1, "bob": 1, "carol": 0} {
+		if got := len(clients[name].Send); got != want {
+			t.Errorf("%s got %d frame(s), want %d", name, got, want)
+		}
+	}
+
+	// The excluded member is skipped, the others still get it
+	h.BroadcastToGroup(group.ID, "group_updated", map[string]interface{}{"group_id": group.ID}, alice.ID)
+	if got := len(clients["alice"].Send); got != 1 {
+		t.Errorf("excluded alice has %d frame(s), want still 1", got)
+	}
+	if got := len(clients["bob"].Send); got != 2 {
+		t.Errorf("bob has %d frame(s), want 2", got)
+	}
+}
+
+func TestBroadcastToUsersSharesOneEncoding(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	alice, _ := addClient(t, h, 1, 8)
+	bob, _ := addClient(t, h, 2, 8)
+
+	// User 3 is offline everywhere
+	h.BroadcastToUsers([]uint{1, 2, 3}, "group_message", map[string]interface{}{"message_id": 1})
+
+	aliceFrame, bobFrame := <-alice.Send, <-bob.Send
+	if !bytes.Equal(aliceFrame.Payload, bobFrame.Payload) || &aliceFrame.Payload[0] != &bobFrame.Payload[0] {
+		t.Fatal("recipients got separately encoded payloads, want one shared encoding")
+	}
+	pending, err := redis.PopPendingEvents(3)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("offline user has %d queued event(s), want 1", len(pending))
+	}
+}
+
+// BenchmarkGroupFanOut sends a message to a 1,000-member group whose
+// members are all connected here, the way group messages went out before
+// BroadcastToUsers (an encoding and a publish per member) and the way they
+// go out now:
+//
+//	go test ./internal/pkg/websocket -run '^$' -bench GroupFanOut -benchmem
+func BenchmarkGroupFanOut(b *testing.B) {
+	setupRedis(b)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	b.Cleanup(func() { logrus.SetLevel(level) })
+
+	const members = 1000
+	h := NewHub(nil, nil)
+	memberIDs := make([]uint, members)
+	clients := make([]*Client, members)
+	for i := range memberIDs {
+		memberIDs[i] = uint(i + 1)
+		clients[i] = benchClient(memberIDs[i], "conn")
+		h.putClient(clients[i])
+	}
+	h.groupMembers = func(groupID uint) ([]uint, error) { return memberIDs, nil }
+
+	data := map[string]interface{}{"id": 1, "group_id": 1, "sender_id": 1, "content": "hello everyone"}
+	drain := func(b *testing.B) {
+		b.StopTimer()
+		for _, client := range clients {
+			<-client.Send
+		}
+		b.StartTimer()
+	}
+
+	b.Run("per-user", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, memberID := range memberIDs {
+				h.SendToUser(memberID, "group_message", data)
+			}
+			drain(b)
+		}
+	})
+	b.Run("once", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.BroadcastToGroup(1, "group_message", data, 0)
+			drain(b)
+		}
+	})
+}
+
+// runHub runs a hub until the test ends
+func runHub(t *testing.T) *Hub {
+	t.Helper()
+
+	h := NewHub(nil, nil)
+	stopped := make(chan struct{})
+	go func() {
+		h.Run()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+		<-stopped
+	})
+	return h
+}
+
+// readEvents reads events from the peer until n arrived; a frame may carry
+// several, separated by newlines
+func readEvents(t *testing.T, peer *websocket.Conn, n int) []Message {
+	t.Helper()
+
+	var events []Message
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(events) < n {
+		_, payload, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v after %d event(s), want %d", err, len(events), n)
+		}
+		for _, line := range bytes.Split(payload, newline) {
+			var msg Message
+			if err := json.Unmarshal(line, &msg); err != nil {
+				t.Fatalf("decode %q: %v", line, err)
+			}
+			events = append(events, msg)
+		}
+	}
+	return events
+}
+
+func TestEventsForOfflineUserAreDeliveredOnConnect(t *testing.T) {
+	testutil.Setup(t)
+	h := runHub(t)
+	user := testutil.CreateUser(t, "user")
+
+	PublishToUsers([]uint{user.ID}, "group_message", map[string]interface{}{"message_id": 1})
+	PublishToUser(user.ID, "private_message", map[string]interface{}{"message_id": 2})
+	PublishToUser(user.ID, "typing", map[string]interface{}{"user_id": 2})
+
+	server, peer := connect(t)
+	client := NewClient(h, server, user.ID, user.Username, false)
+	if err := h.RegisterClient(client); err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	go client.WritePump()
+	go client.ReadPump()
+
+	events := readEvents(t, peer, 2)
+	if events[0].Event != "group_message" || events[1].Event != "private_message" {
+		t.Fatalf("got %s, %s, want the queued group_message then private_message", events[0].Event, events[1].Event)
+	}
+
+	// Typing is ephemeral and was not queued; the queue is now empty
+	pending, err := redis.PopPendingEvents(user.ID)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("%d event(s) left in the queue, want none", len(pending))
+	}
+}
+
+// subscribe starts the client's Redis subscriber and waits until Redis
+// counts it
+func subscribe(t *testing.T, mr *miniredis.Miniredis, client *Client) {
+	t.Helper()
+
+	client.StartRedisSubscriber()
+	t.Cleanup(client.StopRedisSubscriber)
+
+	channel := fmt.Sprintf("ws:user:%d", client.UserID)
+	within(t, func() bool { return mr.PubSubNumSub(channel)[channel] > 0 })
+}
+
+// within fails the test if cond does not hold within two seconds
+func within(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := waitUntil(ctx, cond); err != nil {
+		t.Fatal("condition not met in time")
+	}
+}
+
+// Two hubs sharing one Redis stand in for two app instances
+func TestSendToUserReachesAnotherInstance(t *testing.T) {
+	mr := setupRedis(t)
+	local, remote := NewHub(nil, nil), NewHub(nil, nil)
+	remote.instanceID = "remote-instance"
+
+	client, _ := addClient(t, local, 1, 8)
+	subscribe(t, mr, client)
+
+	remote.SendToUser(1, "private_message", map[string]interface{}{"message_id": 1})
+	within(t, func() bool { return len(client.Send) == 1 })
+
+	// The local hub writes to its own connection and its subscriber skips
+	// the copy published for the other instances
+	local.SendToUser(1, "private_message", map[string]interface{}{"message_id": 2})
+	time.Sleep(100 * time.Millisecond)
+	if n := len(client.Send); n != 2 {
+		t.Fatalf("client got %d frame(s), want 2 with no duplicate", n)
+	}
+
+	pending, err := redis.PopPendingEvents(1)
+	if err != nil {
+		t.Fatalf("PopPendingEvents: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("queued %q for a connected user", pending)
+	}
+}
+
+func TestDisconnectUserOnAnotherInstance(t *testing.T) {
+	mr := setupRedis(t)
+	local, remote := NewHub(nil, nil), NewHub(nil, nil)
+	remote.instanceID = "remote-instance"
+
+	client, peer := addClient(t, local, 1, 8)
+	subscribe(t, mr, client)
+
+	remote.DisconnectUser(1, "banned")
+	if code, reason := closeCode(t, peer); code != websocket.ClosePolicyViolation || reason != "banned" {
+		t.Fatalf("closed with %d %q, want %d \"banned\"", code, reason, websocket.ClosePolicyViolation)
+	}
+}
+
+// nextFrame decodes the next event queued for the client
+func nextFrame(t *testing.T, client *Client) Message {
+	t.Helper()
+
+	select {
+	case frame := <-client.Send:
+		var msg Message
+		if err := json.Unmarshal(frame.Payload, &msg); err != nil {
+			t.Fatalf("decode %q: %v", frame.Payload, err)
+		}
+		return msg
+	default:
+		t.Fatalf("no frame queued for user %d", client.UserID)
+		return Message{}
+	}
+}
+
+func TestPrivateTypingReachesTheOtherUser(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	alice, _ := addClient(t, h, 1, 8)
+	bob, _ := addClient(t, h, 2, 8)
+
+	tests := []struct {
+		name             string
+		sender, receiver *Client
+	}{
+		{"alice to bob", alice, bob},
+		{"bob to alice", bob, alice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, isTyping := range []bool{true, false} {
+				h.handleTypingIndicator(BroadcastMessage{
+					Message: Message{Event: "typing", Data: map[string]interface{}{
+						"conversation_id": fmt.Sprintf("private:%d", tt.receiver.UserID),
+						"is_typing":       isTyping,
+					}},
+					SenderID: tt.sender.UserID,
+				})
+
+				msg := nextFrame(t, tt.receiver)
+				// The receiver sees the chat under the sender's ID
+				if msg.Event != "typing" || msg.Data["is_typing"] != isTyping ||
+					uint(msg.Data["user_id"].(float64)) != tt.sender.UserID ||
+					uint(msg.Data["chat_id"].(float64)) != tt.sender.UserID {
+					t.Fatalf("receiver got %+v, want typing=%v from user %d", msg, isTyping, tt.sender.UserID)
+				}
+				if n := len(tt.sender.Send); n != 0 {
+					t.Fatalf("sender got %d frame(s) of their own typing", n)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMessageBoundsContent(t *testing.T) {
+	send := func(content interface{}, msgType string) Message {
+		data := map[string]interface{}{"receiver_id": float64(2), "content": content}
+		if msgType != "" {
+			data["type"] = msgType
+		}
+		return Message{Event: "send_private_message", Data: data}
+	}
+
+	tests := []struct {
+		name   string
+		limit  int
+		msg    Message
+		wantOK bool
+	}{
+		{"text at the default limit", 0, send(strings.Repeat("a", models.DefaultMaxMessageLength), ""), true},
+		{"text over the default limit", 0, send(strings.Repeat("a", models.DefaultMaxMessageLength+1), ""), false},
+		{"text at a configured limit", 16, send(strings.Repeat("a", 16), "text"), true},
+		{"text over a configured limit", 16, send(strings.Repeat("a", 17), "text"), false},
+		{"empty content", 0, send("", ""), false},
+		{"whitespace only", 0, send(" \t\n ", ""), false},
+		{"content not a string", 0, send(42, ""), false},
+		{"known type", 0, send("look", string(models.MessageTypeFile)), true},
+		{"unknown type", 0, send("hello", "hologram"), false},
+		{"group message over the limit", 16, Message{Event: "send_group_message", Data: map[string]interface{}{
+			"group_id": float64(1), "content": strings.Repeat("a", 17),
+		}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &config.Configuration{Chat: config.ChatConfiguration{MaxMessageLength: tt.limit}})
+
+			err := validateMessage(tt.msg)
+			if tt.wantOK && err != nil {
+				t.Fatalf("validateMessage: %v", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Fatal("validateMessage accepted the message")
+			}
+		})
+	}
+}
+
+func TestInvalidMessageIsAnsweredWithAnError(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(nil, nil)
+	client, _ := addClient(t, h, 1, 8)
+
+	h.handleBroadcast(BroadcastMessage{
+		Message:  Message{Event: "send_private_message", Data: map[string]interface{}{"receiver_id": float64(2), "content": "   "}},
+		SenderID: client.UserID,
+		Client:   client,
+	})
+
+	msg := nextFrame(t, client)
+	if msg.Event != "error" || msg.Data["code"] != "invalid_message" || msg.Data["event"] != "send_private_message" || msg.Data["message"] == "" {
+		t.Fatalf("sender got %+v, want an invalid_message error for send_private_message", msg)
+	}
+}
+
+func TestDisconnectUserClosesEveryDevice(t *testing.T) {
+	testutil.Setup(t)
+	h := runHub(t)
+	connectAs := func(userID uint) (*Client, *websocket.Conn) {
+		t.Helper()
+		server, peer := connect(t)
+		client := NewClient(h, server, userID, "user", false)
+		if err := h.RegisterClient(client); err != nil {
+			t.Fatalf("RegisterClient: %v", err)
+		}
+		go client.WritePump()
+		go client.ReadPump()
+		return client, peer
+	}
+	_, phone := connectAs(1)
+	_, laptop := connectAs(1)
+	bystander, _ := connectAs(2)
+
+	h.DisconnectUser(1, "spamming")
+	for _, peer := range []*websocket.Conn{phone, laptop} {
+		if code, reason := closeCode(t, peer); code != websocket.ClosePolicyViolation || reason != "spamming" {
+			t.Fatalf("closed with %d %q, want %d \"spamming\"", code, reason, websocket.ClosePolicyViolation)
+		}
+	}
+
+	// The closed connections unregister; other users stay connected
+	within(t, func() bool { return len(h.getClients(1)) == 0 })
+	if clients := h.getClients(2); len(clients) != 1 || clients[0] != bystander {
+		t.Fatalf("user 2 has %d connection(s), want their one", len(clients))
+	}
+}
+
+func TestGroupTypingCarriesEveryTypist(t *testing.T) {
+	mr := testutil.Setup(t)
+	h := NewHub(nil, nil)
+	alice, bob, carol, dave := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob"), testutil.CreateUser(t, "carol"), testutil.CreateUser(t, "dave")
+	group := testutil.CreateGroup(t, alice, bob, carol, dave)
+	watcher, _ := addClient(t, h, bob.ID, 8)
+
+	// typing sends a typing event of the user and returns who the watcher
+	// is told is typing
+	typing := func(user *models.User, isTyping bool) []uint {
+		t.Helper()
+		h.handleTypingIndicator(BroadcastMessage{
+			Message: Message{Event: "typing", Data: map[string]interface{}{
+				"conversation_id": fmt.Sprintf("group:%d", group.ID),
+				"is_typing":       isTyping,
+			}},
+			SenderID: user.ID,
+		})
+
+		msg := nextFrame(t, watcher)
+		if msg.Event != "typing" || uint(msg.Data["user_id"].(float64)) != user.ID || msg.Data["is_typing"] != isTyping {
+			t.Fatalf("watcher got %+v, want typing=%v from user %d", msg, isTyping, user.ID)
+		}
+		ids, _ := msg.Data["typing_user_ids"].([]interface{})
+		typists := make([]uint, len(ids))
+		for i, id := range ids {
+			typists[i] = uint(id.(float64))
+		}
+		sort.Slice(typists, func(i, j int) bool { return typists[i] < typists[j] })
+		return typists
+	}
+	t.Cleanup(func() {
+		for _, user := range []*models.User{alice, carol, dave} {
+			h.stopTypingTimer(fmt.Sprintf("group:%d:%d", group.ID, user.ID))
+		}
+	})
+
+	for _, tt := range []struct {
+		user     *models.User
+		isTyping bool
+		want     []uint
+	}{
+		{alice, true, []uint{alice.ID}},
+		{carol, true, []uint{alice.ID, carol.ID}},
+		{dave, true, []uint{alice.ID, carol.ID, dave.ID}},
+		{alice, false, []uint{carol.ID, dave.ID}},
+	} {
+		if got := typing(tt.user, tt.isTyping); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("after user %d typing=%v the typists are %v, want %v", tt.user.ID, tt.isTyping, got, tt.want)
+		}
+	}
+
+	// Typists who went quiet drop out once their Redis key expires
+	mr.FastForward(6 * time.Second)
+	typing(carol, true)
+	mr.FastForward(5 * time.Second)
+	if got := typing(alice, true); !reflect.DeepEqual(got, []uint{alice.ID, carol.ID}) {
+		t.Fatalf("typists %v, want dave's indicator expired", got)
+	}
+}
@@ -0,0 +1,433 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"web-api/internal/pkg/config"
+	"web-api/internal/pkg/database"
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// presenceChannel carries online/offline changes to every instance,
+	// which forwards them to its local subscribers
+	presenceChannel = "ws:presence"
+
+	// maxPresenceSubscriptions bounds the users one connection can watch
+	maxPresenceSubscriptions = 500
+
+	// defaultIdleAwayAfter applies when no idle timeout is configured
+	defaultIdleAwayAfter = 5 * time.Minute
+
+	// idleCheckInterval is how often users are checked for inactivity
+	idleCheckInterval = 30 * time.Second
+)
+
+// userActivity tracks when a locally connected user last sent an event.
+// It is only touched by the hub's Run goroutine.
+type userActivity struct {
+	lastActive time.Time
+	idle       bool // Idle detection already looked at this user
+	autoAway   bool // Idle detection switched the user to away
+}
+
+// presenceSubscriptions tracks which local connections watch which users'
+// online status
+type presenceSubscriptions struct {
+	mu       sync.RWMutex
+	watchers map[uint]map[*Client]bool // watched user -> subscribed connections
+	watching map[*Client]map[uint]bool // connection -> watched users
+}
+
+// subscribe adds users to the connection's watch list
+func (p *presenceSubscriptions) subscribe(c *Client, userIDs []uint) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.watchers == nil {
+		p.watchers = make(map[uint]map[*Client]bool)
+		p.watching = make(map[*Client]map[uint]bool)
+	}
+
+	watched := p.watching[c]
+	added := 0
+	for _, userID := range userIDs {
+		if !watched[userID] {
+			added++
+		}
+	}
+	if len(watched)+added > maxPresenceSubscriptions {
+		return fmt.Errorf("a connection can watch at most %d users", maxPresenceSubscriptions)
+	}
+
+	if watched == nil {
+		watched = make(map[uint]bool, len(userIDs))
+		p.watching[c] = watched
+	}
+	for _, userID := range userIDs {
+		watched[userID] = true
+		if p.watchers[userID] == nil {
+			p.watchers[userID] = make(map[*Client]bool)
+		}
+		p.watchers[userID][c] = true
+	}
+
+	return nil
+}
+
+// unsubscribe removes users from the connection's watch list, or all of
+// them if userIDs is empty
+func (p *presenceSubscriptions) unsubscribe(c *Client, userIDs []uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	watched := p.watching[c]
+	if len(userIDs) == 0 {
+		for userID := range watched {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	for _, userID := range userIDs {
+		delete(watched, userID)
+		if conns := p.watchers[userID]; conns != nil {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(p.watchers, userID)
+			}
+		}
+	}
+	if len(watched) == 0 {
+		delete(p.watching, c)
+	}
+}
+
+// subscribers returns the local connections watching a user
+func (p *presenceSubscriptions) subscribers(userID uint) []*Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	conns := make([]*Client, 0, len(p.watchers[userID]))
+	for c := range p.watchers[userID] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// handleSubscribePresence starts pushing user_status events about the
+// listed users to the connection, and replies with their current status.
+// Users who are not the sender's contacts are left out.
+func (h *Hub) handleSubscribePresence(bm BroadcastMessage) {
+	if bm.Client == nil {
+		return
+	}
+
+	userIDs, err := h.watchableUsers(bm.SenderID, presenceUserIDs(bm.Message.Data["user_ids"]))
+	if err != nil {
+		logrus.Errorf("Failed to load contacts of user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "presence_unavailable", err)
+		return
+	}
+	if err := h.presence.subscribe(bm.Client, userIDs); err != nil {
+		h.replyError(bm, "invalid_message", err)
+		return
+	}
+
+	online, err := redis.OnlineStatuses(userIDs)
+	if err != nil {
+		logrus.Errorf("Failed to load presence snapshot for user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "presence_unavailable", err)
+		return
+	}
+	stored, err := redis.PresenceStatuses(userIDs)
+	if err != nil {
+		logrus.Errorf("Failed to load presence snapshot for user %d: %v", bm.SenderID, err)
+		h.replyError(bm, "presence_unavailable", err)
+		return
+	}
+
+	statuses := make([]map[string]interface{}, len(userIDs))
+	for i, userID := range userIDs {
+		statuses[i] = presenceData(userID, online[userID], storedStatus(stored[userID]))
+	}
+
+	bm.Client.SendMessage("presence_subscribed", map[string]interface{}{
+		"statuses": statuses,
+	})
+}
+
+// handleUnsubscribePresence stops status updates about the listed users,
+// or about everyone if no user_ids are given
+func (h *Hub) handleUnsubscribePresence(bm BroadcastMessage) {
+	if bm.Client == nil {
+		return
+	}
+
+	h.presence.unsubscribe(bm.Client, presenceUserIDs(bm.Message.Data["user_ids"]))
+}
+
+// handleSetStatus changes the sender's presence status
+func (h *Hub) handleSetStatus(bm BroadcastMessage) {
+	status, _ := bm.Message.Data["status"].(string)
+	if err := SetPresenceStatus(bm.SenderID, models.PresenceStatus(status)); err != nil {
+		h.replyError(bm, "invalid_message", err)
+	}
+}
+
+// SetPresenceStatus stores the status a user picked and, if they are
+// connected, tells the users watching them. Invisible users appear offline.
+func SetPresenceStatus(userID uint, status models.PresenceStatus) error {
+	if !status.IsSettable() {
+		return fmt.Errorf("status must be online, away, busy or invisible, got %q", status)
+	}
+
+	previous, _ := loadPresenceStatus(userID)
+	if err := redis.SetPresenceStatus(userID, string(status), false); err != nil {
+		return err
+	}
+
+	if previous.Visible() == status.Visible() {
+		return nil
+	}
+	if online, err := redis.IsUserOnline(userID); err != nil || !online {
+		return nil
+	}
+
+	publishPresence(presenceData(userID, true, status))
+	return nil
+}
+
+// loadPresenceStatus returns a user's stored status, online if none is
+// stored, and whether idle detection set it
+func loadPresenceStatus(userID uint) (models.PresenceStatus, bool) {
+	status, auto, err := redis.GetPresenceStatus(userID)
+	if err != nil {
+		logrus.Errorf("Failed to load status of user %d: %v", userID, err)
+	}
+	return storedStatus(status), auto
+}
+
+// storedStatus maps a status read from Redis to a presence status
+func storedStatus(status string) models.PresenceStatus {
+	if status == "" {
+		return models.PresenceOnline
+	}
+	return models.PresenceStatus(status)
+}
+
+// presenceData builds a user_status payload describing the user as others
+// see them
+func presenceData(userID uint, online bool, status models.PresenceStatus) map[string]interface{} {
+	visible := models.PresenceOffline
+	if online {
+		visible = status.Visible()
+	}
+
+	return map[string]interface{}{
+		"user_id":   userID,
+		"is_online": visible != models.PresenceOffline,
+		"status":    string(visible),
+	}
+}
+
+// markActive records activity from a locally connected user, bringing them
+// back from auto-away
+func (h *Hub) markActive(userID uint) {
+	a, ok := h.activity[userID]
+	if !ok {
+		return
+	}
+	a.lastActive = time.Now()
+	a.idle = false
+
+	if !a.autoAway {
+		return
+	}
+	a.autoAway = false
+
+	// The user may have picked another status since going idle
+	if status, auto := loadPresenceStatus(userID); status != models.PresenceAway || !auto {
+		return
+	}
+	if err := redis.SetPresenceStatus(userID, string(models.PresenceOnline), false); err != nil {
+		logrus.Errorf("Failed to bring user %d back from away: %v", userID, err)
+		return
+	}
+	publishPresence(presenceData(userID, true, models.PresenceOnline))
+}
+
+// checkIdle switches online users who have been inactive for a while to away
+func (h *Hub) checkIdle() {
+	idleAfter := idleAwayAfter()
+	now := time.Now()
+
+	for userID, a := range h.activity {
+		if a.idle || now.Sub(a.lastActive) < idleAfter {
+			continue
+		}
+		a.idle = true
+
+		// Busy, invisible and a chosen away are left alone
+		if status, _ := loadPresenceStatus(userID); status != models.PresenceOnline {
+			continue
+		}
+		if err := redis.SetPresenceStatus(userID, string(models.PresenceAway), true); err != nil {
+			logrus.Errorf("Failed to mark user %d away: %v", userID, err)
+			continue
+		}
+		a.autoAway = true
+		publishPresence(presenceData(userID, true, models.PresenceAway))
+	}
+}
+
+// idleAwayAfter returns the configured idle timeout, falling back to the
+// default
+func idleAwayAfter() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.WebSocket.IdleAwayAfter > 0 {
+		return cfg.WebSocket.IdleAwayAfter
+	}
+	return defaultIdleAwayAfter
+}
+
+// publishPresence announces a user's status change to all instances
+func publishPresence(data map[string]interface{}) {
+	if err := redis.BroadcastToChannel(presenceChannel, "user_status", data); err != nil {
+		logrus.Errorf("Failed to publish status of user %v: %v", data["user_id"], err)
+	}
+}
+
+// listenPresence forwards status changes published by any instance to the
+// local connections watching the user. It returns when the hub stops.
+func (h *Hub) listenPresence() {
+	pubsub := redis.Subscribe(presenceChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-h.done:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var event Message
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				logrus.Errorf("Failed to unmarshal presence event: %v", err)
+				continue
+			}
+
+			userID := numericID(event.Data["user_id"])
+			for _, client := range h.presence.subscribers(userID) {
+				client.SendMessage(event.Event, h.presenceFor(client.UserID, userID, event.Data))
+			}
+		}
+	}
+}
+
+// presenceFor strips the last seen time from a status event unless the
+// user's privacy setting lets viewerID see it
+func (h *Hub) presenceFor(viewerID, userID uint, data map[string]interface{}) map[string]interface{} {
+	visibility, ok := data["last_seen_visibility"].(string)
+	if !ok {
+		return data
+	}
+
+	filtered := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		filtered[k] = v
+	}
+	delete(filtered, "last_seen_visibility")
+
+	visible := true
+	switch visibility {
+	case models.LastSeenNobody:
+		visible = false
+	case models.LastSeenContacts:
+		visible = h.isContact != nil && h.isContact(context.Background(), userID, viewerID)
+	}
+	if !visible && viewerID != userID {
+		delete(filtered, "last_seen")
+	}
+
+	return filtered
+}
+
+// watchableUsers keeps the users whose presence viewerID may watch: their
+// contacts and themselves. Without a contact list everyone is watchable.
+func (h *Hub) watchableUsers(viewerID uint, userIDs []uint) ([]uint, error) {
+	if h.contactsOf == nil {
+		return userIDs, nil
+	}
+
+	contactIDs, err := h.contactsOf(context.Background(), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[uint]bool, len(contactIDs)+1)
+	contacts[viewerID] = true
+	for _, id := range contactIDs {
+		contacts[id] = true
+	}
+
+	watchable := make([]uint, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if contacts[userID] {
+			watchable = append(watchable, userID)
+		}
+	}
+	return watchable, nil
+}
+
+// UseContactCheck sets how the hub tells whether two users are contacts
+func (h *Hub) UseContactCheck(check ContactCheck) {
+	h.isContact = check
+}
+
+// UseContactList sets how the hub finds a user's contacts, whose presence
+// is all the user may watch
+func (h *Hub) UseContactList(list ContactList) {
+	h.contactsOf = list
+}
+
+// recordLastSeen stores when a user went offline and returns who may see it
+func recordLastSeen(userID uint, at time.Time) (string, error) {
+	db := database.GetDB()
+
+	if err := db.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"is_online": false, "last_seen": at}).Error; err != nil {
+		return models.LastSeenNobody, err
+	}
+
+	var user models.User
+	if err := db.Select("id", "last_seen_visibility").First(&user, userID).Error; err != nil {
+		return models.LastSeenNobody, err
+	}
+	return user.LastSeenVisibility, nil
+}
+
+// presenceUserIDs reads a user_ids list from event data, dropping invalid
+// entries and duplicates
+func presenceUserIDs(v interface{}) []uint {
+	raw, _ := v.([]interface{})
+
+	seen := make(map[uint]bool, len(raw))
+	userIDs := make([]uint, 0, len(raw))
+	for _, item := range raw {
+		userID := numericID(item)
+		if userID == 0 || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
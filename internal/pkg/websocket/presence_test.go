@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"web-api/internal/pkg/models"
+	"web-api/internal/pkg/redis"
+	"web-api/internal/pkg/testutil"
+)
+
+// listen runs the hub's presence listener until the test ends and waits
+// until Redis counts its subscription
+func listen(t *testing.T, mr *miniredis.Miniredis, h *Hub) {
+	t.Helper()
+
+	stopped := make(chan struct{})
+	go func() {
+		h.listenPresence()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		h.doneOnce.Do(func() { close(h.done) })
+		<-stopped
+	})
+
+	within(t, func() bool { return mr.PubSubNumSub(presenceChannel)[presenceChannel] > 0 })
+}
+
+// statusOf waits for the next user_status event queued for the client
+func statusOf(t *testing.T, client *Client) Message {
+	t.Helper()
+
+	within(t, func() bool { return len(client.Send) > 0 })
+	msg := nextFrame(t, client)
+	if msg.Event != "user_status" {
+		t.Fatalf("client got %+v, want user_status", msg)
+	}
+	return msg
+}
+
+func TestPresenceSubscription(t *testing.T) {
+	mr := setupRedis(t)
+	h := NewHub(nil, nil)
+	listen(t, mr, h)
+	// Users 2 and 3 are contacts of user 1; user 4 is a stranger
+	h.UseContactList(func(ctx context.Context, userID uint) ([]uint, error) {
+		return []uint{2, 3}, nil
+	})
+	watcher, _ := addClient(t, h, 1, 8)
+	if err := redis.SetUserOnline(2, h.instanceID); err != nil {
+		t.Fatalf("SetUserOnline: %v", err)
+	}
+
+	h.handleSubscribePresence(BroadcastMessage{
+		Message:  Message{Event: "subscribe_presence", Data: map[string]interface{}{"user_ids": []interface{}{float64(2), float64(3), float64(4)}}},
+		SenderID: watcher.UserID,
+		Client:   watcher,
+	})
+
+	snapshot := nextFrame(t, watcher)
+	statuses, _ := snapshot.Data["statuses"].([]interface{})
+	if snapshot.Event != "presence_subscribed" || len(statuses) != 2 {
+		t.Fatalf("watcher got %+v, want a snapshot of users 2 and 3", snapshot)
+	}
+	online := make(map[uint]bool)
+	for _, s := range statuses {
+		status := s.(map[string]interface{})
+		online[numericID(status["user_id"])] = status["is_online"].(bool)
+	}
+	if !online[2] || online[3] {
+		t.Fatalf("snapshot online %v, want user 2 online and 3 offline", online)
+	}
+
+	// Status changes of watched users are pushed
+	if err := SetPresenceStatus(2, models.PresenceInvisible); err != nil {
+		t.Fatalf("SetPresenceStatus: %v", err)
+	}
+	if msg := statusOf(t, watcher); numericID(msg.Data["user_id"]) != 2 || msg.Data["is_online"] != false {
+		t.Fatalf("watcher got %+v, want user 2 appearing offline", msg)
+	}
+
+	// Strangers are not watched, even when asked for
+	publishPresence(presenceData(4, true, models.PresenceOnline))
+
+	// Nor are unsubscribed users; user 3 still is, and arrives after them
+	h.handleUnsubscribePresence(BroadcastMessage{
+		Message: Message{Event: "unsubscribe_presence", Data: map[string]interface{}{"user_ids": []interface{}{float64(2)}}},
+		Client:  watcher,
+	})
+	if err := SetPresenceStatus(2, models.PresenceOnline); err != nil {
+		t.Fatalf("SetPresenceStatus: %v", err)
+	}
+	publishPresence(presenceData(3, true, models.PresenceBusy))
+
+	if msg := statusOf(t, watcher); numericID(msg.Data["user_id"]) != 3 || msg.Data["status"] != string(models.PresenceBusy) {
+		t.Fatalf("watcher got %+v, want only user 3 turning busy", msg)
+	}
+	if n := len(watcher.Send); n != 0 {
+		t.Fatalf("watcher has %d more frame(s)", n)
+	}
+}
+
+func TestPresenceHonoursLastSeenVisibility(t *testing.T) {
+	h := NewHub(nil, nil)
+	// User 2 is a contact of user 1; user 3 is not
+	h.UseContactCheck(func(ctx context.Context, userID, otherID uint) bool {
+		return userID == 1 && otherID == 2
+	})
+
+	tests := []struct {
+		visibility string
+		viewerID   uint
+		want       bool
+	}{
+		{models.LastSeenEveryone, 3, true},
+		{models.LastSeenContacts, 2, true},
+		{models.LastSeenContacts, 3, false},
+		{models.LastSeenNobody, 2, false},
+		{models.LastSeenNobody, 1, true},
+	}
+	for _, tt := range tests {
+		data := map[string]interface{}{
+			"user_id":              uint(1),
+			"is_online":            false,
+			"last_seen":            "2026-01-02T15:04:05Z",
+			"last_seen_visibility": tt.visibility,
+		}
+
+		got := h.presenceFor(tt.viewerID, 1, data)
+		if _, shown := got["last_seen"]; shown != tt.want {
+			t.Errorf("%s: user %d sees last_seen = %v, want %v", tt.visibility, tt.viewerID, shown, tt.want)
+		}
+		if _, leaked := got["last_seen_visibility"]; leaked {
+			t.Errorf("%s: the setting itself reached user %d", tt.visibility, tt.viewerID)
+		}
+		// Every watcher gets its own copy
+		if _, ok := data["last_seen"]; !ok {
+			t.Fatalf("%s: presenceFor changed the shared event", tt.visibility)
+		}
+	}
+}
+
+func TestOnlineUsersSpanInstances(t *testing.T) {
+	testutil.Setup(t)
+	h := NewHub(nil, nil)
+	alice, bob := testutil.CreateUser(t, "alice"), testutil.CreateUser(t, "bob")
+
+	server, _ := connect(t)
+	local := NewClient(h, server, alice.ID, alice.Username, false)
+	h.registerClient(local)
+
+	// Bob is connected to another instance only
+	if err := redis.SetUserOnline(bob.ID, "remote-instance"); err != nil {
+		t.Fatalf("SetUserOnline: %v", err)
+	}
+
+	online, err := h.GetOnlineUsers()
+	if err != nil {
+		t.Fatalf("GetOnlineUsers: %v", err)
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i] < online[j] })
+	if !reflect.DeepEqual(online, []uint{alice.ID, bob.ID}) {
+		t.Fatalf("online users %v, want the local and the remote user", online)
+	}
+
+	// Leaving this instance takes alice offline everywhere, and leaves bob
+	// be
+	h.unregisterClient(local)
+	if online, err := h.GetOnlineUsers(); err != nil || !reflect.DeepEqual(online, []uint{bob.ID}) {
+		t.Fatalf("GetOnlineUsers = %v, %v; want only the remote user", online, err)
+	}
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxResyncConversations bounds the conversations one resync event may ask
+// to replay
+const maxResyncConversations = 100
+
+// resyncConversations reads the conversation ID to last seen seq map of a
+// resync event, in a stable order
+func resyncConversations(data map[string]interface{}) (map[string]int64, []string, error) {
+	raw, ok := data["conversations"].(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("resync must have conversations")
+	}
+	if len(raw) > maxResyncConversations {
+		return nil, nil, errors.New("resync lists too many conversations")
+	}
+
+	seqs := make(map[string]int64, len(raw))
+	ids := make([]string, 0, len(raw))
+	for conversationID, v := range raw {
+		seq, ok := v.(float64)
+		if !ok || seq < 0 {
+			return nil, nil, errors.New("resync seqs must be non-negative numbers")
+		}
+		seqs[conversationID] = int64(seq)
+		ids = append(ids, conversationID)
+	}
+	sort.Strings(ids)
+
+	return seqs, ids, nil
+}
+
+// handleResync replays to a reconnected connection the messages it missed
+// in each listed conversation, one resynced event per conversation. Clients
+// ask again with the new last seq while has_more is set.
+func (h *Hub) handleResync(bm BroadcastMessage) {
+	if bm.Client == nil {
+		return
+	}
+
+	seqs, conversationIDs, err := resyncConversations(bm.Message.Data)
+	if err != nil {
+		h.replyError(bm, "invalid_message", err)
+		return
+	}
+
+	ctx, cancel := bm.Client.queryContext()
+	defer cancel()
+
+	for _, conversationID := range conversationIDs {
+		page, err := h.store.SyncConversation(ctx, bm.SenderID, conversationID, seqs[conversationID], 0)
+		if err != nil {
+			logrus.Warnf("Cannot resync %s for user %d: %v", conversationID, bm.SenderID, err)
+			bm.Client.SendMessage("error", map[string]interface{}{
+				"code":            "resync_failed",
+				"event":           bm.Message.Event,
+				"conversation_id": conversationID,
+				"message":         err.Error(),
+			})
+			continue
+		}
+
+		bm.Client.SendMessage("resynced", map[string]interface{}{
+			"chat_type":       page.ChatType,
+			"conversation_id": page.ConversationID,
+			"messages":        page.Messages,
+			"has_more":        page.HasMore,
+		})
+	}
+}
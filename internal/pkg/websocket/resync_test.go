@@ -0,0 +1,88 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"web-api/internal/pkg/models"
+)
+
+// syncStore replays group conversations up to a fixed last seq each
+type syncStore struct {
+	MessageStore
+	last map[string]int64
+}
+
+func (s *syncStore) SyncConversation(ctx context.Context, userID uint, conversationID string, sinceSeq int64, limit int) (*models.ConversationSync, error) {
+	last, ok := s.last[conversationID]
+	if !ok {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+	messages := []models.GroupMessage{}
+	for seq := sinceSeq + 1; seq <= last; seq++ {
+		messages = append(messages, models.GroupMessage{Seq: seq})
+	}
+	return &models.ConversationSync{ChatType: models.ChatTypeGroup, ConversationID: conversationID, Messages: messages}, nil
+}
+
+// resyncedSeqs returns the seqs of the messages of a resynced event
+func resyncedSeqs(msg Message) []int64 {
+	seqs := []int64{}
+	messages, _ := msg.Data["messages"].([]interface{})
+	for _, m := range messages {
+		seqs = append(seqs, int64(m.(map[string]interface{})["seq"].(float64)))
+	}
+	return seqs
+}
+
+func TestResyncReplaysEachGap(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(&syncStore{last: map[string]int64{"group:1": 5, "group:2": 3}}, nil)
+	client, _ := addClient(t, h, 1, 8)
+
+	h.handleBroadcast(BroadcastMessage{
+		Message: Message{Event: "resync", Data: map[string]interface{}{"conversations": map[string]interface{}{
+			"group:2": float64(3), // Already up to date
+			"group:9": float64(0), // Not found
+			"group:1": float64(2), // Missed 3 to 5
+		}}},
+		SenderID: client.UserID,
+		Client:   client,
+	})
+
+	// Answers come in conversation ID order
+	if msg := nextFrame(t, client); msg.Event != "resynced" || msg.Data["conversation_id"] != "group:1" ||
+		!reflect.DeepEqual(resyncedSeqs(msg), []int64{3, 4, 5}) {
+		t.Fatalf("first answer %+v, want seqs 3 to 5 of group:1", msg)
+	}
+	if msg := nextFrame(t, client); msg.Event != "resynced" || msg.Data["conversation_id"] != "group:2" ||
+		len(resyncedSeqs(msg)) != 0 || msg.Data["has_more"] != false {
+		t.Fatalf("second answer %+v, want no messages for group:2", msg)
+	}
+	if msg := nextFrame(t, client); msg.Event != "error" || msg.Data["code"] != "resync_failed" ||
+		msg.Data["conversation_id"] != "group:9" {
+		t.Fatalf("third answer %+v, want resync_failed for group:9", msg)
+	}
+	if n := len(client.Send); n != 0 {
+		t.Fatalf("%d more frame(s) queued, want one answer per conversation", n)
+	}
+}
+
+func TestResyncNeedsConversationSeqs(t *testing.T) {
+	setupRedis(t)
+	h := NewHub(&syncStore{}, nil)
+	client, _ := addClient(t, h, 1, 8)
+
+	for _, data := range []map[string]interface{}{
+		{},
+		{"conversations": map[string]interface{}{"group:1": float64(-1)}},
+		{"conversations": map[string]interface{}{"group:1": "5"}},
+	} {
+		h.handleBroadcast(BroadcastMessage{Message: Message{Event: "resync", Data: data}, SenderID: client.UserID, Client: client})
+		if msg := nextFrame(t, client); msg.Event != "error" || msg.Data["code"] != "invalid_message" {
+			t.Fatalf("resync with %v answered %+v, want an invalid_message error", data, msg)
+		}
+	}
+}